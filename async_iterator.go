@@ -0,0 +1,97 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3/y"
+)
+
+// IterateAsync iterates over the keys in the given options in a background goroutine, and sends
+// the items to the returned channel in order. Their values are fetched ahead of the consumer by a
+// pool of the given number of workers, so that slow processing of the items doesn't stall the
+// reads. Unlike the items returned by Iterator, the items sent are valid until the transaction is
+// discarded, and Item.Value blocks until the value of the item has been fetched.
+//
+// At most opt.PrefetchSize items are fetched ahead of the consumer. opt.PrefetchValues is ignored.
+// The channel is closed once the iteration is done, or ctx is canceled. It must be drained until
+// closed before the transaction is discarded.
+func (txn *Txn) IterateAsync(ctx context.Context, opt IteratorOptions, workers int) <-chan *Item {
+	if workers <= 0 {
+		workers = 1
+	}
+	ahead := opt.PrefetchSize
+	if ahead < 1 {
+		ahead = 1
+	}
+	opt.PrefetchValues = false
+	itr := txn.NewIterator(opt)
+
+	out := make(chan *Item, ahead)
+	jobs := make(chan *Item, ahead)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for item := range jobs {
+				item.prefetchValue()
+				item.wg.Done()
+			}
+		}()
+	}
+
+	go func() {
+		defer close(out)
+		defer itr.Close()
+		// The value log files must be kept around until all the values have been fetched.
+		defer wg.Wait()
+		defer close(jobs)
+
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			item := itr.Item().detach()
+			item.wg.Add(1)
+			jobs <- item
+			select {
+			case out <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// detach returns a copy of the item, which remains valid after the iterator moves on. The value
+// is not copied.
+func (item *Item) detach() *Item {
+	return &Item{
+		key:         y.SafeCopy(nil, item.key),
+		vptr:        y.SafeCopy(nil, item.vptr),
+		version:     item.version,
+		expiresAt:   item.expiresAt,
+		prefixLen:   item.prefixLen,
+		slice:       new(y.Slice),
+		txn:         item.txn,
+		meta:        item.meta,
+		userMeta:    item.userMeta,
+		userMetaExt: y.SafeCopy(nil, item.userMetaExt),
+		stats:       item.stats,
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterateAsync(t *testing.T) {
+	opt := getTestOptions("")
+	opt.ValueThreshold = 32
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		n := 1000
+		val := func(i int) []byte {
+			// Every other value is written to the value log.
+			return bytes.Repeat([]byte{byte(i)}, 1+(i%2)*64)
+		}
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				if err := txn.Set([]byte(fmt.Sprintf("key%04d", i)), val(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+		var items []*Item
+		for item := range txn.IterateAsync(context.Background(), DefaultIteratorOptions, 4) {
+			items = append(items, item)
+		}
+		require.Len(t, items, n)
+		// The items remain valid after the iteration.
+		for i, item := range items {
+			require.Equal(t, fmt.Sprintf("key%04d", i), string(item.Key()))
+			require.Equal(t, val(i), getItemValue(t, item))
+		}
+
+		// Stop the iteration midway.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var count int
+		for range txn.IterateAsync(ctx, DefaultIteratorOptions, 4) {
+			count++
+			if count == 10 {
+				cancel()
+			}
+		}
+		require.Less(t, count, n)
+	})
+}
@@ -0,0 +1,365 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+// AtomicBatch applies a set of writes, which may exceed the limits of a transaction, all-or-nothing.
+//
+// The writes are staged in hidden keys as they are added, where they aren't visible to any reader.
+// On Commit, they are all applied at a single commit timestamp: the transactions started before
+// don't see any of them, and the ones started afterwards wait until all of them are visible, just
+// like they wait for a regular commit to finish. A record of the commit is persisted before the
+// writes are applied, so that if the process crashes midway, the next Open completes them. The
+// writes of a batch that wasn't committed are discarded by Open.
+//
+// AtomicBatch is meant for bulk updates like schema migrations, where the readers are better off
+// waiting for the whole update than seeing a part of it. Like WriteBatch, it doesn't read
+// anything, so it can never encounter ErrConflict.
+type AtomicBatch struct {
+	sync.Mutex
+	db *DB
+	// id is the timestamp the writes are staged at.
+	id       uint64
+	finished bool
+	err      error
+
+	// conflictKeys holds the fingerprints of the keys written, if conflict detection is enabled.
+	conflictKeys map[uint64]struct{}
+
+	// entries are the internal writes yet to be sent to the write channel, and pending is the
+	// request of the ones sent last.
+	entries []*Entry
+	count   int64
+	size    int64
+	pending *request
+}
+
+// NewAtomicBatch creates a new AtomicBatch. Commit or Cancel must be called once done with it.
+func (db *DB) NewAtomicBatch() *AtomicBatch {
+	if db.opt.managedTxns {
+		panic("cannot use NewAtomicBatch in managed mode. Use NewWriteBatchAt instead")
+	}
+	ab := &AtomicBatch{db: db}
+	if db.opt.DetectConflicts {
+		ab.conflictKeys = make(map[uint64]struct{})
+	}
+	ab.id = db.orc.newBatchTs(nil)
+	db.orc.doneCommit(ab.id)
+	return ab
+}
+
+// prefix returns the prefix of the hidden keys of the batch. The key equal to it records the commit
+// timestamp of the batch once committed.
+func (ab *AtomicBatch) prefix() []byte {
+	return append(y.Copy(atomicBatchKey), y.U64ToBytes(ab.id)...)
+}
+
+// SetEntry stages the entry e to be written by the batch. Entries with streamed values and merge
+// entries are not supported.
+func (ab *AtomicBatch) SetEntry(e *Entry) error {
+	ab.Lock()
+	defer ab.Unlock()
+
+	switch {
+	case ab.finished:
+		return errors.Wrap(ErrInvalidRequest, "AtomicBatch has already been committed or canceled")
+	case ab.err != nil:
+		return ab.err
+	case len(e.Key) == 0:
+		return ErrEmptyKey
+	case bytes.HasPrefix(e.Key, badgerPrefix):
+		return ErrInvalidKey
+	case len(e.Key) > maxKeySize:
+		return exceedsSize("Key", maxKeySize, e.Key)
+	case len(e.UserMetaExt) > MaxUserMetaExtSize:
+		return errors.Wrapf(ErrInvalidRequest, "UserMetaExt of length %d exceeds the limit of %d",
+			len(e.UserMetaExt), MaxUserMetaExtSize)
+	case int64(len(e.Value)) > ab.db.opt.ValueLogFileSize:
+		return exceedsSize("Value", ab.db.opt.ValueLogFileSize, e.Value)
+	case ab.db.opt.InMemory && e.valueLen() > ab.db.valueThreshold():
+		return errors.Errorf("Value with size %d exceeded %d limit", e.valueLen(),
+			ab.db.valueThreshold())
+	case e.valueReader != nil || e.meta&bitMergeEntry > 0:
+		return errors.Wrap(ErrInvalidRequest, "AtomicBatch does not support streamed values "+
+			"and merge entries")
+	}
+	if err := ab.db.isBanned(e.Key); err != nil {
+		return err
+	}
+
+	if ab.conflictKeys != nil {
+		ab.conflictKeys[z.MemHash(e.Key)] = struct{}{}
+	}
+	// The expiry is kept in the value, so the hidden key itself doesn't expire.
+	val := make([]byte, 1+binary.MaxVarintLen64+len(e.Value))
+	val[0] = e.meta & (bitDelete | BitDiscardEarlierVersions)
+	sz := 1 + binary.PutUvarint(val[1:], e.ExpiresAt)
+	sz += copy(val[sz:], e.Value)
+	ab.err = ab.write(&Entry{
+		Key:         y.KeyWithTs(append(ab.prefix(), e.Key...), ab.id),
+		Value:       val[:sz],
+		UserMeta:    e.UserMeta,
+		UserMetaExt: e.UserMetaExt,
+	})
+	return ab.err
+}
+
+// Set is equivalent of SetEntry(NewEntry(k, v)).
+func (ab *AtomicBatch) Set(k, v []byte) error {
+	return ab.SetEntry(NewEntry(k, v))
+}
+
+// Delete stages the deletion of key k.
+func (ab *AtomicBatch) Delete(k []byte) error {
+	e := &Entry{Key: k, meta: bitDelete}
+	return ab.SetEntry(e)
+}
+
+// Commit applies all the writes of the batch atomically. It returns once they are all visible.
+//
+// New transactions, including read-only ones, are blocked while the writes are applied. If Commit
+// fails after the commit has been recorded, the writes are completed by the next Open.
+func (ab *AtomicBatch) Commit() error {
+	ab.Lock()
+	defer ab.Unlock()
+
+	if ab.finished {
+		return errors.Wrap(ErrInvalidRequest, "AtomicBatch has already been committed or canceled")
+	}
+	ab.finished = true
+	if ab.err == nil {
+		ab.err = ab.flush()
+	}
+	if ab.err != nil {
+		return ab.err
+	}
+
+	// The staged writes are read at a timestamp below the commit timestamp, so as not to wait for it.
+	txn := ab.db.NewTransaction(false)
+	defer txn.Discard()
+
+	orc := ab.db.orc
+	orc.writeChLock.Lock()
+	commitTs := orc.newBatchTs(ab.conflictKeys)
+	defer orc.doneCommit(commitTs)
+	err := ab.write(&Entry{
+		Key:   y.KeyWithTs(ab.prefix(), ab.id),
+		Value: y.U64ToBytes(commitTs),
+	})
+	if err == nil {
+		err = ab.flush()
+	}
+	orc.writeChLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return ab.rewrite(txn, commitTs, true)
+}
+
+// Cancel discards the writes staged by the batch, unless it has been committed already.
+func (ab *AtomicBatch) Cancel() error {
+	ab.Lock()
+	defer ab.Unlock()
+
+	if ab.finished {
+		return nil
+	}
+	ab.finished = true
+	if err := ab.flush(); err != nil {
+		return err
+	}
+	txn := ab.db.NewTransaction(false)
+	defer txn.Discard()
+	ts := ab.db.orc.newBatchTs(nil)
+	defer ab.db.orc.doneCommit(ts)
+	return ab.rewrite(txn, ts, false)
+}
+
+// rewrite deletes the hidden keys of the batch at ts, having applied the writes staged in them at
+// ts, if apply is true. The hidden keys are read via txn, whose read timestamp must be below ts.
+func (ab *AtomicBatch) rewrite(txn *Txn, ts uint64, apply bool) error {
+	prefix := ab.prefix()
+	iopt := DefaultIteratorOptions
+	iopt.Prefix = prefix
+	iopt.PrefetchValues = false
+	iopt.InternalAccess = true
+	itr := txn.NewIterator(iopt)
+	defer itr.Close()
+
+	var committed bool
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		key := item.KeyCopy(nil)
+		// The commit record is deleted last, so that a crash midway leaves the batch committed.
+		if len(key) == len(prefix) {
+			committed = true
+			continue
+		}
+		if apply {
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			expiresAt, sz := binary.Uvarint(val[1:])
+			if sz <= 0 {
+				return errors.Errorf("Invalid staged write of AtomicBatch for key %q",
+					key[len(prefix):])
+			}
+			// The write goes before the deletion of the hidden key, so that a crash can't leave
+			// the hidden key deleted without the write having been applied.
+			e := &Entry{
+				Key:         y.KeyWithTs(key[len(prefix):], ts),
+				Value:       val[1+sz:],
+				UserMeta:    item.UserMeta(),
+				UserMetaExt: y.SafeCopy(nil, item.UserMetaExt()),
+				ExpiresAt:   expiresAt,
+				meta:        val[0],
+			}
+			if err := ab.write(e); err != nil {
+				return err
+			}
+		}
+		if err := ab.write(&Entry{Key: y.KeyWithTs(key, ts), meta: bitDelete}); err != nil {
+			return err
+		}
+	}
+	if err := ab.flush(); err != nil || !committed {
+		return err
+	}
+	if err := ab.write(&Entry{Key: y.KeyWithTs(prefix, ts), meta: bitDelete}); err != nil {
+		return err
+	}
+	return ab.flush()
+}
+
+// write adds e to the internal writes, sending the ones added before if it doesn't fit along.
+func (ab *AtomicBatch) write(e *Entry) error {
+	sz := e.estimateSizeAndSetThreshold(ab.db.valueThreshold())
+	if ab.count+1 >= ab.db.opt.maxBatchCount || ab.size+sz >= ab.db.opt.maxBatchSize {
+		if err := ab.send(); err != nil {
+			return err
+		}
+	}
+	ab.entries = append(ab.entries, e)
+	ab.count++
+	ab.size += sz
+	return nil
+}
+
+// send sends the internal writes to the write channel, once the ones sent before are done.
+func (ab *AtomicBatch) send() error {
+	if len(ab.entries) == 0 {
+		return nil
+	}
+	if err := ab.wait(); err != nil {
+		return err
+	}
+	req, err := ab.db.sendToWriteCh(ab.entries)
+	if err != nil {
+		return err
+	}
+	ab.pending = req
+	ab.entries, ab.count, ab.size = nil, 0, 0
+	return nil
+}
+
+func (ab *AtomicBatch) wait() error {
+	if ab.pending == nil {
+		return nil
+	}
+	err := ab.pending.Wait()
+	ab.pending = nil
+	return err
+}
+
+// flush sends all the internal writes, and waits for them to be done.
+func (ab *AtomicBatch) flush() error {
+	if err := ab.send(); err != nil {
+		return err
+	}
+	return ab.wait()
+}
+
+// recoverAtomicBatches completes the writes of the AtomicBatches committed before the DB was
+// closed, and discards the ones of the batches that weren't.
+func (db *DB) recoverAtomicBatches() error {
+	if db.opt.ReadOnly || db.opt.managedTxns {
+		return nil
+	}
+	commits := make(map[uint64]uint64)
+	var ids []uint64
+	err := db.View(func(txn *Txn) error {
+		iopts := DefaultIteratorOptions
+		iopts.Prefix = atomicBatchKey
+		iopts.PrefetchValues = false
+		iopts.InternalAccess = true
+		itr := txn.NewIterator(iopts)
+		defer itr.Close()
+		for itr.Rewind(); itr.Valid(); {
+			key := itr.Item().Key()
+			if len(key) < len(atomicBatchKey)+8 {
+				itr.Next()
+				continue
+			}
+			id := y.BytesToU64(key[len(atomicBatchKey):])
+			ids = append(ids, id)
+			// The commit record sorts before the staged writes of the batch.
+			if len(key) == len(atomicBatchKey)+8 {
+				val, err := itr.Item().ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				commits[id] = y.BytesToU64(val)
+			}
+			itr.Seek(append(y.Copy(atomicBatchKey), y.U64ToBytes(id+1)...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		ab := &AtomicBatch{db: db, id: id, finished: true}
+		commitTs, committed := commits[id]
+		if committed {
+			db.opt.Infof("Completing the writes of AtomicBatch %d at %d", id, commitTs)
+			db.orc.advanceTs(commitTs)
+		} else {
+			commitTs = db.orc.newBatchTs(nil)
+			db.orc.doneCommit(commitTs)
+		}
+		// Some of the writes may have been applied already, but the staged ones are still visible
+		// below the commit timestamp.
+		txn := db.newReadTxnAt(commitTs - 1)
+		err := ab.rewrite(txn, commitTs, committed)
+		txn.Discard()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func atomicBatchTestKey(i int) []byte {
+	return []byte(fmt.Sprintf("key%06d", i))
+}
+
+// countKeys returns the number of the user keys and of the hidden keys of AtomicBatches.
+func countKeys(t *testing.T, db *DB) (int, int) {
+	var user, hidden int
+	require.NoError(t, db.View(func(txn *Txn) error {
+		opt := DefaultIteratorOptions
+		opt.InternalAccess = true
+		itr := txn.NewIterator(opt)
+		defer itr.Close()
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			switch key := itr.Item().Key(); {
+			case bytes.HasPrefix(key, atomicBatchKey):
+				hidden++
+			case key[0] != '!':
+				user++
+			}
+		}
+		return nil
+	}))
+	return user, hidden
+}
+
+func TestAtomicBatch(t *testing.T) {
+	opt := getTestOptions("")
+	opt.MemTableSize = 1 << 20
+	opt.ValueThreshold = 1 << 10
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		n := int(db.opt.maxBatchCount) * 3
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set(atomicBatchTestKey(0), []byte("old"))
+		}))
+
+		ab := db.NewAtomicBatch()
+		for i := 0; i < n; i++ {
+			require.NoError(t, ab.Set(atomicBatchTestKey(i), []byte(fmt.Sprintf("val%d", i))))
+		}
+		require.NoError(t, ab.Delete(atomicBatchTestKey(n-1)))
+		require.Equal(t, ErrInvalidKey, ab.Set([]byte("!badger!foo"), nil))
+
+		// Nothing is visible before the commit, including to the txns started before it. The
+		// writes still buffered by the batch are staged first, to count all of them.
+		require.NoError(t, ab.flush())
+		before := db.NewTransaction(false)
+		defer before.Discard()
+		user, hidden := countKeys(t, db)
+		require.Equal(t, 1, user)
+		require.Equal(t, n, hidden)
+
+		require.NoError(t, ab.Commit())
+		require.Equal(t, ErrInvalidRequest, errors.Cause(ab.Commit()))
+
+		item, err := before.Get(atomicBatchTestKey(0))
+		require.NoError(t, err)
+		require.Equal(t, []byte("old"), getItemValue(t, item))
+		_, err = before.Get(atomicBatchTestKey(1))
+		require.Equal(t, ErrKeyNotFound, err)
+
+		user, hidden = countKeys(t, db)
+		require.Equal(t, n-1, user)
+		require.Zero(t, hidden)
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get(atomicBatchTestKey(0))
+			require.NoError(t, err)
+			require.Equal(t, []byte("val0"), getItemValue(t, item))
+			_, err = txn.Get(atomicBatchTestKey(n - 1))
+			require.Equal(t, ErrKeyNotFound, err)
+			return nil
+		}))
+
+		// The writes of a canceled batch are discarded.
+		ab = db.NewAtomicBatch()
+		require.NoError(t, ab.Set([]byte("canceled"), []byte("val")))
+		require.NoError(t, ab.Cancel())
+		user, hidden = countKeys(t, db)
+		require.Equal(t, n-1, user)
+		require.Zero(t, hidden)
+	})
+}
+
+func TestAtomicBatchConflict(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		_, err := txn.Get([]byte("key"))
+		require.Equal(t, ErrKeyNotFound, err)
+		require.NoError(t, txn.Set([]byte("other"), []byte("val")))
+
+		ab := db.NewAtomicBatch()
+		require.NoError(t, ab.Set([]byte("key"), []byte("val")))
+		require.NoError(t, ab.Commit())
+		require.Equal(t, ErrConflict, txn.Commit())
+	})
+}
+
+func TestAtomicBatchRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	// Stage the writes of a batch and record its commit, as if the process crashed before
+	// applying them.
+	committed := db.NewAtomicBatch()
+	require.NoError(t, committed.Set([]byte("committed"), []byte("val")))
+	require.NoError(t, committed.flush())
+	commitTs := db.orc.newBatchTs(nil)
+	require.NoError(t, committed.write(&Entry{
+		Key:   y.KeyWithTs(committed.prefix(), committed.id),
+		Value: y.U64ToBytes(commitTs),
+	}))
+	require.NoError(t, committed.flush())
+	db.orc.doneCommit(commitTs)
+
+	uncommitted := db.NewAtomicBatch()
+	require.NoError(t, uncommitted.Set([]byte("uncommitted"), []byte("val")))
+	require.NoError(t, uncommitted.flush())
+
+	user, hidden := countKeys(t, db)
+	require.Zero(t, user)
+	require.Equal(t, 3, hidden)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+	user, hidden = countKeys(t, db)
+	require.Equal(t, 1, user)
+	require.Zero(t, hidden)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("committed"))
+		require.NoError(t, err)
+		require.Equal(t, commitTs, item.Version())
+		return nil
+	}))
+}
+
+func TestAtomicBatchRecoveryPartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	ab := db.NewAtomicBatch()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, ab.Set(atomicBatchTestKey(i), []byte("val")))
+	}
+	require.NoError(t, ab.flush())
+	commitTs := db.orc.newBatchTs(nil)
+	require.NoError(t, ab.write(&Entry{
+		Key:   y.KeyWithTs(ab.prefix(), ab.id),
+		Value: y.U64ToBytes(commitTs),
+	}))
+	require.NoError(t, ab.flush())
+
+	// Apply the first staged write only, as if the process crashed after the first request sent
+	// by rewrite was persisted.
+	require.NoError(t, ab.write(&Entry{
+		Key:   y.KeyWithTs(atomicBatchTestKey(0), commitTs),
+		Value: []byte("val"),
+	}))
+	require.NoError(t, ab.write(&Entry{
+		Key:  y.KeyWithTs(append(ab.prefix(), atomicBatchTestKey(0)...), commitTs),
+		meta: bitDelete,
+	}))
+	require.NoError(t, ab.flush())
+	db.orc.doneCommit(commitTs)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+	user, hidden := countKeys(t, db)
+	require.Equal(t, 3, user)
+	require.Zero(t, hidden)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 3; i++ {
+			item, err := txn.Get(atomicBatchTestKey(i))
+			require.NoError(t, err)
+			require.Equal(t, commitTs, item.Version())
+		}
+		return nil
+	}))
+}
@@ -17,12 +17,14 @@
 package badger
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/binary"
 	"io"
+	"math"
+	"sync"
 
+	"github.com/dgraph-io/badger/v3/options"
 	"github.com/dgraph-io/badger/v3/pb"
 	"github.com/dgraph-io/badger/v3/y"
 	"github.com/dgraph-io/ristretto/z"
@@ -47,10 +49,109 @@ const flushThreshold = 100 << 20
 // used to generate the backup, or if you wish to backup only a certain range
 // of keys, use Stream.Backup directly.
 func (db *DB) Backup(w io.Writer, since uint64) (uint64, error) {
+	return db.BackupWithOptions(w, since, BackupOptions{})
+}
+
+// BackupOptions restricts the entries dumped by DB.BackupWithOptions.
+type BackupOptions struct {
+	// Prefixes restricts the backup to the keys with any of the given prefixes. If empty, the keys
+	// aren't restricted by prefix.
+	Prefixes [][]byte
+	// ChooseKey is invoked with the latest version of each key, and the key is backed up only if
+	// it returns true. ChooseKey can be left nil to select all keys. Calls to ChooseKey are
+	// concurrent.
+	ChooseKey func(item *Item) bool
+	// SkipExpired excludes the expired entries from the backup.
+	SkipExpired bool
+	// MaxBytesPerSec and MaxOpsPerSec, if positive, throttle the reads of the backup. See
+	// Stream.MaxBytesPerSec.
+	MaxBytesPerSec int64
+	MaxOpsPerSec   int64
+
+	// Compression compresses the backup. Only options.None and options.ZSTD are supported. ZSTD
+	// uses Options.ZSTDCompressionLevel.
+	Compression options.CompressionType
+	// EncryptionKey encrypts the backup with AES. It must be 16, 24 or 32 bytes long. If empty,
+	// the backup isn't encrypted, even if the DB is, unless EncryptWithDBKey is set.
+	EncryptionKey []byte
+	// EncryptWithDBKey encrypts the backup with Options.EncryptionKey if EncryptionKey is empty.
+	// The DB must be encrypted.
+	EncryptWithDBKey bool
+	// Checksum adds a CRC to each list of entries of the backup, which DB.VerifyBackup and
+	// DB.Load validate. Compressed and encrypted backups always have them.
+	Checksum bool
+	// Index writes the backup in the version 2 format, which ends with an index of the key
+	// ranges of its chunks, so that LoadOptions.Prefixes only reads the chunks it needs. Older
+	// versions of Badger can't load these backups.
+	Index bool
+	// NewChain makes DB.BackupToCatalog write a full backup starting a new chain, instead of an
+	// incremental backup. It's ignored by the other backup methods.
+	NewChain bool
+}
+
+// BackupWithOptions works like DB.Backup, but only dumps the entries selected by opt. This can be
+// used, for example, to take a logical backup of the keys of a single tenant.
+func (db *DB) BackupWithOptions(w io.Writer, since uint64, opt BackupOptions) (uint64, error) {
 	stream := db.NewStream()
+	for _, prefix := range opt.Prefixes {
+		stream.Ranges = append(stream.Ranges, PrefixStreamRange(prefix))
+	}
+	return db.backupStream(stream, w, since, opt)
+}
+
+// backupStream writes the backup selected by opt and stream.Ranges to w.
+func (db *DB) backupStream(stream *Stream, w io.Writer, since uint64,
+	opt BackupOptions) (uint64, error) {
+
 	stream.LogPrefix = "DB.Backup"
 	stream.SinceTs = since
-	return stream.Backup(w, since)
+	stream.Prefix = commonPrefix(opt.Prefixes)
+	stream.MaxBytesPerSec = opt.MaxBytesPerSec
+	stream.MaxOpsPerSec = opt.MaxOpsPerSec
+	stream.ChooseKey = opt.ChooseKey
+
+	key := opt.EncryptionKey
+	if len(key) == 0 && opt.EncryptWithDBKey {
+		if len(db.opt.EncryptionKey) == 0 {
+			return 0, errors.Wrapf(ErrInvalidRequest, "EncryptWithDBKey is set, but the DB "+
+				"isn't encrypted")
+		}
+		key = db.opt.EncryptionKey
+	}
+	bw, err := newBackupWriter(w, opt.Compression, db.opt.ZSTDCompressionLevel, key,
+		opt.Checksum, opt.Index)
+	if err != nil {
+		return 0, err
+	}
+	var out io.Writer = bw
+	if !bw.hasHeader {
+		// Write a plain backup, like Stream.Backup does.
+		out = w
+	}
+	maxVersion, err := stream.backup(out, since, opt.SkipExpired)
+	if err != nil {
+		return 0, err
+	}
+	if err := bw.Close(); err != nil {
+		return 0, err
+	}
+	return maxVersion, nil
+}
+
+// commonPrefix returns the longest common prefix of the given prefixes.
+func commonPrefix(prefixes [][]byte) []byte {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	common := prefixes[0]
+	for _, prefix := range prefixes[1:] {
+		i := 0
+		for i < len(common) && i < len(prefix) && common[i] == prefix[i] {
+			i++
+		}
+		common = common[:i]
+	}
+	return common
 }
 
 // Backup dumps a protobuf-encoded list of all entries in the database into the
@@ -62,6 +163,10 @@ func (db *DB) Backup(w io.Writer, since uint64) (uint64, error) {
 //
 // This can be used to backup the data in a database at a given point in time.
 func (stream *Stream) Backup(w io.Writer, since uint64) (uint64, error) {
+	return stream.backup(w, since, false)
+}
+
+func (stream *Stream) backup(w io.Writer, since uint64, skipExpired bool) (uint64, error) {
 	stream.KeyToList = func(key []byte, itr *Iterator) (*pb.KVList, error) {
 		list := &pb.KVList{}
 		a := itr.Alloc
@@ -75,6 +180,11 @@ func (stream *Stream) Backup(w io.Writer, since uint64) (uint64, error) {
 					item.Version(), since)
 			}
 
+			if skipExpired && item.meta&bitDelete == 0 && item.IsDeletedOrExpired() {
+				// The item has expired. The older versions are hidden by it, so skip them too.
+				return list, nil
+			}
+
 			var valCopy []byte
 			if !item.IsDeletedOrExpired() {
 				// No need to copy value, if item is deleted or expired.
@@ -91,12 +201,13 @@ func (stream *Stream) Backup(w io.Writer, since uint64) (uint64, error) {
 			}
 
 			// clear txn bits
-			meta := item.meta &^ (bitTxn | bitFinTxn)
+			// The value has been decrypted if it was encrypted with the key of its tenant.
+			meta := item.meta &^ (bitTxn | bitFinTxn | bitTenantKey)
 			kv := y.NewKV(a)
 			*kv = pb.KV{
 				Key:       a.Copy(item.Key()),
 				Value:     valCopy,
-				UserMeta:  a.Copy([]byte{item.UserMeta()}),
+				UserMeta:  a.Copy(joinUserMeta(item.UserMeta(), item.UserMetaExt())),
 				Version:   item.Version(),
 				ExpiresAt: item.ExpiresAt(),
 				Meta:      a.Copy([]byte{meta}),
@@ -138,6 +249,9 @@ func (stream *Stream) Backup(w io.Writer, since uint64) (uint64, error) {
 			}
 		}
 		list.Kv = out
+		if bw, ok := w.(*backupWriter); ok {
+			return bw.writeList(list)
+		}
 		return writeTo(list, w)
 	}
 
@@ -166,6 +280,22 @@ type KVLoader struct {
 	entries     []*Entry
 	entriesSize int64
 	totalSize   int64
+
+	// The fields below track the progress of DB.LoadWithContext.
+	progress func(LoadProgress)
+	lists    int
+	batchSz  int64
+	mu       sync.Mutex
+	pending  []*loaderBatch
+	done     LoadProgress
+}
+
+// loaderBatch is a batch sent by a KVLoader, which holds the entries of the lists before lists.
+type loaderBatch struct {
+	lists   int
+	entries int64
+	bytes   int64
+	done    bool
 }
 
 // NewKVLoader returns a new instance of KVLoader.
@@ -179,19 +309,22 @@ func (db *DB) NewKVLoader(maxPendingWrites int) *KVLoader {
 
 // Set writes the key-value pair to the database.
 func (l *KVLoader) Set(kv *pb.KV) error {
-	var userMeta, meta byte
-	if len(kv.UserMeta) > 0 {
-		userMeta = kv.UserMeta[0]
+	var meta byte
+	userMeta, userMetaExt := splitUserMeta(kv.UserMeta)
+	if len(userMetaExt) > MaxUserMetaExtSize {
+		return errors.Wrapf(ErrInvalidRequest, "UserMetaExt of length %d exceeds the limit of %d",
+			len(userMetaExt), MaxUserMetaExtSize)
 	}
 	if len(kv.Meta) > 0 {
 		meta = kv.Meta[0]
 	}
 	e := &Entry{
-		Key:       y.KeyWithTs(kv.Key, kv.Version),
-		Value:     kv.Value,
-		UserMeta:  userMeta,
-		ExpiresAt: kv.ExpiresAt,
-		meta:      meta,
+		Key:         y.KeyWithTs(kv.Key, kv.Version),
+		Value:       kv.Value,
+		UserMeta:    userMeta,
+		UserMetaExt: userMetaExt,
+		ExpiresAt:   kv.ExpiresAt,
+		meta:        meta,
 	}
 	estimatedSize := e.estimateSizeAndSetThreshold(l.db.valueThreshold())
 	// Flush entries if inserting the next entry would overflow the transactional limits.
@@ -205,6 +338,7 @@ func (l *KVLoader) Set(kv *pb.KV) error {
 	l.entries = append(l.entries, e)
 	l.entriesSize += estimatedSize
 	l.totalSize += estimatedSize + int64(len(e.Value))
+	l.batchSz += int64(len(kv.Key) + len(kv.Value))
 	return nil
 }
 
@@ -212,7 +346,16 @@ func (l *KVLoader) send() error {
 	if err := l.throttle.Do(); err != nil {
 		return err
 	}
+	b := &loaderBatch{lists: l.lists, entries: int64(len(l.entries)), bytes: l.batchSz}
+	if l.progress != nil {
+		l.mu.Lock()
+		l.pending = append(l.pending, b)
+		l.mu.Unlock()
+	}
 	if err := l.db.batchSetAsync(l.entries, func(err error) {
+		if err == nil && l.progress != nil {
+			l.batchDone(b)
+		}
 		l.throttle.Done(err)
 	}); err != nil {
 		return err
@@ -221,9 +364,30 @@ func (l *KVLoader) send() error {
 	l.entries = make([]*Entry, 0, l.db.opt.maxBatchCount)
 	l.entriesSize = 0
 	l.totalSize = 0
+	l.batchSz = 0
 	return nil
 }
 
+// batchDone reports the progress once b and the batches sent before it are written. The batches
+// are written concurrently, and may finish in any order.
+func (l *KVLoader) batchDone(b *loaderBatch) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b.done = true
+	var advanced bool
+	for len(l.pending) > 0 && l.pending[0].done {
+		first := l.pending[0]
+		l.done.Lists = first.lists
+		l.done.Entries += first.entries
+		l.done.Bytes += first.bytes
+		l.pending = l.pending[1:]
+		advanced = true
+	}
+	if advanced {
+		l.progress(l.done)
+	}
+}
+
 // Finish is meant to be called after all the key-value pairs have been loaded.
 func (l *KVLoader) Finish() error {
 	if len(l.entries) > 0 {
@@ -242,48 +406,296 @@ func (l *KVLoader) Finish() error {
 // DB.Load() should be called on a database that is not running any other
 // concurrent transactions while it is running.
 func (db *DB) Load(r io.Reader, maxPendingWrites int) error {
-	br := bufio.NewReaderSize(r, 16<<10)
-	unmarshalBuf := make([]byte, 1<<10)
+	return db.LoadWithOptions(r, maxPendingWrites, LoadOptions{})
+}
+
+// LoadOptions configures DB.LoadWithOptions.
+type LoadOptions struct {
+	// EncryptionKey decrypts an encrypted backup. If empty, Options.EncryptionKey is used.
+	EncryptionKey []byte
+	// UntilTs, if non-zero, restricts the load to the versions at or below UntilTs, restoring the
+	// DB as it was at that timestamp. Versions discarded before the backup, e.g. by a later entry
+	// with WithDiscard, can't be restored.
+	UntilTs uint64
+	// Prefixes, if not empty, restricts the load to the keys with any of the given prefixes. If
+	// the backup has an index (see BackupOptions.Index) and the reader is an io.ReadSeeker, like
+	// an os.File, only the chunks that may contain such keys are read.
+	Prefixes [][]byte
+
+	// Progress, if set, is called by DB.LoadWithContext as the entries are written to the DB.
+	// The calls don't overlap.
+	Progress func(LoadProgress)
+	// SkipLists skips the given number of lists of entries at the start of the backup. It's used
+	// to resume an interrupted load, by passing the last LoadProgress.Lists reported, along with
+	// the same options. Entries are written with the versions they have in the backup, so the
+	// entries that are loaded again are the same as before.
+	SkipLists int
+
+	// Conflicts decides what to do with the keys of the backup which are already in the DB. It
+	// allows loading a backup into a DB that's in use, e.g. to import the data of another device.
+	Conflicts LoadConflictPolicy
+	// Merge computes the value of a key which is both in the DB and in the backup, from the value
+	// in the DB and the latest one in the backup, with the LoadMerge policy.
+	Merge MergeFunc
+}
+
+// LoadConflictPolicy decides what a load does with the keys that are already in the DB.
+type LoadConflictPolicy int
+
+const (
+	// LoadKeepVersions writes all the versions of the backup with their versions, as if the DB was
+	// empty. The latest version of each key wins, and a version of the backup replaces the same
+	// version in the DB. It's the default.
+	LoadKeepVersions LoadConflictPolicy = iota
+	// LoadSkipExisting skips the keys which have a live value in the DB.
+	LoadSkipExisting
+	// LoadKeepNewest only writes the versions of the backup above the latest version of the key in
+	// the DB, so that the DB keeps its own versions.
+	LoadKeepNewest
+	// LoadOverwrite makes the latest version of each key of the backup the latest one in the DB.
+	// If the DB has a newer version, the older versions of the backup are dropped, and the latest
+	// one is written above the version of the DB.
+	LoadOverwrite
+	// LoadMerge works like LoadOverwrite, but the value written for a key which has a live value
+	// in the DB is computed by LoadOptions.Merge.
+	LoadMerge
+)
+
+// LoadProgress is the progress of a load, see LoadOptions.Progress.
+type LoadProgress struct {
+	// Lists is the number of lists of entries of the backup that are fully written to the DB.
+	Lists int
+	// Entries and Bytes are the number and the size of the keys and values of the entries written
+	// to the DB.
+	Entries int64
+	Bytes   int64
+}
+
+// LoadWithOptions works like DB.Load. Compressed backups are decompressed, and encrypted backups
+// are decrypted with opt.EncryptionKey. ErrEncryptionKeyMismatch is returned if the key isn't the
+// one the backup was encrypted with.
+func (db *DB) LoadWithOptions(r io.Reader, maxPendingWrites int, opt LoadOptions) error {
+	return db.LoadWithContext(context.Background(), r, maxPendingWrites, opt)
+}
+
+// LoadWithContext works like DB.LoadWithOptions, but stops once ctx is done. The writes already
+// sent are waited for, so that the last progress reported can be used to resume the load, and the
+// error of ctx is returned.
+func (db *DB) LoadWithContext(ctx context.Context, r io.Reader, maxPendingWrites int,
+	opt LoadOptions) error {
+
+	key := opt.EncryptionKey
+	if len(key) == 0 {
+		key = db.opt.EncryptionKey
+	}
+	var start int64
+	rs, seekable := r.(io.ReadSeeker)
+	if seekable {
+		var err error
+		if start, err = rs.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+	br, err := newBackupReader(r, key)
+	if err != nil {
+		return err
+	}
+	defer br.Close()
+	if seekable && len(opt.Prefixes) > 0 && br.version == backupVersionV2 {
+		if err := br.seekPrefixes(rs, start, opt.Prefixes); err != nil {
+			return err
+		}
+	}
+
+	if opt.Conflicts == LoadMerge && opt.Merge == nil {
+		return errors.Wrapf(ErrInvalidRequest, "LoadMerge requires a merge function")
+	}
+	// The keys are looked up at the latest version. The keys of the backup are only written after
+	// they're looked up, and only once, so the lookups never see the load's own writes.
+	txn := db.newReadTxnAt(math.MaxUint64)
+	defer txn.Discard()
 
 	ldr := db.NewKVLoader(maxPendingWrites)
-	for {
-		var sz uint64
-		err := binary.Read(br, binary.LittleEndian, &sz)
+	ldr.progress = opt.Progress
+	ldr.lists, ldr.done.Lists = opt.SkipLists, opt.SkipLists
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			if err := ldr.throttle.Finish(); err != nil {
+				return err
+			}
+			return ctx.Err()
+		default:
+		}
+		list, err := br.next()
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return err
 		}
 
-		if cap(unmarshalBuf) < int(sz) {
-			unmarshalBuf = make([]byte, sz)
+		kvs := filterUntilTs(list.Kv, opt.UntilTs)
+		if len(opt.Prefixes) > 0 {
+			filtered := kvs[:0]
+			for _, kv := range kvs {
+				if hasAnyPrefixes(kv.Key, opt.Prefixes) {
+					filtered = append(filtered, kv)
+				}
+			}
+			kvs = filtered
 		}
-
-		if _, err = io.ReadFull(br, unmarshalBuf[:sz]); err != nil {
-			return err
+		var overwrites []*pb.KV
+		if i >= opt.SkipLists && opt.Conflicts != LoadKeepVersions {
+			if kvs, overwrites, err = resolveLoadConflicts(txn, kvs, opt); err != nil {
+				return err
+			}
 		}
-
-		list := &pb.KVList{}
-		if err := proto.Unmarshal(unmarshalBuf[:sz], list); err != nil {
-			return err
+		// Move the commit timestamps past the versions before writing them, so that the
+		// transactions don't commit at the same versions.
+		var maxVersion uint64
+		for _, kv := range kvs {
+			if kv.Version > maxVersion {
+				maxVersion = kv.Version
+			}
 		}
-
-		for _, kv := range list.Kv {
+		db.orc.advanceTs(maxVersion)
+		if i < opt.SkipLists {
+			continue
+		}
+		for _, kv := range kvs {
 			if err := ldr.Set(kv); err != nil {
 				return err
 			}
-
-			// Update nextTxnTs, memtable stores this
-			// timestamp in badger head when flushed.
-			if kv.Version >= db.orc.nextTxnTs {
-				db.orc.nextTxnTs = kv.Version + 1
-			}
 		}
+		if err := db.loadOverwrites(overwrites); err != nil {
+			return err
+		}
+		ldr.lists = i + 1
 	}
 
 	if err := ldr.Finish(); err != nil {
 		return err
 	}
-	db.orc.txnMark.Done(db.orc.nextTxnTs - 1)
+	if opt.Progress != nil && ldr.done.Lists < ldr.lists {
+		// The last lists had no entries to write.
+		ldr.done.Lists = ldr.lists
+		opt.Progress(ldr.done)
+	}
 	return nil
 }
+
+// loadOverwrites writes the KVs of a backup which must become the latest versions of their keys.
+// Outside of managed mode, they're written at a commit timestamp of the oracle, like a transaction,
+// so that their versions are above the ones in the DB, and don't collide with the transactions'.
+func (db *DB) loadOverwrites(kvs []*pb.KV) error {
+	if len(kvs) == 0 {
+		return nil
+	}
+	if !db.opt.managedTxns {
+		keys := make(map[uint64]struct{}, len(kvs))
+		for _, kv := range kvs {
+			keys[z.MemHash(kv.Key)] = struct{}{}
+		}
+		ts := db.orc.newBatchTs(keys)
+		defer db.orc.doneCommit(ts)
+		for _, kv := range kvs {
+			kv.Version = ts
+		}
+	}
+	ldr := db.NewKVLoader(16)
+	for _, kv := range kvs {
+		if err := ldr.Set(kv); err != nil {
+			_ = ldr.throttle.Finish()
+			return err
+		}
+	}
+	return ldr.Finish()
+}
+
+// filterUntilTs drops the versions above untilTs from the KVs of a backup, in place. A zero
+// untilTs keeps them all.
+func filterUntilTs(kvs []*pb.KV, untilTs uint64) []*pb.KV {
+	if untilTs == 0 {
+		return kvs
+	}
+	out := kvs[:0]
+	var skipped *pb.KV
+	for _, kv := range kvs {
+		if kv.Version > untilTs {
+			skipped = kv
+			continue
+		}
+		if skipped != nil && isDiscardMarker(kv, skipped) {
+			// The marker was added for the skipped version, which discards the earlier ones.
+			continue
+		}
+		skipped = nil
+		out = append(out, kv)
+	}
+	return out
+}
+
+// resolveLoadConflicts applies opt.Conflicts to the KVs of a backup, in place. It returns the KVs
+// to write with their versions, and the ones to write above the latest versions in the DB, with
+// the version above it in managed mode. The versions of each key are adjacent in a list of a
+// backup, from the latest one.
+func resolveLoadConflicts(txn *Txn, kvs []*pb.KV, opt LoadOptions) ([]*pb.KV, []*pb.KV, error) {
+	out := kvs[:0]
+	var overwrites []*pb.KV
+	for len(kvs) > 0 {
+		n := 1
+		for n < len(kvs) && bytes.Equal(kvs[n].Key, kvs[0].Key) {
+			n++
+		}
+		versions := kvs[:n]
+		kvs = kvs[n:]
+
+		item, err := txn.Get(versions[0].Key)
+		if err == ErrKeyNotFound {
+			// Deleted and expired keys have a version, but no live value.
+			out = append(out, versions...)
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		latest := versions[0]
+		var meta byte
+		if len(latest.Meta) > 0 {
+			meta = latest.Meta[0]
+		}
+		switch opt.Conflicts {
+		case LoadSkipExisting:
+		case LoadKeepNewest:
+			for _, kv := range versions {
+				if kv.Version > item.Version() {
+					out = append(out, kv)
+				}
+			}
+		case LoadOverwrite, LoadMerge:
+			if opt.Conflicts == LoadMerge && !isDeletedOrExpired(meta, latest.ExpiresAt) {
+				existing, err := item.ValueCopy(nil)
+				if err != nil {
+					return nil, nil, err
+				}
+				latest.Value = opt.Merge(existing, latest.Value)
+			}
+			if latest.Version > item.Version() {
+				out = append(out, versions...)
+				break
+			}
+			latest.Version = item.Version() + 1
+			overwrites = append(overwrites, latest)
+		default:
+			return nil, nil, errors.Wrapf(ErrInvalidRequest, "invalid conflict policy %d",
+				opt.Conflicts)
+		}
+	}
+	return out, overwrites, nil
+}
+
+// isDiscardMarker tells if kv is the delete marker that Backup adds below an entry that discards
+// the earlier versions of its key.
+func isDiscardMarker(kv, entry *pb.KV) bool {
+	return bytes.Equal(kv.Key, entry.Key) && kv.Version == entry.Version-1 &&
+		len(kv.Meta) > 0 && kv.Meta[0] == bitDelete && len(kv.Value) == 0
+}
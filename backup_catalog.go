@@ -0,0 +1,376 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BackupCatalogFilename is the name of the catalog file in a backup directory.
+const BackupCatalogFilename = "CATALOG.json"
+
+// BackupCatalog records chains of backups in a directory. Each chain is a full backup, followed by
+// incremental backups each holding the versions written since the previous one. It's written as
+// JSON.
+type BackupCatalog struct {
+	Backups []BackupCatalogEntry
+}
+
+// BackupCatalogEntry describes a backup of a chain. It holds the versions in
+// (SinceTs, NextSinceTs], SinceTs being 0 for the full backup.
+type BackupCatalogEntry struct {
+	// File is the name of the backup file, in the directory of the catalog.
+	File        string
+	SinceTs     uint64
+	NextSinceTs uint64
+	Size        int64
+	// Checksum is the hex-encoded SHA-256 checksum of the file.
+	Checksum  string
+	CreatedAt time.Time
+}
+
+// ReadBackupCatalog reads the catalog of the backups in dir. It returns an empty catalog if there's
+// none yet.
+func ReadBackupCatalog(dir string) (*BackupCatalog, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, BackupCatalogFilename))
+	if os.IsNotExist(err) {
+		return &BackupCatalog{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c BackupCatalog
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errors.Wrapf(err, "while decoding the backup catalog in %s", dir)
+	}
+	return &c, nil
+}
+
+// write replaces the catalog in dir atomically.
+func (c *BackupCatalog) write(dir string) error {
+	return writeJSONFile(dir, BackupCatalogFilename, c)
+}
+
+// writeJSONFile replaces the file name in dir with the JSON encoding of v, atomically.
+func writeJSONFile(dir, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(dir, name+".tmp")
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Verify checks that the first chain starts with a full backup, and that the chains have no gaps.
+func (c *BackupCatalog) Verify() error {
+	for i, b := range c.Backups {
+		switch {
+		case i == 0 && b.SinceTs != 0:
+			return errors.Errorf("Backup chain starts with incremental backup %s", b.File)
+		case i > 0 && b.SinceTs != 0 && b.SinceTs != c.Backups[i-1].NextSinceTs:
+			return errors.Errorf("Gap in the backup chain: %s holds the versions above %d, "+
+				"but %s only those up to %d", b.File, b.SinceTs, c.Backups[i-1].File,
+				c.Backups[i-1].NextSinceTs)
+		case b.NextSinceTs < b.SinceTs:
+			return errors.Errorf("Invalid version range (%d, %d] of backup %s",
+				b.SinceTs, b.NextSinceTs, b.File)
+		}
+	}
+	return nil
+}
+
+// chains splits the backups into chains, each starting with a full backup.
+func (c *BackupCatalog) chains() [][]BackupCatalogEntry {
+	var chains [][]BackupCatalogEntry
+	for i, b := range c.Backups {
+		if i == 0 || b.SinceTs == 0 {
+			chains = append(chains, nil)
+		}
+		chains[len(chains)-1] = append(chains[len(chains)-1], b)
+	}
+	return chains
+}
+
+// BackupToCatalog adds a backup to the chain of backups in dir: a full backup if the chain is
+// empty, and an incremental backup of the versions written since the last backup otherwise. The
+// backup is written with opt, see DB.BackupWithOptions. If opt.NewChain is set, a full backup
+// starting a new chain is written instead. The backup file is written before the catalog is
+// updated, so an interrupted backup leaves the chain unchanged.
+func (db *DB) BackupToCatalog(dir string, opt BackupOptions) (*BackupCatalogEntry, error) {
+	c, err := ReadBackupCatalog(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Verify(); err != nil {
+		return nil, err
+	}
+	entry := BackupCatalogEntry{CreatedAt: time.Now().UTC()}
+	kind := "full"
+	seq := 1
+	if n := len(c.Backups); n > 0 {
+		// The sequence number keeps increasing once the backups before are pruned.
+		last := c.Backups[n-1].File
+		if _, err := fmt.Sscanf(last, "%06d-", &seq); err != nil {
+			return nil, errors.Wrapf(err, "while parsing backup file name %s", last)
+		}
+		seq++
+		if !opt.NewChain {
+			entry.SinceTs = c.Backups[n-1].NextSinceTs
+			kind = "incremental"
+		}
+	}
+	entry.File = fmt.Sprintf("%06d-%s.bak", seq, kind)
+
+	var maxVersion uint64
+	entry.Size, entry.Checksum, err = writeBackupFile(filepath.Join(dir, entry.File),
+		func(w io.Writer) error {
+			var err error
+			maxVersion, err = db.BackupWithOptions(w, entry.SinceTs, opt)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	// The next backup holds the versions above the ones in this one, as Backup only dumps the
+	// versions above since. If there were none, it starts where this one started.
+	entry.NextSinceTs = entry.SinceTs
+	if maxVersion > entry.NextSinceTs {
+		entry.NextSinceTs = maxVersion
+	}
+
+	c.Backups = append(c.Backups, entry)
+	if err := c.write(dir); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// LoadCatalog restores the last chain of backups in dir, the full backup followed by the
+// incremental ones, like LoadWithOptions does for a single backup. If opt.UntilTs is set, the last
+// chain whose full backup has no version above it is restored instead, if any. The chain and the
+// sizes and checksums of all the files are verified before anything is loaded.
+func (db *DB) LoadCatalog(dir string, maxPendingWrites int, opt LoadOptions) error {
+	c, err := ReadBackupCatalog(dir)
+	if err != nil {
+		return err
+	}
+	if len(c.Backups) == 0 {
+		return errors.Errorf("No backups in %s", dir)
+	}
+	if err := c.Verify(); err != nil {
+		return err
+	}
+	chains := c.chains()
+	backups := chains[len(chains)-1]
+	if opt.UntilTs > 0 {
+		backups = chains[0]
+		for _, chain := range chains {
+			if chain[0].NextSinceTs <= opt.UntilTs {
+				backups = chain
+			}
+		}
+		// The backups of the versions above UntilTs have nothing to load.
+		n := 1
+		for n < len(backups) && backups[n].SinceTs < opt.UntilTs {
+			n++
+		}
+		backups = backups[:n]
+	}
+	for _, b := range backups {
+		if err := verifyBackupFile(dir, b.File, b.Size, b.Checksum); err != nil {
+			return err
+		}
+	}
+	for _, b := range backups {
+		f, err := os.Open(filepath.Join(dir, b.File))
+		if err != nil {
+			return err
+		}
+		err = db.LoadWithOptions(f, maxPendingWrites, opt)
+		f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "while loading backup %s", b.File)
+		}
+	}
+	return nil
+}
+
+// BackupRetention selects the backups kept by PruneBackupCatalog. Each backup is a point the DB can
+// be restored to, and the chain it's part of is kept with it.
+type BackupRetention struct {
+	// KeepDaily keeps the last backup of each of the last KeepDaily days with backups.
+	KeepDaily int
+	// KeepWeekly keeps the last backup of each of the last KeepWeekly ISO weeks with backups.
+	KeepWeekly int
+}
+
+// PruneBackupCatalog deletes the chains of backups in dir which hold none of the backups selected
+// by r. The last chain is always kept, since the next incremental backups are added to it. Whole
+// chains are deleted, so a full backup is never deleted while an incremental backup depending on
+// it is kept. The catalog is updated before the files are deleted, so an interrupted prune at
+// worst leaves unreferenced files behind. It returns the names of the deleted files.
+func PruneBackupCatalog(dir string, r BackupRetention) ([]string, error) {
+	if r.KeepDaily <= 0 && r.KeepWeekly <= 0 {
+		return nil, errors.Wrapf(ErrInvalidRequest, "no backups to keep were given")
+	}
+	c, err := ReadBackupCatalog(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Verify(); err != nil {
+		return nil, err
+	}
+	chains := c.chains()
+	if len(chains) < 2 {
+		return nil, nil
+	}
+
+	// Select the backups to keep, from the newest one.
+	keep := make(map[int]bool)
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	for i := len(chains) - 1; i >= 0; i-- {
+		for j := len(chains[i]) - 1; j >= 0; j-- {
+			t := chains[i][j].CreatedAt.UTC()
+			day := t.Format("2006-01-02")
+			if !days[day] && len(days) < r.KeepDaily {
+				days[day] = true
+				keep[i] = true
+			}
+			year, week := t.ISOWeek()
+			wk := fmt.Sprintf("%d-%02d", year, week)
+			if !weeks[wk] && len(weeks) < r.KeepWeekly {
+				weeks[wk] = true
+				keep[i] = true
+			}
+		}
+	}
+	keep[len(chains)-1] = true
+
+	pruned := &BackupCatalog{}
+	var deleted []string
+	for i, chain := range chains {
+		if keep[i] {
+			pruned.Backups = append(pruned.Backups, chain...)
+			continue
+		}
+		for _, b := range chain {
+			deleted = append(deleted, b.File)
+		}
+	}
+	if len(deleted) == 0 {
+		return nil, nil
+	}
+	if err := pruned.Verify(); err != nil {
+		return nil, errors.Wrapf(err, "refusing to prune the backups in %s", dir)
+	}
+	if err := pruned.write(dir); err != nil {
+		return nil, err
+	}
+	for _, file := range deleted {
+		if err := os.Remove(filepath.Join(dir, file)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return deleted, syncDir(dir)
+}
+
+// writeBackupFile creates the file at path, and writes a backup to it with backup. It returns the
+// size and the hex-encoded SHA-256 checksum of the file.
+func writeBackupFile(path string, backup func(w io.Writer) error) (int64, string, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(f, h)}
+	bw := bufio.NewWriterSize(cw, 4<<20)
+	if err := backup(bw); err != nil {
+		return 0, "", err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, "", err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, "", err
+	}
+	return cw.n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyBackupFile checks the size and the checksum of the backup file in dir.
+func verifyBackupFile(dir, file string, size int64, checksum string) error {
+	f, err := os.Open(filepath.Join(dir, file))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return errors.Errorf("Backup %s has %d bytes instead of %d", file, n, size)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != checksum {
+		return errors.Errorf("Checksum mismatch for backup %s: %s instead of %s",
+			file, sum, checksum)
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupCatalog(t *testing.T) {
+	backupDir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(backupDir)
+
+	set := func(db *DB, from, to int, val string) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := from; i < to; i++ {
+				if err := txn.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(val)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		set(db, 0, 10, "full")
+		entry, err := db.BackupToCatalog(backupDir, BackupOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "000001-full.bak", entry.File)
+		require.Zero(t, entry.SinceTs)
+
+		set(db, 5, 15, "incr1")
+		entry, err = db.BackupToCatalog(backupDir, BackupOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "000002-incremental.bak", entry.File)
+
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Delete([]byte("key000"))
+		}))
+		_, err = db.BackupToCatalog(backupDir, BackupOptions{})
+		require.NoError(t, err)
+
+		// Nothing changed since the last backup.
+		entry, err = db.BackupToCatalog(backupDir, BackupOptions{})
+		require.NoError(t, err)
+		require.Equal(t, entry.SinceTs, entry.NextSinceTs)
+	})
+
+	c, err := ReadBackupCatalog(backupDir)
+	require.NoError(t, err)
+	require.Len(t, c.Backups, 4)
+	require.NoError(t, c.Verify())
+
+	restore := func() (map[string]string, error) {
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+		db, err := Open(getTestOptions(dir))
+		require.NoError(t, err)
+		defer db.Close()
+		if err := db.LoadCatalog(backupDir, 16, LoadOptions{}); err != nil {
+			return nil, err
+		}
+		got := make(map[string]string)
+		err = db.View(func(txn *Txn) error {
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				v, err := it.Item().ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				got[string(it.Item().Key())] = string(v)
+			}
+			return nil
+		})
+		return got, err
+	}
+
+	got, err := restore()
+	require.NoError(t, err)
+	require.Len(t, got, 14)
+	require.NotContains(t, got, "key000")
+	require.Equal(t, "full", got["key001"])
+	require.Equal(t, "incr1", got["key005"])
+	require.Equal(t, "incr1", got["key014"])
+
+	// A corrupted file is detected before anything is loaded.
+	path := filepath.Join(backupDir, c.Backups[1].File)
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, data, 0666))
+	_, err = restore()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Checksum mismatch")
+
+	// So is a missing backup of the chain.
+	require.NoError(t, os.Remove(path))
+	c.Backups = append(c.Backups[:1], c.Backups[2:]...)
+	require.NoError(t, c.write(backupDir))
+	_, err = restore()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Gap in the backup chain")
+}
+
+func TestPruneBackupCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	c := &BackupCatalog{}
+	add := func(date string, since, next uint64) {
+		created, err := time.Parse("2006-01-02", date)
+		require.NoError(t, err)
+		b := BackupCatalogEntry{
+			File:        fmt.Sprintf("%06d.bak", len(c.Backups)+1),
+			SinceTs:     since,
+			NextSinceTs: next,
+			CreatedAt:   created,
+		}
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, b.File), nil, 0600))
+		c.Backups = append(c.Backups, b)
+	}
+	// Three chains, of the weeks 24, 25 and 26 of 2021.
+	add("2021-06-14", 0, 10)
+	add("2021-06-15", 10, 20)
+	add("2021-06-23", 0, 30)
+	add("2021-06-24", 30, 40)
+	add("2021-06-29", 0, 50)
+	add("2021-06-30", 50, 60)
+	require.NoError(t, c.write(dir))
+
+	_, err = PruneBackupCatalog(dir, BackupRetention{})
+	require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+
+	deleted, err := PruneBackupCatalog(dir, BackupRetention{KeepDaily: 2, KeepWeekly: 2})
+	require.NoError(t, err)
+	require.Equal(t, []string{"000001.bak", "000002.bak"}, deleted)
+	_, err = os.Stat(filepath.Join(dir, "000001.bak"))
+	require.True(t, os.IsNotExist(err))
+
+	pruned, err := ReadBackupCatalog(dir)
+	require.NoError(t, err)
+	require.Len(t, pruned.Backups, 4)
+	require.NoError(t, pruned.Verify())
+
+	// Only the chain of the last backup is kept.
+	deleted, err = PruneBackupCatalog(dir, BackupRetention{KeepDaily: 1})
+	require.NoError(t, err)
+	require.Equal(t, []string{"000003.bak", "000004.bak"}, deleted)
+}
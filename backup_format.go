@@ -0,0 +1,683 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/dgraph-io/badger/v3/options"
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/golang/protobuf/proto"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// A compressed, encrypted or checksummed backup starts with a header:
+//
+//   magic (8 bytes) | version (1 byte) | compression (1 byte) | flags (1 byte) | IV (16 bytes)
+//
+// The IV is only present if the backup is encrypted. The rest of the backup is the list of
+// KVLists of a plain backup, each followed by its CRC32C if the backup is checksummed, compressed
+// and then encrypted with AES in CTR mode. An encrypted backup starts with the magic again, to
+// detect a wrong key before anything is loaded.
+//
+// Read as the length of the first KVList of a plain backup, the magic would be over 5 EB, so
+// plain backups, which have no header, can't be mistaken for the new ones.
+//
+// Version 2 backups have the same header, followed by an IV and the encrypted magic if the backup
+// is encrypted. The rest of the backup is a list of frames:
+//
+//   type (1 byte) | length (8 bytes) | payload | CRC32C of the payload (4 bytes)
+//
+// Each chunk frame holds a KVList, and the last frame holds the index of the chunks. Payloads are
+// compressed and encrypted on their own, with an IV prepended to each of them, so that any chunk
+// can be read without reading the ones before it. The backup ends with a footer, the offset of the
+// index frame (8 bytes) followed by the magic.
+var backupMagic = []byte("BDGRBKUP")
+
+const (
+	backupVersion   = 1
+	backupVersionV2 = 2
+
+	backupEncrypted   byte = 1 << 0
+	backupChecksummed byte = 1 << 1
+)
+
+// backupHeaderSize is the size of the header, without the IV.
+var backupHeaderSize = len(backupMagic) + 3
+
+const (
+	backupChunkFrame byte = 1
+	backupIndexFrame byte = 2
+
+	backupFrameHeaderSize = 9
+)
+
+// backupFooterSize is the size of the footer of version 2 backups.
+var backupFooterSize = 8 + len(backupMagic)
+
+// backupChunk is the entry of a chunk in the index of a version 2 backup.
+type backupChunk struct {
+	// Offset and Size locate the frame of the chunk in the backup.
+	Offset, Size uint64
+	// MinKey and MaxKey are the smallest and largest keys of the chunk.
+	MinKey, MaxKey []byte
+	MaxVersion     uint64
+}
+
+// hasPrefix tells if the chunk may contain keys with any of the given prefixes.
+func (c *backupChunk) hasPrefix(prefixes [][]byte) bool {
+	for _, p := range prefixes {
+		if bytes.Compare(c.MaxKey, p) >= 0 &&
+			(bytes.Compare(c.MinKey, p) <= 0 || bytes.HasPrefix(c.MinKey, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeBackupIndex encodes the index as the offset, size, max version, and the length-prefixed
+// min and max keys of each chunk, all little-endian.
+func encodeBackupIndex(index []backupChunk) []byte {
+	var buf bytes.Buffer
+	var tmp [8]byte
+	putUint := func(v uint64) {
+		binary.LittleEndian.PutUint64(tmp[:], v)
+		buf.Write(tmp[:])
+	}
+	for _, c := range index {
+		putUint(c.Offset)
+		putUint(c.Size)
+		putUint(c.MaxVersion)
+		putUint(uint64(len(c.MinKey)))
+		buf.Write(c.MinKey)
+		putUint(uint64(len(c.MaxKey)))
+		buf.Write(c.MaxKey)
+	}
+	return buf.Bytes()
+}
+
+func decodeBackupIndex(buf []byte) ([]backupChunk, error) {
+	corrupt := false
+	getUint := func() uint64 {
+		if len(buf) < 8 {
+			corrupt = true
+			return 0
+		}
+		v := binary.LittleEndian.Uint64(buf)
+		buf = buf[8:]
+		return v
+	}
+	getKey := func() []byte {
+		sz := getUint()
+		if corrupt || uint64(len(buf)) < sz {
+			corrupt = true
+			return nil
+		}
+		key := buf[:sz]
+		buf = buf[sz:]
+		return key
+	}
+	var index []backupChunk
+	for len(buf) > 0 && !corrupt {
+		index = append(index, backupChunk{
+			Offset:     getUint(),
+			Size:       getUint(),
+			MaxVersion: getUint(),
+			MinKey:     getKey(),
+			MaxKey:     getKey(),
+		})
+	}
+	if corrupt {
+		return nil, errors.Errorf("Corrupt backup index")
+	}
+	return index, nil
+}
+
+// backupWriter writes the KVLists of a backup to an underlying writer.
+type backupWriter struct {
+	w    io.Writer
+	zstd *zstd.Encoder
+
+	// hasHeader is false for plain backups, which are written as is to w, so that they can be
+	// read by older versions of Badger.
+	hasHeader bool
+	checksum  bool
+
+	// The fields below are only used by version 2 backups.
+	version byte
+	cw      *countingWriter
+	block   cipher.Block
+	index   []backupChunk
+}
+
+// newBackupWriter writes the header of a backup to w, if it's compressed, encrypted with key,
+// checksummed or indexed. Indexed backups are written in version 2.
+func newBackupWriter(w io.Writer, compression options.CompressionType, level int,
+	key []byte, checksum, index bool) (*backupWriter, error) {
+
+	bw := &backupWriter{w: w, version: backupVersion}
+	if compression == options.None && len(key) == 0 && !checksum && !index {
+		return bw, nil
+	}
+	if compression != options.None && compression != options.ZSTD {
+		return nil, errors.Wrapf(ErrInvalidRequest,
+			"backups can only be compressed with ZSTD, got compression %d", compression)
+	}
+	if err := checkBackupKey(key); err != nil {
+		return nil, err
+	}
+	if index {
+		return newBackupWriterV2(w, compression, level, key)
+	}
+	bw.hasHeader = true
+	bw.checksum = true
+
+	hdr := append([]byte{}, backupMagic...)
+	hdr = append(hdr, backupVersion, byte(compression), backupChecksummed)
+	var iv []byte
+	if len(key) > 0 {
+		hdr[backupHeaderSize-1] |= backupEncrypted
+		var err error
+		if iv, err = y.GenerateIV(); err != nil {
+			return nil, err
+		}
+		hdr = append(hdr, iv...)
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+
+	if len(key) > 0 {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		bw.w = cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: w}
+		if _, err := bw.w.Write(backupMagic); err != nil {
+			return nil, err
+		}
+	}
+	if compression == options.ZSTD {
+		enc, err := zstd.NewWriter(bw.w,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		if err != nil {
+			return nil, err
+		}
+		bw.zstd = enc
+	}
+	return bw, nil
+}
+
+func newBackupWriterV2(w io.Writer, compression options.CompressionType, level int,
+	key []byte) (*backupWriter, error) {
+
+	bw := &backupWriter{
+		hasHeader: true,
+		checksum:  true,
+		version:   backupVersionV2,
+		cw:        &countingWriter{w: w},
+	}
+	bw.w = bw.cw
+	hdr := append([]byte{}, backupMagic...)
+	hdr = append(hdr, backupVersionV2, byte(compression), backupChecksummed)
+	if len(key) > 0 {
+		hdr[backupHeaderSize-1] |= backupEncrypted
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		bw.block = block
+		iv, err := y.GenerateIV()
+		if err != nil {
+			return nil, err
+		}
+		check := make([]byte, len(backupMagic))
+		cipher.NewCTR(block, iv).XORKeyStream(check, backupMagic)
+		hdr = append(hdr, iv...)
+		hdr = append(hdr, check...)
+	}
+	if _, err := bw.w.Write(hdr); err != nil {
+		return nil, err
+	}
+	if compression == options.ZSTD {
+		enc, err := zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		if err != nil {
+			return nil, err
+		}
+		bw.zstd = enc
+	}
+	return bw, nil
+}
+
+// encodePayload compresses and encrypts the payload of a frame of a version 2 backup.
+func (bw *backupWriter) encodePayload(buf []byte) ([]byte, error) {
+	if bw.zstd != nil {
+		buf = bw.zstd.EncodeAll(buf, nil)
+	}
+	if bw.block == nil {
+		return buf, nil
+	}
+	iv, err := y.GenerateIV()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(iv)+len(buf))
+	copy(out, iv)
+	cipher.NewCTR(bw.block, iv).XORKeyStream(out[len(iv):], buf)
+	return out, nil
+}
+
+func (bw *backupWriter) writeFrame(typ byte, payload []byte) error {
+	var hdr [backupFrameHeaderSize]byte
+	hdr[0] = typ
+	binary.LittleEndian.PutUint64(hdr[1:], uint64(len(payload)))
+	if _, err := bw.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := bw.w.Write(payload); err != nil {
+		return err
+	}
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.Checksum(payload, y.CastagnoliCrcTable))
+	_, err := bw.w.Write(crc[:])
+	return err
+}
+
+// writeChunk writes list as a chunk of a version 2 backup, and adds it to the index.
+func (bw *backupWriter) writeChunk(list *pb.KVList) error {
+	if len(list.Kv) == 0 {
+		return nil
+	}
+	c := backupChunk{Offset: uint64(bw.cw.n)}
+	minKey, maxKey := list.Kv[0].Key, list.Kv[0].Key
+	for _, kv := range list.Kv {
+		if bytes.Compare(kv.Key, minKey) < 0 {
+			minKey = kv.Key
+		}
+		if bytes.Compare(kv.Key, maxKey) > 0 {
+			maxKey = kv.Key
+		}
+		if kv.Version > c.MaxVersion {
+			c.MaxVersion = kv.Version
+		}
+	}
+	c.MinKey = append([]byte{}, minKey...)
+	c.MaxKey = append([]byte{}, maxKey...)
+
+	buf, err := proto.Marshal(list)
+	if err != nil {
+		return err
+	}
+	if buf, err = bw.encodePayload(buf); err != nil {
+		return err
+	}
+	if err := bw.writeFrame(backupChunkFrame, buf); err != nil {
+		return err
+	}
+	c.Size = uint64(bw.cw.n) - c.Offset
+	bw.index = append(bw.index, c)
+	return nil
+}
+
+// closeV2 writes the index and the footer of a version 2 backup.
+func (bw *backupWriter) closeV2() error {
+	off := bw.cw.n
+	buf, err := bw.encodePayload(encodeBackupIndex(bw.index))
+	if err != nil {
+		return err
+	}
+	if err := bw.writeFrame(backupIndexFrame, buf); err != nil {
+		return err
+	}
+	footer := make([]byte, backupFooterSize)
+	binary.LittleEndian.PutUint64(footer, uint64(off))
+	copy(footer[8:], backupMagic)
+	_, err = bw.w.Write(footer)
+	return err
+}
+
+func (bw *backupWriter) Write(p []byte) (int, error) {
+	if bw.zstd != nil {
+		return bw.zstd.Write(p)
+	}
+	return bw.w.Write(p)
+}
+
+// writeList writes list, followed by its checksum if the backup is checksummed.
+func (bw *backupWriter) writeList(list *pb.KVList) error {
+	if bw.version == backupVersionV2 {
+		return bw.writeChunk(list)
+	}
+	buf, err := proto.Marshal(list)
+	if err != nil {
+		return err
+	}
+	var hdr [12]byte
+	binary.LittleEndian.PutUint64(hdr[:8], uint64(len(buf)))
+	if _, err := bw.Write(hdr[:8]); err != nil {
+		return err
+	}
+	if _, err := bw.Write(buf); err != nil {
+		return err
+	}
+	if !bw.checksum {
+		return nil
+	}
+	binary.LittleEndian.PutUint32(hdr[8:], crc32.Checksum(buf, y.CastagnoliCrcTable))
+	_, err = bw.Write(hdr[8:])
+	return err
+}
+
+// Close flushes the compressed data, or writes the index of a version 2 backup. It doesn't close
+// the underlying writer.
+func (bw *backupWriter) Close() error {
+	if bw.version == backupVersionV2 {
+		if err := bw.closeV2(); err != nil {
+			return err
+		}
+	}
+	if bw.zstd != nil {
+		return bw.zstd.Close()
+	}
+	return nil
+}
+
+// backupReader reads the KVLists of a backup.
+type backupReader struct {
+	r        *bufio.Reader
+	zstd     *zstd.Decoder
+	checksum bool
+	buf      []byte
+
+	// The fields below are only used by version 2 backups.
+	version byte
+	block   cipher.Block
+	// rs, start and chunks are set by seekPrefixes, to only read the given chunks.
+	rs     io.ReadSeeker
+	start  int64
+	chunks []backupChunk
+}
+
+// newBackupReader reads the header of the backup read from r, if any. If the backup is encrypted,
+// it's decrypted with key.
+func newBackupReader(r io.Reader, key []byte) (*backupReader, error) {
+	br := &backupReader{r: bufio.NewReaderSize(r, 16<<10), buf: make([]byte, 1<<10)}
+	magic, err := br.r.Peek(len(backupMagic))
+	if err != nil || !bytes.Equal(magic, backupMagic) {
+		// A plain backup. Errors are returned when reading the first KVList.
+		return br, nil
+	}
+	hdr := make([]byte, backupHeaderSize)
+	if _, err := io.ReadFull(br.r, hdr); err != nil {
+		return nil, err
+	}
+	br.version = hdr[len(backupMagic)]
+	if br.version != backupVersion && br.version != backupVersionV2 {
+		return nil, errors.Errorf("Unsupported backup version: %d", br.version)
+	}
+	compression := options.CompressionType(hdr[len(backupMagic)+1])
+	flags := hdr[len(backupMagic)+2]
+	br.checksum = flags&backupChecksummed != 0
+
+	var body io.Reader = br.r
+	if flags&backupEncrypted != 0 {
+		if len(key) == 0 {
+			return nil, errors.Wrapf(ErrEncryptionKeyMismatch,
+				"the backup is encrypted, but no key was given")
+		}
+		if err := checkBackupKey(key); err != nil {
+			return nil, err
+		}
+		iv := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(br.r, iv); err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		stream := cipher.NewCTR(block, iv)
+		check := make([]byte, len(backupMagic))
+		if br.version == backupVersionV2 {
+			// The frames are encrypted on their own, only the magic is encrypted with this IV.
+			br.block = block
+			if _, err := io.ReadFull(br.r, check); err != nil {
+				return nil, err
+			}
+			stream.XORKeyStream(check, check)
+		} else {
+			body = cipher.StreamReader{S: stream, R: br.r}
+			if _, err := io.ReadFull(body, check); err != nil {
+				return nil, err
+			}
+		}
+		if !bytes.Equal(check, backupMagic) {
+			return nil, errors.Wrapf(ErrEncryptionKeyMismatch, "while decrypting the backup")
+		}
+	}
+
+	switch compression {
+	case options.None:
+	case options.ZSTD:
+		if br.version == backupVersionV2 {
+			dec, err := zstd.NewReader(nil)
+			if err != nil {
+				return nil, err
+			}
+			br.zstd = dec
+			break
+		}
+		dec, err := zstd.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		br.zstd = dec
+		body = dec
+	default:
+		return nil, errors.Errorf("Unsupported backup compression: %d", compression)
+	}
+	// NewReaderSize returns br.r itself if the backup is neither compressed nor encrypted.
+	br.r = bufio.NewReaderSize(body, 16<<10)
+	return br, nil
+}
+
+// next returns the next KVList of the backup, or io.EOF at its end.
+func (br *backupReader) next() (*pb.KVList, error) {
+	if br.version == backupVersionV2 {
+		return br.nextChunk()
+	}
+	var sz uint64
+	if err := binary.Read(br.r, binary.LittleEndian, &sz); err != nil {
+		return nil, err
+	}
+	if cap(br.buf) < int(sz) {
+		br.buf = make([]byte, sz)
+	}
+	buf := br.buf[:sz]
+	if _, err := io.ReadFull(br.r, buf); err != nil {
+		return nil, err
+	}
+	if br.checksum {
+		var crc uint32
+		if err := binary.Read(br.r, binary.LittleEndian, &crc); err != nil {
+			return nil, err
+		}
+		if actual := crc32.Checksum(buf, y.CastagnoliCrcTable); actual != crc {
+			return nil, errors.Wrapf(y.ErrChecksumMismatch,
+				"in backup list of %d bytes, actual: %d, expected: %d", sz, actual, crc)
+		}
+	}
+	list := &pb.KVList{}
+	if err := proto.Unmarshal(buf, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (br *backupReader) nextChunk() (*pb.KVList, error) {
+	var typ byte
+	var payload []byte
+	var err error
+	if br.rs != nil {
+		if len(br.chunks) == 0 {
+			return nil, io.EOF
+		}
+		typ, payload, err = br.readFrameAt(br.chunks[0].Offset)
+		br.chunks = br.chunks[1:]
+	} else {
+		typ, payload, err = br.readFrame()
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case backupChunkFrame:
+	case backupIndexFrame:
+		return nil, io.EOF
+	default:
+		return nil, errors.Errorf("Invalid backup frame type: %d", typ)
+	}
+	if payload, err = br.decodePayload(payload); err != nil {
+		return nil, err
+	}
+	list := &pb.KVList{}
+	if err := proto.Unmarshal(payload, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// readFrame reads the next frame of a version 2 backup, and validates its checksum. The payload
+// is only valid until the next read.
+func (br *backupReader) readFrame() (byte, []byte, error) {
+	var hdr [backupFrameHeaderSize]byte
+	if _, err := io.ReadFull(br.r, hdr[:]); err != nil {
+		if err == io.EOF {
+			// The index frame is the last one, so a backup can't end before a frame.
+			err = errors.Wrapf(io.ErrUnexpectedEOF, "while reading backup frame")
+		}
+		return 0, nil, err
+	}
+	sz := binary.LittleEndian.Uint64(hdr[1:])
+	if cap(br.buf) < int(sz)+4 {
+		br.buf = make([]byte, sz+4)
+	}
+	buf := br.buf[:sz+4]
+	if _, err := io.ReadFull(br.r, buf); err != nil {
+		return 0, nil, err
+	}
+	payload := buf[:sz]
+	crc := binary.LittleEndian.Uint32(buf[sz:])
+	if actual := crc32.Checksum(payload, y.CastagnoliCrcTable); actual != crc {
+		return 0, nil, errors.Wrapf(y.ErrChecksumMismatch,
+			"in backup frame of %d bytes, actual: %d, expected: %d", sz, actual, crc)
+	}
+	return hdr[0], payload, nil
+}
+
+// readFrameAt reads the frame at the given offset of the backup.
+func (br *backupReader) readFrameAt(off uint64) (byte, []byte, error) {
+	if _, err := br.rs.Seek(br.start+int64(off), io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+	br.r.Reset(br.rs)
+	return br.readFrame()
+}
+
+// decodePayload decrypts and decompresses the payload of a frame, in place if it can.
+func (br *backupReader) decodePayload(buf []byte) ([]byte, error) {
+	if br.block != nil {
+		if len(buf) < aes.BlockSize {
+			return nil, errors.Errorf("Backup frame of %d bytes is too short", len(buf))
+		}
+		iv := buf[:aes.BlockSize]
+		buf = buf[aes.BlockSize:]
+		cipher.NewCTR(br.block, iv).XORKeyStream(buf, buf)
+	}
+	if br.zstd != nil {
+		return br.zstd.DecodeAll(buf, nil)
+	}
+	return buf, nil
+}
+
+// seekPrefixes makes next only return the chunks of a version 2 backup that may contain keys with
+// the given prefixes, using its index. rs must be the reader the backup was opened with, and start
+// the offset of the backup in it.
+func (br *backupReader) seekPrefixes(rs io.ReadSeeker, start int64, prefixes [][]byte) error {
+	if br.version != backupVersionV2 {
+		return errors.Errorf("Only version 2 backups have an index, got version %d", br.version)
+	}
+	if _, err := rs.Seek(-int64(backupFooterSize), io.SeekEnd); err != nil {
+		return err
+	}
+	footer := make([]byte, backupFooterSize)
+	if _, err := io.ReadFull(rs, footer); err != nil {
+		return err
+	}
+	if !bytes.Equal(footer[8:], backupMagic) {
+		return errors.Errorf("Invalid backup footer")
+	}
+	br.rs, br.start = rs, start
+	typ, payload, err := br.readFrameAt(binary.LittleEndian.Uint64(footer))
+	if err != nil {
+		return err
+	}
+	if typ != backupIndexFrame {
+		return errors.Errorf("Invalid backup index frame type: %d", typ)
+	}
+	// The index refers to the payload, copy it if it's the read buffer.
+	payload = append([]byte{}, payload...)
+	if payload, err = br.decodePayload(payload); err != nil {
+		return err
+	}
+	index, err := decodeBackupIndex(payload)
+	if err != nil {
+		return err
+	}
+	br.chunks = br.chunks[:0]
+	for _, c := range index {
+		if c.hasPrefix(prefixes) {
+			br.chunks = append(br.chunks, c)
+		}
+	}
+	return nil
+}
+
+// Close releases the decompressor. It doesn't close the underlying reader.
+func (br *backupReader) Close() {
+	if br.zstd != nil {
+		br.zstd.Close()
+	}
+}
+
+func checkBackupKey(key []byte) error {
+	switch len(key) {
+	case 0, 16, 24, 32:
+		return nil
+	default:
+		return ErrInvalidEncryptionKey
+	}
+}
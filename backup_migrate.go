@@ -0,0 +1,154 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/dgraph-io/badger/v3/options"
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/pkg/errors"
+)
+
+// MigrateOptions are the options of MigrateBackup.
+type MigrateOptions struct {
+	// SourceKey decrypts the backup being migrated, if it's encrypted.
+	SourceKey []byte
+
+	// Compression, CompressionLevel, EncryptionKey, Checksum and Index are the format of the
+	// migrated backup, like the fields of BackupOptions. CompressionLevel is the ZSTD level.
+	Compression      options.CompressionType
+	CompressionLevel int
+	EncryptionKey    []byte
+	Checksum         bool
+	Index            bool
+}
+
+// MigrateStats describes the backup migrated by MigrateBackup.
+type MigrateStats struct {
+	// Physical is true if the backup was a physical backup, copied as is.
+	Physical bool
+	Lists    int
+	Entries  int
+	// Dropped is the number of entries of the backup which hold no key-value pair, like the
+	// markers of the end of a stream.
+	Dropped int
+}
+
+// migrateMetaMask has the bits of the meta of an entry that a backup carries over. The other ones
+// describe how the entry was stored by the version of Badger that wrote it.
+const migrateMetaMask = bitDelete | BitDiscardEarlierVersions | bitMergeEntry
+
+// MigrateBackup rewrites a backup written by Badger v1, v2 or v3, by DB.Backup or the backup
+// command, in the current format selected by opt, so that it can be loaded by this version of
+// Badger. The backup can be plain, or compressed, encrypted, checksummed or indexed.
+//
+// The metadata bits of each entry which aren't part of its logical value, like the value pointer
+// and transaction bits that older versions wrote to backups, are cleared, and the entries which
+// hold no key-value pair are dropped.
+//
+// A physical backup, written by DB.PhysicalBackup, holds the tables and logs of the DB in the
+// format of the version that wrote it, and can't be converted. It's copied as is if it has the
+// data format of this version, and ErrInvalidRequest is returned otherwise: it must be restored
+// with the version that wrote it, and a logical backup taken from there.
+func MigrateBackup(w io.Writer, r io.Reader, opt MigrateOptions) (MigrateStats, error) {
+	var stats MigrateStats
+	br := bufio.NewReaderSize(r, 16<<10)
+	if version, ok := physicalBackupVersion(br); ok {
+		stats.Physical = true
+		if version != badgerMagicVersion {
+			return stats, errors.Wrapf(ErrInvalidRequest, "the physical backup has data format "+
+				"%d, this version of Badger has %d. Restore it with the version of Badger "+
+				"that wrote it, and take a logical backup to migrate", version, badgerMagicVersion)
+		}
+		_, err := io.Copy(w, br)
+		return stats, err
+	}
+
+	rd, err := newBackupReader(br, opt.SourceKey)
+	if err != nil {
+		return stats, err
+	}
+	defer rd.Close()
+	bw, err := newBackupWriter(w, opt.Compression, opt.CompressionLevel, opt.EncryptionKey,
+		opt.Checksum, opt.Index)
+	if err != nil {
+		return stats, err
+	}
+	for {
+		list, err := rd.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return stats, err
+		}
+		kvs := list.Kv[:0]
+		for _, kv := range list.Kv {
+			if !migrateKV(kv) {
+				stats.Dropped++
+				continue
+			}
+			kvs = append(kvs, kv)
+		}
+		list.Kv = kvs
+		if len(kvs) == 0 {
+			continue
+		}
+		if err := bw.writeList(list); err != nil {
+			return stats, err
+		}
+		stats.Lists++
+		stats.Entries += len(kvs)
+	}
+	return stats, bw.Close()
+}
+
+// migrateKV converts kv to the current format, and returns false if it holds no key-value pair.
+func migrateKV(kv *pb.KV) bool {
+	if len(kv.Key) == 0 || kv.StreamDone || kv.Kind != pb.KV_KEY {
+		return false
+	}
+	kv.StreamId = 0
+	if len(kv.Meta) > 0 {
+		kv.Meta = []byte{kv.Meta[0] & migrateMetaMask}
+	}
+	return true
+}
+
+// physicalBackupVersion peeks at the MANIFEST at the start of a physical backup, and returns its
+// data format version. It returns false if r doesn't hold a physical backup.
+func physicalBackupVersion(r *bufio.Reader) (uint16, bool) {
+	// A tar archive starts with a header block of 512 bytes, followed by the data of the file.
+	const blockSize = 512
+	buf, err := r.Peek(blockSize + len(magicText) + 4)
+	if err != nil {
+		return 0, false
+	}
+	hdr, err := tar.NewReader(bytes.NewReader(buf)).Next()
+	if err != nil || hdr.Name != ManifestFilename {
+		return 0, false
+	}
+	magic := buf[blockSize:]
+	if !bytes.Equal(magic[:len(magicText)], magicText[:]) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(magic[len(magicText)+2:]), true
+}
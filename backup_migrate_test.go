@@ -0,0 +1,103 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3/options"
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateBackup(t *testing.T) {
+	// A plain backup, as written by older versions, with the value pointer and txn bits set.
+	var old bytes.Buffer
+	list := &pb.KVList{}
+	for i := 0; i < 10; i++ {
+		list.Kv = append(list.Kv, &pb.KV{
+			Key:      []byte(fmt.Sprintf("key%02d", i)),
+			Value:    []byte(fmt.Sprintf("val%02d", i)),
+			UserMeta: []byte{7},
+			Version:  uint64(i + 1),
+			Meta:     []byte{bitValuePointer | bitTxn},
+			StreamId: 3,
+		})
+	}
+	list.Kv = append(list.Kv, &pb.KV{StreamId: 3, StreamDone: true})
+	require.NoError(t, writeTo(list, &old))
+
+	key := []byte("0123456789abcdef")
+	var migrated bytes.Buffer
+	stats, err := MigrateBackup(&migrated, bytes.NewReader(old.Bytes()), MigrateOptions{
+		Compression:   options.ZSTD,
+		EncryptionKey: key,
+		Index:         true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, MigrateStats{Lists: 1, Entries: 10, Dropped: 1}, stats)
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.LoadWithOptions(bytes.NewReader(migrated.Bytes()), 16,
+			LoadOptions{EncryptionKey: key}))
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 10; i++ {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%02d", i)))
+				require.NoError(t, err)
+				require.Equal(t, byte(7), item.UserMeta())
+				val, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("val%02d", i), string(val))
+			}
+			return nil
+		}))
+	})
+
+	// The migrated backup can be migrated back to a plain backup.
+	var plain bytes.Buffer
+	stats, err = MigrateBackup(&plain, bytes.NewReader(migrated.Bytes()),
+		MigrateOptions{SourceKey: key})
+	require.NoError(t, err)
+	require.Equal(t, 10, stats.Entries)
+	var sz uint64
+	require.NoError(t, binary.Read(bytes.NewReader(plain.Bytes()), binary.LittleEndian, &sz))
+	require.Equal(t, uint64(plain.Len()-8), sz)
+}
+
+func TestMigratePhysicalBackup(t *testing.T) {
+	var bb bytes.Buffer
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txnSet(t, db, []byte("key"), []byte("val"), 0)
+		require.NoError(t, db.PhysicalBackup(&bb))
+	})
+
+	var out bytes.Buffer
+	stats, err := MigrateBackup(&out, bytes.NewReader(bb.Bytes()), MigrateOptions{})
+	require.NoError(t, err)
+	require.True(t, stats.Physical)
+	require.Equal(t, bb.Bytes(), out.Bytes())
+
+	// The MANIFEST is the first file of the archive, right after its tar header.
+	data := append([]byte{}, bb.Bytes()...)
+	binary.BigEndian.PutUint16(data[512+6:], badgerMagicVersion-1)
+	_, err = MigrateBackup(&out, bytes.NewReader(data), MigrateOptions{})
+	require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+}
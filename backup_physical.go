@@ -0,0 +1,279 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// physicalFile is a file of a physical backup. The first size bytes of the file at path are backed
+// up, or data if path is empty.
+type physicalFile struct {
+	path string
+	size int64
+	data []byte
+}
+
+// PhysicalBackup writes a physical backup of the DB to w, a tar archive of the MANIFEST, the key
+// registry, the keys of the tenants, the write-ahead logs of the memtables, the tables and the
+// value log files, to be restored by RestorePhysicalBackup. The DB is frozen (see DB.Freeze) while
+// the files are picked, and the files are kept from being deleted while they're copied, so that
+// the backup holds the state of the DB when it was frozen. This is much faster than DB.Backup for
+// large DBs, but the backup can only be restored by a version of Badger with the same data format,
+// and the same encryption key.
+//
+// Note that the writes made while the files are picked fail with ErrBlockedWrites, and that the
+// memtables queued for flushing are flushed first, so picking the files can take as long as
+// flushing them. The writers must retry on ErrBlockedWrites, or the backup must be taken when
+// there are no writes. The writes made while the files are copied to w work, and aren't in the
+// backup.
+func (db *DB) PhysicalBackup(w io.Writer) error {
+	if db.opt.InMemory {
+		return errors.Wrapf(ErrInvalidRequest, "in-memory DBs have no files to back up")
+	}
+	if err := db.Freeze(); err != nil {
+		return err
+	}
+	files, release, err := db.pickPhysicalFiles()
+	db.Thaw()
+	defer release()
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		if err := writePhysicalFile(tw, f); err != nil {
+			return errors.Wrapf(err, "while backing up %s", f.path)
+		}
+	}
+	return tw.Close()
+}
+
+// pickPhysicalFiles returns the files of a frozen DB, and a function releasing the references
+// that keep them from being deleted.
+func (db *DB) pickPhysicalFiles() ([]physicalFile, func(), error) {
+	var files []physicalFile
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+
+	// The MANIFEST and the key registry are rewritten in place, so read them now.
+	for _, name := range []string{ManifestFilename, KeyRegistryFileName} {
+		data, err := ioutil.ReadFile(filepath.Join(db.opt.Dir, name))
+		if os.IsNotExist(err) && name == KeyRegistryFileName {
+			continue
+		} else if err != nil {
+			return nil, release, err
+		}
+		files = append(files, physicalFile{path: name, data: data})
+	}
+	// The keys of the tenants are small, and read now as they can be destroyed at any time.
+	db.tenants.RLock()
+	for _, k := range db.tenants.byPrefix {
+		name := tenantKeyFileName(k.id)
+		data, err := ioutil.ReadFile(filepath.Join(db.opt.Dir, name))
+		if err != nil {
+			db.tenants.RUnlock()
+			return nil, release, err
+		}
+		files = append(files, physicalFile{path: name, data: data})
+	}
+	db.tenants.RUnlock()
+
+	// The write-ahead logs are deleted once the memtables are flushed, and the one of the current
+	// memtable is appended to. Only the entries written so far are backed up.
+	db.lock.RLock()
+	mts := append([]*memTable{}, db.imm...)
+	if db.mt != nil {
+		mts = append(mts, db.mt)
+	}
+	for _, mt := range mts {
+		if mt.wal == nil {
+			continue
+		}
+		mt.IncrRef()
+		releases = append(releases, mt.DecrRef)
+		files = append(files, physicalFile{path: mt.wal.path, size: int64(mt.wal.writeAt)})
+	}
+	db.lock.RUnlock()
+
+	// The tables are deleted once the last reference to them is released.
+	for _, l := range db.lc.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			t.IncrRef()
+			t := t
+			releases = append(releases, func() { _ = t.DecrRef() })
+			files = append(files, physicalFile{path: t.Filename(), size: -1})
+		}
+		l.RUnlock()
+	}
+
+	// The value log files rewritten by GC aren't deleted while there are active iterators.
+	db.vlog.incrIteratorCount()
+	releases = append(releases, func() {
+		if err := db.vlog.decrIteratorCount(); err != nil {
+			db.opt.Errorf("while deleting value log files after a physical backup: %v", err)
+		}
+	})
+	db.vlog.filesLock.RLock()
+	for fid, lf := range db.vlog.filesMap {
+		size := int64(-1)
+		if fid == db.vlog.maxFid {
+			size = int64(db.vlog.woffset())
+		}
+		files = append(files, physicalFile{path: lf.path, size: size})
+		lf.lock.RLock()
+		if len(lf.holes) > 0 {
+			files = append(files, physicalFile{path: holesFilePath(lf.path),
+				data: encodeHoles(lf.holes)})
+		}
+		lf.lock.RUnlock()
+	}
+	db.vlog.filesLock.RUnlock()
+
+	// So aren't the blob files. The ones still being written may be dropped, and are left out.
+	ids, err := db.vlog.blobIDs()
+	if err != nil {
+		return nil, release, err
+	}
+	db.vlog.blobs.Lock()
+	for _, id := range ids {
+		if _, ok := db.vlog.blobs.pending[id]; !ok {
+			files = append(files, physicalFile{path: blobFilePath(db.vlog.dirPath, id), size: -1})
+		}
+	}
+	db.vlog.blobs.Unlock()
+
+	for i := range files {
+		if files[i].data != nil || files[i].size >= 0 {
+			continue
+		}
+		fi, err := os.Stat(files[i].path)
+		if err != nil {
+			return nil, release, err
+		}
+		files[i].size = fi.Size()
+	}
+	return files, release, nil
+}
+
+func writePhysicalFile(tw *tar.Writer, f physicalFile) error {
+	hdr := &tar.Header{
+		Name:    filepath.Base(f.path),
+		Mode:    0600,
+		Size:    f.size,
+		ModTime: time.Now(),
+	}
+	if f.data != nil {
+		hdr.Size = int64(len(f.data))
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if f.data != nil {
+		_, err := tw.Write(f.data)
+		return err
+	}
+	src, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.CopyN(tw, src, f.size)
+	return err
+}
+
+// physicalRestoreManifest is the name the MANIFEST is restored to, until all the files are.
+const physicalRestoreManifest = "MANIFEST-RESTORE"
+
+// RestorePhysicalBackup lays the files of a backup written by DB.PhysicalBackup back down in
+// opt.Dir, and the value log files in opt.ValueDir. The directories must not hold a DB. The DB
+// can then be opened with opt, which must have the encryption key of the backed up DB.
+func RestorePhysicalBackup(r io.Reader, opt Options) error {
+	if opt.InMemory {
+		return errors.Wrapf(ErrInvalidRequest, "can't restore a physical backup in memory")
+	}
+	if _, err := os.Stat(filepath.Join(opt.Dir, ManifestFilename)); err == nil {
+		return errors.Errorf("Cannot restore to an already existing DB in %s", opt.Dir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for _, dir := range []string{opt.Dir, opt.ValueDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name := hdr.Name
+		if name != filepath.Base(name) || name == "." || name == ".." {
+			return errors.Errorf("Invalid file name in physical backup: %q", name)
+		}
+		path := filepath.Join(opt.Dir, name)
+		switch {
+		case name == ManifestFilename:
+			path = filepath.Join(opt.Dir, physicalRestoreManifest)
+		case strings.HasSuffix(name, ".vlog"), strings.HasSuffix(name, ".holes"),
+			strings.HasSuffix(name, blobFileSuffix):
+			path = filepath.Join(opt.ValueDir, name)
+		}
+		if err := restorePhysicalFile(path, tr); err != nil {
+			return errors.Wrapf(err, "while restoring %s", name)
+		}
+	}
+	if err := syncDir(opt.ValueDir); err != nil {
+		return err
+	}
+	// The MANIFEST is renamed last, so that an interrupted restore isn't mistaken for a DB.
+	if err := os.Rename(filepath.Join(opt.Dir, physicalRestoreManifest),
+		filepath.Join(opt.Dir, ManifestFilename)); err != nil {
+		return errors.Wrapf(err, "while restoring %s", ManifestFilename)
+	}
+	return syncDir(opt.Dir)
+}
+
+func restorePhysicalFile(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Sync()
+}
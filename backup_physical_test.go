@@ -0,0 +1,93 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPhysicalBackup(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	bigVal := bytes.Repeat([]byte("v"), 2<<10)
+	var bb bytes.Buffer
+	opt := getTestOptions("").
+		WithMemTableSize(1 << 16).
+		WithValueThreshold(1 << 10).
+		WithEncryptionKey(key).
+		WithIndexCacheSize(1 << 20)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		for i := 0; i < 100; i++ {
+			val := []byte("a")
+			if i%2 == 0 {
+				val = bigVal
+			}
+			txnSet(t, db, []byte(fmt.Sprintf("key%03d", i)), val, 0)
+		}
+		// Writes made while the files are copied work, and aren't in the backup.
+		var once sync.Once
+		w := hookWriter{Writer: &bb, hook: func() {
+			once.Do(func() { txnSet(t, db, []byte("later"), []byte("b"), 0) })
+		}}
+		require.NoError(t, db.PhysicalBackup(w))
+	})
+
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt.Dir, opt.ValueDir = dir, dir
+	require.NoError(t, RestorePhysicalBackup(&bb, opt))
+	// The backup can't be restored over a DB.
+	require.Error(t, RestorePhysicalBackup(bytes.NewReader(nil), opt))
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 100; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%03d", i)))
+			require.NoError(t, err)
+			val, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			if i%2 == 0 {
+				require.Equal(t, bigVal, val)
+			} else {
+				require.Equal(t, []byte("a"), val)
+			}
+		}
+		_, err := txn.Get([]byte("later"))
+		require.Equal(t, ErrKeyNotFound, err)
+		return nil
+	}))
+}
+
+// hookWriter calls hook before each write to the Writer.
+type hookWriter struct {
+	io.Writer
+	hook func()
+}
+
+func (w hookWriter) Write(p []byte) (int, error) {
+	w.hook()
+	return w.Writer.Write(p)
+}
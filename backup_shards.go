@@ -0,0 +1,231 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+// ShardedBackupFilename is the name of the manifest of a sharded backup, in its directory.
+const ShardedBackupFilename = "SHARDS.json"
+
+// ShardedBackup is the manifest of a backup written as several shards in parallel by
+// DB.BackupSharded. It's written as JSON.
+type ShardedBackup struct {
+	SinceTs uint64
+	// ReadTs is the timestamp the shards were all read at.
+	ReadTs uint64
+	Shards []BackupShard
+}
+
+// BackupShard is a shard of a ShardedBackup, holding the keys in Range.
+type BackupShard struct {
+	File  string
+	Range StreamRange
+	Size  int64
+	// Checksum is the hex-encoded SHA-256 checksum of the file.
+	Checksum   string
+	MaxVersion uint64
+}
+
+// ReadShardedBackup reads the manifest of the sharded backup in dir.
+func ReadShardedBackup(dir string) (*ShardedBackup, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ShardedBackupFilename))
+	if err != nil {
+		return nil, err
+	}
+	var s ShardedBackup
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, errors.Wrapf(err, "while decoding the sharded backup manifest in %s", dir)
+	}
+	return &s, nil
+}
+
+// BackupSharded works like DB.BackupWithOptions, but splits the key space into about numShards
+// partitions of similar sizes, and writes the backup of each one to its own file in dir, in
+// parallel. The shards are all read from the same snapshot of the DB. The manifest tying them
+// together is written once all of them are, see ShardedBackup. DB.LoadSharded restores the
+// shards concurrently.
+func (db *DB) BackupSharded(dir string, since uint64, numShards int,
+	opt BackupOptions) (*ShardedBackup, error) {
+
+	if _, err := os.Stat(filepath.Join(dir, ShardedBackupFilename)); err == nil {
+		return nil, errors.Wrapf(ErrInvalidRequest, "%s already holds a sharded backup", dir)
+	}
+	snap := db.Snapshot()
+	defer snap.Release()
+
+	var prefixes []StreamRange
+	for _, prefix := range opt.Prefixes {
+		prefixes = append(prefixes, PrefixStreamRange(prefix))
+	}
+	prefixes = mergeStreamRanges(prefixes)
+
+	s := &ShardedBackup{SinceTs: since, ReadTs: snap.readTs}
+	for _, kr := range db.ranges(commonPrefix(opt.Prefixes), numShards) {
+		r := StreamRange{Start: kr.left, End: kr.right}
+		if len(prefixes) > 0 && len(intersectRanges(*kr, prefixes)) == 0 {
+			// None of the selected keys are in this partition.
+			continue
+		}
+		s.Shards = append(s.Shards, BackupShard{
+			File:  fmt.Sprintf("shard-%04d.bak", len(s.Shards)),
+			Range: r,
+		})
+	}
+
+	throttle := y.NewThrottle(len(s.Shards))
+	for i := range s.Shards {
+		if err := throttle.Do(); err != nil {
+			// Wait for the shards being written before returning.
+			_ = throttle.Finish()
+			return nil, err
+		}
+		go func(shard *BackupShard) {
+			stream := snap.NewStream()
+			kr := keyRange{left: shard.Range.Start, right: shard.Range.End}
+			for _, part := range intersectRanges(kr, prefixes) {
+				stream.Ranges = append(stream.Ranges, StreamRange{Start: part.left, End: part.right})
+			}
+			var err error
+			shard.Size, shard.Checksum, err = writeBackupFile(filepath.Join(dir, shard.File),
+				func(w io.Writer) error {
+					var err error
+					shard.MaxVersion, err = db.backupStream(stream, w, since, opt)
+					return err
+				})
+			throttle.Done(errors.Wrapf(err, "while writing %s", shard.File))
+		}(&s.Shards[i])
+	}
+	if err := throttle.Finish(); err != nil {
+		return nil, err
+	}
+	if err := writeJSONFile(dir, ShardedBackupFilename, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// LoadSharded restores the sharded backup in dir, written by DB.BackupSharded. The shards are read
+// concurrently, and written with a StreamWriter: a full backup replaces the content of the DB,
+// like StreamWriter.Prepare does, and an incremental one is ingested into it, like
+// StreamWriter.PrepareIngest does. The sizes and checksums of the shards are verified before the
+// DB is prepared, and nothing is written to the DB if any of them differs from the manifest.
+func (db *DB) LoadSharded(dir string, opt LoadOptions) error {
+	s, err := ReadShardedBackup(dir)
+	if err != nil {
+		return err
+	}
+	throttle := y.NewThrottle(len(s.Shards))
+	for i := range s.Shards {
+		if err := throttle.Do(); err != nil {
+			_ = throttle.Finish()
+			return err
+		}
+		go func(shard BackupShard) {
+			throttle.Done(verifyBackupFile(dir, shard.File, shard.Size, shard.Checksum))
+		}(s.Shards[i])
+	}
+	if err := throttle.Finish(); err != nil {
+		return err
+	}
+	key := opt.EncryptionKey
+	if len(key) == 0 {
+		key = db.opt.EncryptionKey
+	}
+
+	sw := db.NewStreamWriter()
+	if s.SinceTs == 0 {
+		err = sw.Prepare()
+	} else {
+		err = sw.PrepareIngest()
+	}
+	if err != nil {
+		sw.Cancel()
+		return err
+	}
+
+	throttle = y.NewThrottle(len(s.Shards))
+	for i := range s.Shards {
+		if err := throttle.Do(); err != nil {
+			_ = throttle.Finish()
+			sw.Cancel()
+			return err
+		}
+		go func(i int) {
+			err := db.loadShard(sw, dir, s.Shards[i], uint32(i), uint32(len(s.Shards)), key,
+				opt)
+			throttle.Done(errors.Wrapf(err, "while loading %s", s.Shards[i].File))
+		}(i)
+	}
+	if err := throttle.Finish(); err != nil {
+		sw.Cancel()
+		return err
+	}
+	return sw.Flush()
+}
+
+// loadShard writes the shard to sw. The stream IDs of the shard are remapped so that they don't
+// collide with the ones of the other shards. The shard must have been verified.
+func (db *DB) loadShard(sw *StreamWriter, dir string, shard BackupShard, idx, numShards uint32,
+	key []byte, opt LoadOptions) error {
+
+	f, err := os.Open(filepath.Join(dir, shard.File))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br, err := newBackupReader(f, key)
+	if err != nil {
+		return err
+	}
+	defer br.Close()
+
+	buf := z.NewBuffer(1<<20, "DB.LoadSharded")
+	defer buf.Release()
+	for {
+		list, err := br.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		for _, kv := range filterUntilTs(list.Kv, opt.UntilTs) {
+			if len(opt.Prefixes) > 0 && !hasAnyPrefixes(kv.Key, opt.Prefixes) {
+				continue
+			}
+			kv.StreamId = kv.StreamId*numShards + idx
+			KVToBuffer(kv, buf)
+		}
+		if buf.LenNoPadding() >= 4<<20 {
+			if err := sw.Write(buf); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+	}
+	return sw.Write(buf)
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupSharded(t *testing.T) {
+	const n = 25000
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%c/key%05d", 'a'+i%2, i)) }
+	val := func(i int) []byte { return []byte(fmt.Sprintf("val%05d", i)) }
+
+	backup := func(t *testing.T, opt BackupOptions) string {
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+			wb := db.NewWriteBatch()
+			for i := 0; i < n; i++ {
+				require.NoError(t, wb.Set(key(i), val(i)))
+			}
+			require.NoError(t, wb.Flush())
+			txnDelete(t, db, key(0))
+
+			s, err := db.BackupSharded(dir, 0, 4, opt)
+			require.NoError(t, err)
+			require.NotEmpty(t, s.Shards)
+			for _, shard := range s.Shards {
+				require.NotZero(t, shard.Size)
+			}
+
+			_, err = db.BackupSharded(dir, 0, 4, opt)
+			require.Error(t, err)
+		})
+		return dir
+	}
+	restore := func(t *testing.T, dir string) (int, error) {
+		var count int
+		var err error
+		runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+			if err = db.LoadSharded(dir, LoadOptions{}); err != nil {
+				return
+			}
+			require.NoError(t, db.View(func(txn *Txn) error {
+				_, err := txn.Get(key(0))
+				require.Equal(t, ErrKeyNotFound, err)
+				it := txn.NewIterator(DefaultIteratorOptions)
+				defer it.Close()
+				for it.Rewind(); it.Valid(); it.Next() {
+					var i int
+					_, err := fmt.Sscanf(string(it.Item().Key()[2:]), "key%05d", &i)
+					require.NoError(t, err)
+					v, err := it.Item().ValueCopy(nil)
+					require.NoError(t, err)
+					require.Equal(t, val(i), v)
+					count++
+				}
+				return nil
+			}))
+		})
+		return count, err
+	}
+
+	dir := backup(t, BackupOptions{})
+	defer removeDir(dir)
+	count, err := restore(t, dir)
+	require.NoError(t, err)
+	require.Equal(t, n-1, count)
+
+	// A corrupted shard is detected.
+	s, err := ReadShardedBackup(dir)
+	require.NoError(t, err)
+	require.True(t, len(s.Shards) > 1)
+	path := filepath.Join(dir, s.Shards[len(s.Shards)-1].File)
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	i := bytes.LastIndex(data, []byte("val"))
+	require.True(t, i >= 0)
+	data[i] = 'V'
+	require.NoError(t, ioutil.WriteFile(path, data, 0666))
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txnSet(t, db, []byte("existing"), []byte("val"), 0)
+		err := db.LoadSharded(dir, LoadOptions{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "Checksum mismatch")
+		// The DB wasn't dropped.
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get([]byte("existing"))
+			return err
+		}))
+	})
+
+	dir = backup(t, BackupOptions{Prefixes: [][]byte{[]byte("b/")}, Checksum: true})
+	defer removeDir(dir)
+	count, err = restore(t, dir)
+	require.NoError(t, err)
+	require.Equal(t, n/2, count)
+}
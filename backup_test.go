@@ -18,17 +18,23 @@ package badger
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v3/options"
 	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -323,6 +329,53 @@ func TestBackup(t *testing.T) {
 	})
 }
 
+func TestBackupWithOptions(t *testing.T) {
+	keys := []string{"a/1", "a/2", "b/1", "b/2", "c/1"}
+	backup := func(t *testing.T, opt BackupOptions) []string {
+		var bb bytes.Buffer
+		runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+			for _, key := range keys {
+				txnSet(t, db, []byte(key), []byte("val"), 0)
+			}
+			// An expired entry.
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				e := NewEntry([]byte("a/3"), []byte("val"))
+				e.ExpiresAt = 1
+				return txn.SetEntry(e)
+			}))
+			_, err := db.BackupWithOptions(&bb, 0, opt)
+			require.NoError(t, err)
+		})
+
+		var restored []string
+		runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+			require.NoError(t, db.Load(&bb, 16))
+			require.NoError(t, db.View(func(txn *Txn) error {
+				iopt := DefaultIteratorOptions
+				iopt.AllVersions = true
+				it := txn.NewIterator(iopt)
+				defer it.Close()
+				for it.Rewind(); it.Valid(); it.Next() {
+					restored = append(restored, string(it.Item().Key()))
+				}
+				return nil
+			}))
+		})
+		return restored
+	}
+
+	require.Equal(t, []string{"a/1", "a/2", "a/3", "b/1", "b/2", "c/1"}, backup(t, BackupOptions{}))
+	require.Equal(t, []string{"a/1", "a/2", "a/3", "c/1"},
+		backup(t, BackupOptions{Prefixes: [][]byte{[]byte("a/"), []byte("c/")}}))
+	require.Equal(t, []string{"a/1", "a/2"},
+		backup(t, BackupOptions{Prefixes: [][]byte{[]byte("a/")}, SkipExpired: true}))
+	require.Equal(t, []string{"a/2", "b/2"}, backup(t, BackupOptions{
+		ChooseKey: func(item *Item) bool {
+			return bytes.HasSuffix(item.Key(), []byte("/2"))
+		},
+	}))
+}
+
 func TestBackupRestore3(t *testing.T) {
 	var bb bytes.Buffer
 	tmpdir, err := ioutil.TempDir("", "badger-test")
@@ -563,3 +616,365 @@ func TestBackupBitClear(t *testing.T) {
 		return nil
 	}))
 }
+
+func TestBackupThrottled(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		n := 1000
+		val := make([]byte, 1<<10)
+		wb := db.NewWriteBatch()
+		for i := 0; i < n; i++ {
+			require.NoError(t, wb.Set([]byte(fmt.Sprintf("key%06d", i)), val))
+		}
+		require.NoError(t, wb.Flush())
+
+		// About 1MB is scanned, which takes about half a second at 2MB/s.
+		var buf bytes.Buffer
+		start := time.Now()
+		_, err := db.BackupWithOptions(&buf, 0, BackupOptions{MaxBytesPerSec: 2 << 20})
+		require.NoError(t, err)
+		require.Greater(t, int64(time.Since(start)), int64(300*time.Millisecond))
+
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+		restored, err := Open(getTestOptions(dir))
+		require.NoError(t, err)
+		defer restored.Close()
+		require.NoError(t, restored.Load(&buf, 16))
+		user, _ := countKeys(t, restored)
+		require.Equal(t, n, user)
+	})
+}
+
+func TestBackupCompressedEncrypted(t *testing.T) {
+	key := []byte("badgerkey16bytes")
+	val := bytes.Repeat([]byte("compressible"), 100)
+	backup := func(t *testing.T, dbOpt *Options, opt BackupOptions) []byte {
+		var bb bytes.Buffer
+		runBadgerTest(t, dbOpt, func(t *testing.T, db *DB) {
+			for i := 0; i < 100; i++ {
+				txnSet(t, db, []byte(fmt.Sprintf("key%03d", i)), val, 0)
+			}
+			_, err := db.BackupWithOptions(&bb, 0, opt)
+			require.NoError(t, err)
+		})
+		return bb.Bytes()
+	}
+	load := func(t *testing.T, dbOpt *Options, data []byte, opt LoadOptions) error {
+		var err error
+		runBadgerTest(t, dbOpt, func(t *testing.T, db *DB) {
+			if err = db.LoadWithOptions(bytes.NewReader(data), 16, opt); err != nil {
+				return
+			}
+			require.NoError(t, db.View(func(txn *Txn) error {
+				for i := 0; i < 100; i++ {
+					item, err := txn.Get([]byte(fmt.Sprintf("key%03d", i)))
+					require.NoError(t, err)
+					got, err := item.ValueCopy(nil)
+					require.NoError(t, err)
+					require.Equal(t, val, got)
+				}
+				return nil
+			}))
+		})
+		return err
+	}
+	encOpt := getTestOptions("")
+	encOpt.EncryptionKey = key
+	encOpt.BlockCacheSize = 10 << 20
+	encOpt.IndexCacheSize = 10 << 20
+
+	plain := backup(t, nil, BackupOptions{})
+	require.NoError(t, load(t, nil, plain, LoadOptions{}))
+
+	compressed := backup(t, nil, BackupOptions{Compression: options.ZSTD})
+	require.Less(t, len(compressed), len(plain)/10)
+	require.NoError(t, load(t, nil, compressed, LoadOptions{}))
+
+	encrypted := backup(t, nil, BackupOptions{Compression: options.ZSTD, EncryptionKey: key})
+	require.False(t, bytes.Contains(encrypted, []byte("key000")))
+	require.NoError(t, load(t, nil, encrypted, LoadOptions{EncryptionKey: key}))
+	// The key of an encrypted DB is used by default.
+	require.NoError(t, load(t, &encOpt, encrypted, LoadOptions{}))
+	err := load(t, nil, encrypted, LoadOptions{})
+	require.Equal(t, ErrEncryptionKeyMismatch, errors.Cause(err))
+	err = load(t, nil, encrypted, LoadOptions{EncryptionKey: []byte("otherkey16bytes!")})
+	require.Equal(t, ErrEncryptionKeyMismatch, errors.Cause(err))
+
+	// The backups of an encrypted DB are plain by default, and encrypted with its key on demand.
+	plain = backup(t, &encOpt, BackupOptions{})
+	require.True(t, bytes.Contains(plain, val))
+	require.NoError(t, load(t, nil, plain, LoadOptions{}))
+	encrypted = backup(t, &encOpt, BackupOptions{EncryptWithDBKey: true})
+	require.False(t, bytes.Contains(encrypted, val))
+	require.NoError(t, load(t, nil, encrypted, LoadOptions{EncryptionKey: key}))
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		_, err := db.BackupWithOptions(ioutil.Discard, 0, BackupOptions{Compression: options.Snappy})
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+		_, err = db.BackupWithOptions(ioutil.Discard, 0, BackupOptions{EncryptWithDBKey: true})
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+	})
+}
+
+func TestBackupLoadUntilTs(t *testing.T) {
+	var bb bytes.Buffer
+	var ts []uint64
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txnSet(t, db, []byte("k1"), []byte("a"), 0)
+		txnSet(t, db, []byte("k2"), []byte("b"), 0)
+		ts = append(ts, db.MaxVersion())
+		since, err := db.Backup(&bb, 0)
+		require.NoError(t, err)
+
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.SetEntry(NewEntry([]byte("k1"), []byte("c")).WithDiscard())
+		}))
+		ts = append(ts, db.MaxVersion())
+		txnDelete(t, db, []byte("k2"))
+		txnSet(t, db, []byte("k3"), []byte("d"), 0)
+		ts = append(ts, db.MaxVersion())
+		// The stream of the backup only reads the versions above since.
+		_, err = db.Backup(&bb, since)
+		require.NoError(t, err)
+	})
+
+	restore := func(untilTs uint64) map[string]string {
+		got := make(map[string]string)
+		runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+			require.NoError(t, db.LoadWithOptions(bytes.NewReader(bb.Bytes()), 16,
+				LoadOptions{UntilTs: untilTs}))
+			require.NoError(t, db.View(func(txn *Txn) error {
+				it := txn.NewIterator(DefaultIteratorOptions)
+				defer it.Close()
+				for it.Rewind(); it.Valid(); it.Next() {
+					v, err := it.Item().ValueCopy(nil)
+					require.NoError(t, err)
+					got[string(it.Item().Key())] = string(v)
+				}
+				return nil
+			}))
+		})
+		return got
+	}
+
+	// The delete marker written below the discarding version of k1 isn't restored with it.
+	require.Equal(t, map[string]string{"k1": "a", "k2": "b"}, restore(ts[0]))
+	require.Equal(t, map[string]string{"k1": "c", "k2": "b"}, restore(ts[1]))
+	require.Equal(t, map[string]string{"k1": "c", "k3": "d"}, restore(ts[2]))
+	require.Equal(t, map[string]string{"k1": "c", "k3": "d"}, restore(0))
+}
+
+func TestBackupIndexLoadPrefixes(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	var bb bytes.Buffer
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		for _, p := range []string{"a", "b", "c"} {
+			for i := 0; i < 10; i++ {
+				txnSet(t, db, []byte(fmt.Sprintf("%s%02d", p, i)), []byte("v"), 0)
+			}
+		}
+		_, err := db.BackupWithOptions(&bb, 0, BackupOptions{
+			Compression:   options.ZSTD,
+			EncryptionKey: key,
+			Index:         true,
+		})
+		require.NoError(t, err)
+	})
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.LoadWithOptions(bytes.NewReader(bb.Bytes()), 16,
+			LoadOptions{EncryptionKey: key, Prefixes: [][]byte{[]byte("b")}}))
+		var keys []string
+		require.NoError(t, db.View(func(txn *Txn) error {
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				keys = append(keys, string(it.Item().Key()))
+			}
+			return nil
+		}))
+		require.Len(t, keys, 10)
+		for _, k := range keys {
+			require.True(t, strings.HasPrefix(k, "b"), k)
+		}
+	})
+
+	// Without a seekable reader, the whole backup is read.
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.LoadWithOptions(bytes.NewBuffer(bb.Bytes()), 16,
+			LoadOptions{EncryptionKey: key}))
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get([]byte("c09"))
+			return err
+		}))
+	})
+}
+
+func TestBackupIndexSeek(t *testing.T) {
+	var bb bytes.Buffer
+	bb.WriteString("prefix")
+	bw, err := newBackupWriter(&bb, options.None, 0, nil, false, true)
+	require.NoError(t, err)
+	for _, p := range []string{"a", "b", "c"} {
+		for i := 0; i < 3; i++ {
+			list := &pb.KVList{}
+			for j := 0; j < 10; j++ {
+				list.Kv = append(list.Kv, &pb.KV{
+					Key:     []byte(fmt.Sprintf("%s%d%02d", p, i, j)),
+					Version: 1,
+				})
+			}
+			require.NoError(t, bw.writeList(list))
+		}
+	}
+	require.NoError(t, bw.Close())
+
+	r := bytes.NewReader(bb.Bytes())
+	_, err = r.Seek(int64(len("prefix")), io.SeekStart)
+	require.NoError(t, err)
+	br, err := newBackupReader(r, nil)
+	require.NoError(t, err)
+	defer br.Close()
+	require.NoError(t, br.seekPrefixes(r, int64(len("prefix")), [][]byte{[]byte("b1")}))
+	require.Len(t, br.chunks, 1)
+	list, err := br.next()
+	require.NoError(t, err)
+	require.Equal(t, "b100", string(list.Kv[0].Key))
+	_, err = br.next()
+	require.Equal(t, io.EOF, err)
+
+	// A corrupt chunk is detected when reading the backup sequentially.
+	data := append([]byte{}, bb.Bytes()[len("prefix"):]...)
+	data[backupHeaderSize+backupFrameHeaderSize] ^= 1
+	br, err = newBackupReader(bytes.NewReader(data), nil)
+	require.NoError(t, err)
+	_, err = br.next()
+	require.Equal(t, y.ErrChecksumMismatch, errors.Cause(err))
+}
+
+func TestLoadWithContextProgress(t *testing.T) {
+	var bb bytes.Buffer
+	for i := 0; i < 5; i++ {
+		list := &pb.KVList{}
+		for j := 0; j < 10; j++ {
+			list.Kv = append(list.Kv, &pb.KV{
+				Key:     []byte(fmt.Sprintf("key%d%d", i, j)),
+				Value:   []byte("val"),
+				Version: uint64(5 - i),
+			})
+		}
+		require.NoError(t, writeTo(list, &bb))
+	}
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := db.LoadWithContext(ctx, bytes.NewReader(bb.Bytes()), 16, LoadOptions{})
+		require.Equal(t, context.Canceled, err)
+	})
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		var progress []LoadProgress
+		require.NoError(t, db.LoadWithContext(context.Background(), bytes.NewReader(bb.Bytes()),
+			16, LoadOptions{
+				SkipLists: 2,
+				Progress:  func(p LoadProgress) { progress = append(progress, p) },
+			}))
+		require.NotEmpty(t, progress)
+		require.Equal(t, LoadProgress{Lists: 5, Entries: 30, Bytes: 30 * 8},
+			progress[len(progress)-1])
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get([]byte("key19"))
+			require.Equal(t, ErrKeyNotFound, err)
+			_, err = txn.Get([]byte("key20"))
+			require.NoError(t, err)
+			return nil
+		}))
+		// The versions of the skipped lists are accounted for.
+		require.Equal(t, uint64(6), db.orc.nextTxnTs)
+	})
+}
+
+func TestLoadConflictPolicies(t *testing.T) {
+	var bb bytes.Buffer
+	list := &pb.KVList{Kv: []*pb.KV{
+		{Key: []byte("a"), Value: []byte("backup-a"), Version: 1},
+		{Key: []byte("b"), Value: []byte("backup-b"), Version: 10},
+		{Key: []byte("c"), Value: []byte("backup-c"), Version: 1},
+	}}
+	require.NoError(t, writeTo(list, &bb))
+
+	check := func(t *testing.T, db *DB, expected map[string]string) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for k, v := range expected {
+				item, err := txn.Get([]byte(k))
+				require.NoError(t, err)
+				val, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				require.Equal(t, v, string(val), k)
+			}
+			return nil
+		}))
+	}
+	load := func(t *testing.T, db *DB, opt LoadOptions) {
+		// Keys "a" and "b" are written at versions 1 and 2.
+		txnSet(t, db, []byte("a"), []byte("db-a"), 0)
+		txnSet(t, db, []byte("b"), []byte("db-b"), 0)
+		require.NoError(t, db.LoadWithOptions(bytes.NewReader(bb.Bytes()), 16, opt))
+	}
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		load(t, db, LoadOptions{Conflicts: LoadSkipExisting})
+		check(t, db, map[string]string{"a": "db-a", "b": "db-b", "c": "backup-c"})
+	})
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		load(t, db, LoadOptions{Conflicts: LoadKeepNewest})
+		check(t, db, map[string]string{"a": "db-a", "b": "backup-b", "c": "backup-c"})
+	})
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		load(t, db, LoadOptions{Conflicts: LoadOverwrite})
+		check(t, db, map[string]string{"a": "backup-a", "b": "backup-b", "c": "backup-c"})
+		// The version written above the one of "a" is a commit timestamp of its own.
+		txnSet(t, db, []byte("d"), []byte("db-d"), 0)
+		require.NoError(t, db.View(func(txn *Txn) error {
+			a, err := txn.Get([]byte("a"))
+			require.NoError(t, err)
+			b, err := txn.Get([]byte("b"))
+			require.NoError(t, err)
+			d, err := txn.Get([]byte("d"))
+			require.NoError(t, err)
+			require.Greater(t, a.Version(), b.Version())
+			require.Less(t, a.Version(), d.Version())
+			return nil
+		}))
+	})
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		merge := func(existing, val []byte) []byte {
+			return append(append(append([]byte{}, existing...), '+'), val...)
+		}
+		load(t, db, LoadOptions{Conflicts: LoadMerge, Merge: merge})
+		check(t, db, map[string]string{
+			"a": "db-a+backup-a", "b": "db-b+backup-b", "c": "backup-c"})
+	})
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		err := db.LoadWithOptions(bytes.NewReader(bb.Bytes()), 16,
+			LoadOptions{Conflicts: LoadMerge})
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+	})
+}
+
+func TestKVLoaderUserMetaExtTooLong(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		loader := db.NewKVLoader(16)
+		err := loader.Set(&pb.KV{
+			Key:      []byte("key"),
+			Value:    []byte("val"),
+			UserMeta: make([]byte, 2+MaxUserMetaExtSize),
+			Version:  1,
+		})
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+		require.NoError(t, loader.Finish())
+	})
+}
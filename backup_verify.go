@@ -0,0 +1,163 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/pkg/errors"
+)
+
+// VerifyBackupOptions configures DB.VerifyBackup.
+type VerifyBackupOptions struct {
+	// EncryptionKey decrypts an encrypted backup. If empty, Options.EncryptionKey is used.
+	EncryptionKey []byte
+	// SampleRate is the fraction of the keys of the backup compared against the DB, between 0 and
+	// 1. The DB is read at the version of the latest backed up version of each sampled key, so
+	// that version must not have been discarded since the backup was taken.
+	SampleRate float64
+}
+
+// BackupVerification reports what DB.VerifyBackup read.
+type BackupVerification struct {
+	// Lists and Entries count the lists of entries and the entries of the backup.
+	Lists      int
+	Entries    int
+	MaxVersion uint64
+	// Sampled counts the keys compared against the DB, and Mismatches those that differed.
+	Sampled    int
+	Mismatches int
+}
+
+// VerifyBackup reads a backup written by DB.Backup without loading it, and returns an error if
+// it's corrupted. The CRCs of checksummed backups are validated, and a sample of the keys can be
+// compared against the DB, see VerifyBackupOptions.SampleRate.
+func (db *DB) VerifyBackup(r io.Reader, opt VerifyBackupOptions) (*BackupVerification, error) {
+	res := &BackupVerification{}
+	if err := db.verifyBackup(r, opt, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// VerifyBackupCatalog verifies the chain of backups in dir: the chain has no gaps, the sizes and
+// checksums of the files match the catalog, and each backup is verified like DB.VerifyBackup does.
+func (db *DB) VerifyBackupCatalog(dir string,
+	opt VerifyBackupOptions) (*BackupVerification, error) {
+
+	c, err := ReadBackupCatalog(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Verify(); err != nil {
+		return nil, err
+	}
+	res := &BackupVerification{}
+	for _, b := range c.Backups {
+		if err := verifyBackupFile(dir, b.File, b.Size, b.Checksum); err != nil {
+			return nil, err
+		}
+		f, err := os.Open(filepath.Join(dir, b.File))
+		if err != nil {
+			return nil, err
+		}
+		err = db.verifyBackup(f, opt, res)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "while verifying backup %s", b.File)
+		}
+	}
+	return res, nil
+}
+
+func (db *DB) verifyBackup(r io.Reader, opt VerifyBackupOptions, res *BackupVerification) error {
+	key := opt.EncryptionKey
+	if len(key) == 0 {
+		key = db.opt.EncryptionKey
+	}
+	br, err := newBackupReader(r, key)
+	if err != nil {
+		return err
+	}
+	defer br.Close()
+
+	for {
+		list, err := br.next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "while reading list %d of the backup", res.Lists)
+		}
+		res.Lists++
+		var last []byte
+		for _, kv := range list.Kv {
+			res.Entries++
+			if kv.Version > res.MaxVersion {
+				res.MaxVersion = kv.Version
+			}
+			// Only the latest version of each key is sampled. The earlier ones may have been
+			// discarded by it.
+			if bytes.Equal(kv.Key, last) {
+				continue
+			}
+			last = kv.Key
+			if opt.SampleRate <= 0 || rand.Float64() >= opt.SampleRate {
+				continue
+			}
+			res.Sampled++
+			match, err := db.matchBackupKV(kv)
+			if err != nil {
+				return err
+			}
+			if !match {
+				res.Mismatches++
+			}
+		}
+	}
+}
+
+// matchBackupKV tells if the DB holds kv at its version.
+func (db *DB) matchBackupKV(kv *pb.KV) (bool, error) {
+	var meta byte
+	if len(kv.Meta) > 0 {
+		meta = kv.Meta[0]
+	}
+	txn := db.newReadTxnAt(kv.Version)
+	defer txn.Discard()
+	item, err := txn.Get(kv.Key)
+	if err == ErrKeyNotFound {
+		return isDeletedOrExpired(meta, kv.ExpiresAt), nil
+	} else if err != nil {
+		return false, err
+	}
+	if isDeletedOrExpired(meta, kv.ExpiresAt) || item.Version() != kv.Version ||
+		item.ExpiresAt() != kv.ExpiresAt ||
+		!bytes.Equal(joinUserMeta(item.UserMeta(), item.UserMetaExt()), kv.UserMeta) {
+		return false, nil
+	}
+	match := false
+	err = item.Value(func(val []byte) error {
+		match = bytes.Equal(val, kv.Value)
+		return nil
+	})
+	return match, err
+}
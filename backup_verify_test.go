@@ -0,0 +1,96 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyBackup(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		for i := 0; i < 50; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("val%03d", i)), 0)
+		}
+		txnSet(t, db, []byte("key000"), []byte("newer"), 0)
+		txnDelete(t, db, []byte("key001"))
+
+		var plain, checksummed bytes.Buffer
+		_, err := db.Backup(&plain, 0)
+		require.NoError(t, err)
+		_, err = db.BackupWithOptions(&checksummed, 0, BackupOptions{Checksum: true})
+		require.NoError(t, err)
+
+		for _, data := range [][]byte{plain.Bytes(), checksummed.Bytes()} {
+			res, err := db.VerifyBackup(bytes.NewReader(data), VerifyBackupOptions{SampleRate: 1})
+			require.NoError(t, err)
+			require.Equal(t, 51, res.Entries)
+			require.Equal(t, db.MaxVersion(), res.MaxVersion)
+			require.Equal(t, 50, res.Sampled)
+			require.Zero(t, res.Mismatches)
+		}
+
+		// A corrupted value is only detected by sampling in a plain backup.
+		corrupt := func(data []byte) []byte {
+			data = append([]byte{}, data...)
+			i := bytes.Index(data, []byte("val042"))
+			require.True(t, i >= 0)
+			data[i+5] = '3'
+			return data
+		}
+		res, err := db.VerifyBackup(bytes.NewReader(corrupt(plain.Bytes())),
+			VerifyBackupOptions{SampleRate: 1})
+		require.NoError(t, err)
+		require.Equal(t, 1, res.Mismatches)
+
+		_, err = db.VerifyBackup(bytes.NewReader(corrupt(checksummed.Bytes())),
+			VerifyBackupOptions{})
+		require.Equal(t, y.ErrChecksumMismatch, errors.Cause(err))
+
+		// Truncated backups are detected too.
+		_, err = db.VerifyBackup(bytes.NewReader(plain.Bytes()[:plain.Len()-1]),
+			VerifyBackupOptions{})
+		require.Error(t, err)
+	})
+}
+
+func TestVerifyBackupCatalog(t *testing.T) {
+	backupDir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(backupDir)
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txnSet(t, db, []byte("a"), []byte("1"), 0)
+		_, err := db.BackupToCatalog(backupDir, BackupOptions{Checksum: true})
+		require.NoError(t, err)
+		txnSet(t, db, []byte("b"), []byte("2"), 0)
+		_, err = db.BackupToCatalog(backupDir, BackupOptions{Checksum: true})
+		require.NoError(t, err)
+
+		res, err := db.VerifyBackupCatalog(backupDir, VerifyBackupOptions{SampleRate: 1})
+		require.NoError(t, err)
+		require.Equal(t, 2, res.Entries)
+		require.Equal(t, 2, res.Sampled)
+		require.Zero(t, res.Mismatches)
+	})
+}
@@ -18,16 +18,37 @@ package cmd
 
 import (
 	"bufio"
+	"context"
+	"fmt"
+	"io"
 	"math"
 	"os"
+	"strings"
 
 	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/objstore"
+	"github.com/dgraph-io/badger/v3/options"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
 var bo = struct {
-	backupFile  string
-	numVersions int
+	backupFile        string
+	numVersions       int
+	partSize          int
+	uploadConcurrency int
+	catalogDir        string
+	compressionType   uint32
+	keyPath           string
+	backupKeyPath     string
+	encrypt           bool
+	verify            bool
+	shardsDir         string
+	numShards         int
+	verifySampleRate  float64
+	index             bool
+	physical          bool
+	newChain          bool
 }{}
 
 // backupCmd represents the backup command
@@ -39,7 +60,41 @@ var backupCmd = &cobra.Command{
 Iterates over each key-value pair, encodes it along with its metadata and
 version in protocol buffers and writes them to a file. This file can later be
 used by the restore command to create an identical copy of the
-database.`,
+database.
+
+The backup file can also be an object URL, s3://bucket/key for S3, gs://bucket/key for GCS,
+az://container/blob for Azure Blob Storage or sftp://[user@]host[:port]/path for an SFTP server,
+in which case the backup is uploaded directly. For S3 and GCS, the credentials are read from the
+environment variables AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN (the HMAC
+keys for GCS), the region from AWS_REGION, and the endpoint of other S3-compatible services from
+S3_ENDPOINT. For Azure, the account and its key are read from AZURE_STORAGE_ACCOUNT and
+AZURE_STORAGE_KEY, and the endpoint from AZURE_STORAGE_ENDPOINT. For SFTP, ssh is run to connect
+to the server, and must be able to authenticate without prompting.
+
+With --catalog, the backup is added to the chain of backups in the given directory: the first
+one is a full backup, and the following ones are incremental backups of the versions written
+since the previous one. The restore command can restore the whole chain. With --new-chain, a
+full backup starting a new chain is added instead. The chains that are no longer needed can be
+deleted with the prune subcommand.
+
+The backup can be compressed with ZSTD. It isn't encrypted by default, even if the database is:
+it's encrypted with the key given by --backup-key-file, or with the encryption key of the
+database with --encrypt.
+
+With --shards-dir, the key space is split into --num-shards partitions, backed up in parallel
+to one file each in the given directory, along with a manifest. The restore command restores
+the shards concurrently.
+
+With --verify, the backup is checksummed, and read back once written: the checksums are
+validated, and a sample of the keys is compared against the database.
+
+With --index, the backup is written in the version 2 format, with an index of the key ranges of
+its chunks, so that restore --prefix only reads the chunks it needs.
+
+With --physical, the files of the database are copied to the backup file as a tar archive, which
+is much faster for large databases. It must be restored with restore --physical, by a version of
+Badger with the same data format. The writes to the database fail while its files are picked, as it
+is frozen and its queued memtables are flushed.`,
 	RunE: doBackup,
 }
 
@@ -49,12 +104,66 @@ func init() {
 		"badger.bak", "File to backup to")
 	backupCmd.Flags().IntVarP(&bo.numVersions, "num-versions", "n",
 		0, "Number of versions to keep. A value <= 0 means keep all versions.")
+	backupCmd.Flags().IntVar(&bo.partSize, "part-size", 64,
+		"Size in MB of the parts uploaded, when backing up to an object URL.")
+	backupCmd.Flags().IntVar(&bo.uploadConcurrency, "upload-concurrency", 4,
+		"Number of parts uploaded at once, when backing up to an object URL.")
+	backupCmd.Flags().StringVar(&bo.catalogDir, "catalog", "",
+		"Directory of a backup chain to add the backup to, instead of backing up to a file.")
+	backupCmd.Flags().Uint32Var(&bo.compressionType, "compression", 0,
+		"Compression of the backup. 0 to disable, and 2 for ZSTD.")
+	backupCmd.Flags().StringVar(&bo.keyPath, "encryption-key-file", "",
+		"Path of the encryption key file of the database.")
+	backupCmd.Flags().StringVar(&bo.backupKeyPath, "backup-key-file", "",
+		"Path of the key file to encrypt the backup with.")
+	backupCmd.Flags().BoolVar(&bo.encrypt, "encrypt", false,
+		"Encrypt the backup with the encryption key of the database, if --backup-key-file "+
+			"isn't given.")
+	backupCmd.Flags().StringVar(&bo.shardsDir, "shards-dir", "",
+		"Directory to write a sharded backup to, instead of backing up to a file.")
+	backupCmd.Flags().IntVar(&bo.numShards, "num-shards", 8,
+		"Number of shards of a sharded backup.")
+	backupCmd.Flags().BoolVar(&bo.verify, "verify", false,
+		"Verify the backup once written.")
+	backupCmd.Flags().Float64Var(&bo.verifySampleRate, "verify-sample-rate", 0.01,
+		"Fraction of the keys compared against the database by --verify.")
+	backupCmd.Flags().BoolVar(&bo.index, "index", false,
+		"Write the backup in the version 2 format, with an index for selective restores.")
+	backupCmd.Flags().BoolVar(&bo.physical, "physical", false,
+		"Copy the files of the database, instead of backing up its entries.")
+	backupCmd.Flags().BoolVar(&bo.newChain, "new-chain", false,
+		"With --catalog, start a new chain with a full backup.")
 }
 
 func doBackup(cmd *cobra.Command, args []string) error {
+	encKey, err := getKey(bo.keyPath)
+	if err != nil {
+		return err
+	}
+	backupKey, err := getKey(bo.backupKeyPath)
+	if err != nil {
+		return err
+	}
+	if bo.compressionType != uint32(options.None) && bo.compressionType != uint32(options.ZSTD) {
+		return errors.Errorf("compression value must be one of 0 (disabled) or 2 (ZSTD)")
+	}
+	backupOpt := badger.BackupOptions{
+		Compression:      options.CompressionType(bo.compressionType),
+		EncryptionKey:    backupKey,
+		EncryptWithDBKey: bo.encrypt,
+		Checksum:         bo.verify,
+		Index:            bo.index,
+		NewChain:         bo.newChain,
+	}
+	verifyOpt := badger.VerifyBackupOptions{
+		EncryptionKey: backupKey,
+		SampleRate:    bo.verifySampleRate,
+	}
+
 	opt := badger.DefaultOptions(sstDir).
 		WithValueDir(vlogDir).
-		WithNumVersionsToKeep(math.MaxInt32)
+		WithNumVersionsToKeep(math.MaxInt32).
+		WithEncryptionKey(encKey)
 
 	if bo.numVersions > 0 {
 		opt.NumVersionsToKeep = bo.numVersions
@@ -67,6 +176,40 @@ func doBackup(cmd *cobra.Command, args []string) error {
 	}
 	defer db.Close()
 
+	if bo.physical {
+		return physicalBackup(db)
+	}
+
+	if bo.shardsDir != "" {
+		if bo.verify {
+			return errors.Errorf("--verify isn't supported for sharded backups")
+		}
+		s, err := db.BackupSharded(bo.shardsDir, 0, bo.numShards, backupOpt)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Backed up to %d shards in %s\n", len(s.Shards), bo.shardsDir)
+		return nil
+	}
+
+	if bo.catalogDir != "" {
+		entry, err := db.BackupToCatalog(bo.catalogDir, backupOpt)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Backed up versions (%d, %d] to %s\n",
+			entry.SinceTs, entry.NextSinceTs, entry.File)
+		if !bo.verify {
+			return nil
+		}
+		res, err := db.VerifyBackupCatalog(bo.catalogDir, verifyOpt)
+		return reportVerification(res, err)
+	}
+
+	if strings.Contains(bo.backupFile, "://") {
+		return backupToStorage(db, backupOpt, verifyOpt)
+	}
+
 	// Create File
 	f, err := os.Create(bo.backupFile)
 	if err != nil {
@@ -74,7 +217,7 @@ func doBackup(cmd *cobra.Command, args []string) error {
 	}
 
 	bw := bufio.NewWriterSize(f, 64<<20)
-	if _, err = db.Backup(bw, 0); err != nil {
+	if _, err = db.BackupWithOptions(bw, 0, backupOpt); err != nil {
 		return err
 	}
 
@@ -86,5 +229,81 @@ func doBackup(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if !bo.verify {
+		return nil
+	}
+	if f, err = os.Open(bo.backupFile); err != nil {
+		return err
+	}
+	defer f.Close()
+	res, err := db.VerifyBackup(f, verifyOpt)
+	return reportVerification(res, err)
+}
+
+// physicalBackup copies the files of db to the backup file.
+func physicalBackup(db *badger.DB) error {
+	f, err := os.Create(bo.backupFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriterSize(f, 64<<20)
+	if err := db.PhysicalBackup(bw); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
 	return f.Close()
 }
+
+func reportVerification(res *badger.BackupVerification, err error) error {
+	if err != nil {
+		return errors.Wrapf(err, "backup verification failed")
+	}
+	fmt.Printf("Verified %d entries in %d lists. Sampled keys: %d, mismatches: %d\n",
+		res.Entries, res.Lists, res.Sampled, res.Mismatches)
+	if res.Mismatches > 0 {
+		return errors.Errorf("backup verification failed: %d of the %d sampled keys differ "+
+			"from the database", res.Mismatches, res.Sampled)
+	}
+	return nil
+}
+
+func backupToStorage(db *badger.DB, backupOpt badger.BackupOptions,
+	verifyOpt badger.VerifyBackupOptions) error {
+	ctx := context.Background()
+	opt := objstore.DefaultOptions()
+	opt.PartSize = bo.partSize << 20
+	opt.Concurrency = bo.uploadConcurrency
+	st, name, err := objstore.OpenStorage(ctx, bo.backupFile, opt)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := db.BackupWithOptions(pw, 0, backupOpt)
+		pw.CloseWithError(err)
+	}()
+	err = st.Put(ctx, name, pr)
+	// Unblock the backup if the upload failed.
+	pr.CloseWithError(err)
+	if err != nil || !bo.verify {
+		return err
+	}
+
+	r, err := st.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	res, err := db.VerifyBackup(r, verifyOpt)
+	return reportVerification(res, err)
+}
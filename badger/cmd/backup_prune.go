@@ -0,0 +1,74 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/spf13/cobra"
+)
+
+var backupPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete the backup chains that are no longer needed.",
+	Long: `Delete the chains of backups of a catalog written by backup --catalog that hold
+none of the backups to keep.
+
+--keep-daily keeps the last backup of each of the last days with backups, and --keep-weekly the
+last backup of each of the last weeks with backups. The chain of each kept backup is kept whole,
+so a full backup is never deleted while an incremental backup depending on it is kept. The last
+chain is always kept, since the next backups are added to it.`,
+	// The database isn't opened, so --dir isn't needed.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error { return nil },
+	RunE:              doBackupPrune,
+}
+
+var pruneOpts = struct {
+	catalogDir string
+	keepDaily  int
+	keepWeekly int
+}{}
+
+func init() {
+	backupCmd.AddCommand(backupPruneCmd)
+	backupPruneCmd.Flags().StringVar(&pruneOpts.catalogDir, "catalog", "",
+		"Directory of the backup catalog to prune.")
+	backupPruneCmd.Flags().IntVar(&pruneOpts.keepDaily, "keep-daily", 0,
+		"Number of days to keep the last backup of.")
+	backupPruneCmd.Flags().IntVar(&pruneOpts.keepWeekly, "keep-weekly", 0,
+		"Number of weeks to keep the last backup of.")
+}
+
+func doBackupPrune(cmd *cobra.Command, args []string) error {
+	if pruneOpts.catalogDir == "" {
+		return errors.New("--catalog not specified")
+	}
+	deleted, err := badger.PruneBackupCatalog(pruneOpts.catalogDir, badger.BackupRetention{
+		KeepDaily:  pruneOpts.keepDaily,
+		KeepWeekly: pruneOpts.keepWeekly,
+	})
+	if err != nil {
+		return err
+	}
+	for _, file := range deleted {
+		fmt.Printf("Deleted %s\n", file)
+	}
+	fmt.Printf("Deleted %d backups\n", len(deleted))
+	return nil
+}
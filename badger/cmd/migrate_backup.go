@@ -0,0 +1,126 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/options"
+	"github.com/spf13/cobra"
+)
+
+var migrateBackupCmd = &cobra.Command{
+	Use:   "migrate-backup",
+	Short: "Rewrite a backup of an older version of Badger in the current format.",
+	Long: `Rewrite a backup written by Badger v1, v2 or v3 in the format of this version, so that
+it can be restored by it.
+
+The backup can be plain, or compressed, encrypted, checksummed or indexed. It's decrypted with
+the key given by --backup-key-file, and the migrated backup is written with the format given by
+--compression, --encryption-key-file and --index.
+
+Physical backups hold the files of the database, which can't be converted. They're copied as is
+if they have the data format of this version, and must otherwise be restored with the version of
+Badger that wrote them, and backed up again with the backup command.`,
+	// The database isn't opened, so --dir isn't needed.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error { return nil },
+	RunE:              doMigrateBackup,
+}
+
+var migrateOpts = struct {
+	inFile          string
+	outFile         string
+	backupKeyPath   string
+	keyPath         string
+	compressionType uint32
+	index           bool
+}{}
+
+func init() {
+	RootCmd.AddCommand(migrateBackupCmd)
+	migrateBackupCmd.Flags().StringVarP(&migrateOpts.inFile, "in", "i", "",
+		"Backup file to migrate.")
+	migrateBackupCmd.Flags().StringVarP(&migrateOpts.outFile, "out", "o", "",
+		"File to write the migrated backup to.")
+	migrateBackupCmd.Flags().StringVar(&migrateOpts.backupKeyPath, "backup-key-file", "",
+		"Path of the key file the backup to migrate is encrypted with.")
+	migrateBackupCmd.Flags().StringVar(&migrateOpts.keyPath, "encryption-key-file", "",
+		"Path of the key file to encrypt the migrated backup with.")
+	migrateBackupCmd.Flags().Uint32Var(&migrateOpts.compressionType, "compression", 0,
+		"Compression of the migrated backup. 0 to disable, and 2 for ZSTD.")
+	migrateBackupCmd.Flags().BoolVar(&migrateOpts.index, "index", false,
+		"Write the migrated backup in the version 2 format, with an index.")
+}
+
+func doMigrateBackup(cmd *cobra.Command, args []string) error {
+	if migrateOpts.inFile == "" || migrateOpts.outFile == "" {
+		return errors.New("--in and --out must be specified")
+	}
+	compression := options.CompressionType(migrateOpts.compressionType)
+	if compression != options.None && compression != options.ZSTD {
+		return errors.New("compression value must be one of 0 (disabled) or 2 (ZSTD)")
+	}
+	sourceKey, err := getKey(migrateOpts.backupKeyPath)
+	if err != nil {
+		return err
+	}
+	key, err := getKey(migrateOpts.keyPath)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(migrateOpts.inFile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(migrateOpts.outFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := bufio.NewWriterSize(out, 64<<20)
+	stats, err := badger.MigrateBackup(w, in, badger.MigrateOptions{
+		SourceKey:        sourceKey,
+		Compression:      compression,
+		CompressionLevel: badger.DefaultOptions("").ZSTDCompressionLevel,
+		EncryptionKey:    key,
+		Checksum:         true,
+		Index:            migrateOpts.index,
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if stats.Physical {
+		fmt.Println("Copied the physical backup, which has the current data format")
+		return nil
+	}
+	fmt.Printf("Migrated %d entries in %d lists, dropped %d entries without a key\n",
+		stats.Entries, stats.Lists, stats.Dropped)
+	return nil
+}
@@ -17,17 +17,43 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/objstore"
+	"github.com/dgraph-io/badger/v3/y"
+	humanize "github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 )
 
 var restoreFile string
 var maxPendingWrites int
+var restoreCatalog string
+var restoreShardsDir string
+var restoreKeyPath string
+var restoreBackupKeyPath string
+var restoreUntilTs uint64
+var restorePrefixes []string
+var restoreLogArchive string
+var restorePhysical bool
+var restoreSkipLists int
+var restoreConflicts string
+
+var restoreConflictPolicies = map[string]badger.LoadConflictPolicy{
+	"skip":        badger.LoadSkipExisting,
+	"keep-newest": badger.LoadKeepNewest,
+	"overwrite":   badger.LoadOverwrite,
+}
 
 // restoreCmd represents the restore command
 var restoreCmd = &cobra.Command{
@@ -39,8 +65,35 @@ It reads a file generated using the backup command (or by calling the
 DB.Backup() API method) and writes each key-value pair found in the file to
 the Badger database.
 
-Restore creates a new database, and currently does not work on an already
-existing database.`,
+Restore creates a new database, unless --conflicts is given. It then restores into an existing
+database, and either skips the keys already in it (skip), only writes the versions newer than the
+ones in it (keep-newest) or overwrites them (overwrite).
+
+The backup file can also be an object URL, downloaded directly, like for the backup command.
+
+With --catalog, the chain of backups in the given directory, written by backup --catalog, is
+restored: the full backup followed by the incremental ones. The chain is checked for gaps, and
+the sizes and checksums of the files are verified before anything is restored.
+
+With --shards-dir, the shards of a backup written by backup --shards-dir are restored
+concurrently.
+
+Compressed backups are decompressed, and encrypted backups are decrypted with the key given by
+--backup-key-file, or else with the encryption key of the database.
+
+With --until-ts, only the versions at or below the given timestamp are restored, which rolls
+the database back to its state at that timestamp, e.g. to just before a bad deploy.
+
+With --prefix, only the keys with one of the given hex-encoded prefixes are restored. For a
+backup file written with backup --index, only the chunks that may hold such keys are read.
+
+With --log-archive, the value log files archived by a database opened with Options.LogArchiveDir
+are replayed once the backup is restored, from the versions written after the backup was taken.
+
+With --physical, the files of a backup written by backup --physical are laid back down.
+
+The progress of the restore of a backup file is printed periodically. An interrupted restore can
+be resumed with the --skip-lists value printed last, and the same flags.`,
 	RunE: doRestore,
 }
 
@@ -52,35 +105,135 @@ func init() {
 	// and overall finish time.
 	restoreCmd.Flags().IntVarP(&maxPendingWrites, "max-pending-writes", "w",
 		256, "Max number of pending writes at any time while restore")
+	restoreCmd.Flags().StringVar(&restoreShardsDir, "shards-dir", "",
+		"Directory of a sharded backup to restore, instead of a backup file")
+	restoreCmd.Flags().StringVar(&restoreCatalog, "catalog", "",
+		"Directory of a backup chain to restore, instead of a backup file")
+	restoreCmd.Flags().StringVar(&restoreKeyPath, "encryption-key-file", "",
+		"Path of the encryption key file of the new database")
+	restoreCmd.Flags().StringVar(&restoreBackupKeyPath, "backup-key-file", "",
+		"Path of the key file the backup is encrypted with, if not the one of the database")
+	restoreCmd.Flags().Uint64Var(&restoreUntilTs, "until-ts", 0,
+		"Restore only the versions at or below this timestamp. 0 restores all of them")
+	restoreCmd.Flags().StringSliceVar(&restorePrefixes, "prefix", nil,
+		"Hex-encoded prefix of the keys to restore. Can be repeated")
+	restoreCmd.Flags().StringVar(&restoreLogArchive, "log-archive", "",
+		"Log archive directory to replay on top of the backup")
+	restoreCmd.Flags().BoolVar(&restorePhysical, "physical", false,
+		"Restore a physical backup, written by backup --physical")
+	restoreCmd.Flags().IntVar(&restoreSkipLists, "skip-lists", 0,
+		"Number of lists of entries of the backup file already restored, to resume a restore")
+	restoreCmd.Flags().StringVar(&restoreConflicts, "conflicts", "",
+		"Restore into an existing database, resolving the keys in both with skip, keep-newest or "+
+			"overwrite")
 }
 
 func doRestore(cmd *cobra.Command, args []string) error {
-	// Check if the DB already exists
+	// Check if the DB already exists. A resumed restore continues in the DB it was writing to.
 	manifestFile := filepath.Join(sstDir, badger.ManifestFilename)
 	if _, err := os.Stat(manifestFile); err == nil { // No error. File already exists.
-		return errors.New("Cannot restore to an already existing database")
+		if restoreSkipLists == 0 && restoreConflicts == "" {
+			return errors.New("Cannot restore to an already existing database")
+		}
 	} else if os.IsNotExist(err) {
 		// pass
 	} else { // Return an error if anything other than the error above
 		return err
 	}
 
-	// Open DB
-	db, err := badger.Open(badger.DefaultOptions(sstDir).
+	encKey, err := getKey(restoreKeyPath)
+	if err != nil {
+		return err
+	}
+	backupKey, err := getKey(restoreBackupKeyPath)
+	if err != nil {
+		return err
+	}
+	loadOpt := badger.LoadOptions{EncryptionKey: backupKey, UntilTs: restoreUntilTs}
+	if restoreConflicts != "" {
+		policy, ok := restoreConflictPolicies[restoreConflicts]
+		if !ok {
+			return fmt.Errorf("invalid --conflicts %q", restoreConflicts)
+		}
+		loadOpt.Conflicts = policy
+	}
+	for _, p := range restorePrefixes {
+		prefix, err := hex.DecodeString(p)
+		if err != nil {
+			return y.Wrapf(err, "failed to decode hex prefix: %s", p)
+		}
+		loadOpt.Prefixes = append(loadOpt.Prefixes, prefix)
+	}
+
+	opt := badger.DefaultOptions(sstDir).
 		WithValueDir(vlogDir).
-		WithNumVersionsToKeep(math.MaxInt32))
+		WithNumVersionsToKeep(math.MaxInt32).
+		WithEncryptionKey(encKey)
+	if restorePhysical {
+		f, err := os.Open(restoreFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return badger.RestorePhysicalBackup(bufio.NewReaderSize(f, 64<<20), opt)
+	}
+
+	// Open DB
+	db, err := badger.Open(opt)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
+	if err := loadBackup(db, loadOpt); err != nil {
+		return err
+	}
+	if restoreLogArchive == "" {
+		return nil
+	}
+	// Replay the writes archived after the backup.
+	return db.LoadLogArchive(restoreLogArchive, db.MaxVersion()+1, maxPendingWrites, loadOpt)
+}
+
+// loadBackup restores the backup file, the backup chain or the sharded backup given by the flags.
+func loadBackup(db *badger.DB, loadOpt badger.LoadOptions) error {
+	if restoreShardsDir != "" {
+		return db.LoadSharded(restoreShardsDir, loadOpt)
+	}
+	if restoreCatalog != "" {
+		return db.LoadCatalog(restoreCatalog, maxPendingWrites, loadOpt)
+	}
+
 	// Open File
-	f, err := os.Open(restoreFile)
+	var f io.ReadCloser
+	var err error
+	if strings.Contains(restoreFile, "://") {
+		var st objstore.Storage
+		var name string
+		st, name, err = objstore.OpenStorage(context.Background(), restoreFile,
+			objstore.DefaultOptions())
+		if err != nil {
+			return err
+		}
+		f, err = st.Get(context.Background(), name)
+	} else {
+		f, err = os.Open(restoreFile)
+	}
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
 	// Run restore
-	return db.Load(f, maxPendingWrites)
+	loadOpt.SkipLists = restoreSkipLists
+	var last time.Time
+	loadOpt.Progress = func(p badger.LoadProgress) {
+		if time.Since(last) < 10*time.Second {
+			return
+		}
+		last = time.Now()
+		fmt.Printf("Restored %d entries (%s) of %d lists. Resume with --skip-lists=%d\n",
+			p.Entries, humanize.IBytes(uint64(p.Bytes)), p.Lists, p.Lists)
+	}
+	return db.LoadWithOptions(f, maxPendingWrites, loadOpt)
 }
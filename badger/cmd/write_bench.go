@@ -422,7 +422,7 @@ func runGC(c *z.Closer, db *badger.DB) {
 		case <-c.HasBeenClosed():
 			return
 		case <-t.C:
-			if err := db.RunValueLogGC(wo.gcDiscardRatio); err == nil {
+			if _, err := db.RunValueLogGC(wo.gcDiscardRatio); err == nil {
 				atomic.AddUint64(&gcSuccess, 1)
 			} else {
 				log.Printf("[GC] Failed due to following err %v", err)
@@ -37,6 +37,27 @@ type WriteBatch struct {
 	isManaged bool
 	commitTs  uint64
 	finished  bool
+	writeOpt  WriteOptions
+
+	// batch is the sequence number of the current internal commit, and callbacks holds the callbacks
+	// of its entries added via SetEntryWithCallback.
+	batch     uint64
+	callbacks []entryCallback
+}
+
+// EntryResult describes the outcome of an entry written via WriteBatch.SetEntryWithCallback.
+type EntryResult struct {
+	Key []byte
+	// Batch is the sequence number of the internal commit the entry was part of, starting at 1. It
+	// is zero if the entry was rejected before being added to any.
+	Batch uint64
+	// Err is nil if the entry was committed successfully.
+	Err error
+}
+
+type entryCallback struct {
+	key []byte
+	cb  func(EntryResult)
 }
 
 // NewWriteBatch creates a new WriteBatch. This provides a way to conveniently do a lot of writes,
@@ -57,6 +78,7 @@ func (db *DB) newWriteBatch(isManaged bool) *WriteBatch {
 		isManaged: isManaged,
 		txn:       db.newTransaction(true, isManaged),
 		throttle:  y.NewThrottle(16),
+		batch:     1,
 	}
 }
 
@@ -67,6 +89,15 @@ func (wb *WriteBatch) SetMaxPendingTxns(max int) {
 	wb.throttle = y.NewThrottle(max)
 }
 
+// SetWriteOptions sets the options used to persist the writes of the batch. This function should be
+// called before using WriteBatch.
+func (wb *WriteBatch) SetWriteOptions(opt WriteOptions) {
+	wb.Lock()
+	defer wb.Unlock()
+	wb.writeOpt = opt
+	wb.txn.SetWriteOptions(opt)
+}
+
 // Cancel function must be called if there's a chance that Flush might not get
 // called. If neither Flush or Cancel is called, the transaction oracle would
 // never get a chance to clear out the row commit timestamp map, thus causing an
@@ -82,6 +113,21 @@ func (wb *WriteBatch) Cancel() {
 		wb.db.opt.Errorf("WatchBatch.Cancel error while finishing: %v", err)
 	}
 	wb.txn.Discard()
+	batch, callbacks := wb.takeCallbacks()
+	wb.runCallbacks(batch, callbacks, ErrDiscardedTxn)
+}
+
+// takeCallbacks returns the entry callbacks of the current batch, along with its sequence number.
+func (wb *WriteBatch) takeCallbacks() (uint64, []entryCallback) {
+	batch, callbacks := wb.batch, wb.callbacks
+	wb.callbacks = nil
+	return batch, callbacks
+}
+
+func (wb *WriteBatch) runCallbacks(batch uint64, callbacks []entryCallback, err error) {
+	for _, c := range callbacks {
+		c.cb(EntryResult{Key: c.key, Batch: batch, Err: err})
+	}
 }
 
 func (wb *WriteBatch) callback(err error) {
@@ -98,9 +144,7 @@ func (wb *WriteBatch) callback(err error) {
 
 func (wb *WriteBatch) writeKV(kv *pb.KV) error {
 	e := Entry{Key: kv.Key, Value: kv.Value}
-	if len(kv.UserMeta) > 0 {
-		e.UserMeta = kv.UserMeta[0]
-	}
+	e.UserMeta, e.UserMetaExt = splitUserMeta(kv.UserMeta)
 	y.AssertTrue(kv.Version != 0)
 	e.version = kv.Version
 	return wb.handleEntry(&e)
@@ -166,6 +210,26 @@ func (wb *WriteBatch) SetEntry(e *Entry) error {
 	return wb.handleEntry(e)
 }
 
+// SetEntryWithCallback is like SetEntry, but additionally calls cb with the outcome of the entry.
+// If the entry is rejected, cb is called right away with the same error SetEntryWithCallback
+// returns. Otherwise, cb is called once the internal commit the entry is part of is done, from
+// another goroutine, or by Cancel if the batch is cancelled before that. cb should not block.
+func (wb *WriteBatch) SetEntryWithCallback(e *Entry, cb func(EntryResult)) error {
+	if cb == nil {
+		return ErrNilCallback
+	}
+	wb.Lock()
+	defer wb.Unlock()
+	// Txn modifies e.Key on commit.
+	key := e.Key
+	if err := wb.handleEntry(e); err != nil {
+		cb(EntryResult{Key: key, Err: err})
+		return err
+	}
+	wb.callbacks = append(wb.callbacks, entryCallback{key: key, cb: cb})
+	return nil
+}
+
 // Set is equivalent of Txn.Set().
 func (wb *WriteBatch) Set(k, v []byte) error {
 	e := &Entry{Key: k, Value: v}
@@ -196,6 +260,42 @@ func (wb *WriteBatch) Delete(k []byte) error {
 	return nil
 }
 
+// DeletePrefix deletes all the keys with the given prefix. The keys are iterated over internally,
+// as visible when DeletePrefix is called, and their deletes are added to the batch, spread over
+// as many internal commits as needed. The keys written afterwards are not deleted, including
+// those written via the batch itself.
+//
+// In managed mode, the keys visible at the commit timestamp of the batch are deleted. So,
+// DeletePrefix cannot be used with the batches created via NewManagedWriteBatch.
+func (wb *WriteBatch) DeletePrefix(prefix []byte) error {
+	var txn *Txn
+	switch {
+	case !wb.isManaged:
+		txn = wb.db.NewTransaction(false)
+	case wb.commitTs == 0:
+		return errors.Wrapf(ErrInvalidRequest, "DeletePrefix requires the batch to have a commit ts")
+	default:
+		txn = wb.db.NewTransactionAt(wb.commitTs, false)
+	}
+	defer txn.Discard()
+
+	opt := DefaultIteratorOptions
+	opt.PrefetchValues = false
+	opt.Prefix = prefix
+	itr := txn.NewIterator(opt)
+	defer itr.Close()
+
+	wb.Lock()
+	defer wb.Unlock()
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		e := &Entry{Key: itr.Item().KeyCopy(nil), meta: bitDelete}
+		if err := wb.handleEntry(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Caller to commit must hold a write lock.
 func (wb *WriteBatch) commit() error {
 	if err := wb.Error(); err != nil {
@@ -208,9 +308,18 @@ func (wb *WriteBatch) commit() error {
 		wb.err.Store(err)
 		return err
 	}
-	wb.txn.CommitWith(wb.callback)
+	if batch, callbacks := wb.takeCallbacks(); len(callbacks) > 0 {
+		wb.txn.CommitWith(func(err error) {
+			wb.runCallbacks(batch, callbacks, err)
+			wb.callback(err)
+		})
+	} else {
+		wb.txn.CommitWith(wb.callback)
+	}
+	wb.batch++
 	wb.txn = wb.db.newTransaction(true, wb.isManaged)
 	wb.txn.commitTs = wb.commitTs
+	wb.txn.SetWriteOptions(wb.writeOpt)
 	return wb.Error()
 }
 
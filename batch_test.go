@@ -19,6 +19,7 @@ package badger
 import (
 	"fmt"
 	"io/ioutil"
+	"sync"
 	"testing"
 	"time"
 
@@ -163,3 +164,79 @@ func TestBatchErrDeadlock(t *testing.T) {
 	require.Error(t, wb.Flush())
 	require.NoError(t, db.Close())
 }
+
+func TestWriteBatchEntryCallbacks(t *testing.T) {
+	opt := getTestOptions("").WithMemTableSize(1 << 16).WithValueThreshold(1 << 10)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		wb := db.NewWriteBatch()
+		defer wb.Cancel()
+
+		const n = 1000
+		var mu sync.Mutex
+		results := make(map[string]EntryResult)
+		record := func(res EntryResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			results[string(res.Key)] = res
+		}
+		for i := 0; i < n; i++ {
+			e := NewEntry([]byte(fmt.Sprintf("key%05d", i)), []byte("val"))
+			require.NoError(t, wb.SetEntryWithCallback(e, record))
+		}
+		// A rejected entry gets its callback called right away.
+		err := wb.SetEntryWithCallback(NewEntry(nil, []byte("val")), record)
+		require.Equal(t, ErrEmptyKey, err)
+		require.NoError(t, wb.Flush())
+
+		mu.Lock()
+		defer mu.Unlock()
+		require.Equal(t, ErrEmptyKey, results[""].Err)
+		require.Zero(t, results[""].Batch)
+		batches := make(map[uint64]struct{})
+		for i := 0; i < n; i++ {
+			res, ok := results[fmt.Sprintf("key%05d", i)]
+			require.True(t, ok)
+			require.NoError(t, res.Err)
+			require.NotZero(t, res.Batch)
+			batches[res.Batch] = struct{}{}
+		}
+		// The entries didn't fit in a single internal commit.
+		require.True(t, len(batches) > 1)
+	})
+}
+
+func TestWriteBatchDeletePrefix(t *testing.T) {
+	opt := getTestOptions("").WithMemTableSize(1 << 16).WithValueThreshold(1 << 10)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		const n = 1000
+		wb := db.NewWriteBatch()
+		for i := 0; i < n; i++ {
+			require.NoError(t, wb.Set([]byte(fmt.Sprintf("del%05d", i)), []byte("val")))
+			require.NoError(t, wb.Set([]byte(fmt.Sprintf("keep%05d", i)), []byte("val")))
+		}
+		require.NoError(t, wb.Flush())
+
+		wb = db.NewWriteBatch()
+		defer wb.Cancel()
+		require.NoError(t, wb.DeletePrefix([]byte("del")))
+		require.NoError(t, wb.Set([]byte("del-new"), []byte("val")))
+		require.NoError(t, wb.Flush())
+
+		count := func(prefix string) int {
+			var count int
+			require.NoError(t, db.View(func(txn *Txn) error {
+				opt := DefaultIteratorOptions
+				opt.Prefix = []byte(prefix)
+				it := txn.NewIterator(opt)
+				defer it.Close()
+				for it.Rewind(); it.Valid(); it.Next() {
+					count++
+				}
+				return nil
+			}))
+			return count
+		}
+		require.Equal(t, 1, count("del"))
+		require.Equal(t, n, count("keep"))
+	})
+}
@@ -0,0 +1,327 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+const (
+	// blobFidBit is set in the Fid of the value pointers to blob files, whose other bits hold the
+	// ID of the blob. The IDs of the value log files never get that high.
+	blobFidBit uint32 = 1 << 31
+
+	blobFileSuffix = ".blob"
+)
+
+// isBlob returns true if p points to a blob file rather than to a value log file.
+func (p valuePointer) isBlob() bool {
+	return p.Fid&blobFidBit > 0
+}
+
+func blobFilePath(dirPath string, id uint32) string {
+	return fmt.Sprintf("%s%s%06d%s", dirPath, string(os.PathSeparator), id, blobFileSuffix)
+}
+
+// blobStore tracks the blob files of the value directory. A blob file holds the entry of a single
+// value of Options.BlobThreshold bytes or more, laid out like a value log file, and is referenced
+// by the version it was written for only. The compactions release the blobs of the versions they
+// drop. As they do so before their tables replace the old ones, a released blob is only deleted
+// once the LSM tree is checked to no longer reference it.
+type blobStore struct {
+	sync.Mutex
+	nextID uint32 // Must access via atomics.
+	// pending are the blobs being written, which the LSM tree doesn't reference yet.
+	pending map[uint32]struct{}
+	// released are the blobs whose version was dropped by a compaction.
+	released map[uint32]struct{}
+	// gcLock serializes the collections of the blobs.
+	gcLock sync.Mutex
+}
+
+// blobIDs returns the IDs of the blob files of the value directory, sorted.
+func (vlog *valueLog) blobIDs() ([]uint32, error) {
+	files, err := ioutil.ReadDir(vlog.dirPath)
+	if err != nil {
+		return nil, errFile(err, vlog.dirPath, "Unable to open log dir.")
+	}
+	var ids []uint32
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, blobFileSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, blobFileSuffix), 10, 31)
+		if err != nil {
+			return nil, errFile(err, name, "Unable to parse blob id.")
+		}
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// openBlobs picks up the blob files of the value directory, so that the new blobs get new IDs.
+func (vlog *valueLog) openBlobs() error {
+	vlog.blobs.pending = make(map[uint32]struct{})
+	vlog.blobs.released = make(map[uint32]struct{})
+	ids, err := vlog.blobIDs()
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		vlog.blobs.nextID = ids[len(ids)-1]
+	}
+	return nil
+}
+
+// writeBlob writes e to a new blob file, using buf if the value isn't streamed, and returns the
+// pointer to it. The blob stays pending until blobsWritten is called with the pointer.
+func (vlog *valueLog) writeBlob(buf *bytes.Buffer, e *Entry, sync bool) (valuePointer, error) {
+	id := atomic.AddUint32(&vlog.blobs.nextID, 1)
+	if id&blobFidBit > 0 {
+		return valuePointer{}, errors.Errorf("Blob id %d is out of range", id)
+	}
+	lf := &logFile{
+		fid:      blobFidBit | id,
+		path:     blobFilePath(vlog.dirPath, id),
+		registry: vlog.db.registry,
+		opt:      vlog.opt,
+	}
+	vlog.blobs.Lock()
+	vlog.blobs.pending[id] = struct{}{}
+	vlog.blobs.Unlock()
+
+	plen := lf.encodedSize(e)
+	err := lf.open(lf.path, os.O_RDWR|os.O_CREATE|os.O_EXCL, int64(vlogHeaderSize+plen))
+	if err != z.NewFile {
+		vlog.dropBlob(id)
+		return valuePointer{}, y.Wrapf(err, "while creating blob file: %s", lf.path)
+	}
+	p := valuePointer{Fid: lf.fid, Offset: vlogHeaderSize, Len: uint32(plen)}
+	dst := lf.Data[p.Offset : p.Offset+p.Len]
+	if e.valueReader != nil {
+		err = lf.encodeStreamedEntry(dst, e, p.Offset)
+	} else {
+		buf.Reset()
+		if _, err = lf.encodeEntry(buf, e, p.Offset); err == nil {
+			y.AssertTrue(copy(dst, buf.Bytes()) == len(dst))
+		}
+	}
+	if err != nil {
+		_ = lf.Delete()
+		vlog.dropBlob(id)
+		return valuePointer{}, err
+	}
+	// Closing the file syncs it.
+	if err := lf.Close(-1); err != nil {
+		vlog.dropBlob(id)
+		return valuePointer{}, y.Wrapf(err, "while closing blob file: %s", lf.path)
+	}
+	if sync {
+		if err := syncDir(vlog.dirPath); err != nil {
+			return valuePointer{}, err
+		}
+	}
+	return p, nil
+}
+
+// dropBlob deletes a blob the LSM tree never got to reference.
+func (vlog *valueLog) dropBlob(id uint32) {
+	path := blobFilePath(vlog.dirPath, id)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		vlog.opt.Warningf("Unable to remove blob file %s: %v", path, err)
+	}
+	vlog.blobs.Lock()
+	delete(vlog.blobs.pending, id)
+	vlog.blobs.Unlock()
+}
+
+// blobsWritten is called once the entries ptrs were written for are in the LSM tree, or failed to
+// make it. The blobs which didn't make it are deleted by the next DB.RunBlobGC.
+func (vlog *valueLog) blobsWritten(ptrs []valuePointer) {
+	vlog.blobs.Lock()
+	defer vlog.blobs.Unlock()
+	for _, p := range ptrs {
+		if p.isBlob() {
+			delete(vlog.blobs.pending, p.Fid&^blobFidBit)
+		}
+	}
+}
+
+// releaseBlob records that a compaction dropped the version referencing the blob p.Fid.
+func (vlog *valueLog) releaseBlob(fid uint32) {
+	vlog.blobs.Lock()
+	vlog.blobs.released[fid&^blobFidBit] = struct{}{}
+	vlog.blobs.Unlock()
+}
+
+// openBlob opens the blob file p points to, with a read lock, like getFileRLocked. The file is
+// closed by the callback returned by getUnlockCallback.
+func (vlog *valueLog) openBlob(p valuePointer) (*logFile, error) {
+	lf := &logFile{
+		fid:      p.Fid,
+		path:     blobFilePath(vlog.dirPath, p.Fid&^blobFidBit),
+		registry: vlog.db.registry,
+		opt:      vlog.opt,
+	}
+	if err := lf.open(lf.path, os.O_RDONLY, 0); err != nil {
+		return nil, y.Wrapf(err, "while opening blob file: %s", lf.path)
+	}
+	lf.lock.RLock()
+	return lf, nil
+}
+
+// blobReferenced returns true if the LSM tree still holds the version the blob was written for.
+func (vlog *valueLog) blobReferenced(id uint32) (bool, error) {
+	lf, err := vlog.openBlob(valuePointer{Fid: blobFidBit | id})
+	if err != nil {
+		return false, err
+	}
+	key, err := func() ([]byte, error) {
+		defer runCallback(vlog.getUnlockCallback(lf))
+		// A crash while the blob was created can leave it empty. It was never referenced then.
+		if len(lf.Data) <= vlogHeaderSize+maxHeaderSize {
+			return nil, nil
+		}
+		var h header
+		kv := lf.Data[vlogHeaderSize+h.Decode(lf.Data[vlogHeaderSize:]):]
+		if h.klen == 0 || int(h.klen) > len(kv) {
+			return nil, nil
+		}
+		if lf.encryptionEnabled() {
+			return lf.decryptKV(kv[:h.klen], vlogHeaderSize)
+		}
+		return y.SafeCopy(nil, kv[:h.klen]), nil
+	}()
+	if err != nil || key == nil {
+		return false, err
+	}
+	vs, err := vlog.db.get(key)
+	if err != nil {
+		return false, err
+	}
+	if vs.Version != y.ParseTs(key) || vs.Meta&bitValuePointer == 0 {
+		return false, nil
+	}
+	var vp valuePointer
+	vp.Decode(vs.Value)
+	return vp.Fid == blobFidBit|id, nil
+}
+
+// collectBlobs deletes the released blobs which the LSM tree no longer references, or all the
+// unreferenced blob files if all is set, and returns the number of files deleted. Like the value
+// log files rewritten by the GC, the blob files aren't deleted while iterators are open.
+func (vlog *valueLog) collectBlobs(all bool) (int, error) {
+	vlog.blobs.gcLock.Lock()
+	defer vlog.blobs.gcLock.Unlock()
+	if vlog.iteratorCount() > 0 {
+		return 0, ErrRejected
+	}
+
+	var ids []uint32
+	if all {
+		var err error
+		if ids, err = vlog.blobIDs(); err != nil {
+			return 0, err
+		}
+	}
+	vlog.blobs.Lock()
+	if !all {
+		for id := range vlog.blobs.released {
+			ids = append(ids, id)
+		}
+	}
+	candidates := ids[:0]
+	for _, id := range ids {
+		if _, ok := vlog.blobs.pending[id]; !ok {
+			candidates = append(candidates, id)
+		}
+	}
+	vlog.blobs.Unlock()
+
+	var deleted int
+	for _, id := range candidates {
+		path := blobFilePath(vlog.dirPath, id)
+		if _, err := os.Stat(path); err == nil {
+			referenced, err := vlog.blobReferenced(id)
+			if err != nil {
+				return deleted, err
+			}
+			// The blobs which are still referenced stay released, as they might be by a
+			// compaction whose tables aren't in place yet.
+			if referenced {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				return deleted, errFile(err, path, "Unable to remove blob file.")
+			}
+			deleted++
+		} else if !os.IsNotExist(err) {
+			return deleted, err
+		}
+		vlog.blobs.Lock()
+		delete(vlog.blobs.released, id)
+		vlog.blobs.Unlock()
+	}
+	return deleted, nil
+}
+
+// dropAllBlobs deletes all the blob files. It's called by dropAll, while the writes are stopped.
+func (vlog *valueLog) dropAllBlobs() (int, error) {
+	ids, err := vlog.blobIDs()
+	if err != nil {
+		return 0, err
+	}
+	for i, id := range ids {
+		path := blobFilePath(vlog.dirPath, id)
+		if err := os.Remove(path); err != nil {
+			return i, errFile(err, path, "Unable to remove blob file.")
+		}
+	}
+	vlog.blobs.Lock()
+	vlog.blobs.released = make(map[uint32]struct{})
+	vlog.blobs.Unlock()
+	return len(ids), nil
+}
+
+// RunBlobGC deletes the blob files which the LSM tree no longer references, and returns the number
+// of files deleted. The blobs released by the compactions are deleted after them, so RunBlobGC is
+// only needed for the ones left behind by a crash or DropPrefix, or while iterators were open.
+// Like the value log GC, it returns ErrRejected while iterators are open. See
+// Options.BlobThreshold.
+func (db *DB) RunBlobGC() (int, error) {
+	if db.opt.InMemory {
+		return 0, ErrGCInMemoryMode
+	}
+	if db.opt.ReadOnly {
+		return 0, errors.Wrapf(ErrInvalidRequest, "Cannot run blob GC in read-only mode")
+	}
+	return db.vlog.collectBlobs(true)
+}
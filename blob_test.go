@@ -0,0 +1,123 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlobFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithBlobThreshold(1 << 20)
+
+	big := func(b byte) []byte { return bytes.Repeat([]byte{b}, 2<<20) }
+	db, err := Open(opt)
+	require.NoError(t, err)
+	txnSet(t, db, []byte("small"), []byte("value"), 0)
+	txnSet(t, db, []byte("big"), big('a'), 0)
+	txnSet(t, db, []byte("big"), big('b'), 0)
+
+	ids, err := db.vlog.blobIDs()
+	require.NoError(t, err)
+	require.Equal(t, []uint32{1, 2}, ids)
+	// The value log doesn't hold the big values.
+	require.Less(t, db.vlog.woffset(), uint32(1<<20))
+
+	require.NoError(t, db.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("big"))
+		require.NoError(t, err)
+		require.Equal(t, big('b'), getItemValue(t, item))
+		r, err := item.ValueReader()
+		require.NoError(t, err)
+		defer r.Close()
+		val, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, big('b'), val)
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	// The compaction dropping the first version deletes its blob.
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NoError(t, db.CompactLevel(0))
+	ids, err = db.vlog.blobIDs()
+	require.NoError(t, err)
+	require.Equal(t, []uint32{2}, ids)
+
+	require.NoError(t, db.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("big"))
+		require.NoError(t, err)
+		require.Equal(t, big('b'), getItemValue(t, item))
+		item, err = txn.Get([]byte("small"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), getItemValue(t, item))
+		return nil
+	}))
+	n, err := db.RunBlobGC()
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func TestRunBlobGC(t *testing.T) {
+	opt := getTestOptions("").WithValueThreshold(256).WithBlobThreshold(1 << 10)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		val := bytes.Repeat([]byte("v"), 4<<10)
+		txnSet(t, db, []byte("key"), val, 0)
+
+		// A blob the LSM tree never got to reference, as if the DB crashed before writing it.
+		e := &Entry{Key: y.KeyWithTs([]byte("orphan"), 1), Value: val}
+		p, err := db.vlog.writeBlob(new(bytes.Buffer), e, false)
+		require.NoError(t, err)
+		require.True(t, p.isBlob())
+
+		// It's left alone while it's being written.
+		n, err := db.RunBlobGC()
+		require.NoError(t, err)
+		require.Zero(t, n)
+
+		db.vlog.blobsWritten([]valuePointer{p})
+		txn := db.NewTransaction(false)
+		itr := txn.NewIterator(DefaultIteratorOptions)
+		_, err = db.RunBlobGC()
+		require.Equal(t, ErrRejected, err)
+		itr.Close()
+		txn.Discard()
+
+		n, err = db.RunBlobGC()
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+		ids, err := db.vlog.blobIDs()
+		require.NoError(t, err)
+		require.Len(t, ids, 1)
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("key"))
+			require.NoError(t, err)
+			require.Equal(t, val, getItemValue(t, item))
+			return nil
+		}))
+	})
+}
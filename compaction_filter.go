@@ -0,0 +1,91 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"github.com/dgraph-io/badger/v3/y"
+)
+
+// CompactionDecision is what a CompactionFilter decides to do with an entry.
+type CompactionDecision int
+
+const (
+	// CompactionKeep keeps the entry as it is.
+	CompactionKeep CompactionDecision = iota
+	// CompactionDrop deletes the entry. The key reads as deleted from its version down, the same
+	// as if it had been deleted by a transaction at that version.
+	CompactionDrop
+	// CompactionRewrite replaces the value of the entry with the value returned by the filter.
+	CompactionRewrite
+)
+
+// CompactionFilter is called by the compactions for the entries they rewrite, to purge or rewrite
+// them in place of a full rewrite of the database.
+type CompactionFilter interface {
+	// Filter decides what to do with the given version of key. It is only called for the versions
+	// which are visible to all the transactions, and which aren't deleted, expired or merge
+	// operands. The value is only valid until Filter returns. The value returned along with
+	// CompactionRewrite is stored in the LSM tree, whatever its size.
+	Filter(key, value []byte, userMeta byte, version uint64) (CompactionDecision, []byte)
+}
+
+// filterEntry runs the compaction filter over the version of key stored in vs. It returns the
+// value struct to write in its place, and whether the filter dropped or rewrote it.
+func (s *levelsController) filterEntry(key []byte, vs y.ValueStruct) (y.ValueStruct, bool) {
+	value := vs.Value
+	if vs.Meta&bitValuePointer > 0 {
+		var vp valuePointer
+		vp.Decode(vs.Value)
+		buf, cb, err := s.kv.vlog.Read(vp, nil)
+		if err != nil {
+			runCallback(cb)
+			s.kv.opt.Warningf("Unable to read the value of %q for the compaction filter: %v",
+				y.ParseKey(key), err)
+			return vs, false
+		}
+		value = y.SafeCopy(nil, buf)
+		runCallback(cb)
+	}
+	value, err := s.kv.plainValue(vs.Meta, value)
+	if err != nil {
+		// The key of the tenant has been destroyed, the value is as good as gone.
+		return vs, false
+	}
+
+	decision, newValue := s.kv.opt.CompactionFilter.Filter(
+		y.ParseKey(key), value, vs.UserMeta, y.ParseTs(key))
+	switch decision {
+	case CompactionDrop:
+		return y.ValueStruct{Meta: bitDelete, Version: vs.Version}, true
+	case CompactionRewrite:
+		// The new value is encrypted with the key of the tenant, like the one it replaces.
+		e := &Entry{Key: key, Value: newValue, meta: vs.Meta &^ (bitValuePointer | bitTenantKey)}
+		if err := s.kv.tenants.encrypt(e); err != nil {
+			s.kv.opt.Warningf("Unable to encrypt the value of %q rewritten by the compaction "+
+				"filter: %v", y.ParseKey(key), err)
+			return vs, false
+		}
+		return y.ValueStruct{
+			Meta:      e.meta,
+			UserMeta:  vs.UserMeta,
+			ExpiresAt: vs.ExpiresAt,
+			Value:     e.Value,
+			Version:   vs.Version,
+		}, true
+	}
+	return vs, false
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testCompactionFilter drops the soft-deleted values and strips the legacy prefix of the others.
+type testCompactionFilter struct {
+	calls int32
+}
+
+func (f *testCompactionFilter) Filter(key, value []byte, userMeta byte,
+	version uint64) (CompactionDecision, []byte) {
+	atomic.AddInt32(&f.calls, 1)
+	switch {
+	case userMeta == 1:
+		return CompactionDrop, nil
+	case bytes.HasPrefix(value, []byte("legacy:")):
+		return CompactionRewrite, append([]byte{}, value[len("legacy:"):]...)
+	}
+	return CompactionKeep, nil
+}
+
+func TestCompactionFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	filter := &testCompactionFilter{}
+	opt := getTestOptions(dir).WithValueThreshold(32).WithCompactL0OnClose(true).
+		WithCompactionFilter(filter)
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%04d", i)) }
+	// The long values are stored in the value log.
+	long := string(bytes.Repeat([]byte("v"), 64))
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for i := 0; i < 100; i++ {
+			e := NewEntry(key(i), []byte(fmt.Sprintf("legacy:%d", i)))
+			switch i % 4 {
+			case 1:
+				e.Value = []byte(fmt.Sprintf("legacy:%d%s", i, long))
+			case 2:
+				e.Value = []byte(fmt.Sprintf("%d", i))
+			case 3:
+				e = e.WithMeta(1)
+			}
+			if err := txn.SetEntry(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	// A read at the version of the entries makes them visible to all the transactions.
+	require.NoError(t, db.View(func(txn *Txn) error { return nil }))
+	require.NoError(t, db.Close())
+	require.True(t, atomic.LoadInt32(&filter.calls) > 0)
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 100; i++ {
+			item, err := txn.Get(key(i))
+			if i%4 == 3 {
+				require.Equal(t, ErrKeyNotFound, err)
+				continue
+			}
+			require.NoError(t, err)
+			val, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			want := fmt.Sprintf("%d", i)
+			if i%4 == 1 {
+				want += long
+			}
+			require.Equal(t, want, string(val))
+		}
+		return nil
+	}))
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// cursorFormat is the version of the encoding of the cursors.
+const cursorFormat = 1
+
+const (
+	cursorReverse byte = 1 << iota
+	cursorAllVersions
+)
+
+// cursor is the decoded form of the cursors returned by Iterator.Cursor.
+type cursor struct {
+	flags   byte
+	readTs  uint64
+	version uint64
+	key     []byte
+}
+
+// The encoded cursor looks like
+// +--------+-------+-----------------+------------------+-----+
+// | Format | Flags | ReadTs (varint) | Version (varint) | Key |
+// +--------+-------+-----------------+------------------+-----+
+func (c *cursor) Encode() []byte {
+	buf := make([]byte, 2+2*binary.MaxVarintLen64+len(c.key))
+	buf[0], buf[1] = cursorFormat, c.flags
+	sz := 2
+	sz += binary.PutUvarint(buf[sz:], c.readTs)
+	sz += binary.PutUvarint(buf[sz:], c.version)
+	sz += copy(buf[sz:], c.key)
+	return buf[:sz]
+}
+
+func (c *cursor) Decode(buf []byte) error {
+	if len(buf) < 2 || buf[0] != cursorFormat {
+		return ErrInvalidCursor
+	}
+	c.flags = buf[1]
+	buf = buf[2:]
+	var sz int
+	if c.readTs, sz = binary.Uvarint(buf); sz <= 0 {
+		return ErrInvalidCursor
+	}
+	buf = buf[sz:]
+	if c.version, sz = binary.Uvarint(buf); sz <= 0 {
+		return ErrInvalidCursor
+	}
+	c.key = buf[sz:]
+	if len(c.key) == 0 {
+		return ErrInvalidCursor
+	}
+	return nil
+}
+
+// Cursor returns an opaque cursor at the current item of the iterator, or nil if the iterator is
+// not valid. Iterator.SeekCursor resumes the iteration right after the item, possibly in another
+// transaction, which makes it suitable for paginating a scan. The cursor records the key and the
+// version of the item, and the read timestamp of the transaction, see CursorReadTs.
+func (it *Iterator) Cursor() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	c := cursor{
+		readTs:  it.readTs,
+		version: it.item.Version(),
+		key:     it.item.Key(),
+	}
+	if it.opt.Reverse {
+		c.flags |= cursorReverse
+	}
+	if it.opt.AllVersions {
+		c.flags |= cursorAllVersions
+	}
+	return c.Encode()
+}
+
+// SeekCursor positions the iterator at the item following the one the cursor was created at, in
+// the direction of the iteration. It returns ErrInvalidCursor if the cursor can't be decoded, and
+// ErrInvalidRequest if it was created by an iterator iterating in the other direction or with a
+// different AllVersions option.
+func (it *Iterator) SeekCursor(cur []byte) error {
+	var c cursor
+	if err := c.Decode(cur); err != nil {
+		return err
+	}
+	if (c.flags&cursorReverse > 0) != it.opt.Reverse ||
+		(c.flags&cursorAllVersions > 0) != it.opt.AllVersions {
+		return errors.Wrap(ErrInvalidRequest, "Cursor was created by an iterator with different "+
+			"Reverse or AllVersions options")
+	}
+
+	it.Seek(c.key)
+	for ; it.Valid(); it.Next() {
+		item := it.item
+		if !bytes.Equal(item.Key(), c.key) {
+			break
+		}
+		// The versions of a key are iterated over from the newest one, or the oldest in reverse.
+		if it.opt.AllVersions && ((!it.opt.Reverse && item.version < c.version) ||
+			(it.opt.Reverse && item.version > c.version)) {
+			break
+		}
+	}
+	return nil
+}
+
+// CursorReadTs returns the read timestamp of the transaction the cursor was created in. Passing
+// it to DB.ViewAsOf, or NewTransactionAt in managed mode, continues the scan at the same snapshot
+// of the DB, as long as the versions it sees haven't been discarded.
+func CursorReadTs(cur []byte) (uint64, error) {
+	var c cursor
+	if err := c.Decode(cur); err != nil {
+		return 0, err
+	}
+	return c.readTs, nil
+}
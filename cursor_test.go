@@ -0,0 +1,130 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIteratorCursor(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		var want []string
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 25; i++ {
+				key := fmt.Sprintf("key%02d", i)
+				want = append(want, key)
+				if err := txn.Set([]byte(key), []byte("val")); err != nil {
+					return err
+				}
+			}
+			return txn.Set([]byte("other"), []byte("val"))
+		}))
+
+		// page returns up to 10 keys following the cursor, and the cursor at the last one.
+		page := func(opt IteratorOptions, cur []byte) ([]string, []byte) {
+			var keys []string
+			require.NoError(t, db.View(func(txn *Txn) error {
+				itr := txn.NewIterator(opt)
+				defer itr.Close()
+				if cur == nil {
+					itr.Rewind()
+				} else {
+					require.NoError(t, itr.SeekCursor(cur))
+				}
+				for ; itr.Valid() && len(keys) < 10; itr.Next() {
+					keys = append(keys, string(itr.Item().Key()))
+					cur = itr.Cursor()
+				}
+				return nil
+			}))
+			return keys, cur
+		}
+
+		opt := DefaultIteratorOptions
+		opt.Prefix = []byte("key")
+		var got []string
+		var cur []byte
+		for {
+			keys, next := page(opt, cur)
+			if len(keys) == 0 {
+				break
+			}
+			got = append(got, keys...)
+			cur = next
+		}
+		require.Equal(t, want, got)
+
+		readTs, err := CursorReadTs(cur)
+		require.NoError(t, err)
+		require.Equal(t, db.MaxVersion(), readTs)
+
+		opt.Reverse = true
+		require.NoError(t, db.View(func(txn *Txn) error {
+			itr := txn.NewIterator(opt)
+			defer itr.Close()
+			require.Equal(t, ErrInvalidRequest, errors.Cause(itr.SeekCursor(cur)))
+			require.Equal(t, ErrInvalidCursor, itr.SeekCursor([]byte("garbage")))
+			return nil
+		}))
+	})
+}
+
+func TestIteratorCursorAllVersions(t *testing.T) {
+	opt := getTestOptions("")
+	opt.NumVersionsToKeep = 10
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		for i := 0; i < 3; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				if err := txn.Set([]byte("a"), []byte("val")); err != nil {
+					return err
+				}
+				return txn.Set([]byte("b"), []byte("val"))
+			}))
+		}
+
+		for _, reverse := range []bool{false, true} {
+			iopt := DefaultIteratorOptions
+			iopt.AllVersions = true
+			iopt.Reverse = reverse
+			var all, resumed []string
+			require.NoError(t, db.View(func(txn *Txn) error {
+				itr := txn.NewIterator(iopt)
+				defer itr.Close()
+				var cur []byte
+				for itr.Rewind(); itr.Valid(); itr.Next() {
+					item := itr.Item()
+					all = append(all, fmt.Sprintf("%s@%d", item.Key(), item.Version()))
+					if len(all) == 2 {
+						cur = itr.Cursor()
+					}
+				}
+				require.NoError(t, itr.SeekCursor(cur))
+				for ; itr.Valid(); itr.Next() {
+					item := itr.Item()
+					resumed = append(resumed, fmt.Sprintf("%s@%d", item.Key(), item.Version()))
+				}
+				return nil
+			}))
+			require.Len(t, all, 6)
+			require.Equal(t, all[2:], resumed)
+		}
+	})
+}
@@ -46,6 +46,13 @@ var (
 	badgerPrefix = []byte("!badger!")       // Prefix for internal keys used by badger.
 	txnKey       = []byte("!badger!txn")    // For indicating end of entries in txn.
 	bannedNsKey  = []byte("!badger!banned") // For storing the banned namespaces.
+	eraseKey     = []byte("!badger!erase")  // For storing the audit records of erased tenants.
+	// For storing the prefixes dropped via DropPrefixAsync, which haven't been reclaimed yet.
+	dropPrefixKey = []byte("!badger!dropPrefix")
+	// For storing the timestamp up to which a TimestampOracle may have handed out timestamps.
+	tsOracleKey = []byte("!badger!tsOracle")
+	// For staging the writes of AtomicBatches, and recording the ones being applied.
+	atomicBatchKey = []byte("!badger!atomic")
 )
 
 const (
@@ -58,8 +65,12 @@ type closers struct {
 	memtable    *z.Closer
 	writes      *z.Closer
 	valueGC     *z.Closer
+	autoGC      *z.Closer
+	tiering     *z.Closer
+	logArchive  *z.Closer
 	pub         *z.Closer
 	cacheHealth *z.Closer
+	dropPrefix  *z.Closer
 }
 
 type lockedKeys struct {
@@ -118,16 +129,59 @@ type DB struct {
 
 	blockWrites int32
 	isClosed    uint32
+	// abortCompactions is set once the running compactions should be abandoned while closing.
+	abortCompactions int32
 
 	orc              *oracle
 	bannedNamespaces *lockedKeys
+	keyLocks         *keyLocks
+	prefixDrops      *prefixDrops
 	threshold        *vlogThreshold
+	// archiver is nil unless Options.LogArchiveDir is set.
+	archiver *logArchiver
 
 	pub        *publisher
 	registry   *KeyRegistry
+	tenants    *tenantKeys
+	// keyspaceCompressions is the compression of the tables of the keyspaces which override it.
+	keyspaceCompressions keyspaceCompressions
 	blockCache *ristretto.Cache
 	indexCache *ristretto.Cache
 	allocPool  *z.AllocatorPool
+
+	flattenPauser pauser
+	// compactionGate pauses the background compactions, via PauseCompactions.
+	compactionGate pauseGate
+
+	// optLock guards tuned, and serializes the changes done via SetOptions.
+	optLock sync.Mutex
+	// tuned is the copy of the options returned by Opts, which SetOptions changes. opt isn't
+	// modified once the DB is open, as it's read and copied without locks: the options read by the
+	// running DB which SetOptions changes are mirrored by the fields accessed atomically below.
+	tuned Options
+	// syncWrites is 1 if opt.SyncWrites is set. It is accessed atomically, as it can be changed via
+	// SetOptions.
+	syncWrites int32
+	// valueLogMaxEntries is opt.ValueLogMaxEntries. It is accessed atomically, as it can be
+	// changed via SetOptions.
+	valueLogMaxEntries uint32
+	// compactionThroughput is opt.CompactionThroughput, the rate at which backgroundLimiter is
+	// charged for the tables written by the compactions. It is accessed atomically, as it can be
+	// changed via SetOptions.
+	compactionThroughput int64
+	// backgroundLimiter limits the I/O of the compactions and memtable flushes, as per
+	// opt.BackgroundThroughput. Each byte read or written is charged to it once.
+	backgroundLimiter rateLimiter
+	// numCompactors is opt.NumCompactors. It is accessed atomically, as it can be changed via
+	// SetOptions while the compactors are restarted by Flatten or Thaw.
+	numCompactors int32
+
+	// freezeLock guards thaw, which is non-nil while the DB is frozen via Freeze.
+	freezeLock sync.Mutex
+	thaw       func()
+
+	// metrics holds the counters reported via Metrics.
+	metrics dbMetrics
 }
 
 const (
@@ -145,6 +199,15 @@ func checkAndSetOptions(opt *Options) error {
 	if opt.InMemory && (opt.Dir != "" || opt.ValueDir != "") {
 		return errors.New("Cannot use badger in Disk-less mode with Dir or ValueDir set")
 	}
+	// The log archive is made of the files of the value log, which only hold all the values when
+	// they're written to disk, outside of managed mode, and without blob files.
+	if opt.LogArchiveDir != "" && (opt.InMemory || opt.managedTxns || opt.BlobThreshold > 0) {
+		return errors.New("Cannot use LogArchiveDir in Disk-less or managed mode, " +
+			"or with BlobThreshold set")
+	}
+	if err := checkMergeFuncs(opt.MergeFuncs); err != nil {
+		return err
+	}
 	opt.maxBatchSize = (15 * opt.MemTableSize) / 100
 	opt.maxBatchCount = opt.maxBatchSize / int64(skl.MaxNodeSize)
 
@@ -178,6 +241,25 @@ func checkAndSetOptions(opt *Options) error {
 		opt.CompactL0OnClose = false
 	}
 
+	if opt.AutoGC.DiscardRatio == 0 {
+		opt.AutoGC.DiscardRatio = 0.5
+	}
+	if opt.AutoGC.DiscardRatio <= 0 || opt.AutoGC.DiscardRatio >= 1 ||
+		opt.AutoGC.Interval < 0 || opt.AutoGC.MaxDurationPerRun < 0 ||
+		(opt.AutoGC.TargetSpaceAmp != 0 && opt.AutoGC.TargetSpaceAmp < 1) {
+		return errors.Errorf("Invalid AutoGC %+v: DiscardRatio must be within 0.0-1.0, "+
+			"TargetSpaceAmp at least 1, and the durations can't be negative", opt.AutoGC)
+	}
+	if t := &opt.ValueLogTiering; t.ColdDir != "" {
+		if t.Interval == 0 {
+			t.Interval = time.Minute
+		}
+		if t.ColdAfter < 0 || t.HotBytes < 0 || t.Interval < 0 {
+			return errors.Errorf("Invalid ValueLogTiering %+v: the durations and sizes can't "+
+				"be negative", *t)
+		}
+	}
+
 	needCache := (opt.Compression != options.None) || (len(opt.EncryptionKey) > 0)
 	if needCache && opt.BlockCacheSize == 0 {
 		panic("BlockCacheSize should be set since compression/encryption are enabled")
@@ -187,6 +269,15 @@ func checkAndSetOptions(opt *Options) error {
 
 // Open returns a new DB object.
 func Open(opt Options) (*DB, error) {
+	return OpenWithContext(context.Background(), opt)
+}
+
+// OpenWithContext returns a new DB object, like Open. Opening a large DB can take a long time, as
+// it replays the manifest and the write-ahead logs, and opens all the tables. If ctx is done
+// before the DB is opened, OpenWithContext stops, releases the directory locks and the resources
+// acquired so far, and returns ctx.Err(). The files on disk are left as they were, so the DB can
+// be opened again later.
+func OpenWithContext(ctx context.Context, opt Options) (*DB, error) {
 	if err := checkAndSetOptions(&opt); err != nil {
 		return nil, err
 	}
@@ -241,6 +332,9 @@ func Open(opt Options) (*DB, error) {
 			_ = manifestFile.close()
 		}
 	}()
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	db := &DB{
 		imm:              make([]*memTable, 0, opt.NumMemtables),
@@ -255,6 +349,8 @@ func Open(opt Options) (*DB, error) {
 		pub:              newPublisher(),
 		allocPool:        z.NewAllocatorPool(8),
 		bannedNamespaces: &lockedKeys{keys: make(map[uint64]struct{})},
+		keyLocks:         newKeyLocks(),
+		prefixDrops:      &prefixDrops{drops: make(map[string]uint64)},
 		threshold:        initVlogThreshold(&opt),
 	}
 	// Cleanup all the goroutines started by badger in case of an error.
@@ -317,6 +413,14 @@ func Open(opt Options) (*DB, error) {
 		// If badger is running in memory mode, push everything into the LSM Tree.
 		db.opt.ValueThreshold = math.MaxInt32
 	}
+	if db.opt.SyncWrites {
+		db.syncWrites = 1
+	}
+	db.valueLogMaxEntries = db.opt.ValueLogMaxEntries
+	db.numCompactors = int32(db.opt.NumCompactors)
+	db.compactionThroughput = db.opt.CompactionThroughput
+	db.backgroundLimiter.setRate(db.opt.BackgroundThroughput)
+	db.tuned = db.opt
 	krOpt := KeyRegistryOptions{
 		ReadOnly:                      opt.ReadOnly,
 		Dir:                           opt.Dir,
@@ -328,11 +432,20 @@ func Open(opt Options) (*DB, error) {
 	if db.registry, err = OpenKeyRegistry(krOpt); err != nil {
 		return db, err
 	}
+	tenantDir := opt.Dir
+	if opt.InMemory {
+		tenantDir = ""
+	}
+	if db.tenants, err = openTenantKeys(tenantDir, db.registry); err != nil {
+		return db, y.Wrapf(err, "while opening tenant keys")
+	}
+	db.pub.tenants = db.tenants
 	db.calculateSize()
 	db.closers.updateSize = z.NewCloser(1)
 	go db.updateSize(db.closers.updateSize)
 
-	if err := db.openMemTables(db.opt); err != nil {
+	if err = db.openMemTables(ctx, db.opt); err != nil {
+		db.closeMemTableFiles()
 		return nil, y.Wrapf(err, "while opening memtables")
 	}
 
@@ -343,16 +456,26 @@ func Open(opt Options) (*DB, error) {
 	}
 
 	// newLevelsController potentially loads files in directory.
-	if db.lc, err = newLevelsController(db, &manifest); err != nil {
+	if db.lc, err = newLevelsController(ctx, db, &manifest); err != nil {
+		if ctx.Err() != nil {
+			db.closeMemTableFiles()
+		}
 		return db, err
 	}
+	// This is the last point at which opening the DB can be abandoned without having to stop the
+	// background work.
+	if err = ctx.Err(); err != nil {
+		_ = db.lc.close()
+		db.closeMemTableFiles()
+		return nil, err
+	}
 
 	// Initialize vlog struct.
 	db.vlog.init(db)
 
 	if !opt.ReadOnly {
 		db.closers.compactors = z.NewCloser(1)
-		db.lc.startCompact(db.closers.compactors)
+		db.lc.startCompact(db.closers.compactors, db.opt.NumCompactors)
 
 		db.closers.memtable = z.NewCloser(1)
 		go func() {
@@ -385,6 +508,14 @@ func Open(opt Options) (*DB, error) {
 		return db, errors.Wrapf(err, "While setting banned keys")
 	}
 
+	if db.opt.LogArchiveDir != "" && !db.opt.ReadOnly {
+		if db.archiver, err = newLogArchiver(db); err != nil {
+			return db, y.Wrapf(err, "while opening the log archive")
+		}
+		db.closers.logArchive = z.NewCloser(1)
+		go db.archiver.run(db.closers.logArchive)
+	}
+
 	db.closers.writes = z.NewCloser(2)
 	go db.doWrites(db.closers.writes)
 	go db.handleHandovers(db.closers.writes)
@@ -393,10 +524,26 @@ func Open(opt Options) (*DB, error) {
 		db.closers.valueGC = z.NewCloser(1)
 		go db.vlog.waitOnGC(db.closers.valueGC)
 	}
+	if !db.opt.InMemory && !db.opt.ReadOnly && db.opt.AutoGC.Interval > 0 {
+		db.closers.autoGC = z.NewCloser(1)
+		go db.runAutoGC(db.closers.autoGC)
+	}
+	if !db.opt.InMemory && !db.opt.ReadOnly && db.opt.ValueLogTiering.ColdDir != "" {
+		db.closers.tiering = z.NewCloser(1)
+		go db.runVlogTiering(db.closers.tiering)
+	}
 
 	db.closers.pub = z.NewCloser(1)
 	go db.pub.listenForUpdates(db.closers.pub)
 
+	db.closers.dropPrefix = z.NewCloser(0)
+	if err := db.initPrefixDrops(); err != nil {
+		return db, errors.Wrapf(err, "While setting dropped prefixes")
+	}
+	if err := db.recoverAtomicBatches(); err != nil {
+		return db, errors.Wrapf(err, "While recovering atomic batches")
+	}
+
 	valueDirLockGuard = nil
 	dirLockGuard = nil
 	manifestFile = nil
@@ -492,6 +639,12 @@ func (db *DB) cleanup() {
 	if db.closers.updateSize != nil {
 		db.closers.updateSize.Signal()
 	}
+	if db.closers.autoGC != nil {
+		db.closers.autoGC.Signal()
+	}
+	if db.closers.tiering != nil {
+		db.closers.tiering.Signal()
+	}
 	if db.closers.valueGC != nil {
 		db.closers.valueGC.Signal()
 	}
@@ -501,6 +654,9 @@ func (db *DB) cleanup() {
 	if db.closers.pub != nil {
 		db.closers.pub.Signal()
 	}
+	if db.closers.dropPrefix != nil {
+		db.closers.dropPrefix.Signal()
+	}
 
 	db.orc.Stop()
 
@@ -534,6 +690,46 @@ func (db *DB) Close() error {
 	return err
 }
 
+// CloseWithContext closes the DB like Close, but bounds the time spent waiting on the background
+// work by ctx. Once ctx is done, the running compactions are abandoned: the tables they have built
+// are removed, while their input tables remain in place, so no data is lost. The forced compaction
+// of level 0 enabled via CompactL0OnClose is skipped as well. The pending updates are still
+// persisted.
+//
+// The DB is closed even if ctx is done, in which case ctx.Err() is returned unless closing the DB
+// failed for another reason.
+func (db *DB) CloseWithContext(ctx context.Context) error {
+	var err error
+	db.closeOnce.Do(func() {
+		abort := func() {
+			db.opt.Infof("Abandoning the running compactions to close the DB: %v", ctx.Err())
+			atomic.StoreInt32(&db.abortCompactions, 1)
+		}
+		if ctx.Err() != nil {
+			abort()
+		} else {
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-ctx.Done():
+					abort()
+				case <-done:
+				}
+			}()
+		}
+		err = db.close()
+		if err == nil && db.compactionsAborted() {
+			err = ctx.Err()
+		}
+	})
+	return err
+}
+
+func (db *DB) compactionsAborted() bool {
+	return atomic.LoadInt32(&db.abortCompactions) == 1
+}
+
 // IsClosed denotes if the badger DB is closed or not. A DB instance should not
 // be used after closing it.
 func (db *DB) IsClosed() bool {
@@ -546,8 +742,20 @@ func (db *DB) close() (err error) {
 	db.opt.Debugf("Closing database")
 	db.opt.Infof("Lifetime L0 stalled for: %s\n", time.Duration(atomic.LoadInt64(&db.lc.l0stallsMs)))
 
+	// Thaw the DB, as closing it requires the writes and the memtable flushes to be running.
+	db.Thaw()
+
+	// Stop reclaiming the dropped prefixes before blocking the writes, as it writes to the DB.
+	db.closers.dropPrefix.SignalAndWait()
+
 	atomic.StoreInt32(&db.blockWrites, 1)
 
+	if db.closers.autoGC != nil {
+		db.closers.autoGC.SignalAndWait()
+	}
+	if db.closers.tiering != nil {
+		db.closers.tiering.SignalAndWait()
+	}
 	if !db.opt.InMemory {
 		// Stop value GC first.
 		db.closers.valueGC.SignalAndWait()
@@ -556,6 +764,12 @@ func (db *DB) close() (err error) {
 	// Stop writes next.
 	db.closers.writes.SignalAndWait()
 
+	// No more value log files are rotated. Archive the ones left.
+	if db.closers.logArchive != nil {
+		db.closers.logArchive.SignalAndWait()
+		err = y.Wrap(db.archiver.err, "DB.Close")
+	}
+
 	// Don't accept any more write.
 	close(db.writeCh)
 	close(db.sklCh)
@@ -605,14 +819,16 @@ func (db *DB) close() (err error) {
 
 	// Force Compact L0
 	// We don't need to care about cstatus since no parallel compaction is running.
-	if db.opt.CompactL0OnClose {
+	if db.opt.CompactL0OnClose && !db.compactionsAborted() {
 		err := db.lc.doCompact(173, compactionPriority{level: 0, score: 1.73})
-		switch err {
-		case errFillTables:
+		switch {
+		case err == errFillTables:
 			// This error only means that there might be enough tables to do a compaction. So, we
 			// should not report it to the end user to avoid confusing them.
-		case nil:
+		case err == nil:
 			db.opt.Debugf("Force compaction on level 0 done")
+		case errors.Cause(err) == errCompactionAborted:
+			db.opt.Infof("Force compaction on level 0 abandoned")
 		default:
 			db.opt.Warningf("While forcing compaction on level 0: %v", err)
 		}
@@ -733,14 +949,21 @@ func (db *DB) get(key []byte) (y.ValueStruct, error) {
 	}
 	tables, decr := db.getMemTables() // Lock should be released.
 	defer decr()
+	return db.getFromTables(tables, key)
+}
 
+// getFromTables is like get, but looks up the key in the given memtables instead of acquiring a
+// fresh set. This allows batched lookups to share a single memtable snapshot.
+func (db *DB) getFromTables(tables []*memTable, key []byte) (y.ValueStruct, error) {
 	var maxVs y.ValueStruct
 	version := y.ParseTs(key)
 
 	y.NumGetsAdd(db.opt.MetricsEnabled, 1)
+	atomic.AddInt64(&db.metrics.gets, 1)
 	for i := 0; i < len(tables); i++ {
 		vs := tables[i].sl.Get(key)
 		y.NumMemtableGetsAdd(db.opt.MetricsEnabled, 1)
+		atomic.AddInt64(&db.metrics.memtableGets, 1)
 		if vs.Meta == 0 && vs.Value == nil {
 			continue
 		}
@@ -766,34 +989,29 @@ func (db *DB) writeToLSM(b *request) error {
 	defer db.lock.RUnlock()
 	for i, entry := range b.Entries {
 		var err error
-		if db.opt.managedTxns || entry.skipVlogAndSetThreshold(db.valueThreshold()) {
+		if db.opt.managedTxns || db.opt.InMemory ||
+			entry.skipVlogAndSetThreshold(db.valueThreshold()) {
 			// Will include deletion / tombstone case.
-			err = db.mt.Put(entry.Key,
-				y.ValueStruct{
-					Value: entry.Value,
-					// Ensure value pointer flag is removed. Otherwise, the value will fail
-					// to be retrieved during iterator prefetch. `bitValuePointer` is only
-					// known to be set in write to LSM when the entry is loaded from a backup
-					// with lower ValueThreshold and its value was stored in the value log.
-					Meta:      entry.meta &^ bitValuePointer,
-					UserMeta:  entry.UserMeta,
-					ExpiresAt: entry.ExpiresAt,
-				})
+			// Ensure value pointer flag is removed. Otherwise, the value will fail
+			// to be retrieved during iterator prefetch. `bitValuePointer` is only
+			// known to be set in write to LSM when the entry is loaded from a backup
+			// with lower ValueThreshold and its value was stored in the value log.
+			err = db.mt.Put(entry.Key, entry.valueStruct(entry.Value, entry.meta&^bitValuePointer))
 		} else {
 			// Write pointer to Memtable.
 			err = db.mt.Put(entry.Key,
-				y.ValueStruct{
-					Value:     b.Ptrs[i].Encode(),
-					Meta:      entry.meta | bitValuePointer,
-					UserMeta:  entry.UserMeta,
-					ExpiresAt: entry.ExpiresAt,
-				})
+				entry.valueStruct(b.Ptrs[i].Encode(), entry.meta|bitValuePointer))
 		}
 		if err != nil {
 			return y.Wrapf(err, "while writing to memTable")
 		}
 	}
-	if db.opt.SyncWrites {
+	if db.opt.InMemory {
+		return nil
+	}
+	// In managed mode, the values are written to the WAL only, and not to the value log.
+	if mode := b.syncMode(db.shouldSyncWrites()); mode == options.SyncAll ||
+		(mode == options.SyncVlog && db.opt.managedTxns) {
 		return db.mt.SyncWAL()
 	}
 	return nil
@@ -804,10 +1022,14 @@ func (db *DB) writeRequests(reqs []*request) error {
 	if len(reqs) == 0 {
 		return nil
 	}
-
 	done := func(err error) {
 		for _, r := range reqs {
-			r.Err = err
+			// The request may be reused once it's done.
+			db.vlog.blobsWritten(r.Ptrs)
+			// Keep the error of a request which failed on its own.
+			if r.Err == nil {
+				r.Err = err
+			}
 			r.Wg.Done()
 		}
 	}
@@ -817,19 +1039,36 @@ func (db *DB) writeRequests(reqs []*request) error {
 		done(err)
 		return err
 	}
+	// Leave out the requests which failed to stream a value to the value log.
+	written := reqs
+	for _, b := range reqs {
+		if b.Err != nil {
+			written = make([]*request, 0, len(reqs))
+			for _, b := range reqs {
+				if b.Err == nil {
+					written = append(written, b)
+				}
+			}
+			break
+		}
+	}
 
 	db.opt.Debugf("Sending updates to subscribers")
-	db.pub.sendUpdates(reqs)
+	db.pub.sendUpdates(written)
 	db.opt.Debugf("Writing to memtable")
 	var count int
-	for _, b := range reqs {
+	for _, b := range written {
 		if len(b.Entries) == 0 {
 			continue
 		}
 		count += len(b.Entries)
 		var i uint64
 		var err error
+		stallStart := time.Now()
 		for err = db.ensureRoomForWrite(); err == errNoRoom; err = db.ensureRoomForWrite() {
+			if i == 0 {
+				atomic.AddInt64(&db.metrics.writeStalls, 1)
+			}
 			i++
 			if i%100 == 0 {
 				db.opt.Debugf("Making room for writes")
@@ -839,10 +1078,16 @@ func (db *DB) writeRequests(reqs []*request) error {
 			// you will get a deadlock.
 			time.Sleep(10 * time.Millisecond)
 		}
+		if i > 0 {
+			atomic.AddInt64(&db.metrics.writeStallNs, int64(time.Since(stallStart)))
+		}
 		if err != nil {
 			done(err)
 			return y.Wrap(err, "writeRequests")
 		}
+		if db.trackVlogSpace() {
+			db.trackDeadValues(b)
+		}
 		if err := db.writeToLSM(b); err != nil {
 			done(err)
 			return y.Wrap(err, "writeRequests")
@@ -854,11 +1099,25 @@ func (db *DB) writeRequests(reqs []*request) error {
 }
 
 func (db *DB) sendToWriteCh(entries []*Entry) (*request, error) {
+	return db.sendToWriteChWithOptions(entries, WriteOptions{})
+}
+
+func (db *DB) sendToWriteChWithOptions(entries []*Entry, opt WriteOptions) (*request, error) {
+	return db.sendToWriteChWithContext(context.Background(), entries, opt)
+}
+
+// sendToWriteChWithContext is like sendToWriteChWithOptions, but gives up waiting for room in the
+// write channel once ctx is done, returning ctx.Err().
+func (db *DB) sendToWriteChWithContext(ctx context.Context, entries []*Entry,
+	opt WriteOptions) (*request, error) {
 	if atomic.LoadInt32(&db.blockWrites) == 1 {
 		return nil, ErrBlockedWrites
 	}
 	var count, size int64
 	for _, e := range entries {
+		if err := db.tenants.encrypt(e); err != nil {
+			return nil, y.Wrapf(err, "while encrypting with tenant key")
+		}
 		size += e.estimateSizeAndSetThreshold(db.valueThreshold())
 		count++
 	}
@@ -871,10 +1130,17 @@ func (db *DB) sendToWriteCh(entries []*Entry) (*request, error) {
 	req := requestPool.Get().(*request)
 	req.reset()
 	req.Entries = entries
+	req.sync = opt.Sync
 	req.Wg.Add(1)
-	req.IncrRef()     // for db write
-	db.writeCh <- req // Handled in doWrites.
+	req.IncrRef() // for db write
+	select {
+	case db.writeCh <- req: // Handled in doWrites.
+	case <-ctx.Done():
+		req.DecrRef()
+		return nil, ctx.Err()
+	}
 	y.NumPutsAdd(db.opt.MetricsEnabled, int64(len(entries)))
+	atomic.AddInt64(&db.metrics.puts, int64(len(entries)))
 
 	return req, nil
 }
@@ -1018,6 +1284,29 @@ func (db *DB) ensureRoomForWrite() error {
 	}
 }
 
+// rotateMemTable pushes mt to flushChan and replaces it with a new memtable, if mt is the current
+// memtable and isn't empty. It returns errNoRoom if flushChan is full.
+func (db *DB) rotateMemTable(mt *memTable) error {
+	var err error
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.mt != mt || db.mt.sl.Empty() {
+		return nil
+	}
+	select {
+	case db.flushChan <- flushTask{mt: db.mt}:
+		db.imm = append(db.imm, db.mt)
+		db.mt, err = db.newMemTable()
+		if err != nil {
+			return y.Wrapf(err, "cannot create new mem table")
+		}
+		return nil
+	default:
+		return errNoRoom
+	}
+}
+
 func (db *DB) handoverSkiplist(r *handoverRequest) error {
 	skl, callback := r.skl, r.callback
 	// If we have some data in db.mt, we should push that first, so the ordering of writes is
@@ -1047,10 +1336,11 @@ func (db *DB) handoverSkiplist(r *handoverRequest) error {
 	for it.SeekToFirst(); it.Valid(); it.Next() {
 		v := it.Value()
 		e := &Entry{
-			Key:       it.Key(),
-			Value:     v.Value,
-			ExpiresAt: v.ExpiresAt,
-			UserMeta:  v.UserMeta,
+			Key:         it.Key(),
+			Value:       v.Value,
+			ExpiresAt:   v.ExpiresAt,
+			UserMeta:    v.UserMeta,
+			UserMetaExt: v.UserMetaExt,
 		}
 		entries = append(entries, e)
 	}
@@ -1155,6 +1445,7 @@ func (db *DB) handleFlushTask(ft flushTask) error {
 	if err != nil {
 		return y.Wrap(err, "error while creating table")
 	}
+	db.backgroundLimiter.wait(tbl.Size())
 	// We own a ref on tbl.
 	err = db.lc.addLevel0Table(tbl) // This will incrRef
 	_ = tbl.DecrRef()               // Releases our ref.
@@ -1329,7 +1620,9 @@ func (db *DB) updateSize(lc *z.Closer) {
 // can discard at least discardRatio space of that file, it would be rewritten.
 //
 // If a call to RunValueLogGC results in no rewrites, then an ErrNoRewrite is
-// thrown indicating that the call resulted in no file rewrites.
+// thrown indicating that the call resulted in no file rewrites. Either way, the
+// GCResult returned reports the files rewritten, the entries moved and the
+// space reclaimed by the call.
 //
 // We recommend setting discardRatio to 0.5, thus indicating that a file be
 // rewritten if half the space can be discarded.  This results in a lifetime
@@ -1345,16 +1638,40 @@ func (db *DB) updateSize(lc *z.Closer) {
 //
 // Note: Every time GC is run, it would produce a spike of activity on the LSM
 // tree.
-func (db *DB) RunValueLogGC(discardRatio float64) error {
+func (db *DB) RunValueLogGC(discardRatio float64) (GCResult, error) {
+	return db.RunValueLogGCWithContext(context.Background(), discardRatio)
+}
+
+// RunValueLogGCWithContext works like RunValueLogGC, but stops rewriting the value log file once
+// ctx is done, and returns ctx.Err(). The entries moved to the head of the value log so far are
+// kept, and the next run of the GC, with either method, resumes the rewrite of the same file
+// where it stopped, before picking another file. This bounds the time spent in a single run,
+// e.g. to only run the GC in off-peak hours.
+//
+// Like RunValueLogGC, it returns what the run did, even if it stopped midway, so that a scheduler
+// can tell whether running the GC again is worth it.
+func (db *DB) RunValueLogGCWithContext(ctx context.Context, discardRatio float64) (GCResult,
+	error) {
+
 	if db.opt.InMemory {
-		return ErrGCInMemoryMode
+		return GCResult{}, ErrGCInMemoryMode
 	}
 	if discardRatio >= 1.0 || discardRatio <= 0.0 {
-		return ErrInvalidRequest
+		return GCResult{}, ErrInvalidRequest
 	}
 
 	// Pick a log file and run GC
-	return db.vlog.runGC(discardRatio)
+	res, err := db.vlog.runGC(ctx, discardRatio)
+	switch err {
+	case nil:
+		atomic.AddInt64(&db.metrics.vlogGCRuns, 1)
+	case ErrNoRewrite:
+		atomic.AddInt64(&db.metrics.vlogGCNoRewrites, 1)
+	case ErrRejected, ctx.Err():
+	default:
+		atomic.AddInt64(&db.metrics.vlogGCErrors, 1)
+	}
+	return res, err
 }
 
 // Size returns the size of lsm and value log files in bytes. It can be used to decide how often to
@@ -1377,13 +1694,26 @@ type Sequence struct {
 	next      uint64
 	leased    uint64
 	bandwidth uint64
+	// gapless is set if the sequence persists every value it hands out. See GetGaplessSequence.
+	gapless bool
 }
 
 // Next would return the next integer in the sequence, updating the lease by running a transaction
-// if needed.
+// if needed. For a gapless sequence, every call runs a synced transaction.
 func (seq *Sequence) Next() (uint64, error) {
 	seq.lock.Lock()
 	defer seq.lock.Unlock()
+	if seq.gapless {
+		var val uint64
+		err := seq.update(func(txn *Txn) error {
+			var err error
+			if val, err = seq.stored(txn); err != nil {
+				return err
+			}
+			return seq.store(txn, val+1)
+		})
+		return val, err
+	}
 	if seq.next >= seq.leased {
 		if err := seq.updateLease(); err != nil {
 			return 0, err
@@ -1394,32 +1724,55 @@ func (seq *Sequence) Next() (uint64, error) {
 	return val, nil
 }
 
+// Peek returns the integer which would be returned by the next call to Next, without consuming it.
+func (seq *Sequence) Peek() (uint64, error) {
+	seq.lock.Lock()
+	defer seq.lock.Unlock()
+	if !seq.gapless {
+		return seq.next, nil
+	}
+	var val uint64
+	err := seq.db.View(func(txn *Txn) error {
+		var err error
+		val, err = seq.stored(txn)
+		return err
+	})
+	return val, err
+}
+
+// SetNext sets the integer to be returned by the next call to Next, which can be used to seed or
+// reset the sequence. The current lease, if any, is released.
+func (seq *Sequence) SetNext(next uint64) error {
+	seq.lock.Lock()
+	defer seq.lock.Unlock()
+	err := seq.update(func(txn *Txn) error {
+		return seq.store(txn, next)
+	})
+	if err != nil {
+		return err
+	}
+	seq.next, seq.leased = next, next
+	return nil
+}
+
 // Release the leased sequence to avoid wasted integers. This should be done right
 // before closing the associated DB. However it is valid to use the sequence after
 // it was released, causing a new lease with full bandwidth.
 func (seq *Sequence) Release() error {
 	seq.lock.Lock()
 	defer seq.lock.Unlock()
+	if seq.gapless {
+		// Nothing is leased.
+		return nil
+	}
 	err := seq.db.Update(func(txn *Txn) error {
-		item, err := txn.Get(seq.key)
+		num, err := seq.stored(txn)
 		if err != nil {
 			return err
 		}
-
-		var num uint64
-		if err := item.Value(func(v []byte) error {
-			num = binary.BigEndian.Uint64(v)
-			return nil
-		}); err != nil {
-			return err
-		}
-
 		if num == seq.leased {
-			var buf [8]byte
-			binary.BigEndian.PutUint64(buf[:], seq.next)
-			return txn.SetEntry(NewEntry(seq.key, buf[:]))
+			return seq.store(txn, seq.next)
 		}
-
 		return nil
 	})
 	if err != nil {
@@ -1431,27 +1784,14 @@ func (seq *Sequence) Release() error {
 
 func (seq *Sequence) updateLease() error {
 	return seq.db.Update(func(txn *Txn) error {
-		item, err := txn.Get(seq.key)
-		switch {
-		case err == ErrKeyNotFound:
-			seq.next = 0
-		case err != nil:
+		num, err := seq.stored(txn)
+		if err != nil {
 			return err
-		default:
-			var num uint64
-			if err := item.Value(func(v []byte) error {
-				num = binary.BigEndian.Uint64(v)
-				return nil
-			}); err != nil {
-				return err
-			}
-			seq.next = num
 		}
+		seq.next = num
 
 		lease := seq.next + seq.bandwidth
-		var buf [8]byte
-		binary.BigEndian.PutUint64(buf[:], lease)
-		if err = txn.SetEntry(NewEntry(seq.key, buf[:])); err != nil {
+		if err = seq.store(txn, lease); err != nil {
 			return err
 		}
 		seq.leased = lease
@@ -1459,6 +1799,43 @@ func (seq *Sequence) updateLease() error {
 	})
 }
 
+// update runs fn in a read-write transaction. The transaction is synced to disk for a gapless
+// sequence, so that the values it hands out are never reused after a crash.
+func (seq *Sequence) update(fn func(txn *Txn) error) error {
+	txn := seq.db.NewTransaction(true)
+	defer txn.Discard()
+	if seq.gapless {
+		txn.SetWriteOptions(WriteOptions{Sync: options.SyncAll})
+	}
+	if err := fn(txn); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// stored returns the integer stored under the key of the sequence, or zero if there is none.
+func (seq *Sequence) stored(txn *Txn) (uint64, error) {
+	item, err := txn.Get(seq.key)
+	switch {
+	case err == ErrKeyNotFound:
+		return 0, nil
+	case err != nil:
+		return 0, err
+	}
+	var num uint64
+	err = item.Value(func(v []byte) error {
+		num = binary.BigEndian.Uint64(v)
+		return nil
+	})
+	return num, err
+}
+
+func (seq *Sequence) store(txn *Txn, num uint64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], num)
+	return txn.SetEntry(NewEntry(seq.key, buf[:]))
+}
+
 // GetSequence would initiate a new sequence object, generating it from the stored lease, if
 // available, in the database. Sequence can be used to get a list of monotonically increasing
 // integers. Multiple sequences can be created by providing different keys. Bandwidth sets the
@@ -1487,6 +1864,22 @@ func (db *DB) GetSequence(key []byte, bandwidth uint64) (*Sequence, error) {
 	return seq, err
 }
 
+// GetGaplessSequence is like GetSequence, but returns a sequence which doesn't lease integers.
+// Instead, every call to Next persists the integer it returns in a transaction synced to disk, so
+// no integers are skipped, even if the process or the machine crashes. This makes Next much slower
+// than for a leased sequence.
+//
+// GetGaplessSequence is not supported on ManagedDB. Calling this would result in a panic.
+func (db *DB) GetGaplessSequence(key []byte) (*Sequence, error) {
+	if db.opt.managedTxns {
+		panic("Cannot use GetGaplessSequence with managedDB=true.")
+	}
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	return &Sequence{db: db, key: key, gapless: true}, nil
+}
+
 // Tables gets the TableInfo objects from the level controller. If withKeysCount
 // is true, TableInfo objects also contain counts of keys for the tables.
 func (db *DB) Tables() []TableInfo {
@@ -1511,10 +1904,168 @@ func (db *DB) EstimateSize(prefix []byte) (uint64, uint64) {
 	return onDiskSize, uncompressedSize
 }
 
-// Ranges can be used to get rough key ranges to divide up iteration over the DB. The ranges here
-// would consider the prefix, but would not necessarily start or end with the prefix. In fact, the
-// first range would have nil as left key, and the last range would have nil as the right key.
-func (db *DB) Ranges(prefix []byte, numRanges int) []*keyRange {
+// PrefixSize is the on-disk usage attributed to a key prefix. See DB.SizeByPrefix.
+type PrefixSize struct {
+	// LSMSize is an estimate of the size of the SSTables holding the keys with the prefix.
+	LSMSize int64
+	// VlogSize is the size of the value log entries referenced by the keys with the prefix.
+	VlogSize int64
+	// NumVersions is the number of versions of the keys with the prefix, including deletes.
+	NumVersions int64
+}
+
+// SizeByPrefix returns the on-disk usage attributed to the keys with the given prefix, which can be
+// used to account for the usage of a tenant.
+//
+// The LSM size is estimated from the blocks of the SSTables overlapping with the prefix, so it's
+// cheap to compute but can overestimate the usage of small prefixes. The value log size is
+// computed by iterating over all the versions of the keys with the prefix and summing up the
+// sizes of the value log entries they point to, without reading the values themselves. Data in
+// the memtables, and value log entries which aren't referenced anymore but haven't been garbage
+// collected yet, are not accounted for.
+func (db *DB) SizeByPrefix(prefix []byte) PrefixSize {
+	var res PrefixSize
+	for _, l := range db.lc.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			if containsPrefix(t, prefix) {
+				res.LSMSize += int64(t.PrefixSize(prefix))
+			}
+		}
+		l.RUnlock()
+	}
+
+	var txn *Txn
+	if db.opt.managedTxns {
+		txn = db.NewTransactionAt(math.MaxUint64, false)
+	} else {
+		txn = db.NewTransaction(false)
+	}
+	defer txn.Discard()
+
+	iopt := DefaultIteratorOptions
+	iopt.Prefix = prefix
+	iopt.PrefetchValues = false
+	iopt.AllVersions = true
+	itr := txn.NewIterator(iopt)
+	defer itr.Close()
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		item := itr.Item()
+		res.NumVersions++
+		if item.meta&bitValuePointer > 0 {
+			var vp valuePointer
+			vp.Decode(item.vptr)
+			res.VlogSize += int64(vp.Len)
+		}
+	}
+	return res
+}
+
+// KeyRange is a range of keys returned by DB.Ranges. It holds the keys from Left, inclusive, up to
+// Right, exclusive. A nil Left or Right means that the range is unbounded on that side.
+type KeyRange struct {
+	Left  []byte
+	Right []byte
+	// EstimatedSize is an estimate of the uncompressed size of the SSTables overlapping with the
+	// range. The unbounded parts of the key space aren't accounted for.
+	EstimatedSize int64
+}
+
+// Ranges can be used to get rough key ranges to divide up iteration over the DB, for example to
+// scan the DB in parallel. The ranges are contiguous and sorted, and are grouped so that the sizes
+// of the SSTables overlapping with each range are roughly equal, with numRanges being a target
+// rather than the exact number of ranges returned.
+//
+// The ranges here would consider the prefix, but would not necessarily start or end with the
+// prefix. In fact, the first range would have nil as left key, and the last range would have nil
+// as the right key.
+func (db *DB) Ranges(prefix []byte, numRanges int) []KeyRange {
+	krs := db.ranges(prefix, numRanges)
+	ranges := make([]KeyRange, 0, len(krs))
+	for _, kr := range krs {
+		ranges = append(ranges, KeyRange{Left: kr.left, Right: kr.right, EstimatedSize: kr.size})
+	}
+	return ranges
+}
+
+// ParallelScan iterates over all the keys with the given prefix at a single read timestamp, using
+// the given number of goroutines. Like Stream, it splits the prefix into ranges of keys, using the
+// indexes of the SSTables, and each goroutine iterates over a range at a time. fn is called with
+// the items of each range in order, but concurrently across the ranges, so it must be safe for
+// concurrent use. The item is only valid until fn returns. The first error returned by fn stops
+// the scan, and is returned.
+func (db *DB) ParallelScan(prefix []byte, workers int, fn func(item *Item) error) error {
+	if db.IsClosed() {
+		return ErrDBClosed
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	readTs := uint64(math.MaxUint64)
+	if !db.opt.managedTxns {
+		snap := db.Snapshot()
+		defer snap.Release()
+		readTs = snap.ReadTs()
+	}
+
+	// Use more ranges than workers, so that the work is spread evenly.
+	ranges := db.ranges(prefix, 4*workers)
+	rangeCh := make(chan *keyRange, len(ranges))
+	for _, kr := range ranges {
+		rangeCh <- kr
+	}
+	close(rangeCh)
+
+	var stop int32
+	scan := func(txn *Txn, kr *keyRange) error {
+		opt := DefaultIteratorOptions
+		opt.Prefix = prefix
+		opt.LowerBound = kr.left
+		opt.UpperBound = kr.right
+		itr := txn.NewIterator(opt)
+		defer itr.Close()
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			if atomic.LoadInt32(&stop) == 1 {
+				return nil
+			}
+			if err := fn(itr.Item()); err != nil {
+				atomic.StoreInt32(&stop, 1)
+				return err
+			}
+		}
+		return nil
+	}
+
+	errCh := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			txn := db.newReadTxnAt(readTs)
+			defer txn.Discard()
+			for kr := range rangeCh {
+				if atomic.LoadInt32(&stop) == 1 {
+					break
+				}
+				if err := scan(txn, kr); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			errCh <- nil
+		}()
+	}
+	var rerr error
+	for i := 0; i < workers; i++ {
+		if err := <-errCh; err != nil && rerr == nil {
+			rerr = err
+		}
+	}
+	return rerr
+}
+
+func (db *DB) ranges(prefix []byte, numRanges int) []*keyRange {
+	if numRanges < 1 {
+		numRanges = 1
+	}
 	var splits []string
 	tables := db.Tables()
 
@@ -1656,7 +2207,7 @@ func (db *DB) startCompactions() {
 	// Resume compactions.
 	if db.closers.compactors != nil {
 		db.closers.compactors = z.NewCloser(1)
-		db.lc.startCompact(db.closers.compactors)
+		db.lc.startCompact(db.closers.compactors, int(atomic.LoadInt32(&db.numCompactors)))
 	}
 }
 
@@ -1671,17 +2222,64 @@ func (db *DB) startMemoryFlush() {
 	}
 }
 
+// FlattenOptions are the options for DB.FlattenWithContext.
+type FlattenOptions struct {
+	// NumWorkers is the number of compactions run concurrently on a level.
+	NumWorkers int
+	// Progress, if set, is called after every round of compactions with the progress so far.
+	Progress func(FlattenProgress)
+}
+
+// FlattenProgress reports the progress of a Flatten call.
+type FlattenProgress struct {
+	// Level is the level being compacted in the last round.
+	Level int
+	// TablesCompacted is the number of tables which have been compacted so far.
+	TablesCompacted int64
+	// BytesCompacted is the on-disk size of the tables which have been compacted so far.
+	BytesCompacted int64
+}
+
 // Flatten can be used to force compactions on the LSM tree so all the tables fall on the same
 // level. This ensures that all the versions of keys are colocated and not split across multiple
 // levels, which is necessary after a restore from backup. During Flatten, live compactions are
 // stopped. Ideally, no writes are going on during Flatten. Otherwise, it would create competition
 // between flattening the tree and new tables being created at level zero.
 func (db *DB) Flatten(workers int) error {
+	return db.FlattenWithContext(context.Background(), FlattenOptions{NumWorkers: workers})
+}
+
+// FlattenWithContext is like Flatten, but stops once ctx is done, returning ctx.Err(), and reports
+// its progress via opt.Progress. Cancellation takes effect in between rounds of compactions.
+//
+// A running flatten can be paused via PauseFlatten, in which case it stops issuing compactions
+// (live compactions remain stopped as well) until ResumeFlatten is called or ctx is done.
+func (db *DB) FlattenWithContext(ctx context.Context, opt FlattenOptions) error {
+	workers := opt.NumWorkers
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	db.stopCompactions()
 	defer db.startCompactions()
 
+	stats := &compactionStats{}
+	report := func(level int) {
+		if opt.Progress == nil {
+			return
+		}
+		opt.Progress(FlattenProgress{
+			Level:           level,
+			TablesCompacted: atomic.LoadInt64(&stats.tables),
+			BytesCompacted:  atomic.LoadInt64(&stats.bytes),
+		})
+	}
+
 	compactAway := func(cp compactionPriority) error {
+		if err := db.flattenPauser.wait(ctx); err != nil {
+			return err
+		}
+		cp.stats = stats
 		db.opt.Infof("Attempting to compact with %+v\n", cp)
 		errCh := make(chan error, 1)
 		for i := 0; i < workers; i++ {
@@ -1706,7 +2304,8 @@ func (db *DB) Flatten(workers int) error {
 		// We could do at least one successful compaction. So, we'll consider this a success.
 		db.opt.Infof("%d compactor(s) succeeded. One or more tables from level %d compacted.\n",
 			success, cp.level)
-		return nil
+		report(cp.level)
+		return ctx.Err()
 	}
 
 	hbytes := func(sz int64) string {
@@ -1744,6 +2343,107 @@ func (db *DB) Flatten(workers int) error {
 	}
 }
 
+// PauseFlatten pauses any running and future Flatten calls until ResumeFlatten is called. The
+// compaction which is currently running, if any, is completed before pausing.
+func (db *DB) PauseFlatten() {
+	db.flattenPauser.pause()
+}
+
+// ResumeFlatten resumes Flatten calls paused via PauseFlatten.
+func (db *DB) ResumeFlatten() {
+	db.flattenPauser.resume()
+}
+
+// PauseCompactions stops the background compactions until ResumeCompactions is called, waiting
+// for the running ones to finish. This quiesces the background I/O of the DB during latency
+// critical windows, or while taking a filesystem snapshot, without closing the DB. The pauses are
+// counted, so each call must be matched by a call to ResumeCompactions. The memtable flushes, and
+// the compactions run by Flatten, CompactLevel, CompactTables or DropPrefix, keep running.
+// Writes might stall if L0 fills up while the compactions are paused.
+func (db *DB) PauseCompactions() {
+	db.opt.Infof("Pausing compactions")
+	db.compactionGate.pause()
+}
+
+// ResumeCompactions resumes the background compactions paused via PauseCompactions, once it has
+// been called as many times as PauseCompactions. It is a no-op if the compactions aren't paused.
+func (db *DB) ResumeCompactions() {
+	db.compactionGate.resume()
+}
+
+// CompactLevel compacts all the tables of the given level into the next level, or rewrites them in
+// place if it is the last level, dropping the versions which are no longer needed. The tables of
+// L0 are compacted into the base level. This allows forcing the compaction of L0 after a bulk
+// ingest, or of a stale last level, which the live compactions would otherwise not pick yet.
+// Live compactions are stopped while it runs.
+func (db *DB) CompactLevel(level int) error {
+	if level < 0 || level >= len(db.lc.levels) {
+		return errors.Wrapf(ErrInvalidRequest, "Level %d is out of range [0, %d)",
+			level, len(db.lc.levels))
+	}
+	return db.compactTables(func() (int, []*table.Table, error) {
+		lh := db.lc.levels[level]
+		lh.RLock()
+		defer lh.RUnlock()
+		return level, append([]*table.Table{}, lh.tables...), nil
+	})
+}
+
+// CompactTables compacts the tables with the given IDs, which must all be on the same level, like
+// CompactLevel does. Compacting L0 tables also compacts all the L0 tables older than them.
+func (db *DB) CompactTables(ids []uint64) error {
+	return db.compactTables(func() (int, []*table.Table, error) {
+		want := make(map[uint64]struct{}, len(ids))
+		for _, id := range ids {
+			want[id] = struct{}{}
+		}
+		level := -1
+		var tables []*table.Table
+		for _, lh := range db.lc.levels {
+			lh.RLock()
+			for _, t := range lh.tables {
+				if _, ok := want[t.ID()]; !ok {
+					continue
+				}
+				if level >= 0 && level != lh.level {
+					lh.RUnlock()
+					return 0, nil, errors.Wrapf(ErrInvalidRequest,
+						"Tables are on levels %d and %d", level, lh.level)
+				}
+				level = lh.level
+				tables = append(tables, t)
+				delete(want, t.ID())
+			}
+			lh.RUnlock()
+		}
+		for id := range want {
+			return 0, nil, errors.Wrapf(ErrInvalidRequest, "Table %d not found", id)
+		}
+		return level, tables, nil
+	})
+}
+
+// compactTables compacts the tables picked by pick, once the live compactions are stopped. It holds
+// freezeLock throughout, which serializes the manual compactions with each other and with Freeze.
+func (db *DB) compactTables(pick func() (int, []*table.Table, error)) error {
+	if db.opt.ReadOnly {
+		return errors.Wrapf(ErrInvalidRequest, "Unable to compact a read-only DB")
+	}
+	db.freezeLock.Lock()
+	defer db.freezeLock.Unlock()
+	if db.thaw != nil {
+		return errors.Wrapf(ErrInvalidRequest, "Unable to compact a frozen DB")
+	}
+	db.stopCompactions()
+	defer db.startCompactions()
+
+	level, tables, err := pick()
+	if err != nil || len(tables) == 0 {
+		return err
+	}
+	return db.lc.compactTables(level, tables)
+}
+
 func (db *DB) blockWrite() error {
 	// Stop accepting new writes.
 	if !atomic.CompareAndSwapInt32(&db.blockWrites, 0, 1) {
@@ -1804,6 +2504,86 @@ func (db *DB) prepareToDrop() (func(), error) {
 	}
 }
 
+// Freeze blocks the writes and quiesces the background work of the DB until Thaw is called, without
+// closing the DB. While the DB is frozen, the files in its directories are not modified, which
+// allows, for example, taking a filesystem snapshot of them. Freeze does the following:
+// - Stop accepting new writes, which fail with ErrBlockedWrites.
+// - Write the pending writes, and sync the value log and the write-ahead log of the memtable.
+// - Flush the memtables queued for flushing, and stop the memtable flushes.
+// - Wait for the running compactions and the reclamation of dropped prefixes, and stop them.
+//
+// The reads, iterators and subscriptions keep working while the DB is frozen. The operations which
+// rewrite data, like DropAll, DropPrefix, Flatten and value log GC, must not be run while the DB is
+// frozen.
+func (db *DB) Freeze() error {
+	db.freezeLock.Lock()
+	defer db.freezeLock.Unlock()
+	if db.thaw != nil {
+		return errors.Wrapf(ErrInvalidRequest, "DB is already frozen")
+	}
+	if db.opt.ReadOnly {
+		// Nothing modifies the files of a read-only DB.
+		db.thaw = func() {}
+		return nil
+	}
+
+	db.opt.Infof("Freezing the DB. Blocking writes...")
+	// Wait for the running reclamation of dropped prefixes to finish, and hold off the next ones
+	// until the DB is thawed, as they flush memtables and run compactions.
+	db.prefixDrops.reclaim.Lock()
+	resume, err := db.prepareToDrop()
+	if err != nil {
+		resume()
+		db.prefixDrops.reclaim.Unlock()
+		return err
+	}
+	db.stopCompactions()
+	thaw := func() {
+		db.opt.Infof("Thawing the DB")
+		db.startCompactions()
+		resume()
+		db.prefixDrops.reclaim.Unlock()
+	}
+	if err := db.syncForFreeze(); err != nil {
+		thaw()
+		return err
+	}
+	db.thaw = thaw
+	db.opt.Infof("DB frozen")
+	return nil
+}
+
+func (db *DB) syncForFreeze() error {
+	if db.opt.InMemory {
+		return nil
+	}
+	if err := db.vlog.sync(); err != nil {
+		return y.Wrapf(err, "while syncing the value log")
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return y.Wrapf(db.mt.SyncWAL(), "while syncing the memtable")
+}
+
+// isFrozen tells if the DB is frozen via Freeze.
+func (db *DB) isFrozen() bool {
+	db.freezeLock.Lock()
+	defer db.freezeLock.Unlock()
+	return db.thaw != nil
+}
+
+// Thaw resumes the writes and the background work of a DB frozen via Freeze. It is a no-op if the
+// DB isn't frozen.
+func (db *DB) Thaw() {
+	db.freezeLock.Lock()
+	defer db.freezeLock.Unlock()
+	if db.thaw == nil {
+		return
+	}
+	db.thaw()
+	db.thaw = nil
+}
+
 // DropAll would drop all the data stored in Badger. It does this in the following way.
 // - Stop accepting new writes.
 // - Pause memtable flushes and compactions.
@@ -2220,6 +3000,12 @@ func createDirs(opt Options) error {
 			}
 		}
 	}
+	// The cold value log directory may be missing in read-only mode, if no file was moved yet.
+	if coldDir := opt.ValueLogTiering.ColdDir; coldDir != "" && !opt.ReadOnly {
+		if err := os.MkdirAll(coldDir, 0700); err != nil {
+			return y.Wrapf(err, "Error Creating Dir: %q", coldDir)
+		}
+	}
 	return nil
 }
 
@@ -2258,7 +3044,101 @@ func (db *DB) StreamDB(outOptions Options) error {
 
 // Opts returns a copy of the DB options.
 func (db *DB) Opts() Options {
-	return db.opt
+	db.optLock.Lock()
+	defer db.optLock.Unlock()
+	return db.tuned
+}
+
+// SetOptions changes the options which can be tuned while the DB is open, without reopening it.
+// These are NumCompactors, CompactionThroughput, BackgroundThroughput, BlockCacheSize,
+// IndexCacheSize, ValueLogMaxEntries, SyncWrites and the level of the default logger, set via
+// WithLoggingLevel.
+// The other fields of opt are ignored, so opt would usually be derived from DB.Opts:
+//
+//	err := db.SetOptions(db.Opts().WithNumCompactors(8).WithSyncWrites(true))
+//
+// The caches can be resized, but can't be enabled or disabled. Changing NumCompactors restarts the
+// compactors, which waits for the running compactions to finish. NumCompactors can't be changed
+// while the DB is frozen.
+func (db *DB) SetOptions(opt Options) error {
+	db.optLock.Lock()
+	defer db.optLock.Unlock()
+	if opt.NumCompactors != db.tuned.NumCompactors {
+		// Restarting the compactors is serialized with Freeze and the manual compactions.
+		db.freezeLock.Lock()
+		defer db.freezeLock.Unlock()
+		if db.thaw != nil {
+			return errors.Wrapf(ErrInvalidRequest,
+				"Cannot change the number of compactors while the DB is frozen")
+		}
+	}
+
+	switch {
+	case opt.NumCompactors == 1 || opt.NumCompactors < 0:
+		return errors.Wrapf(ErrInvalidRequest, "Cannot have %d compactors", opt.NumCompactors)
+	case opt.CompactionThroughput < 0:
+		return errors.Wrapf(ErrInvalidRequest, "Invalid CompactionThroughput: %d",
+			opt.CompactionThroughput)
+	case opt.BackgroundThroughput < 0:
+		return errors.Wrapf(ErrInvalidRequest, "Invalid BackgroundThroughput: %d",
+			opt.BackgroundThroughput)
+	case (opt.BlockCacheSize > 0) != (db.blockCache != nil):
+		return errors.Wrapf(ErrInvalidRequest,
+			"Cannot enable or disable the block cache while the DB is open")
+	case (opt.IndexCacheSize > 0) != (db.indexCache != nil):
+		return errors.Wrapf(ErrInvalidRequest,
+			"Cannot enable or disable the index cache while the DB is open")
+	}
+	var logger, curLogger *defaultLog
+	if opt.Logger != db.tuned.Logger {
+		var ok, curOk bool
+		logger, ok = opt.Logger.(*defaultLog)
+		curLogger, curOk = db.tuned.Logger.(*defaultLog)
+		if !ok || !curOk {
+			return errors.Wrapf(ErrInvalidRequest,
+				"Only the level of the default logger can be changed while the DB is open")
+		}
+	}
+
+	if opt.BlockCacheSize != db.tuned.BlockCacheSize {
+		db.blockCache.UpdateMaxCost(opt.BlockCacheSize)
+		db.tuned.BlockCacheSize = opt.BlockCacheSize
+	}
+	if opt.IndexCacheSize != db.tuned.IndexCacheSize {
+		db.indexCache.UpdateMaxCost(opt.IndexCacheSize)
+		db.tuned.IndexCacheSize = opt.IndexCacheSize
+	}
+	db.tuned.ValueLogMaxEntries = opt.ValueLogMaxEntries
+	atomic.StoreUint32(&db.valueLogMaxEntries, opt.ValueLogMaxEntries)
+	if !db.opt.InMemory {
+		db.tuned.SyncWrites = opt.SyncWrites
+		var syncWrites int32
+		if opt.SyncWrites {
+			syncWrites = 1
+		}
+		atomic.StoreInt32(&db.syncWrites, syncWrites)
+	}
+	db.tuned.CompactionThroughput = opt.CompactionThroughput
+	atomic.StoreInt64(&db.compactionThroughput, opt.CompactionThroughput)
+	db.tuned.BackgroundThroughput = opt.BackgroundThroughput
+	db.backgroundLimiter.setRate(opt.BackgroundThroughput)
+	if logger != nil {
+		curLogger.setLevel(logger.getLevel())
+	}
+	if opt.NumCompactors != db.tuned.NumCompactors {
+		db.opt.Infof("Changing the number of compactors from %d to %d",
+			db.tuned.NumCompactors, opt.NumCompactors)
+		db.stopCompactions()
+		db.tuned.NumCompactors = opt.NumCompactors
+		atomic.StoreInt32(&db.numCompactors, int32(opt.NumCompactors))
+		db.startCompactions()
+	}
+	return nil
+}
+
+// shouldSyncWrites returns the current value of opt.SyncWrites.
+func (db *DB) shouldSyncWrites() bool {
+	return atomic.LoadInt32(&db.syncWrites) == 1
 }
 
 type CacheType int
@@ -286,7 +286,7 @@ func TestBigKeyValuePairs(t *testing.T) {
 		var loops int
 		var err error
 		for err == nil {
-			err = db.RunValueLogGC(0.5)
+			_, err = db.RunValueLogGC(0.5)
 			require.NotRegexp(t, regexp.MustCompile("truncate"), err)
 			loops++
 		}
@@ -610,7 +610,7 @@ func TestL0GCBug(t *testing.T) {
 	// one value log file is garbage collected.
 	success := 0
 	for i := 0; i < 10; i++ {
-		err := db1.RunValueLogGC(0.01)
+		_, err := db1.RunValueLogGC(0.01)
 		if err == nil {
 			success++
 		}
@@ -1150,3 +1150,70 @@ func TestDropPrefixNonBlockingNoError(t *testing.T) {
 	require.NoError(t, db.DropPrefixNonBlocking(prefixes...))
 	closer2.SignalAndWait()
 }
+
+func TestDropPrefixAsync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opts := getTestOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	key := func(prefix string, i int) []byte {
+		return []byte(fmt.Sprintf("%s%04d", prefix, i))
+	}
+	write := func(prefix string, n int) {
+		wb := db.NewWriteBatch()
+		for i := 0; i < n; i++ {
+			require.NoError(t, wb.Set(key(prefix, i), []byte("value")))
+		}
+		require.NoError(t, wb.Flush())
+	}
+	count := func(prefix string) int {
+		var cnt int
+		require.NoError(t, db.View(func(txn *Txn) error {
+			iopt := DefaultIteratorOptions
+			iopt.Prefix = []byte(prefix)
+			it := txn.NewIterator(iopt)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				cnt++
+			}
+			return nil
+		}))
+		return cnt
+	}
+
+	write("aa", 1000)
+	write("ab", 1000)
+	// Push some of the data to the LSM tree.
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	write("aa", 10)
+
+	h, err := db.DropPrefixAsync([]byte("aa"))
+	require.NoError(t, err)
+	// The keys are hidden right away.
+	require.Equal(t, 0, count("aa"))
+	require.NoError(t, db.View(func(txn *Txn) error {
+		_, err := txn.Get(key("aa", 1))
+		require.Equal(t, ErrKeyNotFound, err)
+		return nil
+	}))
+	// Writes done after the drop are visible.
+	write("aa", 5)
+	require.Equal(t, 5, count("aa"))
+
+	require.NoError(t, h.Wait())
+	require.Equal(t, 5, count("aa"))
+	require.Equal(t, 1000, count("ab"))
+	require.Zero(t, atomic.LoadInt32(&db.prefixDrops.num))
+
+	_, err = db.DropPrefixAsync(nil)
+	require.Error(t, err)
+	_, err = db.DropPrefixAsync(badgerPrefix)
+	require.Equal(t, ErrInvalidKey, err)
+}
@@ -30,9 +30,11 @@ import (
 	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 
 	"github.com/dgraph-io/badger/v3/options"
@@ -499,7 +501,7 @@ func BenchmarkDbGrowth(b *testing.B) {
 		require.NoError(b, txn.Commit())
 		require.NoError(b, db.Flatten(1))
 		for {
-			err = db.RunValueLogGC(discardRatio)
+			_, err = db.RunValueLogGC(discardRatio)
 			if err == ErrNoRewrite {
 				break
 			} else {
@@ -1318,6 +1320,143 @@ func TestExpiry(t *testing.T) {
 	})
 }
 
+func TestOnExpire(t *testing.T) {
+	var mu sync.Mutex
+	expired := make(map[string]byte)
+	opt := getTestOptions("").WithOnExpire(func(key []byte, meta byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		expired[string(key)] = meta
+	})
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		err := db.Update(func(txn *Txn) error {
+			e := NewEntry([]byte("ttl"), []byte("42")).WithTTL(time.Second).WithMeta(0x04)
+			if err := txn.SetEntry(e); err != nil {
+				return err
+			}
+			return txn.Set([]byte("deleted"), []byte("43"))
+		})
+		require.NoError(t, err)
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Delete([]byte("deleted"))
+		}))
+
+		time.Sleep(2 * time.Second)
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get([]byte("ttl"))
+			require.Equal(t, ErrKeyNotFound, err)
+			_, err = txn.Get([]byte("deleted"))
+			require.Equal(t, ErrKeyNotFound, err)
+			return nil
+		}))
+		mu.Lock()
+		require.Equal(t, map[string]byte{"ttl": 0x04}, expired)
+		delete(expired, "ttl")
+		mu.Unlock()
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				t.Fatalf("unexpected key: %s", it.Item().Key())
+			}
+			return nil
+		}))
+		mu.Lock()
+		require.Equal(t, map[string]byte{"ttl": 0x04}, expired)
+		mu.Unlock()
+	})
+}
+
+func TestSizeByPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opts := getTestOptions(dir).WithValueThreshold(32)
+
+	db, err := Open(opts)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("a%03d", i)), make([]byte, 1<<10), 0)
+		txnSet(t, db, []byte(fmt.Sprintf("b%03d", i)), []byte("small"), 0)
+	}
+	// Flush the memtables to the LSM tree.
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	a := db.SizeByPrefix([]byte("a"))
+	require.Equal(t, int64(100), a.NumVersions)
+	require.Greater(t, a.VlogSize, int64(100<<10))
+	require.Greater(t, a.LSMSize, int64(0))
+
+	b := db.SizeByPrefix([]byte("b"))
+	require.Equal(t, int64(100), b.NumVersions)
+	require.Zero(t, b.VlogSize)
+	require.Greater(t, b.LSMSize, int64(0))
+
+	require.Equal(t, PrefixSize{}, db.SizeByPrefix([]byte("c")))
+}
+
+func TestItemTTL(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		err := db.Update(func(txn *Txn) error {
+			if err := txn.SetEntry(NewEntry([]byte("forever"), []byte("42"))); err != nil {
+				return err
+			}
+			return txn.SetEntry(NewEntry([]byte("ttl"), []byte("43")).WithTTL(time.Hour))
+		})
+		require.NoError(t, err)
+
+		err = db.View(func(txn *Txn) error {
+			item, ttl, err := txn.GetWithTTL([]byte("forever"))
+			require.NoError(t, err)
+			require.Zero(t, ttl)
+			require.True(t, item.ExpiresAtTime().IsZero())
+
+			item, ttl, err = txn.GetWithTTL([]byte("ttl"))
+			require.NoError(t, err)
+			require.Greater(t, int64(ttl), int64(59*time.Minute))
+			require.LessOrEqual(t, int64(ttl), int64(time.Hour))
+			require.Equal(t, int64(item.ExpiresAt()), item.ExpiresAtTime().Unix())
+
+			_, _, err = txn.GetWithTTL([]byte("missing"))
+			require.Equal(t, ErrKeyNotFound, err)
+			return nil
+		})
+		require.NoError(t, err)
+	})
+}
+
+func TestEntryWithExpiresAt(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		deadline := time.Now().Add(time.Hour).Truncate(time.Second)
+		err := db.Update(func(txn *Txn) error {
+			if err := txn.SetEntry(NewEntry([]byte("live"), []byte("42")).
+				WithExpiresAt(deadline)); err != nil {
+				return err
+			}
+			return txn.SetEntry(NewEntry([]byte("dead"), []byte("43")).
+				WithExpiresAt(time.Now().Add(-time.Minute)))
+		})
+		require.NoError(t, err)
+
+		err = db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("live"))
+			require.NoError(t, err)
+			require.True(t, deadline.Equal(item.ExpiresAtTime()))
+
+			_, err = txn.Get([]byte("dead"))
+			require.Equal(t, ErrKeyNotFound, err)
+			return nil
+		})
+		require.NoError(t, err)
+	})
+	require.Zero(t, NewEntry(nil, nil).WithExpiresAt(time.Time{}).ExpiresAt)
+}
+
 func TestExpiryImproperDBClose(t *testing.T) {
 	testReplay := func(opt Options) {
 		// L0 compaction doesn't affect the test in any way. It is set to allow
@@ -1650,6 +1789,69 @@ func TestSequence_Release(t *testing.T) {
 	})
 }
 
+func TestSequencePeekSetNext(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		seq, err := db.GetSequence([]byte("key"), 10)
+		require.NoError(t, err)
+		peek, err := seq.Peek()
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), peek)
+		num, err := seq.Next()
+		require.NoError(t, err)
+		require.Equal(t, peek, num)
+
+		require.NoError(t, seq.SetNext(100))
+		peek, err = seq.Peek()
+		require.NoError(t, err)
+		require.Equal(t, uint64(100), peek)
+		for i := uint64(100); i < 125; i++ {
+			num, err := seq.Next()
+			require.NoError(t, err)
+			require.Equal(t, i, num)
+		}
+	})
+}
+
+func TestSequenceGapless(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opts := getTestOptions(dir)
+
+	db, err := Open(opts)
+	require.NoError(t, err)
+	key := []byte("key")
+	seq, err := db.GetGaplessSequence(key)
+	require.NoError(t, err)
+	for i := uint64(0); i < 5; i++ {
+		num, err := seq.Next()
+		require.NoError(t, err)
+		require.Equal(t, i, num)
+	}
+	peek, err := seq.Peek()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), peek)
+	// Nothing is leased, so the sequence continues right where it stopped, even without Release.
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	seq, err = db.GetGaplessSequence(key)
+	require.NoError(t, err)
+	num, err := seq.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), num)
+
+	require.NoError(t, seq.SetNext(42))
+	num, err = seq.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), num)
+
+	_, err = db.GetGaplessSequence(nil)
+	require.Equal(t, ErrEmptyKey, err)
+}
+
 func TestTestSequence2(t *testing.T) {
 	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
 		key := []byte("key")
@@ -2576,3 +2778,307 @@ func TestCompactL0OnClose(t *testing.T) {
 		}
 	})
 }
+
+func TestCloseWithContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithCompactL0OnClose(true)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("val%03d", i)), 0)
+	}
+	// The shutdown is cut short, but the pending updates are still persisted.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, db.CloseWithContext(ctx))
+	require.True(t, db.IsClosed())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 100; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%03d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("val%03d", i)), getItemValue(t, item))
+		}
+		return nil
+	}))
+	require.NoError(t, db.CloseWithContext(context.Background()))
+}
+
+func TestSetOptions(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		opt := db.Opts().
+			WithNumCompactors(2).
+			WithCompactionThroughput(10 << 20).
+			WithBackgroundThroughput(20 << 20).
+			WithBlockCacheSize(db.Opts().BlockCacheSize / 2).
+			WithValueLogMaxEntries(1000).
+			WithSyncWrites(true).
+			WithLoggingLevel(ERROR)
+		require.NoError(t, db.SetOptions(opt))
+
+		cur := db.Opts()
+		require.Equal(t, 2, cur.NumCompactors)
+		require.Equal(t, int64(10<<20), cur.CompactionThroughput)
+		require.Equal(t, int64(20<<20), cur.BackgroundThroughput)
+		require.Equal(t, int64(10<<20), atomic.LoadInt64(&db.compactionThroughput))
+		require.Equal(t, int64(20<<20), atomic.LoadInt64(&db.backgroundLimiter.rate))
+		require.Equal(t, opt.BlockCacheSize, cur.BlockCacheSize)
+		require.Equal(t, uint32(1000), cur.ValueLogMaxEntries)
+		require.True(t, cur.SyncWrites)
+		require.True(t, db.shouldSyncWrites())
+		require.Equal(t, ERROR, cur.Logger.(*defaultLog).getLevel())
+		require.Equal(t, uint32(1000), atomic.LoadUint32(&db.valueLogMaxEntries))
+
+		// The options can be changed while the DB is written to.
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte("val"), 0)
+			}
+		}()
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.SetOptions(db.Opts().WithValueLogMaxEntries(uint32(100+i))))
+		}
+		wg.Wait()
+
+		// The DB keeps working with the new options.
+		txnSet(t, db, []byte("key"), []byte("val"), 0)
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("key"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("val"), getItemValue(t, item))
+			return nil
+		}))
+
+		err := db.SetOptions(db.Opts().WithNumCompactors(1))
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+		err = db.SetOptions(db.Opts().WithBackgroundThroughput(-1))
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+		err = db.SetOptions(db.Opts().WithIndexCacheSize(1 << 20))
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+		err = db.SetOptions(db.Opts().WithLogger(nil))
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+
+		require.NoError(t, db.Freeze())
+		err = db.SetOptions(db.Opts().WithNumCompactors(4))
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+		db.Thaw()
+		require.Equal(t, 2, db.Opts().NumCompactors)
+	})
+}
+
+func TestRateLimiter(t *testing.T) {
+	var r rateLimiter
+	r.setRate(100 << 20)
+	// The bytes limited to a lower rate are charged once, at that rate.
+	r.waitAtMost(1<<20, 10<<20)
+	start := time.Now()
+	r.wait(1)
+	require.InDelta(t, 100*time.Millisecond, time.Since(start), float64(50*time.Millisecond))
+
+	// Without a rate, only the bytes limited to a rate wait for each other.
+	r.setRate(0)
+	start = time.Now()
+	r.wait(1 << 30)
+	require.True(t, time.Since(start) < 10*time.Millisecond)
+}
+
+func TestPauseCompactions(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		gate := &db.compactionGate
+		// Pausing waits for the running compaction.
+		require.True(t, gate.enter())
+		paused := make(chan struct{})
+		go func() {
+			db.PauseCompactions()
+			close(paused)
+		}()
+		select {
+		case <-paused:
+			t.Fatal("PauseCompactions returned while a compaction was running")
+		case <-time.After(100 * time.Millisecond):
+		}
+		gate.leave()
+		<-paused
+		require.False(t, gate.enter())
+
+		// The pauses are counted.
+		db.PauseCompactions()
+		db.ResumeCompactions()
+		require.False(t, gate.enter())
+		db.ResumeCompactions()
+		require.True(t, gate.enter())
+		gate.leave()
+
+		// Resuming without pausing is a no-op.
+		db.ResumeCompactions()
+		db.PauseCompactions()
+		require.False(t, gate.enter())
+		db.ResumeCompactions()
+		require.True(t, gate.enter())
+		gate.leave()
+	})
+}
+
+func TestOpenWithContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	txnSet(t, db, []byte("key"), []byte("val"), 0)
+	require.NoError(t, db.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = OpenWithContext(ctx, opt)
+	require.Equal(t, context.Canceled, errors.Cause(err))
+
+	// The directory lock has been released, and the data is intact.
+	db, err = OpenWithContext(context.Background(), opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val"), getItemValue(t, item))
+		return nil
+	}))
+}
+
+func TestFreezeThaw(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txnSet(t, db, []byte("key"), []byte("val"), 0)
+
+		require.NoError(t, db.Freeze())
+		err := db.Freeze()
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+
+		// Writes are rejected, while reads keep working.
+		err = db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("key2"), []byte("val2"))
+		})
+		require.Equal(t, ErrBlockedWrites, err)
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("key"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("val"), getItemValue(t, item))
+			return nil
+		}))
+
+		db.Thaw()
+		db.Thaw() // No-op.
+		txnSet(t, db, []byte("key2"), []byte("val2"), 0)
+
+		// The DB can be closed while frozen.
+		require.NoError(t, db.Freeze())
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		m := db.Metrics()
+		require.Zero(t, m.Puts)
+		require.Zero(t, m.Gets)
+
+		for i := 0; i < 10; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte("val"), 0)
+		}
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 10; i++ {
+				if _, err := txn.Get([]byte(fmt.Sprintf("key%d", i))); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		_, err := db.RunValueLogGC(0.5)
+		require.Equal(t, ErrNoRewrite, err)
+
+		m = db.Metrics()
+		// Each commit also writes the entry marking the end of the txn.
+		require.Equal(t, int64(20), m.Puts)
+		require.Equal(t, int64(10), m.Gets)
+		require.True(t, m.MemtableGets >= m.Gets)
+		require.Equal(t, int64(1), m.VlogGCNoRewrites)
+		require.Zero(t, m.VlogGCRuns)
+		require.Zero(t, m.TablesInCompaction)
+	})
+}
+
+func TestMetricsVlogSpace(t *testing.T) {
+	opt := getTestOptions("").WithValueThreshold(1 << 10).WithTrackVlogSpace(true)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		m := db.Metrics()
+		require.Zero(t, m.VlogDeadBytes)
+
+		val := make([]byte, 4<<10)
+		for i := 0; i < 10; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), val, 0)
+		}
+		m = db.Metrics()
+		require.True(t, m.VlogBytes > 10*int64(len(val)))
+		require.Zero(t, m.VlogDeadBytes)
+		require.True(t, m.VlogSpaceAmp >= 1)
+
+		// Overwrites and deletes are counted without waiting for a compaction.
+		for i := 0; i < 5; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), val, 0)
+		}
+		for i := 5; i < 10; i++ {
+			txnDelete(t, db, []byte(fmt.Sprintf("key%d", i)))
+		}
+		m = db.Metrics()
+		require.True(t, m.VlogDeadBytes >= 10*int64(len(val)), "%d", m.VlogDeadBytes)
+		require.True(t, m.VlogSpaceAmp > 1.5, "%f", m.VlogSpaceAmp)
+	})
+}
+
+func TestParallelScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+	opt.MemTableSize = 1 << 20
+	opt.ValueThreshold = 1 << 10
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	n := 20000
+	wb := db.NewWriteBatch()
+	for i := 0; i < n; i++ {
+		require.NoError(t, wb.Set([]byte(fmt.Sprintf("a%06d", i)), []byte("val")))
+		require.NoError(t, wb.Set([]byte(fmt.Sprintf("b%06d", i)), []byte("val")))
+	}
+	require.NoError(t, wb.Flush())
+	require.NoError(t, db.Flatten(1))
+
+	var mu sync.Mutex
+	seen := make(map[string]struct{})
+	require.NoError(t, db.ParallelScan([]byte("b"), 4, func(item *Item) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[string(item.Key())] = struct{}{}
+		return nil
+	}))
+	require.Len(t, seen, n)
+	for key := range seen {
+		require.Equal(t, byte('b'), key[0])
+	}
+
+	errStop := errors.New("stop")
+	err = db.ParallelScan(nil, 4, func(item *Item) error {
+		return errStop
+	})
+	require.Equal(t, errStop, err)
+}
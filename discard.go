@@ -22,9 +22,11 @@ import (
 	"path/filepath"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/dgraph-io/badger/v3/y"
 	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
 )
 
 // discardStats keeps track of the amount of data that could be discarded for
@@ -166,3 +168,133 @@ func (lf *discardStats) MaxDiscard() (uint32, int64) {
 	})
 	return uint32(maxFid), int64(maxVal)
 }
+
+// VlogFileInfo describes a value log file, and how much of it the value log GC could discard.
+type VlogFileInfo struct {
+	Fid  uint32
+	Path string
+	Size int64
+	// DiscardBytes is the size of the values of the file which are known to be stale. It's
+	// accumulated by the compactions as they drop the keys pointing to the file, and is only
+	// an estimate until DB.RecomputeDiscardStats is called.
+	DiscardBytes int64
+	// DiscardRatio is DiscardBytes / Size. DB.RunValueLogGC only rewrites the file with the
+	// most bytes to discard, and only if its ratio is at least the discardRatio passed to it.
+	DiscardRatio float64
+	// Active is true for the file being written to, which is never rewritten.
+	Active bool
+	// Deleted is true for a file already rewritten, which is deleted once no iterator reads it.
+	Deleted bool
+	// Cold is true for a file moved to Options.ValueLogTiering.ColdDir.
+	Cold bool
+	// Punched is the size of the holes punched in the file by the GC, whose disk space was freed.
+	// It's part of Size. See Options.ValueLogPunchHoles.
+	Punched int64
+}
+
+// ValueLogFiles returns the value log files of the DB, ordered by file ID, with their discard
+// stats. It tells which file RunValueLogGC would pick, and why it returns ErrNoRewrite when no
+// file has enough to discard.
+func (db *DB) ValueLogFiles() []VlogFileInfo {
+	if db.opt.InMemory || db.IsClosed() {
+		return nil
+	}
+	vlog := &db.vlog
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+
+	deleted := make(map[uint32]bool)
+	for _, fid := range vlog.filesToBeDeleted {
+		deleted[fid] = true
+	}
+	maxFid := atomic.LoadUint32(&vlog.maxFid)
+	var infos []VlogFileInfo
+	for fid, lf := range vlog.filesMap {
+		info := VlogFileInfo{
+			Fid:          fid,
+			Path:         lf.path,
+			Size:         int64(atomic.LoadUint32(&lf.size)),
+			DiscardBytes: vlog.discardStats.Update(fid, 0),
+			Active:       fid == maxFid,
+			Deleted:      deleted[fid],
+			Cold:         vlog.isCold(lf),
+		}
+		lf.lock.RLock()
+		info.Punched = lf.punchedBytes()
+		lf.lock.RUnlock()
+		if info.Active {
+			info.Size = int64(vlog.woffset())
+		}
+		if info.Size > 0 {
+			info.DiscardRatio = float64(info.DiscardBytes) / float64(info.Size)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Fid < infos[j].Fid
+	})
+	return infos
+}
+
+// RecomputeDiscardStats reads the value log file fid, and replaces its discard stats with the
+// size of the values in it which are stale as of now. The discard stats are otherwise
+// accumulated by the compactions, which only account for the keys they drop, and are lost for
+// the files written before the DISCARD file existed.
+//
+// It returns ErrRejected if the value log GC is running, like RunValueLogGC, and
+// ErrInvalidRequest if there's no such file, or if it's the active one.
+func (db *DB) RecomputeDiscardStats(fid uint32) (VlogFileInfo, error) {
+	if db.opt.InMemory {
+		return VlogFileInfo{}, ErrGCInMemoryMode
+	}
+	vlog := &db.vlog
+	select {
+	case vlog.garbageCh <- struct{}{}:
+		defer func() {
+			<-vlog.garbageCh
+		}()
+	default:
+		return VlogFileInfo{}, ErrRejected
+	}
+
+	vlog.filesLock.RLock()
+	lf, ok := vlog.filesMap[fid]
+	active := fid == atomic.LoadUint32(&vlog.maxFid)
+	vlog.filesLock.RUnlock()
+	if !ok || active {
+		return VlogFileInfo{}, errors.Wrapf(ErrInvalidRequest,
+			"no value log file %d which isn't being written to", fid)
+	}
+
+	var discard int64
+	_, err := lf.iterate(vlog.opt.ReadOnly, 0, func(e Entry, vp valuePointer) error {
+		key := y.ParseKey(e.Key)
+		vs, err := db.get(y.KeyWithTs(key, db.orc.readTs()))
+		if err != nil {
+			return err
+		}
+		if discardEntry(e, vs, db) || vs.Meta&bitValuePointer > 0 && !sameValuePointer(vs, vp) {
+			discard += int64(vp.Len)
+		}
+		return nil
+	})
+	if err != nil {
+		return VlogFileInfo{}, errors.Wrapf(err, "while reading value log file %d", fid)
+	}
+	vlog.discardStats.Update(fid, -1)
+	vlog.discardStats.Update(fid, discard)
+
+	for _, info := range db.ValueLogFiles() {
+		if info.Fid == fid {
+			return info, nil
+		}
+	}
+	return VlogFileInfo{}, errors.Wrapf(ErrInvalidRequest, "value log file %d is gone", fid)
+}
+
+// sameValuePointer tells if the value pointer of vs is vp.
+func sameValuePointer(vs y.ValueStruct, vp valuePointer) bool {
+	var lsmVp valuePointer
+	lsmVp.Decode(vs.Value)
+	return lsmVp.Fid == vp.Fid && lsmVp.Offset == vp.Offset
+}
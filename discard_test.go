@@ -17,9 +17,11 @@
 package badger
 
 import (
+	"fmt"
 	"io/ioutil"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -75,3 +77,40 @@ func TestReloadDiscardStats(t *testing.T) {
 	require.Zero(t, ds2.Update(uint32(1), 0))
 	require.Equal(t, 1, int(ds2.Update(uint32(2), 0)))
 }
+
+func TestValueLogFilesRecomputeDiscardStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+	opt.ValueLogFileSize = 1 << 20
+	opt.ValueThreshold = 1 << 10
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+
+	val := make([]byte, 32<<10)
+	for i := 0; i < 100; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), val, 0)
+	}
+	for i := 0; i < 50; i++ {
+		txnDelete(t, db, []byte(fmt.Sprintf("key%d", i)))
+	}
+
+	infos := db.ValueLogFiles()
+	require.True(t, len(infos) > 1)
+	require.True(t, infos[len(infos)-1].Active)
+	first := infos[0]
+	require.False(t, first.Active)
+	require.Equal(t, uint32(1), first.Fid)
+
+	info, err := db.RecomputeDiscardStats(first.Fid)
+	require.NoError(t, err)
+	require.True(t, info.DiscardBytes > 0)
+	require.True(t, info.DiscardBytes <= info.Size)
+	require.InDelta(t, float64(info.DiscardBytes)/float64(info.Size), info.DiscardRatio, 1e-9)
+
+	_, err = db.RecomputeDiscardStats(infos[len(infos)-1].Fid)
+	require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+}
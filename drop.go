@@ -0,0 +1,309 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+// prefixDrops tracks the prefixes dropped via DropPrefixAsync, whose data hasn't been reclaimed
+// yet. A key with a dropped prefix is hidden if its version is at or below the version at which
+// the prefix was dropped, so the writes done after the drop remain visible.
+type prefixDrops struct {
+	sync.RWMutex
+	drops map[string]uint64 // prefix -> version at which it was dropped.
+	// num is len(drops), accessed atomically so that reads don't need to take the lock if nothing
+	// has been dropped.
+	num int32
+
+	// reclaim serializes the reclamation of the dropped prefixes.
+	reclaim sync.Mutex
+}
+
+func (pd *prefixDrops) add(prefix []byte, version uint64) {
+	pd.Lock()
+	defer pd.Unlock()
+	if version > pd.drops[string(prefix)] {
+		pd.drops[string(prefix)] = version
+	}
+	atomic.StoreInt32(&pd.num, int32(len(pd.drops)))
+}
+
+// remove removes the drop of prefix, unless it has been dropped again at a version above version.
+func (pd *prefixDrops) remove(prefix []byte, version uint64) {
+	pd.Lock()
+	defer pd.Unlock()
+	if pd.drops[string(prefix)] <= version {
+		delete(pd.drops, string(prefix))
+	}
+	atomic.StoreInt32(&pd.num, int32(len(pd.drops)))
+}
+
+// covers returns true if the given version of key, which must not have a timestamp, is hidden by a
+// drop.
+func (pd *prefixDrops) covers(key []byte, version uint64) bool {
+	if atomic.LoadInt32(&pd.num) == 0 {
+		return false
+	}
+	pd.RLock()
+	defer pd.RUnlock()
+	for prefix, dropTs := range pd.drops {
+		if version <= dropTs && len(key) >= len(prefix) && string(key[:len(prefix)]) == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// DropPrefixHandle is returned by DropPrefixAsync. It can be used to wait for the data of the
+// dropped prefixes to be reclaimed.
+type DropPrefixHandle struct {
+	done chan struct{}
+	err  error
+}
+
+// Done returns a channel which is closed once the data of the dropped prefixes has been reclaimed,
+// or the reclamation has failed.
+func (h *DropPrefixHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait blocks until the data of the dropped prefixes has been reclaimed, and returns the error
+// encountered while doing so, if any.
+func (h *DropPrefixHandle) Wait() error {
+	<-h.done
+	return h.err
+}
+
+type dropPrefixRequest struct {
+	prefixes [][]byte
+	version  uint64
+	// memtables holds the memtables which were present at the time of the drop. These might contain
+	// data of the dropped prefixes and need to be flushed before the data can be reclaimed.
+	memtables map[*memTable]struct{}
+	handle    *DropPrefixHandle
+}
+
+// DropPrefixAsync drops all the keys with the provided prefixes without blocking the writes. The
+// keys are hidden from reads as soon as DropPrefixAsync returns, while their data is reclaimed in
+// the background by running compactions over the tables containing the prefixes. The returned
+// handle can be used to wait for the reclamation to finish.
+//
+// Only the versions written before the call are dropped; keys written with the same prefixes
+// afterwards are visible as usual. The drop is persisted, so if the DB is closed before the data
+// has been reclaimed, the keys remain hidden and the reclamation resumes once the DB is reopened.
+func (db *DB) DropPrefixAsync(prefixes ...[]byte) (*DropPrefixHandle, error) {
+	if db.opt.ReadOnly {
+		return nil, errors.New("Attempting to drop data in read-only mode.")
+	}
+	for _, prefix := range prefixes {
+		if len(prefix) == 0 {
+			return nil, errors.Wrapf(ErrInvalidRequest, "Prefix to drop cannot be empty. Use DropAll")
+		}
+		if bytes.HasPrefix(prefix, badgerPrefix) {
+			return nil, ErrInvalidKey
+		}
+	}
+	if len(prefixes) == 0 {
+		handle := &DropPrefixHandle{done: make(chan struct{})}
+		close(handle.done)
+		return handle, nil
+	}
+	db.opt.Infof("Async DropPrefix called for %s", prefixes)
+
+	var version uint64
+	if db.opt.managedTxns {
+		version = db.MaxVersion()
+	} else {
+		// The read timestamp of a new transaction covers all the committed writes.
+		txn := db.NewTransaction(false)
+		version = txn.readTs
+		txn.Discard()
+	}
+
+	// Persist the drops first, and then update the in-memory structure.
+	entries := make([]*Entry, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		entries = append(entries, &Entry{
+			Key:   y.KeyWithTs(prefixDropKey(prefix, version), 1),
+			Value: nil,
+		})
+	}
+	req, err := db.sendToWriteCh(entries)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Wait(); err != nil {
+		return nil, err
+	}
+
+	var dropped [][]byte
+	for _, prefix := range prefixes {
+		prefix = y.SafeCopy(nil, prefix)
+		dropped = append(dropped, prefix)
+		db.prefixDrops.add(prefix, version)
+	}
+	dr := db.newDropPrefixRequest(dropped, version)
+	db.closers.dropPrefix.AddRunning(1)
+	go db.reclaimDroppedPrefixes(dr)
+	return dr.handle, nil
+}
+
+func (db *DB) newDropPrefixRequest(prefixes [][]byte, version uint64) *dropPrefixRequest {
+	dr := &dropPrefixRequest{
+		prefixes:  prefixes,
+		version:   version,
+		memtables: make(map[*memTable]struct{}),
+		handle:    &DropPrefixHandle{done: make(chan struct{})},
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if db.mt != nil {
+		dr.memtables[db.mt] = struct{}{}
+	}
+	for _, mt := range db.imm {
+		dr.memtables[mt] = struct{}{}
+	}
+	return dr
+}
+
+// initPrefixDrops retrieves the drops which haven't been reclaimed yet from the DB, hides their
+// keys and resumes reclaiming them.
+func (db *DB) initPrefixDrops() error {
+	var reqs []*dropPrefixRequest
+	err := db.View(func(txn *Txn) error {
+		iopts := DefaultIteratorOptions
+		iopts.Prefix = dropPrefixKey
+		iopts.InternalAccess = true
+		itr := txn.NewIterator(iopts)
+		defer itr.Close()
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			key := itr.Item().KeyCopy(nil)[len(dropPrefixKey):]
+			version, prefix := y.BytesToU64(key), key[8:]
+			db.prefixDrops.add(prefix, version)
+			reqs = append(reqs, db.newDropPrefixRequest([][]byte{prefix}, version))
+		}
+		return nil
+	})
+	if err != nil || db.opt.ReadOnly {
+		return err
+	}
+	for _, dr := range reqs {
+		db.closers.dropPrefix.AddRunning(1)
+		go db.reclaimDroppedPrefixes(dr)
+	}
+	return nil
+}
+
+// prefixDropKey returns the key under which a drop of prefix at version is persisted. Every drop
+// is persisted under its own key, so that finishing one drop doesn't affect a later drop of the
+// same prefix.
+func prefixDropKey(prefix []byte, version uint64) []byte {
+	key := make([]byte, 0, len(dropPrefixKey)+8+len(prefix))
+	key = append(key, dropPrefixKey...)
+	key = append(key, y.U64ToBytes(version)...)
+	return append(key, prefix...)
+}
+
+func (db *DB) reclaimDroppedPrefixes(dr *dropPrefixRequest) {
+	defer db.closers.dropPrefix.Done()
+
+	err := db.reclaim(dr)
+	if err == nil {
+		err = db.finishPrefixDrop(dr)
+	}
+	if err != nil {
+		db.opt.Warningf("While reclaiming dropped prefixes %s: %v", dr.prefixes, err)
+	} else {
+		db.opt.Infof("Reclaimed dropped prefixes %s", dr.prefixes)
+	}
+	dr.handle.err = err
+	close(dr.handle.done)
+}
+
+func (db *DB) reclaim(dr *dropPrefixRequest) error {
+	db.prefixDrops.reclaim.Lock()
+	defer db.prefixDrops.reclaim.Unlock()
+
+	closer := db.closers.dropPrefix
+	select {
+	case <-closer.HasBeenClosed():
+		return ErrDBClosed
+	default:
+	}
+
+	// Wait for the memtables which might contain the dropped data to be flushed. The memtables
+	// created after the drop only contain newer versions.
+	pending := func() bool {
+		db.lock.RLock()
+		defer db.lock.RUnlock()
+		if _, ok := dr.memtables[db.mt]; ok {
+			return true
+		}
+		for _, mt := range db.imm {
+			if _, ok := dr.memtables[mt]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	for pending() {
+		for mt := range dr.memtables {
+			if err := db.rotateMemTable(mt); err != nil && err != errNoRoom {
+				return err
+			}
+		}
+		select {
+		case <-closer.HasBeenClosed():
+			return ErrDBClosed
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	db.stopCompactions()
+	defer db.startCompactions()
+	return db.lc.reclaimPrefixes(dr.prefixes)
+}
+
+// finishPrefixDrop removes the drop from the DB and from the in-memory structure, once its data
+// has been reclaimed.
+func (db *DB) finishPrefixDrop(dr *dropPrefixRequest) error {
+	entries := make([]*Entry, 0, len(dr.prefixes))
+	for _, prefix := range dr.prefixes {
+		entries = append(entries, &Entry{
+			Key:  y.KeyWithTs(prefixDropKey(prefix, dr.version), 1),
+			meta: bitDelete,
+		})
+	}
+	req, err := db.sendToWriteCh(entries)
+	if err != nil {
+		return err
+	}
+	if err := req.Wait(); err != nil {
+		return err
+	}
+	for _, prefix := range dr.prefixes {
+		db.prefixDrops.remove(prefix, dr.version)
+	}
+	return nil
+}
@@ -17,6 +17,7 @@
 package badger
 
 import (
+	"fmt"
 	"math"
 
 	"github.com/pkg/errors"
@@ -48,6 +49,15 @@ var (
 	// ErrDiscardedTxn is returned if a previously discarded transaction is re-used.
 	ErrDiscardedTxn = errors.New("This transaction has been discarded. Create a new one")
 
+	// ErrTxnTimeout is returned if a transaction is used after being discarded because it was open
+	// for longer than Options.TxnTimeout.
+	ErrTxnTimeout = errors.New("Transaction was open for longer than TxnTimeout and has been discarded")
+
+	// ErrReadTsReleased is returned if a transaction is read from after creating a detached
+	// iterator, which releases its read timestamp. See IteratorOptions.Detached.
+	ErrReadTsReleased = errors.New("Read timestamp of the transaction has been released " +
+		"by a detached iterator")
+
 	// ErrEmptyKey is returned if an empty key is passed on an update function.
 	ErrEmptyKey = errors.New("Key cannot be empty")
 
@@ -67,6 +77,10 @@ var (
 	ErrNoRewrite = errors.New(
 		"Value log GC attempt didn't result in any cleanup")
 
+	// ErrGCBudgetExhausted is returned by DB.RunValueLogGCForSpaceAmp if it rewrote as many
+	// bytes as it was allowed to, before reaching the target space amplification.
+	ErrGCBudgetExhausted = errors.New("Value log GC budget exhausted")
+
 	// ErrRejected is returned if a value log GC is called either while another GC is running, or
 	// after DB::Close has been called.
 	ErrRejected = errors.New("Value log GC request rejected")
@@ -102,8 +116,9 @@ var (
 		"Log truncate required to run DB. This might result in data loss")
 
 	// ErrBlockedWrites is returned if the user called DropAll. During the process of dropping all
-	// data from Badger, we stop accepting new writes, by returning this error.
-	ErrBlockedWrites = errors.New("Writes are blocked, possibly due to DropAll or Close")
+	// data from Badger, we stop accepting new writes, by returning this error. It is also returned
+	// while the DB is frozen via DB.Freeze.
+	ErrBlockedWrites = errors.New("Writes are blocked, possibly due to DropAll, Freeze or Close")
 
 	// ErrNilCallback is returned when subscriber's callback is nil.
 	ErrNilCallback = errors.New("Callback cannot be nil")
@@ -123,4 +138,52 @@ var (
 
 	// ErrDBClosed is returned when a get operation is performed after closing the DB.
 	ErrDBClosed = errors.New("DB Closed")
+
+	// ErrCASMismatch is returned by CAS if the current value or version of the key doesn't match
+	// the expected one.
+	ErrCASMismatch = errors.New("Compare-and-swap failed. Current value does not match")
+
+	// ErrSnapshotReleased is returned when a Snapshot is used after it has been released.
+	ErrSnapshotReleased = errors.New("Snapshot has been released")
+
+	// ErrInvalidCursor is returned when a cursor passed to Iterator.SeekCursor can't be decoded.
+	ErrInvalidCursor = errors.New("Invalid iterator cursor")
+
+	// ErrSlowDown can be returned by Stream.Send, possibly wrapped, once it has taken the batch in,
+	// to tell the Stream that the consumer lags behind. The Stream then pauses its range workers
+	// for a while instead of buffering up more batches.
+	ErrSlowDown = errors.New("Stream consumer asked to slow down")
+
+	// ErrTenantKeyDestroyed is returned when reading a value encrypted with the key of a tenant
+	// which has been erased.
+	ErrTenantKeyDestroyed = errors.New("The key of the tenant of the value has been destroyed")
 )
+
+// ConflictError is returned in place of ErrConflict when Options.ReportConflictKeys is set. It
+// tells which read of the transaction was invalidated by a concurrent commit. errors.Cause returns
+// ErrConflict for it.
+type ConflictError struct {
+	// Key is the key read by the transaction, and written by the conflicting transaction.
+	Key []byte
+	// Prefix is set instead of Key if the conflict is on a range of keys iterated over by the
+	// transaction. See Txn.TrackRangeReads.
+	Prefix []byte
+	// CommitTs is the commit timestamp of the conflicting transaction.
+	CommitTs uint64
+}
+
+// Error implements the error interface.
+func (e *ConflictError) Error() string {
+	if e.Key == nil {
+		return fmt.Sprintf("Transaction Conflict on prefix %q with commit at %d. Please retry",
+			e.Prefix, e.CommitTs)
+	}
+	return fmt.Sprintf("Transaction Conflict on key %q with commit at %d. Please retry",
+		e.Key, e.CommitTs)
+}
+
+// Cause returns ErrConflict, for errors.Cause.
+func (e *ConflictError) Cause() error { return ErrConflict }
+
+// Unwrap returns ErrConflict, for errors.Is.
+func (e *ConflictError) Unwrap() error { return ErrConflict }
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/dgraph-io/badger/v3/table"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto/z"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+)
+
+// ExternalTableOptions returns the options to build tables offline via table.NewTableBuilder, so
+// they can later be ingested via IngestExternalTables into a DB opened with opt. The keys must be
+// added to the builder in sorted order, with their versions appended via y.KeyWithTs, and the
+// values must be stored inline. The output of Builder.Finish is the content of the table file.
+// Encryption is not supported for external tables.
+func ExternalTableOptions(opt Options) table.Options {
+	return table.Options{
+		TableSize:            uint64(opt.BaseTableSize),
+		BlockSize:            opt.BlockSize,
+		BloomFalsePositive:   opt.BloomFalsePositive,
+		ChkMode:              opt.ChecksumVerificationMode,
+		Compression:          opt.Compression,
+		ZSTDCompressionLevel: opt.ZSTDCompressionLevel,
+	}
+}
+
+// IngestExternalTables atomically adds the tables in the given files to the LSM tree. The tables
+// must have been built with the options returned by ExternalTableOptions, using the same
+// Compression as the DB, and their key ranges must not overlap with each other. All the tables are
+// placed at the lowest level where they don't overlap with any existing data, or at L0 otherwise.
+//
+// The files are hard-linked (or copied, if that isn't possible) into the DB directory, so they
+// can be removed by the caller once this returns, but must not be modified. In non-managed mode,
+// the versions of the ingested keys become visible to the transactions started afterwards.
+func (db *DB) IngestExternalTables(files []string) error {
+	if db.opt.InMemory {
+		return errors.Wrapf(ErrInvalidRequest, "Cannot ingest tables in InMemory mode")
+	}
+	if db.opt.ReadOnly {
+		return errors.Wrapf(ErrInvalidRequest, "Cannot ingest tables in read-only mode")
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	tables := make([]*table.Table, 0, len(files))
+	// Release the refs held by OpenTable. This deletes the tables which didn't make it to the LSM
+	// tree.
+	defer func() {
+		_ = decrRefs(tables)
+	}()
+	for _, file := range files {
+		tbl, err := db.openExternalTable(file)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, tbl)
+	}
+
+	if err := sortTablesToIngest(tables); err != nil {
+		return err
+	}
+	var maxVersion uint64
+	for _, tbl := range tables {
+		if tbl.MaxVersion() > maxVersion {
+			maxVersion = tbl.MaxVersion()
+		}
+	}
+	if err := db.syncDir(db.opt.Dir); err != nil {
+		return err
+	}
+
+	level, err := db.lc.ingestTables(tables)
+	if err != nil {
+		return err
+	}
+	if !db.opt.managedTxns {
+		db.orc.advanceTs(maxVersion)
+	}
+	var size int64
+	for _, tbl := range tables {
+		size += tbl.Size()
+	}
+	db.opt.Infof("Ingested %d tables at level: %d. Size: %s\n",
+		len(tables), level, humanize.IBytes(uint64(size)))
+	return nil
+}
+
+// sortTablesToIngest sorts the tables by key, and checks that their key ranges don't overlap.
+func sortTablesToIngest(tables []*table.Table) error {
+	sort.Slice(tables, func(i, j int) bool {
+		return y.CompareKeys(tables[i].Smallest(), tables[j].Smallest()) < 0
+	})
+	for i := 1; i < len(tables); i++ {
+		if bytes.Compare(y.ParseKey(tables[i-1].Biggest()), y.ParseKey(tables[i].Smallest())) >= 0 {
+			return errors.Wrapf(ErrInvalidRequest, "Tables %d and %d have overlapping key ranges",
+				tables[i-1].ID(), tables[i].ID())
+		}
+	}
+	return nil
+}
+
+// openExternalTable copies the given file into the DB directory and opens it as a table, after
+// verifying its checksums and that it carries no value pointers.
+func (db *DB) openExternalTable(file string) (*table.Table, error) {
+	fname := table.NewFilename(db.lc.reserveFileID(), db.opt.Dir)
+	if err := linkOrCopyFile(file, fname); err != nil {
+		return nil, y.Wrapf(err, "while copying external table %q", file)
+	}
+	mf, err := z.OpenMmapFile(fname, db.opt.getFileFlags(), 0)
+	if err != nil {
+		_ = os.Remove(fname)
+		return nil, y.Wrapf(err, "while opening external table %q", file)
+	}
+	topt := buildTableOptions(db)
+	topt.DataKey = nil
+	tbl, err := table.OpenTable(mf, topt)
+	if err != nil {
+		_ = mf.Delete()
+		return nil, y.Wrapf(err, "while opening external table %q", file)
+	}
+
+	verify := func() error {
+		if err := tbl.VerifyChecksum(); err != nil {
+			return err
+		}
+		it := tbl.NewIterator(0)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if it.Value().Meta&bitValuePointer > 0 {
+				return errors.Errorf("key %q has a value pointer", y.ParseKey(it.Key()))
+			}
+		}
+		return nil
+	}
+	if err := verify(); err != nil {
+		_ = tbl.DecrRef()
+		return nil, errors.Wrapf(ErrInvalidRequest, "Invalid external table %q: %v", file, err)
+	}
+	return tbl, nil
+}
+
+// linkOrCopyFile hard-links src to dst, falling back to copying it if src is on another device.
+func linkOrCopyFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3/table"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func buildExternalTable(t *testing.T, opt Options, fname string, prefix string, n int) {
+	b := table.NewTableBuilder(ExternalTableOptions(opt))
+	defer b.Close()
+	for i := 0; i < n; i++ {
+		key := y.KeyWithTs([]byte(fmt.Sprintf("%s%04d", prefix, i)), 5)
+		b.Add(key, y.ValueStruct{Value: []byte(fmt.Sprintf("val%d", i))}, 0)
+	}
+	require.NoError(t, ioutil.WriteFile(fname, b.Finish(), 0666))
+}
+
+func TestIngestExternalTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opt := getTestOptions("")
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		txnSet(t, db, []byte("a0000"), []byte("existing"), 0)
+
+		files := []string{filepath.Join(dir, "b.sst"), filepath.Join(dir, "c.sst")}
+		buildExternalTable(t, opt, files[0], "b", 100)
+		buildExternalTable(t, opt, files[1], "c", 100)
+		require.NoError(t, db.IngestExternalTables(files))
+
+		// The ingested tables don't overlap with anything, so they should go to the last level.
+		var found int
+		for _, ti := range db.Tables() {
+			if ti.Level == opt.MaxLevels-1 {
+				found++
+			}
+		}
+		require.Equal(t, 2, found)
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for _, prefix := range []string{"b", "c"} {
+				item, err := txn.Get([]byte(prefix + "0042"))
+				require.NoError(t, err)
+				require.Equal(t, []byte("val42"), getItemValue(t, item))
+			}
+			item, err := txn.Get([]byte("a0000"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("existing"), getItemValue(t, item))
+			return nil
+		}))
+
+		// Tables overlapping with each other are rejected.
+		overlapping := []string{filepath.Join(dir, "d1.sst"), filepath.Join(dir, "d2.sst")}
+		buildExternalTable(t, opt, overlapping[0], "d", 10)
+		buildExternalTable(t, opt, overlapping[1], "d", 10)
+		err := db.IngestExternalTables(overlapping)
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+	})
+}
@@ -129,8 +129,8 @@ func main() {
 			default:
 			}
 			log.Printf("Starting a value log GC")
-			err := db.RunValueLogGC(0.1)
-			log.Printf("Result of value log GC: %v\n", err)
+			res, err := db.RunValueLogGC(0.1)
+			log.Printf("Result of value log GC: %+v, %v\n", res, err)
 			if err == nil {
 				count++
 				goto again
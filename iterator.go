@@ -20,6 +20,8 @@ import (
 	"bytes"
 	"fmt"
 	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"math"
 	"sort"
 	"sync"
@@ -46,6 +48,8 @@ type Item struct {
 	val       []byte
 	version   uint64
 	expiresAt uint64
+	// prefixLen is the length of the keyspace prefix, which is hidden from the user.
+	prefixLen int
 
 	slice *y.Slice // Used only during prefetching.
 	next  *Item
@@ -54,8 +58,13 @@ type Item struct {
 	err      error
 	wg       sync.WaitGroup
 	status   prefetchStatus
-	meta     byte // We need to store meta to know about bitValuePointer.
+	fetching int32 // Set while the value is being prefetched.
+	meta     byte  // We need to store meta to know about bitValuePointer.
 	userMeta byte
+
+	userMetaExt []byte
+
+	stats *iteratorStats // Stats of the iterator the item comes from, if any.
 }
 
 // String returns a string representation of Item
@@ -68,14 +77,14 @@ func (item *Item) String() string {
 // Key is only valid as long as item is valid, or transaction is valid.  If you need to use it
 // outside its validity, please use KeyCopy.
 func (item *Item) Key() []byte {
-	return item.key
+	return item.key[item.prefixLen:]
 }
 
 // KeyCopy returns a copy of the key of the item, writing it to dst slice.
 // If nil is passed, or capacity of dst isn't sufficient, a new slice would be allocated and
 // returned.
 func (item *Item) KeyCopy(dst []byte) []byte {
-	return y.SafeCopy(dst, item.key)
+	return y.SafeCopy(dst, item.Key())
 }
 
 // Version returns the commit timestamp of the item.
@@ -130,6 +139,91 @@ func (item *Item) ValueCopy(dst []byte) ([]byte, error) {
 	return y.SafeCopy(dst, buf), err
 }
 
+// ValueView is a read-only view of the value of an item, obtained via Item.ValueView. It must be
+// released once the value is no longer needed.
+type ValueView struct {
+	val     []byte
+	release func()
+}
+
+// Bytes returns the value. It is only valid until the view is released, and must not be modified.
+func (v *ValueView) Bytes() []byte {
+	return v.val
+}
+
+// Release releases the view. Calling it multiple times doesn't cause any issues.
+func (v *ValueView) Release() {
+	v.val = nil
+	runCallback(v.release)
+	v.release = nil
+}
+
+// ValueView returns a view of the value of the item. Unlike the slice passed to the callback of
+// Value, the view stays valid after the call, until it is released, even beyond the transaction.
+// If the value is stored in the value log, the view refers to the log file without copying it, and
+// keeps the file from being rotated or garbage collected until it is released, so views should be
+// released promptly. Other values are copied into the view. With encryption enabled, the values
+// are decrypted into the view instead.
+func (item *Item) ValueView() (*ValueView, error) {
+	item.wg.Wait()
+	if item.status == prefetched || item.meta&bitValuePointer == 0 ||
+		item.meta&(bitMergeEntry|bitTenantKey) > 0 {
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		return &ValueView{val: val}, nil
+	}
+	var vp valuePointer
+	vp.Decode(item.vptr)
+	item.txn.db.threshold.read()
+	val, cb, err := item.txn.db.vlog.Read(vp, nil)
+	if err != nil {
+		runCallback(cb)
+		return nil, err
+	}
+	return &ValueView{val: val, release: cb}, nil
+}
+
+// ValueReader returns a reader of the value of the item, which must be closed once done. It lets
+// large values stored in the value log be read in chunks, decrypting them on the fly if needed,
+// without holding them in memory. Like a ValueView, the reader keeps the log file from being
+// rotated or garbage collected until it is closed. Other values are copied into the reader.
+func (item *Item) ValueReader() (io.ReadCloser, error) {
+	item.wg.Wait()
+	if item.status == prefetched || item.meta&bitValuePointer == 0 ||
+		item.meta&(bitMergeEntry|bitTenantKey) > 0 {
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(val)), nil
+	}
+	var vp valuePointer
+	vp.Decode(item.vptr)
+	item.txn.db.threshold.read()
+	r, cb, err := item.txn.db.vlog.readValueStream(vp)
+	if err != nil {
+		runCallback(cb)
+		return nil, err
+	}
+	return &valueReader{Reader: r, release: cb}, nil
+}
+
+// valueReader is the reader returned by Item.ValueReader.
+type valueReader struct {
+	io.Reader
+	release func()
+}
+
+// Close implements io.Closer.
+func (r *valueReader) Close() error {
+	r.Reader = bytes.NewReader(nil)
+	runCallback(r.release)
+	r.release = nil
+	return nil
+}
+
 func (item *Item) hasValue() bool {
 	if item.meta == 0 && item.vptr == nil {
 		// key not found
@@ -143,6 +237,12 @@ func (item *Item) IsDeletedOrExpired() bool {
 	return isDeletedOrExpired(item.meta, item.expiresAt)
 }
 
+// IsDeleted returns true if the item is a deletion marker, as opposed to a value which may have
+// expired.
+func (item *Item) IsDeleted() bool {
+	return item.meta&bitDelete > 0
+}
+
 // DiscardEarlierVersions returns whether the item was created with the
 // option to discard earlier versions of a key when multiple are available.
 func (item *Item) DiscardEarlierVersions() bool {
@@ -150,7 +250,29 @@ func (item *Item) DiscardEarlierVersions() bool {
 }
 
 func (item *Item) yieldItemValue() ([]byte, func(), error) {
-	key := item.Key() // No need to copy.
+	if item.meta&bitMergeEntry > 0 {
+		if mf := item.txn.db.mergeFunc(item.key); mf != nil {
+			if item.txn.isReadTsReleased() {
+				return nil, nil, ErrReadTsReleased
+			}
+			val, err := item.txn.mergedValue(item.key, item.version, mf)
+			if err != nil {
+				return nil, nil, err
+			}
+			if item.slice == nil {
+				item.slice = new(y.Slice)
+			}
+			buf := item.slice.Resize(len(val))
+			copy(buf, val)
+			return buf, nil, nil
+		}
+	}
+	return item.yieldRawValue()
+}
+
+// yieldRawValue returns the value of the item as stored, without merging the merge operands.
+func (item *Item) yieldRawValue() ([]byte, func(), error) {
+	key := item.key // No need to copy.
 	if !item.hasValue() {
 		return nil, nil, nil
 	}
@@ -158,8 +280,13 @@ func (item *Item) yieldItemValue() ([]byte, func(), error) {
 	if item.slice == nil {
 		item.slice = new(y.Slice)
 	}
+	item.txn.db.threshold.read()
 
 	if (item.meta & bitValuePointer) == 0 {
+		if item.meta&bitTenantKey > 0 {
+			val, err := item.txn.db.tenants.decrypt(item.vptr)
+			return val, nil, err
+		}
 		val := item.slice.Resize(len(item.vptr))
 		copy(val, item.vptr)
 		return val, nil, nil
@@ -169,6 +296,9 @@ func (item *Item) yieldItemValue() ([]byte, func(), error) {
 	vp.Decode(item.vptr)
 	db := item.txn.db
 	result, cb, err := db.vlog.Read(vp, item.slice)
+	if item.stats != nil {
+		atomic.AddUint64(&item.stats.valueLogReads, 1)
+	}
 	if err != nil {
 		db.opt.Logger.Errorf("Unable to read: Key: %v, Version : %v, meta: %v, userMeta: %v"+
 			" Error: %v", key, item.version, item.meta, item.userMeta, err)
@@ -185,7 +315,7 @@ func (item *Item) yieldItemValue() ([]byte, func(), error) {
 		iopt.InternalAccess = true
 		iopt.PrefetchValues = false
 
-		it := txn.NewKeyIterator(item.Key(), iopt)
+		it := txn.NewKeyIterator(key, iopt)
 		defer it.Close()
 		for it.Rewind(); it.Valid(); it.Next() {
 			item := it.Item()
@@ -196,8 +326,14 @@ func (item *Item) yieldItemValue() ([]byte, func(), error) {
 			db.opt.Logger.Errorf("Key: %v, Version : %v, meta: %v, userMeta: %v valuePointer: %+v",
 				item.Key(), item.version, item.meta, item.userMeta, vp)
 		}
+		// Don't return error if we cannot read the value. Just log the error.
+		return result, cb, nil
+	}
+	if item.meta&bitTenantKey > 0 {
+		val, err := db.tenants.decrypt(result)
+		runCallback(cb)
+		return val, nil, err
 	}
-	// Don't return error if we cannot read the value. Just log the error.
 	return result, cb, nil
 }
 
@@ -252,8 +388,12 @@ func (item *Item) ValueSize() int64 {
 	if !item.hasValue() {
 		return 0
 	}
+	var overhead int64
+	if item.meta&bitTenantKey > 0 {
+		overhead = tenantValueHeaderSize
+	}
 	if (item.meta & bitValuePointer) == 0 {
-		return int64(len(item.vptr))
+		return int64(len(item.vptr)) - overhead
 	}
 	var vp valuePointer
 	vp.Decode(item.vptr)
@@ -261,7 +401,7 @@ func (item *Item) ValueSize() int64 {
 	klen := int64(len(item.key) + 8) // 8 bytes for timestamp.
 	// 6 bytes are for the approximate length of the header. Since header is encoded in varint, we
 	// cannot find the exact length of header without fetching it.
-	return int64(vp.Len) - klen - 6 - crc32.Size
+	return int64(vp.Len) - klen - 6 - crc32.Size - overhead
 }
 
 // UserMeta returns the userMeta set by the user. Typically, this byte, optionally set by the user
@@ -270,19 +410,61 @@ func (item *Item) UserMeta() byte {
 	return item.userMeta
 }
 
+// UserMetaExt returns the extended user metadata set via Entry.WithUserMetaExt, or nil if none
+// was set. The returned slice is only valid as long as the item is valid.
+func (item *Item) UserMetaExt() []byte {
+	if len(item.userMetaExt) == 0 {
+		return nil
+	}
+	return item.userMetaExt
+}
+
 // ExpiresAt returns a Unix time value indicating when the item will be
 // considered expired. 0 indicates that the item will never expire.
 func (item *Item) ExpiresAt() uint64 {
 	return item.expiresAt
 }
 
+// ExpiresAtTime returns the time at which the item will be considered expired. The zero Time is
+// returned if the item never expires.
+func (item *Item) ExpiresAtTime() time.Time {
+	return expiresAtTime(item.expiresAt)
+}
+
+// TTL returns the remaining time to live of the item. It returns zero if the item never expires.
+// If the item has already expired, the returned duration is negative.
+func (item *Item) TTL() time.Duration {
+	return remainingTTL(item.expiresAt)
+}
+
+func expiresAtTime(expiresAt uint64) time.Time {
+	if expiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(expiresAt), 0)
+}
+
+func remainingTTL(expiresAt uint64) time.Duration {
+	if expiresAt == 0 {
+		return 0
+	}
+	ttl := time.Until(expiresAtTime(expiresAt))
+	if ttl == 0 {
+		// Zero is reserved for items which never expire.
+		ttl = -1
+	}
+	return ttl
+}
+
 // TODO: Switch this to use linked list container in Go.
 type list struct {
 	head *Item
 	tail *Item
+	n    int
 }
 
 func (l *list) push(i *Item) {
+	l.n++
 	i.next = nil
 	if l.tail == nil {
 		l.head = i
@@ -297,6 +479,7 @@ func (l *list) pop() *Item {
 	if l.head == nil {
 		return nil
 	}
+	l.n--
 	i := l.head
 	if l.head == l.tail {
 		l.tail = nil
@@ -325,12 +508,103 @@ type IteratorOptions struct {
 	AllVersions    bool // Fetch all valid versions of the same key.
 	InternalAccess bool // Used to allow internal access to badger keys.
 
+	// AdaptivePrefetch, if set along with PrefetchValues, makes PrefetchSize the maximum number of
+	// KV pairs to prefetch. The iterator starts by prefetching a couple of them, and doubles the
+	// number every time it moves to a KV pair whose value is still being fetched, so short scans
+	// don't fetch values they don't use, and long ones read more values concurrently. Only the
+	// values in the value log are read concurrently; the ones in the LSM tree are copied right away.
+	AdaptivePrefetch bool
+
 	// The following option is used to narrow down the SSTables that iterator
 	// picks up. If Prefix is specified, only tables which could have this
 	// prefix are picked based on their range of keys.
 	prefixIsKey bool   // If set, use the prefix for bloom filter lookup.
 	Prefix      []byte // Only iterate over this given prefix.
 	SinceTs     uint64 // Only read data that has version > SinceTs.
+
+	// LowerBound and UpperBound, if set, restrict the iteration to the keys in the range
+	// [LowerBound, UpperBound). Like Prefix, they are used to narrow down the SSTables the iterator
+	// picks up, and the iterator doesn't prefetch beyond them.
+	LowerBound []byte
+	UpperBound []byte
+
+	// KeyFilter, if set, is called with the keys in the range of the iteration, and only the ones
+	// for which it returns true are iterated over. The keys are filtered out before their values
+	// are fetched, so a scan matching few keys doesn't read the values of the rest. For example,
+	// regexp.Regexp.Match can be used to filter by a regular expression. The key passed must not
+	// be retained after KeyFilter returns.
+	KeyFilter func(key []byte) bool
+
+	// UserMetaMask, if not zero, restricts the iteration to the keys whose UserMeta has the bits
+	// in the mask set as in UserMetaValue, for example to skip the keys carrying an application
+	// marker. Only the latest visible version of a key is matched, unless AllVersions is set, in
+	// which case every version is matched on its own. Like with KeyFilter, the values of the keys
+	// filtered out aren't fetched.
+	UserMetaMask  byte
+	UserMetaValue byte
+
+	// Sample, if greater than 1, makes the iterator visit only about one in Sample of the keys, by
+	// skipping whole blocks of the SSTables at random. It is meant for computing approximate
+	// statistics, like the average value size, over large datasets. As the versions of a key are
+	// sampled independently, an older version of a key, or one which has been deleted, may be
+	// returned.
+	Sample int
+
+	// OnlyPendingWrites restricts the iteration to the writes of the transaction which are not
+	// committed yet. Set AllVersions as well to also iterate over the pending deletes.
+	OnlyPendingWrites bool
+
+	// Detached makes the iterator read from the memtables, tables and value log files it holds
+	// references to, instead of relying on the read timestamp of the transaction to keep the
+	// versions it reads around. The read timestamp is released as the iterator is created, so a
+	// long-running scan doesn't hold back the cleanup of the old versions in the rest of the DB.
+	// It's only valid for read-only transactions, which can't read anymore afterwards: Get returns
+	// ErrReadTsReleased and NewIterator panics. Merge entries can't be resolved either, so
+	// Item.Value returns ErrReadTsReleased for them.
+	Detached bool
+
+	// Sources are merged with the KV pairs of the DB into the iteration, as if they were stored in
+	// the DB. Only their versions up to the read timestamp of the transaction are visible, and if
+	// a source has the same version of a key as the DB, or as a source before it, it is skipped.
+	// The sources are closed along with the iterator.
+	Sources []IteratorSource
+
+	// ValueReadAhead, if positive along with PrefetchValues, makes the iterator read the value log
+	// ahead, ValueReadAhead bytes at a time, once the values it fetches follow each other closely
+	// in a value log file, as they do after a bulk load. A few large sequential reads then replace
+	// the random reads of single values, which are dominated by the seek time on spinning disks.
+	// A value of a few MB is a good start.
+	ValueReadAhead int
+
+	stats *iteratorStats // Set by NewIterator. See Iterator.Stats.
+}
+
+// IteratorStats reports the work done by an Iterator, to help diagnose slow scans.
+type IteratorStats struct {
+	TablesTouched        uint64 // Number of tables at least a block of which has been read.
+	BlocksRead           uint64 // Number of blocks read, including the block cache hits.
+	BlockCacheHits       uint64 // Number of blocks found in the block cache.
+	BloomFilterNegatives uint64 // Number of tables skipped as their bloom filter ruled out the key.
+	ValueLogReads        uint64 // Number of values read from the value log.
+	BytesDecompressed    uint64 // Size of the blocks decompressed, once decompressed.
+}
+
+// iteratorStats holds the counters behind IteratorStats, which are updated atomically.
+type iteratorStats struct {
+	table.IteratorStats
+	bloomFilterNegatives uint64
+	valueLogReads        uint64
+}
+
+func (s *iteratorStats) addBloomFilterNegative() {
+	if s != nil {
+		atomic.AddUint64(&s.bloomFilterNegatives, 1)
+	}
+}
+
+// matchesUserMeta returns true if the given UserMeta matches UserMetaMask and UserMetaValue.
+func (opt *IteratorOptions) matchesUserMeta(userMeta byte) bool {
+	return userMeta&opt.UserMetaMask == opt.UserMetaValue&opt.UserMetaMask
 }
 
 func (opt *IteratorOptions) compareToPrefix(key []byte) int {
@@ -342,11 +616,26 @@ func (opt *IteratorOptions) compareToPrefix(key []byte) int {
 	return bytes.Compare(key, opt.Prefix)
 }
 
+// overlapsBounds returns false if all the keys in the range [smallest, biggest] are out of the
+// bounds of the iteration.
+func (opt *IteratorOptions) overlapsBounds(smallest, biggest []byte) bool {
+	if len(opt.LowerBound) > 0 && bytes.Compare(y.ParseKey(biggest), opt.LowerBound) < 0 {
+		return false
+	}
+	if len(opt.UpperBound) > 0 && bytes.Compare(y.ParseKey(smallest), opt.UpperBound) >= 0 {
+		return false
+	}
+	return true
+}
+
 func (opt *IteratorOptions) pickTable(t table.TableInterface) bool {
 	// Ignore this table if its max version is less than the sinceTs.
 	if t.MaxVersion() < opt.SinceTs {
 		return false
 	}
+	if !opt.overlapsBounds(t.Smallest(), t.Biggest()) {
+		return false
+	}
 	if len(opt.Prefix) == 0 {
 		return true
 	}
@@ -359,6 +648,7 @@ func (opt *IteratorOptions) pickTable(t table.TableInterface) bool {
 	// Bloom filter lookup would only work if opt.Prefix does NOT have the read
 	// timestamp as part of the key.
 	if opt.prefixIsKey && t.DoesNotHave(y.Hash(opt.Prefix)) {
+		opt.stats.addBloomFilterNegative()
 		return false
 	}
 	return true
@@ -368,7 +658,7 @@ func (opt *IteratorOptions) pickTable(t table.TableInterface) bool {
 // that the tables are sorted in the right order.
 func (opt *IteratorOptions) pickTables(all []*table.Table) []*table.Table {
 	filterTables := func(tables []*table.Table) []*table.Table {
-		if opt.SinceTs == 0 {
+		if opt.SinceTs == 0 && len(opt.LowerBound) == 0 && len(opt.UpperBound) == 0 {
 			return tables
 		}
 		out := tables[:0]
@@ -376,6 +666,9 @@ func (opt *IteratorOptions) pickTables(all []*table.Table) []*table.Table {
 			if t.MaxVersion() < opt.SinceTs {
 				continue
 			}
+			if !opt.overlapsBounds(t.Smallest(), t.Biggest()) {
+				continue
+			}
 			out = append(out, t)
 		}
 		return out
@@ -420,6 +713,7 @@ func (opt *IteratorOptions) pickTables(all []*table.Table) []*table.Table {
 		// opt.Prefix is actually the key. So, we can run bloom filter checks
 		// as well.
 		if t.DoesNotHave(hash) {
+			opt.stats.addBloomFilterNegative()
 			continue
 		}
 		out = append(out, t)
@@ -450,6 +744,9 @@ type Iterator struct {
 
 	closed  bool
 	scanned int // Used to estimate the size of data scanned by iterator.
+	window  int // Number of KV pairs to prefetch, if AdaptivePrefetch is set.
+
+	readAhead vlogReadAhead // Used if ValueReadAhead is set.
 
 	// ThreadId is an optional value that can be set to identify which goroutine created
 	// the iterator. It can be used, for example, to uniquely identify each of the
@@ -458,6 +755,9 @@ type Iterator struct {
 
 	latestTs uint64
 	Alloc    *z.Allocator
+
+	// ksPrefix is the prefix of the keyspace this iterator was created for, if any.
+	ksPrefix []byte
 }
 
 // NewIterator returns a new iterator. Depending upon the options, either only keys, or both
@@ -477,32 +777,94 @@ func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 	if txn.db.IsClosed() {
 		panic(ErrDBClosed.Error())
 	}
+	if txn.isReadTsReleased() {
+		panic(ErrReadTsReleased.Error())
+	}
+	if opt.Detached && txn.update {
+		panic("Detached iterators can only be created in read-only transactions")
+	}
 
 	// Keep track of the number of active iterators.
 	atomic.AddInt32(&txn.numIterators, 1)
+	if !opt.OnlyPendingWrites {
+		txn.addReadPrefix(opt.Prefix)
+	}
 
-	// TODO: If Prefix is set, only pick those memtables which have keys with
-	// the prefix.
-	tables, decr := txn.db.getMemTables()
-	defer decr()
 	txn.db.vlog.incrIteratorCount()
+	opt.stats = new(iteratorStats)
 	var iters []y.Iterator
 	if itr := txn.newPendingWritesIterator(opt.Reverse); itr != nil {
 		iters = append(iters, itr)
 	}
-	for i := 0; i < len(tables); i++ {
-		iters = append(iters, tables[i].sl.NewUniIterator(opt.Reverse))
+	if !opt.OnlyPendingWrites {
+		// TODO: If Prefix is set, only pick those memtables which have keys with
+		// the prefix.
+		tables, decr := txn.db.getMemTables()
+		defer decr()
+		for i := 0; i < len(tables); i++ {
+			var itr y.Iterator = tables[i].sl.NewUniIterator(opt.Reverse)
+			if opt.Sample > 1 {
+				itr = &sampledIterator{Iterator: itr, n: opt.Sample}
+			}
+			iters = append(iters, itr)
+		}
+		iters = append(iters, txn.db.lc.iterators(&opt)...) // This will increment references.
+		for _, src := range opt.Sources {
+			iters = append(iters, &sourceIterator{src: src})
+		}
 	}
-	iters = append(iters, txn.db.lc.iterators(&opt)...) // This will increment references.
 	res := &Iterator{
 		txn:    txn,
 		iitr:   table.NewMergeIterator(iters, opt.Reverse),
 		opt:    opt,
 		readTs: txn.readTs,
 	}
+	if opt.PrefetchValues && opt.ValueReadAhead > 0 && !txn.db.opt.InMemory {
+		res.readAhead.size = math.MaxUint32
+		if int64(opt.ValueReadAhead) < math.MaxUint32 {
+			res.readAhead.size = uint32(opt.ValueReadAhead)
+		}
+	}
+	if res.iitr == nil {
+		// There are no pending writes. Close doesn't decrement the count for a nil iitr.
+		_ = txn.db.vlog.decrIteratorCount()
+	}
+	if opt.Detached {
+		// The sub-iterators hold references to the memtables and the tables, and the value log
+		// files aren't deleted while the iterator is open, so the read timestamp isn't needed.
+		txn.releaseReadTs()
+	}
 	return res
 }
 
+// Stats returns the work done by the iterator so far. It may be called concurrently with the
+// iteration, and after Close.
+func (it *Iterator) Stats() IteratorStats {
+	s := it.opt.stats
+	return IteratorStats{
+		TablesTouched:        atomic.LoadUint64(&s.TablesTouched),
+		BlocksRead:           atomic.LoadUint64(&s.BlocksRead),
+		BlockCacheHits:       atomic.LoadUint64(&s.BlockCacheHits),
+		BloomFilterNegatives: atomic.LoadUint64(&s.bloomFilterNegatives),
+		ValueLogReads:        atomic.LoadUint64(&s.valueLogReads),
+		BytesDecompressed:    atomic.LoadUint64(&s.BytesDecompressed),
+	}
+}
+
+// sampledIterator visits only about one in n of the keys of the underlying iterator as it moves
+// forward. It is used to sample the memtables, whose keys aren't grouped into blocks.
+type sampledIterator struct {
+	y.Iterator
+	n int
+}
+
+func (s *sampledIterator) Next() {
+	s.Iterator.Next()
+	for s.Iterator.Valid() && z.FastRand()%uint32(s.n) != 0 {
+		s.Iterator.Next()
+	}
+}
+
 // NewKeyIterator is just like NewIterator, but allows the user to iterate over all versions of a
 // single key. Internally, it sets the Prefix option in provided opt, and uses that prefix to
 // additionally run bloom filter lookups before picking tables from the LSM tree.
@@ -519,7 +881,7 @@ func (txn *Txn) NewKeyIterator(key []byte, opt IteratorOptions) *Iterator {
 func (it *Iterator) newItem() *Item {
 	item := it.waste.pop()
 	if item == nil {
-		item = &Item{slice: new(y.Slice), txn: it.txn}
+		item = &Item{slice: new(y.Slice), txn: it.txn, stats: it.opt.stats}
 	}
 	return item
 }
@@ -528,7 +890,7 @@ func (it *Iterator) newItem() *Item {
 // This item is only valid until it.Next() gets called.
 func (it *Iterator) Item() *Item {
 	tx := it.txn
-	tx.addReadKey(it.item.Key())
+	tx.addReadKey(it.item.key)
 	return it.item
 }
 
@@ -546,7 +908,7 @@ func (it *Iterator) Valid() bool {
 // ValidForPrefix returns false when iteration is done
 // or when the current key is not prefixed by the specified prefix.
 func (it *Iterator) ValidForPrefix(prefix []byte) bool {
-	return it.Valid() && bytes.HasPrefix(it.item.key, prefix)
+	return it.Valid() && bytes.HasPrefix(it.item.Key(), prefix)
 }
 
 // Close would close the iterator. It is important to call this when you're done with iteration.
@@ -591,15 +953,37 @@ func (it *Iterator) Next() {
 
 	// Set next item to current
 	it.item = it.data.pop()
-	for it.iitr.Valid() {
+	adaptive := it.adaptivePrefetch()
+	if adaptive && it.item != nil && atomic.LoadInt32(&it.item.fetching) == 1 {
+		// The values aren't fetched as fast as they are consumed.
+		if it.window *= 2; it.window > it.opt.PrefetchSize {
+			it.window = it.opt.PrefetchSize
+		}
+	}
+	for it.iitrValid() {
 		if it.parseItem() {
 			// parseItem calls one extra next.
 			// This is used to deal with the complexity of reverse iteration.
-			break
+			if !adaptive || it.data.n+1 >= it.window {
+				break
+			}
 		}
 	}
 }
 
+func (it *Iterator) adaptivePrefetch() bool {
+	return it.opt.PrefetchValues && it.opt.AdaptivePrefetch && it.opt.PrefetchSize > 2
+}
+
+// notifyExpired calls the OnExpire callback if the given version of key, which is deleted or
+// expired, has expired.
+func (db *DB) notifyExpired(key []byte, vs y.ValueStruct) {
+	if db.opt.OnExpire == nil || vs.Meta&bitDelete > 0 || vs.ExpiresAt == 0 {
+		return
+	}
+	db.opt.OnExpire(key, vs.UserMeta)
+}
+
 func isDeletedOrExpired(meta byte, expiresAt uint64) bool {
 	if meta&bitDelete > 0 {
 		return true
@@ -629,31 +1013,19 @@ func (it *Iterator) parseItem() bool {
 		}
 	}
 
-	isInternalKey := bytes.HasPrefix(key, badgerPrefix)
-	// Skip badger keys.
-	if !it.opt.InternalAccess && isInternalKey {
-		mi.Next()
-		return false
-	}
-
-	// Skip any versions which are beyond the readTs.
-	version := y.ParseTs(key)
-	if version > it.latestTs {
+	if version := y.ParseTs(key); version > it.latestTs {
 		it.latestTs = version
 	}
-	// Ignore everything that is above the readTs and below or at the sinceTs.
-	if version > it.readTs || (it.opt.SinceTs > 0 && version <= it.opt.SinceTs) {
-		mi.Next()
-		return false
-	}
-
-	// Skip banned keys only if it does not have badger internal prefix.
-	if !isInternalKey && it.txn.db.isBanned(key) != nil {
+	if it.skip(key) {
 		mi.Next()
 		return false
 	}
 
 	if it.opt.AllVersions {
+		if !it.opt.matchesUserMeta(mi.Value().UserMeta) {
+			mi.Next()
+			return false
+		}
 		// Return deleted or expired values also, otherwise user can't figure out
 		// whether the key was deleted.
 		item := it.newItem()
@@ -682,6 +1054,12 @@ FILL:
 	// If deleted, advance and return.
 	vs := mi.Value()
 	if isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
+		it.txn.db.notifyExpired(y.ParseKey(mi.Key()), vs)
+		mi.Next()
+		return false
+	}
+	// Like a deleted key, a key whose latest version doesn't match is skipped altogether.
+	if !it.opt.matchesUserMeta(vs.UserMeta) {
 		mi.Next()
 		return false
 	}
@@ -709,22 +1087,117 @@ FILL:
 	return true
 }
 
+// skip returns true if the given version of a key, with the timestamp, is not visible to the
+// iterator.
+func (it *Iterator) skip(key []byte) bool {
+	isInternalKey := bytes.HasPrefix(key, badgerPrefix)
+	// Skip badger keys.
+	if !it.opt.InternalAccess && isInternalKey {
+		return true
+	}
+
+	// Ignore everything that is above the readTs and below or at the sinceTs.
+	version := y.ParseTs(key)
+	if version > it.readTs || (it.opt.SinceTs > 0 && version <= it.opt.SinceTs) {
+		return true
+	}
+
+	// Skip banned keys only if it does not have badger internal prefix.
+	if !isInternalKey && it.txn.db.isBanned(key) != nil {
+		return true
+	}
+	// Skip the versions hidden by DropPrefixAsync. As all the older versions of the key are hidden
+	// as well, this is equivalent to the key being deleted.
+	if !isInternalKey && it.txn.db.prefixDrops.covers(y.ParseKey(key), version) {
+		return true
+	}
+
+	// Skip the keys filtered out by the user, before fetching their values.
+	if it.opt.KeyFilter != nil {
+		userKey := y.ParseKey(key)
+		if bytes.HasPrefix(userKey, it.ksPrefix) {
+			userKey = userKey[len(it.ksPrefix):]
+		}
+		if !it.opt.KeyFilter(userKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// iitrValid returns true if the internal iterator is valid, has not gone past the bound in the
+// direction of the iteration, and is within the prefix, if any.
+func (it *Iterator) iitrValid() bool {
+	if !it.iitr.Valid() {
+		return false
+	}
+	if len(it.opt.Prefix) > 0 && !bytes.HasPrefix(y.ParseKey(it.iitr.Key()), it.opt.Prefix) {
+		return false
+	}
+	if !it.opt.Reverse {
+		return len(it.opt.UpperBound) == 0 ||
+			bytes.Compare(y.ParseKey(it.iitr.Key()), it.opt.UpperBound) < 0
+	}
+	return len(it.opt.LowerBound) == 0 ||
+		bytes.Compare(y.ParseKey(it.iitr.Key()), it.opt.LowerBound) >= 0
+}
+
+// end returns the smallest key above the range of keys to iterate over, given the prefix and the
+// upper bound, or nil if there's no such key.
+func (it *Iterator) end() []byte {
+	end := it.opt.UpperBound
+	pend := prefixEnd(it.opt.Prefix)
+	if pend != nil && (len(end) == 0 || bytes.Compare(pend, end) < 0) {
+		end = pend
+	}
+	return end
+}
+
+// prefixEnd returns the smallest key above all the keys with the given prefix, or nil if there's
+// no such key.
+func prefixEnd(prefix []byte) []byte {
+	// The prefix followed by 0xFF bytes is the last key with the prefix, so the end is the prefix
+	// with its last byte below 0xFF incremented.
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xFF {
+			return append(y.SafeCopy(nil, prefix[:i]), prefix[i]+1)
+		}
+	}
+	return nil
+}
+
 func (it *Iterator) fill(item *Item) {
 	vs := it.iitr.Value()
 	item.meta = vs.Meta
 	item.userMeta = vs.UserMeta
+	item.userMetaExt = y.SafeCopy(item.userMetaExt, vs.UserMetaExt)
 	item.expiresAt = vs.ExpiresAt
 
 	item.version = y.ParseTs(it.iitr.Key())
 	item.key = y.SafeCopy(item.key, y.ParseKey(it.iitr.Key()))
+	item.prefixLen = len(it.ksPrefix)
 
 	item.vptr = y.SafeCopy(item.vptr, vs.Value)
 	item.val = nil
+	if it.readAhead.size > 0 && vs.Meta&bitValuePointer > 0 {
+		var vp valuePointer
+		vp.Decode(vs.Value)
+		if start, end, ok := it.readAhead.next(vp); ok {
+			it.txn.db.vlog.readAhead(vp.Fid, start, end)
+		}
+	}
 	if it.opt.PrefetchValues {
+		if it.adaptivePrefetch() && vs.Meta&bitValuePointer == 0 {
+			// The value is in the LSM tree, there's nothing to wait for.
+			item.prefetchValue()
+			return
+		}
 		item.wg.Add(1)
+		atomic.StoreInt32(&item.fetching, 1)
 		go func() {
 			// FIXME we are not handling errors here.
 			item.prefetchValue()
+			atomic.StoreInt32(&item.fetching, 0)
 			item.wg.Done()
 		}()
 	}
@@ -732,14 +1205,16 @@ func (it *Iterator) fill(item *Item) {
 
 func (it *Iterator) prefetch() {
 	prefetchSize := 2
-	if it.opt.PrefetchValues && it.opt.PrefetchSize > 1 {
+	if it.adaptivePrefetch() {
+		// Start small, Next widens the window as needed.
+		it.window = prefetchSize
+	} else if it.opt.PrefetchValues && it.opt.PrefetchSize > 1 {
 		prefetchSize = it.opt.PrefetchSize
 	}
 
-	i := it.iitr
 	var count int
 	it.item = nil
-	for i.Valid() {
+	for it.iitrValid() {
 		if !it.parseItem() {
 			continue
 		}
@@ -757,6 +1232,9 @@ func (it *Iterator) Seek(key []byte) uint64 {
 	if it.iitr == nil {
 		return it.latestTs
 	}
+	if len(key) > 0 && len(it.ksPrefix) > 0 {
+		key = append(y.SafeCopy(nil, it.ksPrefix), key...)
+	}
 	if len(key) > 0 {
 		it.txn.addReadKey(key)
 	}
@@ -766,9 +1244,20 @@ func (it *Iterator) Seek(key []byte) uint64 {
 	}
 
 	it.lastKey = it.lastKey[:0]
-	if len(key) == 0 {
+	if len(key) == 0 && !it.opt.Reverse {
 		key = it.opt.Prefix
 	}
+	// Keep within the bounds. The iteration stops at the bound in the direction of the iteration.
+	if !it.opt.Reverse && len(it.opt.LowerBound) > 0 && bytes.Compare(key, it.opt.LowerBound) < 0 {
+		key = it.opt.LowerBound
+	}
+	if end := it.end(); it.opt.Reverse && len(end) > 0 &&
+		(len(key) == 0 || bytes.Compare(key, end) >= 0) {
+		// This is the first version of the end, so the seek lands on the key below it.
+		it.iitr.Seek(y.KeyWithTs(end, math.MaxUint64))
+		it.prefetch()
+		return it.latestTs
+	}
 	if len(key) == 0 {
 		it.iitr.Rewind()
 		it.prefetch()
@@ -787,9 +1276,103 @@ func (it *Iterator) Seek(key []byte) uint64 {
 	return it.latestTs
 }
 
+// SeekForPrev would seek to the provided key if present. If absent, it would seek to the greatest
+// key smaller than the provided key if iterating in the forward direction, so that the iteration
+// continues from there. Behavior would be reversed if iterating backwards. The iterator is invalid
+// if there's no such key. A nil key rewinds the iterator, like Seek.
+func (it *Iterator) SeekForPrev(key []byte) uint64 {
+	latestTs := it.Seek(key)
+	if it.iitr == nil || len(key) == 0 || (it.Valid() && bytes.Equal(it.item.Key(), key)) {
+		return latestTs
+	}
+
+	// Find the preceding key by seeking in the opposite direction.
+	opt := it.opt
+	opt.Reverse = !opt.Reverse
+	opt.PrefetchValues = false
+	prev := it.txn.NewIterator(opt)
+	prev.ksPrefix = it.ksPrefix
+	prev.Seek(key)
+	if !prev.Valid() {
+		prev.Close()
+		for i := it.data.pop(); i != nil; i = it.data.pop() {
+			i.wg.Wait()
+			it.waste.push(i)
+		}
+		if it.item != nil {
+			it.item.wg.Wait()
+			it.waste.push(it.item)
+			it.item = nil
+		}
+		return latestTs
+	}
+	key = prev.Item().KeyCopy(nil)
+	prev.Close()
+	return it.Seek(key)
+}
+
 // Rewind would rewind the iterator cursor all the way to zero-th position, which would be the
 // smallest key if iterating forward, and largest if iterating backward. It does not keep track of
-// whether the cursor started with a Seek().
+// whether the cursor started with a Seek(). If IteratorOptions.Prefix is set, the iteration starts
+// at the smallest or largest key with the prefix, and stops at the last one.
 func (it *Iterator) Rewind() {
 	it.Seek(nil)
 }
+
+// CountKeys returns the number of keys with the given prefix visible to the transaction, as an
+// Iterator with the given options would count them, but only reading the keys and the metadata
+// stored alongside them, without fetching the values or allocating Items. opt.Prefix is replaced
+// by prefix, and opt.Reverse is ignored. Deleted and expired keys are not counted, unless
+// opt.AllVersions is set, in which case every version of the keys is counted.
+func (txn *Txn) CountKeys(prefix []byte, opt IteratorOptions) (int, error) {
+	if txn.discarded {
+		return 0, ErrDiscardedTxn
+	}
+	opt.Prefix = prefix
+	opt.Reverse = false
+	opt.PrefetchValues = false
+	it := txn.NewIterator(opt)
+	defer it.Close()
+	if it.iitr == nil {
+		return 0, nil
+	}
+
+	mi := it.iitr
+	seek := prefix
+	if len(opt.LowerBound) > 0 && bytes.Compare(seek, opt.LowerBound) < 0 {
+		seek = opt.LowerBound
+	}
+	if len(seek) == 0 {
+		mi.Rewind()
+	} else {
+		mi.Seek(y.KeyWithTs(seek, math.MaxUint64))
+	}
+
+	var count int
+	var lastKey []byte
+	for ; it.iitrValid(); mi.Next() {
+		key := mi.Key()
+		if !bytes.HasPrefix(y.ParseKey(key), prefix) {
+			break
+		}
+		if it.skip(key) {
+			continue
+		}
+		if opt.AllVersions {
+			if opt.matchesUserMeta(mi.Value().UserMeta) {
+				count++
+			}
+			continue
+		}
+		// Only the latest visible version of a key decides whether it is counted.
+		if y.SameKey(lastKey, key) {
+			continue
+		}
+		lastKey = y.SafeCopy(lastKey, key)
+		vs := mi.Value()
+		if !isDeletedOrExpired(vs.Meta, vs.ExpiresAt) && opt.matchesUserMeta(vs.UserMeta) {
+			count++
+		}
+	}
+	return count, nil
+}
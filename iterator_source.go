@@ -0,0 +1,114 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/dgraph-io/badger/v3/y"
+)
+
+// IteratorSource is a sorted source of KV pairs, like a remote shard or an in-memory overlay, which
+// an Iterator merges with the KV pairs of the DB. See IteratorOptions.Sources.
+//
+// The KV pairs are ordered by key, and then by version from the newest to the oldest. A source
+// iterates in the direction of the Iterator it is passed to: if IteratorOptions.Reverse is set,
+// it must iterate in the reverse order, from the biggest key to the smallest, and from the oldest
+// version of a key to the newest.
+type IteratorSource interface {
+	// Rewind moves to the first KV pair in the order of the iteration.
+	Rewind()
+	// Seek moves to the first KV pair at or after the given version of key, in the order of the
+	// iteration.
+	Seek(key []byte, version uint64)
+	// Next moves to the next KV pair in the order of the iteration.
+	Next()
+	// Valid returns false once the source has been iterated over.
+	Valid() bool
+
+	// Key, Version, Value, UserMeta, ExpiresAt and IsDeleted describe the current KV pair. The
+	// slices returned are only read until the source is moved.
+	Key() []byte
+	Version() uint64
+	Value() []byte
+	UserMeta() byte
+	ExpiresAt() uint64
+	IsDeleted() bool
+
+	// Close is called once the Iterator is closed.
+	Close() error
+}
+
+// sourceIterator adapts an IteratorSource to the internal iterator interface, whose keys carry the
+// version.
+type sourceIterator struct {
+	src IteratorSource
+	key []byte
+}
+
+var _ y.Iterator = (*sourceIterator)(nil)
+
+func (s *sourceIterator) setKey() {
+	if !s.src.Valid() {
+		return
+	}
+	// Like y.KeyWithTs, reusing the buffer.
+	key := s.src.Key()
+	s.key = append(append(s.key[:0], key...), make([]byte, 8)...)
+	binary.BigEndian.PutUint64(s.key[len(key):], math.MaxUint64-s.src.Version())
+}
+
+func (s *sourceIterator) Next() {
+	s.src.Next()
+	s.setKey()
+}
+
+func (s *sourceIterator) Rewind() {
+	s.src.Rewind()
+	s.setKey()
+}
+
+func (s *sourceIterator) Seek(key []byte) {
+	s.src.Seek(y.ParseKey(key), y.ParseTs(key))
+	s.setKey()
+}
+
+func (s *sourceIterator) Key() []byte {
+	return s.key
+}
+
+func (s *sourceIterator) Value() y.ValueStruct {
+	vs := y.ValueStruct{
+		Value:     s.src.Value(),
+		UserMeta:  s.src.UserMeta(),
+		ExpiresAt: s.src.ExpiresAt(),
+		Version:   s.src.Version(),
+	}
+	if s.src.IsDeleted() {
+		vs.Meta = bitDelete
+	}
+	return vs
+}
+
+func (s *sourceIterator) Valid() bool {
+	return s.src.Valid()
+}
+
+func (s *sourceIterator) Close() error {
+	return s.src.Close()
+}
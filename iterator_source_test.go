@@ -0,0 +1,144 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type sourceKV struct {
+	key     string
+	version uint64
+	value   string
+	deleted bool
+}
+
+// sliceSource is an IteratorSource over a slice of KV pairs.
+type sliceSource struct {
+	kvs     []sourceKV
+	reverse bool
+	idx     int
+	closed  bool
+}
+
+func newSliceSource(kvs []sourceKV, reverse bool) *sliceSource {
+	// Sort by key, and by version from the newest to the oldest.
+	sort.Slice(kvs, func(i, j int) bool {
+		if kvs[i].key != kvs[j].key {
+			return kvs[i].key < kvs[j].key
+		}
+		return kvs[i].version > kvs[j].version
+	})
+	if reverse {
+		for i, j := 0, len(kvs)-1; i < j; i, j = i+1, j-1 {
+			kvs[i], kvs[j] = kvs[j], kvs[i]
+		}
+	}
+	return &sliceSource{kvs: kvs, reverse: reverse}
+}
+
+func (s *sliceSource) Rewind() { s.idx = 0 }
+
+func (s *sliceSource) Seek(key []byte, version uint64) {
+	s.idx = sort.Search(len(s.kvs), func(i int) bool {
+		kv := s.kvs[i]
+		cmp := bytes.Compare([]byte(kv.key), key)
+		if s.reverse {
+			return cmp < 0 || (cmp == 0 && kv.version >= version)
+		}
+		return cmp > 0 || (cmp == 0 && kv.version <= version)
+	})
+}
+
+func (s *sliceSource) Next()             { s.idx++ }
+func (s *sliceSource) Valid() bool       { return s.idx < len(s.kvs) }
+func (s *sliceSource) Key() []byte       { return []byte(s.kvs[s.idx].key) }
+func (s *sliceSource) Version() uint64   { return s.kvs[s.idx].version }
+func (s *sliceSource) Value() []byte     { return []byte(s.kvs[s.idx].value) }
+func (s *sliceSource) UserMeta() byte    { return 0 }
+func (s *sliceSource) ExpiresAt() uint64 { return 0 }
+func (s *sliceSource) IsDeleted() bool   { return s.kvs[s.idx].deleted }
+func (s *sliceSource) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestIteratorSources(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for _, k := range []string{"a", "c", "e"} {
+				if err := txn.Set([]byte(k), []byte("db")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		// The versions of the source are above the ones of the DB, up to the read timestamp.
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("g"), []byte("db"))
+		}))
+		srcTs := db.MaxVersion()
+
+		kvs := func() []sourceKV {
+			return []sourceKV{
+				{key: "b", version: 1, value: "src"},
+				// Newer than the version of the DB.
+				{key: "c", version: srcTs, value: "src"},
+				{key: "c", version: 1, value: "old"},
+				{key: "d", version: 1, value: "src"},
+				// Deletes the key of the DB.
+				{key: "e", version: srcTs, deleted: true},
+				// Above the read timestamp, so not visible.
+				{key: "f", version: srcTs + 100, value: "src"},
+			}
+		}
+
+		iterate := func(reverse bool, seek string) ([]string, *sliceSource) {
+			src := newSliceSource(kvs(), reverse)
+			var out []string
+			require.NoError(t, db.View(func(txn *Txn) error {
+				opt := DefaultIteratorOptions
+				opt.Reverse = reverse
+				opt.Sources = []IteratorSource{src}
+				itr := txn.NewIterator(opt)
+				defer itr.Close()
+				for itr.Seek([]byte(seek)); itr.Valid(); itr.Next() {
+					item := itr.Item()
+					out = append(out, fmt.Sprintf("%s=%s", item.Key(), getItemValue(t, item)))
+				}
+				return nil
+			}))
+			return out, src
+		}
+
+		out, src := iterate(false, "")
+		require.True(t, src.closed)
+		require.Equal(t, []string{"a=db", "b=src", "c=src", "d=src", "g=db"}, out)
+		out, _ = iterate(false, "c")
+		require.Equal(t, []string{"c=src", "d=src", "g=db"}, out)
+
+		out, _ = iterate(true, "")
+		require.Equal(t, []string{"g=db", "d=src", "c=src", "b=src", "a=db"}, out)
+		out, _ = iterate(true, "c")
+		require.Equal(t, []string{"c=src", "b=src", "a=db"}, out)
+	})
+}
@@ -18,6 +18,7 @@ package badger
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math"
@@ -26,6 +27,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/badger/v3/options"
 	"github.com/dgraph-io/badger/v3/table"
@@ -124,6 +126,470 @@ func TestPickSortTables(t *testing.T) {
 	require.Equal(t, y.ParseKey(filtered[0].Biggest()), []byte("abc"))
 }
 
+func TestPickTablesWithBounds(t *testing.T) {
+	opt := DefaultIteratorOptions
+	opt.LowerBound = []byte("b")
+	opt.UpperBound = []byte("d")
+	pick := func(left, right string) bool {
+		tm := &tableMock{left: y.KeyWithTs([]byte(left), 1), right: y.KeyWithTs([]byte(right), 1)}
+		return opt.pickTable(tm)
+	}
+	require.True(t, pick("a", "b"))
+	require.True(t, pick("bb", "c"))
+	require.True(t, pick("a", "z"))
+	require.True(t, pick("cz", "z"))
+	require.False(t, pick("a", "az"))
+	require.False(t, pick("d", "z"))
+}
+
+func TestIterateBounds(t *testing.T) {
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%04d", i))
+	}
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 100; i++ {
+				if err := txn.Set(key(i), []byte("val")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+
+		iterate := func(opt IteratorOptions, seek []byte) []string {
+			var keys []string
+			require.NoError(t, db.View(func(txn *Txn) error {
+				itr := txn.NewIterator(opt)
+				defer itr.Close()
+				for itr.Seek(seek); itr.Valid(); itr.Next() {
+					keys = append(keys, string(itr.Item().Key()))
+				}
+				return nil
+			}))
+			return keys
+		}
+
+		opt := DefaultIteratorOptions
+		opt.PrefetchSize = 3
+		opt.LowerBound = key(10)
+		opt.UpperBound = []byte("0013")
+		require.Equal(t, []string{"0010", "0011", "0012"}, iterate(opt, nil))
+		require.Equal(t, []string{"0010", "0011", "0012"}, iterate(opt, key(2)))
+		require.Equal(t, []string{"0012"}, iterate(opt, key(12)))
+		require.Empty(t, iterate(opt, key(50)))
+
+		opt.Reverse = true
+		require.Equal(t, []string{"0012", "0011", "0010"}, iterate(opt, nil))
+		require.Equal(t, []string{"0012", "0011", "0010"}, iterate(opt, key(50)))
+		require.Equal(t, []string{"0011", "0010"}, iterate(opt, key(11)))
+
+		opt.Reverse = false
+		opt.LowerBound = nil
+		opt.UpperBound = key(2)
+		require.Equal(t, []string{"0000", "0001"}, iterate(opt, nil))
+	})
+}
+
+func TestIterateReversePrefix(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for _, k := range []string{"a1", "b1", "b2", "b\xff", "b\xff\xff1", "c1", "\xff\xff1"} {
+				if err := txn.Set([]byte(k), []byte("val")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+
+		iterate := func(opt IteratorOptions, seek string) []string {
+			var keys []string
+			require.NoError(t, db.View(func(txn *Txn) error {
+				itr := txn.NewIterator(opt)
+				defer itr.Close()
+				for itr.Seek([]byte(seek)); itr.Valid(); itr.Next() {
+					keys = append(keys, string(itr.Item().Key()))
+				}
+				return nil
+			}))
+			return keys
+		}
+
+		opt := DefaultIteratorOptions
+		opt.Prefix = []byte("b")
+		require.Equal(t, []string{"b1", "b2", "b\xff", "b\xff\xff1"}, iterate(opt, ""))
+
+		opt.Reverse = true
+		require.Equal(t, []string{"b\xff\xff1", "b\xff", "b2", "b1"}, iterate(opt, ""))
+		require.Equal(t, []string{"b\xff\xff1", "b\xff", "b2", "b1"}, iterate(opt, "c"))
+		require.Equal(t, []string{"b2", "b1"}, iterate(opt, "b2"))
+		require.Empty(t, iterate(opt, "a"))
+
+		opt.UpperBound = []byte("b2")
+		require.Equal(t, []string{"b1"}, iterate(opt, ""))
+
+		opt.UpperBound = nil
+		opt.Prefix = []byte("\xff")
+		require.Equal(t, []string{"\xff\xff1"}, iterate(opt, ""))
+	})
+}
+
+func TestIterateKeyFilter(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 100; i++ {
+				if err := txn.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("val")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		// Overwrite a key, so that it has more than one version.
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("key017"), []byte("new"))
+		}))
+
+		for _, allVersions := range []bool{false, true} {
+			var filtered int
+			opt := DefaultIteratorOptions
+			opt.AllVersions = allVersions
+			opt.KeyFilter = func(key []byte) bool {
+				filtered++
+				return bytes.HasSuffix(key, []byte("7"))
+			}
+			var keys []string
+			require.NoError(t, db.View(func(txn *Txn) error {
+				itr := txn.NewIterator(opt)
+				defer itr.Close()
+				for itr.Rewind(); itr.Valid(); itr.Next() {
+					keys = append(keys, string(itr.Item().Key()))
+				}
+				return nil
+			}))
+			require.Equal(t, 101, filtered)
+			if allVersions {
+				require.Len(t, keys, 11)
+			} else {
+				require.Len(t, keys, 10)
+			}
+			require.Equal(t, "key007", keys[0])
+		}
+	})
+}
+
+func TestIterateUserMeta(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		const marker = 0x01
+		set := func(key string, userMeta byte) {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.SetEntry(NewEntry([]byte(key), []byte("val")).WithMeta(userMeta))
+			}))
+		}
+		set("a", 0x10)
+		set("b", marker|0x10)
+		set("c", marker)
+		// The latest version of a key decides whether it matches.
+		set("d", 0)
+		set("d", marker)
+		set("e", marker)
+		set("e", 0)
+
+		iterate := func(opt IteratorOptions) []string {
+			var keys []string
+			require.NoError(t, db.View(func(txn *Txn) error {
+				itr := txn.NewIterator(opt)
+				defer itr.Close()
+				for itr.Rewind(); itr.Valid(); itr.Next() {
+					keys = append(keys, string(itr.Item().Key()))
+				}
+				return nil
+			}))
+			return keys
+		}
+
+		opt := DefaultIteratorOptions
+		opt.UserMetaMask = marker
+		require.Equal(t, []string{"a", "e"}, iterate(opt))
+		opt.Reverse = true
+		require.Equal(t, []string{"e", "a"}, iterate(opt))
+
+		opt = DefaultIteratorOptions
+		opt.UserMetaMask = marker
+		opt.UserMetaValue = marker
+		require.Equal(t, []string{"b", "c", "d"}, iterate(opt))
+		opt.AllVersions = true
+		require.Equal(t, []string{"b", "c", "d", "e"}, iterate(opt))
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			n, err := txn.CountKeys(nil, opt)
+			require.NoError(t, err)
+			require.Equal(t, 4, n)
+			return nil
+		}))
+	})
+}
+
+func TestIteratorSeekForPrev(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for _, k := range []string{"10", "20", "30", "40"} {
+				if err := txn.Set([]byte(k), []byte("val")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Delete([]byte("30"))
+		}))
+
+		seek := func(reverse bool, key string) []string {
+			opt := DefaultIteratorOptions
+			opt.Reverse = reverse
+			var keys []string
+			require.NoError(t, db.View(func(txn *Txn) error {
+				itr := txn.NewIterator(opt)
+				defer itr.Close()
+				for itr.SeekForPrev([]byte(key)); itr.Valid(); itr.Next() {
+					keys = append(keys, string(itr.Item().Key()))
+				}
+				return nil
+			}))
+			return keys
+		}
+
+		require.Equal(t, []string{"20", "40"}, seek(false, "20"))
+		require.Equal(t, []string{"20", "40"}, seek(false, "25"))
+		require.Equal(t, []string{"20", "40"}, seek(false, "35"))
+		require.Equal(t, []string{"40"}, seek(false, "50"))
+		require.Empty(t, seek(false, "05"))
+
+		require.Equal(t, []string{"20", "10"}, seek(true, "20"))
+		require.Equal(t, []string{"40", "20", "10"}, seek(true, "25"))
+		require.Equal(t, []string{"10"}, seek(true, "05"))
+		require.Empty(t, seek(true, "50"))
+	})
+}
+
+func TestIterateSample(t *testing.T) {
+	opt := getTestOptions("")
+	opt.MemTableSize = 1 << 20
+	opt.ValueThreshold = 1 << 10
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		n := 50000
+		wb := db.NewWriteBatch()
+		for i := 0; i < n; i++ {
+			require.NoError(t, wb.Set([]byte(fmt.Sprintf("key%06d", i)), []byte("val")))
+		}
+		require.NoError(t, wb.Flush())
+
+		iopt := DefaultIteratorOptions
+		iopt.Sample = 10
+		var count int
+		require.NoError(t, db.View(func(txn *Txn) error {
+			itr := txn.NewIterator(iopt)
+			defer itr.Close()
+			for itr.Rewind(); itr.Valid(); itr.Next() {
+				count++
+			}
+			return nil
+		}))
+		require.Greater(t, count, 0)
+		require.Less(t, count, n/2)
+	})
+}
+
+func TestIterateAdaptivePrefetch(t *testing.T) {
+	opt := getTestOptions("")
+	opt.ValueThreshold = 32
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		n := 1000
+		val := func(i int) []byte {
+			// Every other value goes to the value log.
+			if i%2 == 0 {
+				return []byte(fmt.Sprintf("%064d", i))
+			}
+			return []byte(fmt.Sprintf("%d", i))
+		}
+		wb := db.NewWriteBatch()
+		for i := 0; i < n; i++ {
+			require.NoError(t, wb.Set([]byte(fmt.Sprintf("key%06d", i)), val(i)))
+		}
+		require.NoError(t, wb.Flush())
+
+		for _, reverse := range []bool{false, true} {
+			iopt := DefaultIteratorOptions
+			iopt.AdaptivePrefetch = true
+			iopt.Reverse = reverse
+			require.NoError(t, db.View(func(txn *Txn) error {
+				itr := txn.NewIterator(iopt)
+				defer itr.Close()
+				var count int
+				for itr.Rewind(); itr.Valid(); itr.Next() {
+					if count == 0 {
+						// Only a couple of KV pairs are fetched to start with.
+						require.Equal(t, 2, itr.window)
+						require.Equal(t, 1, itr.data.n)
+					}
+					require.LessOrEqual(t, itr.window, iopt.PrefetchSize)
+					require.LessOrEqual(t, itr.data.n, iopt.PrefetchSize)
+					i := count
+					if reverse {
+						i = n - 1 - count
+					}
+					require.Equal(t, []byte(fmt.Sprintf("key%06d", i)), itr.Item().Key())
+					require.Equal(t, val(i), getItemValue(t, itr.Item()))
+					count++
+				}
+				require.Equal(t, n, count)
+				return nil
+			}))
+		}
+	})
+}
+
+func TestIteratorStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+	opt.ValueThreshold = 32
+	opt.Compression = options.ZSTD
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%06d", i)) }
+	n := 1000
+	wb := db.NewWriteBatch()
+	// Only the even keys are written, the odd ones are looked up below.
+	for i := 0; i < 2*n; i += 2 {
+		require.NoError(t, wb.Set(key(i), []byte(fmt.Sprintf("%064d", i))))
+	}
+	require.NoError(t, wb.Flush())
+	// Reopen the DB, so that the keys are in the SSTables.
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+
+	iterate := func(iopt IteratorOptions) IteratorStats {
+		var stats IteratorStats
+		require.NoError(t, db.View(func(txn *Txn) error {
+			itr := txn.NewIterator(iopt)
+			for itr.Rewind(); itr.Valid(); itr.Next() {
+				getItemValue(t, itr.Item())
+			}
+			itr.Close()
+			stats = itr.Stats()
+			return nil
+		}))
+		return stats
+	}
+	stats := iterate(DefaultIteratorOptions)
+	require.Equal(t, uint64(n), stats.ValueLogReads)
+	require.Greater(t, stats.TablesTouched, uint64(0))
+	require.Greater(t, stats.BlocksRead, uint64(0))
+	require.LessOrEqual(t, stats.BlockCacheHits, stats.BlocksRead)
+	require.Greater(t, stats.BytesDecompressed, uint64(0))
+	require.Zero(t, stats.BloomFilterNegatives)
+
+	var negatives uint64
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 1; i < 200; i += 2 {
+			itr := txn.NewKeyIterator(key(i), DefaultIteratorOptions)
+			itr.Rewind()
+			require.False(t, itr.Valid())
+			negatives += itr.Stats().BloomFilterNegatives
+			itr.Close()
+		}
+		return nil
+	}))
+	require.Greater(t, negatives, uint64(0))
+}
+
+func TestIteratorDetached(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		set := func(val string) {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				for i := 0; i < 10; i++ {
+					if err := txn.Set([]byte(fmt.Sprintf("key%d", i)), []byte(val)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+		set("old")
+
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+		iopt := DefaultIteratorOptions
+		iopt.Detached = true
+		itr := txn.NewIterator(iopt)
+		defer itr.Close()
+
+		// The txn doesn't hold back the cleanup of the versions anymore, nor can it read.
+		set("new")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		require.NoError(t, db.orc.readMark.WaitForMark(ctx, txn.readTs))
+		_, err := txn.Get([]byte("key0"))
+		require.Equal(t, ErrReadTsReleased, err)
+		require.Panics(t, func() { txn.NewIterator(DefaultIteratorOptions) })
+
+		var count int
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			require.Equal(t, []byte("old"), getItemValue(t, itr.Item()))
+			count++
+		}
+		require.Equal(t, 10, count)
+
+		update := db.NewTransaction(true)
+		defer update.Discard()
+		require.Panics(t, func() { update.NewIterator(iopt) })
+	})
+}
+
+func TestTxnCountKeys(t *testing.T) {
+	opt := getTestOptions("")
+	opt.NumVersionsToKeep = 10
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		for round := 0; round < 2; round++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				for i := 0; i < 100; i++ {
+					if err := txn.Set([]byte(fmt.Sprintf("a%03d", i)), []byte("val")); err != nil {
+						return err
+					}
+					if err := txn.Set([]byte(fmt.Sprintf("b%03d", i)), []byte("val")); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Delete([]byte("a050"))
+		}))
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.NoError(t, txn.Set([]byte("a100"), []byte("val")))
+
+		count := func(prefix string, opt IteratorOptions) int {
+			n, err := txn.CountKeys([]byte(prefix), opt)
+			require.NoError(t, err)
+			return n
+		}
+		require.Equal(t, 100, count("a", DefaultIteratorOptions))
+		require.Equal(t, 200, count("", DefaultIteratorOptions))
+		require.Equal(t, 10, count("b01", DefaultIteratorOptions))
+
+		allVersions := DefaultIteratorOptions
+		allVersions.AllVersions = true
+		// Two versions of each key, one more for the deletion and one for the pending write.
+		require.Equal(t, 202, count("a", allVersions))
+	})
+}
+
 func TestIterateSinceTs(t *testing.T) {
 	bkey := func(i int) []byte {
 		return []byte(fmt.Sprintf("%04d", i))
@@ -415,3 +881,40 @@ func BenchmarkIteratePrefixSingleKey(b *testing.B) {
 		}
 	})
 }
+
+func TestIteratorOnlyPendingWrites(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txnSet(t, db, []byte("a"), []byte("committed"), 0)
+		txnSet(t, db, []byte("b"), []byte("committed"), 0)
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+
+		keys := func(opt IteratorOptions) []string {
+			opt.OnlyPendingWrites = true
+			it := txn.NewIterator(opt)
+			defer it.Close()
+			var keys []string
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+				if item.IsDeletedOrExpired() {
+					keys = append(keys, "-"+string(item.Key()))
+					continue
+				}
+				keys = append(keys, string(item.Key())+"="+string(getItemValue(t, item)))
+			}
+			return keys
+		}
+		require.Empty(t, keys(DefaultIteratorOptions))
+
+		require.NoError(t, txn.Set([]byte("c"), []byte("pending")))
+		require.NoError(t, txn.Delete([]byte("a")))
+		require.Equal(t, []string{"c=pending"}, keys(DefaultIteratorOptions))
+
+		opt := DefaultIteratorOptions
+		opt.AllVersions = true
+		require.Equal(t, []string{"-a", "c=pending"}, keys(opt))
+		opt.Reverse = true
+		require.Equal(t, []string{"c=pending", "-a"}, keys(opt))
+	})
+}
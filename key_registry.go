@@ -310,6 +310,17 @@ func (kr *KeyRegistry) DataKey(id uint64) (*pb.DataKey, error) {
 	return dk, nil
 }
 
+// latestKeyID returns the ID of the latest data key generated, without generating a new one if
+// it's due. It's 0 if encryption is disabled.
+func (kr *KeyRegistry) latestKeyID() uint64 {
+	if len(kr.opt.EncryptionKey) == 0 {
+		return 0
+	}
+	kr.RLock()
+	defer kr.RUnlock()
+	return kr.nextKeyID
+}
+
 // LatestDataKey will give you the latest generated datakey based on the rotation
 // period. If the last generated datakey lifetime exceeds the rotation period.
 // It'll create new datakey.
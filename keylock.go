@@ -0,0 +1,140 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"sync"
+)
+
+// keyLocks holds the keys locked via Txn.Lock.
+type keyLocks struct {
+	sync.Mutex
+	// keys maps every locked key to a channel, which is closed once the key is unlocked.
+	keys map[string]chan struct{}
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{keys: make(map[string]chan struct{})}
+}
+
+// lock blocks until key is locked, or ctx is done.
+func (kl *keyLocks) lock(ctx context.Context, key string) error {
+	for {
+		kl.Lock()
+		unlocked, ok := kl.keys[key]
+		if !ok {
+			kl.keys[key] = make(chan struct{})
+			kl.Unlock()
+			return nil
+		}
+		kl.Unlock()
+
+		select {
+		case <-unlocked:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (kl *keyLocks) unlock(key string) {
+	kl.Lock()
+	unlocked := kl.keys[key]
+	delete(kl.keys, key)
+	kl.Unlock()
+	close(unlocked)
+}
+
+// Lock locks key for the transaction, blocking until no other transaction holds the lock for it.
+// The lock is held until the transaction is committed or discarded. See LockWithContext.
+func (txn *Txn) Lock(key []byte) error {
+	return txn.LockWithContext(context.Background(), key)
+}
+
+// LockWithContext is like Lock, but gives up waiting for the lock once ctx is done, returning
+// ctx.Err().
+//
+// Locking provides a pessimistic alternative to conflict detection for highly contended keys.
+// Once the lock is acquired, Get reads the latest committed version of key, instead of the one at
+// the read timestamp of the transaction, and the key is no longer checked for conflicts on commit.
+// So, all the transactions writing key must lock it, or their writes may be lost. Reading key
+// before locking it still makes the commit fail with ErrConflict if key has changed since. Keys
+// locked by different transactions in different orders can deadlock, which a context with a
+// deadline can guard against.
+//
+// Locking cannot be used with read-only transactions or in managed mode.
+func (txn *Txn) LockWithContext(ctx context.Context, key []byte) error {
+	switch {
+	case !txn.update:
+		return ErrReadOnlyTxn
+	case txn.discarded:
+		return ErrDiscardedTxn
+	case txn.db.opt.managedTxns:
+		return ErrManagedTxn
+	case len(key) == 0:
+		return ErrEmptyKey
+	}
+	if _, ok := txn.locks[string(key)]; ok {
+		return nil
+	}
+	if err := txn.db.keyLocks.lock(ctx, string(key)); err != nil {
+		return err
+	}
+	if txn.locks == nil {
+		txn.locks = make(map[string]struct{})
+	}
+	txn.locks[string(key)] = struct{}{}
+
+	// The previous holder of the lock is done committing by now. Read the locked keys at a
+	// timestamp past its commit. oracle.readTs pins the timestamp until the locks are released.
+	ts := txn.db.orc.readTs()
+	if txn.lockTs > 0 {
+		txn.db.orc.readMark.Done(txn.lockTs)
+	}
+	txn.lockTs = ts
+	return nil
+}
+
+func (txn *Txn) isLocked(key []byte) bool {
+	_, ok := txn.locks[string(key)]
+	return ok
+}
+
+// readTsFor returns the timestamp key should be read at by the transaction.
+func (txn *Txn) readTsFor(key []byte) uint64 {
+	if txn.lockTs > txn.readTs && txn.isLocked(key) {
+		return txn.lockTs
+	}
+	return txn.readTs
+}
+
+// takeLocks returns a function releasing the locks held by the transaction, or nil if it holds
+// none.
+func (txn *Txn) takeLocks() func() {
+	if len(txn.locks) == 0 {
+		return nil
+	}
+	locks, lockTs := txn.locks, txn.lockTs
+	txn.locks, txn.lockTs = nil, 0
+	return func() {
+		for key := range locks {
+			txn.db.keyLocks.unlock(key)
+		}
+		txn.db.orc.readMark.Done(lockTs)
+	}
+}
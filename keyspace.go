@@ -0,0 +1,246 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/options"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+// KeyspaceOptions are the options which apply to all the keys of a Keyspace.
+type KeyspaceOptions struct {
+	// DefaultTTL is applied to every entry written to the keyspace which doesn't have an expiry
+	// set already. Zero means entries don't expire by default.
+	DefaultTTL time.Duration
+	// ValueThreshold overrides Options.ValueThreshold for the entries of the keyspace. Zero means
+	// the DB wide value threshold is used.
+	ValueThreshold int64
+	// Compression overrides Options.Compression for the tables holding the keys of the keyspace,
+	// if OverrideCompression is set, with ZSTDCompressionLevel overriding
+	// Options.ZSTDCompressionLevel unless it's zero. The compactions split the tables at the
+	// boundaries of the keyspaces with their own compression, while the tables written by the
+	// memtable flushes to level 0 hold all the keys, and use Options.Compression. Compression
+	// requires Options.BlockCacheSize to be set.
+	Compression          options.CompressionType
+	ZSTDCompressionLevel int
+	OverrideCompression  bool
+}
+
+// tableCompression is the compression of the blocks of a table.
+type tableCompression struct {
+	ctype options.CompressionType
+	level int
+}
+
+// keyspaceCompressions holds the compression of the keyspaces which override Options.Compression,
+// by keyspace prefix.
+type keyspaceCompressions struct {
+	sync.RWMutex
+	m map[string]tableCompression
+}
+
+// tableCompression returns the compression of the tables holding key, which depends on its
+// keyspace.
+func (db *DB) tableCompression(key []byte) tableCompression {
+	tc := tableCompression{ctype: db.opt.Compression, level: db.opt.ZSTDCompressionLevel}
+	kc := &db.keyspaceCompressions
+	kc.RLock()
+	defer kc.RUnlock()
+	if len(kc.m) == 0 {
+		return tc
+	}
+	key = y.ParseKey(key)
+	if i := bytes.IndexByte(key, 0); i >= 0 {
+		if c, ok := kc.m[string(key[:i+1])]; ok {
+			return c
+		}
+	}
+	return tc
+}
+
+// Keyspace is a named set of keys, isolated from the keys of all other keyspaces. Internally, all
+// the keys of a keyspace share a prefix derived from its name, which is hidden from the user: Items
+// returned by Get and by iterators created via NewIterator carry the key without the prefix.
+//
+// A Keyspace does not hold any resources and it is safe to create multiple Keyspace values with
+// the same name.
+type Keyspace struct {
+	db     *DB
+	name   string
+	prefix []byte
+	opt    KeyspaceOptions
+}
+
+// Keyspace returns the keyspace with the given name, using the default KeyspaceOptions. The name
+// must be non-empty and must not contain a zero byte.
+func (db *DB) Keyspace(name string) (*Keyspace, error) {
+	return db.KeyspaceWithOptions(name, KeyspaceOptions{})
+}
+
+// KeyspaceWithOptions is like Keyspace, but applies the given options to the keyspace. Options are
+// not persisted, so the same options should be passed every time the keyspace is used. The
+// compression is set DB wide for the keyspace, by the last call overriding it, until the DB is
+// closed.
+func (db *DB) KeyspaceWithOptions(name string, opt KeyspaceOptions) (*Keyspace, error) {
+	prefix := []byte(name)
+	switch {
+	case len(name) == 0:
+		return nil, errors.New("Keyspace name cannot be empty")
+	case bytes.IndexByte(prefix, 0) >= 0:
+		return nil, errors.Errorf("Keyspace name %q cannot contain a zero byte", name)
+	case bytes.HasPrefix(prefix, badgerPrefix):
+		return nil, ErrInvalidKey
+	case opt.ValueThreshold < 0 || opt.ValueThreshold > maxValueThreshold:
+		return nil, errors.Errorf("Invalid keyspace ValueThreshold, must be in range [0, %d]",
+			maxValueThreshold)
+	case opt.OverrideCompression && opt.Compression > options.ZSTD:
+		return nil, errors.Errorf("Invalid keyspace Compression %d", opt.Compression)
+	case opt.OverrideCompression && opt.Compression != options.None && db.blockCache == nil:
+		return nil, errors.Errorf("Keyspace Compression requires BlockCacheSize to be set")
+	}
+	ks := &Keyspace{
+		db: db,
+		// The zero byte terminates the name, so that no keyspace prefix is a prefix of another.
+		prefix: append(prefix, 0),
+		name:   name,
+		opt:    opt,
+	}
+	if opt.OverrideCompression {
+		tc := tableCompression{ctype: opt.Compression, level: opt.ZSTDCompressionLevel}
+		if tc.level == 0 {
+			tc.level = db.opt.ZSTDCompressionLevel
+		}
+		kc := &db.keyspaceCompressions
+		kc.Lock()
+		if kc.m == nil {
+			kc.m = make(map[string]tableCompression)
+		}
+		kc.m[string(ks.prefix)] = tc
+		kc.Unlock()
+	}
+	return ks, nil
+}
+
+// Name returns the name of the keyspace.
+func (ks *Keyspace) Name() string {
+	return ks.name
+}
+
+// Prefix returns the prefix shared by all the keys of the keyspace, as stored in the DB.
+func (ks *Keyspace) Prefix() []byte {
+	return y.SafeCopy(nil, ks.prefix)
+}
+
+func (ks *Keyspace) key(key []byte) []byte {
+	out := make([]byte, 0, len(ks.prefix)+len(key))
+	out = append(out, ks.prefix...)
+	return append(out, key...)
+}
+
+// Get is the equivalent of Txn.Get for the given key within the keyspace.
+func (ks *Keyspace) Get(txn *Txn, key []byte) (*Item, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	item, err := txn.Get(ks.key(key))
+	if err != nil {
+		return nil, err
+	}
+	item.prefixLen = len(ks.prefix)
+	return item, nil
+}
+
+// Set is the equivalent of Txn.Set for the given key within the keyspace.
+func (ks *Keyspace) Set(txn *Txn, key, val []byte) error {
+	return ks.SetEntry(txn, NewEntry(key, val))
+}
+
+// SetEntry is the equivalent of Txn.SetEntry for the given entry within the keyspace. The
+// keyspace options are applied to a copy of the entry; e itself is not modified.
+func (ks *Keyspace) SetEntry(txn *Txn, e *Entry) error {
+	if len(e.Key) == 0 {
+		return ErrEmptyKey
+	}
+	ne := *e
+	ne.Key = ks.key(e.Key)
+	if ne.ExpiresAt == 0 && ks.opt.DefaultTTL > 0 && ne.meta&bitDelete == 0 {
+		ne.WithTTL(ks.opt.DefaultTTL)
+	}
+	if ks.opt.ValueThreshold > 0 {
+		ne.valThreshold = ne.location.threshold(ks.opt.ValueThreshold)
+	}
+	return txn.SetEntry(&ne)
+}
+
+// Delete is the equivalent of Txn.Delete for the given key within the keyspace.
+func (ks *Keyspace) Delete(txn *Txn, key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	return txn.Delete(ks.key(key))
+}
+
+// NewIterator is the equivalent of Txn.NewIterator, iterating only over the keys of the keyspace.
+// opt.Prefix, opt.LowerBound and opt.UpperBound, if set, and the keys passed to Iterator.Seek are
+// relative to the keyspace.
+func (ks *Keyspace) NewIterator(txn *Txn, opt IteratorOptions) *Iterator {
+	opt.Prefix = ks.key(opt.Prefix)
+	if len(opt.LowerBound) > 0 {
+		opt.LowerBound = ks.key(opt.LowerBound)
+	}
+	if len(opt.UpperBound) > 0 {
+		opt.UpperBound = ks.key(opt.UpperBound)
+	}
+	itr := txn.NewIterator(opt)
+	itr.ksPrefix = ks.prefix
+	return itr
+}
+
+// DropAll drops all the keys of the keyspace. See DB.DropPrefix.
+func (ks *Keyspace) DropAll() error {
+	return ks.db.DropPrefix(ks.prefix)
+}
+
+// NewStream is the equivalent of DB.NewStream, streaming only the keys of the keyspace. Keys sent
+// by the stream carry the keyspace prefix, so they can be written to another DB as is.
+func (ks *Keyspace) NewStream() *Stream {
+	stream := ks.db.NewStream()
+	stream.Prefix = ks.Prefix()
+	return stream
+}
+
+// NewStreamAt is the equivalent of DB.NewStreamAt, streaming only the keys of the keyspace.
+func (ks *Keyspace) NewStreamAt(readTs uint64) *Stream {
+	stream := ks.db.NewStreamAt(readTs)
+	stream.Prefix = ks.Prefix()
+	return stream
+}
+
+// Backup is the equivalent of DB.Backup, dumping only the keys of the keyspace. The backup can be
+// restored via DB.Load, which restores the keys into the same keyspace.
+func (ks *Keyspace) Backup(w io.Writer, since uint64) (uint64, error) {
+	stream := ks.NewStream()
+	stream.LogPrefix = "Keyspace.Backup " + ks.name
+	stream.SinceTs = since
+	return stream.Backup(w, since)
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/options"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyspace(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		blocks, err := db.Keyspace("blocks")
+		require.NoError(t, err)
+		txs, err := db.KeyspaceWithOptions("txs", KeyspaceOptions{DefaultTTL: time.Hour})
+		require.NoError(t, err)
+
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 10; i++ {
+				key := []byte(fmt.Sprintf("key%d", i))
+				require.NoError(t, blocks.Set(txn, key, []byte("block")))
+				require.NoError(t, txs.Set(txn, key, []byte("tx")))
+				require.NoError(t, txn.Set(key, []byte("plain")))
+			}
+			return nil
+		}))
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := blocks.Get(txn, []byte("key1"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("key1"), item.Key())
+			require.Equal(t, []byte("block"), getItemValue(t, item))
+			require.Zero(t, item.ExpiresAt())
+
+			item, err = txs.Get(txn, []byte("key1"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("tx"), getItemValue(t, item))
+			require.NotZero(t, item.ExpiresAt())
+
+			itr := blocks.NewIterator(txn, DefaultIteratorOptions)
+			defer itr.Close()
+			var count int
+			for itr.Rewind(); itr.Valid(); itr.Next() {
+				require.True(t, bytes.HasPrefix(itr.Item().Key(), []byte("key")))
+				require.Equal(t, []byte("block"), getItemValue(t, itr.Item()))
+				count++
+			}
+			require.Equal(t, 10, count)
+
+			itr.Seek([]byte("key5"))
+			require.True(t, itr.Valid())
+			require.Equal(t, []byte("key5"), itr.Item().Key())
+			return nil
+		}))
+
+		require.NoError(t, blocks.DropAll())
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := blocks.Get(txn, []byte("key1"))
+			require.Equal(t, ErrKeyNotFound, err)
+			_, err = txs.Get(txn, []byte("key1"))
+			require.NoError(t, err)
+			_, err = txn.Get([]byte("key1"))
+			require.NoError(t, err)
+			return nil
+		}))
+
+		_, err = db.Keyspace("")
+		require.Error(t, err)
+		_, err = db.Keyspace("a\x00b")
+		require.Error(t, err)
+	})
+}
+
+func TestKeyspaceCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithCompression(options.Snappy)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	_, err = db.KeyspaceWithOptions("bad", KeyspaceOptions{
+		Compression: options.ZSTD + 1, OverrideCompression: true})
+	require.Error(t, err)
+
+	keyspaces := func(db *DB) map[string]*Keyspace {
+		ks := make(map[string]*Keyspace)
+		for name, c := range map[string]options.CompressionType{
+			"raw": options.None, "zstd": options.ZSTD, "plain": options.Snappy} {
+			var err error
+			ks[name], err = db.KeyspaceWithOptions(name, KeyspaceOptions{
+				Compression: c, OverrideCompression: name != "plain"})
+			require.NoError(t, err)
+		}
+		return ks
+	}
+	ks := keyspaces(db)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for _, k := range ks {
+			for i := 0; i < 100; i++ {
+				require.NoError(t, k.Set(txn, []byte(fmt.Sprintf("key%d", i)), []byte(k.Name())))
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	// The memtable is flushed to a single table at level 0, which the compaction splits.
+	db, err = Open(opt)
+	require.NoError(t, err)
+	keyspaces(db)
+	require.NoError(t, db.CompactLevel(0))
+	want := map[string]options.CompressionType{
+		"raw": options.None, "zstd": options.ZSTD, "plain": options.Snappy}
+	var tables int
+	for _, lh := range db.lc.levels[1:] {
+		lh.RLock()
+		for _, tbl := range lh.tables {
+			name := string(y.ParseKey(tbl.Smallest())[:bytes.IndexByte(tbl.Smallest(), 0)])
+			require.Equal(t, want[name], tbl.CompressionType(), name)
+			require.Equal(t, name, string(y.ParseKey(tbl.Biggest())[:len(name)]))
+			tables++
+		}
+		lh.RUnlock()
+	}
+	require.Equal(t, 3, tables)
+	require.NoError(t, db.Close())
+
+	// The tables keep their compression once the keyspaces aren't registered anymore.
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for name := range want {
+			k, err := db.Keyspace(name)
+			require.NoError(t, err)
+			item, err := k.Get(txn, []byte("key42"))
+			require.NoError(t, err)
+			require.Equal(t, []byte(name), getItemValue(t, item))
+		}
+		return nil
+	}))
+}
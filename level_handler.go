@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/dgraph-io/badger/v3/table"
 	"github.com/dgraph-io/badger/v3/y"
@@ -283,6 +284,7 @@ func (s *levelHandler) get(key []byte) (y.ValueStruct, error) {
 	for _, th := range tables {
 		if th.DoesNotHave(hash) {
 			y.NumLSMBloomHitsAdd(s.db.opt.MetricsEnabled, s.strLevel, 1)
+			atomic.AddInt64(&s.db.metrics.bloomHits, 1)
 			continue
 		}
 
@@ -290,6 +292,7 @@ func (s *levelHandler) get(key []byte) (y.ValueStruct, error) {
 		defer it.Close()
 
 		y.NumLSMGetsAdd(s.db.opt.MetricsEnabled, s.strLevel, 1)
+		atomic.AddInt64(&s.db.metrics.lsmGets, 1)
 		it.Seek(key)
 		if !it.Valid() {
 			continue
@@ -324,14 +327,32 @@ func (s *levelHandler) iterators(opt *IteratorOptions) []y.Iterator {
 				out = append(out, t)
 			}
 		}
-		return iteratorsReversed(out, topt)
+		itrs := iteratorsReversed(out, topt)
+		if opt.Sample > 1 {
+			for _, itr := range itrs {
+				itr.(*table.Iterator).SetSample(opt.Sample)
+			}
+		}
+		if opt.stats != nil {
+			for _, itr := range itrs {
+				itr.(*table.Iterator).SetStats(&opt.stats.IteratorStats)
+			}
+		}
+		return itrs
 	}
 
 	tables := opt.pickTables(s.tables)
 	if len(tables) == 0 {
 		return nil
 	}
-	return []y.Iterator{table.NewConcatIterator(tables, topt)}
+	itr := table.NewConcatIterator(tables, topt)
+	if opt.Sample > 1 {
+		itr.SetSample(opt.Sample)
+	}
+	if opt.stats != nil {
+		itr.SetStats(&opt.stats.IteratorStats)
+	}
+	return []y.Iterator{itr}
 }
 
 func (s *levelHandler) getTables(opt *IteratorOptions) []*table.Table {
@@ -76,7 +76,7 @@ func revertToManifest(kv *DB, mf *Manifest, idMap map[uint64]struct{}) error {
 	return nil
 }
 
-func newLevelsController(db *DB, mf *Manifest) (*levelsController, error) {
+func newLevelsController(ctx context.Context, db *DB, mf *Manifest) (*levelsController, error) {
 	y.AssertTrue(db.opt.NumLevelZeroTablesStall > db.opt.NumLevelZeroTables)
 	s := &levelsController{
 		kv:     db,
@@ -120,6 +120,12 @@ func newLevelsController(db *DB, mf *Manifest) (*levelsController, error) {
 				len(mf.Tables), time.Since(start).Round(time.Millisecond))
 		default:
 		}
+		if err := ctx.Err(); err != nil {
+			// Wait for the tables being opened, so that they can be closed.
+			_ = throttle.Finish()
+			closeAllTables(tables)
+			return nil, err
+		}
 		if err := throttle.Do(); err != nil {
 			closeAllTables(tables)
 			return nil, err
@@ -274,8 +280,8 @@ func (s *levelsController) dropPrefixes(prefixes [][]byte) error {
 	for i := len(s.levels) - 1; i >= 0; i-- {
 		l := s.levels[i]
 
-		l.RLock()
 		if l.level == 0 {
+			l.RLock()
 			size := len(l.tables)
 			l.RUnlock()
 
@@ -295,61 +301,114 @@ func (s *levelsController) dropPrefixes(prefixes [][]byte) error {
 			continue
 		}
 
-		// Build a list of compaction tableGroups affecting all the prefixes we
-		// need to drop. We need to build tableGroups that satisfy the invariant that
-		// bottom tables are consecutive.
-		// tableGroup contains groups of consecutive tables.
-		var tableGroups [][]*table.Table
-		var tableGroup []*table.Table
-
-		finishGroup := func() {
-			if len(tableGroup) > 0 {
-				tableGroups = append(tableGroups, tableGroup)
-				tableGroup = nil
-			}
+		if err := s.compactPrefixesAtLevel(l, prefixes, prefixes); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		for _, table := range l.tables {
-			if containsAnyPrefixes(table, prefixes) {
-				tableGroup = append(tableGroup, table)
-			} else {
-				finishGroup()
-			}
+// compactPrefixesAtLevel runs same level compactions on the tables of level l which could contain
+// any of the given prefixes, dropping the keys with dropPrefixes.
+func (s *levelsController) compactPrefixesAtLevel(
+	l *levelHandler, prefixes, dropPrefixes [][]byte) error {
+	opt := s.kv.opt
+
+	// Build a list of compaction tableGroups affecting all the prefixes we
+	// need to drop. We need to build tableGroups that satisfy the invariant that
+	// bottom tables are consecutive.
+	// tableGroup contains groups of consecutive tables.
+	var tableGroups [][]*table.Table
+	var tableGroup []*table.Table
+
+	finishGroup := func() {
+		if len(tableGroup) > 0 {
+			tableGroups = append(tableGroups, tableGroup)
+			tableGroup = nil
 		}
-		finishGroup()
+	}
 
-		l.RUnlock()
+	l.RLock()
+	for _, table := range l.tables {
+		if containsAnyPrefixes(table, prefixes) {
+			tableGroup = append(tableGroup, table)
+		} else {
+			finishGroup()
+		}
+	}
+	finishGroup()
+	l.RUnlock()
 
-		if len(tableGroups) == 0 {
-			continue
+	if len(tableGroups) == 0 {
+		return nil
+	}
+	_, span := otrace.StartSpan(context.Background(), "Badger.Compaction")
+	span.Annotatef(nil, "Compaction level: %v", l.level)
+	span.Annotatef(nil, "Drop Prefixes: %v", dropPrefixes)
+	defer span.End()
+	opt.Infof("Compacting prefixes at level %d (%d tableGroups)", l.level, len(tableGroups))
+	for _, operation := range tableGroups {
+		cd := compactDef{
+			span:         span,
+			thisLevel:    l,
+			nextLevel:    l,
+			top:          nil,
+			bot:          operation,
+			dropPrefixes: dropPrefixes,
+			t:            s.levelTargets(),
+		}
+		cd.t.baseLevel = l.level
+		if err := s.runCompactDef(-1, l.level, cd); err != nil {
+			opt.Warningf("While running compact def: %+v. Error: %v", cd, err)
+			return err
 		}
-		_, span := otrace.StartSpan(context.Background(), "Badger.Compaction")
-		span.Annotatef(nil, "Compaction level: %v", l.level)
-		span.Annotatef(nil, "Drop Prefixes: %v", prefixes)
-		defer span.End()
-		opt.Infof("Dropping prefix at level %d (%d tableGroups)", l.level, len(tableGroups))
-		for _, operation := range tableGroups {
-			cd := compactDef{
-				span:         span,
-				thisLevel:    l,
-				nextLevel:    l,
-				top:          nil,
-				bot:          operation,
-				dropPrefixes: prefixes,
-				t:            s.levelTargets(),
-			}
-			cd.t.baseLevel = l.level
-			if err := s.runCompactDef(-1, l.level, cd); err != nil {
-				opt.Warningf("While running compact def: %+v. Error: %v", cd, err)
-				return err
+	}
+	return nil
+}
+
+// reclaimPrefixes rewrites all the tables which could contain any of the given prefixes, so that
+// the versions hidden via DB.DropPrefixAsync are left out by the compactions. It expects the
+// compactions to be stopped, and the memtables holding the hidden versions to be flushed.
+func (s *levelsController) reclaimPrefixes(prefixes [][]byte) error {
+	// Move the L0 tables which could contain the prefixes to Lbase. The tables added to L0 from
+	// now on only contain newer versions.
+	l0 := s.levels[0]
+	pending := make(map[uint64]struct{})
+	l0.RLock()
+	for _, t := range l0.tables {
+		if containsAnyPrefixes(t, prefixes) {
+			pending[t.ID()] = struct{}{}
+		}
+	}
+	l0.RUnlock()
+	hasPending := func() bool {
+		l0.RLock()
+		defer l0.RUnlock()
+		for _, t := range l0.tables {
+			if _, ok := pending[t.ID()]; ok {
+				return true
 			}
 		}
+		return false
+	}
+	for hasPending() {
+		// L0->Lbase compactions pick the oldest tables first, so every round makes progress.
+		cp := compactionPriority{level: 0, score: 1.73}
+		if err := s.doCompact(173, cp); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range s.levels[1:] {
+		if err := s.compactPrefixesAtLevel(l, prefixes, nil); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (s *levelsController) startCompact(lc *z.Closer) {
-	n := s.kv.opt.NumCompactors
+// startCompact starts n compactors, which run until lc is signalled.
+func (s *levelsController) startCompact(lc *z.Closer, n int) {
 	lc.AddRunning(n - 1)
 	for i := 0; i < n; i++ {
 		go s.runCompactor(i, lc)
@@ -463,14 +522,21 @@ func (s *levelsController) runCompactor(id int, lc *z.Closer) {
 	}
 
 	run := func(p compactionPriority) bool {
+		// Don't compact while the compactions are paused via DB.PauseCompactions.
+		if !s.kv.compactionGate.enter() {
+			return false
+		}
 		err := s.doCompact(id, p)
+		s.kv.compactionGate.leave()
 		switch err {
 		case nil:
 			return true
 		case errFillTables:
 			// pass
 		default:
-			s.kv.opt.Warningf("While running doCompact: %v\n", err)
+			if errors.Cause(err) != errCompactionAborted {
+				s.kv.opt.Warningf("While running doCompact: %v\n", err)
+			}
 		}
 		return false
 	}
@@ -529,6 +595,27 @@ type compactionPriority struct {
 	adjusted     float64
 	dropPrefixes [][]byte
 	t            targets
+	// stats, if set, accumulates the amount of data compacted.
+	stats *compactionStats
+}
+
+// compactionStats accumulates the number of tables and bytes compacted. Fields must be accessed
+// atomically, as multiple compactions can update them concurrently.
+type compactionStats struct {
+	tables int64
+	bytes  int64
+}
+
+func (cs *compactionStats) add(cd *compactDef) {
+	var sz int64
+	for _, t := range cd.top {
+		sz += t.Size()
+	}
+	for _, t := range cd.bot {
+		sz += t.Size()
+	}
+	atomic.AddInt64(&cs.tables, int64(len(cd.top)+len(cd.bot)))
+	atomic.AddInt64(&cs.bytes, sz)
 }
 
 func (s *levelsController) lastLevel() *levelHandler {
@@ -678,20 +765,50 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 		// Denotes if the first key is a series of duplicate keys had
 		// "DiscardEarlierVersions" set
 		firstKeyHasDiscardSet bool
+		// merge collapses the merge operands of the keys with a registered merge function.
+		merge compactionMerge
+		// tc is the compression of the table being built, which depends on the keyspace of its keys.
+		tc tableCompression
 	)
 
 	addKeys := func(builder *table.Builder) {
 		timeStart := time.Now()
 		var numKeys, numSkips uint64
 		var rangeCheck int
+		// Size of the entries read since the last wait on the background limiter.
+		var numRead int64
 		var tableKr keyRange
+		addMerged := func(base *y.ValueStruct, isFinal bool) {
+			key, vs := merge.finish(base, isFinal)
+			builder.Add(key, vs, 0)
+			numKeys++
+		}
 		for ; it.Valid(); it.Next() {
+			if s.kv.compactionsAborted() {
+				break
+			}
+			rvs := it.Value()
+			if numRead += int64(len(it.Key())) + int64(rvs.EncodedSize()); numRead >= 1<<20 {
+				s.kv.backgroundLimiter.wait(numRead)
+				numRead = 0
+			}
+			// Add the merged operands of the previous key.
+			if merge.active() && !y.SameKey(it.Key(), merge.key) {
+				addMerged(nil, !hasOverlap)
+			}
+
 			// See if we need to skip the prefix.
 			if len(cd.dropPrefixes) > 0 && hasAnyPrefixes(it.Key(), cd.dropPrefixes) {
 				numSkips++
 				updateStats(it.Value())
 				continue
 			}
+			// Skip the versions hidden by DropPrefixAsync.
+			if s.kv.prefixDrops.covers(y.ParseKey(it.Key()), y.ParseTs(it.Key())) {
+				numSkips++
+				updateStats(it.Value())
+				continue
+			}
 
 			// See if we need to skip this key.
 			if len(skipKey) > 0 {
@@ -715,6 +832,10 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 					// not divided across multiple tables at the same level.
 					break
 				}
+				// The keyspaces with their own compression get their own tables.
+				if s.kv.tableCompression(it.Key()) != tc {
+					break
+				}
 				lastKey = y.SafeCopy(lastKey, it.Key())
 				numVersions = 0
 				firstKeyHasDiscardSet = it.Value().Meta&BitDiscardEarlierVersions > 0
@@ -743,6 +864,42 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 
 			isExpired := isDeletedOrExpired(vs.Meta, vs.ExpiresAt)
 
+			// Collapse the merge operands which are visible to all the transactions. The operands
+			// are merged into the value they are written on top of, if it is stored in the LSM
+			// tree. Otherwise, they are collapsed into a single operand.
+			if mf := s.kv.mergeFunc(y.ParseKey(it.Key())); mf != nil && version <= discardTs {
+				isInline := vs.Meta&bitValuePointer == 0
+				switch {
+				case isInline && !isExpired && vs.Meta&bitMergeEntry > 0:
+					merge.add(mf.Merge, it.Key(), vs)
+					numSkips++
+					continue
+				case !merge.active():
+				case isInline && !isExpired:
+					// The operands have been merged into this value, so it replaces the value and
+					// all the older versions.
+					addMerged(&vs, true)
+					skipKey = y.SafeCopy(skipKey, it.Key())
+					numSkips++
+					continue
+				default:
+					// The operands are written on top of a deletion, so the older versions don't
+					// matter.
+					addMerged(nil, isExpired)
+				}
+			}
+
+			// Let the compaction filter drop or rewrite the versions visible to all the
+			// transactions. A dropped version turns into a deletion marker.
+			if s.kv.opt.CompactionFilter != nil && version <= discardTs && !isExpired &&
+				vs.Meta&bitMergeEntry == 0 && !bytes.HasPrefix(it.Key(), badgerPrefix) {
+				if fvs, changed := s.filterEntry(it.Key(), vs); changed {
+					updateStats(vs)
+					vs = fvs
+					isExpired = isDeletedOrExpired(vs.Meta, vs.ExpiresAt)
+				}
+			}
+
 			// Do not discard entries inserted by merge operator. These entries will be
 			// discarded once they're merged
 			if version <= discardTs && vs.Meta&bitMergeEntry == 0 {
@@ -776,6 +933,7 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 						// If no overlap, we can skip all the versions, by continuing here.
 						numSkips++
 						updateStats(vs)
+						s.kv.notifyExpired(y.ParseKey(it.Key()), vs)
 						continue // Skip adding this key.
 					}
 				}
@@ -799,6 +957,10 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 				builder.Add(it.Key(), vs, vp.Len)
 			}
 		}
+		if merge.active() {
+			addMerged(nil, !hasOverlap)
+		}
+		s.kv.backgroundLimiter.wait(numRead)
 		s.kv.opt.Debugf("[%d] LOG Compact. Added %d keys. Skipped %d keys. Iteration took: %v",
 			cd.compactorId, numKeys, numSkips, time.Since(timeStart).Round(time.Millisecond))
 	} // End of function: addKeys
@@ -812,10 +974,15 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 		if len(kr.right) > 0 && y.CompareKeys(it.Key(), kr.right) >= 0 {
 			break
 		}
+		if s.kv.compactionsAborted() {
+			break
+		}
 
 		bopts := buildTableOptions(s.kv)
 		// Set TableSize to the target file size for that level.
 		bopts.TableSize = uint64(cd.t.fileSz[cd.nextLevel.level])
+		tc = s.kv.tableCompression(it.Key())
+		bopts.Compression, bopts.ZSTDCompressionLevel = tc.ctype, tc.level
 		builder := table.NewTableBuilder(bopts)
 
 		// This would do the iteration and add keys to builder.
@@ -851,6 +1018,8 @@ func (s *levelsController) subcompact(it y.Iterator, kr keyRange, cd compactDef,
 			if err != nil {
 				return
 			}
+			s.kv.backgroundLimiter.waitAtMost(tbl.Size(),
+				atomic.LoadInt64(&s.kv.compactionThroughput))
 			res <- tbl
 		}(builder, s.reserveFileID())
 	}
@@ -868,6 +1037,8 @@ func (s *levelsController) compactBuildTables(
 	numTables := int64(len(topTables) + len(botTables))
 	y.NumCompactionTablesAdd(s.kv.opt.MetricsEnabled, numTables)
 	defer y.NumCompactionTablesAdd(s.kv.opt.MetricsEnabled, -numTables)
+	atomic.AddInt64(&s.kv.metrics.compactionTables, numTables)
+	defer atomic.AddInt64(&s.kv.metrics.compactionTables, -numTables)
 
 	cd.span.Annotatef(nil, "Top tables count: %v Bottom tables count: %v",
 		len(topTables), len(botTables))
@@ -897,9 +1068,11 @@ func (s *levelsController) compactBuildTables(
 		switch {
 		case lev == 0:
 			iters = append(iters, iteratorsReversed(topTables, table.NOCACHE)...)
-		case len(topTables) > 0:
-			y.AssertTrue(len(topTables) == 1)
+		case len(topTables) == 1:
 			iters = []y.Iterator{topTables[0].NewIterator(table.NOCACHE)}
+		case len(topTables) > 1:
+			// Only the manual compactions pick several tables of a level, which don't overlap.
+			iters = []y.Iterator{table.NewConcatIterator(topTables, table.NOCACHE)}
 		}
 		// Next level has level>=1 and we can use ConcatIterator as key ranges do not overlap.
 		return append(iters, table.NewConcatIterator(valid, table.NOCACHE))
@@ -914,10 +1087,15 @@ func (s *levelsController) compactBuildTables(
 			return nil, nil, err
 		}
 		go func(kr keyRange) {
-			defer inflightBuilders.Done(nil)
+			var err error
+			defer func() { inflightBuilders.Done(err) }()
 			it := table.NewMergeIterator(newIterator(), false)
 			defer it.Close()
 			s.subcompact(it, kr, cd, inflightBuilders, res)
+			if s.kv.compactionsAborted() {
+				// The subcompaction might have stopped early, so the built tables are incomplete.
+				err = errCompactionAborted
+			}
 		}(kr)
 	}
 
@@ -1455,6 +1633,12 @@ func (s *levelsController) runCompactDef(id, l int, cd compactDef) (err error) {
 	if err := thisLevel.deleteTables(cd.top); err != nil {
 		return err
 	}
+	// The tables referencing the blobs released by the compaction are gone.
+	if !s.kv.opt.InMemory {
+		if _, err := s.kv.vlog.collectBlobs(false); err != nil && err != ErrRejected {
+			s.kv.opt.Warningf("While deleting blob files after compaction: %v", err)
+		}
+	}
 
 	// Note: For level 0, while doCompact is running, it is possible that new tables are added.
 	// However, the tables are added only to the end, so it is ok to just delete the first table.
@@ -1493,6 +1677,9 @@ func tablesToString(tables []*table.Table) []string {
 
 var errFillTables = errors.New("Unable to fill tables")
 
+// errCompactionAborted is returned by the compactions abandoned by DB.CloseWithContext.
+var errCompactionAborted = errors.New("Compaction aborted")
+
 // doCompact picks some table on level l and compacts it away to the next level.
 func (s *levelsController) doCompact(id int, p compactionPriority) error {
 	l := p.level
@@ -1539,10 +1726,135 @@ func (s *levelsController) doCompact(id int, p compactionPriority) error {
 		return err
 	}
 
+	if p.stats != nil {
+		p.stats.add(&cd)
+	}
 	s.kv.opt.Debugf("[Compactor: %d] Compaction for level: %d DONE", id, cd.thisLevel.level)
 	return nil
 }
 
+// compactTables compacts the given tables of level l into the next level, or within l if it is the
+// last level. L0 tables are compacted into the base level, along with all the L0 tables older than
+// them, so the newer versions of the keys are never placed below the older ones.
+func (s *levelsController) compactTables(l int, top []*table.Table) error {
+	y.AssertTrue(len(top) > 0)
+	t := s.levelTargets()
+	cd := compactDef{
+		compactorId: 175,
+		p:           compactionPriority{level: l, score: 1.72, t: t},
+		t:           t,
+		thisLevel:   s.levels[l],
+		nextLevel:   s.levels[l],
+	}
+	switch {
+	case l == 0:
+		cd.nextLevel = s.levels[t.baseLevel]
+	case !cd.thisLevel.isLastLevel():
+		cd.nextLevel = s.levels[l+1]
+	}
+
+	cd.lockLevels()
+	if l == 0 {
+		ids := make(map[uint64]struct{}, len(top))
+		for _, tbl := range top {
+			ids[tbl.ID()] = struct{}{}
+		}
+		// The L0 tables are ordered from the oldest to the newest.
+		var last int
+		for i, tbl := range cd.thisLevel.tables {
+			if _, ok := ids[tbl.ID()]; ok {
+				last = i + 1
+			}
+		}
+		top = append([]*table.Table{}, cd.thisLevel.tables[:last]...)
+	}
+	cd.top = top
+	cd.thisRange = getKeyRange(top...)
+	for _, tbl := range top {
+		cd.thisSize += tbl.Size()
+	}
+	cd.bot = []*table.Table{}
+	cd.nextRange = cd.thisRange
+	if cd.nextLevel != cd.thisLevel {
+		left, right := cd.nextLevel.overlappingTables(levelHandlerRLocked{}, cd.thisRange)
+		cd.bot = append(cd.bot, cd.nextLevel.tables[left:right]...)
+		if len(cd.bot) > 0 {
+			cd.nextRange = getKeyRange(cd.bot...)
+		}
+	}
+	ok := s.cstatus.compareAndAdd(thisAndNextLevelRLocked{}, cd)
+	cd.unlockLevels()
+	if !ok {
+		return errors.Wrapf(errFillTables, "tables of level %d are being compacted", l)
+	}
+	defer s.cstatus.delete(cd)
+
+	_, span := otrace.StartSpan(context.Background(), "Badger.Compaction")
+	defer span.End()
+	cd.span = span
+	return s.runCompactDef(cd.compactorId, l, cd)
+}
+
+// ingestTables adds the given tables, which must not overlap with each other, to the lowest level
+// whose tables and running compactions, and those of all the levels above it, don't overlap with
+// them. The tables are added to L0 if no such level exists. It returns the level picked.
+func (s *levelsController) ingestTables(tables []*table.Table) (int, error) {
+	kr := getKeyRange(tables...)
+
+	// Hold the compaction status lock, so no compaction can pick up an overlapping key range
+	// while the tables are being added.
+	s.cstatus.Lock()
+	defer s.cstatus.Unlock()
+
+	overlaps := func(level int) bool {
+		if s.cstatus.levels[level].overlapsWith(kr) {
+			return true
+		}
+		lh := s.levels[level]
+		lh.RLock()
+		defer lh.RUnlock()
+		if level == 0 {
+			// L0 tables are not sorted by key, so we can't binary search them.
+			for _, t := range lh.tables {
+				if kr.overlapsWith(getKeyRange(t)) {
+					return true
+				}
+			}
+			return false
+		}
+		left, right := lh.overlappingTables(levelHandlerRLocked{}, kr)
+		return right > left
+	}
+
+	level := 0
+	if !overlaps(0) {
+		for i := 1; i < len(s.levels); i++ {
+			if overlaps(i) {
+				break
+			}
+			level = i
+		}
+	}
+
+	var changes []*pb.ManifestChange
+	for _, t := range tables {
+		changes = append(changes, newCreateChange(t.ID(), level, t.KeyID(), t.CompressionType()))
+	}
+	if err := s.kv.manifest.addChanges(changes); err != nil {
+		return 0, err
+	}
+
+	lh := s.levels[level]
+	if level == 0 {
+		// L0 tables are kept in the order of their creation, and not sorted by key.
+		for _, t := range tables {
+			lh.addTable(t)
+		}
+		return level, nil
+	}
+	return level, lh.replaceTables(nil, tables)
+}
+
 func (s *levelsController) addLevel0Table(t *table.Table) error {
 	// Add table to manifest file only if it is not opened in memory. We don't want to add a table
 	// to the manifest file if it exists only in memory.
@@ -1652,19 +1964,35 @@ type TableInfo struct {
 	Level            int
 	Left             []byte
 	Right            []byte
-	KeyCount         uint32 // Number of keys in the table
+	KeyCount         uint32 // Number of keys in the table, counting every version of a key.
 	OnDiskSize       uint32
 	StaleDataSize    uint32
 	UncompressedSize uint32
 	MaxVersion       uint64
 	IndexSz          int
 	BloomFilterSize  int
+	CreatedAt        time.Time
+	CompressionRatio float64 // UncompressedSize / OnDiskSize.
+	InCompaction     bool    // Whether the table is being compacted.
+}
+
+// compactingTables returns the IDs of the tables being compacted.
+func (s *levelsController) compactingTables() map[uint64]struct{} {
+	s.cstatus.RLock()
+	defer s.cstatus.RUnlock()
+	ids := make(map[uint64]struct{}, len(s.cstatus.tables))
+	for id := range s.cstatus.tables {
+		ids[id] = struct{}{}
+	}
+	return ids
 }
 
 func (s *levelsController) getTableInfo() (result []TableInfo) {
+	compacting := s.compactingTables()
 	for _, l := range s.levels {
 		l.RLock()
 		for _, t := range l.tables {
+			_, inCompaction := compacting[t.ID()]
 			info := TableInfo{
 				ID:               t.ID(),
 				Level:            l.level,
@@ -1677,6 +2005,11 @@ func (s *levelsController) getTableInfo() (result []TableInfo) {
 				BloomFilterSize:  t.BloomFilterSize(),
 				UncompressedSize: t.UncompressedSize(),
 				MaxVersion:       t.MaxVersion(),
+				CreatedAt:        t.CreatedAt,
+				InCompaction:     inCompaction,
+			}
+			if info.OnDiskSize > 0 {
+				info.CompressionRatio = float64(info.UncompressedSize) / float64(info.OnDiskSize)
 			}
 			result = append(result, info)
 		}
@@ -1701,11 +2034,14 @@ type LevelInfo struct {
 	Score          float64
 	Adjusted       float64
 	StaleDatSize   int64
+	// NumTablesInCompaction is the number of tables of the level being compacted.
+	NumTablesInCompaction int
 }
 
 func (s *levelsController) getLevelInfo() []LevelInfo {
 	t := s.levelTargets()
 	prios := s.pickCompactLevels()
+	compacting := s.compactingTables()
 	result := make([]LevelInfo, len(s.levels))
 	for i, l := range s.levels {
 		l.RLock()
@@ -1713,6 +2049,11 @@ func (s *levelsController) getLevelInfo() []LevelInfo {
 		result[i].Size = l.totalSize
 		result[i].NumTables = len(l.tables)
 		result[i].StaleDatSize = l.totalStaleSize
+		for _, tbl := range l.tables {
+			if _, ok := compacting[tbl.ID()]; ok {
+				result[i].NumTablesInCompaction++
+			}
+		}
 
 		l.RUnlock()
 
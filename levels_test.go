@@ -17,6 +17,7 @@
 package badger
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math"
@@ -30,6 +31,7 @@ import (
 	"github.com/dgraph-io/badger/v3/pb"
 	"github.com/dgraph-io/badger/v3/table"
 	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -1069,6 +1071,57 @@ func TestKeyVersions(t *testing.T) {
 	})
 }
 
+func TestRanges(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		l0 := make([]keyValVersion, 0)
+		for i := 0; i < 10000; i++ {
+			l0 = append(l0, keyValVersion{fmt.Sprintf("%05d", i), "foo", 1, 0})
+		}
+		createAndOpen(db, l0, 0)
+
+		ranges := db.Ranges(nil, 4)
+		require.Greater(t, len(ranges), 1)
+		require.Nil(t, ranges[0].Left)
+		require.Nil(t, ranges[len(ranges)-1].Right)
+		var total int64
+		for i, r := range ranges {
+			if i > 0 {
+				// The ranges are contiguous.
+				require.Equal(t, ranges[i-1].Right, r.Left)
+			}
+			total += r.EstimatedSize
+		}
+		require.Greater(t, total, int64(0))
+	})
+}
+
+func TestTableInfo(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		l0 := make([]keyValVersion, 0)
+		for i := 0; i < 100; i++ {
+			l0 = append(l0, keyValVersion{fmt.Sprintf("%05d", i), "foo", 1, 0})
+		}
+		createAndOpen(db, l0, 0)
+
+		tables := db.Tables()
+		require.Len(t, tables, 1)
+		require.Equal(t, uint32(100), tables[0].KeyCount)
+		require.False(t, tables[0].CreatedAt.IsZero())
+		require.Greater(t, tables[0].CompressionRatio, float64(0))
+		require.False(t, tables[0].InCompaction)
+
+		// The table is marked as being compacted while it's part of a compaction.
+		db.lc.cstatus.Lock()
+		db.lc.cstatus.tables[tables[0].ID] = struct{}{}
+		db.lc.cstatus.Unlock()
+		require.True(t, db.Tables()[0].InCompaction)
+		require.Equal(t, 1, db.Levels()[0].NumTablesInCompaction)
+		db.lc.cstatus.Lock()
+		delete(db.lc.cstatus.tables, tables[0].ID)
+		db.lc.cstatus.Unlock()
+	})
+}
+
 func TestSameLevel(t *testing.T) {
 	opt := DefaultOptions("")
 	opt.NumCompactors = 0
@@ -1320,3 +1373,115 @@ func TestStreamWithFullCopy(t *testing.T) {
 		})
 	})
 }
+
+func TestFlattenWithContext(t *testing.T) {
+	// Only Flatten compacts the tables.
+	opt := DefaultOptions("").WithNumCompactors(0)
+	setup := func(db *DB) {
+		createAndOpen(db, []keyValVersion{{"foo", "bar", 3, 0}}, 1)
+		createAndOpen(db, []keyValVersion{{"fooz", "baz", 2, 0}}, 2)
+		createAndOpen(db, []keyValVersion{{"fooz", "bar", 1, 0}}, 3)
+		// Account for the sizes of the tables, which Flatten picks the levels by.
+		for _, lh := range db.lc.levels {
+			lh.initTables(lh.tables)
+		}
+	}
+	t.Run("progress", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			setup(db)
+			var last FlattenProgress
+			calls := 0
+			err := db.FlattenWithContext(context.Background(), FlattenOptions{
+				NumWorkers: 1,
+				Progress: func(p FlattenProgress) {
+					calls++
+					require.GreaterOrEqual(t, p.TablesCompacted, last.TablesCompacted)
+					last = p
+				},
+			})
+			require.NoError(t, err)
+			require.NotZero(t, calls)
+			require.GreaterOrEqual(t, last.TablesCompacted, int64(3))
+			require.NotZero(t, last.BytesCompacted)
+			require.Zero(t, db.lc.levels[1].getTotalSize())
+		})
+	})
+	t.Run("cancelled", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			setup(db)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := db.FlattenWithContext(ctx, FlattenOptions{NumWorkers: 1})
+			require.Equal(t, context.Canceled, err)
+			require.NotZero(t, db.lc.levels[1].getTotalSize())
+		})
+	})
+	t.Run("pause and resume", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			setup(db)
+			db.PauseFlatten()
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			err := db.FlattenWithContext(ctx, FlattenOptions{NumWorkers: 1})
+			require.Equal(t, context.DeadlineExceeded, err)
+			require.NotZero(t, db.lc.levels[1].getTotalSize())
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- db.Flatten(1)
+			}()
+			time.Sleep(100 * time.Millisecond)
+			db.ResumeFlatten()
+			require.NoError(t, <-errCh)
+			require.Zero(t, db.lc.levels[1].getTotalSize())
+		})
+	})
+}
+
+func TestCompactLevelAndTables(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	// Disable the discarding of the older versions, and read all the versions of the tables.
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		createAndOpen(db, []keyValVersion{{"foo", "bar", 3, 0}}, 6)
+		createAndOpen(db, []keyValVersion{{"foo", "baz", 4, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"fooz", "baz", 5, 0}}, 0)
+		expected := []keyValVersion{
+			{"foo", "baz", 4, 0}, {"foo", "bar", 3, 0}, {"fooz", "baz", 5, 0},
+		}
+		l0 := db.lc.levels[0]
+		older, newer := l0.tables[0].ID(), l0.tables[1].ID()
+		last := db.lc.levels[6].tables[0].ID()
+
+		err := db.CompactTables([]uint64{older, last})
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+		err = db.CompactTables([]uint64{12345})
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+		err = db.CompactLevel(7)
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+
+		// The newer L0 table stays on L0.
+		require.NoError(t, db.CompactTables([]uint64{older}))
+		require.Equal(t, 1, l0.numTables())
+		require.Equal(t, newer, l0.tables[0].ID())
+		getAllAndCheck(t, db, expected)
+
+		require.NoError(t, db.CompactLevel(0))
+		require.Equal(t, 0, l0.numTables())
+		getAllAndCheck(t, db, expected)
+
+		// The last level is rewritten in place.
+		require.NoError(t, db.CompactLevel(6))
+		require.Equal(t, 0, l0.numTables())
+		require.NotZero(t, db.lc.levels[6].numTables())
+		getAllAndCheck(t, db, expected)
+
+		// Compacting an empty level is a no-op.
+		require.NoError(t, db.CompactLevel(0))
+
+		require.NoError(t, db.Freeze())
+		err = db.CompactLevel(6)
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+		db.Thaw()
+	})
+}
@@ -0,0 +1,406 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/options"
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+// LogArchiveFilename is the name of the manifest of a log archive directory.
+const LogArchiveFilename = "ARCHIVE.json"
+
+// LogArchive records the value log files archived to Options.LogArchiveDir, in the order they
+// were archived. It's written as JSON after each file.
+type LogArchive struct {
+	Segments []LogArchiveSegment
+}
+
+// LogArchiveSegment describes an archived value log file.
+type LogArchiveSegment struct {
+	// File is the name of the segment file, in the archive directory. It's a copy of the value log
+	// file Fid.
+	File       string
+	Fid        uint32
+	MinVersion uint64
+	MaxVersion uint64
+	Size       int64
+	// Checksum is the hex-encoded SHA-256 checksum of the file.
+	Checksum  string
+	CreatedAt time.Time
+}
+
+// ReadLogArchive reads the manifest of the log archive in dir. It returns an empty archive if
+// there's none yet.
+func ReadLogArchive(dir string) (*LogArchive, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, LogArchiveFilename))
+	if os.IsNotExist(err) {
+		return &LogArchive{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	a := &LogArchive{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, errors.Wrapf(err, "while reading the log archive in %s", dir)
+	}
+	return a, nil
+}
+
+// logArchiver copies the value log files to Options.LogArchiveDir once they're rotated. The files
+// waiting to be archived are kept from being deleted, like by an iterator.
+type logArchiver struct {
+	sync.Mutex
+	db      *DB
+	pending []uint32
+	notify  chan struct{}
+	// err is the first archiving which failed for good. It's returned by DB.Close.
+	err error
+}
+
+// newLogArchiver returns the archiver of db, with the value log files which aren't in the archive
+// yet, except the one being written, pending. It must be called once the value log is opened.
+func newLogArchiver(db *DB) (*logArchiver, error) {
+	a, err := ReadLogArchive(db.opt.LogArchiveDir)
+	if err != nil {
+		return nil, err
+	}
+	archived := make(map[uint32]struct{})
+	for _, s := range a.Segments {
+		archived[s.Fid] = struct{}{}
+	}
+	la := &logArchiver{db: db, notify: make(chan struct{}, 1)}
+	db.vlog.filesLock.RLock()
+	for _, fid := range db.vlog.sortedFids() {
+		if _, ok := archived[fid]; !ok && fid != db.vlog.maxFid {
+			la.add(fid)
+		}
+	}
+	db.vlog.filesLock.RUnlock()
+	return la, nil
+}
+
+// add queues the value log file fid to be archived. It's called when the file is rotated.
+func (la *logArchiver) add(fid uint32) {
+	la.db.vlog.incrIteratorCount()
+	la.Lock()
+	la.pending = append(la.pending, fid)
+	la.Unlock()
+	select {
+	case la.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run archives the pending files until lc is signaled. A failed archiving is retried every second
+// until then. The files left are archived once the DB is opened again.
+func (la *logArchiver) run(lc *z.Closer) {
+	defer lc.Done()
+	for {
+		la.Lock()
+		pending := la.pending
+		la.pending = nil
+		la.Unlock()
+		for _, fid := range pending {
+			la.archive(lc, fid)
+		}
+		select {
+		case <-la.notify:
+		case <-lc.HasBeenClosed():
+			la.Lock()
+			n := len(la.pending)
+			la.Unlock()
+			if n == 0 {
+				return
+			}
+		}
+	}
+}
+
+func (la *logArchiver) archive(lc *z.Closer, fid uint32) {
+	defer func() {
+		if err := la.db.vlog.decrIteratorCount(); err != nil {
+			la.db.opt.Errorf("while deleting value log files after archiving: %v", err)
+		}
+	}()
+	for {
+		err := la.db.archiveLogFile(fid)
+		if err == nil {
+			return
+		}
+		la.db.opt.Errorf("Failure while archiving value log file %d: %v", fid, err)
+		select {
+		case <-lc.HasBeenClosed():
+			if la.err == nil {
+				la.err = y.Wrapf(err, "while archiving value log file %d", fid)
+			}
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// archiveLogFile copies the value log file fid to a new segment of the log archive, along with
+// snapshots of the key registry, which holds the data keys the segments are encrypted with, and of
+// the MANIFEST.
+func (db *DB) archiveLogFile(fid uint32) error {
+	db.vlog.filesLock.RLock()
+	lf, ok := db.vlog.filesMap[fid]
+	db.vlog.filesLock.RUnlock()
+	if !ok {
+		// The file was dropped, by DB.DropAll.
+		return nil
+	}
+	dir := db.opt.LogArchiveDir
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	seg := LogArchiveSegment{
+		Fid:       fid,
+		CreatedAt: time.Now().UTC(),
+	}
+	a, err := ReadLogArchive(dir)
+	if err != nil {
+		return err
+	}
+	// The fids start over after DB.DropAll, so the segments are numbered on their own.
+	seg.File = fmt.Sprintf("%08d.vlog", len(a.Segments)+1)
+	path := filepath.Join(dir, seg.File)
+	// Remove the segment of an archiving that failed before the manifest was written.
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := removeHoles(path); err != nil {
+		return err
+	}
+
+	lf.lock.RLock()
+	err = db.archiveLogFileLocked(lf, path, &seg)
+	lf.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	if err := db.snapshotKeyRegistry(dir); err != nil {
+		return err
+	}
+	if err := db.snapshotManifest(dir); err != nil {
+		return err
+	}
+	a.Segments = append(a.Segments, seg)
+	return writeJSONFile(dir, LogArchiveFilename, a)
+}
+
+// archiveLogFileLocked copies lf to path, and sets the size, the checksum and the version range of
+// seg. It must be called with the read lock of lf held.
+func (db *DB) archiveLogFileLocked(lf *logFile, path string, seg *LogArchiveSegment) error {
+	seg.MinVersion = math.MaxUint64
+	_, err := lf.iterate(true, 0, func(e Entry, _ valuePointer) error {
+		if bytes.HasPrefix(e.Key, badgerPrefix) {
+			return nil
+		}
+		version := y.ParseTs(e.Key)
+		if version < seg.MinVersion {
+			seg.MinVersion = version
+		}
+		if version > seg.MaxVersion {
+			seg.MaxVersion = version
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if seg.MinVersion > seg.MaxVersion {
+		// The file only holds internal keys.
+		seg.MinVersion = 0
+	}
+	data := lf.Data[:lf.size]
+	seg.Size, seg.Checksum, err = writeBackupFile(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil || len(lf.holes) == 0 {
+		return err
+	}
+	// The holes punched by the GC read as zeros, and must be skipped when the segment is replayed.
+	return writeHoles(path, lf.holes)
+}
+
+// snapshotKeyRegistry writes a copy of the key registry of the DB to dir.
+func (db *DB) snapshotKeyRegistry(dir string) error {
+	db.registry.RLock()
+	defer db.registry.RUnlock()
+	return WriteKeyRegistry(db.registry, KeyRegistryOptions{
+		Dir:           dir,
+		EncryptionKey: db.opt.EncryptionKey,
+	})
+}
+
+// snapshotManifest writes a copy of the MANIFEST of the DB to dir.
+func (db *DB) snapshotManifest(dir string) error {
+	db.manifest.appendLock.Lock()
+	m := db.manifest.manifest.clone()
+	db.manifest.appendLock.Unlock()
+	fp, _, err := helpRewrite(dir, &m, db.opt.ExternalMagicVersion)
+	if err != nil {
+		return err
+	}
+	return fp.Close()
+}
+
+// LoadLogArchive replays the segments of the log archive in dir which hold versions at or above
+// sinceTs, like LoadWithOptions does for a backup. It's used to restore the writes made after a
+// full backup, by passing the version returned by DB.Backup plus one as sinceTs. The sizes and
+// checksums of the segments are verified before anything is loaded. The segments are decrypted
+// with the key registry of the archive, which is opened with opt.EncryptionKey, or else with
+// Options.EncryptionKey. The archive doesn't hold the keys of the tenants: the values encrypted
+// with them are loaded as is, and can be read if the DB has the keys, while the values of the
+// tenants erased since are left out.
+func (db *DB) LoadLogArchive(dir string, sinceTs uint64, maxPendingWrites int,
+	opt LoadOptions) error {
+
+	a, err := ReadLogArchive(dir)
+	if err != nil {
+		return err
+	}
+	var segs []LogArchiveSegment
+	for _, s := range a.Segments {
+		if s.MaxVersion < sinceTs || (opt.UntilTs > 0 && s.MinVersion > opt.UntilTs) {
+			continue
+		}
+		if err := verifyBackupFile(dir, s.File, s.Size, s.Checksum); err != nil {
+			return err
+		}
+		segs = append(segs, s)
+	}
+	if len(segs) == 0 {
+		return nil
+	}
+
+	key := opt.EncryptionKey
+	if len(key) == 0 {
+		key = db.opt.EncryptionKey
+	}
+	kr, err := OpenKeyRegistry(KeyRegistryOptions{Dir: dir, ReadOnly: true, EncryptionKey: key})
+	if err != nil {
+		return y.Wrapf(err, "while opening the key registry of the log archive in %s", dir)
+	}
+	defer kr.Close()
+	for _, s := range segs {
+		if err := db.loadLogSegment(dir, s, kr, sinceTs, maxPendingWrites, opt); err != nil {
+			return errors.Wrapf(err, "while loading log segment %s", s.File)
+		}
+	}
+	return nil
+}
+
+// loadLogSegment loads the versions at or above sinceTs of the segment s.
+func (db *DB) loadLogSegment(dir string, s LogArchiveSegment, kr *KeyRegistry, sinceTs uint64,
+	maxPendingWrites int, opt LoadOptions) error {
+
+	path := filepath.Join(dir, s.File)
+	lf := &logFile{fid: s.Fid, path: path, registry: kr, opt: db.opt}
+	if err := lf.open(path, os.O_RDONLY, 0); err != nil {
+		return err
+	}
+	defer lf.Close(-1)
+	var err error
+	if lf.holes, err = readHoles(path); err != nil {
+		return err
+	}
+
+	// The segment is streamed to the load in the backup format.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeLogSegment(pw, lf, sinceTs, db.tenants))
+	}()
+	err = db.LoadWithOptions(pr, maxPendingWrites, opt)
+	// Unblock the writer if the load failed.
+	pr.CloseWithError(err)
+	return err
+}
+
+// writeLogSegment writes the entries of lf with versions at or above sinceTs to w, in the backup
+// format. The versions of each key are sorted from the latest in each list, as in a backup. The
+// values encrypted with the key of their tenant are left out if tenants doesn't have the key, as
+// the tenant has been erased.
+func writeLogSegment(w io.Writer, lf *logFile, sinceTs uint64, tenants *tenantKeys) error {
+	bw, err := newBackupWriter(w, options.None, 0, nil, false, false)
+	if err != nil {
+		return err
+	}
+	list := &pb.KVList{}
+	var sz int
+	flush := func() error {
+		if len(list.Kv) == 0 {
+			return nil
+		}
+		sort.SliceStable(list.Kv, func(i, j int) bool {
+			a, b := list.Kv[i], list.Kv[j]
+			if c := bytes.Compare(a.Key, b.Key); c != 0 {
+				return c < 0
+			}
+			return a.Version > b.Version
+		})
+		err := bw.writeList(list)
+		list.Kv, sz = list.Kv[:0], 0
+		return err
+	}
+
+	_, err = lf.iterate(true, 0, func(e Entry, _ valuePointer) error {
+		version := y.ParseTs(e.Key)
+		if bytes.HasPrefix(e.Key, badgerPrefix) || version < sinceTs {
+			return nil
+		}
+		if e.meta&bitTenantKey > 0 && !tenants.known(e.Value) {
+			return nil
+		}
+		list.Kv = append(list.Kv, &pb.KV{
+			Key:       y.SafeCopy(nil, y.ParseKey(e.Key)),
+			Value:     y.SafeCopy(nil, e.Value),
+			UserMeta:  joinUserMeta(e.UserMeta, e.UserMetaExt),
+			Version:   version,
+			ExpiresAt: e.ExpiresAt,
+			Meta:      []byte{e.meta &^ (bitValuePointer | bitTxn | bitFinTxn)},
+		})
+		if sz += len(e.Key) + len(e.Value); sz >= 4<<20 {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return bw.Close()
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogArchive(t *testing.T) {
+	test := func(t *testing.T, opt Options) {
+		archiveDir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(archiveDir)
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+
+		// The value log files are rotated every few transactions.
+		opt = opt.WithDir(dir).WithValueDir(dir).WithLogArchiveDir(archiveDir).
+			WithValueThreshold(1 << 10).WithValueLogMaxEntries(8)
+		bigVal := bytes.Repeat([]byte("v"), 2<<10)
+		var bb bytes.Buffer
+		db, err := Open(opt)
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%02d", i)), []byte("a"), 0)
+		}
+		since, err := db.Backup(&bb, 0)
+		require.NoError(t, err)
+		for i := 10; i < 20; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%02d", i)), bigVal, 0)
+		}
+		txnDelete(t, db, []byte("key00"))
+		require.NoError(t, db.Close())
+
+		// The file being written is archived once the DB is reopened.
+		a, err := ReadLogArchive(archiveDir)
+		require.NoError(t, err)
+		n := len(a.Segments)
+		require.Greater(t, n, 1)
+		db, err = Open(opt)
+		require.NoError(t, err)
+		require.NoError(t, db.Close())
+		a, err = ReadLogArchive(archiveDir)
+		require.NoError(t, err)
+		require.Len(t, a.Segments, n+1)
+		require.Greater(t, a.Segments[n].MaxVersion, since)
+
+		opt = getTestOptions("").WithEncryptionKey(opt.EncryptionKey).
+			WithIndexCacheSize(opt.IndexCacheSize)
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			require.NoError(t, db.Load(&bb, 16))
+			require.NoError(t, db.LoadLogArchive(archiveDir, since+1, 16, LoadOptions{}))
+			require.NoError(t, db.View(func(txn *Txn) error {
+				_, err := txn.Get([]byte("key00"))
+				require.Equal(t, ErrKeyNotFound, err)
+				for i := 1; i < 20; i++ {
+					item, err := txn.Get([]byte(fmt.Sprintf("key%02d", i)))
+					require.NoError(t, err)
+					val, err := item.ValueCopy(nil)
+					require.NoError(t, err)
+					if i < 10 {
+						require.Equal(t, []byte("a"), val)
+					} else {
+						require.Equal(t, bigVal, val)
+					}
+				}
+				return nil
+			}))
+		})
+	}
+	t.Run("plain", func(t *testing.T) {
+		test(t, getTestOptions(""))
+	})
+	t.Run("encrypted", func(t *testing.T) {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		require.NoError(t, err)
+		test(t, getTestOptions("").WithEncryptionKey(key).WithIndexCacheSize(1<<20))
+	})
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"hash/crc32"
+
+	"github.com/dgraph-io/badger/v3/y"
+)
+
+// logSalvage is what salvageTail found past the end of the valid entries of a log file.
+type logSalvage struct {
+	// lost are the regions of the file which don't hold valid entries, in order. The last one may
+	// be past the last entry salvaged, if the file ends with a torn write.
+	lost []vlogHole
+	// entries is the number of entries salvaged.
+	entries int
+	// dropped is the number of valid entries left out, as they were part of a transaction which
+	// might have lost some of its entries.
+	dropped int
+}
+
+// report logs what was lost from the file at path.
+func (s logSalvage) report(opt Options, path string) {
+	for _, h := range s.lost {
+		opt.Warningf("Log file %s is corrupted, lost bytes [%d, %d)", path, h.start, h.end)
+	}
+	if s.dropped > 0 {
+		opt.Warningf("Log file %s: dropped %d entries of transactions which might be partial",
+			path, s.dropped)
+	}
+	if s.entries > 0 {
+		opt.Warningf("Log file %s: salvaged %d entries past corrupted data", path, s.entries)
+	}
+}
+
+// salvageTail looks for valid entries past end, the offset iterate stopped at, and calls fn for
+// them like iterate does. Iterate stops at the first torn or corrupted entry, so the entries
+// written after it would otherwise be lost. It returns the end of the last entry salvaged, or end
+// if none was, and what was found. The first transaction found after a corrupted region is
+// dropped, as the region might have held its first entries, unless it follows the end of another
+// transaction.
+func (lf *logFile) salvageTail(end uint32, fn logEntry) (uint32, logSalvage, error) {
+	var s logSalvage
+	var finEnd uint32
+	size := uint32(len(lf.Data))
+	for off := end; off < size; {
+		start, e, ok := lf.nextEntry(off, size)
+		if !ok {
+			break
+		}
+		whole := start == finEnd
+		var dropTs uint64
+		first := true
+		runEnd, err := lf.iterate(true, start, func(e Entry, vp valuePointer) error {
+			if first && e.meta&bitTxn > 0 && !whole {
+				dropTs = y.ParseTs(e.Key)
+			}
+			first = false
+			if e.meta&bitTxn > 0 && y.ParseTs(e.Key) == dropTs {
+				s.dropped++
+				return nil
+			}
+			s.entries++
+			return fn(e, vp)
+		})
+		if err != nil {
+			return end, s, err
+		}
+		if runEnd == start {
+			// The entry found ends a transaction which lost its first entries, or starts one which
+			// lost its last ones.
+			if e.meta&bitFinTxn > 0 {
+				finEnd = start + uint32(e.hlen+len(e.Key)+len(e.Value)+crc32.Size)
+			}
+			off = start + 1
+			continue
+		}
+		s.lost = append(s.lost, vlogHole{start: end, end: start})
+		end, off = runEnd, runEnd
+	}
+	// The rest of the file is zeros, unless a write was torn.
+	if n := trimZeros(lf.Data[end:size]); n > 0 {
+		s.lost = append(s.lost, vlogHole{start: end, end: end + uint32(n)})
+	}
+	return end, s, nil
+}
+
+// nextEntry returns the first entry of lf which is valid from off, below size, and its offset.
+func (lf *logFile) nextEntry(off, size uint32) (uint32, *Entry, bool) {
+	read := &safeRead{
+		k:  make([]byte, 10),
+		v:  make([]byte, 10),
+		lf: lf,
+	}
+	for ; off+2 < size; off++ {
+		// The length of the key follows the two meta bytes, and is never zero. Skip the zeros,
+		// which fill the end of the file.
+		if lf.Data[off+2] == 0 {
+			off += uint32(skipZeros(lf.Data[off+2:size])) - 1
+			continue
+		}
+		// Check the lengths before reading the entry, which allocates them.
+		var h header
+		hlen, err := h.DecodeFrom(newHashReader(bytes.NewReader(lf.Data[off:size])))
+		if err != nil || h.klen == 0 || h.klen > 1<<16 ||
+			uint64(off)+uint64(hlen)+uint64(h.klen)+uint64(h.vlen)+crc32.Size > uint64(size) {
+			continue
+		}
+		read.recordOffset = off
+		if e, err := read.Entry(bytes.NewReader(lf.Data[off:size])); err == nil && !e.isZero() {
+			return off, e, true
+		}
+	}
+	return 0, nil, false
+}
+
+// zeroBlock is compared with the log files to skip their zeros, as they are preallocated.
+var zeroBlock = make([]byte, 64<<10)
+
+// skipZeros returns the number of zeros b starts with.
+func skipZeros(b []byte) int {
+	var n int
+	for n+len(zeroBlock) <= len(b) && bytes.Equal(b[n:n+len(zeroBlock)], zeroBlock) {
+		n += len(zeroBlock)
+	}
+	for n < len(b) && b[n] == 0 {
+		n++
+	}
+	return n
+}
+
+// trimZeros returns the length of b without the zeros it ends with.
+func trimZeros(b []byte) int {
+	n := len(b)
+	for n >= len(zeroBlock) && bytes.Equal(b[n-len(zeroBlock):n], zeroBlock) {
+		n -= len(zeroBlock)
+	}
+	for n > 0 && b[n-1] == 0 {
+		n--
+	}
+	return n
+}
+
+// salvageTail salvages the entries of the last value log file past end, and returns the new end
+// of the file. The LSM tree points to the entries at their offsets, so the corrupted regions
+// before them are recorded as holes, which the iterations over the file skip.
+func (vlog *valueLog) salvageTail(lf *logFile, end uint32) (uint32, error) {
+	end, s, err := lf.salvageTail(end, func(Entry, valuePointer) error { return nil })
+	if err != nil {
+		return 0, err
+	}
+	s.report(vlog.opt, lf.path)
+	var lost []vlogHole
+	for _, h := range s.lost {
+		if h.end <= end {
+			lost = append(lost, h)
+		}
+	}
+	if len(lost) == 0 {
+		return end, nil
+	}
+	holes := mergeHoles(lf.holes, lost)
+	if err := writeHoles(lf.path, holes); err != nil {
+		return 0, err
+	}
+	lf.holes = holes
+	return end, nil
+}
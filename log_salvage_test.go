@@ -0,0 +1,139 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSalvageLogTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+	db, err := Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%d", i)) }
+	val := []byte("value-012345678901234567890123456789")
+	var buf []byte
+	var corrupt []uint32
+	func() {
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+		db, err := Open(getTestOptions(dir))
+		require.NoError(t, err)
+		defer db.Close()
+
+		txnSet(t, db, key(0), val, 0)
+		corrupt = append(corrupt, db.mt.wal.writeAt+10)
+		txnSet(t, db, key(1), val, 0)
+		// The transaction of key2 and key3 loses its first entry.
+		corrupt = append(corrupt, db.mt.wal.writeAt+10)
+		txn := db.NewTransaction(true)
+		require.NoError(t, txn.Set(key(2), val))
+		require.NoError(t, txn.Set(key(3), val))
+		require.NoError(t, txn.Commit())
+		txnSet(t, db, key(4), val, 0)
+		txnSet(t, db, key(5), val, 0)
+
+		buf, err = ioutil.ReadFile(db.mtFilePath(1))
+		require.NoError(t, err)
+	}()
+	for _, off := range corrupt {
+		buf[off]++
+	}
+	require.NoError(t, ioutil.WriteFile(db.mtFilePath(1), buf, 0666))
+
+	check := func(db *DB) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i <= 5; i++ {
+				item, err := txn.Get(key(i))
+				if i >= 1 && i <= 3 {
+					require.Equal(t, ErrKeyNotFound, err, "key%d", i)
+					continue
+				}
+				require.NoError(t, err, "key%d", i)
+				require.Equal(t, val, getItemValue(t, item))
+			}
+			return nil
+		}))
+	}
+
+	// Without salvaging, the entries past the first corrupted one are lost.
+	_, err = Open(opt.WithReadOnly(true))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), ErrTruncateNeeded.Error())
+
+	// The read-only DB leaves the file as it is.
+	db, err = Open(opt.WithReadOnly(true).WithSalvageLogTail(true))
+	require.NoError(t, err)
+	check(db)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt.WithSalvageLogTail(true))
+	require.NoError(t, err)
+	check(db)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	check(db)
+}
+
+func TestSalvageValueLogTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithValueThreshold(16).WithValueLogFileSize(1 << 20)
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	lf := db.vlog.filesMap[db.vlog.maxFid]
+	val := []byte("value-012345678901234567890123456789")
+	var offsets []uint32
+	for i := 0; i < 3; i++ {
+		offsets = append(offsets, db.vlog.woffset())
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), val, 0)
+	}
+	end := db.vlog.woffset()
+	lf.Data[offsets[1]+10]++
+	// A torn write at the end.
+	lf.Data[end+3] = 1
+
+	newEnd, err := db.vlog.salvageTail(lf, offsets[1])
+	require.NoError(t, err)
+	require.Equal(t, end, newEnd)
+	require.Equal(t, []vlogHole{{offsets[1], offsets[2]}}, lf.holes)
+
+	var keys []string
+	_, err = lf.iterate(true, 0, func(e Entry, _ valuePointer) error {
+		keys = append(keys, string(y.ParseKey(e.Key)))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"key0", "key2"}, keys)
+	require.NoError(t, db.Close())
+}
@@ -19,6 +19,7 @@ package badger
 import (
 	"log"
 	"os"
+	"sync/atomic"
 )
 
 // Logger is implemented by any logging system that is used for standard logs.
@@ -73,33 +74,41 @@ const (
 
 type defaultLog struct {
 	*log.Logger
-	level loggingLevel
+	level int32 // loggingLevel, accessed atomically as it can be changed via DB.SetOptions.
 }
 
 func defaultLogger(level loggingLevel) *defaultLog {
-	return &defaultLog{Logger: log.New(os.Stderr, "badger ", log.LstdFlags), level: level}
+	return &defaultLog{Logger: log.New(os.Stderr, "badger ", log.LstdFlags), level: int32(level)}
+}
+
+func (l *defaultLog) getLevel() loggingLevel {
+	return loggingLevel(atomic.LoadInt32(&l.level))
+}
+
+func (l *defaultLog) setLevel(level loggingLevel) {
+	atomic.StoreInt32(&l.level, int32(level))
 }
 
 func (l *defaultLog) Errorf(f string, v ...interface{}) {
-	if l.level <= ERROR {
+	if l.getLevel() <= ERROR {
 		l.Printf("ERROR: "+f, v...)
 	}
 }
 
 func (l *defaultLog) Warningf(f string, v ...interface{}) {
-	if l.level <= WARNING {
+	if l.getLevel() <= WARNING {
 		l.Printf("WARNING: "+f, v...)
 	}
 }
 
 func (l *defaultLog) Infof(f string, v ...interface{}) {
-	if l.level <= INFO {
+	if l.getLevel() <= INFO {
 		l.Printf("INFO: "+f, v...)
 	}
 }
 
 func (l *defaultLog) Debugf(f string, v ...interface{}) {
-	if l.level <= DEBUG {
+	if l.getLevel() <= DEBUG {
 		l.Printf("DEBUG: "+f, v...)
 	}
 }
@@ -40,6 +40,19 @@ func (db *DB) NewTransactionAt(readTs uint64, update bool) *Txn {
 	return txn
 }
 
+// SnapshotAt follows the same logic as DB.Snapshot(), but uses the provided read timestamp. It is
+// up to the caller to not discard the versions visible at readTs, via SetDiscardTs, until the
+// snapshot is released.
+//
+// This is only useful for databases built on top of Badger (like Dgraph), and
+// can be ignored by most users.
+func (db *DB) SnapshotAt(readTs uint64) *Snapshot {
+	if !db.opt.managedTxns {
+		panic("Cannot use SnapshotAt with managedDB=false. Use Snapshot instead.")
+	}
+	return &Snapshot{db: db, readTs: readTs}
+}
+
 // NewWriteBatchAt is similar to NewWriteBatch but it allows user to set the commit timestamp.
 // NewWriteBatchAt is supposed to be used only in the managed mode.
 func (db *DB) NewWriteBatchAt(commitTs uint64) *WriteBatch {
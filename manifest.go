@@ -245,7 +245,7 @@ var syncFunc = func(f *os.File) error { return f.Sync() }
 var magicText = [4]byte{'B', 'd', 'g', 'r'}
 
 // The magic version number. It is allocated 2 bytes, so it's value must be <= math.MaxUint16
-const badgerMagicVersion = 8
+const badgerMagicVersion = 9
 
 func helpRewrite(dir string, m *Manifest, extMagic uint16) (*os.File, int, error) {
 	rewritePath := filepath.Join(dir, manifestRewriteFilename)
@@ -185,7 +185,7 @@ func TestOverlappingKeyRangeError(t *testing.T) {
 	cd.t.baseLevel = 1
 
 	manifest := createManifest()
-	lc, err := newLevelsController(kv, &manifest)
+	lc, err := newLevelsController(context.Background(), kv, &manifest)
 	require.NoError(t, err)
 	done = lc.fillTablesL0(&cd)
 	require.Equal(t, true, done)
@@ -19,6 +19,7 @@ package badger
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/aes"
 	cryptorand "crypto/rand"
 	"encoding/binary"
@@ -53,7 +54,7 @@ type memTable struct {
 	buf        *bytes.Buffer
 }
 
-func (db *DB) openMemTables(opt Options) error {
+func (db *DB) openMemTables(ctx context.Context, opt Options) error {
 	// We don't need to open any tables in in-memory mode.
 	if db.opt.InMemory {
 		return nil
@@ -81,6 +82,9 @@ func (db *DB) openMemTables(opt Options) error {
 		return fids[i] < fids[j]
 	})
 	for _, fid := range fids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		flags := os.O_RDWR
 		if db.opt.ReadOnly {
 			flags = os.O_RDONLY
@@ -105,6 +109,24 @@ func (db *DB) openMemTables(opt Options) error {
 	return nil
 }
 
+// closeMemTableFiles closes the write-ahead log files of the memtables, without deleting them. It
+// is used to release the files if opening the DB fails.
+func (db *DB) closeMemTableFiles() {
+	mts := db.imm
+	if db.mt != nil {
+		mts = append(mts, db.mt)
+	}
+	for _, mt := range mts {
+		if mt.wal == nil {
+			continue
+		}
+		if err := mt.wal.Close(-1); err != nil {
+			db.opt.Errorf("While closing file: %s, err: %v", mt.wal.path, err)
+		}
+	}
+	db.imm, db.mt = nil, nil
+}
+
 const memFileExt string = ".mem"
 
 func (db *DB) openMemTable(fid, flags int) (*memTable, error) {
@@ -184,11 +206,12 @@ func (mt *memTable) isFull() bool {
 
 func (mt *memTable) Put(key []byte, value y.ValueStruct) error {
 	entry := &Entry{
-		Key:       key,
-		Value:     value.Value,
-		UserMeta:  value.UserMeta,
-		meta:      value.Meta,
-		ExpiresAt: value.ExpiresAt,
+		Key:         key,
+		Value:       value.Value,
+		UserMeta:    value.UserMeta,
+		UserMetaExt: value.UserMetaExt,
+		meta:        value.Meta,
+		ExpiresAt:   value.ExpiresAt,
 	}
 
 	// wal is nil only when badger in running in in-memory mode and we don't need the wal.
@@ -220,6 +243,17 @@ func (mt *memTable) UpdateSkipList() error {
 	if err != nil {
 		return y.Wrapf(err, "while iterating wal: %s", mt.wal.Fd.Name())
 	}
+	if mt.opt.SalvageLogTail {
+		var s logSalvage
+		endOff, s, err = mt.wal.salvageTail(endOff, mt.replayFunction(mt.opt))
+		if err != nil {
+			return y.Wrapf(err, "while salvaging wal: %s", mt.wal.path)
+		}
+		s.report(mt.opt, mt.wal.path)
+		if mt.opt.ReadOnly {
+			return nil
+		}
+	}
 	if endOff < mt.wal.size && mt.opt.ReadOnly {
 		return y.Wrapf(ErrTruncateNeeded, "end offset: %d < size: %d", endOff, mt.wal.size)
 	}
@@ -246,12 +280,7 @@ func (mt *memTable) replayFunction(opt Options) func(Entry, valuePointer) error
 		if ts := y.ParseTs(e.Key); ts > mt.maxVersion {
 			mt.maxVersion = ts
 		}
-		v := y.ValueStruct{
-			Value:     e.Value,
-			Meta:      e.meta,
-			UserMeta:  e.UserMeta,
-			ExpiresAt: e.ExpiresAt,
-		}
+		v := e.valueStruct(e.Value, e.meta)
 		// This is already encoded correctly. Value would be either a vptr, or a full value
 		// depending upon how big the original value was. Skiplist makes a copy of the key and
 		// value.
@@ -276,6 +305,9 @@ type logFile struct {
 	registry *KeyRegistry
 	writeAt  uint32
 	opt      Options
+	// holes are the regions of a value log file deallocated by the GC, sorted by offset. They're
+	// set by the GC holding lock, and read by the iterations over the file.
+	holes []vlogHole
 }
 
 func (lf *logFile) Truncate(end int64) error {
@@ -295,13 +327,7 @@ func (lf *logFile) Truncate(end int64) error {
 // | header | key | value | crc32 |
 // +--------+-----+-------+-------+
 func (lf *logFile) encodeEntry(buf *bytes.Buffer, e *Entry, offset uint32) (int, error) {
-	h := header{
-		klen:      uint32(len(e.Key)),
-		vlen:      uint32(len(e.Value)),
-		expiresAt: e.ExpiresAt,
-		meta:      e.meta,
-		userMeta:  e.UserMeta,
-	}
+	h := e.header()
 
 	hash := crc32.New(y.CastagnoliCrcTable)
 	writer := io.MultiWriter(buf, hash)
@@ -335,6 +361,34 @@ func (lf *logFile) encodeEntry(buf *bytes.Buffer, e *Entry, offset uint32) (int,
 	return len(headerEnc[:sz]) + len(e.Key) + len(e.Value) + len(crcBuf), nil
 }
 
+// encodedSize returns the length of the encoding of the entry.
+func (lf *logFile) encodedSize(e *Entry) int {
+	h := e.header()
+	var headerEnc [maxHeaderSize]byte
+	return h.Encode(headerEnc[:]) + len(e.Key) + int(e.valueLen()) + crc32.Size
+}
+
+// encodeStreamedEntry is like encodeEntry, for an entry whose value is set via WithValueReader.
+// The value is read straight into dst, which must be of the size returned by encodedSize.
+func (lf *logFile) encodeStreamedEntry(dst []byte, e *Entry, offset uint32) error {
+	sz := e.header().Encode(dst)
+	kv := dst[sz : len(dst)-crc32.Size]
+	copy(kv, e.Key)
+	if err := readFullValue(e.valueReader, kv[len(e.Key):]); err != nil {
+		return err
+	}
+	// we'll encrypt only key and value.
+	if lf.encryptionEnabled() {
+		if err := y.XORBlock(kv, kv, lf.dataKey.Data, lf.generateIV(offset)); err != nil {
+			return y.Wrapf(err, "Error while encoding entry for vlog.")
+		}
+	}
+	hash := crc32.New(y.CastagnoliCrcTable)
+	y.Check2(hash.Write(dst[:len(dst)-crc32.Size]))
+	binary.BigEndian.PutUint32(dst[len(dst)-crc32.Size:], hash.Sum32())
+	return nil
+}
+
 func (lf *logFile) writeEntry(buf *bytes.Buffer, e *Entry, opt Options) error {
 	buf.Reset()
 	plen, err := lf.encodeEntry(buf, e, lf.writeAt)
@@ -361,12 +415,13 @@ func (lf *logFile) decodeEntry(buf []byte, offset uint32) (*Entry, error) {
 		}
 	}
 	e := &Entry{
-		meta:      h.meta,
-		UserMeta:  h.userMeta,
-		ExpiresAt: h.expiresAt,
-		offset:    offset,
-		Key:       kv[:h.klen],
-		Value:     kv[h.klen : h.klen+h.vlen],
+		meta:        h.meta,
+		UserMeta:    h.userMeta,
+		UserMetaExt: h.userMetaExt,
+		ExpiresAt:   h.expiresAt,
+		offset:      offset,
+		Key:         kv[:h.klen],
+		Value:       kv[h.klen : h.klen+h.vlen],
 	}
 	return e, nil
 }
@@ -471,6 +526,11 @@ func (lf *logFile) iterate(readOnly bool, offset uint32, fn logEntry) (uint32, e
 
 loop:
 	for {
+		// Skip the holes punched by the GC, they only held stale entries.
+		if end := lf.holeEnd(read.recordOffset); end > 0 {
+			reader.Reset(lf.NewReader(int(end)))
+			read.recordOffset = end
+		}
 		e, err := read.Entry(reader)
 		switch {
 		// We have not reached the end of the file but the entry we read is
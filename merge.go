@@ -17,6 +17,7 @@
 package badger
 
 import (
+	"bytes"
 	"sync"
 	"time"
 
@@ -179,3 +180,148 @@ func (op *MergeOperator) Get() ([]byte, error) {
 func (op *MergeOperator) Stop() {
 	op.closer.SignalAndWait()
 }
+
+// NamedMergeFunc is a merge function registered via Options.WithMergeFunc. It is applied to the
+// operands written via Txn.Merge to the keys with the given prefix.
+type NamedMergeFunc struct {
+	Name   string
+	Prefix []byte
+	Merge  MergeFunc
+}
+
+// mergeFunc returns the merge function registered for key, or nil if there is none.
+func (db *DB) mergeFunc(key []byte) *NamedMergeFunc {
+	for i := range db.opt.MergeFuncs {
+		if mf := &db.opt.MergeFuncs[i]; bytes.HasPrefix(key, mf.Prefix) {
+			return mf
+		}
+	}
+	return nil
+}
+
+// checkMergeFuncs checks that the prefixes of the merge functions don't overlap, so that every key
+// has at most one merge function.
+func checkMergeFuncs(funcs []NamedMergeFunc) error {
+	for i, a := range funcs {
+		for _, b := range funcs[i+1:] {
+			if bytes.HasPrefix(a.Prefix, b.Prefix) || bytes.HasPrefix(b.Prefix, a.Prefix) {
+				return errors.Errorf("The prefixes %q and %q of the merge functions %q and %q "+
+					"overlap", a.Prefix, b.Prefix, a.Name, b.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// mergedValue returns the value of key as of version, obtained by applying mf to the merge
+// operands written on top of the latest value, deletion or expiry of key. It returns
+// ErrKeyNotFound if key has neither a value nor operands.
+func (db *DB) mergedValue(key []byte, version uint64, mf *NamedMergeFunc) ([]byte, error) {
+	// The caller's transaction holds the read mark, which protects the versions we read here.
+	txn := db.newTransaction(false, true)
+	txn.readTs = version
+	txn.doneRead = 1
+	defer txn.Discard()
+
+	opt := DefaultIteratorOptions
+	opt.AllVersions = true
+	opt.PrefetchValues = false
+	it := txn.NewKeyIterator(key, opt)
+	defer it.Close()
+
+	var base []byte
+	var hasBase bool
+	var operands [][]byte // Newest first.
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if item.IsDeletedOrExpired() {
+			break
+		}
+		// Read the value as stored, the merged value would recurse into this function.
+		val, cb, err := item.yieldRawValue()
+		val = y.SafeCopy(nil, val)
+		runCallback(cb)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading the operands of key %q for the merge "+
+				"function %q", key, mf.Name)
+		}
+		if item.meta&bitMergeEntry == 0 {
+			base, hasBase = val, true
+			break
+		}
+		operands = append(operands, val)
+		if item.DiscardEarlierVersions() {
+			break
+		}
+	}
+	if !hasBase && len(operands) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	if !hasBase {
+		base, operands = operands[len(operands)-1], operands[:len(operands)-1]
+	}
+	for i := len(operands) - 1; i >= 0; i-- {
+		base = mf.Merge(base, operands[i])
+	}
+	return base, nil
+}
+
+// mergedValue returns the value of key as of version, as seen by txn. The pending operand of key,
+// if any, is merged into the committed value.
+func (txn *Txn) mergedValue(key []byte, version uint64, mf *NamedMergeFunc) ([]byte, error) {
+	if txn.update && version == txn.readTs {
+		if e, ok := txn.pendingWrites[string(key)]; ok && e.meta&bitMergeEntry > 0 {
+			base, err := txn.db.mergedValue(key, txn.readTs, mf)
+			switch {
+			case err == ErrKeyNotFound:
+				return e.Value, nil
+			case err != nil:
+				return nil, err
+			}
+			return mf.Merge(base, e.Value), nil
+		}
+	}
+	return txn.db.mergedValue(key, version, mf)
+}
+
+// compactionMerge collapses the merge operands of a key during compaction. The operands are fed
+// from the newest to the oldest version, and are merged into the value they are written on top of.
+type compactionMerge struct {
+	f   MergeFunc
+	key []byte // Key with the version of the newest operand.
+	vs  y.ValueStruct
+	val []byte
+}
+
+func (m *compactionMerge) active() bool {
+	return m.f != nil
+}
+
+// add merges an older operand of the key into the pending value.
+func (m *compactionMerge) add(f MergeFunc, key []byte, vs y.ValueStruct) {
+	if !m.active() {
+		m.f = f
+		m.key = y.SafeCopy(m.key, key)
+		m.vs = vs
+		m.val = y.SafeCopy(m.val, vs.Value)
+		return
+	}
+	// The merge function might modify the existing value, which is owned by the table.
+	m.val = m.f(y.SafeCopy(nil, vs.Value), m.val)
+}
+
+// finish returns the pending value, merged into base if it isn't nil. The value remains a merge
+// operand unless it has been merged into a base, or isFinal denotes that no older version of the
+// key needs to be merged into it.
+func (m *compactionMerge) finish(base *y.ValueStruct, isFinal bool) ([]byte, y.ValueStruct) {
+	vs := m.vs
+	vs.Value = m.val
+	if base != nil {
+		vs.Value = m.f(y.SafeCopy(nil, base.Value), m.val)
+	}
+	if base != nil || isFinal {
+		vs.Meta &^= bitMergeEntry
+	}
+	m.f = nil
+	return m.key, vs
+}
@@ -22,6 +22,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -186,6 +187,130 @@ func TestGetMergeOperator(t *testing.T) {
 
 }
 
+func TestMergeFunc(t *testing.T) {
+	counter := []byte("counter")
+	getCounter := func(t *testing.T, txn *Txn, key []byte) uint64 {
+		item, err := txn.Get(key)
+		require.NoError(t, err)
+		val, err := item.ValueCopy(nil)
+		require.NoError(t, err)
+		return bytesToUint64(val)
+	}
+
+	t.Run("Merge and Get", func(t *testing.T) {
+		opt := getTestOptions("").WithMergeFunc("add", []byte("count"), add)
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			for i := 1; i <= 3; i++ {
+				require.NoError(t, db.Update(func(txn *Txn) error {
+					return txn.Merge(counter, uint64ToBytes(uint64(i)))
+				}))
+			}
+			require.NoError(t, db.View(func(txn *Txn) error {
+				require.Equal(t, uint64(6), getCounter(t, txn, counter))
+				return nil
+			}))
+
+			// The pending operands are merged into the committed value.
+			txn := db.NewTransaction(true)
+			defer txn.Discard()
+			require.NoError(t, txn.Merge(counter, uint64ToBytes(4)))
+			require.NoError(t, txn.Merge(counter, uint64ToBytes(5)))
+			require.Equal(t, uint64(15), getCounter(t, txn, counter))
+			require.NoError(t, txn.Commit())
+
+			require.NoError(t, db.View(func(txn *Txn) error {
+				it := txn.NewIterator(DefaultIteratorOptions)
+				defer it.Close()
+				it.Rewind()
+				require.True(t, it.Valid())
+				val, err := it.Item().ValueCopy(nil)
+				require.NoError(t, err)
+				require.Equal(t, uint64(15), bytesToUint64(val))
+				return nil
+			}))
+
+			// Merge without a registered merge function fails.
+			err := db.Update(func(txn *Txn) error {
+				return txn.Merge([]byte("foo"), uint64ToBytes(1))
+			})
+			require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+		})
+	})
+	t.Run("Merge on top of Set and Delete", func(t *testing.T) {
+		opt := getTestOptions("").WithMergeFunc("add", []byte("count"), add)
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set(counter, uint64ToBytes(10))
+			}))
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Merge(counter, uint64ToBytes(1))
+			}))
+			require.NoError(t, db.View(func(txn *Txn) error {
+				require.Equal(t, uint64(11), getCounter(t, txn, counter))
+				return nil
+			}))
+
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Delete(counter)
+			}))
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Merge(counter, uint64ToBytes(2))
+			}))
+			require.NoError(t, db.View(func(txn *Txn) error {
+				require.Equal(t, uint64(2), getCounter(t, txn, counter))
+				return nil
+			}))
+		})
+	})
+	t.Run("Operands are collapsed by compaction", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "badger-test")
+		require.NoError(t, err)
+		defer removeDir(dir)
+
+		opts := getTestOptions(dir).WithCompactL0OnClose(true).
+			WithMergeFunc("add", []byte("count"), add)
+		db, err := Open(opts)
+		require.NoError(t, err)
+
+		count := 5000
+		for i := 0; i < count; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Merge(counter, uint64ToBytes(1))
+			}))
+		}
+		// The operands are collapsed once no transaction reads below them. The last one is read
+		// below by the transaction which wrote it, so read above it.
+		require.NoError(t, db.View(func(txn *Txn) error { return nil }))
+		require.NoError(t, db.Close())
+
+		db, err = Open(opts)
+		require.NoError(t, err)
+		defer db.Close()
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			require.Equal(t, uint64(count), getCounter(t, txn, counter))
+
+			iopt := DefaultIteratorOptions
+			iopt.AllVersions = true
+			it := txn.NewKeyIterator(counter, iopt)
+			defer it.Close()
+			var versions int
+			for it.Rewind(); it.Valid(); it.Next() {
+				versions++
+			}
+			require.Equal(t, 1, versions)
+			return nil
+		}))
+	})
+	t.Run("Overlapping prefixes", func(t *testing.T) {
+		opt := getTestOptions("").WithMergeFunc("add", []byte("count"), add).
+			WithMergeFunc("other", []byte("counter"), add)
+		_, err := Open(opt)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), `"other"`)
+	})
+}
+
 func uint64ToBytes(i uint64) []byte {
 	var buf [8]byte
 	binary.BigEndian.PutUint64(buf[:], i)
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics is a point-in-time snapshot of the counters of a single DB instance. Unlike the expvar
+// metrics in the y package, which are shared by all the DBs in the process, these only cover the
+// DB they were taken from. All the cumulative counters start at zero when the DB is opened.
+type Metrics struct {
+	// Gets is the number of point lookups served by the DB.
+	Gets int64
+	// MemtableGets is the number of memtable lookups done while serving Gets.
+	MemtableGets int64
+	// LSMGets is the number of table lookups done while serving Gets.
+	LSMGets int64
+	// BloomHits is the number of table lookups avoided because of the bloom filter.
+	BloomHits int64
+	// Puts is the number of entries handed over to the write pipeline.
+	Puts int64
+
+	// ConflictRetries is the number of times UpdateWithRetry retried a transaction after a
+	// conflict.
+	ConflictRetries int64
+	// ConflictRetriesExhausted is the number of times UpdateWithRetry gave up on a transaction
+	// after running out of retries.
+	ConflictRetriesExhausted int64
+
+	// BlockCacheHitRatio is the hit ratio of the block cache, or zero if there is no block cache.
+	BlockCacheHitRatio float64
+	// IndexCacheHitRatio is the hit ratio of the index cache, or zero if there is no index cache.
+	IndexCacheHitRatio float64
+
+	// VlogGCRuns is the number of value log GC runs that rewrote a file.
+	VlogGCRuns int64
+	// VlogGCNoRewrites is the number of value log GC runs that found no file worth rewriting.
+	VlogGCNoRewrites int64
+	// VlogGCErrors is the number of value log GC runs that failed.
+	VlogGCErrors int64
+
+	// VlogBytes is the size of the value log files.
+	VlogBytes int64
+	// VlogDeadBytes is the size of the values in the value log which were overwritten or deleted.
+	// It's only updated as the compactions drop them, unless Options.TrackVlogSpace is set.
+	VlogDeadBytes int64
+	// VlogSpaceAmp is the space amplification of the value log, VlogBytes over the live bytes.
+	// It's 1 if the value log is empty, and +Inf if it holds no live value.
+	VlogSpaceAmp float64
+
+	// PendingCompactions is the number of levels which currently need a compaction.
+	PendingCompactions int
+	// TablesInCompaction is the number of tables being compacted right now.
+	TablesInCompaction int64
+
+	// WriteStalls is the number of times a write had to wait for room in the memtables.
+	WriteStalls int64
+	// WriteStallTime is the total time writes spent waiting for room in the memtables.
+	WriteStallTime time.Duration
+	// L0StallTime is the total time memtable flushes spent waiting for L0 to be compacted.
+	L0StallTime time.Duration
+}
+
+// dbMetrics holds the per DB counters reported via DB.Metrics. All the fields are accessed
+// atomically.
+type dbMetrics struct {
+	gets             int64
+	memtableGets     int64
+	lsmGets          int64
+	bloomHits        int64
+	puts             int64
+	vlogGCRuns       int64
+	vlogGCNoRewrites int64
+	vlogGCErrors     int64
+	compactionTables int64
+	writeStalls      int64
+	writeStallNs     int64
+	conflictRetries  int64
+	retriesExhausted int64
+}
+
+// Metrics returns a snapshot of the metrics of the DB. It is cheap enough to be called
+// periodically by the application to export the metrics to its own monitoring system.
+func (db *DB) Metrics() Metrics {
+	m := &db.metrics
+	out := Metrics{
+		Gets:                     atomic.LoadInt64(&m.gets),
+		MemtableGets:             atomic.LoadInt64(&m.memtableGets),
+		LSMGets:                  atomic.LoadInt64(&m.lsmGets),
+		BloomHits:                atomic.LoadInt64(&m.bloomHits),
+		Puts:                     atomic.LoadInt64(&m.puts),
+		ConflictRetries:          atomic.LoadInt64(&m.conflictRetries),
+		ConflictRetriesExhausted: atomic.LoadInt64(&m.retriesExhausted),
+		VlogGCRuns:               atomic.LoadInt64(&m.vlogGCRuns),
+		VlogGCNoRewrites:         atomic.LoadInt64(&m.vlogGCNoRewrites),
+		VlogGCErrors:             atomic.LoadInt64(&m.vlogGCErrors),
+		TablesInCompaction:       atomic.LoadInt64(&m.compactionTables),
+		WriteStalls:              atomic.LoadInt64(&m.writeStalls),
+		WriteStallTime:           time.Duration(atomic.LoadInt64(&m.writeStallNs)),
+	}
+	if db.blockCache != nil {
+		out.BlockCacheHitRatio = db.blockCache.Metrics.Ratio()
+	}
+	if db.indexCache != nil {
+		out.IndexCacheHitRatio = db.indexCache.Metrics.Ratio()
+	}
+	out.VlogBytes, out.VlogDeadBytes = db.vlogSpace()
+	out.VlogSpaceAmp = spaceAmp(out.VlogBytes, out.VlogDeadBytes)
+	if db.lc != nil {
+		out.PendingCompactions = len(db.lc.pickCompactLevels())
+		out.L0StallTime = time.Duration(atomic.LoadInt64(&db.lc.l0stallsMs))
+	}
+	return out
+}
@@ -0,0 +1,327 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// azureVersion is the version of the Blob service API used.
+const azureVersion = "2019-12-12"
+
+// AzureConfig configures an Azure Blob Storage client.
+type AzureConfig struct {
+	// Endpoint is the URL of the service, like http://127.0.0.1:10000/devstoreaccount1 for
+	// Azurite. It defaults to https://<Account>.blob.core.windows.net.
+	Endpoint  string
+	Account   string
+	Container string
+	// Key is the base64-encoded access key of the account, used to sign the requests with Shared
+	// Key authorization.
+	Key string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+	// Upload configures the uploads of Put. It defaults to DefaultOptions.
+	Upload Options
+}
+
+// Azure is an Uploader for the block blobs of Azure Blob Storage. The parts are uploaded as
+// blocks, which are committed as the blob by Complete. The blocks of an aborted upload are
+// discarded by the service once they expire, a week later.
+type Azure struct {
+	cfg AzureConfig
+	now func() time.Time
+}
+
+var (
+	_ Uploader = (*Azure)(nil)
+	_ Storage  = (*Azure)(nil)
+)
+
+// NewAzure returns an Azure Blob Storage client.
+func NewAzure(cfg AzureConfig) *Azure {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", cfg.Account)
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.Upload.PartSize == 0 {
+		cfg.Upload = DefaultOptions()
+	}
+	return &Azure{cfg: cfg, now: time.Now}
+}
+
+// azureConfigFromURL returns the configuration of the container of an az:// URL, and the name of
+// the blob. The account and its key are read from the environment variables
+// AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_KEY, and the endpoint can be overridden with
+// AZURE_STORAGE_ENDPOINT.
+func azureConfigFromURL(u *url.URL) (AzureConfig, string, error) {
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return AzureConfig{}, "", errors.Errorf(
+			"Invalid object URL %q: the container or the blob is missing", u)
+	}
+	return AzureConfig{
+		Endpoint:  os.Getenv("AZURE_STORAGE_ENDPOINT"),
+		Account:   os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		Container: u.Host,
+		Key:       os.Getenv("AZURE_STORAGE_KEY"),
+	}, key, nil
+}
+
+// Create implements Uploader. The id of the upload prefixes the ids of its blocks, so that they
+// aren't mixed up with the uncommitted blocks of another upload of the same blob.
+func (a *Azure) Create(ctx context.Context, key string) (string, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// blockID returns the id of a block of an upload. The ids of the blocks of a blob must all have
+// the same length.
+func blockID(uploadID string, number int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s-%06d", uploadID, number)))
+}
+
+// UploadPart implements Uploader. The ETag of the part is the id of its block. Azure doesn't take
+// empty blocks, so an empty part isn't uploaded, and has an empty ETag.
+func (a *Azure) UploadPart(ctx context.Context, key, uploadID string, number int,
+	data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", nil
+	}
+	id := blockID(uploadID, number)
+	query := url.Values{"comp": {"block"}, "blockid": {id}}
+	if _, err := a.do(ctx, http.MethodPut, key, query, data, nil); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Complete implements Uploader.
+func (a *Azure) Complete(ctx context.Context, key, uploadID string, parts []Part) error {
+	req := struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{}
+	for _, p := range parts {
+		if p.ETag != "" {
+			req.Latest = append(req.Latest, p.ETag)
+		}
+	}
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return err
+	}
+	body = append([]byte(xml.Header), body...)
+	_, err = a.do(ctx, http.MethodPut, key, url.Values{"comp": {"blocklist"}}, body, nil)
+	return err
+}
+
+// Abort implements Uploader. The uncommitted blocks can't be deleted, so it does nothing.
+func (a *Azure) Abort(ctx context.Context, key, uploadID string) error {
+	return nil
+}
+
+// Put implements Storage. The blob is uploaded in blocks, see Writer.
+func (a *Azure) Put(ctx context.Context, name string, r io.Reader) error {
+	w, err := NewWriter(ctx, a, name, a.cfg.Upload)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		_ = w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// Get implements Storage.
+func (a *Azure) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := a.send(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// List implements Storage.
+func (a *Azure) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+	for {
+		var res struct {
+			Blobs []struct {
+				Name string
+			} `xml:"Blobs>Blob"`
+			NextMarker string
+		}
+		if _, err := a.do(ctx, http.MethodGet, "", query, nil, &res); err != nil {
+			return nil, err
+		}
+		for _, b := range res.Blobs {
+			names = append(names, b.Name)
+		}
+		if res.NextMarker == "" {
+			break
+		}
+		query.Set("marker", res.NextMarker)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// send sends a signed request about the blob with the given name, or about the container if the
+// name is empty. The caller must close the body of the response, which is only returned if its
+// status is 2xx.
+func (a *Azure) send(ctx context.Context, method, name string, query url.Values,
+	body []byte) (*http.Response, error) {
+	u := a.cfg.Endpoint + "/" + a.cfg.Container
+	if name != "" {
+		u += "/" + uriEncode(name, false)
+	}
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if err := a.sign(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := a.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		// The errors of Azure have the same shape as the ones of S3.
+		var aerr s3Error
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		_ = xml.Unmarshal(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), &aerr)
+		return nil, errors.Errorf("%s %s failed with status %d: %s: %s",
+			method, u, resp.StatusCode, aerr.Code, aerr.Message)
+	}
+	return resp, nil
+}
+
+// do sends a signed request like send, and decodes the XML response into res, if set.
+func (a *Azure) do(ctx context.Context, method, name string, query url.Values, body []byte,
+	res interface{}) (*http.Response, error) {
+	resp, err := a.send(ctx, method, name, query, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if res == nil {
+		_, err := io.Copy(ioutil.Discard, resp.Body)
+		return resp, err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// The responses may start with a byte order mark.
+	if err := xml.Unmarshal(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), res); err != nil {
+		return nil, errors.Wrapf(err, "while decoding the response of %s %s/%s", method,
+			a.cfg.Container, name)
+	}
+	return resp, nil
+}
+
+// sign signs req with Shared Key authorization.
+func (a *Azure) sign(req *http.Request) error {
+	key, err := base64.StdEncoding.DecodeString(a.cfg.Key)
+	if err != nil {
+		return errors.Wrapf(err, "while decoding the key of the account %q", a.cfg.Account)
+	}
+	req.Header.Set("X-Ms-Date", a.now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", azureVersion)
+
+	var headers []string
+	for name := range req.Header {
+		if lname := strings.ToLower(name); strings.HasPrefix(lname, "x-ms-") {
+			headers = append(headers, lname+":"+strings.TrimSpace(req.Header.Get(name)))
+		}
+	}
+	sort.Strings(headers)
+
+	resource := "/" + a.cfg.Account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		vals := append([]string{}, query[name]...)
+		sort.Strings(vals)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(vals, ",")
+	}
+
+	var length string
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date.
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(headers, "\n"),
+		resource,
+	}, "\n")
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", a.cfg.Account,
+		base64.StdEncoding.EncodeToString(h.Sum(nil))))
+	return nil
+}
@@ -0,0 +1,272 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package objstore writes backups and streams directly to object storage, like S3, GCS or Azure
+// Blob Storage, via multipart uploads, so that they don't need a local staging file as large as
+// the DB.
+//
+// A Writer is an io.WriteCloser, which can be passed to DB.Backup, or written to by Stream.Send.
+// It uploads the data in parts of a fixed size, several at once, and retries the failed requests.
+// The uploads are done by an Uploader, which S3 implements for S3 and the S3-compatible services,
+// like the XML API of GCS, and Azure for the block blobs of Azure Blob Storage.
+package objstore
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Part is an uploaded part of an object.
+type Part struct {
+	Number int
+	ETag   string
+}
+
+// Uploader uploads objects in parts. Its methods are called concurrently.
+type Uploader interface {
+	// Create starts the upload of the object with the given key, and returns its id.
+	Create(ctx context.Context, key string) (uploadID string, err error)
+	// UploadPart uploads a part of the object, numbered from 1, and returns its ETag.
+	UploadPart(ctx context.Context, key, uploadID string, number int, data []byte) (string, error)
+	// Complete assembles the object from its parts, in the order of their numbers.
+	Complete(ctx context.Context, key, uploadID string, parts []Part) error
+	// Abort discards the upload and the parts uploaded.
+	Abort(ctx context.Context, key, uploadID string) error
+}
+
+// Options are the options of a Writer.
+type Options struct {
+	// PartSize is the size of the parts uploaded, but the last one. S3 requires at least 5MB.
+	PartSize int
+	// Concurrency is the number of parts uploaded at once. A Writer buffers up to Concurrency
+	// parts in memory, and Write blocks while they're all being uploaded.
+	Concurrency int
+	// MaxRetries is the number of times a failed request is retried, waiting RetryBackoff before
+	// the first retry, and twice as long before each of the next ones.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// DefaultOptions returns the default options of a Writer.
+func DefaultOptions() Options {
+	return Options{
+		PartSize:     64 << 20,
+		Concurrency:  4,
+		MaxRetries:   5,
+		RetryBackoff: time.Second,
+	}
+}
+
+// Writer uploads the data written to it as an object. The object is only created once Close
+// succeeds.
+type Writer struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	up     Uploader
+	key    string
+	id     string
+	opt    Options
+
+	buf    []byte
+	next   int // The number of the next part.
+	sem    chan struct{}
+	wg     sync.WaitGroup
+	closed bool
+
+	mu    sync.Mutex
+	parts []Part
+	err   error
+}
+
+// NewWriter starts the upload of the object with the given key.
+func NewWriter(ctx context.Context, up Uploader, key string, opt Options) (*Writer, error) {
+	if opt.PartSize <= 0 || opt.Concurrency <= 0 {
+		return nil, errors.Errorf("Invalid part size %d or concurrency %d",
+			opt.PartSize, opt.Concurrency)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	w := &Writer{
+		ctx:    ctx,
+		cancel: cancel,
+		up:     up,
+		key:    key,
+		opt:    opt,
+		next:   1,
+		sem:    make(chan struct{}, opt.Concurrency),
+	}
+	err := w.retry(func() error {
+		var err error
+		w.id, err = up.Create(ctx, key)
+		return err
+	})
+	if err != nil {
+		cancel()
+		return nil, errors.Wrapf(err, "while starting the upload of %q", key)
+	}
+	return w, nil
+}
+
+// retry calls f until it succeeds, up to MaxRetries more times.
+func (w *Writer) retry(f func() error) error {
+	backoff := w.opt.RetryBackoff
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil || i >= w.opt.MaxRetries {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-w.ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+func (w *Writer) setErr(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+		// Stop the other uploads.
+		w.cancel()
+	}
+}
+
+func (w *Writer) getErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Write buffers p, and uploads the parts which are full. It only returns an error if an upload
+// failed, in which case the Writer must be aborted.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("Write on closed objstore.Writer")
+	}
+	if err := w.getErr(); err != nil {
+		return 0, err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, w.opt.PartSize)
+		}
+		sz := w.opt.PartSize - len(w.buf)
+		if sz > len(p) {
+			sz = len(p)
+		}
+		w.buf = append(w.buf, p[:sz]...)
+		p = p[sz:]
+		if len(w.buf) == w.opt.PartSize {
+			if err := w.upload(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// upload uploads the buffer as the next part, blocking while Concurrency parts are being uploaded.
+func (w *Writer) upload() error {
+	select {
+	case w.sem <- struct{}{}:
+	case <-w.ctx.Done():
+		if err := w.getErr(); err != nil {
+			return err
+		}
+		return w.ctx.Err()
+	}
+	data, number := w.buf, w.next
+	w.buf = nil
+	w.next++
+	w.wg.Add(1)
+	go func() {
+		defer func() {
+			<-w.sem
+			w.wg.Done()
+		}()
+		var etag string
+		err := w.retry(func() error {
+			var err error
+			etag, err = w.up.UploadPart(w.ctx, w.key, w.id, number, data)
+			return err
+		})
+		if err != nil {
+			w.setErr(errors.Wrapf(err, "while uploading part %d of %q", number, w.key))
+			return
+		}
+		w.mu.Lock()
+		w.parts = append(w.parts, Part{Number: number, ETag: etag})
+		w.mu.Unlock()
+	}()
+	return nil
+}
+
+// Close uploads the data left, and completes the upload. If it fails, the upload is aborted.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	// An object needs at least one part, which may be empty if it's the last one.
+	var err error
+	if len(w.buf) > 0 || w.next == 1 {
+		err = w.upload()
+	}
+	w.wg.Wait()
+	if err == nil {
+		err = w.getErr()
+	}
+	if err == nil {
+		sort.Slice(w.parts, func(i, j int) bool { return w.parts[i].Number < w.parts[j].Number })
+		err = w.retry(func() error {
+			return w.up.Complete(w.ctx, w.key, w.id, w.parts)
+		})
+		if err != nil {
+			err = errors.Wrapf(err, "while completing the upload of %q", w.key)
+		}
+	}
+	if err != nil {
+		w.abort()
+		return err
+	}
+	w.cancel()
+	return nil
+}
+
+// Abort discards the upload.
+func (w *Writer) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.abort()
+}
+
+func (w *Writer) abort() error {
+	w.cancel()
+	w.wg.Wait()
+	// The context of the writer is done, so use a new one to abort.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return w.up.Abort(ctx, w.key, w.id)
+}
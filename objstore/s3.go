@@ -0,0 +1,397 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// S3Config configures an S3 client.
+type S3Config struct {
+	// Endpoint is the URL of the service, like https://storage.googleapis.com for GCS. It
+	// defaults to the AWS endpoint of the region.
+	Endpoint string
+	// Region is the region of the bucket, used to sign the requests. GCS accepts "auto".
+	Region string
+	Bucket string
+	// AccessKey and SecretKey are the credentials, which are HMAC keys for GCS. SessionToken is
+	// only set for temporary credentials.
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+	// Upload configures the uploads of Put. It defaults to DefaultOptions.
+	Upload Options
+}
+
+// S3 is an Uploader for S3, and the services implementing its API, like the XML API of GCS. The
+// requests are signed with AWS Signature Version 4, and the objects are addressed by path.
+type S3 struct {
+	cfg S3Config
+	now func() time.Time
+}
+
+var (
+	_ Uploader = (*S3)(nil)
+	_ Storage  = (*S3)(nil)
+)
+
+// NewS3 returns an S3 client.
+func NewS3(cfg S3Config) *S3 {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.Upload.PartSize == 0 {
+		cfg.Upload = DefaultOptions()
+	}
+	return &S3{cfg: cfg, now: time.Now}
+}
+
+// Open starts the upload of the object at the given URL, which is s3://bucket/key for S3,
+// gs://bucket/key for GCS, or az://container/blob for Azure Blob Storage. For S3 and GCS, the
+// credentials are read from the environment variables AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN, and the region from AWS_REGION, which defaults to us-east-1. The endpoint can
+// be overridden with the environment variable S3_ENDPOINT, for the other S3-compatible services.
+// For Azure, the account and its key are read from AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_KEY,
+// and the endpoint can be overridden with AZURE_STORAGE_ENDPOINT.
+func Open(ctx context.Context, rawurl string, opt Options) (*Writer, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "az" {
+		cfg, name, err := azureConfigFromURL(u)
+		if err != nil {
+			return nil, err
+		}
+		return NewWriter(ctx, NewAzure(cfg), name, opt)
+	}
+	cfg, key, err := s3ConfigFromURL(u)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriter(ctx, NewS3(cfg), key, opt)
+}
+
+// s3ConfigFromURL returns the configuration of the bucket of an s3:// or gs:// URL, and the key
+// of the object. See Open.
+func s3ConfigFromURL(u *url.URL) (S3Config, string, error) {
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return S3Config{}, "", errors.Errorf(
+			"Invalid object URL %q: the bucket or the key is missing", u)
+	}
+	cfg := S3Config{
+		Endpoint:     os.Getenv("S3_ENDPOINT"),
+		Region:       os.Getenv("AWS_REGION"),
+		Bucket:       u.Host,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	switch u.Scheme {
+	case "s3":
+		if cfg.Region == "" {
+			cfg.Region = "us-east-1"
+		}
+	case "gs":
+		if cfg.Endpoint == "" {
+			cfg.Endpoint = "https://storage.googleapis.com"
+		}
+		if cfg.Region == "" {
+			cfg.Region = "auto"
+		}
+	default:
+		return S3Config{}, "", errors.Errorf("Unsupported object URL scheme %q", u.Scheme)
+	}
+	return cfg, key, nil
+}
+
+// Create implements Uploader.
+func (s *S3) Create(ctx context.Context, key string) (string, error) {
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if _, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, &res); err != nil {
+		return "", err
+	}
+	return res.UploadID, nil
+}
+
+// UploadPart implements Uploader.
+func (s *S3) UploadPart(ctx context.Context, key, uploadID string, number int,
+	data []byte) (string, error) {
+	query := url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {uploadID}}
+	resp, err := s.do(ctx, http.MethodPut, key, query, data, nil)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// Complete implements Uploader.
+func (s *S3) Complete(ctx context.Context, key, uploadID string, parts []Part) error {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	req := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for _, p := range parts {
+		req.Parts = append(req.Parts, part{PartNumber: p.Number, ETag: p.ETag})
+	}
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, err = s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, nil)
+	return err
+}
+
+// Put implements Storage. The object is uploaded in parts, see Writer.
+func (s *S3) Put(ctx context.Context, name string, r io.Reader) error {
+	w, err := NewWriter(ctx, s, name, s.cfg.Upload)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		_ = w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// Get implements Storage.
+func (s *S3) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.send(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// List implements Storage.
+func (s *S3) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		var res struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if _, err := s.do(ctx, http.MethodGet, "", query, nil, &res); err != nil {
+			return nil, err
+		}
+		for _, c := range res.Contents {
+			names = append(names, c.Key)
+		}
+		if !res.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", res.NextContinuationToken)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Abort implements Uploader.
+func (s *S3) Abort(ctx context.Context, key, uploadID string) error {
+	_, err := s.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	return err
+}
+
+// s3Error is the body of an error response.
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+// send sends a signed request about the object with the given key. The caller must close the body
+// of the response, which is only returned if its status is 2xx.
+func (s *S3) send(ctx context.Context, method, key string, query url.Values,
+	body []byte) (*http.Response, error) {
+	u := fmt.Sprintf("%s/%s/%s?%s", s.cfg.Endpoint, s.cfg.Bucket,
+		uriEncode(key, false), canonicalQuery(query))
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	s.sign(req, body)
+
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var serr s3Error
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		_ = xml.Unmarshal(data, &serr)
+		return nil, errors.Errorf("%s %s failed with status %d: %s: %s",
+			method, u, resp.StatusCode, serr.Code, serr.Message)
+	}
+	return resp, nil
+}
+
+// do sends a signed request about the object with the given key, and decodes the XML response
+// into res, if set.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, body []byte,
+	res interface{}) (*http.Response, error) {
+	resp, err := s.send(ctx, method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	// CompleteMultipartUpload can fail after responding with 200 OK.
+	var serr s3Error
+	if xml.Unmarshal(data, &serr) == nil {
+		return nil, errors.Errorf("%s %s/%s failed: %s: %s",
+			method, s.cfg.Bucket, key, serr.Code, serr.Message)
+	}
+	if res != nil {
+		if err := xml.Unmarshal(data, res); err != nil {
+			return nil, errors.Wrapf(err, "while decoding the response of %s %s/%s", method,
+				s.cfg.Bucket, key)
+		}
+	}
+	return resp, nil
+}
+
+// sign signs req with AWS Signature Version 4.
+func (s *S3) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lname := strings.ToLower(name); strings.HasPrefix(lname, "x-amz-") {
+			headers[lname] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by key, as required by the signature.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string{}, query[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes s, but the unreserved characters, and the slashes unless encodeSlash
+// is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,517 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package objstore
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The packet types and constants of version 3 of the SFTP protocol, see
+// https://tools.ietf.org/html/draft-ietf-secsh-filexfer-02.
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpExtended = 200
+
+	sftpFlagRead  = 0x01
+	sftpFlagWrite = 0x02
+	sftpFlagCreat = 0x08
+	sftpFlagTrunc = 0x10
+
+	sftpOK  = 0
+	sftpEOF = 1
+
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+
+	// sftpChunk is the size of the data read or written by a request. Servers accept at least
+	// 32KB.
+	sftpChunk = 32 << 10
+
+	sftpPosixRename = "posix-rename@openssh.com"
+)
+
+// SFTP is a Storage on an SFTP server. It speaks version 3 of the SFTP protocol over connections
+// to the sftp subsystem of the server, opened by dial. Each call opens its own connection.
+type SFTP struct {
+	dir  string
+	dial func(ctx context.Context) (io.ReadWriteCloser, error)
+}
+
+var _ Storage = (*SFTP)(nil)
+
+// NewSFTP returns a Storage in the directory dir of an SFTP server. dial opens a connection to
+// the sftp subsystem of the server, like DialSSH does.
+func NewSFTP(dir string, dial func(ctx context.Context) (io.ReadWriteCloser, error)) *SFTP {
+	return &SFTP{dir: dir, dial: dial}
+}
+
+// DialSSH returns a function opening connections to the sftp subsystem of the host of the given
+// sftp:// URL, by running ssh. The authentication is left to ssh, which uses the usual keys,
+// agent and known hosts, but never prompts for a password. The hosts and users starting with '-'
+// are rejected, as ssh would parse them as options.
+func DialSSH(u *url.URL) (func(ctx context.Context) (io.ReadWriteCloser, error), error) {
+	host := u.Hostname()
+	if host == "" || strings.HasPrefix(host, "-") {
+		return nil, errors.Errorf("Invalid SFTP host %q", host)
+	}
+	args := []string{"-o", "BatchMode=yes", "-s"}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	if u.User != nil {
+		user := u.User.Username()
+		if strings.HasPrefix(user, "-") {
+			return nil, errors.Errorf("Invalid SFTP user %q", user)
+		}
+		args = append(args, "-l", user)
+	}
+	args = append(args, "--", host, "sftp")
+	return func(ctx context.Context) (io.ReadWriteCloser, error) {
+		cmd := exec.CommandContext(ctx, "ssh", args...)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &cmdConn{cmd: cmd, WriteCloser: stdin, Reader: stdout}, nil
+	}, nil
+}
+
+// cmdConn is a connection to the standard input and output of a command.
+type cmdConn struct {
+	cmd *exec.Cmd
+	io.WriteCloser
+	io.Reader
+}
+
+func (c *cmdConn) Close() error {
+	c.WriteCloser.Close()
+	return c.cmd.Wait()
+}
+
+// Put implements Storage. The object is written to a temporary file, which is then renamed.
+func (s *SFTP) Put(ctx context.Context, name string, r io.Reader) error {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	p := path.Join(s.dir, name)
+	// Create the parent directories, ignoring the errors about the existing ones.
+	var dir string
+	if strings.HasPrefix(p, "/") {
+		dir = "/"
+	}
+	for _, elem := range strings.Split(strings.Trim(path.Dir(p), "/"), "/") {
+		dir = path.Join(dir, elem)
+		_, _, _ = c.request(sftpMkdir, str(dir), u32(0))
+	}
+	tmp := p + ".tmp"
+	h, err := c.open(tmp, sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, sftpChunk)
+	var off uint64
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			_, _, err := c.request(sftpWrite, str(h), u64(off), str(string(buf[:n])))
+			if err != nil {
+				c.closeHandle(h)
+				return err
+			}
+			off += uint64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		} else if rerr != nil {
+			c.closeHandle(h)
+			return rerr
+		}
+	}
+	if err := c.closeHandle(h); err != nil {
+		return err
+	}
+	if c.exts[sftpPosixRename] {
+		_, _, err = c.request(sftpExtended, str(sftpPosixRename), str(tmp), str(p))
+		return err
+	}
+	// The plain rename fails if the object exists.
+	_, _, _ = c.request(sftpRemove, str(p))
+	_, _, err = c.request(sftpRename, str(tmp), str(p))
+	return err
+}
+
+// Get implements Storage.
+func (s *SFTP) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	h, err := c.open(path.Join(s.dir, name), sftpFlagRead)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &sftpFile{c: c, handle: h}, nil
+}
+
+// List implements Storage. The directories are walked recursively.
+func (s *SFTP) List(ctx context.Context, prefix string) ([]string, error) {
+	c, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var names []string
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		typ, data, err := c.request(sftpOpendir, str(path.Join(s.dir, rel)))
+		if err != nil {
+			return err
+		}
+		if typ != sftpHandle {
+			return errors.Errorf("Unexpected SFTP response %d to opendir", typ)
+		}
+		h, _ := readString(data)
+		defer c.closeHandle(h)
+		for {
+			typ, data, err := c.request(sftpReaddir, str(h))
+			if isSFTPStatus(err, sftpEOF) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if typ != sftpName || len(data) < 4 {
+				return errors.Errorf("Unexpected SFTP response %d to readdir", typ)
+			}
+			count := binary.BigEndian.Uint32(data)
+			data = data[4:]
+			for i := uint32(0); i < count; i++ {
+				var file string
+				file, data = readString(data)
+				_, data = readString(data) // The long name.
+				var isDir bool
+				if isDir, data, err = readAttrs(data); err != nil {
+					return err
+				}
+				if file == "." || file == ".." {
+					continue
+				}
+				name := path.Join(rel, file)
+				switch {
+				case isDir:
+					// Only walk the directories which can hold names with the prefix.
+					if strings.HasPrefix(name+"/", prefix) || strings.HasPrefix(prefix, name+"/") {
+						if err := walk(name); err != nil {
+							return err
+						}
+					}
+				case strings.HasPrefix(name, prefix):
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// sftpFile reads a file of an SFTP server.
+type sftpFile struct {
+	c      *sftpConn
+	handle string
+	off    uint64
+}
+
+func (f *sftpFile) Read(p []byte) (int, error) {
+	if len(p) > sftpChunk {
+		p = p[:sftpChunk]
+	}
+	typ, data, err := f.c.request(sftpRead, str(f.handle), u64(f.off), u32(uint32(len(p))))
+	if isSFTPStatus(err, sftpEOF) {
+		return 0, io.EOF
+	} else if err != nil {
+		return 0, err
+	}
+	if typ != sftpData {
+		return 0, errors.Errorf("Unexpected SFTP response %d to read", typ)
+	}
+	chunk, _ := readString(data)
+	n := copy(p, chunk)
+	f.off += uint64(n)
+	return n, nil
+}
+
+func (f *sftpFile) Close() error {
+	err := f.c.closeHandle(f.handle)
+	if cerr := f.c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// sftpConn is a connection to an SFTP server, which sends one request at a time.
+type sftpConn struct {
+	rwc  io.ReadWriteCloser
+	r    *bufio.Reader
+	id   uint32
+	exts map[string]bool
+}
+
+// sftpError is a failure status returned by the server.
+type sftpError struct {
+	code uint32
+	msg  string
+}
+
+func (e *sftpError) Error() string {
+	return fmt.Sprintf("SFTP error %d: %s", e.code, e.msg)
+}
+
+func isSFTPStatus(err error, code uint32) bool {
+	serr, ok := errors.Cause(err).(*sftpError)
+	return ok && serr.code == code
+}
+
+// connect opens a connection and negotiates the version of the protocol.
+func (s *SFTP) connect(ctx context.Context) (*sftpConn, error) {
+	rwc, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := &sftpConn{rwc: rwc, r: bufio.NewReader(rwc), exts: make(map[string]bool)}
+	if err := c.writePacket(sftpInit, u32(3)); err != nil {
+		rwc.Close()
+		return nil, err
+	}
+	typ, data, err := c.readPacket()
+	if err != nil {
+		rwc.Close()
+		return nil, errors.Wrapf(err, "while connecting to the SFTP server")
+	}
+	if typ != sftpVersion || len(data) < 4 {
+		rwc.Close()
+		return nil, errors.Errorf("Unexpected SFTP response %d to init", typ)
+	}
+	for data = data[4:]; len(data) > 0; {
+		var name string
+		name, data = readString(data)
+		_, data = readString(data)
+		c.exts[name] = true
+	}
+	return c, nil
+}
+
+func (c *sftpConn) Close() error {
+	return c.rwc.Close()
+}
+
+func (c *sftpConn) open(p string, flags uint32) (string, error) {
+	typ, data, err := c.request(sftpOpen, str(p), u32(flags), u32(0))
+	if err != nil {
+		return "", errors.Wrapf(err, "while opening %s", p)
+	}
+	if typ != sftpHandle {
+		return "", errors.Errorf("Unexpected SFTP response %d to open", typ)
+	}
+	h, _ := readString(data)
+	return h, nil
+}
+
+func (c *sftpConn) closeHandle(h string) error {
+	_, _, err := c.request(sftpClose, str(h))
+	return err
+}
+
+// request sends a request made of the given fields, and returns the type and the data of the
+// response, after its id. A status response is returned as an error, unless it's OK.
+func (c *sftpConn) request(typ byte, fields ...[]byte) (byte, []byte, error) {
+	c.id++
+	if err := c.writePacket(typ, append([][]byte{u32(c.id)}, fields...)...); err != nil {
+		return 0, nil, err
+	}
+	rtyp, data, err := c.readPacket()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != c.id {
+		return 0, nil, errors.Errorf("Unexpected SFTP response id")
+	}
+	data = data[4:]
+	if rtyp == sftpStatus {
+		if len(data) < 4 {
+			return 0, nil, errors.Errorf("Invalid SFTP status")
+		}
+		code := binary.BigEndian.Uint32(data)
+		if code == sftpOK {
+			return rtyp, nil, nil
+		}
+		msg, _ := readString(data[4:])
+		return 0, nil, &sftpError{code: code, msg: msg}
+	}
+	return rtyp, data, nil
+}
+
+func (c *sftpConn) writePacket(typ byte, fields ...[]byte) error {
+	n := 1
+	for _, f := range fields {
+		n += len(f)
+	}
+	buf := make([]byte, 0, 4+n)
+	buf = append(buf, u32(uint32(n))...)
+	buf = append(buf, typ)
+	for _, f := range fields {
+		buf = append(buf, f...)
+	}
+	_, err := c.rwc.Write(buf)
+	return err
+}
+
+func (c *sftpConn) readPacket() (byte, []byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == 0 || n > 1<<20 {
+		return 0, nil, errors.Errorf("Invalid SFTP packet length %d", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return 0, nil, err
+	}
+	return buf[0], buf[1:], nil
+}
+
+func str(s string) []byte {
+	return append(u32(uint32(len(s))), s...)
+}
+
+func u32(v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return b[:]
+}
+
+func u64(v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return b[:]
+}
+
+// readString reads a string, returning it and the rest of data. It returns an empty string if
+// data is too short.
+func readString(data []byte) (string, []byte) {
+	if len(data) < 4 {
+		return "", nil
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint64(len(data)-4) < uint64(n) {
+		return "", nil
+	}
+	return string(data[4 : 4+n]), data[4+n:]
+}
+
+// readAttrs reads the attributes of a file, returning whether it's a directory, and the rest of
+// data.
+func readAttrs(data []byte) (bool, []byte, error) {
+	errShort := errors.Errorf("Invalid SFTP file attributes")
+	if len(data) < 4 {
+		return false, nil, errShort
+	}
+	flags := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	skip := func(n int) bool {
+		if len(data) < n {
+			return false
+		}
+		data = data[n:]
+		return true
+	}
+	var isDir bool
+	switch {
+	case flags&sftpAttrSize != 0 && !skip(8):
+		return false, nil, errShort
+	case flags&sftpAttrUIDGID != 0 && !skip(8):
+		return false, nil, errShort
+	}
+	if flags&sftpAttrPermissions != 0 {
+		if len(data) < 4 {
+			return false, nil, errShort
+		}
+		isDir = binary.BigEndian.Uint32(data)&0170000 == 0040000
+		data = data[4:]
+	}
+	if flags&sftpAttrACModTime != 0 && !skip(8) {
+		return false, nil, errShort
+	}
+	if flags&sftpAttrExtended != 0 {
+		if len(data) < 4 {
+			return false, nil, errShort
+		}
+		count := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		for i := uint32(0); i < 2*count; i++ {
+			if len(data) < 4 {
+				return false, nil, errShort
+			}
+			_, data = readString(data)
+		}
+	}
+	return isDir, data, nil
+}
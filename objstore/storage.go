@@ -0,0 +1,158 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Storage stores backups as named objects. Local stores them in a directory, S3 in a bucket of
+// S3 or GCS, Azure in a container of Azure Blob Storage, and SFTP on an SFTP server.
+type Storage interface {
+	// Put stores the object with the given name, reading it from r. The object is only visible
+	// once Put succeeds.
+	Put(ctx context.Context, name string, r io.Reader) error
+	// Get returns a reader of the object with the given name, which the caller must close.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the sorted names of the objects with the given prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Local is a Storage in a local directory. The names of the objects are slash-separated paths
+// relative to the directory.
+type Local struct {
+	dir string
+}
+
+var _ Storage = (*Local)(nil)
+
+// NewLocal returns a Storage in the given directory.
+func NewLocal(dir string) *Local {
+	return &Local{dir: dir}
+}
+
+// Put implements Storage. The object is written to a temporary file, which is synced and renamed.
+func (l *Local) Put(ctx context.Context, name string, r io.Reader) error {
+	p := filepath.Join(l.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), filepath.Base(p)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// Get implements Storage.
+func (l *Local) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(l.dir, filepath.FromSlash(name)))
+}
+
+// List implements Storage.
+func (l *Local) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	err := filepath.Walk(l.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.dir, p)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	sort.Strings(names)
+	return names, err
+}
+
+// OpenStorage returns the Storage of the object at the given URL, and the name of the object in
+// it. The URL is s3://bucket/name for S3, gs://bucket/name for GCS, az://container/name for Azure
+// Blob Storage, sftp://[user@]host[:port]/path for SFTP, and a local path otherwise. S3, GCS and
+// Azure are configured like for Open, and the uploads use opt. SFTP runs ssh, see DialSSH. The
+// Storage of a path is its directory.
+func OpenStorage(ctx context.Context, rawurl string, opt Options) (Storage, string, error) {
+	if !strings.Contains(rawurl, "://") {
+		return NewLocal(filepath.Dir(rawurl)), filepath.Base(rawurl), nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, "", err
+	}
+	switch u.Scheme {
+	case "s3", "gs":
+		cfg, key, err := s3ConfigFromURL(u)
+		if err != nil {
+			return nil, "", err
+		}
+		cfg.Upload = opt
+		return NewS3(cfg), key, nil
+	case "az":
+		cfg, name, err := azureConfigFromURL(u)
+		if err != nil {
+			return nil, "", err
+		}
+		cfg.Upload = opt
+		return NewAzure(cfg), name, nil
+	case "sftp":
+		if u.Host == "" || u.Path == "" {
+			return nil, "", errors.Errorf("Invalid SFTP URL %q: the host or the path is missing",
+				rawurl)
+		}
+		dial, err := DialSSH(u)
+		if err != nil {
+			return nil, "", err
+		}
+		dir, name := path.Split(u.Path)
+		return NewSFTP(dir, dial), name, nil
+	case "file":
+		return NewLocal(filepath.Dir(u.Path)), filepath.Base(u.Path), nil
+	default:
+		return nil, "", errors.Errorf("Unsupported URL scheme %q", u.Scheme)
+	}
+}
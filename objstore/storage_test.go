@@ -0,0 +1,288 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testStorage(t *testing.T, st Storage) {
+	ctx := context.Background()
+	put := func(name string, size int) []byte {
+		data := make([]byte, size)
+		rand.Read(data)
+		require.NoError(t, st.Put(ctx, name, bytes.NewReader(data)))
+		return data
+	}
+	get := func(name string) ([]byte, error) {
+		r, err := st.Get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+
+	put("a/1.bak", 10)
+	a2 := put("a/2.bak", 100<<10+7)
+	b := put("b.bak", 0)
+	// Put replaces the existing objects.
+	a1 := put("a/1.bak", 40<<10)
+
+	for name, data := range map[string][]byte{"a/1.bak": a1, "a/2.bak": a2, "b.bak": b} {
+		got, err := get(name)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(data, got), name)
+	}
+	_, err := get("c.bak")
+	require.Error(t, err)
+
+	names, err := st.List(ctx, "a/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/1.bak", "a/2.bak"}, names)
+	names, err = st.List(ctx, "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/1.bak", "a/2.bak", "b.bak"}, names)
+}
+
+func TestLocalStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objstore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	testStorage(t, NewLocal(dir))
+}
+
+func TestS3Storage(t *testing.T) {
+	srv := &s3Server{parts: make(map[int][]byte), objects: make(map[string][]byte)}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	testStorage(t, NewS3(S3Config{Endpoint: ts.URL, Region: "auto", Bucket: "bucket",
+		AccessKey: "ak", SecretKey: "sk", Upload: testOptions()}))
+}
+
+func TestAzureStorage(t *testing.T) {
+	srv := &azureServer{blocks: make(map[string][]byte), objects: make(map[string][]byte)}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	testStorage(t, NewAzure(AzureConfig{Endpoint: ts.URL, Account: "account",
+		Container: "container", Key: "a2V5", Upload: testOptions()}))
+}
+
+func TestSFTPStorage(t *testing.T) {
+	srv := &sftpServer{files: make(map[string][]byte), dirs: map[string]bool{"/": true}}
+	testStorage(t, NewSFTP("/backups", func(ctx context.Context) (io.ReadWriteCloser, error) {
+		client, server := net.Pipe()
+		go srv.serve(server)
+		return client, nil
+	}))
+	require.True(t, srv.dirs["/backups/a"])
+}
+
+func TestOpenStorage(t *testing.T) {
+	ctx := context.Background()
+	st, name, err := OpenStorage(ctx, "/tmp/dir/backup.bak", DefaultOptions())
+	require.NoError(t, err)
+	require.Equal(t, &Local{dir: "/tmp/dir"}, st)
+	require.Equal(t, "backup.bak", name)
+
+	st, name, err = OpenStorage(ctx, "gs://bucket/dir/backup.bak", DefaultOptions())
+	require.NoError(t, err)
+	require.Equal(t, "https://storage.googleapis.com", st.(*S3).cfg.Endpoint)
+	require.Equal(t, "dir/backup.bak", name)
+
+	st, name, err = OpenStorage(ctx, "az://container/dir/backup.bak", DefaultOptions())
+	require.NoError(t, err)
+	require.Equal(t, "container", st.(*Azure).cfg.Container)
+	require.Equal(t, "dir/backup.bak", name)
+
+	st, name, err = OpenStorage(ctx, "sftp://user@host:2222/dir/backup.bak", DefaultOptions())
+	require.NoError(t, err)
+	require.Equal(t, "/dir/", st.(*SFTP).dir)
+	require.Equal(t, "backup.bak", name)
+
+	_, _, err = OpenStorage(ctx, "sftp://-oProxyCommand=x/dir/backup.bak", DefaultOptions())
+	require.Error(t, err)
+	_, _, err = OpenStorage(ctx, "sftp://-oProxyCommand=x@host/dir/backup.bak", DefaultOptions())
+	require.Error(t, err)
+
+	_, _, err = OpenStorage(ctx, "ftp://host/backup.bak", DefaultOptions())
+	require.Error(t, err)
+}
+
+// sftpServer implements the subset of the SFTP protocol used by SFTP, in memory.
+type sftpServer struct {
+	sync.Mutex
+	files   map[string][]byte
+	dirs    map[string]bool
+	handles map[string]string
+	next    int
+}
+
+func (s *sftpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			return
+		}
+		pkt := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+		if _, err := io.ReadFull(conn, pkt); err != nil {
+			return
+		}
+		s.Lock()
+		typ, resp := s.handle(pkt[0], pkt[1:])
+		s.Unlock()
+		out := append(u32(uint32(len(resp)+1)), typ)
+		if _, err := conn.Write(append(out, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *sftpServer) handle(typ byte, data []byte) (byte, []byte) {
+	if typ == sftpInit {
+		return sftpVersion, append(u32(3), append(str(sftpPosixRename), str("1")...)...)
+	}
+	id := data[:4]
+	data = data[4:]
+	status := func(code uint32) (byte, []byte) {
+		resp := append(append([]byte{}, id...), u32(code)...)
+		return sftpStatus, append(resp, append(str("msg"), str("")...)...)
+	}
+	reply := func(typ byte, fields ...[]byte) (byte, []byte) {
+		resp := append([]byte{}, id...)
+		for _, f := range fields {
+			resp = append(resp, f...)
+		}
+		return typ, resp
+	}
+	newHandle := func(p string) string {
+		if s.handles == nil {
+			s.handles = make(map[string]string)
+		}
+		s.next++
+		h := fmt.Sprintf("h%d", s.next)
+		s.handles[h] = p
+		return h
+	}
+	arg, rest := readString(data)
+	switch typ {
+	case sftpOpen:
+		if !s.dirs[path.Dir(arg)] {
+			return status(2)
+		}
+		flags := binary.BigEndian.Uint32(rest)
+		if _, ok := s.files[arg]; !ok && flags&sftpFlagCreat == 0 {
+			return status(2)
+		}
+		if flags&sftpFlagTrunc != 0 || s.files[arg] == nil {
+			s.files[arg] = []byte{}
+		}
+		return reply(sftpHandle, str(newHandle(arg)))
+	case sftpClose:
+		delete(s.handles, arg)
+		return status(sftpOK)
+	case sftpWrite:
+		p := s.handles[arg]
+		off := binary.BigEndian.Uint64(rest)
+		chunk, _ := readString(rest[8:])
+		f := s.files[p]
+		for uint64(len(f)) < off+uint64(len(chunk)) {
+			f = append(f, 0)
+		}
+		copy(f[off:], chunk)
+		s.files[p] = f
+		return status(sftpOK)
+	case sftpRead:
+		f := s.files[s.handles[arg]]
+		off := binary.BigEndian.Uint64(rest)
+		n := uint64(binary.BigEndian.Uint32(rest[8:]))
+		if off >= uint64(len(f)) {
+			return status(sftpEOF)
+		}
+		if off+n > uint64(len(f)) {
+			n = uint64(len(f)) - off
+		}
+		return reply(sftpData, str(string(f[off:off+n])))
+	case sftpMkdir:
+		if s.dirs[arg] || !s.dirs[path.Dir(arg)] {
+			return status(4)
+		}
+		s.dirs[arg] = true
+		return status(sftpOK)
+	case sftpRemove:
+		delete(s.files, arg)
+		return status(sftpOK)
+	case sftpExtended:
+		oldpath, rest := readString(rest)
+		newpath, _ := readString(rest)
+		s.files[newpath] = s.files[oldpath]
+		delete(s.files, oldpath)
+		return status(sftpOK)
+	case sftpOpendir:
+		if !s.dirs[arg] {
+			return status(2)
+		}
+		return reply(sftpHandle, str(newHandle(arg+"/")))
+	case sftpReaddir:
+		dir := s.handles[arg]
+		if strings.HasSuffix(dir, "//") {
+			return status(sftpEOF)
+		}
+		s.handles[arg] = dir + "/"
+		var entries []string
+		for p := range s.files {
+			if path.Dir(p)+"/" == dir {
+				entries = append(entries, path.Base(p))
+			}
+		}
+		for p := range s.dirs {
+			if p != "/" && path.Dir(p)+"/" == dir {
+				entries = append(entries, path.Base(p)+"/")
+			}
+		}
+		sort.Strings(entries)
+		fields := [][]byte{u32(uint32(len(entries)))}
+		for _, e := range entries {
+			mode := uint32(0100644)
+			if strings.HasSuffix(e, "/") {
+				mode = 0040755
+			}
+			e = strings.TrimSuffix(e, "/")
+			fields = append(fields, str(e), str(e), u32(sftpAttrPermissions), u32(mode))
+		}
+		return reply(sftpName, fields...)
+	default:
+		return status(8)
+	}
+}
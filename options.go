@@ -68,9 +68,10 @@ type Options struct {
 	TableSizeMultiplier int
 	MaxLevels           int
 
-	VLogPercentile float64
-	ValueThreshold int64
-	NumMemtables   int
+	VLogPercentile         float64
+	AdaptiveValueThreshold bool
+	ValueThreshold         int64
+	NumMemtables           int
 	// Changing BlockSize across DB runs will not break badger. The block size is
 	// read from the block index stored at the end of the table.
 	BlockSize          int
@@ -85,6 +86,8 @@ type Options struct {
 	ValueLogMaxEntries uint32
 
 	NumCompactors        int
+	CompactionThroughput int64
+	BackgroundThroughput int64
 	CompactL0OnClose     bool
 	LmaxCompaction       bool
 	ZSTDCompressionLevel int
@@ -112,6 +115,13 @@ type Options struct {
 	// conflict detection is disabled.
 	DetectConflicts bool
 
+	// TxnTimeout is the duration after which an open read-write transaction is discarded.
+	TxnTimeout time.Duration
+
+	// ReportConflictKeys makes the failed commits return a ConflictError, which holds the key the
+	// conflict is on, in place of ErrConflict.
+	ReportConflictKeys bool
+
 	// NamespaceOffset specifies the offset from where the next 8 bytes contains the namespace.
 	NamespaceOffset int
 
@@ -119,6 +129,44 @@ type Options struct {
 	// with incompatible data format.
 	ExternalMagicVersion uint16
 
+	// MergeFuncs are the merge functions applied to the operands written via Txn.Merge.
+	MergeFuncs []NamedMergeFunc
+
+	// OnExpire is called when an expired key is skipped by a read or purged by a compaction.
+	OnExpire func(key []byte, meta byte)
+
+	// CompactionFilter is called by the compactions to drop or rewrite the entries they rewrite.
+	CompactionFilter CompactionFilter
+
+	// LogArchiveDir is the directory the value log files are archived to once they're rotated.
+	LogArchiveDir string
+
+	// AutoGC schedules the value log GC. See WithAutoGC.
+	AutoGC GCPolicy
+
+	// TrackVlogSpace tracks the values of the value log overwritten or deleted by the writes.
+	TrackVlogSpace bool
+
+	// ValueLogTiering moves the old value log files to a colder directory. See
+	// WithValueLogTiering.
+	ValueLogTiering VlogTiering
+
+	// ValueLogPunchHoles makes the value log GC deallocate the stale regions of the value log
+	// files in place. See WithValueLogPunchHoles.
+	ValueLogPunchHoles bool
+
+	// ValueLogReencrypt makes the value log GC rewrite the files encrypted with retired data keys
+	// when there's nothing else to rewrite. See WithValueLogReencrypt.
+	ValueLogReencrypt bool
+
+	// BlobThreshold is the size from which the values are stored in their own blob files instead
+	// of the value log files. See WithBlobThreshold.
+	BlobThreshold int64
+
+	// SalvageLogTail makes the DB keep the valid entries found past corrupted data at the end of
+	// the log files when it's opened. See WithSalvageLogTail.
+	SalvageLogTail bool
+
 	// Transaction start and commit timestamps are managed by end-user.
 	// This is only useful for databases built on top of Badger (like Dgraph).
 	// Not recommended for most users.
@@ -392,6 +440,8 @@ func (opt Options) WithValueDir(val string) Options {
 // When set to true, Badger would call an additional msync after writes to flush mmap buffer over to
 // disk to survive hard reboots. Most users of Badger should not need to do this.
 //
+// SyncWrites can be overridden for individual transactions and write batches via WriteOptions.
+//
 // The default value of SyncWrites is false.
 func (opt Options) WithSyncWrites(val bool) Options {
 	opt.SyncWrites = val
@@ -526,6 +576,22 @@ func (opt Options) WithVLogPercentile(t float64) Options {
 	return opt
 }
 
+// WithAdaptiveValueThreshold returns a new Options value with AdaptiveValueThreshold set to the
+// given value.
+//
+// When AdaptiveValueThreshold is set, the value threshold is adjusted every 10000 values written,
+// within the range of [ValueThreshold, Options.maxValueThreshold], like with VLogPercentile, which
+// it overrides. It's set to a percentile of the sizes of the values written since the previous
+// adjustment, which follows the share of reads among the values recently read and written: from
+// 0.5 for a workload only writing values, which moves half of them to the value log to save
+// compaction work, to 0.99 for one only reading them, which saves value log reads.
+//
+// The default value of AdaptiveValueThreshold is false.
+func (opt Options) WithAdaptiveValueThreshold(b bool) Options {
+	opt.AdaptiveValueThreshold = b
+	return opt
+}
+
 // WithNumMemtables returns a new Options value with NumMemtables set to the given value.
 //
 // NumMemtables sets the maximum number of tables to keep in memory before stalling.
@@ -625,6 +691,39 @@ func (opt Options) WithNumCompactors(val int) Options {
 	return opt
 }
 
+// WithCompactionThroughput returns a new Options value with CompactionThroughput set to the given
+// value.
+//
+// CompactionThroughput limits the rate, in bytes per second, at which compactions write tables.
+// This reduces the impact of compactions on the disk bandwidth available to the application, at
+// the cost of slower compactions, which might eventually cause writes to stall. The tables are
+// charged once to the limiter of BackgroundThroughput, at the lower of the two rates, so they
+// also delay the rest of the background work. A value of zero disables the limit.
+//
+// The default value of CompactionThroughput is 0.
+func (opt Options) WithCompactionThroughput(val int64) Options {
+	opt.CompactionThroughput = val
+	return opt
+}
+
+// WithBackgroundThroughput returns a new Options value with BackgroundThroughput set to the given
+// value.
+//
+// BackgroundThroughput limits the rate, in bytes per second, of the I/O shared by all the
+// background work: the entries read and the tables written by the compactions, and the tables
+// written by the memtable flushes. This keeps the background work from taking over the disk on
+// small machines, at the cost of the foreground latency of the writes, which stall once the
+// flushes or the compactions fall behind. Each byte is counted once, and CompactionThroughput
+// further limits the tables written by the compactions. It can be changed while the DB is open
+// via SetOptions.
+// A value of zero disables the limit.
+//
+// The default value of BackgroundThroughput is 0.
+func (opt Options) WithBackgroundThroughput(val int64) Options {
+	opt.BackgroundThroughput = val
+	return opt
+}
+
 // WithCompactL0OnClose determines whether Level 0 should be compacted before closing the DB.  This
 // ensures that both reads and writes are efficient when the DB is opened later.
 //
@@ -790,6 +889,39 @@ func (opt Options) WithDetectConflicts(b bool) Options {
 	return opt
 }
 
+// WithTxnTimeout returns a new Options value with TxnTimeout set to the given value.
+//
+// TxnTimeout sets the maximum duration a read-write transaction can stay open. An open transaction
+// keeps the versions it can read from being discarded by compactions and value log GC, so a single
+// leaked transaction can make the DB grow indefinitely. Once the timeout expires, the transaction
+// is discarded and a warning is logged along with the stack trace of its creation. Any further
+// Get, Set, Delete or Commit on it returns ErrTxnTimeout. Discard must still be called as usual.
+//
+// This option has no effect in managed mode, where the application controls which versions can be
+// discarded via SetDiscardTs.
+//
+// The default value of TxnTimeout is 0, which means transactions never time out.
+func (opt Options) WithTxnTimeout(d time.Duration) Options {
+	opt.TxnTimeout = d
+	return opt
+}
+
+// WithReportConflictKeys returns a new Options value with ReportConflictKeys set to the given
+// value.
+//
+// When ReportConflictKeys is set, the commits which fail because of a conflict return a
+// *ConflictError in place of ErrConflict, holding the key read by the transaction which was
+// written by a concurrent commit. This helps finding out the hot keys causing contention. The
+// transactions keep a copy of each key they read for it, so it is meant for debugging. Use
+// errors.Cause(err) == ErrConflict, or errors.Is(err, ErrConflict), to check for conflicts when it
+// is set.
+//
+// The default value of ReportConflictKeys is false.
+func (opt Options) WithReportConflictKeys(b bool) Options {
+	opt.ReportConflictKeys = b
+	return opt
+}
+
 // WithNamespaceOffset returns a new Options value with NamespaceOffset set to the given value. DB
 // will expect the namespace in each key at the 8 bytes starting from NamespaceOffset. A negative
 // value means that namespace is not stored in the key.
@@ -800,6 +932,213 @@ func (opt Options) WithNamespaceOffset(offset int) Options {
 	return opt
 }
 
+// WithMergeFunc returns a new Options value with a merge function registered for the keys with the
+// given prefix. The name identifies the merge function in errors.
+//
+// The operands written via Txn.Merge to keys with the prefix are collapsed by compactions, which
+// persist the merged value, and by reads, which merge the operands not collapsed yet. As
+// compactions might only see some of the operands of a key, f must be associative, i.e.
+// f(f(a, b), c) must be equal to f(a, f(b, c)).
+//
+// The same merge functions must be registered every time the DB is opened. The prefixes of
+// different merge functions must not overlap, otherwise Open fails.
+func (opt Options) WithMergeFunc(name string, prefix []byte, f MergeFunc) Options {
+	funcs := make([]NamedMergeFunc, len(opt.MergeFuncs), len(opt.MergeFuncs)+1)
+	copy(funcs, opt.MergeFuncs)
+	opt.MergeFuncs = append(funcs, NamedMergeFunc{Name: name, Prefix: prefix, Merge: f})
+	return opt
+}
+
+// WithOnExpire returns a new Options value with OnExpire set to the given value.
+//
+// OnExpire is called with the key and the user meta of an expired version of the key, when a read
+// skips the version or a compaction purges it. This allows the applications to invalidate the
+// state derived from the expired keys without polling. OnExpire might be called more than once for
+// the same version, and is called from the read and compaction paths, so it must not block. The
+// key must not be used after OnExpire returns.
+//
+// The default value of OnExpire is nil.
+func (opt Options) WithOnExpire(f func(key []byte, meta byte)) Options {
+	opt.OnExpire = f
+	return opt
+}
+
+// WithCompactionFilter returns a new Options value with CompactionFilter set to the given value.
+//
+// CompactionFilter is called for the versions rewritten by the compactions which are visible to
+// all the transactions, and can keep, drop or rewrite them. This allows purging soft-deleted
+// records, stripping legacy fields or enforcing retention policies as the data is compacted,
+// without rewriting the whole database. The filter is called from the compaction goroutines, so it
+// must be safe for concurrent use. A version which is never compacted is never filtered.
+//
+// The default value of CompactionFilter is nil.
+func (opt Options) WithCompactionFilter(f CompactionFilter) Options {
+	opt.CompactionFilter = f
+	return opt
+}
+
+// WithLogArchiveDir returns a new Options value with LogArchiveDir set to the given value.
+//
+// When LogArchiveDir is set, each value log file is copied to a new segment in LogArchiveDir once
+// it's rotated, along with snapshots of the MANIFEST and of the key registry. The segments are
+// recorded in the ARCHIVE.json manifest of the directory. The values below ValueThreshold, which
+// are kept in the LSM tree, are written to the value log as well, so that the segments hold all
+// the writes. DB.LoadLogArchive replays them on top of the last full backup, which loses at most
+// the writes of the value log file being written. That file is archived once the DB is reopened.
+// The segments are encrypted like the value log, with the data keys of the key registry.
+//
+// Archiving can't be used in InMemory or managed mode, or with BlobThreshold set. A failed
+// archiving is retried every second, and its error is returned by DB.Close if it didn't succeed
+// by then.
+//
+// The default value of LogArchiveDir is "", which disables archiving.
+func (opt Options) WithLogArchiveDir(dir string) Options {
+	opt.LogArchiveDir = dir
+	return opt
+}
+
+// GCPolicy is the policy of the value log GC scheduled by the DB itself. See WithAutoGC.
+type GCPolicy struct {
+	// DiscardRatio is passed to DB.RunValueLogGC. It defaults to 0.5.
+	DiscardRatio float64
+	// Interval is the time between two runs. The GC is disabled if it's zero.
+	Interval time.Duration
+	// MaxDurationPerRun bounds the time spent by a run rewriting value log files, one after the
+	// other. A rewrite still running once it's exceeded is stopped, and resumed by the next run.
+	// Zero rewrites all the files which have enough to discard.
+	MaxDurationPerRun time.Duration
+	// IdleOnly skips the runs when the DB served any read or write since the previous one.
+	// Otherwise, they're only skipped when writes stalled since the previous one.
+	IdleOnly bool
+	// TargetSpaceAmp, if set, makes the runs rewrite the files with the most dead bytes until the
+	// space amplification of the value log is at most TargetSpaceAmp, with
+	// DB.RunValueLogGCForSpaceAmp, instead of using DiscardRatio. It must be at least 1.
+	TargetSpaceAmp float64
+}
+
+// WithAutoGC returns a new Options value with AutoGC set to the given value.
+//
+// When AutoGC.Interval is set, the DB runs the value log GC every Interval, rewriting the files
+// which have at least DiscardRatio of their data to discard until there are no more, or
+// MaxDurationPerRun is exceeded. The runs are skipped while the DB is under load, as told by the
+// write stalls, or by any read and write with IdleOnly, and while the DB is frozen or its
+// compactions are paused. Applications no longer need to call DB.RunValueLogGC themselves, though
+// they still can.
+//
+// The default value of AutoGC is the zero GCPolicy, which disables it. It's ignored for
+// in-memory DBs, which have no value log.
+func (opt Options) WithAutoGC(policy GCPolicy) Options {
+	opt.AutoGC = policy
+	return opt
+}
+
+// WithTrackVlogSpace returns a new Options value with TrackVlogSpace set to the given value.
+//
+// The dead bytes of the value log reported by DB.Metrics are otherwise the discard stats, which
+// are only updated once the compactions drop the overwritten and deleted versions of the keys.
+// When TrackVlogSpace is set, the latest version of each key written is looked up before the
+// write, and its value is counted as dead right away if it's in the value log. This costs a
+// lookup per write, and is only done if NumVersionsToKeep is 1, since the older versions are kept
+// otherwise.
+//
+// The default value of TrackVlogSpace is false.
+func (opt Options) WithTrackVlogSpace(b bool) Options {
+	opt.TrackVlogSpace = b
+	return opt
+}
+
+// VlogTiering is the policy moving the value log files to a colder directory. See
+// WithValueLogTiering.
+type VlogTiering struct {
+	// ColdDir is the directory the cold value log files are moved to, typically on a slower and
+	// cheaper disk. Tiering is disabled if it's empty.
+	ColdDir string
+	// ColdAfter moves the files last written to more than ColdAfter ago.
+	ColdAfter time.Duration
+	// HotBytes moves the oldest files, once the newer ones add up to more than HotBytes.
+	HotBytes int64
+	// Interval is the time between two checks for files to move. It defaults to a minute.
+	Interval time.Duration
+}
+
+// WithValueLogTiering returns a new Options value with ValueLogTiering set to the given value.
+//
+// When ValueLogTiering.ColdDir is set, the value log files which are older than ColdAfter, or
+// beyond the newest HotBytes of value log files, are moved to ColdDir. The moved files are still
+// read from as usual, and rewritten by the value log GC: only the latency of the reads of their
+// values changes. An object store can be used as ColdDir through a filesystem mounting it, as the
+// files are memory-mapped. DB.MoveColdValueLogFiles moves the files right away. The files aren't
+// moved while there are active iterators, or while the DB is frozen.
+//
+// The default value of ValueLogTiering is the zero VlogTiering, which disables it.
+func (opt Options) WithValueLogTiering(tiering VlogTiering) Options {
+	opt.ValueLogTiering = tiering
+	return opt
+}
+
+// WithValueLogPunchHoles returns a new Options value with ValueLogPunchHoles set to the given
+// value.
+//
+// When ValueLogPunchHoles is set, the value log GC punches holes in the file it picks, with
+// fallocate(FALLOC_FL_PUNCH_HOLE), over the runs of stale entries, instead of rewriting its live
+// entries to the head of the value log. The disk space of the stale values is reclaimed without
+// writing anything but the list of the holes, kept next to the file. The file is still rewritten
+// once all of it is stale, or if the filesystem can't punch holes, which is only supported on
+// Linux, by filesystems like ext4, XFS and Btrfs. Like the deletion of the rewritten files, the
+// holes are only punched while no iterator is open, and the GC returns ErrRejected otherwise.
+//
+// The default value of ValueLogPunchHoles is false.
+func (opt Options) WithValueLogPunchHoles(b bool) Options {
+	opt.ValueLogPunchHoles = b
+	return opt
+}
+
+// WithValueLogReencrypt returns a new Options value with ValueLogReencrypt set to the given value.
+//
+// The data keys encrypting the data are rotated every EncryptionKeyRotationDuration, but a value
+// log file keeps the data key it was created with until it's rewritten by the GC, which only
+// happens if it has enough to discard. When ValueLogReencrypt is set, RunValueLogGC rewrites the
+// oldest file encrypted with a retired data key, or not encrypted at all, when no file has enough
+// to discard, so that the old keys stop being needed. DB.ReencryptValueLog rewrites all of them
+// at once.
+//
+// The default value of ValueLogReencrypt is false.
+func (opt Options) WithValueLogReencrypt(b bool) Options {
+	opt.ValueLogReencrypt = b
+	return opt
+}
+
+// WithBlobThreshold returns a new Options value with BlobThreshold set to the given value.
+//
+// When BlobThreshold is set, the values of BlobThreshold bytes or more which would go to the value
+// log are each written to an immutable blob file of the value directory instead, referenced from
+// the LSM tree like the values in the value log. A blob file is deleted as soon as the compactions
+// drop the version referencing it, once no iterator is open, so huge values neither fill the value
+// log files nor make the value log GC rewrite them. DB.RunBlobGC deletes the blob files left
+// behind by a crash.
+//
+// The default value of BlobThreshold is 0, which disables the blob files.
+func (opt Options) WithBlobThreshold(val int64) Options {
+	opt.BlobThreshold = val
+	return opt
+}
+
+// WithSalvageLogTail returns a new Options value with SalvageLogTail set to the given value.
+//
+// When the DB is opened after a crash, the write-ahead logs of the memtables and the last value
+// log file are replayed up to their first torn or corrupted entry, and truncated there, or, in
+// read-only mode, fail the open with ErrTruncateNeeded. When SalvageLogTail is set, the rest of
+// the files are scanned for valid entries instead, which are kept, and the corrupted regions are
+// skipped. In read-only mode, the files are left as they are. The regions lost are logged as
+// warnings, with the number of entries salvaged. The first transaction found after a corrupted
+// region is dropped, as the region might have held some of its entries.
+//
+// The default value of SalvageLogTail is false.
+func (opt Options) WithSalvageLogTail(b bool) Options {
+	opt.SalvageLogTail = b
+	return opt
+}
+
 // WithExternalMagic returns a new Options value with ExternalMagicVersion set to the given value.
 // The DB would fail to start if either the internal or the external magic number fails validated.
 func (opt Options) WithExternalMagic(magic uint16) Options {
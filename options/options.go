@@ -31,6 +31,23 @@ const (
 	OnTableAndBlockRead
 )
 
+// SyncMode specifies which files should be synced to disk before a write is acknowledged.
+type SyncMode int
+
+const (
+	// SyncDefault indicates that the writes are synced according to Options.SyncWrites.
+	SyncDefault SyncMode = iota
+	// NoSync indicates that the writes are not synced to disk. They might be lost on a crash of the
+	// machine, but not on a crash of the process.
+	NoSync
+	// SyncVlog indicates that the value log is synced, which makes the values stored in the value
+	// log durable. The values stored along with the keys in the LSM tree are not synced.
+	SyncVlog
+	// SyncAll indicates that both the value log and the write-ahead log of the memtable are
+	// synced, which makes the writes fully durable.
+	SyncAll
+)
+
 // CompressionType specifies how a block should be compressed.
 type CompressionType uint32
 
@@ -0,0 +1,41 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pb
+
+import "time"
+
+// ExpiresAtTime returns the time at which the KV will be considered expired. The zero Time is
+// returned if the KV never expires. This is useful for KVs produced by Stream and Backup.
+func (m *KV) ExpiresAtTime() time.Time {
+	if m.GetExpiresAt() == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(m.ExpiresAt), 0)
+}
+
+// TTL returns the remaining time to live of the KV. It returns zero if the KV never expires. If
+// the KV has already expired, the returned duration is negative.
+func (m *KV) TTL() time.Duration {
+	if m.GetExpiresAt() == 0 {
+		return 0
+	}
+	ttl := time.Until(m.ExpiresAtTime())
+	if ttl == 0 {
+		ttl = -1
+	}
+	return ttl
+}
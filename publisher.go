@@ -42,6 +42,8 @@ type publisher struct {
 	subscribers map[uint64]subscriber
 	nextID      uint64
 	indexer     *trie.Trie
+	// tenants decrypts the values encrypted with the keys of their tenants.
+	tenants *tenantKeys
 }
 
 func newPublisher() *publisher {
@@ -93,11 +95,20 @@ func (p *publisher) publishUpdates(reqs requests) {
 			if len(ids) == 0 {
 				continue
 			}
+			val := y.SafeCopy(nil, e.Value)
+			if e.meta&bitTenantKey > 0 && len(e.Value) > 0 {
+				var err error
+				// The key of the tenant may have been destroyed in the meantime.
+				if val, err = p.tenants.decrypt(e.Value); err != nil {
+					continue
+				}
+			}
 			k := y.SafeCopy(nil, e.Key)
 			kv := &pb.KV{
 				Key:       y.ParseKey(k),
-				Value:     y.SafeCopy(nil, e.Value),
+				Value:     val,
 				Meta:      []byte{e.UserMeta},
+				UserMeta:  joinUserMeta(e.UserMeta, e.UserMetaExt),
 				ExpiresAt: e.ExpiresAt,
 				Version:   y.ParseTs(k),
 			}
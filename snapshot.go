@@ -0,0 +1,100 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import "sync"
+
+// Snapshot is a read-only view of the DB pinned at a read timestamp. Unlike a Txn, a Snapshot is
+// safe for concurrent use and can be held for as long as needed, across any number of read
+// transactions: the versions visible to it are not discarded by compactions until Release is
+// called.
+type Snapshot struct {
+	db     *DB
+	readTs uint64
+
+	// lock is held for reading by the running View calls, so Release waits for them.
+	lock     sync.RWMutex
+	released bool
+}
+
+// Snapshot returns a Snapshot of the DB at the current read timestamp. The caller must call
+// Release once done with it, as an unreleased snapshot keeps compactions from discarding the
+// older versions of the keys.
+//
+// Snapshot cannot be used with managed transactions. Use SnapshotAt instead.
+func (db *DB) Snapshot() *Snapshot {
+	if db.opt.managedTxns {
+		panic("Cannot use Snapshot with managedDB=true. Use SnapshotAt instead.")
+	}
+	// oracle.readTs registers the timestamp with readMark, which pins it until Release.
+	return &Snapshot{db: db, readTs: db.orc.readTs()}
+}
+
+// newReadTxnAt returns a read-only transaction at the given read timestamp. Unlike the
+// transactions returned by NewTransaction, it doesn't register readTs with the oracle, so the
+// caller must ensure the versions visible at readTs are kept around while it is in use.
+func (db *DB) newReadTxnAt(readTs uint64) *Txn {
+	txn := db.newTransaction(false, true)
+	txn.readTs = readTs
+	txn.doneRead = 1
+	return txn
+}
+
+// ReadTs returns the read timestamp of the snapshot.
+func (s *Snapshot) ReadTs() uint64 {
+	return s.readTs
+}
+
+// View executes fn with a read-only transaction reading at the snapshot's read timestamp. It can
+// be called concurrently from multiple goroutines, each getting its own transaction. View returns
+// ErrSnapshotReleased if the snapshot has already been released.
+func (s *Snapshot) View(fn func(txn *Txn) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.released {
+		return ErrSnapshotReleased
+	}
+	if s.db.IsClosed() {
+		return ErrDBClosed
+	}
+	txn := s.db.newReadTxnAt(s.readTs)
+	defer txn.Discard()
+
+	return fn(txn)
+}
+
+// NewStream creates a new Stream reading at the snapshot's read timestamp. The stream must be
+// done before the snapshot is released.
+func (s *Snapshot) NewStream() *Stream {
+	stream := s.db.newStream()
+	stream.readTs = s.readTs
+	return stream
+}
+
+// Release releases the snapshot, allowing compactions to discard the versions only visible to it.
+// It waits for the running View calls to return. Calling Release multiple times is a no-op.
+func (s *Snapshot) Release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	if !s.db.opt.managedTxns {
+		s.db.orc.readMark.Done(s.readTs)
+	}
+}
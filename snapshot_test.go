@@ -0,0 +1,87 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		for i := 0; i < 10; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte("old"), 0)
+		}
+		snap := db.Snapshot()
+		for i := 0; i < 10; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), []byte("new"), 0)
+		}
+		txnSet(t, db, []byte("key10"), []byte("new"), 0)
+
+		// The versions visible to the snapshot must not be discarded.
+		require.True(t, db.orc.discardAtOrBelow() < snap.ReadTs())
+
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				require.NoError(t, snap.View(func(txn *Txn) error {
+					for i := 0; i < 10; i++ {
+						item, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+						require.NoError(t, err)
+						require.Equal(t, []byte("old"), getItemValue(t, item))
+					}
+					_, err := txn.Get([]byte("key10"))
+					require.Equal(t, ErrKeyNotFound, err)
+					return nil
+				}))
+			}()
+		}
+		wg.Wait()
+
+		stream := snap.NewStream()
+		var count int
+		stream.Send = func(buf *z.Buffer) error {
+			list, err := BufferToKVList(buf)
+			require.NoError(t, err)
+			for _, kv := range list.Kv {
+				require.Equal(t, []byte("old"), kv.Value)
+				count++
+			}
+			return nil
+		}
+		require.NoError(t, stream.Orchestrate(context.Background()))
+		require.Equal(t, 10, count)
+
+		snap.Release()
+		snap.Release()
+		require.Equal(t, ErrSnapshotReleased, snap.View(func(txn *Txn) error { return nil }))
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("key0"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("new"), getItemValue(t, item))
+			return nil
+		}))
+	})
+}
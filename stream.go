@@ -48,6 +48,9 @@ type Stream struct {
 	// Prefix to only iterate over certain range of keys. If set to nil (default), Stream would
 	// iterate over the entire DB.
 	Prefix []byte
+	// Ranges restricts the Stream to the keys in any of the given ranges, which may be built from
+	// prefixes with PrefixStreamRange. If empty, the keys aren't restricted. Prefix still applies.
+	Ranges []StreamRange
 
 	// Number of goroutines to use for iterating over key ranges. Defaults to 8.
 	NumGo int
@@ -79,22 +82,96 @@ type Stream struct {
 	// Note: Calls to KeyToList are concurrent.
 	KeyToList func(key []byte, itr *Iterator) (*pb.KVList, error)
 
+	// TransformValue, if set, is invoked with each KV returned by KeyToList, and its value is
+	// replaced by the one returned. This lets the values be decrypted, re-encoded or compressed
+	// by the goroutines iterating over the key ranges, in parallel, rather than in Send. If
+	// TransformValue returns an error, the stream fails with it. It's not supported along with
+	// FullCopy.
+	//
+	// Note: Calls to TransformValue are concurrent.
+	TransformValue func(kv *pb.KV) ([]byte, error)
+
 	// This is the method where Stream sends the final output. All calls to Send are done by a
 	// single goroutine, i.e. logic within Send method can expect single threaded execution.
+	// Send can return ErrSlowDown to apply backpressure: the batch is taken as sent, and the
+	// Stream pauses for a while, longer each time in a row Send asks to slow down.
 	Send func(buf *z.Buffer) error
 
 	// Read data above the sinceTs. All keys with version =< sinceTs will be ignored.
 	SinceTs uint64
+	// UntilTs, if set, makes the versions above it ignored, as if the stream was reading at
+	// UntilTs. Along with SinceTs, it restricts the stream to the versions in (SinceTs, UntilTs],
+	// to ship the changes made between two timestamps. It's not supported along with FullCopy.
+	UntilTs uint64
+	// MaxVersions, if positive, makes ToList send up to MaxVersions versions of each key, going
+	// past the deletion markers and the expired versions, rather than stopping at them. The
+	// versions before one set with DiscardEarlierVersions are still not sent.
+	MaxVersions int
+	// SkipDeletedOrExpired makes ToList leave out the deletion markers and the expired versions,
+	// which it sends by default so that the receiver can tell that a key is gone.
+	SkipDeletedOrExpired bool
 	// FullCopy should be set to true only when encryption mode is same for sender and receiver.
-	FullCopy     bool
+	FullCopy bool
+
+	// Checkpoint, if set, is called after every successful call to Send with the ranges of keys
+	// all of which have been sent, so that the caller can persist it and resume the stream later
+	// on, instead of starting over. It's called by the goroutine calling Send.
+	Checkpoint func(cp *StreamCheckpoint) error
+	// Resume, if set, makes the stream skip the keys in the ranges of the checkpoint, which were
+	// sent by a previous stream. Only the keys in the other ranges are sent, as of the read
+	// timestamp of this stream. It's not supported along with FullCopy.
+	Resume *StreamCheckpoint
+
+	// MaxBytesPerSec and MaxOpsPerSec, if positive, throttle the reads of the stream to the given
+	// number of bytes scanned, and of blocks and values read from the disk, per second. This keeps
+	// a stream over a live DB, like an online backup, from starving the foreground operations of
+	// disk bandwidth.
+	MaxBytesPerSec int64
+	MaxOpsPerSec   int64
+
+	// OnProgress, if set, is called with the progress of the stream after every successful call to
+	// Send, and once the stream is done. It's called by the goroutine calling Send.
+	OnProgress func(p StreamProgress)
+
+	bytesLimiter rateLimiter
+	opsLimiter   rateLimiter
 	readTs       uint64
 	db           *DB
-	rangeCh      chan keyRange
+	rangeCh      chan *rangeProgress
 	kvChan       chan *z.Buffer
 	nextStreamId uint32
 	doneMarkers  bool
 	scanned      uint64 // used to estimate the ETA for data scan.
 	numProducers int32
+
+	// progress tracks the ranges being iterated over, if Checkpoint is set. buffers maps the
+	// buffers in flight to the progress made by sending them.
+	progressMu  sync.Mutex
+	progress    []*rangeProgress
+	buffers     sync.Map
+	rangesTotal int64 // accessed atomically.
+	rangesDone  int
+	keysSent    uint64
+
+	// slowUntil is the time, in Unix nanoseconds, until which the stream is paused after Send
+	// returned ErrSlowDown. It's accessed atomically. slowDown is the length of the last pause.
+	slowUntil int64
+	slowDown  time.Duration
+}
+
+// StreamProgress reports the progress of a Stream. See Stream.OnProgress.
+type StreamProgress struct {
+	RangesDone  int // Number of key ranges iterated over and sent entirely.
+	RangesTotal int // Number of key ranges to iterate over.
+	KeysSent    uint64
+	BytesSent   uint64
+	// BytesScanned is the size of the data iterated over so far, out of about BytesEstimated.
+	BytesScanned   uint64
+	BytesEstimated uint64
+	Elapsed        time.Duration
+	// ETA is the estimated time left, based on the rate at which the data has been scanned so far.
+	// It's zero if unknown.
+	ETA time.Duration
 }
 
 // SendDoneMarkers when true would send out done markers on the stream. False by default.
@@ -103,7 +180,7 @@ func (st *Stream) SendDoneMarkers(done bool) {
 }
 
 // ToList is a default implementation of KeyToList. It picks up all valid versions of the key,
-// skipping over deleted or expired keys.
+// skipping over deleted or expired keys. See MaxVersions and SkipDeletedOrExpired.
 func (st *Stream) ToList(key []byte, itr *Iterator) (*pb.KVList, error) {
 	a := itr.Alloc
 	ka := a.Copy(key)
@@ -115,6 +192,15 @@ func (st *Stream) ToList(key []byte, itr *Iterator) (*pb.KVList, error) {
 			// Break out on the first encounter with another key.
 			break
 		}
+		if st.MaxVersions > 0 && len(list.Kv) == st.MaxVersions {
+			break
+		}
+		if st.SkipDeletedOrExpired && item.IsDeletedOrExpired() {
+			if st.MaxVersions > 0 && !item.DiscardEarlierVersions() {
+				continue
+			}
+			break
+		}
 
 		kv := y.NewKV(a)
 		kv.Key = ka
@@ -130,14 +216,16 @@ func (st *Stream) ToList(key []byte, itr *Iterator) (*pb.KVList, error) {
 		kv.ExpiresAt = item.ExpiresAt()
 		// As we do full copy, we need to transmit only if it is a delete key or not.
 		kv.Meta = []byte{item.meta & bitDelete}
-		kv.UserMeta = a.Copy([]byte{item.UserMeta()})
+		kv.UserMeta = a.Copy(joinUserMeta(item.UserMeta(), item.UserMetaExt()))
 
 		list.Kv = append(list.Kv, kv)
-		if st.db.opt.NumVersionsToKeep == 1 {
+		if item.DiscardEarlierVersions() {
 			break
 		}
-
-		if item.DiscardEarlierVersions() {
+		if st.MaxVersions > 0 {
+			continue
+		}
+		if st.db.opt.NumVersionsToKeep == 1 {
 			break
 		}
 		if item.IsDeletedOrExpired() {
@@ -153,7 +241,7 @@ func (st *Stream) ToList(key []byte, itr *Iterator) (*pb.KVList, error) {
 // keyRange is [start, end), including start, excluding end. Do ensure that the start,
 // end byte slices are owned by keyRange struct.
 func (st *Stream) produceRanges(ctx context.Context) {
-	ranges := st.db.Ranges(st.Prefix, 16)
+	ranges := st.db.ranges(st.Prefix, 16)
 	y.AssertTrue(len(ranges) > 0)
 	y.AssertTrue(ranges[0].left == nil)
 	y.AssertTrue(ranges[len(ranges)-1].right == nil)
@@ -163,8 +251,43 @@ func (st *Stream) produceRanges(ctx context.Context) {
 	sort.Slice(ranges, func(i, j int) bool {
 		return ranges[i].size > ranges[j].size
 	})
+	var done []StreamRange
+	if st.Resume != nil {
+		done = mergeStreamRanges(append([]StreamRange{}, st.Resume.Done...))
+	}
+	var selected []StreamRange
+	if len(st.Ranges) > 0 {
+		selected = mergeStreamRanges(append([]StreamRange{}, st.Ranges...))
+	}
+	// Pick up the parts of the ranges left to iterate over upfront, so that their number is known.
+	parts := make([][]*rangeProgress, len(ranges))
+	var numParts int
+	for i, r := range ranges {
+		for _, rem := range remainingRanges(*r, done) {
+			for _, kr := range intersectRanges(rem, selected) {
+				parts[i] = append(parts[i], &rangeProgress{kr: kr})
+			}
+		}
+		numParts += len(parts[i])
+	}
+	if st.tracksProgress() {
+		st.progressMu.Lock()
+		for _, rp := range parts {
+			st.progress = append(st.progress, rp...)
+		}
+		st.progressMu.Unlock()
+	}
+	atomic.StoreInt64(&st.rangesTotal, int64(numParts))
+
 	for i, r := range ranges {
-		st.rangeCh <- *r
+		for _, p := range parts[i] {
+			select {
+			case st.rangeCh <- p:
+			case <-ctx.Done():
+				close(st.rangeCh)
+				return
+			}
+		}
 		st.db.opt.Infof("Sent range %d for iteration: [%x, %x) of size: %s\n",
 			i, r.left, r.right, humanize.IBytes(uint64(r.size)))
 	}
@@ -184,15 +307,25 @@ func (st *Stream) produceKVs(ctx context.Context, itr *Iterator) error {
 		outList.Release()
 	}()
 
-	iterate := func(kr keyRange) error {
+	iterate := func(p *rangeProgress) error {
+		kr := p.kr
 		itr.Alloc = z.NewAllocator(1<<20, "Stream.Iterate")
 		defer itr.Alloc.Release()
 
 		// This unique stream id is used to identify all the keys from this iteration.
 		streamId := atomic.AddUint32(&st.nextStreamId, 1)
 		var scanned int
+		throttled, throttledOps := itr.scanned, diskReads(itr)
+		var keys uint64 // Number of keys added to outList.
 
-		sendIt := func() error {
+		// doneKey is the last key all the KVs of which have been added to outList.
+		var doneKey []byte
+		sendIt := func(complete bool) error {
+			if err := st.waitSlowDown(ctx); err != nil {
+				return err
+			}
+			st.trackBuffer(outList, p, doneKey, complete, keys)
+			keys = 0
 			select {
 			case st.kvChan <- outList:
 				outList = z.NewBuffer(2*batchSize, "Stream.ProduceKVs")
@@ -212,6 +345,7 @@ func (st *Stream) produceKVs(ctx context.Context, itr *Iterator) error {
 				itr.Next()
 				continue
 			}
+			doneKey = append(doneKey[:0], prevKey...)
 			prevKey = append(prevKey[:0], item.Key()...)
 
 			// Check if we reached the end of the key range.
@@ -227,6 +361,12 @@ func (st *Stream) produceKVs(ctx context.Context, itr *Iterator) error {
 			// Now convert to key value.
 			itr.Alloc.Reset()
 			list, err := st.KeyToList(item.KeyCopy(nil), itr)
+			if st.MaxBytesPerSec > 0 || st.MaxOpsPerSec > 0 {
+				st.bytesLimiter.wait(int64(itr.scanned - throttled))
+				ops := diskReads(itr)
+				st.opsLimiter.wait(int64(ops - throttledOps))
+				throttled, throttledOps = itr.scanned, ops
+			}
 			if err != nil {
 				st.db.opt.Warningf("While reading key: %x, got error: %v", item.Key(), err)
 				continue
@@ -234,13 +374,19 @@ func (st *Stream) produceKVs(ctx context.Context, itr *Iterator) error {
 			if list == nil || len(list.Kv) == 0 {
 				continue
 			}
+			keys++
 			for _, kv := range list.Kv {
+				if st.TransformValue != nil && kv.Kind == pb.KV_KEY {
+					if kv.Value, err = st.TransformValue(kv); err != nil {
+						return errors.Wrapf(err, "while transforming the value of key: %x", kv.Key)
+					}
+				}
 				kv.StreamId = streamId
 				KVToBuffer(kv, outList)
 				if outList.LenNoPadding() < batchSize {
 					continue
 				}
-				if err := sendIt(); err != nil {
+				if err := sendIt(false); err != nil {
 					return err
 				}
 			}
@@ -253,17 +399,17 @@ func (st *Stream) produceKVs(ctx context.Context, itr *Iterator) error {
 			}
 			KVToBuffer(kv, outList)
 		}
-		return sendIt()
+		return sendIt(true)
 	}
 
 	for {
 		select {
-		case kr, ok := <-st.rangeCh:
+		case p, ok := <-st.rangeCh:
 			if !ok {
 				// Done with the keys.
 				return nil
 			}
-			if err := iterate(kr); err != nil {
+			if err := iterate(p); err != nil {
 				return err
 			}
 		case <-ctx.Done():
@@ -272,6 +418,46 @@ func (st *Stream) produceKVs(ctx context.Context, itr *Iterator) error {
 	}
 }
 
+// diskReads returns the number of blocks and values read from the disk by itr.
+func diskReads(itr *Iterator) uint64 {
+	stats := itr.Stats()
+	return stats.BlocksRead - stats.BlockCacheHits + stats.ValueLogReads
+}
+
+const (
+	minStreamSlowDown = 10 * time.Millisecond
+	maxStreamSlowDown = time.Second
+)
+
+// pause pauses the stream after Send returned ErrSlowDown, twice as long as the last time if the
+// previous call to Send asked to slow down too.
+func (st *Stream) pause() {
+	st.slowDown *= 2
+	if st.slowDown < minStreamSlowDown {
+		st.slowDown = minStreamSlowDown
+	}
+	if st.slowDown > maxStreamSlowDown {
+		st.slowDown = maxStreamSlowDown
+	}
+	atomic.StoreInt64(&st.slowUntil, time.Now().Add(st.slowDown).UnixNano())
+}
+
+// waitSlowDown blocks while the stream is paused.
+func (st *Stream) waitSlowDown(ctx context.Context) error {
+	d := time.Until(time.Unix(0, atomic.LoadInt64(&st.slowUntil)))
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (st *Stream) streamKVs(ctx context.Context) error {
 	onDiskSize, uncompressedSize := st.db.EstimateSize(st.Prefix)
 	// Manish has seen uncompressed size to be in 20% error margin.
@@ -292,15 +478,46 @@ func (st *Stream) streamKVs(ctx context.Context) error {
 			return nil
 		}
 		bytesSent += sz
+		if err := st.waitSlowDown(ctx); err != nil {
+			return err
+		}
 		// st.db.opt.Infof("%s Sending batch of size: %s.\n", st.LogPrefix, humanize.IBytes(sz))
-		if err := st.Send(batch); err != nil {
+		err := st.Send(batch)
+		switch {
+		case errors.Cause(err) == ErrSlowDown:
+			st.pause()
+		case err != nil:
 			st.db.opt.Warningf("Error while sending: %v\n", err)
 			return err
+		default:
+			st.slowDown = 0
 		}
 		return nil
 	}
 
+	reportProgress := func(done bool) {
+		if st.OnProgress == nil {
+			return
+		}
+		p := StreamProgress{
+			RangesTotal:    int(atomic.LoadInt64(&st.rangesTotal)),
+			BytesSent:      bytesSent,
+			BytesScanned:   atomic.LoadUint64(&st.scanned),
+			BytesEstimated: uncompressedSize,
+			Elapsed:        time.Since(now),
+		}
+		st.progressMu.Lock()
+		p.RangesDone, p.KeysSent = st.rangesDone, st.keysSent
+		st.progressMu.Unlock()
+		if !done && p.BytesScanned > 0 && p.BytesScanned < p.BytesEstimated {
+			left := float64(p.BytesEstimated-p.BytesScanned) / float64(p.BytesScanned)
+			p.ETA = time.Duration(float64(p.Elapsed) * left)
+		}
+		st.OnProgress(p)
+	}
+
 	slurp := func(batch *z.Buffer) error {
+		progress := st.bufferSent(nil, batch)
 	loop:
 		for {
 			// Send the batch immediately if it already exceeds the maximum allowed size.
@@ -316,13 +533,21 @@ func (st *Stream) streamKVs(ctx context.Context) error {
 				}
 				y.AssertTrue(kvs != nil)
 				y.Check2(batch.Write(kvs.Bytes()))
+				progress = st.bufferSent(progress, kvs)
 				y.Check(kvs.Release())
 
 			default:
 				break loop
 			}
 		}
-		return sendBatch(batch)
+		if err := sendBatch(batch); err != nil {
+			return err
+		}
+		if err := st.applyProgress(progress); err != nil {
+			return err
+		}
+		reportProgress(false)
+		return nil
 	} // end of slurp.
 
 	writeRate := y.NewRateMonitor(20)
@@ -365,6 +590,7 @@ outer:
 	}
 
 	st.db.opt.Infof("%s Sent data of size %s\n", st.LogPrefix, humanize.IBytes(bytesSent))
+	reportProgress(true)
 	return nil
 }
 
@@ -447,13 +673,18 @@ func (st *Stream) copyTablesOver(ctx context.Context, tableMatrix [][]*table.Tab
 // return that error. Orchestrate can be called multiple times, but in serial order.
 func (st *Stream) Orchestrate(ctx context.Context) error {
 	if st.FullCopy {
-		if !st.db.opt.managedTxns || st.SinceTs != 0 || st.ChooseKey != nil && st.KeyToList != nil {
+		if !st.db.opt.managedTxns || st.SinceTs != 0 || st.ChooseKey != nil && st.KeyToList != nil ||
+			st.Resume != nil || len(st.Ranges) > 0 || st.TransformValue != nil || st.UntilTs != 0 {
 			panic("Got invalid stream options when doing full copy")
 		}
 	}
+	st.progress, st.rangesDone, st.keysSent = nil, 0, 0
+	st.slowUntil, st.slowDown = 0, 0
+	st.bytesLimiter.setRate(st.MaxBytesPerSec)
+	st.opsLimiter.setRate(st.MaxOpsPerSec)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	st.rangeCh = make(chan keyRange, 3) // Contains keys for posting lists.
+	st.rangeCh = make(chan *rangeProgress, 3) // Contains keys for posting lists.
 
 	// kvChan should only have a small capacity to ensure that we don't buffer up too much data if
 	// sending is slow. Page size is set to 4MB, which is used to lazily cap the size of each
@@ -546,25 +777,32 @@ func (st *Stream) Orchestrate(ctx context.Context) error {
 
 	var txn *Txn
 	if st.readTs > 0 {
-		txn = st.db.NewTransactionAt(st.readTs, false)
+		txn = st.db.newReadTxnAt(st.readTs)
 	} else {
 		txn = st.db.NewTransaction(false)
 	}
 	defer txn.Discard()
 
 	newIterator := func(threadId int) *Iterator {
+		// The stats are used to throttle the reads.
+		stats := new(iteratorStats)
 		var itrs []y.Iterator
 		for _, mt := range memTables {
 			itrs = append(itrs, mt.sl.NewUniIterator(false))
 		}
 		if tables := tableMatrix[0]; len(tables) > 0 {
-			itrs = append(itrs, iteratorsReversed(tables, 0)...)
+			for _, itr := range iteratorsReversed(tables, 0) {
+				itr.(*table.Iterator).SetStats(&stats.IteratorStats)
+				itrs = append(itrs, itr)
+			}
 		}
 		for _, tables := range tableMatrix[1:] {
 			if len(tables) == 0 {
 				continue
 			}
-			itrs = append(itrs, table.NewConcatIterator(tables, 0))
+			itr := table.NewConcatIterator(tables, 0)
+			itr.SetStats(&stats.IteratorStats)
+			itrs = append(itrs, itr)
 		}
 
 		opt := DefaultIteratorOptions
@@ -572,6 +810,7 @@ func (st *Stream) Orchestrate(ctx context.Context) error {
 		opt.Prefix = st.Prefix
 		opt.PrefetchValues = false
 		opt.SinceTs = st.SinceTs
+		opt.stats = stats
 
 		res := &Iterator{
 			txn:      txn,
@@ -580,6 +819,9 @@ func (st *Stream) Orchestrate(ctx context.Context) error {
 			readTs:   txn.readTs,
 			ThreadId: threadId,
 		}
+		if st.UntilTs > 0 && st.UntilTs < res.readTs {
+			res.readTs = st.UntilTs
+		}
 		return res
 	}
 
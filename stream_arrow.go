@@ -0,0 +1,282 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/ristretto/z"
+	fbs "github.com/google/flatbuffers/go"
+	"github.com/pkg/errors"
+)
+
+// ArrowWriter writes the KV pairs sent by a Stream in the Apache Arrow IPC streaming format, which
+// analytics engines can read directly. Every batch sent by the Stream is written as a record batch
+// of the columns:
+//
+//	key           binary
+//	version       uint64
+//	expires_at    uint64, 0 if the key doesn't expire
+//	user_meta     uint8
+//	user_meta_ext binary, see Entry.UserMetaExt
+//	value         binary
+//
+// The deletion markers sent by the Stream are skipped.
+//
+// Usage:
+//
+//	aw := NewArrowWriter(w)
+//	stream.Send = aw.Send
+//	err := stream.Orchestrate(ctx)
+//	...
+//	err = aw.Close()
+type ArrowWriter struct {
+	w           io.Writer
+	wroteSchema bool
+}
+
+// NewArrowWriter returns an ArrowWriter writing to w.
+func NewArrowWriter(w io.Writer) *ArrowWriter {
+	return &ArrowWriter{w: w}
+}
+
+// The Arrow format constants used, from Schema.fbs and Message.fbs.
+const (
+	arrowMetadataV5        = 4
+	arrowHeaderSchema      = 1
+	arrowHeaderRecordBatch = 3
+	arrowTypeInt           = 2
+	arrowTypeBinary        = 4
+)
+
+// arrowColumn describes a column: an unsigned integer of the given width read by uint, or binary
+// data read by bytes if the width is 0.
+type arrowColumn struct {
+	name     string
+	bitWidth int32
+	uint     func(kv *pb.KV) uint64
+	bytes    func(kv *pb.KV) []byte
+}
+
+var arrowColumns = []arrowColumn{
+	{name: "key", bytes: func(kv *pb.KV) []byte { return kv.Key }},
+	{name: "version", bitWidth: 64, uint: func(kv *pb.KV) uint64 { return kv.Version }},
+	{name: "expires_at", bitWidth: 64, uint: func(kv *pb.KV) uint64 { return kv.ExpiresAt }},
+	{name: "user_meta", bitWidth: 8, uint: func(kv *pb.KV) uint64 {
+		userMeta, _ := splitUserMeta(kv.UserMeta)
+		return uint64(userMeta)
+	}},
+	{name: "user_meta_ext", bytes: func(kv *pb.KV) []byte {
+		_, ext := splitUserMeta(kv.UserMeta)
+		return ext
+	}},
+	{name: "value", bytes: func(kv *pb.KV) []byte { return kv.Value }},
+}
+
+// Send writes the KV pairs in buf as a record batch. It has the signature of Stream.Send.
+func (aw *ArrowWriter) Send(buf *z.Buffer) error {
+	list, err := BufferToKVList(buf)
+	if err != nil {
+		return err
+	}
+	kvs := list.Kv[:0]
+	for _, kv := range list.Kv {
+		// Skip the done markers, the tables and keys of a full copy, and the deletion markers.
+		if kv.StreamDone || kv.Kind != pb.KV_KEY || len(kv.Meta) > 0 && kv.Meta[0]&bitDelete > 0 {
+			continue
+		}
+		kvs = append(kvs, kv)
+	}
+	if len(kvs) == 0 {
+		return nil
+	}
+	if err := aw.writeSchema(); err != nil {
+		return err
+	}
+	return aw.writeRecordBatch(kvs)
+}
+
+// Close writes the end of the stream. It doesn't close the underlying writer.
+func (aw *ArrowWriter) Close() error {
+	if err := aw.writeSchema(); err != nil {
+		return err
+	}
+	var eos [8]byte
+	binary.LittleEndian.PutUint32(eos[:], math.MaxUint32)
+	_, err := aw.w.Write(eos[:])
+	return err
+}
+
+func (aw *ArrowWriter) writeSchema() error {
+	if aw.wroteSchema {
+		return nil
+	}
+	b := fbs.NewBuilder(1024)
+	fields := make([]fbs.UOffsetT, len(arrowColumns))
+	for i, col := range arrowColumns {
+		name := b.CreateString(col.name)
+		var typ fbs.UOffsetT
+		typeType := byte(arrowTypeBinary)
+		if col.bitWidth > 0 {
+			typeType = arrowTypeInt
+			b.StartObject(2)
+			b.PrependInt32Slot(0, col.bitWidth, 0)
+			b.PrependBoolSlot(1, false, false) // is_signed
+			typ = b.EndObject()
+		} else {
+			b.StartObject(0)
+			typ = b.EndObject()
+		}
+		b.StartVector(4, 0, 4)
+		children := b.EndVector(0)
+
+		b.StartObject(7)
+		b.PrependUOffsetTSlot(0, name, 0)
+		b.PrependBoolSlot(1, false, false) // nullable
+		b.PrependByteSlot(2, typeType, 0)
+		b.PrependUOffsetTSlot(3, typ, 0)
+		b.PrependUOffsetTSlot(5, children, 0)
+		fields[i] = b.EndObject()
+	}
+	b.StartVector(4, len(fields), 4)
+	for i := len(fields) - 1; i >= 0; i-- {
+		b.PrependUOffsetT(fields[i])
+	}
+	fieldsVec := b.EndVector(len(fields))
+
+	b.StartObject(4)
+	b.PrependUOffsetTSlot(1, fieldsVec, 0)
+	schema := b.EndObject()
+
+	if err := aw.writeMessage(b, arrowHeaderSchema, schema, nil); err != nil {
+		return err
+	}
+	aw.wroteSchema = true
+	return nil
+}
+
+// arrowBody builds the body of a record batch: its buffers, each one aligned to 8 bytes.
+type arrowBody struct {
+	data    bytes.Buffer
+	buffers [][2]int64 // The offset and length of each buffer.
+}
+
+func (ab *arrowBody) add(data []byte) {
+	ab.buffers = append(ab.buffers, [2]int64{int64(ab.data.Len()), int64(len(data))})
+	ab.data.Write(data)
+	if pad := ab.data.Len() % 8; pad > 0 {
+		ab.data.Write(make([]byte, 8-pad))
+	}
+}
+
+// addBinary adds the buffers of a binary column: the validity bitmap, the offsets and the data.
+func (ab *arrowBody) addBinary(kvs []*pb.KV, get func(kv *pb.KV) []byte) error {
+	offsets := make([]byte, 4*(len(kvs)+1))
+	var data []byte
+	for i, kv := range kvs {
+		data = append(data, get(kv)...)
+		if len(data) > math.MaxInt32 {
+			return errors.Errorf("Batch of %d KVs is too big for an Arrow record batch", len(kvs))
+		}
+		binary.LittleEndian.PutUint32(offsets[4*(i+1):], uint32(len(data)))
+	}
+	ab.add(nil)
+	ab.add(offsets)
+	ab.add(data)
+	return nil
+}
+
+// addUint adds the buffers of an unsigned integer column: the validity bitmap and the data.
+func (ab *arrowBody) addUint(kvs []*pb.KV, bitWidth int32, get func(kv *pb.KV) uint64) {
+	width := int(bitWidth / 8)
+	data := make([]byte, width*len(kvs))
+	for i, kv := range kvs {
+		switch width {
+		case 1:
+			data[i] = byte(get(kv))
+		case 8:
+			binary.LittleEndian.PutUint64(data[8*i:], get(kv))
+		}
+	}
+	ab.add(nil)
+	ab.add(data)
+}
+
+func (aw *ArrowWriter) writeRecordBatch(kvs []*pb.KV) error {
+	var body arrowBody
+	for _, col := range arrowColumns {
+		if col.bitWidth > 0 {
+			body.addUint(kvs, col.bitWidth, col.uint)
+		} else if err := body.addBinary(kvs, col.bytes); err != nil {
+			return err
+		}
+	}
+
+	b := fbs.NewBuilder(1024)
+	// The vectors of structs are written backwards, and so are the fields of the structs.
+	b.StartVector(16, len(arrowColumns), 8)
+	for range arrowColumns {
+		b.Prep(8, 16)
+		b.PrependInt64(0) // null_count
+		b.PrependInt64(int64(len(kvs)))
+	}
+	nodes := b.EndVector(len(arrowColumns))
+	b.StartVector(16, len(body.buffers), 8)
+	for i := len(body.buffers) - 1; i >= 0; i-- {
+		b.Prep(8, 16)
+		b.PrependInt64(body.buffers[i][1])
+		b.PrependInt64(body.buffers[i][0])
+	}
+	buffers := b.EndVector(len(body.buffers))
+
+	b.StartObject(4)
+	b.PrependInt64Slot(0, int64(len(kvs)), 0)
+	b.PrependUOffsetTSlot(1, nodes, 0)
+	b.PrependUOffsetTSlot(2, buffers, 0)
+	batch := b.EndObject()
+	return aw.writeMessage(b, arrowHeaderRecordBatch, batch, body.data.Bytes())
+}
+
+// writeMessage finishes the message with the given header in b, and writes it along with its body,
+// in the encapsulated format: a continuation marker, the size of the metadata padded to 8 bytes,
+// the metadata and the body.
+func (aw *ArrowWriter) writeMessage(b *fbs.Builder, headerType byte, header fbs.UOffsetT,
+	body []byte) error {
+	b.StartObject(5)
+	b.PrependInt16Slot(0, arrowMetadataV5, 0)
+	b.PrependByteSlot(1, headerType, 0)
+	b.PrependUOffsetTSlot(2, header, 0)
+	b.PrependInt64Slot(3, int64(len(body)), 0)
+	b.Finish(b.EndObject())
+	meta := b.FinishedBytes()
+
+	sz := len(meta)
+	if pad := (8 + sz) % 8; pad > 0 {
+		sz += 8 - pad
+	}
+	out := make([]byte, 8+sz, 8+sz+len(body))
+	binary.LittleEndian.PutUint32(out[0:4], math.MaxUint32)
+	binary.LittleEndian.PutUint32(out[4:8], uint32(sz))
+	copy(out[8:], meta)
+	out = append(out, body...)
+	_, err := aw.w.Write(out)
+	return err
+}
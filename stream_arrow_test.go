@@ -0,0 +1,141 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	fbs "github.com/google/flatbuffers/go"
+	"github.com/stretchr/testify/require"
+)
+
+type arrowRow struct {
+	key, value, userMetaExt []byte
+	version, expiresAt      uint64
+	userMeta                byte
+}
+
+// readArrowStream decodes the rows of a stream written by ArrowWriter.
+func readArrowStream(t *testing.T, data []byte) []arrowRow {
+	var rows []arrowRow
+	var headers []byte
+	for {
+		require.Equal(t, uint32(math.MaxUint32), binary.LittleEndian.Uint32(data))
+		sz := int(binary.LittleEndian.Uint32(data[4:]))
+		if sz == 0 {
+			require.Len(t, data, 8)
+			break
+		}
+		require.Zero(t, (8+sz)%8)
+		meta := data[8 : 8+sz]
+		msg := &fbs.Table{Bytes: meta, Pos: fbs.GetUOffsetT(meta)}
+		require.Equal(t, int16(arrowMetadataV5), msg.GetInt16Slot(4, 0))
+		headerType := msg.GetByteSlot(6, 0)
+		headers = append(headers, headerType)
+		bodyLen := int(msg.GetInt64Slot(10, 0))
+		body := data[8+sz : 8+sz+bodyLen]
+		data = data[8+sz+bodyLen:]
+
+		header := &fbs.Table{Bytes: meta}
+		header.Pos = msg.Indirect(fbs.UOffsetT(msg.Offset(8)) + msg.Pos)
+		if headerType == arrowHeaderSchema {
+			o := fbs.UOffsetT(header.Offset(6))
+			require.Equal(t, len(arrowColumns), header.VectorLen(o))
+			continue
+		}
+		require.Equal(t, byte(arrowHeaderRecordBatch), headerType)
+		n := int(header.GetInt64Slot(4, 0))
+		o := fbs.UOffsetT(header.Offset(8))
+		buffers := make([][]byte, header.VectorLen(o))
+		for i := range buffers {
+			pos := header.Vector(o) + fbs.UOffsetT(16*i)
+			off := fbs.GetInt64(meta[pos:])
+			require.Zero(t, off%8)
+			buffers[i] = body[off : off+fbs.GetInt64(meta[pos+8:])]
+		}
+		require.Len(t, buffers, 15)
+		binaryAt := func(col []byte, data []byte, i int) []byte {
+			return data[binary.LittleEndian.Uint32(col[4*i:]):binary.LittleEndian.Uint32(col[4*i+4:])]
+		}
+		for i := 0; i < n; i++ {
+			rows = append(rows, arrowRow{
+				key:         binaryAt(buffers[1], buffers[2], i),
+				version:     binary.LittleEndian.Uint64(buffers[4][8*i:]),
+				expiresAt:   binary.LittleEndian.Uint64(buffers[6][8*i:]),
+				userMeta:    buffers[8][i],
+				userMetaExt: binaryAt(buffers[10], buffers[11], i),
+				value:       binaryAt(buffers[13], buffers[14], i),
+			})
+		}
+	}
+	require.Equal(t, byte(arrowHeaderSchema), headers[0])
+	sort.Slice(rows, func(i, j int) bool { return bytes.Compare(rows[i].key, rows[j].key) < 0 })
+	return rows
+}
+
+func TestStreamArrow(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("d"), []byte("vd"))
+		}))
+		txn := db.NewTransaction(true)
+		e := NewEntry([]byte("a"), []byte("va")).WithMeta(7)
+		e.UserMetaExt = []byte("ext")
+		require.NoError(t, txn.SetEntry(e))
+		require.NoError(t, txn.SetEntry(NewEntry([]byte("b"), nil)))
+		require.NoError(t, txn.SetEntry(NewEntry([]byte("c"), []byte("vc")).WithTTL(time.Hour)))
+		require.NoError(t, txn.Delete([]byte("d")))
+		require.NoError(t, txn.Commit())
+
+		var out bytes.Buffer
+		aw := NewArrowWriter(&out)
+		stream := db.NewStream()
+		stream.Send = aw.Send
+		require.NoError(t, stream.Orchestrate(ctxb))
+		require.NoError(t, aw.Close())
+
+		var expiresAt uint64
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("c"))
+			if err != nil {
+				return err
+			}
+			expiresAt = item.ExpiresAt()
+			return nil
+		}))
+		version := db.MaxVersion()
+		require.Equal(t, []arrowRow{
+			{key: []byte("a"), value: []byte("va"), version: version, userMeta: 7,
+				userMetaExt: []byte("ext")},
+			{key: []byte("b"), value: []byte{}, version: version, userMetaExt: []byte{}},
+			{key: []byte("c"), value: []byte("vc"), version: version, expiresAt: expiresAt,
+				userMetaExt: []byte{}},
+		}, readArrowStream(t, out.Bytes()))
+	})
+}
+
+func TestStreamArrowEmpty(t *testing.T) {
+	var out bytes.Buffer
+	aw := NewArrowWriter(&out)
+	require.NoError(t, aw.Close())
+	require.Empty(t, readArrowStream(t, out.Bytes()))
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// StreamCheckpoint records the progress of a Stream: the key ranges all the keys of which have been
+// sent. It can be persisted by the caller, for example as JSON, and passed as Stream.Resume to a
+// new Stream, which then skips those ranges.
+type StreamCheckpoint struct {
+	Done []StreamRange
+}
+
+// StreamRange is the range of keys [Start, End). A nil Start is the beginning of the key space,
+// and a nil End is its end.
+type StreamRange struct {
+	Start []byte
+	End   []byte
+}
+
+// PrefixStreamRange returns the range of the keys with the given prefix.
+func PrefixStreamRange(prefix []byte) StreamRange {
+	return StreamRange{Start: y.SafeCopy(nil, prefix), End: prefixEnd(prefix)}
+}
+
+// rangeProgress tracks the progress of the iteration over a key range of a Stream: the keys up
+// to next, excluded, have been sent, or all of them if complete is set.
+type rangeProgress struct {
+	kr       keyRange
+	next     []byte
+	complete bool
+}
+
+// bufferProgress is the progress of a range made by sending a buffer of KVs.
+type bufferProgress struct {
+	p        *rangeProgress
+	next     []byte
+	complete bool
+	keys     uint64
+}
+
+// endsBefore returns true if the range ends at or before key.
+func (r StreamRange) endsBefore(key []byte) bool {
+	return r.End != nil && bytes.Compare(r.End, key) <= 0
+}
+
+// mergeStreamRanges sorts the given ranges, and merges the ones which overlap or are adjacent.
+func mergeStreamRanges(ranges []StreamRange) []StreamRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].Start, ranges[j].Start) < 0
+	})
+	var out []StreamRange
+	for _, r := range ranges {
+		n := len(out)
+		if n == 0 || out[n-1].End != nil && bytes.Compare(out[n-1].End, r.Start) < 0 {
+			out = append(out, r)
+			continue
+		}
+		// The range overlaps the last one, or starts right at its end.
+		last := &out[n-1]
+		if last.End != nil && (r.End == nil || bytes.Compare(r.End, last.End) > 0) {
+			last.End = r.End
+		}
+	}
+	return out
+}
+
+// remainingRanges returns the parts of the key range kr which aren't covered by done, which must
+// be sorted and merged.
+func remainingRanges(kr keyRange, done []StreamRange) []keyRange {
+	var out []keyRange
+	cur := kr.left
+	for _, d := range done {
+		if d.endsBefore(cur) {
+			continue
+		}
+		if len(kr.right) > 0 && bytes.Compare(d.Start, kr.right) >= 0 {
+			break
+		}
+		if bytes.Compare(d.Start, cur) > 0 {
+			out = append(out, keyRange{left: cur, right: d.Start})
+		}
+		if d.End == nil {
+			return out
+		}
+		cur = d.End
+	}
+	if len(kr.right) == 0 || bytes.Compare(cur, kr.right) < 0 {
+		out = append(out, keyRange{left: cur, right: kr.right})
+	}
+	return out
+}
+
+// intersectRanges returns the parts of the key range kr which are covered by ranges, which must be
+// sorted and merged. If ranges is empty, kr is returned whole.
+func intersectRanges(kr keyRange, ranges []StreamRange) []keyRange {
+	if len(ranges) == 0 {
+		return []keyRange{kr}
+	}
+	var out []keyRange
+	for _, r := range ranges {
+		if r.endsBefore(kr.left) {
+			continue
+		}
+		if len(kr.right) > 0 && bytes.Compare(r.Start, kr.right) >= 0 {
+			break
+		}
+		part := kr
+		if bytes.Compare(r.Start, part.left) > 0 {
+			part.left = r.Start
+		}
+		if r.End != nil && (len(part.right) == 0 || bytes.Compare(r.End, part.right) < 0) {
+			part.right = r.End
+		}
+		out = append(out, keyRange{left: part.left, right: part.right})
+	}
+	return out
+}
+
+// checkpoint returns the ranges sent by the stream so far, including the ones it resumed from.
+func (st *Stream) checkpoint() *StreamCheckpoint {
+	var done []StreamRange
+	if st.Resume != nil {
+		done = append(done, st.Resume.Done...)
+	}
+	st.progressMu.Lock()
+	for _, p := range st.progress {
+		switch {
+		case p.complete:
+			done = append(done, StreamRange{Start: p.kr.left, End: p.kr.right})
+		case p.next != nil:
+			done = append(done, StreamRange{Start: p.kr.left, End: p.next})
+		}
+	}
+	st.progressMu.Unlock()
+	return &StreamCheckpoint{Done: mergeStreamRanges(done)}
+}
+
+// tracksProgress returns true if the progress of the stream is reported.
+func (st *Stream) tracksProgress() bool {
+	return st.Checkpoint != nil || st.OnProgress != nil
+}
+
+// trackBuffer records the progress made by sending buf, to which the given number of keys have
+// been added. The keys up to lastKey, included, have been added to it or to the buffers before, or
+// all the keys of the range if complete is set.
+func (st *Stream) trackBuffer(buf *z.Buffer, p *rangeProgress, lastKey []byte, complete bool,
+	keys uint64) {
+	if !st.tracksProgress() {
+		return
+	}
+	bp := bufferProgress{p: p, complete: complete, keys: keys}
+	if lastKey != nil {
+		// The smallest key after lastKey.
+		bp.next = append(append(make([]byte, 0, len(lastKey)+1), lastKey...), 0)
+	}
+	st.buffers.Store(buf, bp)
+}
+
+// bufferSent returns the progress recorded for buf, appended to progress.
+func (st *Stream) bufferSent(progress []bufferProgress, buf *z.Buffer) []bufferProgress {
+	if bp, ok := st.buffers.Load(buf); ok {
+		st.buffers.Delete(buf)
+		progress = append(progress, bp.(bufferProgress))
+	}
+	return progress
+}
+
+// applyProgress applies the progress made by sending a batch, and reports the checkpoint.
+func (st *Stream) applyProgress(progress []bufferProgress) error {
+	if !st.tracksProgress() {
+		return nil
+	}
+	st.progressMu.Lock()
+	for _, bp := range progress {
+		st.keysSent += bp.keys
+		switch {
+		case bp.complete && !bp.p.complete:
+			bp.p.complete = true
+			st.rangesDone++
+		case bp.next != nil:
+			bp.p.next = bp.next
+		}
+	}
+	st.progressMu.Unlock()
+	if st.Checkpoint == nil {
+		return nil
+	}
+	return st.Checkpoint(st.checkpoint())
+}
@@ -17,6 +17,7 @@
 package badger
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
@@ -24,12 +25,14 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/badger/v3/pb"
 	bpb "github.com/dgraph-io/badger/v3/pb"
 	"github.com/dgraph-io/badger/v3/y"
 	"github.com/dgraph-io/ristretto/z"
 	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -324,3 +327,315 @@ func TestStreamCustomKeyToList(t *testing.T) {
 	require.NoError(t, stream.Orchestrate(ctxb))
 	require.Zero(t, len(res))
 }
+
+func TestStreamCheckpoint(t *testing.T) {
+	defer func(sz uint64) { maxStreamSize = sz }(maxStreamSize)
+	// Send every buffer of KVs on its own.
+	maxStreamSize = 1
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		n := 600
+		val := make([]byte, 64<<10)
+		wb := db.NewWriteBatch()
+		for i := 0; i < n; i++ {
+			require.NoError(t, wb.Set(keyWithPrefix("key", i), val))
+		}
+		require.NoError(t, wb.Flush())
+
+		collect := func(sent map[string]int, fail int) func(buf *z.Buffer) error {
+			var sends int
+			return func(buf *z.Buffer) error {
+				if sends++; sends == fail {
+					return fmt.Errorf("send %d failed", sends)
+				}
+				list, err := BufferToKVList(buf)
+				require.NoError(t, err)
+				for _, kv := range list.Kv {
+					sent[string(kv.Key)]++
+				}
+				return nil
+			}
+		}
+
+		var cp *StreamCheckpoint
+		sent := make(map[string]int)
+		stream := db.NewStream()
+		stream.Send = collect(sent, 2)
+		stream.Checkpoint = func(c *StreamCheckpoint) error {
+			cp = c
+			return nil
+		}
+		require.Error(t, stream.Orchestrate(ctxb))
+		require.NotNil(t, cp)
+		require.Greater(t, len(sent), 0)
+		require.Less(t, len(sent), n)
+
+		resumed := make(map[string]int)
+		stream = db.NewStream()
+		stream.Send = collect(resumed, 0)
+		stream.Resume = cp
+		require.NoError(t, stream.Orchestrate(ctxb))
+
+		covered := func(key []byte) bool {
+			for _, r := range cp.Done {
+				if bytes.Compare(r.Start, key) <= 0 && (r.End == nil || bytes.Compare(key, r.End) < 0) {
+					return true
+				}
+			}
+			return false
+		}
+		var skipped int
+		for i := 0; i < n; i++ {
+			key := keyWithPrefix("key", i)
+			if covered(key) {
+				// Sent by the first stream, and skipped by the resumed one.
+				require.Equal(t, 1, sent[string(key)])
+				require.Zero(t, resumed[string(key)])
+				skipped++
+				continue
+			}
+			require.Equal(t, 1, resumed[string(key)])
+		}
+		require.Greater(t, skipped, 0)
+	})
+}
+
+func TestRemainingStreamRanges(t *testing.T) {
+	done := mergeStreamRanges([]StreamRange{
+		{Start: []byte("k"), End: []byte("m")},
+		{Start: []byte("c"), End: []byte("e")},
+		{Start: []byte("d"), End: []byte("f")},
+		{Start: []byte("m"), End: []byte("n")},
+		{Start: []byte("x")},
+	})
+	require.Equal(t, []StreamRange{
+		{Start: []byte("c"), End: []byte("f")},
+		{Start: []byte("k"), End: []byte("n")},
+		{Start: []byte("x")},
+	}, done)
+
+	require.Equal(t, []keyRange{
+		{right: []byte("c")},
+		{left: []byte("f"), right: []byte("k")},
+		{left: []byte("n"), right: []byte("x")},
+	}, remainingRanges(keyRange{}, done))
+	require.Equal(t, []keyRange{
+		{left: []byte("g"), right: []byte("k")},
+	}, remainingRanges(keyRange{left: []byte("g"), right: []byte("l")}, done))
+	require.Empty(t, remainingRanges(keyRange{left: []byte("y")}, done))
+}
+
+func TestStreamRanges(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		wb := db.NewWriteBatch()
+		for _, prefix := range []string{"p0", "p1", "p2", "p3"} {
+			for i := 0; i < 100; i++ {
+				require.NoError(t, wb.Set(keyWithPrefix(prefix, i), value(i)))
+			}
+		}
+		require.NoError(t, wb.Flush())
+
+		stream := db.NewStream()
+		stream.Ranges = []StreamRange{
+			PrefixStreamRange([]byte("p2")),
+			PrefixStreamRange([]byte("p0")),
+			{Start: []byte("p1-1"), End: []byte("p1-2")},
+		}
+		c := &collector{}
+		stream.Send = c.Send
+		require.NoError(t, stream.Orchestrate(ctxb))
+
+		m := make(map[string]int)
+		for _, kv := range c.kv {
+			prefix, _ := keyToInt(kv.Key)
+			m[prefix]++
+		}
+		// p1-1 and p1-10 to p1-19.
+		require.Equal(t, map[string]int{"p0": 100, "p1": 11, "p2": 100}, m)
+	})
+}
+
+func TestIntersectStreamRanges(t *testing.T) {
+	ranges := mergeStreamRanges([]StreamRange{
+		{Start: []byte("c"), End: []byte("e")},
+		{Start: []byte("k"), End: []byte("m")},
+		{Start: []byte("x")},
+	})
+	require.Equal(t, []keyRange{
+		{left: []byte("c"), right: []byte("e")},
+		{left: []byte("k"), right: []byte("m")},
+		{left: []byte("x")},
+	}, intersectRanges(keyRange{}, ranges))
+	require.Equal(t, []keyRange{
+		{left: []byte("d"), right: []byte("e")},
+		{left: []byte("k"), right: []byte("l")},
+	}, intersectRanges(keyRange{left: []byte("d"), right: []byte("l")}, ranges))
+	require.Empty(t, intersectRanges(keyRange{left: []byte("e"), right: []byte("k")}, ranges))
+
+	require.Equal(t, StreamRange{Start: []byte("ab"), End: []byte("ac")},
+		PrefixStreamRange([]byte("ab")))
+	require.Equal(t, StreamRange{Start: []byte("a\xff"), End: []byte("b")},
+		PrefixStreamRange([]byte("a\xff")))
+}
+
+func TestStreamSlowDown(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		wb := db.NewWriteBatch()
+		for i := 0; i < 100; i++ {
+			require.NoError(t, wb.Set(keyWithPrefix("key", i), value(i)))
+		}
+		require.NoError(t, wb.Flush())
+
+		// Send every range in its own batch, so that Send is called several times.
+		defer func(sz uint64) { maxStreamSize = sz }(maxStreamSize)
+		maxStreamSize = 1
+
+		stream := db.NewStream()
+		for _, prefix := range []string{"key-1", "key-3", "key-5", "key-7", "key-9"} {
+			stream.Ranges = append(stream.Ranges, PrefixStreamRange([]byte(prefix)))
+		}
+		c := &collector{}
+		var calls int
+		stream.Send = func(buf *z.Buffer) error {
+			if err := c.Send(buf); err != nil {
+				return err
+			}
+			calls++
+			if calls <= 3 {
+				return errors.Wrapf(ErrSlowDown, "call %d", calls)
+			}
+			return nil
+		}
+		start := time.Now()
+		require.NoError(t, stream.Orchestrate(ctxb))
+		require.Len(t, c.kv, 55)
+		require.GreaterOrEqual(t, calls, 5)
+		// The stream paused for 10ms, 20ms and then 40ms.
+		require.GreaterOrEqual(t, int64(time.Since(start)), int64(70*time.Millisecond))
+	})
+}
+
+func TestStreamTransformValue(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		wb := db.NewWriteBatch()
+		for i := 0; i < 100; i++ {
+			require.NoError(t, wb.Set(keyWithPrefix("key", i), value(i)))
+		}
+		require.NoError(t, wb.Flush())
+
+		stream := db.NewStream()
+		stream.TransformValue = func(kv *pb.KV) ([]byte, error) {
+			return append([]byte("t-"), kv.Value...), nil
+		}
+		c := &collector{}
+		stream.Send = c.Send
+		require.NoError(t, stream.Orchestrate(ctxb))
+		require.Len(t, c.kv, 100)
+		for _, kv := range c.kv {
+			_, i := keyToInt(kv.Key)
+			require.Equal(t, append([]byte("t-"), value(i)...), kv.Value)
+		}
+
+		errTransform := errors.New("transform failed")
+		stream = db.NewStream()
+		stream.TransformValue = func(kv *pb.KV) ([]byte, error) {
+			return nil, errTransform
+		}
+		stream.Send = func(buf *z.Buffer) error { return nil }
+		require.Equal(t, errTransform, errors.Cause(stream.Orchestrate(ctxb)))
+	})
+}
+
+func TestStreamVersions(t *testing.T) {
+	opt := getTestOptions("")
+	opt.NumVersionsToKeep = math.MaxInt32
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		// The versions of key, from the oldest to the newest: two values, a deletion marker and
+		// another value.
+		var ts []uint64
+		for i, val := range []string{"v1", "v2", "", "v4"} {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				if i == 2 {
+					return txn.Delete(key)
+				}
+				return txn.Set(key, []byte(val))
+			}))
+			ts = append(ts, db.MaxVersion())
+		}
+
+		// versions returns the versions of key sent by the stream, and whether they're deleted.
+		versions := func(setup func(st *Stream)) []string {
+			stream := db.NewStream()
+			setup(stream)
+			c := &collector{}
+			stream.Send = c.Send
+			require.NoError(t, stream.Orchestrate(ctxb))
+			var out []string
+			for _, kv := range c.kv {
+				require.Equal(t, key, kv.Key)
+				v := fmt.Sprintf("%d", kv.Version)
+				if len(kv.Meta) > 0 && kv.Meta[0]&bitDelete > 0 {
+					v += "-deleted"
+				}
+				out = append(out, v)
+			}
+			return out
+		}
+		ver := func(i int) string { return fmt.Sprintf("%d", ts[i]) }
+		deleted := ver(2) + "-deleted"
+
+		require.Equal(t, []string{ver(3), deleted}, versions(func(st *Stream) {}))
+		require.Equal(t, []string{ver(3)}, versions(func(st *Stream) {
+			st.SkipDeletedOrExpired = true
+		}))
+		require.Equal(t, []string{ver(3), deleted, ver(1), ver(0)}, versions(func(st *Stream) {
+			st.MaxVersions = 10
+		}))
+		require.Equal(t, []string{ver(3), deleted}, versions(func(st *Stream) {
+			st.MaxVersions = 2
+		}))
+		require.Equal(t, []string{ver(3), ver(1), ver(0)}, versions(func(st *Stream) {
+			st.MaxVersions = 10
+			st.SkipDeletedOrExpired = true
+		}))
+		require.Equal(t, []string{deleted, ver(1)}, versions(func(st *Stream) {
+			st.MaxVersions = 10
+			st.SinceTs = ts[0]
+			st.UntilTs = ts[2]
+		}))
+		require.Equal(t, []string{ver(1), ver(0)}, versions(func(st *Stream) {
+			st.UntilTs = ts[1]
+		}))
+	})
+}
+
+func TestStreamProgress(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		n := 100
+		wb := db.NewWriteBatch()
+		for i := 0; i < n; i++ {
+			require.NoError(t, wb.Set(keyWithPrefix("key", i), value(i)))
+		}
+		require.NoError(t, wb.Flush())
+
+		var reports []StreamProgress
+		stream := db.NewStream()
+		stream.Send = func(buf *z.Buffer) error { return nil }
+		stream.OnProgress = func(p StreamProgress) {
+			reports = append(reports, p)
+		}
+		require.NoError(t, stream.Orchestrate(ctxb))
+
+		require.NotEmpty(t, reports)
+		last := reports[len(reports)-1]
+		require.Greater(t, last.RangesTotal, 0)
+		require.Equal(t, last.RangesTotal, last.RangesDone)
+		require.Equal(t, uint64(n), last.KeysSent)
+		require.Greater(t, last.BytesSent, uint64(0))
+		require.Zero(t, last.ETA)
+		for i := 1; i < len(reports); i++ {
+			require.LessOrEqual(t, reports[i-1].KeysSent, reports[i].KeysSent)
+		}
+	})
+}
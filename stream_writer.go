@@ -17,6 +17,7 @@
 package badger
 
 import (
+	"container/heap"
 	"encoding/hex"
 	"fmt"
 	"sync"
@@ -40,8 +41,15 @@ import (
 // when restoring from backup or replicating DB across servers.
 //
 // StreamWriter should not be called on in-use DB instances. It is designed only to bootstrap new
-// DBs.
+// DBs, unless it's prepared with PrepareIngest.
 type StreamWriter struct {
+	// ReorderBufferSize, if positive, is the memory budget in bytes of a window in which the keys
+	// of each stream are sorted before being written, so that streams whose keys arrive slightly
+	// out of order, like after a network reassembly, can still be written. A key which arrives
+	// after a bigger one has left the window still makes the write fail. It must be set before
+	// the first call to Write.
+	ReorderBufferSize int64
+
 	writeLock       sync.Mutex
 	db              *DB
 	done            func()
@@ -54,6 +62,31 @@ type StreamWriter struct {
 	// Writer might receive tables first, and then receive keys. If true, that means we have
 	// started processing keys.
 	processingKeys bool
+	// ingest collects the tables built, if PrepareIngest was called.
+	ingest *ingestedTables
+	// blobs are the pointers to the blob files written, which the LSM tree references once the
+	// tables are all written.
+	blobs []valuePointer
+}
+
+// ingestedTables collects the tables built by a StreamWriter, to ingest them at Flush.
+type ingestedTables struct {
+	sync.Mutex
+	tables []*table.Table
+}
+
+func (it *ingestedTables) add(tbl *table.Table) {
+	it.Lock()
+	defer it.Unlock()
+	it.tables = append(it.tables, tbl)
+}
+
+func (it *ingestedTables) take() []*table.Table {
+	it.Lock()
+	defer it.Unlock()
+	tables := it.tables
+	it.tables = nil
+	return tables
 }
 
 // NewStreamWriter creates a StreamWriter. Right after creating StreamWriter, Prepare must be
@@ -128,6 +161,27 @@ func (sw *StreamWriter) PrepareIncremental() error {
 	return nil
 }
 
+// PrepareIngest should be called before writing any entry to StreamWriter, to add the streams to
+// the existing data of a DB in use, like a periodic bulk delta, instead of replacing it. The writes
+// and the compactions of the DB go on meanwhile. The tables built are added to the LSM tree at
+// Flush, like IngestExternalTables does: at the lowest level where they don't overlap with any
+// existing data, or at L0 otherwise. The values are kept in the tables rather than in the value
+// log, and the tables sent by a Stream with FullCopy aren't supported.
+func (sw *StreamWriter) PrepareIngest() error {
+	sw.writeLock.Lock()
+	defer sw.writeLock.Unlock()
+
+	if sw.db.opt.InMemory {
+		return errors.Wrapf(ErrInvalidRequest, "Cannot ingest streams in InMemory mode")
+	}
+	if sw.db.opt.ReadOnly {
+		return errors.Wrapf(ErrInvalidRequest, "Cannot ingest streams in read-only mode")
+	}
+	sw.ingest = &ingestedTables{}
+	sw.done = func() {}
+	return nil
+}
+
 // Write writes KVList to DB. Each KV within the list contains the stream id which StreamWriter
 // would use to demux the writes. Write is thread safe and can be called concurrently by multiple
 // goroutines.
@@ -175,6 +229,9 @@ func (sw *StreamWriter) Write(buf *z.Buffer) error {
 			}
 			return nil
 		case pb.KV_FILE:
+			if sw.ingest != nil {
+				return errors.Wrapf(ErrInvalidRequest, "Cannot ingest the tables of a full copy")
+			}
 			// All tables should be recieved before any of the keys.
 			if sw.processingKeys {
 				return errors.New("Received pb.KV_FILE after pb.KV_KEY")
@@ -209,22 +266,29 @@ func (sw *StreamWriter) Write(buf *z.Buffer) error {
 		}
 
 		sw.processingKeys = true
-		var meta, userMeta byte
+		var meta byte
 		if len(kv.Meta) > 0 {
 			meta = kv.Meta[0]
 		}
-		if len(kv.UserMeta) > 0 {
-			userMeta = kv.UserMeta[0]
+		userMeta, userMetaExt := splitUserMeta(kv.UserMeta)
+		if len(userMetaExt) > MaxUserMetaExtSize {
+			return errors.Wrapf(ErrInvalidRequest,
+				"UserMetaExt of length %d exceeds the limit of %d",
+				len(userMetaExt), MaxUserMetaExtSize)
 		}
 		if sw.maxVersion < kv.Version {
 			sw.maxVersion = kv.Version
 		}
 		e := &Entry{
-			Key:       y.KeyWithTs(kv.Key, kv.Version),
-			Value:     y.Copy(kv.Value),
-			UserMeta:  userMeta,
-			ExpiresAt: kv.ExpiresAt,
-			meta:      meta,
+			Key:         y.KeyWithTs(kv.Key, kv.Version),
+			Value:       y.Copy(kv.Value),
+			UserMeta:    userMeta,
+			UserMetaExt: y.SafeCopy(nil, userMetaExt),
+			ExpiresAt:   kv.ExpiresAt,
+			meta:        meta,
+		}
+		if err := sw.db.tenants.encrypt(e); err != nil {
+			return y.Wrapf(err, "while encrypting with tenant key")
 		}
 		// If the value can be collocated with the key in LSM tree, we can skip
 		// writing the value to value log.
@@ -251,8 +315,18 @@ func (sw *StreamWriter) Write(buf *z.Buffer) error {
 	// We are writing all requests to vlog even if some request belongs to already closed stream.
 	// It is safe to do because we are panicking while writing to sorted writer, which will be nil
 	// for closed stream. At restart, stream writer will drop all the data in Prepare function.
-	if err := sw.db.vlog.write(all); err != nil {
-		return err
+	// The values of ingested streams are kept in the tables, as the vlog is written concurrently.
+	if sw.ingest == nil {
+		if err := sw.db.vlog.write(all); err != nil {
+			return err
+		}
+		for _, req := range all {
+			for _, p := range req.Ptrs {
+				if p.isBlob() {
+					sw.blobs = append(sw.blobs, p)
+				}
+			}
+		}
 	}
 
 	// Moved this piece of code to within the lock.
@@ -308,6 +382,7 @@ func (sw *StreamWriter) Flush() error {
 	defer sw.writeLock.Unlock()
 
 	defer sw.done()
+	defer sw.db.vlog.blobsWritten(sw.blobs)
 
 	for _, writer := range sw.writers {
 		if writer != nil {
@@ -323,6 +398,9 @@ func (sw *StreamWriter) Flush() error {
 			return err
 		}
 	}
+	if sw.ingest != nil {
+		return sw.flushIngest()
+	}
 
 	if !sw.db.opt.managedTxns {
 		if sw.db.orc != nil {
@@ -357,6 +435,38 @@ func (sw *StreamWriter) Flush() error {
 	return sw.db.lc.validate()
 }
 
+// flushIngest adds the tables built to the LSM tree, once they have all been written.
+func (sw *StreamWriter) flushIngest() error {
+	err := sw.throttle.Finish()
+	tables := sw.ingest.take()
+	// Release the refs held by the writers. This deletes the tables which didn't make it to the
+	// LSM tree.
+	defer func() {
+		_ = decrRefs(tables)
+	}()
+	if err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	if err := sortTablesToIngest(tables); err != nil {
+		return err
+	}
+	if err := sw.db.syncDir(sw.db.opt.Dir); err != nil {
+		return err
+	}
+	level, err := sw.db.lc.ingestTables(tables)
+	if err != nil {
+		return err
+	}
+	if !sw.db.opt.managedTxns {
+		sw.db.orc.advanceTs(sw.maxVersion)
+	}
+	sw.db.opt.Infof("Ingested %d tables from streams at level: %d\n", len(tables), level)
+	return nil
+}
+
 // Cancel signals all goroutines to exit. Calling defer sw.Cancel() immediately after creating a new StreamWriter
 // ensures that writes are unblocked even upon early return. Note that dropAll() is not called here, so any
 // partially written data will not be erased until a new StreamWriter is initialized.
@@ -378,6 +488,10 @@ func (sw *StreamWriter) Cancel() {
 	if err := sw.throttle.Finish(); err != nil {
 		sw.db.opt.Errorf("error in throttle.Finish: %+v", err)
 	}
+	if sw.ingest != nil {
+		_ = decrRefs(sw.ingest.take())
+	}
+	sw.db.vlog.blobsWritten(sw.blobs)
 
 	// Handle Cancel() being called before Prepare().
 	if sw.done != nil {
@@ -397,6 +511,37 @@ type sortedWriter struct {
 	reqCh    chan *request
 	// Have separate closer for each writer, as it can be closed at any time.
 	closer *z.Closer
+	// ingest collects the tables built instead of adding them to level, if set.
+	ingest *ingestedTables
+
+	// reorder holds the keys in the reorder window, see StreamWriter.ReorderBufferSize.
+	reorder        reorderHeap
+	reorderSize    int64
+	maxReorderSize int64
+}
+
+// reorderEntry is a key waiting in the reorder window of a sortedWriter.
+type reorderEntry struct {
+	key []byte
+	vs  y.ValueStruct
+}
+
+func (e reorderEntry) size() int64 {
+	return int64(len(e.key) + len(e.vs.Value) + len(e.vs.UserMetaExt))
+}
+
+type reorderHeap []reorderEntry
+
+func (h reorderHeap) Len() int            { return len(h) }
+func (h reorderHeap) Less(i, j int) bool  { return y.CompareKeys(h[i].key, h[j].key) < 0 }
+func (h reorderHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *reorderHeap) Push(x interface{}) { *h = append(*h, x.(reorderEntry)) }
+func (h *reorderHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
 }
 
 func (sw *StreamWriter) newWriter(streamID uint32) (*sortedWriter, error) {
@@ -413,6 +558,9 @@ func (sw *StreamWriter) newWriter(streamID uint32) (*sortedWriter, error) {
 		reqCh:    make(chan *request, 3),
 		closer:   z.NewCloser(1),
 		level:    sw.prevLevel - 1, // Write at the level just above the one we were writing to.
+
+		maxReorderSize: sw.ReorderBufferSize,
+		ingest:         sw.ingest,
 	}
 
 	go w.handleRequests()
@@ -430,21 +578,12 @@ func (w *sortedWriter) handleRequests() {
 			// writer (and not the sender) to determine if the Value goes to vlog or stays in SST
 			// only. In managed mode, we do not write values to vlog and hence we would not have
 			// req.Ptrs initialized.
-			if w.db.opt.managedTxns || e.skipVlogAndSetThreshold(w.db.valueThreshold()) {
-				vs = y.ValueStruct{
-					Value:     e.Value,
-					Meta:      e.meta,
-					UserMeta:  e.UserMeta,
-					ExpiresAt: e.ExpiresAt,
-				}
+			if w.db.opt.managedTxns || w.ingest != nil ||
+				e.skipVlogAndSetThreshold(w.db.valueThreshold()) {
+				vs = e.valueStruct(e.Value, e.meta)
 			} else {
 				vptr := req.Ptrs[i]
-				vs = y.ValueStruct{
-					Value:     vptr.Encode(),
-					Meta:      e.meta | bitValuePointer,
-					UserMeta:  e.UserMeta,
-					ExpiresAt: e.ExpiresAt,
-				}
+				vs = e.valueStruct(vptr.Encode(), e.meta|bitValuePointer)
 			}
 			if err := w.Add(e.Key, vs); err != nil {
 				panic(err)
@@ -466,8 +605,34 @@ func (w *sortedWriter) handleRequests() {
 	}
 }
 
-// Add adds key and vs to sortedWriter.
+// Add adds key and vs to sortedWriter. If the writer has a reorder window, the key goes through it.
 func (w *sortedWriter) Add(key []byte, vs y.ValueStruct) error {
+	if w.maxReorderSize <= 0 {
+		return w.add(key, vs)
+	}
+	if len(w.lastKey) > 0 && y.CompareKeys(key, w.lastKey) <= 0 {
+		return errors.Errorf("keys not in sorted order beyond the reorder window "+
+			"(last key: %s, key: %s)", hex.Dump(w.lastKey), hex.Dump(key))
+	}
+	e := reorderEntry{key: key, vs: vs}
+	heap.Push(&w.reorder, e)
+	w.reorderSize += e.size()
+	for w.reorderSize > w.maxReorderSize {
+		if err := w.popReorder(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// popReorder adds the smallest key of the reorder window.
+func (w *sortedWriter) popReorder() error {
+	e := heap.Pop(&w.reorder).(reorderEntry)
+	w.reorderSize -= e.size()
+	return w.add(e.key, e.vs)
+}
+
+func (w *sortedWriter) add(key []byte, vs y.ValueStruct) error {
 	if len(w.lastKey) > 0 && y.CompareKeys(key, w.lastKey) <= 0 {
 		return errors.Errorf("keys not in sorted order (last key: %s, key: %s)",
 			hex.Dump(w.lastKey), hex.Dump(key))
@@ -514,6 +679,11 @@ func (w *sortedWriter) send(done bool) error {
 // Done is called once we are done writing all keys and valueStructs
 // to sortedWriter. It completes writing current SST to disk.
 func (w *sortedWriter) Done() error {
+	for w.reorder.Len() > 0 {
+		if err := w.popReorder(); err != nil {
+			return err
+		}
+	}
 	if w.builder.Empty() {
 		w.builder.Close()
 		// Assign builder as nil, so that underlying memory can be garbage collected.
@@ -546,6 +716,13 @@ func (w *sortedWriter) createTable(builder *table.Builder) error {
 			return err
 		}
 	}
+	if w.ingest != nil {
+		// The ref held by CreateTable is released once the table is ingested.
+		w.ingest.add(tbl)
+		w.db.opt.Infof("Table created: %d for stream: %d. Size: %s\n",
+			fileID, w.streamID, humanize.IBytes(uint64(tbl.Size())))
+		return nil
+	}
 	lc := w.db.lc
 
 	lhandler := lc.levels[w.level]
@@ -676,3 +676,99 @@ func TestStreamWriterIncremental(t *testing.T) {
 		})
 	})
 }
+
+func TestStreamWriterReorder(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		// Swap every pair of keys, and send the second half of the keys in another write.
+		noOfKeys := 1000
+		keys := make([][]byte, noOfKeys)
+		for i := range keys {
+			keys[i] = make([]byte, 8)
+			binary.BigEndian.PutUint64(keys[i], uint64(i))
+		}
+		for i := 0; i+1 < noOfKeys; i += 2 {
+			keys[i], keys[i+1] = keys[i+1], keys[i]
+		}
+		sw := db.NewStreamWriter()
+		sw.ReorderBufferSize = 1 << 10
+		require.NoError(t, sw.Prepare())
+		for _, half := range [][][]byte{keys[:noOfKeys/2], keys[noOfKeys/2:]} {
+			buf := z.NewBuffer(10<<20, "test")
+			for _, key := range half {
+				KVToBuffer(&pb.KV{Key: key, Value: key, Version: 1}, buf)
+			}
+			require.NoError(t, sw.Write(buf))
+			require.NoError(t, buf.Release())
+		}
+		require.NoError(t, sw.Flush())
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			var i uint64
+			for it.Rewind(); it.Valid(); it.Next() {
+				require.Equal(t, i, binary.BigEndian.Uint64(it.Item().Key()))
+				val, err := it.Item().ValueCopy(nil)
+				require.NoError(t, err)
+				require.Equal(t, it.Item().Key(), val)
+				i++
+			}
+			require.Equal(t, uint64(noOfKeys), i)
+			return nil
+		}))
+	})
+}
+
+func TestStreamWriterIngest(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 10; i++ {
+				if err := txn.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("old")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		version := db.MaxVersion() + 10
+
+		sw := db.NewStreamWriter()
+		require.NoError(t, sw.PrepareIngest())
+		buf := z.NewBuffer(10<<20, "test")
+		defer func() { require.NoError(t, buf.Release()) }()
+		// key-5 overwrites the existing key, and the others are new.
+		for _, key := range []string{"key-5", "new-1", "new-2"} {
+			KVToBuffer(&pb.KV{Key: []byte(key), Value: []byte("new"), Version: version}, buf)
+		}
+		// The DB can still be written to meanwhile.
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("key-9"), []byte("updated"))
+		}))
+		require.NoError(t, sw.Write(buf))
+		require.NoError(t, sw.Flush())
+
+		// The versions ingested are visible to the transactions started afterwards.
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("key-0"), []byte("updated"))
+		}))
+		expected := map[string]string{
+			"key-0": "updated", "key-5": "new", "key-9": "updated", "new-1": "new", "new-2": "new",
+		}
+		for i := 1; i < 9; i++ {
+			if i != 5 {
+				expected[fmt.Sprintf("key-%d", i)] = "old"
+			}
+		}
+		got := make(map[string]string)
+		require.NoError(t, db.View(func(txn *Txn) error {
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				val, err := it.Item().ValueCopy(nil)
+				require.NoError(t, err)
+				got[string(it.Item().Key())] = string(val)
+			}
+			return nil
+		}))
+		require.Equal(t, expected, got)
+	})
+}
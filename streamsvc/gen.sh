@@ -0,0 +1,8 @@
+#!/bin/bash
+
+# Run this script from its directory, so that streamsvc.proto is where it's expected to be.
+
+# You might need to go get -v github.com/gogo/protobuf/...
+go get -v github.com/gogo/protobuf/protoc-gen-gogofaster
+protoc --gogofaster_out=plugins=grpc,paths=source_relative,Mbadgerpb3.proto=github.com/dgraph-io/badger/v3/pb:. \
+	-I=. -I=../pb streamsvc.proto
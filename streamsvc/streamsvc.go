@@ -0,0 +1,105 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package streamsvc serves the Stream framework of Badger as a gRPC service, and feeds what a
+// client receives from it to a StreamWriter, so that a DB can be bulk-replicated over the network.
+//
+// The service is defined in streamsvc.proto. Register a Server on a grpc.Server via
+// RegisterStreamServer, and call Fetch with a client returned by NewStreamClient.
+package streamsvc
+
+import (
+	"context"
+	"io"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+// Server streams the KV pairs of a DB. It implements StreamServer.
+type Server struct {
+	db *badger.DB
+
+	// NumGo is the number of goroutines iterating over the DB, see Stream.NumGo.
+	NumGo int
+}
+
+var _ StreamServer = (*Server)(nil)
+
+// NewServer returns a Server streaming the KV pairs of db.
+func NewServer(db *badger.DB) *Server {
+	return &Server{db: db}
+}
+
+// Stream streams the KV pairs selected by req to out, as of the current time. The lists sent carry
+// the stream ids and done markers that a StreamWriter expects.
+func (s *Server) Stream(req *Request, out Stream_StreamServer) error {
+	stream := s.db.NewStream()
+	stream.LogPrefix = "streamsvc.Stream"
+	stream.Prefix = req.Prefix
+	for _, r := range req.Ranges {
+		stream.Ranges = append(stream.Ranges, badger.StreamRange{Start: r.Start, End: r.End})
+	}
+	stream.SinceTs = req.SinceTs
+	if s.NumGo > 0 {
+		stream.NumGo = s.NumGo
+	}
+	stream.SendDoneMarkers(true)
+	stream.Send = func(buf *z.Buffer) error {
+		list, err := badger.BufferToKVList(buf)
+		if err != nil {
+			return err
+		}
+		return out.Send(list)
+	}
+	return stream.Orchestrate(out.Context())
+}
+
+// Fetch streams the KV pairs selected by req from the server of client, and writes them to sw,
+// which must have been prepared. sw is flushed once the stream ends, or cancelled if Fetch fails.
+func Fetch(ctx context.Context, client StreamClient, req *Request, sw *badger.StreamWriter) error {
+	in, err := client.Stream(ctx, req)
+	if err != nil {
+		sw.Cancel()
+		return errors.Wrap(err, "while starting the stream")
+	}
+	for {
+		list, err := in.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			sw.Cancel()
+			return errors.Wrap(err, "while receiving the stream")
+		}
+		if err := write(sw, list); err != nil {
+			sw.Cancel()
+			return err
+		}
+	}
+	return sw.Flush()
+}
+
+func write(sw *badger.StreamWriter, list *pb.KVList) error {
+	buf := z.NewBuffer(1<<20, "streamsvc.Fetch")
+	defer buf.Release()
+	for _, kv := range list.Kv {
+		badger.KVToBuffer(kv, buf)
+	}
+	return sw.Write(buf)
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package streamsvc
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func openDB(t *testing.T) (*badger.DB, func()) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	require.NoError(t, err)
+	return db, func() {
+		require.NoError(t, db.Close())
+		require.NoError(t, os.RemoveAll(dir))
+	}
+}
+
+// serve serves srv over gRPC on a local port, and returns a client connected to it.
+func serve(t *testing.T, srv StreamServer) (StreamClient, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := grpc.NewServer()
+	RegisterStreamServer(s, srv)
+	go func() {
+		_ = s.Serve(lis)
+	}()
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	return NewStreamClient(conn), func() {
+		require.NoError(t, conn.Close())
+		s.Stop()
+	}
+}
+
+func TestFetch(t *testing.T) {
+	src, closeSrc := openDB(t)
+	defer closeSrc()
+	dst, closeDst := openDB(t)
+	defer closeDst()
+	wb := src.NewWriteBatch()
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("%s-%03d", prefix, i))
+			require.NoError(t, wb.Set(key, []byte(fmt.Sprintf("value-%d", i))))
+		}
+	}
+	require.NoError(t, wb.Flush())
+
+	client, stop := serve(t, NewServer(src))
+	defer stop()
+
+	sw := dst.NewStreamWriter()
+	require.NoError(t, sw.Prepare())
+	a, c := badger.PrefixStreamRange([]byte("a")), badger.PrefixStreamRange([]byte("c"))
+	req := &Request{Ranges: []*Range{
+		{Start: a.Start, End: a.End},
+		{Start: c.Start, End: c.End},
+	}}
+	require.NoError(t, Fetch(context.Background(), client, req, sw))
+
+	count := make(map[byte]int)
+	require.NoError(t, dst.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := it.Item().Key()
+			count[key[0]]++
+			var i int
+			_, err := fmt.Sscanf(string(key[2:]), "%03d", &i)
+			require.NoError(t, err)
+			val, err := it.Item().ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("value-%d", i), string(val))
+		}
+		return nil
+	}))
+	require.Equal(t, map[byte]int{'a': 100, 'c': 100}, count)
+}
+
+func TestFetchError(t *testing.T) {
+	dst, closeDst := openDB(t)
+	defer closeDst()
+	client, stop := serve(t, &UnimplementedStreamServer{})
+	defer stop()
+
+	sw := dst.NewStreamWriter()
+	require.NoError(t, sw.Prepare())
+	require.Error(t, Fetch(context.Background(), client, &Request{}, sw))
+}
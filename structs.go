@@ -19,8 +19,12 @@ package badger
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"time"
 	"unsafe"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
 )
 
 type valuePointer struct {
@@ -63,31 +67,44 @@ func (p *valuePointer) Decode(b []byte) {
 
 // header is used in value log as a header before Entry.
 type header struct {
-	klen      uint32
-	vlen      uint32
-	expiresAt uint64
-	meta      byte
-	userMeta  byte
+	klen        uint32
+	vlen        uint32
+	expiresAt   uint64
+	meta        byte
+	userMeta    byte
+	userMetaExt []byte
 }
 
+// MaxUserMetaExtSize is the maximum length of Entry.UserMetaExt.
+const MaxUserMetaExtSize = 16
+
 const (
 	// Maximum possible size of the header. The maximum size of header struct will be 18 but the
-	// maximum size of varint encoded header will be 21.
-	maxHeaderSize = 21
+	// maximum size of varint encoded header will be 21, plus the length and the bytes of the
+	// extended user metadata.
+	maxHeaderSize = 21 + 1 + MaxUserMetaExtSize
 )
 
 // Encode encodes the header into []byte. The provided []byte should be atleast 5 bytes. The
 // function will panic if out []byte isn't large enough to hold all the values.
 // The encoded header looks like
-// +------+----------+------------+--------------+-----------+
-// | Meta | UserMeta | Key Length | Value Length | ExpiresAt |
-// +------+----------+------------+--------------+-----------+
+// +------+----------+------------+--------------+-----------+-------------+
+// | Meta | UserMeta | Key Length | Value Length | ExpiresAt | UserMetaExt |
+// +------+----------+------------+--------------+-----------+-------------+
+// where UserMetaExt, prefixed by its length byte, is only present if bitUserMetaExt is set in Meta.
 func (h header) Encode(out []byte) int {
 	out[0], out[1] = h.meta, h.userMeta
+	if len(h.userMetaExt) > 0 {
+		out[0] |= bitUserMetaExt
+	}
 	index := 2
 	index += binary.PutUvarint(out[index:], uint64(h.klen))
 	index += binary.PutUvarint(out[index:], uint64(h.vlen))
 	index += binary.PutUvarint(out[index:], h.expiresAt)
+	if len(h.userMetaExt) > 0 {
+		out[index] = byte(len(h.userMetaExt))
+		index += 1 + copy(out[index+1:], h.userMetaExt)
+	}
 	return index
 }
 
@@ -103,7 +120,15 @@ func (h *header) Decode(buf []byte) int {
 	h.vlen = uint32(vlen)
 	index += count
 	h.expiresAt, count = binary.Uvarint(buf[index:])
-	return index + count
+	index += count
+	h.userMetaExt = nil
+	if h.meta&bitUserMetaExt > 0 {
+		h.meta &^= bitUserMetaExt
+		n := int(buf[index])
+		h.userMetaExt = buf[index+1 : index+1+n]
+		index += 1 + n
+	}
+	return index
 }
 
 // DecodeFrom reads the header from the hashReader.
@@ -132,6 +157,18 @@ func (h *header) DecodeFrom(reader *hashReader) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	h.userMetaExt = nil
+	if h.meta&bitUserMetaExt > 0 {
+		h.meta &^= bitUserMetaExt
+		n, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		h.userMetaExt = make([]byte, n)
+		if _, err := io.ReadFull(reader, h.userMetaExt); err != nil {
+			return 0, err
+		}
+	}
 	return reader.bytesRead, nil
 }
 
@@ -146,9 +183,44 @@ type Entry struct {
 	UserMeta  byte
 	meta      byte
 
+	// UserMetaExt extends UserMeta with up to MaxUserMetaExtSize more bytes. Like UserMeta, it is
+	// stored alongside the key, and is not encrypted in the value log.
+	UserMetaExt []byte
+
 	// Fields maintained internally.
 	hlen         int // Length of the header.
 	valThreshold int64
+
+	// valueReader provides the value of size valueSize, in place of Value. See WithValueReader.
+	valueReader io.Reader
+	valueSize   int64
+	location    ValueLocation
+}
+
+// ValueLocation tells where the value of an entry is stored. See Entry.WithValueLocation.
+type ValueLocation byte
+
+const (
+	// ValueLocationDefault stores the value in the value log if it isn't smaller than the value
+	// threshold.
+	ValueLocationDefault ValueLocation = iota
+	// ValueLocationInline stores the value in the LSM tree, if it's smaller than 1 MB.
+	ValueLocationInline
+	// ValueLocationValueLog stores the value in the value log, unless it's empty.
+	ValueLocationValueLog
+)
+
+// threshold returns the value threshold of an entry with location l, given the threshold of the
+// DB or keyspace.
+func (l ValueLocation) threshold(threshold int64) int64 {
+	switch l {
+	case ValueLocationInline:
+		return maxValueThreshold
+	case ValueLocationValueLog:
+		return 1
+	default:
+		return threshold
+	}
 }
 
 func (e *Entry) isZero() bool {
@@ -157,21 +229,90 @@ func (e *Entry) isZero() bool {
 
 func (e *Entry) estimateSizeAndSetThreshold(threshold int64) int64 {
 	if e.valThreshold == 0 {
-		e.valThreshold = threshold
+		e.valThreshold = e.location.threshold(threshold)
 	}
-	k := int64(len(e.Key))
-	v := int64(len(e.Value))
+	k := int64(len(e.Key)) + int64(len(e.UserMetaExt))
+	v := e.valueLen()
 	if v < e.valThreshold {
 		return k + v + 2 // Meta, UserMeta
 	}
 	return k + 12 + 2 // 12 for ValuePointer, 2 for metas.
 }
 
+// header returns the header of the entry in the value log.
+func (e *Entry) header() header {
+	return header{
+		klen:        uint32(len(e.Key)),
+		vlen:        uint32(e.valueLen()),
+		expiresAt:   e.ExpiresAt,
+		meta:        e.meta,
+		userMeta:    e.UserMeta,
+		userMetaExt: e.UserMetaExt,
+	}
+}
+
+// valueStruct returns the value struct of the entry in the LSM tree, holding value.
+func (e *Entry) valueStruct(value []byte, meta byte) y.ValueStruct {
+	return y.ValueStruct{
+		Value:       value,
+		Meta:        meta,
+		UserMeta:    e.UserMeta,
+		UserMetaExt: e.UserMetaExt,
+		ExpiresAt:   e.ExpiresAt,
+	}
+}
+
+// joinUserMeta returns the user metadata in the format of pb.KV.
+func joinUserMeta(userMeta byte, ext []byte) []byte {
+	return append([]byte{userMeta}, ext...)
+}
+
+// splitUserMeta parses the user metadata in the format of pb.KV.
+func splitUserMeta(b []byte) (userMeta byte, ext []byte) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if len(b) > 1 {
+		ext = b[1:]
+	}
+	return b[0], ext
+}
+
 func (e *Entry) skipVlogAndSetThreshold(threshold int64) bool {
 	if e.valThreshold == 0 {
-		e.valThreshold = threshold
+		e.valThreshold = e.location.threshold(threshold)
+	}
+	return e.valueLen() < e.valThreshold
+}
+
+// valueLen returns the length of the value of the entry, which may not have been read yet.
+func (e *Entry) valueLen() int64 {
+	if e.valueReader != nil {
+		return e.valueSize
+	}
+	return int64(len(e.Value))
+}
+
+// readValue reads the value set via WithValueReader into Value.
+func (e *Entry) readValue() error {
+	val := make([]byte, e.valueSize)
+	if err := readFullValue(e.valueReader, val); err != nil {
+		return err
+	}
+	e.Value, e.valueReader = val, nil
+	return nil
+}
+
+// readFullValue fills dst with the value read from r, which must be exactly len(dst) bytes long.
+func readFullValue(r io.Reader, dst []byte) error {
+	if _, err := io.ReadFull(r, dst); err != nil {
+		return errors.Wrapf(err, "while reading value of size %d", len(dst))
+	}
+	var extra [1]byte
+	if n, _ := r.Read(extra[:]); n > 0 {
+		return errors.Errorf("value is longer than its size %d", len(dst))
 	}
-	return int64(len(e.Value)) < e.valThreshold
+	return nil
 }
 
 func (e Entry) print(prefix string) {
@@ -199,6 +340,13 @@ func (e *Entry) WithMeta(meta byte) *Entry {
 	return e
 }
 
+// WithUserMetaExt sets the extended user metadata of Entry e, which can hold up to
+// MaxUserMetaExtSize bytes more than the single byte set via WithMeta.
+func (e *Entry) WithUserMetaExt(ext []byte) *Entry {
+	e.UserMetaExt = ext
+	return e
+}
+
 // WithDiscard adds a marker to Entry e. This means all the previous versions of the key (of the
 // Entry) will be eligible for garbage collection.
 // This method is only useful if you have set a higher limit for options.NumVersionsToKeep. The
@@ -217,6 +365,42 @@ func (e *Entry) WithTTL(dur time.Duration) *Entry {
 	return e
 }
 
+// WithExpiresAt sets the absolute time at which Entry e expires. Unlike WithTTL, the expiry does
+// not depend on when the entry is created, which keeps it identical when the same write is
+// replayed on multiple nodes. A zero Time means the entry never expires.
+func (e *Entry) WithExpiresAt(t time.Time) *Entry {
+	if t.IsZero() {
+		e.ExpiresAt = 0
+		return e
+	}
+	e.ExpiresAt = uint64(t.Unix())
+	return e
+}
+
+// WithValueReader sets the value of Entry e to the size bytes read from r, in place of Value. This
+// lets large values be written without holding them in memory: r is read only once the transaction
+// is committed, straight into the value log. Values smaller than the value threshold, and all the
+// values in InMemory or managed mode, don't go to the value log and are read by Txn.SetEntry.
+//
+// Reading r holds up the other writes to the DB, so it should be quick to read, like a local file.
+// The commit fails if r returns an error, or fewer or more than size bytes. The value can't be read
+// back by the transaction which set it: Get returns ErrInvalidRequest for the key, while iterators
+// and subscribers see an empty value.
+func (e *Entry) WithValueReader(r io.Reader, size int64) *Entry {
+	e.Value = nil
+	e.valueReader, e.valueSize = r, size
+	return e
+}
+
+// WithValueLocation sets where the value of Entry e is stored, in place of the value threshold of
+// the DB: ValueLocationInline keeps a small but often read value in the LSM tree, and
+// ValueLocationValueLog moves a value rarely read to the value log, to keep the LSM tree small.
+// The values are always stored in the LSM tree in InMemory and managed mode.
+func (e *Entry) WithValueLocation(l ValueLocation) *Entry {
+	e.location = l
+	return e
+}
+
 // withMergeBit sets merge bit in entry's metadata. This
 // function is called by MergeOperator's Add method.
 func (e *Entry) withMergeBit() *Entry {
@@ -21,9 +21,11 @@ import (
 	"fmt"
 	"io"
 	"sort"
+	"sync/atomic"
 
 	"github.com/dgraph-io/badger/v3/fb"
 	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto/z"
 )
 
 type blockIterator struct {
@@ -182,6 +184,20 @@ type Iterator struct {
 	// Internally, Iterator is bidirectional. However, we only expose the
 	// unidirectional functionality for now.
 	opt int // Valid options are REVERSED and NOCACHE.
+
+	sample int // If greater than 1, only about one in sample blocks is visited.
+
+	stats   *IteratorStats // If not nil, the work done by the iterator is accounted for here.
+	touched bool           // Set once a block of the table has been read.
+}
+
+// IteratorStats counts the work done by table iterators. The counters are updated atomically, so
+// that a single IteratorStats can be shared by the iterators merged together.
+type IteratorStats struct {
+	TablesTouched     uint64 // Number of tables at least a block of which has been read.
+	BlocksRead        uint64 // Number of blocks read, including the block cache hits.
+	BlockCacheHits    uint64 // Number of blocks found in the block cache.
+	BytesDecompressed uint64 // Size of the blocks decompressed, once decompressed.
 }
 
 // NewIterator returns a new iterator of the Table
@@ -197,6 +213,35 @@ func (itr *Iterator) Close() error {
 	return itr.t.DecrRef()
 }
 
+// SetSample makes the iterator visit only about one in n of the blocks it moves to, skipping the
+// rest at random. This is useful for computing approximate statistics over a table.
+func (itr *Iterator) SetSample(n int) {
+	itr.sample = n
+}
+
+// SetStats makes the iterator account for the work it does in stats.
+func (itr *Iterator) SetStats(stats *IteratorStats) {
+	itr.stats = stats
+}
+
+// block returns the block at idx of the table.
+func (itr *Iterator) block(idx int) (*block, error) {
+	if itr.stats != nil && !itr.touched {
+		itr.touched = true
+		atomic.AddUint64(&itr.stats.TablesTouched, 1)
+	}
+	return itr.t.readBlock(idx, itr.useCache(), itr.stats)
+}
+
+// skippedBlocks returns the number of blocks to skip before moving to the next one.
+func (itr *Iterator) skippedBlocks() int {
+	var n int
+	for itr.sample > 1 && z.FastRand()%uint32(itr.sample) != 0 {
+		n++
+	}
+	return n
+}
+
 func (itr *Iterator) reset() {
 	itr.bpos = 0
 	itr.err = nil
@@ -218,7 +263,7 @@ func (itr *Iterator) seekToFirst() {
 		return
 	}
 	itr.bpos = 0
-	block, err := itr.t.block(itr.bpos, itr.useCache())
+	block, err := itr.block(itr.bpos)
 	if err != nil {
 		itr.err = err
 		return
@@ -237,7 +282,7 @@ func (itr *Iterator) seekToLast() {
 		return
 	}
 	itr.bpos = numBlocks - 1
-	block, err := itr.t.block(itr.bpos, itr.useCache())
+	block, err := itr.block(itr.bpos)
 	if err != nil {
 		itr.err = err
 		return
@@ -251,7 +296,7 @@ func (itr *Iterator) seekToLast() {
 
 func (itr *Iterator) seekHelper(blockIdx int, key []byte) {
 	itr.bpos = blockIdx
-	block, err := itr.t.block(blockIdx, itr.useCache())
+	block, err := itr.block(blockIdx)
 	if err != nil {
 		itr.err = err
 		return
@@ -328,7 +373,7 @@ func (itr *Iterator) next() {
 	}
 
 	if len(itr.bi.data) == 0 {
-		block, err := itr.t.block(itr.bpos, itr.useCache())
+		block, err := itr.block(itr.bpos)
 		if err != nil {
 			itr.err = err
 			return
@@ -343,7 +388,7 @@ func (itr *Iterator) next() {
 
 	itr.bi.next()
 	if !itr.bi.Valid() {
-		itr.bpos++
+		itr.bpos += 1 + itr.skippedBlocks()
 		itr.bi.data = nil
 		itr.next()
 		return
@@ -358,7 +403,7 @@ func (itr *Iterator) prev() {
 	}
 
 	if len(itr.bi.data) == 0 {
-		block, err := itr.t.block(itr.bpos, itr.useCache())
+		block, err := itr.block(itr.bpos)
 		if err != nil {
 			itr.err = err
 			return
@@ -373,7 +418,7 @@ func (itr *Iterator) prev() {
 
 	itr.bi.prev()
 	if !itr.bi.Valid() {
-		itr.bpos--
+		itr.bpos -= 1 + itr.skippedBlocks()
 		itr.bi.data = nil
 		itr.prev()
 		return
@@ -440,6 +485,8 @@ type ConcatIterator struct {
 	iters   []*Iterator // Corresponds to tables.
 	tables  []*Table    // Disregarding reversed, this is in ascending order.
 	options int         // Valid options are REVERSED and NOCACHE.
+	sample  int
+	stats   *IteratorStats
 }
 
 // NewConcatIterator creates a new concatenated iterator
@@ -469,10 +516,33 @@ func (s *ConcatIterator) setIdx(idx int) {
 	}
 	if s.iters[idx] == nil {
 		s.iters[idx] = s.tables[idx].NewIterator(s.options)
+		s.iters[idx].SetSample(s.sample)
+		s.iters[idx].SetStats(s.stats)
 	}
 	s.cur = s.iters[s.idx]
 }
 
+// SetSample makes the iterators of the tables visit only about one in n of their blocks. See
+// Iterator.SetSample.
+func (s *ConcatIterator) SetSample(n int) {
+	s.sample = n
+	for _, it := range s.iters {
+		if it != nil {
+			it.SetSample(n)
+		}
+	}
+}
+
+// SetStats makes the iterators of the tables account for the work they do in stats.
+func (s *ConcatIterator) SetStats(stats *IteratorStats) {
+	s.stats = stats
+	for _, it := range s.iters {
+		if it != nil {
+			it.SetStats(stats)
+		}
+	}
+}
+
 // Rewind implements y.Interface
 func (s *ConcatIterator) Rewind() {
 	if len(s.iters) == 0 {
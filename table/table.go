@@ -559,10 +559,18 @@ func (t *Table) offsets(ko *fb.BlockOffset, i int) bool {
 // slice stored in the block will be reused when the ref becomes zero. The
 // caller should release the block by calling block.decrRef() on it.
 func (t *Table) block(idx int, useCache bool) (*block, error) {
+	return t.readBlock(idx, useCache, nil)
+}
+
+// readBlock is like block, but also accounts for the block in stats, if not nil.
+func (t *Table) readBlock(idx int, useCache bool, stats *IteratorStats) (*block, error) {
 	y.AssertTruef(idx >= 0, "idx=%d", idx)
 	if idx >= t.offsetsLength() {
 		return nil, errors.New("block out of index")
 	}
+	if stats != nil {
+		atomic.AddUint64(&stats.BlocksRead, 1)
+	}
 	if t.opt.BlockCache != nil {
 		key := t.blockCacheKey(idx)
 		blk, ok := t.opt.BlockCache.Get(key)
@@ -571,6 +579,9 @@ func (t *Table) block(idx int, useCache bool) (*block, error) {
 			// could get evicted from the cache between the Get() call and the
 			// incrRef() call.
 			if b := blk.(*block); b.incrRef() {
+				if stats != nil {
+					atomic.AddUint64(&stats.BlockCacheHits, 1)
+				}
 				return b, nil
 			}
 		}
@@ -606,6 +617,9 @@ func (t *Table) block(idx int, useCache bool) (*block, error) {
 			"failed to decode compressed data in file: %s at offset: %d, len: %d",
 			t.Fd.Name(), blk.offset, ko.Len())
 	}
+	if stats != nil && t.opt.Compression != options.None {
+		atomic.AddUint64(&stats.BytesDecompressed, uint64(len(blk.data)))
+	}
 
 	// Read meta data related to block.
 	readPos := len(blk.data) - 4 // First read checksum length.
@@ -723,6 +737,39 @@ func (t *Table) CoveredByPrefix(prefix []byte) bool {
 		bytes.HasPrefix(y.ParseKey(t.Smallest()), prefix)
 }
 
+// PrefixSize returns an estimate of the on-disk size of the keys with the given prefix in the table.
+// It sums up the sizes of the blocks whose key range overlaps with the prefix.
+func (t *Table) PrefixSize(prefix []byte) uint64 {
+	if t.CoveredByPrefix(prefix) {
+		return uint64(t.OnDiskSize())
+	}
+	var bo, next fb.BlockOffset
+	var size uint64
+	oLen := t.offsetsLength()
+	for i := 0; i < oLen; i++ {
+		y.AssertTrue(t.offsets(&bo, i))
+		first := y.ParseKey(bo.KeyBytes())
+		if bytes.HasPrefix(first, prefix) {
+			size += uint64(bo.Len())
+			continue
+		}
+		if bytes.Compare(first, prefix) > 0 {
+			break
+		}
+		// The block starts before the prefix. It can only have keys with the prefix if the next
+		// block starts after the prefix.
+		last := y.ParseKey(t.Biggest())
+		if i+1 < oLen {
+			y.AssertTrue(t.offsets(&next, i+1))
+			last = y.ParseKey(next.KeyBytes())
+		}
+		if bytes.Compare(last, prefix) >= 0 {
+			size += uint64(bo.Len())
+		}
+	}
+	return size
+}
+
 // readTableIndex reads table index from the sst and returns its pb format.
 func (t *Table) readTableIndex() (*fb.TableIndex, error) {
 	data := t.readNoFail(t.indexStart, t.indexLen)
@@ -289,6 +289,31 @@ func TestTable(t *testing.T) {
 	require.EqualValues(t, string(y.ParseKey(k)), key("key", 0))
 }
 
+func TestTableIteratorSample(t *testing.T) {
+	opts := getTestTableOptions()
+	table := buildTestTable(t, "key", 10000, opts)
+	defer table.DecrRef()
+	require.Greater(t, table.offsetsLength(), 20)
+
+	for _, reversed := range []int{0, REVERSED} {
+		it := table.NewIterator(reversed)
+		it.SetSample(10)
+		var count int
+		var last []byte
+		for it.Rewind(); it.Valid(); it.Next() {
+			if last != nil {
+				// The keys are still visited in order.
+				require.Equal(t, reversed == 0, y.CompareKeys(last, it.Key()) < 0)
+			}
+			last = y.SafeCopy(last, it.Key())
+			count++
+		}
+		require.NoError(t, it.Close())
+		require.Greater(t, count, 0)
+		require.Less(t, count, 5000)
+	}
+}
+
 func TestIterateBackAndForth(t *testing.T) {
 	opts := getTestTableOptions()
 	table := buildTestTable(t, "key", 10000, opts)
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+// eraseDiscardRatio is the discard ratio used by EraseTenant while collecting value log files.
+// It is lower than the usual recommendation of 0.5, so that files holding even a small share of
+// the erased tenant's values get rewritten.
+const eraseDiscardRatio = 0.1
+
+// eraseGCRetries is the number of times EraseTenant retries the value log GC while it's rejected,
+// waiting eraseGCRetryInterval in between, before leaving the value log files to later runs.
+const (
+	eraseGCRetries       = 50
+	eraseGCRetryInterval = 100 * time.Millisecond
+)
+
+// EraseStage denotes the step an EraseTenant call is currently performing.
+type EraseStage int
+
+const (
+	// EraseShredding means the keys of the tenants with the prefix are being destroyed.
+	EraseShredding EraseStage = iota
+	// EraseDropping means the keys with the tenant prefix are being dropped from the LSM tree.
+	EraseDropping
+	// EraseCollecting means the value log files are being garbage collected.
+	EraseCollecting
+	// EraseVerifying means the DB is being scanned to verify no key with the prefix is left.
+	EraseVerifying
+	// EraseDone means the erasure has been verified and the audit record has been written.
+	EraseDone
+)
+
+func (s EraseStage) String() string {
+	switch s {
+	case EraseShredding:
+		return "shredding"
+	case EraseDropping:
+		return "dropping"
+	case EraseCollecting:
+		return "collecting"
+	case EraseVerifying:
+		return "verifying"
+	case EraseDone:
+		return "done"
+	}
+	return "unknown"
+}
+
+// EraseStatus reports the progress of an EraseTenant call.
+type EraseStatus struct {
+	Prefix []byte
+	Stage  EraseStage
+	// KeysDestroyed is the number of tenant keys destroyed. See DB.CreateTenantKey.
+	KeysDestroyed int
+	// VlogFilesRewritten is the number of value log files rewritten so far.
+	VlogFilesRewritten int
+	// VlogCollectionSkipped is set if the value log GC kept being rejected, because another GC
+	// was running or the DB was frozen, and the value log files were left to the later runs.
+	VlogCollectionSkipped bool
+	StartedAt             time.Time
+	// FinishedAt is only set once Stage is EraseDone.
+	FinishedAt time.Time
+}
+
+// EraseTenant permanently removes all the keys with the given prefix. It runs the following
+// steps, reporting the status to progress (if non-nil) as each step starts:
+// - Destroy the keys created via CreateTenantKey for the prefix, or for longer prefixes starting
+//   with it. This makes the values encrypted with them unreadable at once, wherever copies of
+//   them are left: in the value log files and the tables not rewritten yet, or in the log archive.
+// - Drop the prefix from the LSM tree, blocking writes while doing so. See DropPrefixBlocking.
+// - Run value log GC until no more files can be rewritten, so the values of the dropped keys are
+//   removed from disk. The GC is retried for a while if it's rejected, and then left to the later
+//   runs.
+// - Verify that no version of any key with the prefix can be read anymore.
+// - Write an audit record of the erasure, which can be retrieved via TenantErasedAt.
+//
+// Note that the values of a tenant without a key which live in the value log file currently being
+// written to are only reclaimed once that file has been rotated and garbage collected.
+func (db *DB) EraseTenant(prefix []byte, progress func(EraseStatus)) (*EraseStatus, error) {
+	switch {
+	case db.opt.ReadOnly:
+		return nil, errors.New("Attempting to erase tenant in read-only mode.")
+	case len(prefix) == 0:
+		return nil, ErrEmptyKey
+	case bytes.HasPrefix(prefix, badgerPrefix):
+		return nil, ErrInvalidKey
+	}
+
+	status := &EraseStatus{
+		Prefix:    y.SafeCopy(nil, prefix),
+		StartedAt: time.Now(),
+	}
+	report := func(stage EraseStage) {
+		status.Stage = stage
+		if progress != nil {
+			progress(*status)
+		}
+	}
+
+	report(EraseShredding)
+	n, err := db.tenants.destroy(prefix)
+	status.KeysDestroyed = n
+	if err != nil {
+		return status, err
+	}
+
+	report(EraseDropping)
+	if err := db.DropPrefixBlocking(prefix); err != nil {
+		return status, errors.Wrapf(err, "while dropping prefix %#x", prefix)
+	}
+
+	if !db.opt.InMemory {
+		report(EraseCollecting)
+		for retries := 0; ; {
+			_, err := db.RunValueLogGC(eraseDiscardRatio)
+			if err == ErrNoRewrite {
+				break
+			}
+			if err == ErrRejected {
+				if retries++; retries > eraseGCRetries {
+					db.opt.Warningf("Leaving the value log files of the erased prefix %#x to "+
+						"the later GC runs, as the GC keeps being rejected", prefix)
+					status.VlogCollectionSkipped = true
+					break
+				}
+				time.Sleep(eraseGCRetryInterval)
+				continue
+			}
+			if err != nil {
+				return status, errors.Wrapf(err, "while collecting value log")
+			}
+			status.VlogFilesRewritten++
+			report(EraseCollecting)
+		}
+	}
+
+	report(EraseVerifying)
+	err = db.View(func(txn *Txn) error {
+		iopt := DefaultIteratorOptions
+		iopt.Prefix = prefix
+		iopt.PrefetchValues = false
+		iopt.AllVersions = true
+		itr := txn.NewIterator(iopt)
+		defer itr.Close()
+		if itr.Rewind(); itr.Valid() {
+			return errors.Errorf("key %q still present after erasing prefix %#x",
+				itr.Item().Key(), prefix)
+		}
+		return nil
+	})
+	if err != nil {
+		return status, err
+	}
+
+	status.FinishedAt = time.Now()
+	key := y.KeyWithTs(append(y.SafeCopy(nil, eraseKey), prefix...), 1)
+	req, err := db.sendToWriteCh([]*Entry{{
+		Key:   key,
+		Value: y.U64ToBytes(uint64(status.FinishedAt.UnixNano())),
+	}})
+	if err != nil {
+		return status, errors.Wrapf(err, "while writing erase audit record")
+	}
+	if err := req.Wait(); err != nil {
+		return status, errors.Wrapf(err, "while writing erase audit record")
+	}
+	report(EraseDone)
+	db.opt.Infof("Erased tenant with prefix %#x. Destroyed %d keys. Rewrote %d value log files.",
+		prefix, status.KeysDestroyed, status.VlogFilesRewritten)
+	return status, nil
+}
+
+// TenantErasedAt returns the time at which the given prefix was erased via EraseTenant. It
+// returns ErrKeyNotFound if there is no audit record for the prefix.
+func (db *DB) TenantErasedAt(prefix []byte) (time.Time, error) {
+	var at time.Time
+	err := db.View(func(txn *Txn) error {
+		item, err := txn.Get(append(y.SafeCopy(nil, eraseKey), prefix...))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) != 8 {
+				return errors.Errorf("invalid erase audit record of length %d", len(val))
+			}
+			at = time.Unix(0, int64(y.BytesToU64(val)))
+			return nil
+		})
+	})
+	return at, err
+}
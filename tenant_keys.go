@@ -0,0 +1,393 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+const (
+	// tenantKeyFileSuffix is the suffix of the files holding the keys created via CreateTenantKey.
+	tenantKeyFileSuffix = ".tenantkey"
+	// tenantKeySize is the size of the AES-256 keys of the tenants.
+	tenantKeySize = 32
+	// tenantValueHeaderSize is the size of the header of the values encrypted with the key of
+	// their tenant: the ID of the key, followed by the IV.
+	tenantValueHeaderSize = 8 + aes.BlockSize
+)
+
+// tenantKey is the key the values of the keys with the given prefix are encrypted with.
+type tenantKey struct {
+	id     uint64
+	prefix []byte
+	key    []byte
+}
+
+// tenantKeys holds the keys of the tenants. Destroying the key of a tenant makes all the copies of
+// its values unreadable, wherever they are left: in the value log files not yet garbage collected,
+// in the tables not yet compacted, or in the log archive.
+//
+// Each key is stored in its own file in the DB directory, encrypted with a data key of the key
+// registry if encryption is enabled. The file is overwritten before being removed once the key is
+// destroyed.
+type tenantKeys struct {
+	sync.RWMutex
+	dir      string // Empty in InMemory mode, where the keys are only kept in memory.
+	registry *KeyRegistry
+	byPrefix []*tenantKey // Sorted by prefix. The prefixes don't overlap.
+	byID     map[uint64]*tenantKey
+}
+
+// openTenantKeys reads the keys of the tenants stored in dir. An empty dir keeps them in memory.
+func openTenantKeys(dir string, registry *KeyRegistry) (*tenantKeys, error) {
+	tk := &tenantKeys{
+		dir:      dir,
+		registry: registry,
+		byID:     make(map[uint64]*tenantKey),
+	}
+	if dir == "" {
+		return tk, nil
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), tenantKeyFileSuffix) {
+			continue
+		}
+		k, err := tk.readKeyFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, y.Wrapf(err, "while reading tenant key file %s", info.Name())
+		}
+		tk.insert(k)
+	}
+	return tk, nil
+}
+
+func tenantKeyFileName(id uint64) string {
+	return fmt.Sprintf("%016x%s", id, tenantKeyFileSuffix)
+}
+
+// The file of a tenant key is laid out as follows, the payload being encrypted with the data key
+// of the registry if any, and the checksum being the one of the plain payload.
+// +-------------------+---------+---------+-------------------+
+// | data key ID (8 B) | IV (16) | payload | CRC32 Castagnoli  |
+// +-------------------+---------+---------+-------------------+
+// where the payload is the ID of the tenant key (8 bytes), the key and the prefix.
+func (tk *tenantKeys) writeKeyFile(k *tenantKey) error {
+	dk, err := tk.registry.LatestDataKey()
+	if err != nil {
+		return err
+	}
+	iv, err := y.GenerateIV()
+	if err != nil {
+		return err
+	}
+	payload := make([]byte, 8+len(k.key)+len(k.prefix))
+	binary.BigEndian.PutUint64(payload, k.id)
+	copy(payload[8:], k.key)
+	copy(payload[8+len(k.key):], k.prefix)
+	sum := crc32.Checksum(payload, y.CastagnoliCrcTable)
+
+	buf := make([]byte, 8, 8+len(iv)+len(payload)+crc32.Size)
+	if dk != nil {
+		binary.BigEndian.PutUint64(buf, dk.KeyId)
+		if payload, err = y.XORBlockAllocate(payload, dk.Data, iv); err != nil {
+			return err
+		}
+	}
+	buf = append(buf, iv...)
+	buf = append(buf, payload...)
+	buf = append(buf, y.U32ToBytes(sum)...)
+
+	// The file is renamed once written, so that a crash doesn't leave a partial key file behind.
+	path := filepath.Join(tk.dir, tenantKeyFileName(k.id))
+	tmpPath := path + ".tmp"
+	fp, err := y.OpenTruncFile(tmpPath, true)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(buf); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(tk.dir)
+}
+
+func (tk *tenantKeys) readKeyFile(path string) (*tenantKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < 8+aes.BlockSize+8+tenantKeySize+crc32.Size {
+		return nil, errors.Errorf("tenant key file of invalid length %d", len(buf))
+	}
+	dk, err := tk.registry.DataKey(binary.BigEndian.Uint64(buf))
+	if err != nil {
+		return nil, err
+	}
+	iv := buf[8 : 8+aes.BlockSize]
+	payload := buf[8+aes.BlockSize : len(buf)-crc32.Size]
+	if dk != nil {
+		if payload, err = y.XORBlockAllocate(payload, dk.Data, iv); err != nil {
+			return nil, err
+		}
+	}
+	sum := y.BytesToU32(buf[len(buf)-crc32.Size:])
+	if crc32.Checksum(payload, y.CastagnoliCrcTable) != sum {
+		return nil, errors.Wrapf(y.ErrChecksumMismatch, "in tenant key file, possibly because "+
+			"of a wrong encryption key")
+	}
+	return &tenantKey{
+		id:     binary.BigEndian.Uint64(payload),
+		key:    payload[8 : 8+tenantKeySize],
+		prefix: payload[8+tenantKeySize:],
+	}, nil
+}
+
+// shredKeyFile overwrites the file of a destroyed key before removing it.
+func (tk *tenantKeys) shredKeyFile(id uint64) error {
+	path := filepath.Join(tk.dir, tenantKeyFileName(id))
+	fp, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := fp.Stat()
+	if err == nil {
+		_, err = fp.WriteAt(make([]byte, info.Size()), 0)
+	}
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return syncDir(tk.dir)
+}
+
+// insert adds k to the keys. The caller must hold the lock, or be the only user of tk.
+func (tk *tenantKeys) insert(k *tenantKey) {
+	i := sort.Search(len(tk.byPrefix), func(i int) bool {
+		return bytes.Compare(tk.byPrefix[i].prefix, k.prefix) > 0
+	})
+	tk.byPrefix = append(tk.byPrefix, nil)
+	copy(tk.byPrefix[i+1:], tk.byPrefix[i:])
+	tk.byPrefix[i] = k
+	tk.byID[k.id] = k
+}
+
+// create creates a key for the given prefix, unless it already has one. The prefix can't overlap
+// the prefix of another key, as every key can only be encrypted with one tenant key.
+func (tk *tenantKeys) create(prefix []byte) error {
+	tk.Lock()
+	defer tk.Unlock()
+	for _, k := range tk.byPrefix {
+		switch {
+		case bytes.Equal(k.prefix, prefix):
+			return nil
+		case bytes.HasPrefix(k.prefix, prefix), bytes.HasPrefix(prefix, k.prefix):
+			return errors.Wrapf(ErrInvalidRequest, "The prefix %q overlaps the prefix %q of "+
+				"another tenant key", prefix, k.prefix)
+		}
+	}
+	k := &tenantKey{prefix: y.SafeCopy(nil, prefix), key: make([]byte, tenantKeySize)}
+	if _, err := rand.Read(k.key); err != nil {
+		return err
+	}
+	for k.id == 0 || tk.byID[k.id] != nil {
+		var id [8]byte
+		if _, err := rand.Read(id[:]); err != nil {
+			return err
+		}
+		k.id = binary.BigEndian.Uint64(id[:])
+	}
+	if tk.dir != "" {
+		if err := tk.writeKeyFile(k); err != nil {
+			return y.Wrapf(err, "while writing tenant key")
+		}
+	}
+	tk.insert(k)
+	return nil
+}
+
+// destroy destroys the keys of the tenants whose prefix starts with the given prefix, and returns
+// how many it destroyed.
+func (tk *tenantKeys) destroy(prefix []byte) (int, error) {
+	tk.Lock()
+	defer tk.Unlock()
+	var n int
+	kept := tk.byPrefix[:0]
+	for i, k := range tk.byPrefix {
+		if !bytes.HasPrefix(k.prefix, prefix) {
+			kept = append(kept, k)
+			continue
+		}
+		if tk.dir != "" {
+			if err := tk.shredKeyFile(k.id); err != nil {
+				kept = append(kept, tk.byPrefix[i:]...)
+				tk.byPrefix = kept
+				return n, y.Wrapf(err, "while destroying tenant key of prefix %q", k.prefix)
+			}
+		}
+		delete(tk.byID, k.id)
+		n++
+	}
+	tk.byPrefix = kept
+	return n, nil
+}
+
+// lookup returns the key the value of key must be encrypted with, or nil if it has none.
+func (tk *tenantKeys) lookup(key []byte) *tenantKey {
+	tk.RLock()
+	defer tk.RUnlock()
+	// The prefixes don't overlap, so only the greatest one not above key can be a prefix of it.
+	i := sort.Search(len(tk.byPrefix), func(i int) bool {
+		return bytes.Compare(tk.byPrefix[i].prefix, key) > 0
+	})
+	if i > 0 && bytes.HasPrefix(key, tk.byPrefix[i-1].prefix) {
+		return tk.byPrefix[i-1]
+	}
+	return nil
+}
+
+// known tells if the value of a tenant, as stored, can still be decrypted.
+func (tk *tenantKeys) known(val []byte) bool {
+	if len(val) < tenantValueHeaderSize {
+		return false
+	}
+	tk.RLock()
+	defer tk.RUnlock()
+	return tk.byID[binary.BigEndian.Uint64(val)] != nil
+}
+
+// encrypt encrypts the value of e with the key of its tenant, if it has one, and marks it with
+// bitTenantKey. The value is replaced, not modified. Deletions, merge operands and the values
+// already encrypted are left alone.
+func (tk *tenantKeys) encrypt(e *Entry) error {
+	if e.meta&(bitDelete|bitMergeEntry|bitTenantKey) > 0 {
+		return nil
+	}
+	k := tk.lookup(y.ParseKey(e.Key))
+	if k == nil {
+		return nil
+	}
+	iv, err := y.GenerateIV()
+	if err != nil {
+		return err
+	}
+	hdr := make([]byte, tenantValueHeaderSize)
+	binary.BigEndian.PutUint64(hdr, k.id)
+	copy(hdr[8:], iv)
+	if e.valueReader != nil {
+		block, err := aes.NewCipher(k.key)
+		if err != nil {
+			return err
+		}
+		r := cipher.StreamReader{S: cipher.NewCTR(block, iv), R: e.valueReader}
+		e.valueReader = io.MultiReader(bytes.NewReader(hdr), r)
+		e.valueSize += tenantValueHeaderSize
+	} else {
+		val := make([]byte, tenantValueHeaderSize+len(e.Value))
+		copy(val, hdr)
+		if err := y.XORBlock(val[tenantValueHeaderSize:], e.Value, k.key, iv); err != nil {
+			return err
+		}
+		e.Value = val
+	}
+	e.meta |= bitTenantKey
+	return nil
+}
+
+// decrypt returns the plain value of a value encrypted with the key of its tenant. It returns
+// ErrTenantKeyDestroyed if the key has been destroyed.
+func (tk *tenantKeys) decrypt(val []byte) ([]byte, error) {
+	if len(val) < tenantValueHeaderSize {
+		return nil, errors.Errorf("tenant encrypted value of invalid length %d", len(val))
+	}
+	tk.RLock()
+	k := tk.byID[binary.BigEndian.Uint64(val)]
+	tk.RUnlock()
+	if k == nil {
+		return nil, ErrTenantKeyDestroyed
+	}
+	return y.XORBlockAllocate(val[tenantValueHeaderSize:], k.key, val[8:tenantValueHeaderSize])
+}
+
+// plainValue returns val, decrypted if meta marks it as encrypted with the key of its tenant.
+func (db *DB) plainValue(meta byte, val []byte) ([]byte, error) {
+	if meta&bitTenantKey == 0 {
+		return val, nil
+	}
+	return db.tenants.decrypt(val)
+}
+
+// CreateTenantKey creates a key for the tenant whose keys have the given prefix. The values of the
+// keys with the prefix written from then on are encrypted with it, and it is destroyed by
+// EraseTenant, which makes all the copies of these values left on disk unreadable: this is known
+// as crypto-shredding. The values written before the key is created aren't encrypted with it, so
+// it should be created before the tenant is written to.
+//
+// The key is stored in its own file in the DB directory, encrypted with the encryption key of the
+// DB if it has one. Logical backups hold the plain values, but physical backups hold the keys. The
+// prefix can't overlap the prefix of another tenant key or of a merge function, as the merge
+// operands aren't encrypted. Creating the key of a prefix which already has one does nothing.
+func (db *DB) CreateTenantKey(prefix []byte) error {
+	switch {
+	case db.opt.ReadOnly:
+		return errors.New("Attempting to create a tenant key in read-only mode.")
+	case len(prefix) == 0:
+		return ErrEmptyKey
+	case bytes.HasPrefix(prefix, badgerPrefix):
+		return ErrInvalidKey
+	}
+	for _, mf := range db.opt.MergeFuncs {
+		if bytes.HasPrefix(mf.Prefix, prefix) || bytes.HasPrefix(prefix, mf.Prefix) {
+			return errors.Wrapf(ErrInvalidRequest, "The prefix %q overlaps the prefix %q of the "+
+				"merge function %q", prefix, mf.Prefix, mf.Name)
+		}
+	}
+	return db.tenants.create(prefix)
+}
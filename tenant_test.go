@@ -0,0 +1,166 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEraseTenant(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		for _, tenant := range []string{"tenant1", "tenant2"} {
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("%s/key%d", tenant, i))
+				txnSet(t, db, key, key, 0)
+			}
+		}
+
+		_, err := db.TenantErasedAt([]byte("tenant1/"))
+		require.Equal(t, ErrKeyNotFound, err)
+
+		var stages []EraseStage
+		status, err := db.EraseTenant([]byte("tenant1/"), func(s EraseStatus) {
+			stages = append(stages, s.Stage)
+		})
+		require.NoError(t, err)
+		require.Equal(t, EraseDone, status.Stage)
+		require.Equal(t, EraseShredding, stages[0])
+		require.Zero(t, status.KeysDestroyed)
+		require.Equal(t, EraseDone, stages[len(stages)-1])
+
+		at, err := db.TenantErasedAt([]byte("tenant1/"))
+		require.NoError(t, err)
+		require.Equal(t, status.FinishedAt.UnixNano(), at.UnixNano())
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get([]byte("tenant1/key1"))
+			require.Equal(t, ErrKeyNotFound, err)
+			item, err := txn.Get([]byte("tenant2/key1"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("tenant2/key1"), getItemValue(t, item))
+			return nil
+		}))
+
+		_, err = db.EraseTenant(nil, nil)
+		require.Equal(t, ErrEmptyKey, err)
+		_, err = db.EraseTenant(badgerPrefix, nil)
+		require.Equal(t, ErrInvalidKey, err)
+	})
+}
+
+func TestEraseTenantKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	key := make([]byte, 32)
+	rand.Read(key)
+	opt := getTestOptions(dir).WithEncryptionKey(key).WithIndexCacheSize(1 << 20).
+		WithValueThreshold(64)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.CreateTenantKey([]byte("tenant1/")))
+	require.NoError(t, db.CreateTenantKey([]byte("tenant2/")))
+	require.NoError(t, db.CreateTenantKey([]byte("tenant2/")))
+	err = db.CreateTenantKey([]byte("tenant2/sub/"))
+	require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+
+	// Both small values stored in the LSM tree and big ones stored in the value log.
+	val := func(tenant string, i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%s/val%d", tenant, i)), 1+i%2*10)
+	}
+	for _, tenant := range []string{"tenant1", "tenant2", "tenant3"} {
+		for i := 0; i < 10; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("%s/key%d", tenant, i)), val(tenant, i), 0)
+		}
+	}
+	check := func(db *DB, tenant string) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 10; i++ {
+				item, err := txn.Get([]byte(fmt.Sprintf("%s/key%d", tenant, i)))
+				require.NoError(t, err)
+				require.Equal(t, val(tenant, i), getItemValue(t, item))
+				require.Equal(t, tenant != "tenant3", item.meta&bitTenantKey > 0)
+				vv, err := item.ValueView()
+				require.NoError(t, err)
+				require.Equal(t, val(tenant, i), vv.Bytes())
+				vv.Release()
+			}
+			return nil
+		}))
+	}
+	for _, tenant := range []string{"tenant1", "tenant2", "tenant3"} {
+		check(db, tenant)
+	}
+
+	// Keep the encrypted values of tenant1 as stored, as if a copy was left behind.
+	var stored [][]byte
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 10; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("tenant1/key%d", i)))
+			require.NoError(t, err)
+			if item.meta&bitValuePointer == 0 {
+				stored = append(stored, y.SafeCopy(nil, item.vptr))
+				continue
+			}
+			var vp valuePointer
+			vp.Decode(item.vptr)
+			buf, cb, err := db.vlog.Read(vp, nil)
+			require.NoError(t, err)
+			require.False(t, bytes.Contains(buf, []byte("tenant1/val")))
+			stored = append(stored, y.SafeCopy(nil, buf))
+			runCallback(cb)
+		}
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	check(db, "tenant1")
+
+	// The GC being run elsewhere holds up the erasure for a while.
+	db.vlog.garbageCh <- struct{}{}
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		<-db.vlog.garbageCh
+	}()
+	status, err := db.EraseTenant([]byte("tenant1/"), nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, status.KeysDestroyed)
+	require.False(t, status.VlogCollectionSkipped)
+	for _, v := range stored {
+		_, err := db.tenants.decrypt(v)
+		require.Equal(t, ErrTenantKeyDestroyed, err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+tenantKeyFileSuffix))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	check(db, "tenant2")
+	check(db, "tenant3")
+}
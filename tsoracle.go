@@ -0,0 +1,204 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+const (
+	// tsLogicalBits is the number of low bits of the timestamps used for the logical clock. The
+	// high bits hold the physical time in milliseconds.
+	tsLogicalBits = 16
+	// tsLease is the span of timestamps reserved by each write of the timestamp oracle state, so
+	// the state is written about once per second.
+	tsLease = 1000 << tsLogicalBits
+)
+
+// TimestampOracle hands out the timestamps of the transactions of a managed DB, the way the DB
+// does by itself in normal mode. The timestamps come from a hybrid logical clock: their high bits
+// are the physical time in milliseconds, so they can be related to wall clock time via
+// TimestampTime, while the low bits keep them strictly increasing, even if the clock goes back.
+// The oracle persists its state in the DB, so the timestamps keep increasing across restarts.
+//
+// The oracle also keeps track of the timestamps in use, and moves the discard timestamp of the DB
+// (see DB.SetDiscardTs) up to the oldest read timestamp still in use. Hence, all the transactions
+// on the DB should go through the oracle, either via View and Update, or via ReadTs, NewCommitTs
+// and their Done counterparts.
+type TimestampOracle struct {
+	sync.Mutex // Guards the fields below, and the order of the calls to Begin of the marks.
+	db         *DB
+	last       uint64 // The last timestamp handed out.
+	lease      uint64 // The timestamp up to which the state has been persisted.
+
+	readMark   *y.WaterMark // Tracks the read timestamps in use.
+	commitMark *y.WaterMark // Tracks the commits in progress.
+	closer     *z.Closer
+}
+
+// NewTimestampOracle returns a timestamp oracle for the given managed DB. The first timestamp it
+// hands out is higher than all the versions in the DB, and than all the timestamps handed out by
+// the previous oracles of the DB. Stop must be called before closing the DB.
+func NewTimestampOracle(db *DB) (*TimestampOracle, error) {
+	if !db.opt.managedTxns {
+		return nil, errors.Wrapf(ErrInvalidRequest, "TimestampOracle requires managed mode")
+	}
+	o := &TimestampOracle{
+		db:         db,
+		readMark:   &y.WaterMark{Name: "badger.OracleReads"},
+		commitMark: &y.WaterMark{Name: "badger.OracleCommits"},
+		closer:     z.NewCloser(2),
+	}
+	err := db.View(func(txn *Txn) error {
+		item, err := txn.Get(tsOracleKey)
+		if err == ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) != 8 {
+				return errors.Errorf("invalid timestamp oracle state of length %d", len(val))
+			}
+			o.lease = y.BytesToU64(val)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, y.Wrapf(err, "while reading timestamp oracle state")
+	}
+	o.last = o.lease
+	if v := db.MaxVersion(); v > o.last {
+		o.last = v
+	}
+	o.readMark.Init(o.closer)
+	o.commitMark.Init(o.closer)
+	o.readMark.SetDoneUntil(o.last)
+	o.commitMark.SetDoneUntil(o.last)
+	return o, nil
+}
+
+// Stop stops the oracle. It must not be used afterwards.
+func (o *TimestampOracle) Stop() {
+	o.closer.SignalAndWait()
+}
+
+// TimestampTime returns the wall clock time at which a timestamp handed out by a TimestampOracle
+// was created, with millisecond precision.
+func TimestampTime(ts uint64) time.Time {
+	ms := int64(ts >> tsLogicalBits)
+	return time.Unix(ms/1e3, (ms%1e3)*1e6)
+}
+
+// next returns a new timestamp. It must be called under the lock.
+func (o *TimestampOracle) next() (uint64, error) {
+	ts := uint64(time.Now().UnixNano()/1e6) << tsLogicalBits
+	if ts <= o.last {
+		ts = o.last + 1
+	}
+	if ts > o.lease {
+		// Persist the state before handing out ts, so it is never handed out again.
+		lease := ts + tsLease
+		req, err := o.db.sendToWriteCh([]*Entry{{
+			Key:   y.KeyWithTs(tsOracleKey, 1),
+			Value: y.U64ToBytes(lease),
+		}})
+		if err != nil {
+			return 0, y.Wrapf(err, "while writing timestamp oracle state")
+		}
+		if err := req.Wait(); err != nil {
+			return 0, y.Wrapf(err, "while writing timestamp oracle state")
+		}
+		o.lease = lease
+	}
+	o.last = ts
+	return ts, nil
+}
+
+// ReadTs returns the timestamp to read the DB at, which covers all the commits given a timestamp so
+// far via the oracle, waiting for those in progress. DoneRead must be called with it once the read
+// is done.
+func (o *TimestampOracle) ReadTs() uint64 {
+	o.Lock()
+	readTs := o.last
+	o.readMark.Begin(readTs)
+	o.Unlock()
+
+	// Wait for the commits handed out a timestamp up to readTs, so they are all seen.
+	y.Check(o.commitMark.WaitForMark(context.Background(), readTs))
+	return readTs
+}
+
+// DoneRead marks the read at readTs, returned by ReadTs, as done.
+func (o *TimestampOracle) DoneRead(readTs uint64) {
+	o.readMark.Done(readTs)
+	o.db.SetDiscardTs(o.readMark.DoneUntil())
+}
+
+// NewCommitTs returns a new timestamp to commit a transaction at. DoneCommit must be called with
+// it once the commit is done, successful or not. The commits are seen by ReadTs in the order of
+// their timestamps, so they should be done promptly.
+func (o *TimestampOracle) NewCommitTs() (uint64, error) {
+	o.Lock()
+	defer o.Unlock()
+	commitTs, err := o.next()
+	if err != nil {
+		return 0, err
+	}
+	o.commitMark.Begin(commitTs)
+	return commitTs, nil
+}
+
+// DoneCommit marks the commit at commitTs, returned by NewCommitTs, as done.
+func (o *TimestampOracle) DoneCommit(commitTs uint64) {
+	o.commitMark.Done(commitTs)
+}
+
+// View executes fn in a read-only transaction at a timestamp returned by ReadTs, like DB.View does
+// in normal mode.
+func (o *TimestampOracle) View(fn func(txn *Txn) error) error {
+	readTs := o.ReadTs()
+	defer o.DoneRead(readTs)
+	txn := o.db.NewTransactionAt(readTs, false)
+	defer txn.Discard()
+	return fn(txn)
+}
+
+// Update executes fn in a read-write transaction, and commits it at a timestamp returned by
+// NewCommitTs, like DB.Update does in normal mode. It returns ErrConflict if the transaction
+// conflicts with another one committed since it started.
+func (o *TimestampOracle) Update(fn func(txn *Txn) error) error {
+	readTs := o.ReadTs()
+	defer o.DoneRead(readTs)
+	txn := o.db.NewTransactionAt(readTs, true)
+	defer txn.Discard()
+	if err := fn(txn); err != nil {
+		return err
+	}
+	commitTs, err := o.NewCommitTs()
+	if err != nil {
+		return err
+	}
+	defer o.DoneCommit(commitTs)
+	return txn.CommitAt(commitTs, nil)
+}
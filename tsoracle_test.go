@@ -0,0 +1,95 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimestampOracle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	_, err = NewTimestampOracle(db)
+	require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+	require.NoError(t, db.Close())
+
+	db, err = OpenManaged(opt)
+	require.NoError(t, err)
+	o, err := NewTimestampOracle(db)
+	require.NoError(t, err)
+
+	require.NoError(t, o.Update(func(txn *Txn) error {
+		return txn.Set([]byte("key"), []byte("val"))
+	}))
+	require.NoError(t, o.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val"), getItemValue(t, item))
+		require.WithinDuration(t, time.Now(), TimestampTime(item.Version()), time.Minute)
+		return nil
+	}))
+
+	// Conflicting transactions are detected like in normal mode.
+	readTs := o.ReadTs()
+	txn := db.NewTransactionAt(readTs, true)
+	_, err = txn.Get([]byte("key"))
+	require.NoError(t, err)
+	require.NoError(t, txn.Set([]byte("key"), []byte("txn")))
+	require.NoError(t, o.Update(func(txn *Txn) error {
+		return txn.Set([]byte("key"), []byte("other"))
+	}))
+	commitTs, err := o.NewCommitTs()
+	require.NoError(t, err)
+	require.Equal(t, ErrConflict, txn.CommitAt(commitTs, nil))
+	o.DoneCommit(commitTs)
+	o.DoneRead(readTs)
+
+	// The discard timestamp follows the reads.
+	for i := 0; db.orc.discardAtOrBelow() < readTs; i++ {
+		require.NoError(t, o.View(func(txn *Txn) error { return nil }))
+		require.Less(t, i, 500, "discard timestamp did not advance")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The timestamps keep increasing across restarts.
+	last, err := o.NewCommitTs()
+	require.NoError(t, err)
+	o.DoneCommit(last)
+	o.Stop()
+	require.NoError(t, db.Close())
+
+	db, err = OpenManaged(opt)
+	require.NoError(t, err)
+	defer db.Close()
+	o, err = NewTimestampOracle(db)
+	require.NoError(t, err)
+	defer o.Stop()
+	ts, err := o.NewCommitTs()
+	require.NoError(t, err)
+	require.Greater(t, ts, last)
+	o.DoneCommit(ts)
+}
@@ -21,19 +21,22 @@ import (
 	"context"
 	"encoding/hex"
 	"math"
+	"math/rand"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/dgraph-io/badger/v3/options"
 	"github.com/dgraph-io/badger/v3/y"
 	"github.com/dgraph-io/ristretto/z"
 	"github.com/pkg/errors"
 )
 
 type oracle struct {
-	isManaged       bool // Does not change value, so no locking required.
-	detectConflicts bool // Determines if the txns should be checked for conflicts.
+	isManaged bool // Does not change value, so no locking required.
 
 	sync.Mutex // For nextTxnTs and commits.
 	// writeChLock lock is for ensuring that transactions go to the write
@@ -53,6 +56,9 @@ type oracle struct {
 	// of keys written and their latest commit counter).
 	committedTxns []committedTxn
 	lastCleanupTs uint64
+	// rangeReaders is the number of running txns tracking the ranges they read. The keys written by
+	// the committed txns are only recorded while it is non-zero.
+	rangeReaders int
 
 	// closer is used to stop watermarks.
 	closer *z.Closer
@@ -62,12 +68,33 @@ type committedTxn struct {
 	ts uint64
 	// ConflictKeys Keeps track of the entries written at timestamp ts.
 	conflictKeys map[uint64]struct{}
+	// keys holds the keys written at timestamp ts, if there were txns tracking the ranges they
+	// read. It is nil otherwise.
+	keys [][]byte
+}
+
+// writesPrefix returns the first of the given prefixes the committed txn wrote a key with, if any.
+// It is assumed to have done so if its keys were not recorded.
+func (c committedTxn) writesPrefix(prefixes [][]byte) ([]byte, bool) {
+	if len(prefixes) == 0 || len(c.conflictKeys) == 0 {
+		return nil, false
+	}
+	if c.keys == nil {
+		return prefixes[0], true
+	}
+	for _, key := range c.keys {
+		for _, prefix := range prefixes {
+			if bytes.HasPrefix(key, prefix) {
+				return prefix, true
+			}
+		}
+	}
+	return nil, false
 }
 
 func newOracle(opt Options) *oracle {
 	orc := &oracle{
-		isManaged:       opt.managedTxns,
-		detectConflicts: opt.DetectConflicts,
+		isManaged: opt.managedTxns,
 		// We're not initializing nextTxnTs and readOnlyTs. It would be done after replay in Open.
 		//
 		// WaterMarks must be 64-bit aligned for atomic package, hence we must use pointers here.
@@ -116,6 +143,19 @@ func (o *oracle) incrementNextTs() {
 	o.nextTxnTs++
 }
 
+// advanceTs moves the next commit timestamp past ts, so the versions at or below ts become visible
+// to the transactions started afterwards.
+func (o *oracle) advanceTs(ts uint64) {
+	o.Lock()
+	defer o.Unlock()
+	if o.nextTxnTs > ts {
+		return
+	}
+	o.nextTxnTs = ts + 1
+	o.txnMark.Begin(ts)
+	o.txnMark.Done(ts)
+}
+
 // Any deleted or invalid versions at or below ts would be discarded during
 // compaction to reclaim disk space in LSM tree and thence value log.
 func (o *oracle) setDiscardTs(ts uint64) {
@@ -134,10 +174,12 @@ func (o *oracle) discardAtOrBelow() uint64 {
 	return o.readMark.DoneUntil()
 }
 
-// hasConflict must be called while having a lock.
-func (o *oracle) hasConflict(txn *Txn) bool {
-	if len(txn.reads) == 0 {
-		return false
+// hasConflict returns ErrConflict, or a ConflictError if the read keys of txn are recorded, if txn
+// has read a key or a range written by a transaction committed since it started. It must be called
+// while having a lock.
+func (o *oracle) hasConflict(txn *Txn) error {
+	if len(txn.reads) == 0 && len(txn.readPrefixes) == 0 {
+		return nil
 	}
 	for _, committedTxn := range o.committedTxns {
 		// If the committedTxn.ts is less than txn.readTs that implies that the
@@ -152,20 +194,29 @@ func (o *oracle) hasConflict(txn *Txn) bool {
 
 		for _, ro := range txn.reads {
 			if _, has := committedTxn.conflictKeys[ro]; has {
-				return true
+				if txn.readKeys == nil {
+					return ErrConflict
+				}
+				return &ConflictError{Key: txn.readKeys[ro], CommitTs: committedTxn.ts}
 			}
 		}
+		if prefix, has := committedTxn.writesPrefix(txn.readPrefixes); has {
+			if txn.readKeys == nil {
+				return ErrConflict
+			}
+			return &ConflictError{Prefix: prefix, CommitTs: committedTxn.ts}
+		}
 	}
 
-	return false
+	return nil
 }
 
-func (o *oracle) newCommitTs(txn *Txn) (uint64, bool) {
+func (o *oracle) newCommitTs(txn *Txn) (uint64, error) {
 	o.Lock()
 	defer o.Unlock()
 
-	if o.hasConflict(txn) {
-		return 0, true
+	if err := o.hasConflict(txn); err != nil {
+		return 0, err
 	}
 
 	var ts uint64
@@ -185,28 +236,52 @@ func (o *oracle) newCommitTs(txn *Txn) (uint64, bool) {
 
 	y.AssertTrue(ts >= o.lastCleanupTs)
 
-	if o.detectConflicts {
+	if txn.conflictKeys != nil {
 		// We should ensure that txns are not added to o.committedTxns slice when
 		// conflict detection is disabled otherwise this slice would keep growing.
-		o.committedTxns = append(o.committedTxns, committedTxn{
+		ct := committedTxn{
 			ts:           ts,
 			conflictKeys: txn.conflictKeys,
-		})
+		}
+		if o.rangeReaders > 0 {
+			ct.keys = make([][]byte, 0, len(txn.pendingWrites))
+			for key := range txn.pendingWrites {
+				ct.keys = append(ct.keys, []byte(key))
+			}
+		}
+		o.committedTxns = append(o.committedTxns, ct)
 	}
 
-	return ts, false
+	return ts, nil
+}
+
+// newBatchTs returns a commit timestamp for writes made outside of a transaction, recording the
+// given keys as written at it for conflict detection, if non-nil. doneCommit must be called with
+// the timestamp once the writes are done.
+func (o *oracle) newBatchTs(conflictKeys map[uint64]struct{}) uint64 {
+	o.Lock()
+	defer o.Unlock()
+
+	o.cleanupCommittedTransactions()
+	ts := o.nextTxnTs
+	o.nextTxnTs++
+	o.txnMark.Begin(ts)
+	if conflictKeys != nil {
+		o.committedTxns = append(o.committedTxns, committedTxn{ts: ts, conflictKeys: conflictKeys})
+	}
+	return ts
 }
 
 func (o *oracle) doneRead(txn *Txn) {
-	if !txn.doneRead {
-		txn.doneRead = true
+	// The read mark can also be released by the timeout of the txn, from another goroutine.
+	if atomic.CompareAndSwapInt32(&txn.doneRead, 0, 1) {
 		o.readMark.Done(txn.readTs)
 	}
 }
 
 func (o *oracle) cleanupCommittedTransactions() { // Must be called under o.Lock
-	if !o.detectConflicts {
-		// When detectConflicts is set to false, we do not store any
+	if len(o.committedTxns) == 0 {
+		// When conflict detection is disabled, we do not store any
 		// committedTxns and so there's nothing to clean up.
 		return
 	}
@@ -245,6 +320,13 @@ func (o *oracle) doneCommit(cts uint64) {
 	o.txnMark.Done(cts)
 }
 
+// WriteOptions control how the writes of a transaction or a WriteBatch are persisted.
+type WriteOptions struct {
+	// Sync specifies which files are synced to disk before the commit returns. The default,
+	// options.SyncDefault, syncs according to Options.SyncWrites.
+	Sync options.SyncMode
+}
+
 // Txn represents a Badger transaction.
 type Txn struct {
 	readTs   uint64
@@ -254,6 +336,11 @@ type Txn struct {
 	db       *DB
 
 	reads []uint64 // contains fingerprints of keys read.
+	// readKeys maps the fingerprints in reads to their keys, if Options.ReportConflictKeys is set.
+	readKeys map[uint64][]byte
+	// readPrefixes contains the prefixes iterated over, if trackRanges is set.
+	readPrefixes [][]byte
+	trackRanges  bool
 	// contains fingerprints of keys written. This is used for conflict detection.
 	conflictKeys map[uint64]struct{}
 	readsLock    sync.Mutex // guards the reads slice. See addReadKey.
@@ -261,10 +348,60 @@ type Txn struct {
 	pendingWrites   map[string]*Entry // cache stores any writes done by txn.
 	duplicateWrites []*Entry          // Used in managed mode to store duplicate entries.
 
+	// savepoints is the stack of the savepoints which can still be rolled back to. undo records the
+	// changes done to the pending writes since the oldest of them.
+	savepoints []*Savepoint
+	undo       []undoEntry
+
+	// locks holds the keys locked via Lock. They are read at lockTs.
+	locks  map[string]struct{}
+	lockTs uint64
+
 	numIterators int32
 	discarded    bool
-	doneRead     bool
-	update       bool // update is used to conditionally keep track of reads.
+	doneRead     int32 // accessed atomically.
+	update       bool  // update is used to conditionally keep track of reads.
+	autoSpill    bool  // autoSpill is set via SetAutoSpill.
+	writeOpt     WriteOptions
+
+	// detectConflicts determines whether the reads of the txn are checked for conflicts. The writes
+	// are tracked for the other txns if conflictKeys is set.
+	detectConflicts bool
+
+	// timeout discards the txn once Options.TxnTimeout expires, unless it's being committed. state
+	// is one of txnActive, txnCommitting and txnExpired, accessed atomically. stack is the stack
+	// trace of the creation of the txn, which is logged on expiry.
+	timeout *time.Timer
+	state   int32
+	stack   []byte
+
+	// readTsReleased is set once a detached iterator has released the read timestamp of the txn.
+	readTsReleased int32
+}
+
+// The states of a txn, which keep its commit and its expiry mutually exclusive.
+const (
+	txnActive int32 = iota
+	txnCommitting
+	txnExpired
+)
+
+// Savepoint marks a point in the pending writes of a transaction, which the transaction can be
+// rolled back to via Txn.RollbackTo.
+type Savepoint struct {
+	undoLen       int
+	numDuplicates int
+	count         int64
+	size          int64
+}
+
+// undoEntry records the pending write of key that was replaced by a modification.
+type undoEntry struct {
+	key  string
+	prev *Entry // nil if key had no pending write.
+	// fp is set if the modification added the fingerprint of key to conflictKeys.
+	fp    uint64
+	hasFp bool
 }
 
 type pendingWritesIterator struct {
@@ -302,13 +439,9 @@ func (pi *pendingWritesIterator) Key() []byte {
 func (pi *pendingWritesIterator) Value() y.ValueStruct {
 	y.AssertTrue(pi.Valid())
 	entry := pi.entries[pi.nextIdx]
-	return y.ValueStruct{
-		Value:     entry.Value,
-		Meta:      entry.meta,
-		UserMeta:  entry.UserMeta,
-		ExpiresAt: entry.ExpiresAt,
-		Version:   pi.readTs,
-	}
+	vs := entry.valueStruct(entry.Value, entry.meta)
+	vs.Version = pi.readTs
+	return vs
 }
 
 func (pi *pendingWritesIterator) Valid() bool {
@@ -358,6 +491,12 @@ func exceedsSize(prefix string, max int64, key []byte) error {
 		prefix, len(key), max, prefix, hex.Dump(key[:1<<10]))
 }
 
+// errPendingStream is returned on reading the pending write of key, if its value is set via
+// Entry.WithValueReader.
+func errPendingStream(key []byte) error {
+	return errors.Wrapf(ErrInvalidRequest, "Value of key %q is only read on commit", key)
+}
+
 const maxKeySize = 65000
 const maxValSize = 1 << 20
 
@@ -387,44 +526,142 @@ func (txn *Txn) modify(e *Entry) error {
 		return ErrReadOnlyTxn
 	case txn.discarded:
 		return ErrDiscardedTxn
+	case txn.isExpired():
+		return ErrTxnTimeout
 	case len(e.Key) == 0:
 		return ErrEmptyKey
 	case bytes.HasPrefix(e.Key, badgerPrefix):
 		return ErrInvalidKey
+	case len(e.UserMetaExt) > MaxUserMetaExtSize:
+		return errors.Wrapf(ErrInvalidRequest, "UserMetaExt of length %d exceeds the limit of %d",
+			len(e.UserMetaExt), MaxUserMetaExtSize)
 	case len(e.Key) > maxKeySize:
 		// Key length can't be more than uint16, as determined by table::header.  To
 		// keep things safe and allow badger move prefix and a timestamp suffix, let's
 		// cut it down to 65000, instead of using 65536.
 		return exceedsSize("Key", maxKeySize, e.Key)
+	case e.valueReader != nil && (e.valueSize < 0 || e.valueSize > txn.db.opt.ValueLogFileSize):
+		return errors.Errorf("Value with size %d exceeded %d limit", e.valueSize,
+			txn.db.opt.ValueLogFileSize)
 	case int64(len(e.Value)) > txn.db.opt.ValueLogFileSize:
 		return exceedsSize("Value", txn.db.opt.ValueLogFileSize, e.Value)
-	case txn.db.opt.InMemory && int64(len(e.Value)) > txn.db.valueThreshold():
-		return exceedsSize("Value", txn.db.valueThreshold(), e.Value)
+	case txn.db.opt.InMemory && e.valueLen() > txn.db.valueThreshold():
+		return errors.Errorf("Value with size %d exceeded %d limit", e.valueLen(),
+			txn.db.valueThreshold())
 	}
 
 	if err := txn.db.isBanned(e.Key); err != nil {
 		return err
 	}
+	orig := e
+	if orig.meta&bitMergeEntry > 0 {
+		if old, ok := txn.pendingWrites[string(e.Key)]; ok && old.valueReader != nil {
+			return errPendingStream(e.Key)
+		}
+		e = txn.combineWithPending(orig)
+	}
 	if err := txn.checkSize(e); err != nil {
-		return err
+		if err != ErrTxnTooBig || !txn.autoSpill {
+			return err
+		}
+		if err := txn.spill(); err != nil {
+			return err
+		}
+		// The pending write a merge operand was combined with has been committed now.
+		e = orig
+		if err := txn.checkSize(e); err != nil {
+			return err
+		}
+	}
+	// Only the values written to the value log are streamed. checkSize has fixed the threshold.
+	if e.valueReader != nil && (txn.db.opt.InMemory || txn.db.opt.managedTxns ||
+		e.skipVlogAndSetThreshold(txn.db.valueThreshold())) {
+		if err := e.readValue(); err != nil {
+			return err
+		}
 	}
 
 	// The txn.conflictKeys is used for conflict detection. If conflict detection
 	// is disabled, we don't need to store key hashes in this map.
-	if txn.db.opt.DetectConflicts {
+	var undo undoEntry
+	if txn.conflictKeys != nil {
 		fp := z.MemHash(e.Key) // Avoid dealing with byte arrays.
+		if _, ok := txn.conflictKeys[fp]; !ok {
+			undo.fp, undo.hasFp = fp, true
+		}
 		txn.conflictKeys[fp] = struct{}{}
 	}
+	oldEntry, ok := txn.pendingWrites[string(e.Key)]
 	// If a duplicate entry was inserted in managed mode, move it to the duplicate writes slice.
 	// Add the entry to duplicateWrites only if both the entries have different versions. For
 	// same versions, we will overwrite the existing entry.
-	if oldEntry, ok := txn.pendingWrites[string(e.Key)]; ok && oldEntry.version != e.version {
+	if ok && oldEntry.version != e.version {
 		txn.duplicateWrites = append(txn.duplicateWrites, oldEntry)
 	}
+	if len(txn.savepoints) > 0 {
+		undo.key, undo.prev = string(e.Key), oldEntry
+		txn.undo = append(txn.undo, undo)
+	}
 	txn.pendingWrites[string(e.Key)] = e
 	return nil
 }
 
+// Savepoint returns a Savepoint marking the current state of the pending writes of the
+// transaction. A later call to RollbackTo with it undoes all the writes done after this call,
+// without discarding the transaction.
+func (txn *Txn) Savepoint() *Savepoint {
+	sp := &Savepoint{
+		undoLen:       len(txn.undo),
+		numDuplicates: len(txn.duplicateWrites),
+		count:         txn.count,
+		size:          txn.size,
+	}
+	txn.savepoints = append(txn.savepoints, sp)
+	return sp
+}
+
+// RollbackTo undoes all the writes done by the transaction since sp was taken. The savepoints
+// taken after sp are invalidated, while sp itself can be rolled back to again. The keys read since
+// sp are still considered for conflict detection. RollbackTo returns ErrInvalidRequest if sp
+// doesn't belong to the transaction or has been invalidated.
+func (txn *Txn) RollbackTo(sp *Savepoint) error {
+	switch {
+	case !txn.update:
+		return ErrReadOnlyTxn
+	case txn.discarded:
+		return ErrDiscardedTxn
+	case txn.isExpired():
+		return ErrTxnTimeout
+	}
+	idx := -1
+	for i := len(txn.savepoints) - 1; i >= 0; i-- {
+		if txn.savepoints[i] == sp {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return errors.Wrapf(ErrInvalidRequest, "Savepoint is not valid for this transaction")
+	}
+	txn.savepoints = txn.savepoints[:idx+1]
+
+	for i := len(txn.undo) - 1; i >= sp.undoLen; i-- {
+		u := txn.undo[i]
+		if u.prev == nil {
+			delete(txn.pendingWrites, u.key)
+		} else {
+			txn.pendingWrites[u.key] = u.prev
+		}
+		if u.hasFp {
+			delete(txn.conflictKeys, u.fp)
+		}
+	}
+	txn.undo = txn.undo[:sp.undoLen]
+	txn.duplicateWrites = txn.duplicateWrites[:sp.numDuplicates]
+	txn.count, txn.size = sp.count, sp.size
+	return nil
+}
+
 // Set adds a key-value pair to the database.
 // It will return ErrReadOnlyTxn if update flag was set to false when creating the transaction.
 //
@@ -459,6 +696,64 @@ func (txn *Txn) Delete(key []byte) error {
 	return txn.modify(e)
 }
 
+// Merge writes a merge operand for key. The value of key becomes the result of applying the merge
+// function registered for key via Options.WithMergeFunc to its current value and the operand. The
+// operands are merged lazily by reads and collapsed persistently by compactions, so Merge doesn't
+// need to read the current value. It returns ErrInvalidRequest if no merge function is registered
+// for key.
+//
+// The current transaction keeps a reference to the key and operand byte slice arguments. Users
+// must not modify them until the end of the transaction.
+func (txn *Txn) Merge(key, operand []byte) error {
+	if txn.db.mergeFunc(key) == nil {
+		return errors.Wrapf(ErrInvalidRequest, "No merge function registered for key: %q", key)
+	}
+	e := &Entry{Key: key, Value: operand, meta: bitMergeEntry}
+	// Keep the operands in the LSM tree, so that compactions can merge them.
+	e.valThreshold = int64(txn.db.opt.maxValueThreshold)
+	return txn.modify(e)
+}
+
+// combineWithPending returns the entry replacing the pending write of the key of the merge operand
+// e, if there is one. The result is e combined with the pending write.
+func (txn *Txn) combineWithPending(e *Entry) *Entry {
+	old, ok := txn.pendingWrites[string(e.Key)]
+	if !ok || old.version != e.version {
+		return e
+	}
+	combined := *e
+	switch {
+	case isDeletedOrExpired(old.meta, old.ExpiresAt):
+		combined.meta = 0
+	default:
+		combined.Value = txn.db.mergeFunc(e.Key).Merge(old.Value, e.Value)
+		combined.meta = old.meta & bitMergeEntry
+	}
+	return &combined
+}
+
+// pendingItem returns the item for the pending write e of key. The value of a merge operand
+// depends on the committed value of key, so it is merged when read.
+func (txn *Txn) pendingItem(key []byte, e *Entry) *Item {
+	item := &Item{
+		key:         key,
+		meta:        e.meta,
+		userMeta:    e.UserMeta,
+		userMetaExt: e.UserMetaExt,
+		version:     txn.readTs,
+		expiresAt:   e.ExpiresAt,
+	}
+	if e.meta&bitMergeEntry > 0 && txn.db.mergeFunc(key) != nil {
+		txn.addReadKey(key)
+		item.vptr = e.Value
+		item.txn = txn
+		return item
+	}
+	item.val = e.Value
+	item.status = prefetched
+	return item
+}
+
 // Get looks for key and returns corresponding Item.
 // If key is not found, ErrKeyNotFound is returned.
 func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
@@ -466,6 +761,10 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 		return nil, ErrEmptyKey
 	} else if txn.discarded {
 		return nil, ErrDiscardedTxn
+	} else if txn.isExpired() {
+		return nil, ErrTxnTimeout
+	} else if txn.isReadTsReleased() {
+		return nil, ErrReadTsReleased
 	}
 
 	if err := txn.db.isBanned(key); err != nil {
@@ -478,23 +777,18 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 			if isDeletedOrExpired(e.meta, e.ExpiresAt) {
 				return nil, ErrKeyNotFound
 			}
+			if e.valueReader != nil {
+				return nil, errPendingStream(key)
+			}
 			// Fulfill from cache.
-			item.meta = e.meta
-			item.val = e.Value
-			item.userMeta = e.UserMeta
-			item.key = key
-			item.status = prefetched
-			item.version = txn.readTs
-			item.expiresAt = e.ExpiresAt
-			// We probably don't need to set db on item here.
-			return item, nil
+			return txn.pendingItem(key, e), nil
 		}
 		// Only track reads if this is update txn. No need to track read if txn serviced it
 		// internally.
 		txn.addReadKey(key)
 	}
 
-	seek := y.KeyWithTs(key, txn.readTs)
+	seek := y.KeyWithTs(key, txn.readTsFor(key))
 	vs, err := txn.db.get(seek)
 	if err != nil {
 		return nil, y.Wrapf(err, "DB::Get key: %q", key)
@@ -503,6 +797,10 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 		return nil, ErrKeyNotFound
 	}
 	if isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
+		txn.db.notifyExpired(key, vs)
+		return nil, ErrKeyNotFound
+	}
+	if txn.db.prefixDrops.covers(key, vs.Version) {
 		return nil, ErrKeyNotFound
 	}
 
@@ -510,14 +808,130 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 	item.version = vs.Version
 	item.meta = vs.Meta
 	item.userMeta = vs.UserMeta
+	item.userMetaExt = y.SafeCopy(item.userMetaExt, vs.UserMetaExt)
 	item.vptr = y.SafeCopy(item.vptr, vs.Value)
 	item.txn = txn
 	item.expiresAt = vs.ExpiresAt
 	return item, nil
 }
 
+// GetWithTTL is like Get, but additionally returns the remaining time to live of the key. The
+// returned duration is zero if the key never expires. See Item.TTL.
+func (txn *Txn) GetWithTTL(key []byte) (*Item, time.Duration, error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return item, item.TTL(), nil
+}
+
+// MultiGet looks up all the given keys in a single call and returns the corresponding Items in
+// the same order as keys. A nil Item is returned for every key that is not found, deleted or
+// expired; ErrKeyNotFound is never returned.
+//
+// Keys are looked up in sorted order against a single snapshot of the memtables, which improves
+// block cache locality compared to issuing individual Gets. Values stored in the value log are
+// read concurrently and are available by the time MultiGet returns.
+func (txn *Txn) MultiGet(keys [][]byte) ([]*Item, error) {
+	if txn.discarded {
+		return nil, ErrDiscardedTxn
+	}
+	if txn.isExpired() {
+		return nil, ErrTxnTimeout
+	}
+	if txn.isReadTsReleased() {
+		return nil, ErrReadTsReleased
+	}
+	for _, key := range keys {
+		if len(key) == 0 {
+			return nil, ErrEmptyKey
+		}
+		if err := txn.db.isBanned(key); err != nil {
+			return nil, err
+		}
+	}
+	if txn.db.IsClosed() {
+		return nil, ErrDBClosed
+	}
+
+	idx := make([]int, len(keys))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		return bytes.Compare(keys[idx[i]], keys[idx[j]]) < 0
+	})
+
+	tables, decr := txn.db.getMemTables()
+	defer decr()
+
+	items := make([]*Item, len(keys))
+	var wg sync.WaitGroup
+	throttle := make(chan struct{}, 16)
+	for _, i := range idx {
+		key := keys[i]
+		if txn.update {
+			if e, has := txn.pendingWrites[string(key)]; has && bytes.Equal(key, e.Key) {
+				if isDeletedOrExpired(e.meta, e.ExpiresAt) {
+					continue
+				}
+				if e.valueReader != nil {
+					wg.Wait()
+					return nil, errPendingStream(key)
+				}
+				items[i] = txn.pendingItem(key, e)
+				continue
+			}
+			txn.addReadKey(key)
+		}
+
+		vs, err := txn.db.getFromTables(tables, y.KeyWithTs(key, txn.readTs))
+		if err != nil {
+			wg.Wait()
+			return nil, y.Wrapf(err, "DB::MultiGet key: %q", key)
+		}
+		if vs.Value == nil && vs.Meta == 0 {
+			continue
+		}
+		if isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
+			txn.db.notifyExpired(key, vs)
+			continue
+		}
+		if txn.db.prefixDrops.covers(key, vs.Version) {
+			continue
+		}
+		item := &Item{
+			key:         key,
+			version:     vs.Version,
+			meta:        vs.Meta,
+			userMeta:    vs.UserMeta,
+			userMetaExt: y.SafeCopy(nil, vs.UserMetaExt),
+			vptr:        y.SafeCopy(nil, vs.Value),
+			txn:         txn,
+			expiresAt:   vs.ExpiresAt,
+		}
+		items[i] = item
+		if item.meta&bitValuePointer == 0 {
+			continue
+		}
+		// Fetch values living in the value log concurrently.
+		wg.Add(1)
+		throttle <- struct{}{}
+		go func() {
+			defer func() {
+				<-throttle
+				wg.Done()
+			}()
+			item.prefetchValue()
+		}()
+	}
+	wg.Wait()
+	return items, nil
+}
+
 func (txn *Txn) addReadKey(key []byte) {
-	if txn.update {
+	// The locked keys can't be changed by the other transactions, so they aren't tracked.
+	if txn.update && txn.detectConflicts && !txn.isLocked(key) {
 		fp := z.MemHash(key)
 
 		// Because of the possibility of multiple iterators it is now possible
@@ -526,10 +940,123 @@ func (txn *Txn) addReadKey(key []byte) {
 		// needs to be locked whenever we mark a key as read.
 		txn.readsLock.Lock()
 		txn.reads = append(txn.reads, fp)
+		if txn.readKeys != nil {
+			if _, ok := txn.readKeys[fp]; !ok {
+				txn.readKeys[fp] = y.Copy(key)
+			}
+		}
 		txn.readsLock.Unlock()
 	}
 }
 
+// addReadPrefix records that the keys with the given prefix were iterated over.
+func (txn *Txn) addReadPrefix(prefix []byte) {
+	if !txn.trackRanges {
+		return
+	}
+	txn.readsLock.Lock()
+	txn.readPrefixes = append(txn.readPrefixes, y.Copy(prefix))
+	txn.readsLock.Unlock()
+}
+
+// TrackRangeReads enables tracking the ranges of keys the transaction iterates over, so that
+// it fails with ErrConflict on commit if another transaction has since written a key in one of
+// them, including a key which didn't exist when it was read. Without it, only the keys actually
+// read are checked for conflicts. The range of an iterator is given by the Prefix in its options,
+// or is the whole key space if the Prefix is not set. It should be called right after creating
+// the transaction, and has no effect if conflicts are not detected for the transaction.
+//
+// The keys written by the transactions are only recorded while a transaction tracking ranges is
+// running. A transaction committed before TrackRangeReads was called, but after the transaction
+// started, is conservatively assumed to conflict with any range.
+func (txn *Txn) TrackRangeReads() {
+	if !txn.update || !txn.detectConflicts || txn.trackRanges || txn.discarded {
+		return
+	}
+	txn.trackRanges = true
+	txn.db.orc.Lock()
+	txn.db.orc.rangeReaders++
+	txn.db.orc.Unlock()
+}
+
+// SetWriteOptions sets the options used to persist the writes of the transaction on commit. It
+// allows syncing only the writes which need to be durable, while keeping the other writes fast.
+func (txn *Txn) SetWriteOptions(opt WriteOptions) {
+	txn.writeOpt = opt
+}
+
+// SetDetectConflicts overrides Options.DetectConflicts for the transaction. It must be called
+// before any reads or writes.
+//
+// A transaction opting out of conflict detection never fails with ErrConflict, which is useful for
+// blind writes and bulk loads. Its writes are still tracked when DetectConflicts is set for the DB,
+// so the other transactions are checked against them. A transaction opting in when
+// DetectConflicts is not set for the DB is only checked against the writes of the other
+// transactions which opted in.
+func (txn *Txn) SetDetectConflicts(enabled bool) {
+	if !txn.update {
+		return
+	}
+	txn.detectConflicts = enabled
+	if enabled && txn.conflictKeys == nil {
+		txn.conflictKeys = make(map[uint64]struct{})
+	}
+}
+
+// SetAutoSpill sets whether the transaction commits its pending writes on its own once they grow
+// too big, instead of failing with ErrTxnTooBig. This should be called before any writes.
+//
+// With auto-spill enabled, a transaction is no longer atomic as a whole: each spill is committed
+// as a separate transaction, at its own commit timestamp, and is visible to other transactions
+// right away. After a spill, the transaction continues at a new read timestamp, so it sees its
+// spilled writes and all the other writes committed before the spill. The keys read before a
+// spill are only checked for conflicts by that spill, which can fail with ErrConflict. Savepoints
+// taken before a spill are invalidated by it, and a spill fails with ErrTxnTooBig while there are
+// open iterators. Auto-spill cannot be used in managed mode.
+func (txn *Txn) SetAutoSpill(enabled bool) {
+	if txn.db.opt.managedTxns {
+		panic("Cannot use SetAutoSpill in managed mode.")
+	}
+	txn.autoSpill = enabled
+}
+
+// spill commits the pending writes of the transaction and continues it at a new read timestamp.
+func (txn *Txn) spill() error {
+	if atomic.LoadInt32(&txn.numIterators) > 0 {
+		return ErrTxnTooBig
+	}
+	if err := txn.commitPrecheck(); err != nil {
+		return err
+	}
+	// The txn goes on after the spill, so it can expire again.
+	defer atomic.StoreInt32(&txn.state, txnActive)
+	commitCb, err := txn.commitAndSend(context.Background())
+	if err != nil {
+		return err
+	}
+	if err := commitCb(); err != nil {
+		return err
+	}
+
+	// commitAndSend has already marked the old read timestamp as done.
+	txn.readTs = txn.db.orc.readTs()
+	atomic.StoreInt32(&txn.doneRead, 0)
+	txn.readsLock.Lock()
+	txn.reads, txn.readPrefixes = nil, nil
+	if txn.readKeys != nil {
+		txn.readKeys = make(map[uint64][]byte)
+	}
+	txn.readsLock.Unlock()
+	if txn.conflictKeys != nil {
+		txn.conflictKeys = make(map[uint64]struct{})
+	}
+	txn.pendingWrites = make(map[string]*Entry)
+	txn.duplicateWrites = nil
+	txn.savepoints, txn.undo = nil, nil
+	txn.count, txn.size = 1, int64(len(txnKey)+10)
+	return nil
+}
+
 // Discard discards a created transaction. This method is very important and must be called. Commit
 // method calls this internally, however, calling this multiple times doesn't cause any issues. So,
 // this can safely be called via a defer right when transaction is created.
@@ -543,12 +1070,23 @@ func (txn *Txn) Discard() {
 		panic("Unclosed iterator at time of Txn.Discard.")
 	}
 	txn.discarded = true
+	if txn.timeout != nil {
+		txn.timeout.Stop()
+	}
 	if !txn.db.orc.isManaged {
 		txn.db.orc.doneRead(txn)
 	}
+	if txn.trackRanges {
+		txn.db.orc.Lock()
+		txn.db.orc.rangeReaders--
+		txn.db.orc.Unlock()
+	}
+	if release := txn.takeLocks(); release != nil {
+		release()
+	}
 }
 
-func (txn *Txn) commitAndSend() (func() error, error) {
+func (txn *Txn) commitAndSend(ctx context.Context) (func() error, error) {
 	orc := txn.db.orc
 	// Ensure that the order in which we get the commit timestamp is the same as
 	// the order in which we push these updates to the write channel. So, we
@@ -557,9 +1095,9 @@ func (txn *Txn) commitAndSend() (func() error, error) {
 	orc.writeChLock.Lock()
 	defer orc.writeChLock.Unlock()
 
-	commitTs, conflict := orc.newCommitTs(txn)
-	if conflict {
-		return nil, ErrConflict
+	commitTs, err := orc.newCommitTs(txn)
+	if err != nil {
+		return nil, err
 	}
 
 	keepTogether := true
@@ -620,7 +1158,7 @@ func (txn *Txn) commitAndSend() (func() error, error) {
 		entries = append(entries, e)
 	}
 
-	req, err := txn.db.sendToWriteCh(entries)
+	req, err := txn.db.sendToWriteChWithContext(ctx, entries, txn.writeOpt)
 	if err != nil {
 		orc.doneCommit(commitTs)
 		return nil, err
@@ -640,6 +1178,9 @@ func (txn *Txn) commitPrecheck() error {
 	if txn.discarded {
 		return errors.New("Trying to commit a discarded txn")
 	}
+	if txn.isExpired() {
+		return ErrTxnTimeout
+	}
 	keepTogether := true
 	for _, e := range txn.pendingWrites {
 		if e.version != 0 {
@@ -655,6 +1196,10 @@ func (txn *Txn) commitPrecheck() error {
 	if keepTogether && txn.db.opt.managedTxns && txn.commitTs == 0 {
 		return errors.New("CommitTs cannot be zero. Please use commitAt instead")
 	}
+	// Keep the timeout from releasing the read timestamp while the conflicts are checked.
+	if !atomic.CompareAndSwapInt32(&txn.state, txnActive, txnCommitting) {
+		return ErrTxnTimeout
+	}
 	return nil
 }
 
@@ -688,7 +1233,7 @@ func (txn *Txn) Commit() error {
 	}
 	defer txn.Discard()
 
-	txnCb, err := txn.commitAndSend()
+	txnCb, err := txn.commitAndSend(context.Background())
 	if err != nil {
 		return err
 	}
@@ -699,6 +1244,47 @@ func (txn *Txn) Commit() error {
 	return txnCb()
 }
 
+// CommitWithContext is like Commit, but gives up once ctx is done, returning ctx.Err(). If ctx is
+// done before the writes are handed over to the write pipeline, nothing is written and the
+// transaction is discarded. Past that point, the writes cannot be aborted anymore: they may still
+// be applied after CommitWithContext returns, and the keys locked via Lock are held until then.
+func (txn *Txn) CommitWithContext(ctx context.Context) error {
+	// txn.conflictKeys can be zero if conflict detection is turned off. So we
+	// should check txn.pendingWrites.
+	if len(txn.pendingWrites) == 0 {
+		return nil // Nothing to do.
+	}
+	// Precheck before discarding txn.
+	if err := txn.commitPrecheck(); err != nil {
+		return err
+	}
+	defer txn.Discard()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	commitCb, err := txn.commitAndSend(ctx)
+	if err != nil {
+		return err
+	}
+	// Hold the locks until the writes are visible, instead of releasing them on Discard.
+	release := txn.takeLocks()
+	done := make(chan error, 1)
+	go func() {
+		err := commitCb()
+		if release != nil {
+			release()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 type txnCb struct {
 	commit func() error
 	user   func(error)
@@ -746,11 +1332,19 @@ func (txn *Txn) CommitWith(cb func(error)) {
 
 	defer txn.Discard()
 
-	commitCb, err := txn.commitAndSend()
+	commitCb, err := txn.commitAndSend(context.Background())
 	if err != nil {
 		go runTxnCallback(&txnCb{user: cb, err: err})
 		return
 	}
+	// Hold the locks until the writes are visible, instead of releasing them on Discard.
+	if release := txn.takeLocks(); release != nil {
+		commit := commitCb
+		commitCb = func() error {
+			defer release()
+			return commit()
+		}
+	}
 
 	go runTxnCallback(&txnCb{user: cb, commit: commitCb})
 }
@@ -760,6 +1354,40 @@ func (txn *Txn) ReadTs() uint64 {
 	return txn.readTs
 }
 
+// Size returns the estimated size of the writes of the transaction, as counted against
+// DB.MaxBatchSize. It includes a few bytes for the metadata of each write, and for the entry which
+// marks the end of the transaction. Values stored in the value log only count for the size of a
+// value pointer.
+func (txn *Txn) Size() int64 {
+	return txn.size
+}
+
+// Count returns the number of writes of the transaction, as counted against DB.MaxBatchCount. It
+// includes the entry which marks the end of the transaction.
+func (txn *Txn) Count() int64 {
+	return txn.count
+}
+
+// Remaining returns how much the transaction can still grow before a write fails with
+// ErrTxnTooBig: a write succeeds only if count is positive and the write adds at most size bytes
+// to Size. This lets the writes be committed in batches of the right size up front. Read-only
+// transactions can't be written to, so both are zero for them.
+func (txn *Txn) Remaining() (size, count int64) {
+	if !txn.update {
+		return 0, 0
+	}
+	// See checkSize.
+	size = txn.db.opt.maxBatchSize - txn.size - 1
+	count = txn.db.opt.maxBatchCount - txn.count - 1
+	if size < 0 {
+		size = 0
+	}
+	if count < 0 {
+		count = 0
+	}
+	return size, count
+}
+
 // NewTransaction creates a new transaction. Badger supports concurrent execution of transactions,
 // providing serializable snapshot isolation, avoiding write skews. Badger achieves this by tracking
 // the keys read and at Commit time, ensuring that these read keys weren't concurrently modified by
@@ -784,6 +1412,32 @@ func (db *DB) NewTransaction(update bool) *Txn {
 	return db.newTransaction(update, false)
 }
 
+// NewTransactionFromSnapshot creates a new read-only transaction reading at the given timestamp,
+// instead of the latest one, to repeat a historical read. readTs must not be greater than the
+// read timestamp a new transaction would get, see Txn.ReadTs.
+//
+// Unlike the transactions returned by NewTransaction, the one returned here doesn't keep
+// compactions from discarding the versions visible at readTs. So, the reads are only accurate as
+// long as the relevant versions are retained, e.g. via Options.NumVersionsToKeep.
+//
+// NewTransactionFromSnapshot cannot be used with managed transactions. Use NewTransactionAt
+// instead.
+func (db *DB) NewTransactionFromSnapshot(readTs uint64) (*Txn, error) {
+	if db.opt.managedTxns {
+		return nil, ErrManagedTxn
+	}
+	if db.IsClosed() {
+		return nil, ErrDBClosed
+	}
+	if maxTs := db.orc.nextTs() - 1; readTs > maxTs {
+		return nil, errors.Wrapf(ErrInvalidRequest,
+			"Read timestamp %d is greater than the latest one: %d", readTs, maxTs)
+	}
+	// Wait for the txns committed at or below readTs to be visible, as oracle.readTs does.
+	y.Check(db.orc.txnMark.WaitForMark(context.Background(), readTs))
+	return db.newReadTxnAt(readTs), nil
+}
+
 func (db *DB) newTransaction(update, isManaged bool) *Txn {
 	if db.opt.ReadOnly && update {
 		// DB is read-only, force read-only transaction.
@@ -791,23 +1445,62 @@ func (db *DB) newTransaction(update, isManaged bool) *Txn {
 	}
 
 	txn := &Txn{
-		update: update,
-		db:     db,
-		count:  1,                       // One extra entry for BitFin.
-		size:   int64(len(txnKey) + 10), // Some buffer for the extra entry.
+		update:          update,
+		db:              db,
+		count:           1,                       // One extra entry for BitFin.
+		size:            int64(len(txnKey) + 10), // Some buffer for the extra entry.
+		detectConflicts: db.opt.DetectConflicts,
 	}
 	if update {
 		if db.opt.DetectConflicts {
 			txn.conflictKeys = make(map[uint64]struct{})
 		}
+		if db.opt.ReportConflictKeys {
+			txn.readKeys = make(map[uint64][]byte)
+		}
 		txn.pendingWrites = make(map[string]*Entry)
 	}
 	if !isManaged {
 		txn.readTs = db.orc.readTs()
+		if update && db.opt.TxnTimeout > 0 {
+			txn.stack = debug.Stack()
+			txn.timeout = time.AfterFunc(db.opt.TxnTimeout, txn.expire)
+		}
 	}
 	return txn
 }
 
+// expire is run by the timer of the txn once Options.TxnTimeout expires. It releases the read
+// timestamp of the txn, unless it's being committed or has been discarded, so the versions
+// it pinned can be cleaned up. The rest of the state of the txn is left to Discard, as the txn may
+// still be in use from another goroutine.
+func (txn *Txn) expire() {
+	if txn.db.IsClosed() || !atomic.CompareAndSwapInt32(&txn.state, txnActive, txnExpired) {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&txn.doneRead, 0, 1) {
+		return
+	}
+	txn.db.orc.readMark.Done(txn.readTs)
+	txn.db.opt.Warningf("Discarded a transaction open for more than %s. It was created at:\n%s",
+		txn.db.opt.TxnTimeout, txn.stack)
+}
+
+func (txn *Txn) isExpired() bool {
+	return atomic.LoadInt32(&txn.state) == txnExpired
+}
+
+// releaseReadTs releases the read timestamp of the txn on behalf of its detached iterators, after
+// which the txn can't read anymore.
+func (txn *Txn) releaseReadTs() {
+	atomic.StoreInt32(&txn.readTsReleased, 1)
+	txn.db.orc.doneRead(txn)
+}
+
+func (txn *Txn) isReadTsReleased() bool {
+	return atomic.LoadInt32(&txn.readTsReleased) == 1
+}
+
 // View executes a function creating and managing a read-only transaction for the user. Error
 // returned by the function is relayed by the View method.
 // If View is used with managed transactions, it would assume a read timestamp of MaxUint64.
@@ -826,6 +1519,52 @@ func (db *DB) View(fn func(txn *Txn) error) error {
 	return fn(txn)
 }
 
+// ViewAsOf executes a function, creating and managing a read-only transaction which reads the DB
+// as it was at the given timestamp, i.e., sees the versions committed at or before ts. The
+// versions older than the latest one of a key are only kept as configured via NumVersionsToKeep,
+// so ViewAsOf may not see the versions discarded since ts. It returns ErrInvalidRequest if ts is
+// beyond the current read timestamp.
+func (db *DB) ViewAsOf(ts uint64, fn func(txn *Txn) error) error {
+	if db.IsClosed() {
+		return ErrDBClosed
+	}
+	var txn *Txn
+	if db.opt.managedTxns {
+		txn = db.NewTransactionAt(ts, false)
+	} else {
+		// The current read timestamp is registered to keep the versions it sees.
+		cur := db.NewTransaction(false)
+		defer cur.Discard()
+		if ts > cur.readTs {
+			return errors.Wrapf(ErrInvalidRequest, "ViewAsOf timestamp %d is beyond the read "+
+				"timestamp %d", ts, cur.readTs)
+		}
+		txn = db.newReadTxnAt(ts)
+	}
+	defer txn.Discard()
+
+	return fn(txn)
+}
+
+// IterateVersions calls fn with each version of key visible to the transaction, newest first,
+// including the deletion markers and the expired versions. Item.Version, Item.IsDeleted and
+// Item.IsDeletedOrExpired describe each version. The item is only valid until fn returns.
+func (txn *Txn) IterateVersions(key []byte, fn func(item *Item) error) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	opt := DefaultIteratorOptions
+	opt.PrefetchValues = false
+	itr := txn.NewKeyIterator(key, opt)
+	defer itr.Close()
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		if err := fn(itr.Item()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Update executes a function, creating and managing a read-write transaction
 // for the user. Error returned by the function is relayed by the Update method.
 // Update cannot be used with managed transactions.
@@ -845,3 +1584,135 @@ func (db *DB) Update(fn func(txn *Txn) error) error {
 
 	return txn.Commit()
 }
+
+// RetryOptions configures how UpdateWithRetry retries the transactions which fail with
+// ErrConflict.
+type RetryOptions struct {
+	// MaxRetries is the number of times a transaction is retried before giving up. Zero means the
+	// transaction is not retried.
+	MaxRetries int
+	// InitialBackoff is the time to wait before the first retry. It doubles on every retry, up to
+	// MaxBackoff. The actual wait is picked randomly between half of it and all of it, so the
+	// conflicting transactions don't keep retrying in lockstep. Zero means no wait.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the time to wait before a retry. Zero means no cap.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryOptions are the recommended RetryOptions for UpdateWithRetry.
+var DefaultRetryOptions = RetryOptions{
+	MaxRetries:     10,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     100 * time.Millisecond,
+}
+
+// UpdateWithRetry is like Update, but runs fn again in a new transaction, after a backoff, as long
+// as the commit fails with ErrConflict, following opt. Hence, fn must be safe to run multiple
+// times. It returns ErrConflict once the retries are exhausted, and ctx.Err() if ctx is done while
+// waiting to retry. The retries are reported via DB.Metrics. UpdateWithRetry cannot be used with
+// managed transactions.
+func (db *DB) UpdateWithRetry(ctx context.Context, fn func(txn *Txn) error,
+	opt RetryOptions) error {
+	backoff := opt.InitialBackoff
+	for i := 0; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := db.Update(fn)
+		if errors.Cause(err) != ErrConflict {
+			return err
+		}
+		if i >= opt.MaxRetries {
+			atomic.AddInt64(&db.metrics.retriesExhausted, 1)
+			return err
+		}
+		atomic.AddInt64(&db.metrics.conflictRetries, 1)
+
+		if backoff <= 0 {
+			continue
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff-backoff/2)+1))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if backoff *= 2; opt.MaxBackoff > 0 && backoff > opt.MaxBackoff {
+			backoff = opt.MaxBackoff
+		}
+	}
+}
+
+// maxCASRetries is the number of times CAS retries on ErrConflict before giving up.
+const maxCASRetries = 16
+
+// CAS atomically replaces the value of key with newValue, provided the current value matches the
+// expectation. If expectedVersion is non-zero, the current version of the key must be equal to
+// it. If expectedValue is non-nil, the current value of the key must be equal to it. If both are
+// unset, the key must not exist. A nil newValue deletes the key.
+//
+// On success, the version at which newValue was committed is returned. If the expectation isn't
+// met, ErrCASMismatch is returned along with the current version and value of the key (zero and
+// nil if the key doesn't exist). Concurrent modifications are detected via the transaction
+// conflict detection, in which case the comparison is retried against the new state.
+//
+// CAS requires conflict detection to be enabled and cannot be used with managed transactions.
+func (db *DB) CAS(key []byte, expectedVersion uint64, expectedValue, newValue []byte) (
+	uint64, []byte, error) {
+	if db.opt.managedTxns {
+		return 0, nil, ErrManagedTxn
+	}
+	if !db.opt.DetectConflicts {
+		return 0, nil, errors.Wrap(ErrInvalidRequest, "CAS requires DetectConflicts to be set")
+	}
+
+	cas := func() (curVersion uint64, curValue []byte, err error) {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+
+		item, err := txn.Get(key)
+		switch {
+		case err == ErrKeyNotFound:
+		case err != nil:
+			return 0, nil, err
+		default:
+			curVersion = item.Version()
+			if curValue, err = item.ValueCopy(nil); err != nil {
+				return 0, nil, err
+			}
+		}
+
+		switch {
+		case expectedVersion == 0 && expectedValue == nil:
+			if curVersion != 0 {
+				return curVersion, curValue, ErrCASMismatch
+			}
+		case expectedVersion != 0 && expectedVersion != curVersion:
+			return curVersion, curValue, ErrCASMismatch
+		case expectedValue != nil && (curVersion == 0 || !bytes.Equal(expectedValue, curValue)):
+			return curVersion, curValue, ErrCASMismatch
+		}
+
+		e := NewEntry(key, newValue)
+		if newValue == nil {
+			e.meta = bitDelete
+		}
+		if err := txn.SetEntry(e); err != nil {
+			return 0, nil, err
+		}
+		if err := txn.Commit(); err != nil {
+			return 0, nil, err
+		}
+		return e.version, nil, nil
+	}
+
+	for i := 0; ; i++ {
+		version, value, err := cas()
+		if errors.Cause(err) == ErrConflict && i < maxCASRetries {
+			continue
+		}
+		return version, value, err
+	}
+}
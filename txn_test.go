@@ -17,6 +17,7 @@
 package badger
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -26,8 +27,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v3/options"
 	"github.com/dgraph-io/badger/v3/y"
 	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
 
 	"github.com/stretchr/testify/require"
 )
@@ -952,3 +955,640 @@ func TestConflict(t *testing.T) {
 		runTest(t, testAndSetItr)
 	})
 }
+
+func TestTxnMultiGet(t *testing.T) {
+	opt := getTestOptions("")
+	// Keep some of the values in the value log.
+	opt.ValueThreshold = 32
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		key := func(i int) []byte {
+			return []byte(fmt.Sprintf("key=%03d", i))
+		}
+		val := func(i int) []byte {
+			if i%2 == 0 {
+				return []byte(fmt.Sprintf("%064d", i))
+			}
+			return []byte(fmt.Sprintf("val=%d", i))
+		}
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < 50; i++ {
+				if err := txn.Set(key(i), val(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		txnDelete(t, db, key(10))
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.NoError(t, txn.Set(key(100), val(100)))
+
+		keys := [][]byte{key(42), key(100), key(3), key(10), key(77), key(0)}
+		items, err := txn.MultiGet(keys)
+		require.NoError(t, err)
+		require.Len(t, items, len(keys))
+		for i, idx := range []int{42, 100, 3, 10, 77, 0} {
+			if idx == 10 || idx == 77 {
+				require.Nil(t, items[i])
+				continue
+			}
+			require.NotNil(t, items[i])
+			require.Equal(t, key(idx), items[i].Key())
+			require.Equal(t, val(idx), getItemValue(t, items[i]))
+		}
+
+		_, err = txn.MultiGet([][]byte{key(1), nil})
+		require.Equal(t, ErrEmptyKey, err)
+	})
+}
+
+func TestCAS(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("cas")
+
+		// Key must be absent when neither version nor value is expected.
+		v1, _, err := db.CAS(key, 0, nil, []byte("v1"))
+		require.NoError(t, err)
+		require.NotZero(t, v1)
+
+		ver, val, err := db.CAS(key, 0, nil, []byte("v2"))
+		require.Equal(t, ErrCASMismatch, err)
+		require.Equal(t, v1, ver)
+		require.Equal(t, []byte("v1"), val)
+
+		// Compare by value.
+		_, _, err = db.CAS(key, 0, []byte("foo"), []byte("v2"))
+		require.Equal(t, ErrCASMismatch, err)
+		v2, _, err := db.CAS(key, 0, []byte("v1"), []byte("v2"))
+		require.NoError(t, err)
+		require.Greater(t, v2, v1)
+
+		// Compare by version.
+		ver, val, err = db.CAS(key, v1, nil, []byte("v3"))
+		require.Equal(t, ErrCASMismatch, err)
+		require.Equal(t, v2, ver)
+		require.Equal(t, []byte("v2"), val)
+		_, _, err = db.CAS(key, v2, nil, nil)
+		require.NoError(t, err)
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get(key)
+			require.Equal(t, ErrKeyNotFound, err)
+			return nil
+		}))
+	})
+}
+
+func TestCASConcurrent(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("counter")
+		_, _, err := db.CAS(key, 0, nil, []byte("0"))
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		var success int32
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _, err := db.CAS(key, 0, []byte("0"), []byte("1"))
+				if err == nil {
+					atomic.AddInt32(&success, 1)
+					return
+				}
+				require.Equal(t, ErrCASMismatch, err)
+			}()
+		}
+		wg.Wait()
+		require.Equal(t, int32(1), success)
+	})
+}
+
+func TestTxnWriteOptions(t *testing.T) {
+	req := &request{}
+	require.Equal(t, options.NoSync, req.syncMode(false))
+	require.Equal(t, options.SyncAll, req.syncMode(true))
+	req.sync = options.NoSync
+	require.Equal(t, options.NoSync, req.syncMode(true))
+	reqs := []*request{req, {sync: options.SyncVlog}, {}}
+	require.Equal(t, options.SyncVlog, syncMode(false, reqs))
+	require.Equal(t, options.SyncAll, syncMode(true, reqs))
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		modes := []options.SyncMode{
+			options.SyncDefault, options.NoSync, options.SyncVlog, options.SyncAll}
+		for i, mode := range modes {
+			key := []byte(fmt.Sprintf("txn%d", i))
+			txn := db.NewTransaction(true)
+			txn.SetWriteOptions(WriteOptions{Sync: mode})
+			require.NoError(t, txn.Set(key, make([]byte, 1<<10)))
+			require.NoError(t, txn.Commit())
+
+			wb := db.NewWriteBatch()
+			wb.SetWriteOptions(WriteOptions{Sync: mode})
+			for j := 0; j < 100; j++ {
+				require.NoError(t, wb.Set([]byte(fmt.Sprintf("wb%d-%d", i, j)), []byte("val")))
+			}
+			require.NoError(t, wb.Flush())
+		}
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := range modes {
+				_, err := txn.Get([]byte(fmt.Sprintf("txn%d", i)))
+				require.NoError(t, err)
+				_, err = txn.Get([]byte(fmt.Sprintf("wb%d-99", i)))
+				require.NoError(t, err)
+			}
+			return nil
+		}))
+	})
+}
+
+func TestTxnSavepoint(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txnSet(t, db, []byte("a"), []byte("committed"), 0)
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.NoError(t, txn.Set([]byte("a"), []byte("a1")))
+		sp1 := txn.Savepoint()
+		count, size := txn.count, txn.size
+
+		require.NoError(t, txn.Set([]byte("a"), []byte("a2")))
+		require.NoError(t, txn.Set([]byte("b"), []byte("b1")))
+		sp2 := txn.Savepoint()
+		require.NoError(t, txn.Delete([]byte("b")))
+
+		get := func(key string) (string, error) {
+			item, err := txn.Get([]byte(key))
+			if err != nil {
+				return "", err
+			}
+			return string(getItemValue(t, item)), nil
+		}
+
+		require.NoError(t, txn.RollbackTo(sp2))
+		val, err := get("b")
+		require.NoError(t, err)
+		require.Equal(t, "b1", val)
+
+		require.NoError(t, txn.RollbackTo(sp1))
+		val, err = get("a")
+		require.NoError(t, err)
+		require.Equal(t, "a1", val)
+		_, err = get("b")
+		require.Equal(t, ErrKeyNotFound, err)
+		require.Equal(t, count, txn.count)
+		require.Equal(t, size, txn.size)
+
+		// sp2 was taken after sp1, so it's no longer valid. sp1 can be rolled back to again.
+		require.Error(t, txn.RollbackTo(sp2))
+		require.NoError(t, txn.Set([]byte("c"), []byte("c1")))
+		require.NoError(t, txn.RollbackTo(sp1))
+
+		require.NoError(t, txn.Commit())
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("a"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("a1"), getItemValue(t, item))
+			for _, key := range []string{"b", "c"} {
+				_, err := txn.Get([]byte(key))
+				require.Equal(t, ErrKeyNotFound, err)
+			}
+			return nil
+		}))
+	})
+}
+
+func TestTxnAutoSpill(t *testing.T) {
+	opt := getTestOptions("").WithMemTableSize(1 << 16).WithValueThreshold(1 << 10)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		const n = 2000
+		key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+
+		txn := db.NewTransaction(true)
+		var err error
+		for i := 0; i < n && err == nil; i++ {
+			err = txn.Set(key(i), []byte("val"))
+		}
+		require.Equal(t, ErrTxnTooBig, err)
+		txn.Discard()
+
+		txn = db.NewTransaction(true)
+		defer txn.Discard()
+		txn.SetAutoSpill(true)
+		readTs := txn.readTs
+		for i := 0; i < n; i++ {
+			require.NoError(t, txn.Set(key(i), []byte("val")))
+		}
+		// The transaction must have spilled, and it must still see its spilled writes.
+		require.True(t, txn.readTs > readTs)
+		item, err := txn.Get(key(0))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val"), getItemValue(t, item))
+		require.NoError(t, txn.Commit())
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				if _, err := txn.Get(key(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	})
+}
+
+func TestTxnLock(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("counter")
+		txnSet(t, db, key, []byte("0"), 0)
+
+		const n = 20
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				txn := db.NewTransaction(true)
+				defer txn.Discard()
+				require.NoError(t, txn.Lock(key))
+				item, err := txn.Get(key)
+				require.NoError(t, err)
+				val, err := strconv.Atoi(string(getItemValue(t, item)))
+				require.NoError(t, err)
+				require.NoError(t, txn.Set(key, []byte(strconv.Itoa(val+1))))
+				// Locked keys are not checked for conflicts.
+				require.NoError(t, txn.Commit())
+			}()
+		}
+		wg.Wait()
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, []byte(strconv.Itoa(n)), getItemValue(t, item))
+			return nil
+		}))
+
+		// Waiting for a lock gives up once the context is done.
+		holder := db.NewTransaction(true)
+		require.NoError(t, holder.Lock(key))
+		waiter := db.NewTransaction(true)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		require.Equal(t, context.DeadlineExceeded, waiter.LockWithContext(ctx, key))
+		holder.Discard()
+		require.NoError(t, waiter.Lock(key))
+		waiter.Discard()
+	})
+}
+
+func TestTxnSetDetectConflicts(t *testing.T) {
+	key := []byte("key")
+	readAndSet := func(t *testing.T, db *DB, detect bool) *Txn {
+		txn := db.NewTransaction(true)
+		txn.SetDetectConflicts(detect)
+		_, err := txn.Get(key)
+		require.NoError(t, err)
+		require.NoError(t, txn.Set(key, []byte("txn")))
+		return txn
+	}
+
+	t.Run("opt out", func(t *testing.T) {
+		runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+			txnSet(t, db, key, []byte("init"), 0)
+			txn := readAndSet(t, db, false)
+			defer txn.Discard()
+			// A concurrent write must not make the transaction fail.
+			txnSet(t, db, key, []byte("other"), 0)
+			require.NoError(t, txn.Commit())
+
+			// The writes of the opted out transaction are still tracked for the other ones.
+			other := readAndSet(t, db, true)
+			defer other.Discard()
+			blind := db.NewTransaction(true)
+			blind.SetDetectConflicts(false)
+			require.NoError(t, blind.Set(key, []byte("blind")))
+			require.NoError(t, blind.Commit())
+			require.Equal(t, ErrConflict, other.Commit())
+		})
+	})
+	t.Run("opt in", func(t *testing.T) {
+		opt := getTestOptions("").WithDetectConflicts(false)
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			txnSet(t, db, key, []byte("init"), 0)
+			txn := readAndSet(t, db, true)
+			defer txn.Discard()
+			other := readAndSet(t, db, true)
+			require.NoError(t, other.Commit())
+			require.Equal(t, ErrConflict, txn.Commit())
+		})
+	})
+}
+
+func TestTxnCommitWithContext(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txn := db.NewTransaction(true)
+		require.NoError(t, txn.Set([]byte("a"), []byte("a")))
+		require.NoError(t, txn.CommitWithContext(context.Background()))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		txn = db.NewTransaction(true)
+		require.NoError(t, txn.Set([]byte("b"), []byte("b")))
+		require.Equal(t, context.Canceled, txn.CommitWithContext(ctx))
+		// The transaction is discarded on cancellation.
+		require.Equal(t, ErrDiscardedTxn, txn.Set([]byte("c"), []byte("c")))
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("a"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("a"), getItemValue(t, item))
+			_, err = txn.Get([]byte("b"))
+			require.Equal(t, ErrKeyNotFound, err)
+			return nil
+		}))
+	})
+}
+
+func TestTxnTrackRangeReads(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txnSet(t, db, []byte("user/1"), []byte("a"), 0)
+
+		scanAndWrite := func(track bool) *Txn {
+			txn := db.NewTransaction(true)
+			if track {
+				txn.TrackRangeReads()
+			}
+			opt := DefaultIteratorOptions
+			opt.Prefix = []byte("user/")
+			it := txn.NewIterator(opt)
+			var count int
+			for it.Rewind(); it.Valid(); it.Next() {
+				count++
+			}
+			it.Close()
+			require.NoError(t, txn.Set([]byte("count"), []byte(strconv.Itoa(count))))
+			return txn
+		}
+
+		// Without range tracking, a concurrently inserted key is missed.
+		txn := scanAndWrite(false)
+		txnSet(t, db, []byte("user/2"), []byte("b"), 0)
+		require.NoError(t, txn.Commit())
+
+		txn = scanAndWrite(true)
+		txnSet(t, db, []byte("user/3"), []byte("c"), 0)
+		require.Equal(t, ErrConflict, txn.Commit())
+
+		// Writes outside of the range don't conflict.
+		txn = scanAndWrite(true)
+		txnSet(t, db, []byte("other"), []byte("d"), 0)
+		require.NoError(t, txn.Commit())
+		require.Zero(t, db.orc.rangeReaders)
+	})
+}
+
+func TestNewTransactionFromSnapshot(t *testing.T) {
+	opt := getTestOptions("").WithNumVersionsToKeep(10)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		var readTs []uint64
+		for i := 0; i < 3; i++ {
+			txnSet(t, db, key, []byte(strconv.Itoa(i)), 0)
+			txn := db.NewTransaction(false)
+			readTs = append(readTs, txn.ReadTs())
+			txn.Discard()
+		}
+
+		for i, ts := range readTs {
+			txn, err := db.NewTransactionFromSnapshot(ts)
+			require.NoError(t, err)
+			item, err := txn.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, []byte(strconv.Itoa(i)), getItemValue(t, item))
+			require.Equal(t, ErrReadOnlyTxn, txn.Set(key, []byte("x")))
+			txn.Discard()
+		}
+
+		_, err := db.NewTransactionFromSnapshot(readTs[2] + 10)
+		require.Error(t, err)
+	})
+}
+
+func TestTxnTimeout(t *testing.T) {
+	opt := getTestOptions("").WithTxnTimeout(100 * time.Millisecond)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		// A transaction finished in time is not affected by the timeout.
+		txnSet(t, db, []byte("key"), []byte("val"), 0)
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.NoError(t, txn.Set([]byte("leaked"), []byte("val")))
+		readTs := txn.readTs
+
+		// The read timestamp of the transaction is released once it expires.
+		for i := 0; db.orc.readMark.DoneUntil() < readTs; i++ {
+			require.Less(t, i, 500, "read timestamp of the expired txn was not released")
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		_, err := txn.Get([]byte("key"))
+		require.Equal(t, ErrTxnTimeout, err)
+		require.Equal(t, ErrTxnTimeout, txn.Set([]byte("leaked"), []byte("val")))
+		require.Equal(t, ErrTxnTimeout, txn.Commit())
+
+		// A transaction isn't expired once its commit has started.
+		ctxn := db.NewTransaction(true)
+		defer ctxn.Discard()
+		require.NoError(t, ctxn.Set([]byte("committed"), []byte("val")))
+		require.NoError(t, ctxn.commitPrecheck())
+		ctxn.expire()
+		require.False(t, ctxn.isExpired())
+		require.Equal(t, int32(0), atomic.LoadInt32(&ctxn.doneRead))
+		commitCb, err := ctxn.commitAndSend(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, commitCb())
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get([]byte("committed"))
+			return err
+		}))
+
+		// Read-only transactions don't time out.
+		rtxn := db.NewTransaction(false)
+		defer rtxn.Discard()
+		time.Sleep(200 * time.Millisecond)
+		item, err := rtxn.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val"), getItemValue(t, item))
+	})
+}
+
+func TestTxnRemaining(t *testing.T) {
+	opt := getTestOptions("").WithMemTableSize(1 << 16).WithValueThreshold(1 << 10)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		rtxn := db.NewTransaction(false)
+		defer rtxn.Discard()
+		size, count := rtxn.Remaining()
+		require.Zero(t, size)
+		require.Zero(t, count)
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.Equal(t, int64(1), txn.Count())
+		val := make([]byte, 100)
+		for i := 0; ; i++ {
+			key := []byte(fmt.Sprintf("key%06d", i))
+			// The key, the value, their metas and the version.
+			added := int64(len(key)+len(val)) + 2 + 10
+			size, count := txn.Remaining()
+			before := txn.Size()
+			err := txn.Set(key, val)
+			if added > size || count == 0 {
+				require.Equal(t, ErrTxnTooBig, err)
+				break
+			}
+			require.NoError(t, err)
+			require.Equal(t, before+added, txn.Size())
+			require.Equal(t, int64(i+2), txn.Count())
+		}
+		require.NoError(t, txn.Commit())
+	})
+}
+
+func TestUpdateWithRetry(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		opt := RetryOptions{MaxRetries: 2, InitialBackoff: time.Millisecond}
+		// conflictingUpdate reads key and writes it, while another transaction writes it too on
+		// the first conflicts attempts.
+		conflictingUpdate := func(attempts *int, conflicts int) func(txn *Txn) error {
+			return func(txn *Txn) error {
+				*attempts++
+				if _, err := txn.Get(key); err != nil && err != ErrKeyNotFound {
+					return err
+				}
+				if *attempts <= conflicts {
+					txnSet(t, db, key, []byte("other"), 0)
+				}
+				return txn.Set(key, []byte("txn"))
+			}
+		}
+
+		var attempts int
+		require.NoError(t, db.UpdateWithRetry(context.Background(),
+			conflictingUpdate(&attempts, 1), opt))
+		require.Equal(t, 2, attempts)
+		require.Equal(t, int64(1), db.Metrics().ConflictRetries)
+
+		attempts = 0
+		err := db.UpdateWithRetry(context.Background(), conflictingUpdate(&attempts, 100), opt)
+		require.Equal(t, ErrConflict, err)
+		require.Equal(t, 3, attempts)
+		require.Equal(t, int64(3), db.Metrics().ConflictRetries)
+		require.Equal(t, int64(1), db.Metrics().ConflictRetriesExhausted)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		attempts = 0
+		err = db.UpdateWithRetry(ctx, conflictingUpdate(&attempts, 100), DefaultRetryOptions)
+		require.Equal(t, context.Canceled, err)
+		require.Zero(t, attempts)
+	})
+}
+
+func TestTxnReportConflictKeys(t *testing.T) {
+	opt := getTestOptions("").WithReportConflictKeys(true)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		for _, key := range []string{"a", "b"} {
+			_, err := txn.Get([]byte(key))
+			require.Equal(t, ErrKeyNotFound, err)
+		}
+		require.NoError(t, txn.Set([]byte("c"), []byte("txn")))
+		txnSet(t, db, []byte("b"), []byte("other"), 0)
+
+		err := txn.Commit()
+		require.Equal(t, ErrConflict, errors.Cause(err))
+		cerr, ok := err.(*ConflictError)
+		require.True(t, ok)
+		require.Equal(t, []byte("b"), cerr.Key)
+		require.Nil(t, cerr.Prefix)
+		require.NotZero(t, cerr.CommitTs)
+
+		txn = db.NewTransaction(true)
+		defer txn.Discard()
+		txn.TrackRangeReads()
+		iopt := DefaultIteratorOptions
+		iopt.Prefix = []byte("p")
+		it := txn.NewIterator(iopt)
+		for it.Rewind(); it.Valid(); it.Next() {
+		}
+		it.Close()
+		require.NoError(t, txn.Set([]byte("c"), []byte("txn")))
+		txnSet(t, db, []byte("p1"), []byte("other"), 0)
+
+		err = txn.Commit()
+		cerr, ok = err.(*ConflictError)
+		require.True(t, ok)
+		require.Nil(t, cerr.Key)
+		require.Equal(t, []byte("p"), cerr.Prefix)
+	})
+}
+
+func TestTxnTimeTravel(t *testing.T) {
+	opt := getTestOptions("")
+	opt.NumVersionsToKeep = 10
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		var versions []uint64
+		write := func(val string) {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				if val == "" {
+					return txn.Delete(key)
+				}
+				return txn.Set(key, []byte(val))
+			}))
+			versions = append(versions, db.MaxVersion())
+		}
+		write("a")
+		write("b")
+		write("")
+		write("d")
+
+		get := func(ts uint64) string {
+			var val []byte
+			require.NoError(t, db.ViewAsOf(ts, func(txn *Txn) error {
+				item, err := txn.Get(key)
+				if err == ErrKeyNotFound {
+					return nil
+				}
+				require.NoError(t, err)
+				val = getItemValue(t, item)
+				return nil
+			}))
+			return string(val)
+		}
+		require.Equal(t, "", get(versions[0]-1))
+		require.Equal(t, "a", get(versions[0]))
+		require.Equal(t, "b", get(versions[1]))
+		require.Equal(t, "", get(versions[2]))
+		require.Equal(t, "d", get(versions[3]))
+		err := db.ViewAsOf(versions[3]+1, func(txn *Txn) error { return nil })
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+
+		var got []uint64
+		var deleted []bool
+		require.NoError(t, db.View(func(txn *Txn) error {
+			return txn.IterateVersions(key, func(item *Item) error {
+				got = append(got, item.Version())
+				deleted = append(deleted, item.IsDeleted())
+				return nil
+			})
+		}))
+		require.Equal(t, []uint64{versions[3], versions[2], versions[1], versions[0]}, got)
+		require.Equal(t, []bool{false, true, false, false}, deleted)
+	})
+}
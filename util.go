@@ -17,9 +17,11 @@
 package badger
 
 import (
+	"context"
 	"encoding/hex"
 	"io/ioutil"
 	"math/rand"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -115,3 +117,125 @@ func getIDMap(dir string) map[uint64]struct{} {
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
+
+// pauser lets a long running background operation be paused and resumed. The zero value is an
+// unpaused pauser.
+type pauser struct {
+	sync.Mutex
+	resumeCh chan struct{} // Non-nil while paused. Closed on resume.
+}
+
+func (p *pauser) pause() {
+	p.Lock()
+	defer p.Unlock()
+	if p.resumeCh == nil {
+		p.resumeCh = make(chan struct{})
+	}
+}
+
+func (p *pauser) resume() {
+	p.Lock()
+	defer p.Unlock()
+	if p.resumeCh != nil {
+		close(p.resumeCh)
+		p.resumeCh = nil
+	}
+}
+
+// wait blocks while paused. It returns ctx.Err() if ctx is done before resuming.
+func (p *pauser) wait(ctx context.Context) error {
+	p.Lock()
+	ch := p.resumeCh
+	p.Unlock()
+	if ch == nil {
+		return nil
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pauseGate lets background work be paused, waiting for the running work to finish. Pauses are
+// counted, so the work resumes once every pause has been resumed.
+type pauseGate struct {
+	sync.RWMutex       // Held for reading by the running work.
+	pauses       int32 // Accessed atomically.
+}
+
+// pause pauses the work, and waits for the running work to finish.
+func (g *pauseGate) pause() {
+	atomic.AddInt32(&g.pauses, 1)
+	g.Lock()
+	g.Unlock()
+}
+
+// resume undoes a call to pause. It is a no-op if the work isn't paused.
+func (g *pauseGate) resume() {
+	for {
+		n := atomic.LoadInt32(&g.pauses)
+		if n == 0 || atomic.CompareAndSwapInt32(&g.pauses, n, n-1) {
+			return
+		}
+	}
+}
+
+// enter returns true if the work can run, in which case leave must be called once it is done.
+func (g *pauseGate) enter() bool {
+	g.RLock()
+	if atomic.LoadInt32(&g.pauses) > 0 {
+		g.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (g *pauseGate) leave() {
+	g.RUnlock()
+}
+
+// paused tells if the work is paused.
+func (g *pauseGate) paused() bool {
+	return atomic.LoadInt32(&g.pauses) > 0
+}
+
+// rateLimiter limits the rate at which bytes are processed. The rate can be changed at any time. A
+// rate of zero means no limit.
+type rateLimiter struct {
+	sync.Mutex
+	rate int64     // Bytes per second, accessed atomically.
+	next time.Time // Time from which more bytes can be processed.
+}
+
+func (r *rateLimiter) setRate(rate int64) {
+	atomic.StoreInt64(&r.rate, rate)
+}
+
+// wait blocks until n more bytes can be processed at the current rate.
+func (r *rateLimiter) wait(n int64) {
+	r.waitAtMost(n, 0)
+}
+
+// waitAtMost is like wait, but the n bytes are processed at no more than maxRate bytes per second,
+// if maxRate is positive, even if the current rate is higher or unlimited. They still take their
+// share of the current rate only once, so the bytes processed after them wait for them as well.
+func (r *rateLimiter) waitAtMost(n, maxRate int64) {
+	rate := atomic.LoadInt64(&r.rate)
+	if maxRate > 0 && (rate <= 0 || maxRate < rate) {
+		rate = maxRate
+	}
+	if rate <= 0 {
+		return
+	}
+	r.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	delay := r.next.Sub(now)
+	r.next = r.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	r.Unlock()
+	time.Sleep(delay)
+}
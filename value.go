@@ -19,6 +19,8 @@ package badger
 import (
 	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"fmt"
 	"hash"
 	"hash/crc32"
@@ -31,7 +33,9 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/dgraph-io/badger/v3/options"
 	"github.com/dgraph-io/badger/v3/skl"
 	"github.com/dgraph-io/badger/v3/y"
 	"github.com/dgraph-io/ristretto/z"
@@ -51,6 +55,10 @@ const (
 	BitDiscardEarlierVersions byte = 1 << 2 // Set if earlier versions can be discarded.
 	// Set if item shouldn't be discarded via compactions (used by merge operator)
 	bitMergeEntry byte = 1 << 3
+	// Set in the encodings of the entries which carry a UserMetaExt.
+	bitUserMetaExt = y.BitUserMetaExt
+	// Set if the value is encrypted with the key of its tenant. See DB.CreateTenantKey.
+	bitTenantKey byte = 1 << 5
 	// The MSB 2 bits are for transactions.
 	bitTxn    byte = 1 << 6 // Set if the entry is part of a txn.
 	bitFinTxn byte = 1 << 7 // Set if the entry is to indicate end of txn in value log.
@@ -65,6 +73,7 @@ const (
 )
 
 var errStop = errors.New("Stop iteration")
+var errGCStopped = errors.New("Value log GC stopped")
 var errTruncate = errors.New("Do truncate")
 var errDeleteVlogFile = errors.New("Delete vlog file")
 
@@ -167,6 +176,7 @@ func (r *safeRead) Entry(reader io.Reader) (*Entry, error) {
 	}
 	e.meta = h.meta
 	e.UserMeta = h.userMeta
+	e.UserMetaExt = h.userMetaExt
 	e.ExpiresAt = h.expiresAt
 	return e, nil
 }
@@ -212,6 +222,15 @@ func (vlog *valueLog) calculateDiscardStat(f *logFile) (discardedRatio float64,
 }
 
 func (vlog *valueLog) rewrite(f *logFile) error {
+	return vlog.rewriteFrom(context.Background(), f, 0, &GCResult{})
+}
+
+// rewriteFrom rewrites the entries of f from offset, or from its start if offset is 0, and adds
+// what it did to res. If ctx is done before the end of f, the entries moved so far are written,
+// the offset the rewrite stopped at is saved in vlog.gcCheckpoint, and ctx.Err() is returned.
+func (vlog *valueLog) rewriteFrom(ctx context.Context, f *logFile, offset uint32,
+	res *GCResult) error {
+
 	vlog.filesLock.RLock()
 	for _, fid := range vlog.filesToBeDeleted {
 		if fid == f.fid {
@@ -229,7 +248,20 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 
 	y.AssertTrue(vlog.db != nil)
 	var count, moved int
+	var stopAt uint32
+	var lastTxn uint64
 	fe := func(e Entry) error {
+		// Only stop between transactions, so that the rewrite can resume from an entry.
+		if e.meta&bitTxn == 0 || y.ParseTs(e.Key) != lastTxn {
+			if ctx.Err() != nil {
+				stopAt = e.offset
+				return errGCStopped
+			}
+		}
+		lastTxn = 0
+		if e.meta&bitTxn > 0 {
+			lastTxn = y.ParseTs(e.Key)
+		}
 		count++
 		if count%100000 == 0 {
 			vlog.opt.Debugf("Processing entry %d", count)
@@ -266,12 +298,15 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 		// an older vlog file. See the comments in the else part.
 		if vp.Fid == f.fid && vp.Offset == e.offset {
 			moved++
+			res.EntriesMoved++
+			res.BytesMoved += int64(e.hlen + len(e.Key) + len(e.Value) + crc32.Size)
 			// This new entry only contains the key, and a pointer to the value.
 			ne := new(Entry)
 			// Remove only the bitValuePointer and transaction markers. We
 			// should keep the other bits.
 			ne.meta = e.meta &^ (bitValuePointer | bitTxn | bitFinTxn)
 			ne.UserMeta = e.UserMeta
+			ne.UserMetaExt = y.SafeCopy(nil, e.UserMetaExt)
 			ne.ExpiresAt = e.ExpiresAt
 			ne.Key = append([]byte{}, e.Key...)
 			ne.Value = append([]byte{}, e.Value...)
@@ -347,38 +382,27 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 		return nil
 	}
 
-	_, err := f.iterate(vlog.opt.ReadOnly, 0, func(e Entry, vp valuePointer) error {
+	_, err := f.iterate(vlog.opt.ReadOnly, offset, func(e Entry, vp valuePointer) error {
 		return fe(e)
 	})
+	if stopAt > 0 {
+		if err := vlog.writeMoved(wb); err != nil {
+			return err
+		}
+		vlog.gcCheckpoint = valuePointer{Fid: f.fid, Offset: stopAt}
+		vlog.opt.Infof("Stopped rewriting fid: %d at offset: %d. Moved: %d", f.fid, stopAt, moved)
+		return ctx.Err()
+	}
 	if err != nil {
 		return err
 	}
-
-	batchSize := 1024
-	var loops int
-	for i := 0; i < len(wb); {
-		loops++
-		if batchSize == 0 {
-			vlog.db.opt.Warningf("We shouldn't reach batch size of zero.")
-			return ErrNoRewrite
-		}
-		end := i + batchSize
-		if end > len(wb) {
-			end = len(wb)
-		}
-		if err := vlog.db.batchSet(wb[i:end]); err != nil {
-			if err == ErrTxnTooBig {
-				// Decrease the batch size to half.
-				batchSize = batchSize / 2
-				continue
-			}
-			return err
-		}
-		i += batchSize
+	if err := vlog.writeMoved(wb); err != nil {
+		return err
 	}
-	vlog.opt.Infof("Processed %d entries in %d loops", len(wb), loops)
 	vlog.opt.Infof("Total entries: %d. Moved: %d", count, moved)
 	vlog.opt.Infof("Removing fid: %d", f.fid)
+	res.FilesRewritten++
+	res.BytesReclaimed += int64(atomic.LoadUint32(&f.size))
 	var deleteFileNow bool
 	// Entries written to LSM. Remove the older file now.
 	{
@@ -405,6 +429,34 @@ func (vlog *valueLog) rewrite(f *logFile) error {
 	return nil
 }
 
+// writeMoved writes the entries moved by a rewrite to the DB.
+func (vlog *valueLog) writeMoved(wb []*Entry) error {
+	batchSize := 1024
+	var loops int
+	for i := 0; i < len(wb); {
+		loops++
+		if batchSize == 0 {
+			vlog.db.opt.Warningf("We shouldn't reach batch size of zero.")
+			return ErrNoRewrite
+		}
+		end := i + batchSize
+		if end > len(wb) {
+			end = len(wb)
+		}
+		if err := vlog.db.batchSet(wb[i:end]); err != nil {
+			if err == ErrTxnTooBig {
+				// Decrease the batch size to half.
+				batchSize = batchSize / 2
+				continue
+			}
+			return err
+		}
+		i += batchSize
+	}
+	vlog.opt.Infof("Processed %d entries in %d loops", len(wb), loops)
+	return nil
+}
+
 func (vlog *valueLog) incrIteratorCount() {
 	atomic.AddInt32(&vlog.numActiveIterators, 1)
 }
@@ -444,8 +496,14 @@ func (vlog *valueLog) deleteLogFile(lf *logFile) error {
 	defer lf.lock.Unlock()
 	// Delete fid from discard stats as well.
 	vlog.discardStats.Update(lf.fid, -1)
+	vlog.deadLock.Lock()
+	delete(vlog.deadBytes, lf.fid)
+	vlog.deadLock.Unlock()
 
-	return lf.Delete()
+	if err := lf.Delete(); err != nil {
+		return err
+	}
+	return removeHoles(lf.path)
 }
 
 func (vlog *valueLog) dropAll() (int, error) {
@@ -472,6 +530,11 @@ func (vlog *valueLog) dropAll() (int, error) {
 	if err := deleteAll(); err != nil {
 		return count, err
 	}
+	n, err := vlog.dropAllBlobs()
+	count += n
+	if err != nil {
+		return count, err
+	}
 
 	vlog.db.opt.Infof("Value logs deleted. Creating value log file: 1")
 	if _, err := vlog.createVlogFile(); err != nil { // Called while writes are stopped.
@@ -496,6 +559,9 @@ type valueLog struct {
 	// A refcount of iterators -- when this hits zero, we can delete the filesToBeDeleted.
 	numActiveIterators int32
 
+	// blobs tracks the blob files. See Options.BlobThreshold.
+	blobs blobStore
+
 	db                *DB
 	writableLogOffset uint32 // read by read, written by write. Must access via atomics.
 	numEntriesWritten uint32
@@ -503,6 +569,20 @@ type valueLog struct {
 
 	garbageCh    chan struct{}
 	discardStats *discardStats
+	// gcCheckpoint is the file and offset the last rewrite was stopped at, if it was. It's
+	// guarded by garbageCh.
+	gcCheckpoint valuePointer
+	// rotateKey is set to 1 to replace the file being written to on the next write, as it's
+	// encrypted with a retired data key. Must access via atomics.
+	rotateKey int32
+	// noPunch is set once punching holes failed for lack of support, if
+	// Options.ValueLogPunchHoles is set. It's guarded by garbageCh.
+	noPunch bool
+
+	// deadBytes has the size of the values of each file overwritten or deleted since the DB was
+	// opened, if Options.TrackVlogSpace is set.
+	deadLock  sync.Mutex
+	deadBytes map[uint32]int64
 }
 
 func vlogFilePath(dirPath string, fid uint32) string {
@@ -515,14 +595,34 @@ func (vlog *valueLog) fpath(fid uint32) string {
 
 func (vlog *valueLog) populateFilesMap() error {
 	vlog.filesMap = make(map[uint32]*logFile)
+	if err := vlog.populateFilesMapFrom(vlog.dirPath, false); err != nil {
+		return err
+	}
+	if coldDir := vlog.opt.ValueLogTiering.ColdDir; coldDir != "" {
+		return vlog.populateFilesMapFrom(coldDir, true)
+	}
+	return nil
+}
 
-	files, err := ioutil.ReadDir(vlog.dirPath)
-	if err != nil {
-		return errFile(err, vlog.dirPath, "Unable to open log dir.")
+// populateFilesMapFrom adds the value log files of dir to vlog.filesMap. The files of the cold
+// directory are only added if they aren't in the value directory too, which happens if the DB
+// crashed while moving them.
+func (vlog *valueLog) populateFilesMapFrom(dir string, cold bool) error {
+	files, err := ioutil.ReadDir(dir)
+	if cold && os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errFile(err, dir, "Unable to open log dir.")
 	}
 
 	found := make(map[uint64]struct{})
+	var stale []string
 	for _, file := range files {
+		if cold && !vlog.opt.ReadOnly && (strings.HasSuffix(file.Name(), ".holes") ||
+			strings.HasSuffix(file.Name(), ".vlog.tmp")) {
+			// A crash while moving a file can leave its holes and its partial copy behind.
+			stale = append(stale, file.Name())
+		}
 		if !strings.HasSuffix(file.Name(), ".vlog") {
 			continue
 		}
@@ -536,9 +636,21 @@ func (vlog *valueLog) populateFilesMap() error {
 		}
 		found[fid] = struct{}{}
 
+		path := vlogFilePath(dir, uint32(fid))
+		if _, ok := vlog.filesMap[uint32(fid)]; ok && cold {
+			if !vlog.opt.ReadOnly {
+				if err := os.Remove(path); err != nil {
+					return errFile(err, path, "Unable to remove the copy of a moved file.")
+				}
+				if err := removeHoles(path); err != nil {
+					return errFile(err, path, "Unable to remove the holes of a moved file.")
+				}
+			}
+			continue
+		}
 		lf := &logFile{
 			fid:      uint32(fid),
-			path:     vlog.fpath(uint32(fid)),
+			path:     path,
 			registry: vlog.db.registry,
 		}
 		vlog.filesMap[uint32(fid)] = lf
@@ -546,6 +658,19 @@ func (vlog *valueLog) populateFilesMap() error {
 			vlog.maxFid = uint32(fid)
 		}
 	}
+	for _, name := range stale {
+		path := dir + string(os.PathSeparator) + name
+		if strings.HasSuffix(name, ".holes") {
+			fid, err := strconv.ParseUint(strings.TrimSuffix(name, ".holes"), 10, 32)
+			if lf, ok := vlog.filesMap[uint32(fid)]; err == nil && ok &&
+				lf.path == vlogFilePath(dir, uint32(fid)) {
+				continue
+			}
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errFile(err, path, "Unable to remove the leftover of a moved file.")
+		}
+	}
 	return nil
 }
 
@@ -595,6 +720,7 @@ func (vlog *valueLog) init(db *DB) {
 	vlog.dirPath = vlog.opt.ValueDir
 
 	vlog.garbageCh = make(chan struct{}, 1) // Only allow one GC at a time.
+	vlog.deadBytes = make(map[uint32]int64)
 	lf, err := InitDiscardStats(vlog.opt)
 	y.Check(err)
 	vlog.discardStats = lf
@@ -610,6 +736,9 @@ func (vlog *valueLog) open(db *DB) error {
 	if err := vlog.populateFilesMap(); err != nil {
 		return err
 	}
+	if err := vlog.openBlobs(); err != nil {
+		return err
+	}
 	// If no files are found, then create a new file.
 	if len(vlog.filesMap) == 0 {
 		if vlog.opt.ReadOnly {
@@ -625,10 +754,15 @@ func (vlog *valueLog) open(db *DB) error {
 
 		// Just open in RDWR mode. This should not create a new log file.
 		lf.opt = vlog.opt
-		if err := lf.open(vlog.fpath(fid), os.O_RDWR,
+		if err := lf.open(lf.path, os.O_RDWR,
 			2*vlog.opt.ValueLogFileSize); err != nil {
 			return y.Wrapf(err, "Open existing file: %q", lf.path)
 		}
+		holes, err := readHoles(lf.path)
+		if err != nil {
+			return err
+		}
+		lf.holes = holes
 		// We shouldn't delete the maxFid file.
 		if lf.size == vlogHeaderSize && fid != vlog.maxFid {
 			vlog.opt.Infof("Deleting empty file: %s", lf.path)
@@ -654,6 +788,11 @@ func (vlog *valueLog) open(db *DB) error {
 	if err != nil {
 		return y.Wrapf(err, "while iterating over: %s", last.path)
 	}
+	if vlog.opt.SalvageLogTail {
+		if lastOff, err = vlog.salvageTail(last, lastOff); err != nil {
+			return y.Wrapf(err, "while salvaging: %s", last.path)
+		}
+	}
 	if err := last.Truncate(int64(lastOff)); err != nil {
 		return y.Wrapf(err, "while truncating last value log file: %s", last.path)
 	}
@@ -713,6 +852,7 @@ func (vlog *valueLog) sortedFids() []uint32 {
 type request struct {
 	// Input values
 	Entries []*Entry
+	sync    options.SyncMode
 	// Output values and wait group stuff below
 	Ptrs []valuePointer
 	Wg   sync.WaitGroup
@@ -727,8 +867,32 @@ type handoverRequest struct {
 	wg       sync.WaitGroup
 }
 
+// syncMode returns the sync mode of req, resolving SyncDefault based on syncWrites, the value of
+// Options.SyncWrites.
+func (req *request) syncMode(syncWrites bool) options.SyncMode {
+	if req.sync != options.SyncDefault {
+		return req.sync
+	}
+	if syncWrites {
+		return options.SyncAll
+	}
+	return options.NoSync
+}
+
+// syncMode returns the strictest sync mode amongst the given requests.
+func syncMode(syncWrites bool, reqs []*request) options.SyncMode {
+	mode := options.NoSync
+	for _, req := range reqs {
+		if m := req.syncMode(syncWrites); m > mode {
+			mode = m
+		}
+	}
+	return mode
+}
+
 func (req *request) reset() {
 	req.Entries = req.Entries[:0]
+	req.sync = options.SyncDefault
 	req.Ptrs = req.Ptrs[:0]
 	req.Wg = sync.WaitGroup{}
 	req.Err = nil
@@ -775,7 +939,7 @@ func (reqs requests) IncrRef() {
 // if fid >= vlog.maxFid. In some cases such as replay(while opening db), it might be called with
 // fid < vlog.maxFid. To sync irrespective of file id just call it with math.MaxUint32.
 func (vlog *valueLog) sync() error {
-	if vlog.opt.SyncWrites || vlog.opt.InMemory {
+	if vlog.opt.InMemory {
 		return nil
 	}
 
@@ -831,7 +995,7 @@ func (vlog *valueLog) validateWrites(reqs []*request) error {
 func estimateRequestSize(req *request) uint64 {
 	size := uint64(0)
 	for _, e := range req.Entries {
-		size += uint64(maxHeaderSize + len(e.Key) + len(e.Value) + crc32.Size)
+		size += uint64(maxHeaderSize+len(e.Key)+crc32.Size) + uint64(e.valueLen())
 	}
 	return size
 }
@@ -854,61 +1018,86 @@ func (vlog *valueLog) write(reqs []*request) error {
 	curlf := vlog.filesMap[maxFid]
 	vlog.filesLock.RUnlock()
 
+	syncVlog := syncMode(vlog.db.shouldSyncWrites(), reqs) >= options.SyncVlog
 	defer func() {
-		if vlog.opt.SyncWrites {
+		if syncVlog {
 			if err := curlf.Sync(); err != nil {
 				vlog.opt.Errorf("Error while curlf sync: %v\n", err)
 			}
 		}
 	}()
 
-	write := func(buf *bytes.Buffer) error {
-		if buf.Len() == 0 {
-			return nil
-		}
-
-		n := uint32(buf.Len())
+	// reserve returns the next n bytes of the log file to write to.
+	reserve := func(n uint32) []byte {
 		endOffset := atomic.AddUint32(&vlog.writableLogOffset, n)
 		// Increase the file size if we cannot accommodate this entry.
 		if int(endOffset) >= len(curlf.Data) {
 			curlf.Truncate(int64(endOffset))
 		}
+		return curlf.Data[endOffset-n : endOffset]
+	}
+
+	write := func(buf *bytes.Buffer) error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		y.AssertTrue(copy(reserve(uint32(buf.Len())), buf.Bytes()) == buf.Len())
+		atomic.StoreUint32(&curlf.size, vlog.woffset())
+		return nil
+	}
 
-		start := int(endOffset - n)
-		y.AssertTrue(copy(curlf.Data[start:], buf.Bytes()) == int(n))
+	rotate := func() error {
+		if syncVlog {
+			if err := curlf.Sync(); err != nil {
+				return y.Wrapf(err, "Unable to sync value log: %q", curlf.path)
+			}
+		}
+		if err := curlf.doneWriting(vlog.woffset()); err != nil {
+			return err
+		}
+		if vlog.db.archiver != nil {
+			vlog.db.archiver.add(curlf.fid)
+		}
 
-		atomic.StoreUint32(&curlf.size, endOffset)
+		newlf, err := vlog.createVlogFile()
+		if err != nil {
+			return err
+		}
+		curlf = newlf
 		return nil
 	}
 
 	toDisk := func() error {
 		if vlog.woffset() > uint32(vlog.opt.ValueLogFileSize) ||
-			vlog.numEntriesWritten > vlog.opt.ValueLogMaxEntries {
-			if err := curlf.doneWriting(vlog.woffset()); err != nil {
-				return err
-			}
-
-			newlf, err := vlog.createVlogFile()
-			if err != nil {
-				return err
-			}
-			curlf = newlf
+			vlog.numEntriesWritten > atomic.LoadUint32(&vlog.db.valueLogMaxEntries) {
+			return rotate()
 		}
 		return nil
 	}
 
+	// The file is encrypted with a retired data key. See DB.ReencryptValueLog.
+	if atomic.CompareAndSwapInt32(&vlog.rotateKey, 1, 0) {
+		if err := rotate(); err != nil {
+			return err
+		}
+	}
+
 	buf := new(bytes.Buffer)
 	for i := range reqs {
 		b := reqs[i]
 		b.Ptrs = b.Ptrs[:0]
 		var written, bytesWritten int
+		var archived int64
 		valueSizes := make([]int64, 0, len(b.Entries))
+		reqStart := vlog.woffset()
 		for j := range b.Entries {
 			buf.Reset()
 
 			e := b.Entries[j]
-			valueSizes = append(valueSizes, int64(len(e.Value)))
-			if e.skipVlogAndSetThreshold(vlog.db.valueThreshold()) {
+			valueSizes = append(valueSizes, e.valueLen())
+			// The files of the value log hold all the entries if they're archived.
+			inline := e.skipVlogAndSetThreshold(vlog.db.valueThreshold())
+			if inline && vlog.db.archiver == nil {
 				b.Ptrs = append(b.Ptrs, valuePointer{})
 				continue
 			}
@@ -924,22 +1113,60 @@ func (vlog *valueLog) write(reqs []*request) error {
 			// in a temporary variable and reassign it after writing to the value log.
 			tmpMeta := e.meta
 			e.meta = e.meta &^ (bitTxn | bitFinTxn)
-			plen, err := curlf.encodeEntry(buf, e, p.Offset) // Now encode the entry into buffer.
-			if err != nil {
-				return err
+			var plen int
+			var err error
+			switch {
+			case vlog.opt.BlobThreshold > 0 && e.valueLen() >= vlog.opt.BlobThreshold:
+				p, err = vlog.writeBlob(buf, e, syncVlog)
+				buf.Reset()
+				plen = int(p.Len)
+			case e.valueReader != nil:
+				// Stream the value straight into the file.
+				plen = curlf.encodedSize(e)
+				err = curlf.encodeStreamedEntry(reserve(uint32(plen)), e, p.Offset)
+				atomic.StoreUint32(&curlf.size, vlog.woffset())
+			default:
+				plen, err = curlf.encodeEntry(buf, e, p.Offset) // Now encode the entry into buffer.
 			}
 			// Restore the meta.
 			e.meta = tmpMeta
+			if err != nil && e.valueReader != nil {
+				// Only this request fails. Drop the entries it has written so far.
+				atomic.StoreUint32(&vlog.writableLogOffset, reqStart)
+				atomic.StoreUint32(&curlf.size, reqStart)
+				for _, p := range b.Ptrs {
+					if p.isBlob() {
+						vlog.dropBlob(p.Fid &^ blobFidBit)
+					}
+				}
+				b.Ptrs = b.Ptrs[:0]
+				b.Err = y.Wrapf(err, "while streaming value of key %q", e.Key)
+				break
+			}
+			if err != nil {
+				return err
+			}
 
 			p.Len = uint32(plen)
+			if inline {
+				// The value is kept in the LSM tree, so the entry is already stale for the GC.
+				archived += int64(plen)
+				p = valuePointer{}
+			}
 			b.Ptrs = append(b.Ptrs, p)
 			if err := write(buf); err != nil {
 				return err
 			}
 			written++
-			bytesWritten += buf.Len()
+			bytesWritten += plen
 			// No need to flush anything, we write to file directly via mmap.
 		}
+		if b.Err != nil {
+			continue
+		}
+		if archived > 0 {
+			vlog.discardStats.Update(curlf.fid, archived)
+		}
 		y.NumWritesAdd(vlog.opt.MetricsEnabled, int64(written))
 		y.NumBytesWrittenAdd(vlog.opt.MetricsEnabled, int64(bytesWritten))
 
@@ -994,16 +1221,9 @@ func (vlog *valueLog) Read(vp valuePointer, _ *y.Slice) ([]byte, func(), error)
 	}
 
 	if vlog.opt.VerifyValueChecksum {
-		hash := crc32.New(y.CastagnoliCrcTable)
-		if _, err := hash.Write(buf[:len(buf)-crc32.Size]); err != nil {
-			runCallback(cb)
-			return nil, nil, y.Wrapf(err, "failed to write hash for vp %+v", vp)
-		}
-		// Fetch checksum from the end of the buffer.
-		checksum := buf[len(buf)-crc32.Size:]
-		if hash.Sum32() != y.BytesToU32(checksum) {
+		if err := verifyValueChecksum(buf, vp); err != nil {
 			runCallback(cb)
-			return nil, nil, y.Wrapf(y.ErrChecksumMismatch, "value corrupted for vp: %+v", vp)
+			return nil, nil, err
 		}
 	}
 	var h header
@@ -1023,19 +1243,80 @@ func (vlog *valueLog) Read(vp valuePointer, _ *y.Slice) ([]byte, func(), error)
 	return kv[h.klen : h.klen+h.vlen], cb, nil
 }
 
+// readValueStream is like Read, but returns a reader of the value which reads it straight from the
+// log file, decrypting it on the fly if needed. The log file stays locked until the callback runs.
+func (vlog *valueLog) readValueStream(vp valuePointer) (io.Reader, func(), error) {
+	buf, lf, err := vlog.readValueBytes(vp)
+	cb := vlog.getUnlockCallback(lf)
+	if err != nil {
+		return nil, cb, err
+	}
+	if vlog.opt.VerifyValueChecksum {
+		if err := verifyValueChecksum(buf, vp); err != nil {
+			return nil, cb, err
+		}
+	}
+	var h header
+	kv := buf[h.Decode(buf):]
+	if uint32(len(kv)) < h.klen+h.vlen {
+		return nil, cb, errors.Errorf("Invalid read: Len: %d read at:[%d:%d]",
+			len(kv), h.klen, h.klen+h.vlen)
+	}
+	val := bytes.NewReader(kv[h.klen : h.klen+h.vlen])
+	if !lf.encryptionEnabled() {
+		return val, cb, nil
+	}
+	block, err := aes.NewCipher(lf.dataKey.Data)
+	if err != nil {
+		return nil, cb, err
+	}
+	// The key and the value are encrypted as one stream, so skip the key stream of the key.
+	stream := cipher.NewCTR(block, lf.generateIV(vp.Offset))
+	skip := make([]byte, h.klen)
+	stream.XORKeyStream(skip, skip)
+	return cipher.StreamReader{S: stream, R: val}, cb, nil
+}
+
+// verifyValueChecksum verifies the checksum of the value log entry in buf, read from vp.
+func verifyValueChecksum(buf []byte, vp valuePointer) error {
+	hash := crc32.New(y.CastagnoliCrcTable)
+	if _, err := hash.Write(buf[:len(buf)-crc32.Size]); err != nil {
+		return y.Wrapf(err, "failed to write hash for vp %+v", vp)
+	}
+	// Fetch checksum from the end of the buffer.
+	checksum := buf[len(buf)-crc32.Size:]
+	if hash.Sum32() != y.BytesToU32(checksum) {
+		return y.Wrapf(y.ErrChecksumMismatch, "value corrupted for vp: %+v", vp)
+	}
+	return nil
+}
+
 // getUnlockCallback will returns a function which unlock the logfile if the logfile is mmaped.
 // otherwise, it unlock the logfile and return nil.
 func (vlog *valueLog) getUnlockCallback(lf *logFile) func() {
 	if lf == nil {
 		return nil
 	}
+	if lf.fid&blobFidBit > 0 {
+		// Blob files are opened for each read.
+		return func() {
+			lf.lock.RUnlock()
+			_ = lf.Close(-1)
+		}
+	}
 	return lf.lock.RUnlock
 }
 
 // readValueBytes return vlog entry slice and read locked log file. Caller should take care of
 // logFile unlocking.
 func (vlog *valueLog) readValueBytes(vp valuePointer) ([]byte, *logFile, error) {
-	lf, err := vlog.getFileRLocked(vp)
+	var lf *logFile
+	var err error
+	if vp.isBlob() {
+		lf, err = vlog.openBlob(vp)
+	} else {
+		lf, err = vlog.getFileRLocked(vp)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1128,11 +1409,33 @@ type reason struct {
 	count   int
 }
 
-func (vlog *valueLog) doRunGC(lf *logFile) error {
-	_, span := otrace.StartSpan(context.Background(), "Badger.GC")
-	span.Annotatef(nil, "GC rewrite for: %v", lf.path)
+func (vlog *valueLog) doRunGC(ctx context.Context, lf *logFile, offset uint32,
+	res *GCResult) error {
+
+	_, span := otrace.StartSpan(ctx, "Badger.GC")
+	span.Annotatef(nil, "GC rewrite for: %v from offset: %d", lf.path, offset)
 	defer span.End()
-	if err := vlog.rewrite(lf); err != nil {
+	// A rewrite stopped midway is resumed, rather than punched, and punching holes doesn't
+	// re-encrypt the file.
+	if vlog.opt.ValueLogPunchHoles && !vlog.noPunch && offset == 0 &&
+		!(vlog.opt.ValueLogReencrypt && vlog.retiredKey(lf)) {
+		punched, err := vlog.punchStale(ctx, lf, res)
+		switch {
+		case err == errPunchHoleUnsupported:
+			vlog.opt.Warningf("Rewriting value log files, as holes can't be punched in %s",
+				lf.path)
+			vlog.noPunch = true
+		case err != nil:
+			return err
+		case punched:
+			vlog.discardStats.Update(lf.fid, -1)
+			vlog.deadLock.Lock()
+			delete(vlog.deadBytes, lf.fid)
+			vlog.deadLock.Unlock()
+			return nil
+		}
+	}
+	if err := vlog.rewriteFrom(ctx, lf, offset, res); err != nil {
 		return err
 	}
 	// Remove the file from discardStats.
@@ -1150,7 +1453,19 @@ func (vlog *valueLog) waitOnGC(lc *z.Closer) {
 	vlog.garbageCh <- struct{}{}
 }
 
-func (vlog *valueLog) runGC(discardRatio float64) error {
+func (vlog *valueLog) runGC(ctx context.Context, discardRatio float64) (GCResult, error) {
+	return vlog.runGCWith(ctx, func() *logFile {
+		if lf := vlog.pickLog(discardRatio); lf != nil || !vlog.opt.ValueLogReencrypt {
+			return lf
+		}
+		return vlog.pickRetired()
+	})
+}
+
+// runGCWith rewrites the file returned by pick, unless the rewrite of another file was stopped
+// and must be resumed first.
+func (vlog *valueLog) runGCWith(ctx context.Context, pick func() *logFile) (GCResult, error) {
+	var res GCResult
 	select {
 	case vlog.garbageCh <- struct{}{}:
 		// Pick a log file for GC.
@@ -1158,14 +1473,44 @@ func (vlog *valueLog) runGC(discardRatio float64) error {
 			<-vlog.garbageCh
 		}()
 
-		lf := vlog.pickLog(discardRatio)
+		start := time.Now()
+		// Resume the rewrite of the file the last run stopped at, if any.
+		lf, offset := vlog.resumeGC()
 		if lf == nil {
-			return ErrNoRewrite
+			lf = pick()
+		}
+		if lf == nil {
+			res.Duration = time.Since(start)
+			return res, ErrNoRewrite
 		}
-		return vlog.doRunGC(lf)
+		err := vlog.doRunGC(ctx, lf, offset, &res)
+		res.Duration = time.Since(start)
+		return res, err
 	default:
-		return ErrRejected
+		return res, ErrRejected
+	}
+}
+
+// resumeGC returns the file and offset the last rewrite was stopped at, and clears them. It
+// returns a nil file if there's none, or if the file was deleted since.
+func (vlog *valueLog) resumeGC() (*logFile, uint32) {
+	cp := vlog.gcCheckpoint
+	vlog.gcCheckpoint = valuePointer{}
+	if cp.Fid == 0 {
+		return nil, 0
+	}
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+	for _, fid := range vlog.filesToBeDeleted {
+		if fid == cp.Fid {
+			return nil, 0
+		}
+	}
+	lf, ok := vlog.filesMap[cp.Fid]
+	if !ok {
+		return nil, 0
 	}
+	return lf, cp.Offset
 }
 
 func (vlog *valueLog) updateDiscardStats(stats map[uint32]int64) {
@@ -1173,10 +1518,24 @@ func (vlog *valueLog) updateDiscardStats(stats map[uint32]int64) {
 		return
 	}
 	for fid, discard := range stats {
+		if fid&blobFidBit > 0 {
+			vlog.releaseBlob(fid)
+			continue
+		}
 		vlog.discardStats.Update(fid, discard)
 	}
 }
 
+const (
+	// adaptiveWindow is the number of values written between the adjustments of an adaptive
+	// value threshold.
+	adaptiveWindow = 10000
+	// The bounds of the percentile of the value sizes an adaptive value threshold is set to, for
+	// workloads only writing and only reading values.
+	adaptiveMinPercentile = 0.5
+	adaptiveMaxPercentile = 0.99
+)
+
 type vlogThreshold struct {
 	logger         Logger
 	percentile     float64
@@ -1186,6 +1545,16 @@ type vlogThreshold struct {
 	closer         *z.Closer
 	// Metrics contains a running log of statistics like amount of data stored etc.
 	vlMetrics *z.HistogramData
+
+	// adaptive is set by Options.AdaptiveValueThreshold.
+	adaptive bool
+	// reads counts the values read since the last adjustment. Must access via atomics.
+	reads int64
+	// sampled counts the values written since the last adjustment.
+	sampled int64
+	// readCount and writeCount are the numbers of values read and written, halved at every
+	// adjustment so that they follow the workload.
+	readCount, writeCount float64
 }
 
 func initVlogThreshold(opt *Options) *vlogThreshold {
@@ -1217,6 +1586,7 @@ func initVlogThreshold(opt *Options) *vlogThreshold {
 		clearCh:        make(chan bool, 1),
 		closer:         z.NewCloser(1),
 		vlMetrics:      z.NewHistogramData(getBounds()),
+		adaptive:       opt.AdaptiveValueThreshold,
 	}
 }
 
@@ -1229,6 +1599,29 @@ func (v *vlogThreshold) update(sizes []int64) {
 	v.valueCh <- sizes
 }
 
+// read records that a value was read, for an adaptive threshold.
+func (v *vlogThreshold) read() {
+	if v.adaptive {
+		atomic.AddInt64(&v.reads, 1)
+	}
+}
+
+// adapt returns the threshold for the values written since the last adjustment, and starts the
+// next one. The share of reads among the values read and written sets the percentile of the value
+// sizes the threshold is set to, so that read-heavy workloads keep more values in the LSM tree,
+// which saves value log reads, and write-heavy ones move more to the value log, which saves
+// compaction work.
+func (v *vlogThreshold) adapt() int64 {
+	v.readCount = v.readCount/2 + float64(atomic.SwapInt64(&v.reads, 0))
+	v.writeCount = v.writeCount/2 + float64(v.sampled)
+	share := v.readCount / (v.readCount + v.writeCount)
+	p := adaptiveMinPercentile + share*(adaptiveMaxPercentile-adaptiveMinPercentile)
+	t := int64(v.vlMetrics.Percentile(p))
+	v.vlMetrics.Clear()
+	v.sampled = 0
+	return t
+}
+
 func (v *vlogThreshold) close() {
 	v.closer.SignalAndWait()
 }
@@ -1243,10 +1636,18 @@ func (v *vlogThreshold) listenForValueThresholdUpdate() {
 			for _, e := range val {
 				v.vlMetrics.Update(e)
 			}
-			// we are making it to get Options.VlogPercentile so that values with sizes
-			// in range of Options.VlogPercentile will make it to the LSM tree and rest to the
-			// value log file.
-			p := int64(v.vlMetrics.Percentile(v.percentile))
+			var p int64
+			if v.adaptive {
+				if v.sampled += int64(len(val)); v.sampled < adaptiveWindow {
+					continue
+				}
+				p = v.adapt()
+			} else {
+				// we are making it to get Options.VlogPercentile so that values with sizes
+				// in range of Options.VlogPercentile will make it to the LSM tree and rest to
+				// the value log file.
+				p = int64(v.vlMetrics.Percentile(v.percentile))
+			}
 			if atomic.LoadInt64(&v.valueThreshold) != p {
 				if v.logger != nil {
 					v.logger.Infof("updating value of threshold to: %d", p)
@@ -1255,6 +1656,8 @@ func (v *vlogThreshold) listenForValueThresholdUpdate() {
 			}
 		case <-v.clearCh:
 			v.vlMetrics.Clear()
+			v.sampled, v.readCount, v.writeCount = 0, 0, 0
+			atomic.StoreInt64(&v.reads, 0)
 		}
 	}
 }
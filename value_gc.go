@@ -0,0 +1,129 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// GCResult describes the work done by a run of the value log GC.
+type GCResult struct {
+	// FilesRewritten is the number of value log files whose live entries were all moved to the
+	// head of the value log. The files are deleted once no iterator reads them anymore.
+	FilesRewritten int
+	// FilesPunched is the number of value log files in which holes were punched over the stale
+	// entries. See Options.ValueLogPunchHoles.
+	FilesPunched int
+	// EntriesMoved and BytesMoved are the number and the size of the live entries moved to the
+	// head of the value log, including the ones moved by a rewrite stopped midway.
+	EntriesMoved int
+	BytesMoved   int64
+	// BytesReclaimed is the disk space freed by the files rewritten and the holes punched. The
+	// entries moved take BytesMoved of it back.
+	BytesReclaimed int64
+	Duration       time.Duration
+}
+
+func (r *GCResult) add(o GCResult) {
+	r.FilesRewritten += o.FilesRewritten
+	r.FilesPunched += o.FilesPunched
+	r.EntriesMoved += o.EntriesMoved
+	r.BytesMoved += o.BytesMoved
+	r.BytesReclaimed += o.BytesReclaimed
+	r.Duration += o.Duration
+}
+
+// gcLoad is a snapshot of the counters telling the load of the DB.
+type gcLoad struct {
+	ops    int64
+	stalls int64
+}
+
+func (db *DB) gcLoad() gcLoad {
+	return gcLoad{
+		ops:    atomic.LoadInt64(&db.metrics.gets) + atomic.LoadInt64(&db.metrics.puts),
+		stalls: atomic.LoadInt64(&db.metrics.writeStalls),
+	}
+}
+
+// busy tells if the DB was under load since prev was taken, according to the policy.
+func (l gcLoad) busy(prev gcLoad, policy GCPolicy) bool {
+	if l.stalls > prev.stalls {
+		return true
+	}
+	return policy.IdleOnly && l.ops > prev.ops
+}
+
+// runAutoGC runs the value log GC every Options.AutoGC.Interval, until c is closed.
+func (db *DB) runAutoGC(c *z.Closer) {
+	defer c.Done()
+	policy := db.opt.AutoGC
+
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+	// The load is measured from the end of the previous run, since the rewrites of a run are
+	// writes too.
+	prev := db.gcLoad()
+	for {
+		select {
+		case <-c.HasBeenClosed():
+			return
+		case <-ticker.C:
+		}
+		if db.compactionGate.paused() || db.isFrozen() {
+			db.opt.Debugf("Skipping value log GC, the background work is paused")
+			continue
+		}
+		if load := db.gcLoad(); load.busy(prev, policy) {
+			db.opt.Debugf("Skipping value log GC, the DB is busy")
+			prev = load
+			continue
+		}
+		db.autoGCRun(c, policy)
+		prev = db.gcLoad()
+	}
+}
+
+// autoGCRun rewrites value log files until none has enough to discard, MaxDurationPerRun is
+// exceeded, or c is closed. A rewrite stopped midway is resumed by the next run.
+func (db *DB) autoGCRun(c *z.Closer, policy GCPolicy) {
+	ctx := c.Ctx()
+	if policy.MaxDurationPerRun > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.MaxDurationPerRun)
+		defer cancel()
+	}
+	if policy.TargetSpaceAmp > 0 {
+		_, err := db.RunValueLogGCForSpaceAmp(ctx, policy.TargetSpaceAmp, 0)
+		if err != nil && err != ErrNoRewrite && err != ErrRejected && err != ctx.Err() {
+			db.opt.Warningf("While running value log GC: %v", err)
+		}
+		return
+	}
+	for {
+		if _, err := db.RunValueLogGCWithContext(ctx, policy.DiscardRatio); err != nil {
+			if err != ErrNoRewrite && err != ErrRejected && err != ctx.Err() {
+				db.opt.Warningf("While running value log GC: %v", err)
+			}
+			return
+		}
+	}
+}
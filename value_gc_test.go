@@ -0,0 +1,73 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGCLoadBusy(t *testing.T) {
+	prev := gcLoad{ops: 10, stalls: 1}
+	require.False(t, gcLoad{ops: 20, stalls: 1}.busy(prev, GCPolicy{}))
+	require.True(t, gcLoad{ops: 20, stalls: 1}.busy(prev, GCPolicy{IdleOnly: true}))
+	require.False(t, gcLoad{ops: 10, stalls: 1}.busy(prev, GCPolicy{IdleOnly: true}))
+	require.True(t, gcLoad{ops: 10, stalls: 2}.busy(prev, GCPolicy{}))
+}
+
+func TestAutoGC(t *testing.T) {
+	opt := getTestOptions("").WithAutoGC(GCPolicy{Interval: 10 * time.Millisecond})
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		require.Equal(t, 0.5, db.opt.AutoGC.DiscardRatio)
+		// There's nothing to rewrite, but the runs are counted.
+		deadline := time.Now().Add(5 * time.Second)
+		for db.Metrics().VlogGCNoRewrites == 0 {
+			require.True(t, time.Now().Before(deadline), "no value log GC ran")
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// The runs are skipped while the compactions are paused, or the DB is frozen.
+		for _, pause := range []func() func(){
+			func() func() {
+				db.PauseCompactions()
+				return db.ResumeCompactions
+			},
+			func() func() {
+				require.NoError(t, db.Freeze())
+				return db.Thaw
+			},
+		} {
+			resume := pause()
+			// Let the running one finish.
+			time.Sleep(50 * time.Millisecond)
+			runs := db.Metrics().VlogGCNoRewrites
+			time.Sleep(100 * time.Millisecond)
+			require.Equal(t, runs, db.Metrics().VlogGCNoRewrites)
+			resume()
+		}
+	})
+
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt = getTestOptions(dir).WithAutoGC(GCPolicy{DiscardRatio: 1, Interval: time.Second})
+	_, err = Open(opt)
+	require.Error(t, err)
+}
@@ -18,7 +18,9 @@ package badger
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"math/rand"
@@ -30,6 +32,7 @@ import (
 
 	"github.com/dgraph-io/badger/v3/y"
 	humanize "github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -75,6 +78,37 @@ func TestDynamicValueThreshold(t *testing.T) {
 	require.Equal(t, log.db.valueThreshold(), int64(995))
 }
 
+func TestAdaptiveValueThreshold(t *testing.T) {
+	opt := DefaultOptions("").WithValueThreshold(100).WithAdaptiveValueThreshold(true)
+	opt.maxValueThreshold = 1000
+	v := initVlogThreshold(&opt)
+	sample := func() {
+		for size := int64(1); size <= 1000; size++ {
+			v.vlMetrics.Update(size)
+		}
+		v.sampled = 1000
+	}
+
+	// Only writes move half of the values to the value log.
+	sample()
+	require.InDelta(t, 500, v.adapt(), 20)
+
+	// Mostly reads keep most of them in the LSM tree.
+	sample()
+	for i := 0; i < 100000; i++ {
+		v.read()
+	}
+	require.InDelta(t, 980, v.adapt(), 20)
+
+	// The reads are forgotten as the workload turns back to writes.
+	for i := 0; i < 10; i++ {
+		sample()
+		v.adapt()
+	}
+	sample()
+	require.InDelta(t, 500, v.adapt(), 20)
+}
+
 func TestValueBasic(t *testing.T) {
 	dir, err := ioutil.TempDir("", "badger-test")
 	y.Check(err)
@@ -197,7 +231,7 @@ func TestValueGCManaged(t *testing.T) {
 
 	for i := 0; i < 100; i++ {
 		// Try at max 100 times to GC even a single value log file.
-		if err := db.RunValueLogGC(0.0001); err == nil {
+		if _, err := db.RunValueLogGC(0.0001); err == nil {
 			return // Done
 		}
 	}
@@ -334,6 +368,82 @@ func TestValueGC2(t *testing.T) {
 	}
 }
 
+// stopAfterCtx is a context which is done once Err was called n times.
+type stopAfterCtx struct {
+	context.Context
+	n int
+}
+
+func (ctx *stopAfterCtx) Err() error {
+	if ctx.n--; ctx.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestValueGCWithContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+	opt.ValueLogFileSize = 1 << 20
+	opt.ValueThreshold = 1 << 10
+
+	kv, err := Open(opt)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	sz := 32 << 10
+	for i := 0; i < 100; i++ {
+		v := make([]byte, sz)
+		rand.Read(v)
+		txnSet(t, kv, []byte(fmt.Sprintf("key%d", i)), v, 0)
+	}
+	for i := 0; i < 5; i++ {
+		txnDelete(t, kv, []byte(fmt.Sprintf("key%d", i)))
+	}
+
+	kv.vlog.filesLock.RLock()
+	fid := kv.vlog.sortedFids()[0]
+	kv.vlog.filesLock.RUnlock()
+
+	// Stop the rewrite after a few entries. The file is kept, and the checkpoint is saved.
+	ctx := &stopAfterCtx{Context: context.Background(), n: 10}
+	res, err := kv.RunValueLogGCWithContext(ctx, 0.01)
+	require.Equal(t, context.Canceled, err)
+	// The entries moved before the stop are reported, but the file isn't rewritten yet.
+	require.Zero(t, res.FilesRewritten)
+	require.Zero(t, res.BytesReclaimed)
+	require.Equal(t, fid, kv.vlog.gcCheckpoint.Fid)
+	require.True(t, kv.vlog.gcCheckpoint.Offset > vlogHeaderSize)
+	kv.vlog.filesLock.RLock()
+	_, ok := kv.vlog.filesMap[fid]
+	kv.vlog.filesLock.RUnlock()
+	require.True(t, ok)
+
+	// The next run resumes the same file, even if its discard ratio is too low.
+	res, err = kv.RunValueLogGCWithContext(context.Background(), 0.99)
+	require.NoError(t, err)
+	require.Equal(t, 1, res.FilesRewritten)
+	require.True(t, res.EntriesMoved > 0)
+	require.True(t, res.BytesReclaimed > res.BytesMoved)
+	require.NotZero(t, res.Duration)
+	require.Zero(t, kv.vlog.gcCheckpoint.Fid)
+	kv.vlog.filesLock.RLock()
+	_, ok = kv.vlog.filesMap[fid]
+	kv.vlog.filesLock.RUnlock()
+	require.False(t, ok)
+
+	for i := 5; i < 100; i++ {
+		require.NoError(t, kv.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+			require.NoError(t, err)
+			require.Len(t, getItemValue(t, item), sz)
+			return nil
+		}))
+	}
+}
+
 func TestValueGC3(t *testing.T) {
 	dir, err := ioutil.TempDir("", "badger-test")
 	require.NoError(t, err)
@@ -759,11 +869,12 @@ func TestValueLogTrigger(t *testing.T) {
 		txnDelete(t, kv, []byte(fmt.Sprintf("key%d", i)))
 	}
 
-	require.NoError(t, kv.RunValueLogGC(0.5))
+	_, err = kv.RunValueLogGC(0.5)
+	require.NoError(t, err)
 
 	require.NoError(t, kv.Close())
 
-	err = kv.RunValueLogGC(0.5)
+	_, err = kv.RunValueLogGC(0.5)
 	require.Equal(t, ErrRejected, err, "Error should be returned after closing DB.")
 }
 
@@ -944,7 +1055,7 @@ func TestBug578(t *testing.T) {
 
 		// Run value log GC a few times.
 		for i := 0; i < 5; i++ {
-			db.RunValueLogGC(0.5)
+			_, _ = db.RunValueLogGC(0.5)
 		}
 		h.readRange(0, 10)
 	}
@@ -1272,3 +1383,252 @@ func TestFirstVlogFile(t *testing.T) {
 	require.NotZero(t, len(fids))
 	require.Equal(t, uint32(1), fids[0])
 }
+
+func TestEntryWithValueReader(t *testing.T) {
+	run := func(t *testing.T, opt Options) {
+		// The small value is below the threshold, so it is read on SetEntry.
+		opt.ValueThreshold = 1 << 10
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			val := make([]byte, 1<<20)
+			rand.Read(val)
+			small := []byte("small value")
+
+			txn := db.NewTransaction(true)
+			defer txn.Discard()
+			e := NewEntry([]byte("big"), nil).WithValueReader(bytes.NewReader(val), int64(len(val)))
+			require.NoError(t, txn.SetEntry(e))
+			e = NewEntry([]byte("small"), nil).WithValueReader(bytes.NewReader(small),
+				int64(len(small)))
+			require.NoError(t, txn.SetEntry(e))
+			// The value of big has not been read yet.
+			_, err := txn.Get([]byte("big"))
+			require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+			require.NoError(t, txn.Commit())
+
+			require.NoError(t, db.View(func(txn *Txn) error {
+				item, err := txn.Get([]byte("big"))
+				require.NoError(t, err)
+				require.Equal(t, val, getItemValue(t, item))
+				// The size of the header is estimated.
+				require.InDelta(t, len(val), item.ValueSize(), 4)
+				item, err = txn.Get([]byte("small"))
+				require.NoError(t, err)
+				require.Equal(t, small, getItemValue(t, item))
+				return nil
+			}))
+
+			// A failing reader fails only the commit of its own transaction.
+			failing := io.MultiReader(bytes.NewReader(val[:100]), iotestErrReader{})
+			for _, r := range []io.Reader{failing, bytes.NewReader(val[:100])} {
+				txn := db.NewTransaction(true)
+				e := NewEntry([]byte("bad"), nil).WithValueReader(r, int64(len(val)))
+				require.NoError(t, txn.SetEntry(e))
+				require.NoError(t, txn.Set([]byte("other"), []byte("other")))
+				require.Error(t, txn.Commit())
+			}
+			txnSet(t, db, []byte("after"), val, 0)
+			require.NoError(t, db.View(func(txn *Txn) error {
+				for _, key := range []string{"bad", "other"} {
+					_, err := txn.Get([]byte(key))
+					require.Equal(t, ErrKeyNotFound, err)
+				}
+				item, err := txn.Get([]byte("after"))
+				require.NoError(t, err)
+				require.Equal(t, val, getItemValue(t, item))
+				return nil
+			}))
+		})
+	}
+	t.Run("plain", func(t *testing.T) {
+		run(t, getTestOptions(""))
+	})
+	t.Run("encrypted", func(t *testing.T) {
+		key := make([]byte, 32)
+		rand.Read(key)
+		opt := getTestOptions("")
+		opt.EncryptionKey = key
+		opt.IndexCacheSize = 1 << 20
+		run(t, opt)
+	})
+}
+
+func TestEntryWithValueLocation(t *testing.T) {
+	opt := getTestOptions("")
+	opt.ValueThreshold = 1 << 10
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		small, big := []byte("small value"), make([]byte, 4<<10)
+		rand.Read(big)
+		tests := []struct {
+			key      string
+			val      []byte
+			location ValueLocation
+			inVlog   bool
+		}{
+			{"small", small, ValueLocationDefault, false},
+			{"big", big, ValueLocationDefault, true},
+			{"small-vlog", small, ValueLocationValueLog, true},
+			{"big-inline", big, ValueLocationInline, false},
+			{"empty-vlog", nil, ValueLocationValueLog, false},
+		}
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for _, tt := range tests {
+				e := NewEntry([]byte(tt.key), tt.val).WithValueLocation(tt.location)
+				require.NoError(t, txn.SetEntry(e))
+			}
+			return nil
+		}))
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for _, tt := range tests {
+				item, err := txn.Get([]byte(tt.key))
+				require.NoError(t, err)
+				require.Equal(t, tt.inVlog, item.meta&bitValuePointer > 0, tt.key)
+				require.Equal(t, len(tt.val), len(getItemValue(t, item)), tt.key)
+			}
+			return nil
+		}))
+	})
+}
+
+// iotestErrReader fails all the reads.
+type iotestErrReader struct{}
+
+func (iotestErrReader) Read([]byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestItemValueReaderAndView(t *testing.T) {
+	run := func(t *testing.T, opt Options) {
+		opt.ValueThreshold = 1 << 10
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			big := make([]byte, 1<<20)
+			rand.Read(big)
+			small := []byte("small value")
+			txnSet(t, db, []byte("big"), big, 0)
+			txnSet(t, db, []byte("small"), small, 0)
+
+			var views []*ValueView
+			require.NoError(t, db.View(func(txn *Txn) error {
+				for key, val := range map[string][]byte{"big": big, "small": small} {
+					item, err := txn.Get([]byte(key))
+					require.NoError(t, err)
+
+					r, err := item.ValueReader()
+					require.NoError(t, err)
+					// Read in small chunks, to exercise the decryption of partial blocks.
+					var got []byte
+					chunk := make([]byte, 7)
+					for {
+						n, err := r.Read(chunk)
+						got = append(got, chunk[:n]...)
+						if err == io.EOF {
+							break
+						}
+						require.NoError(t, err)
+					}
+					require.NoError(t, r.Close())
+					require.Equal(t, val, got)
+
+					view, err := item.ValueView()
+					require.NoError(t, err)
+					views = append(views, view)
+				}
+				return nil
+			}))
+			// The views stay valid after the transaction is done.
+			for _, view := range views {
+				n := len(view.Bytes())
+				require.True(t, n == len(big) || n == len(small))
+				if n == len(big) {
+					require.Equal(t, big, view.Bytes())
+				} else {
+					require.Equal(t, small, view.Bytes())
+				}
+				view.Release()
+				view.Release()
+				require.Nil(t, view.Bytes())
+			}
+		})
+	}
+	t.Run("plain", func(t *testing.T) {
+		run(t, getTestOptions(""))
+	})
+	t.Run("encrypted", func(t *testing.T) {
+		key := make([]byte, 32)
+		rand.Read(key)
+		opt := getTestOptions("")
+		opt.EncryptionKey = key
+		opt.IndexCacheSize = 1 << 20
+		run(t, opt)
+	})
+}
+
+func TestEntryUserMetaExt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opt := getTestOptions(dir)
+	opt.ValueThreshold = 32
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	ext := []byte("0123456789abcdef")
+	small := []byte("small")
+	big := bytes.Repeat([]byte("b"), 64)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		tooBig := NewEntry([]byte("bad"), small).WithUserMetaExt(append(ext, 'x'))
+		require.Equal(t, ErrInvalidRequest, errors.Cause(txn.SetEntry(tooBig)))
+		if err := txn.SetEntry(NewEntry([]byte("small"), small).WithMeta(7).
+			WithUserMetaExt(ext)); err != nil {
+			return err
+		}
+		if err := txn.SetEntry(NewEntry([]byte("big"), big).WithMeta(8).
+			WithUserMetaExt(ext[:3])); err != nil {
+			return err
+		}
+		return txn.Set([]byte("plain"), small)
+	}))
+
+	check := func(db *DB) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("small"))
+			require.NoError(t, err)
+			require.Equal(t, byte(7), item.UserMeta())
+			require.Equal(t, ext, item.UserMetaExt())
+			require.Equal(t, small, getItemValue(t, item))
+
+			item, err = txn.Get([]byte("big"))
+			require.NoError(t, err)
+			require.Equal(t, byte(8), item.UserMeta())
+			require.Equal(t, ext[:3], item.UserMetaExt())
+			require.Equal(t, big, getItemValue(t, item))
+
+			item, err = txn.Get([]byte("plain"))
+			require.NoError(t, err)
+			require.Nil(t, item.UserMetaExt())
+			return nil
+		}))
+	}
+	check(db)
+
+	// Flush the memtable to a table and replay from disk.
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	check(db)
+
+	// Round trip through a backup.
+	var buf bytes.Buffer
+	_, err = db.Backup(&buf, 0)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	dir2, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir2)
+	db2, err := Open(getTestOptions(dir2))
+	require.NoError(t, err)
+	defer db2.Close()
+	require.NoError(t, db2.Load(&buf, 16))
+	check(db2)
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// retiredKey tells if lf isn't encrypted with the latest data key, either because it was created
+// before the key was rotated, or before encryption was enabled.
+func (vlog *valueLog) retiredKey(lf *logFile) bool {
+	return lf.keyID() != vlog.db.registry.latestKeyID()
+}
+
+// retiredFiles returns the value log files encrypted with retired data keys, oldest first. The
+// file being written to isn't returned, and neither are the files already rewritten, which are
+// pending deletion in vlog.filesToBeDeleted while iterators are open.
+func (vlog *valueLog) retiredFiles() []*logFile {
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+	toBeDeleted := make(map[uint32]struct{}, len(vlog.filesToBeDeleted))
+	for _, fid := range vlog.filesToBeDeleted {
+		toBeDeleted[fid] = struct{}{}
+	}
+	var files []*logFile
+	for _, fid := range vlog.sortedFids() {
+		if _, ok := toBeDeleted[fid]; ok || fid == vlog.maxFid {
+			continue
+		}
+		if lf := vlog.filesMap[fid]; vlog.retiredKey(lf) {
+			files = append(files, lf)
+		}
+	}
+	return files
+}
+
+// pickRetired returns the oldest value log file encrypted with a retired data key, if any.
+func (vlog *valueLog) pickRetired() *logFile {
+	if files := vlog.retiredFiles(); len(files) > 0 {
+		vlog.opt.Infof("Picking fid: %d encrypted with retired data key: %d", files[0].fid,
+			files[0].keyID())
+		return files[0]
+	}
+	return nil
+}
+
+// ReencryptValueLog rewrites the value log files which aren't encrypted with the latest data key,
+// like the value log GC does, so that the retired data keys, or the plain text of the files
+// written before encryption was enabled, aren't needed anymore. A new data key is generated first
+// if the latest one is older than Options.EncryptionKeyRotationDuration, and the file being
+// written to is replaced on the next write if it has a retired key, as the rewritten values go
+// there. The data keys themselves are kept in the key registry.
+//
+// The rewrites stop once ctx is done, with ctx.Err(), and the file being rewritten is resumed by
+// the next call, or by the value log GC. It returns ErrRejected if the value log GC is running,
+// and what the rewrites did in any case. Set Options.ValueLogReencrypt to have the value
+// log GC rewrite the files as it goes instead.
+func (db *DB) ReencryptValueLog(ctx context.Context) (res GCResult, err error) {
+	if db.opt.InMemory {
+		return res, ErrGCInMemoryMode
+	}
+	vlog := &db.vlog
+	select {
+	case vlog.garbageCh <- struct{}{}:
+		defer func() {
+			<-vlog.garbageCh
+		}()
+	default:
+		return res, ErrRejected
+	}
+
+	start := time.Now()
+	defer func() {
+		res.Duration = time.Since(start)
+	}()
+	if _, err := db.registry.LatestDataKey(); err != nil {
+		return res, err
+	}
+	vlog.filesLock.RLock()
+	active := vlog.filesMap[vlog.maxFid]
+	vlog.filesLock.RUnlock()
+	if vlog.retiredKey(active) {
+		atomic.StoreInt32(&vlog.rotateKey, 1)
+	}
+
+	// The file being written to is only replaced once a value is rewritten, and then has to be
+	// rewritten as well.
+	for files := vlog.retiredFiles(); len(files) > 0; files = vlog.retiredFiles() {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		lf := files[0]
+		// Resume the rewrite of the file if it was stopped midway.
+		var offset uint32
+		if cp := vlog.gcCheckpoint; cp.Fid == lf.fid {
+			offset = cp.Offset
+			vlog.gcCheckpoint = valuePointer{}
+		}
+		if err = vlog.rewriteFrom(ctx, lf, offset, &res); err != nil {
+			return res, err
+		}
+		vlog.discardStats.Update(lf.fid, -1)
+		atomic.AddInt64(&db.metrics.vlogGCRuns, 1)
+	}
+	return res, nil
+}
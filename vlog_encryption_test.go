@@ -0,0 +1,123 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReencryptValueLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	key := make([]byte, 32)
+	rand.Read(key)
+	opt := getTestOptions(dir).WithValueLogFileSize(1 << 20).WithValueThreshold(1 << 10).
+		WithEncryptionKey(key).WithIndexCacheSize(1 << 20).WithValueLogReencrypt(true)
+
+	sz := 32 << 10
+	vals := make(map[int][]byte)
+	set := func(db *DB, i int) {
+		v := make([]byte, sz)
+		rand.Read(v)
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), v, 0)
+		vals[i] = v
+	}
+	check := func(db *DB) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i, v := range vals {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+				require.NoError(t, err)
+				require.Equal(t, v, getItemValue(t, item))
+			}
+			return nil
+		}))
+	}
+	// rotate makes the next data key requested a new one.
+	rotate := func(db *DB) {
+		db.registry.Lock()
+		db.registry.lastCreated = 0
+		db.registry.Unlock()
+	}
+	retired := func(db *DB) int {
+		var n int
+		db.vlog.filesLock.RLock()
+		for _, lf := range db.vlog.filesMap {
+			if db.vlog.retiredKey(lf) {
+				n++
+			}
+		}
+		db.vlog.filesLock.RUnlock()
+		return n
+	}
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	for i := 0; i < 80; i++ {
+		set(db, i)
+	}
+	oldKey := db.vlog.filesMap[1].keyID()
+	rotate(db)
+
+	res, err := db.ReencryptValueLog(context.Background())
+	require.NoError(t, err)
+	// The file being written to when the key was rotated is rewritten as well.
+	require.True(t, res.FilesRewritten >= 3, "%d", res.FilesRewritten)
+	require.Zero(t, retired(db))
+	require.NotEqual(t, oldKey, db.registry.latestKeyID())
+	check(db)
+
+	// The files rewritten while an iterator is open are only deleted once it's closed, and aren't
+	// picked again in the meantime.
+	rotate(db)
+	txn := db.NewTransaction(false)
+	itr := txn.NewIterator(DefaultIteratorOptions)
+	res, err = db.ReencryptValueLog(context.Background())
+	require.NoError(t, err)
+	require.NotZero(t, res.FilesRewritten)
+	db.vlog.filesLock.RLock()
+	pending := len(db.vlog.filesToBeDeleted)
+	db.vlog.filesLock.RUnlock()
+	require.Equal(t, res.FilesRewritten, pending)
+	require.Empty(t, db.vlog.retiredFiles())
+	require.Nil(t, db.vlog.pickRetired())
+	itr.Close()
+	txn.Discard()
+	require.Zero(t, retired(db))
+	check(db)
+
+	// The value log GC rewrites the retired files when there's nothing to discard.
+	rotate(db)
+	_, err = db.registry.LatestDataKey()
+	require.NoError(t, err)
+	require.NotZero(t, retired(db))
+	_, err = db.RunValueLogGC(0.5)
+	require.NoError(t, err)
+	check(db)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	check(db)
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+// errPunchHoleUnsupported is returned by punchHole if the filesystem can't punch holes.
+var errPunchHoleUnsupported = errors.New("Punching holes is not supported")
+
+// minHoleSize is the size of the shortest run of stale entries a hole is punched over. A shorter
+// run may not span a whole filesystem block, and punching it would free nothing.
+const minHoleSize = 8 << 10
+
+// vlogHole is a region [start, end) of a value log file which only holds stale entries, and whose
+// disk space was deallocated by the GC. It reads as zeros. See Options.ValueLogPunchHoles.
+type vlogHole struct {
+	start, end uint32
+}
+
+// holesFilePath returns the path of the file listing the holes of the value log file at path.
+func holesFilePath(path string) string {
+	return strings.TrimSuffix(path, ".vlog") + ".holes"
+}
+
+// readHoles reads the holes of the value log file at path, if it has any. The holes file holds
+// the start and end offsets of each hole, followed by their CRC.
+func readHoles(path string) ([]vlogHole, error) {
+	hpath := holesFilePath(path)
+	data, err := ioutil.ReadFile(hpath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errFile(err, hpath, "Unable to read holes file")
+	}
+	n := len(data) - crc32.Size
+	if n < 0 || n%8 != 0 ||
+		crc32.Checksum(data[:n], y.CastagnoliCrcTable) != y.BytesToU32(data[n:]) {
+		return nil, errors.Errorf("Corrupted holes file: %s", hpath)
+	}
+	holes := make([]vlogHole, 0, n/8)
+	for i := 0; i < n; i += 8 {
+		holes = append(holes, vlogHole{
+			start: binary.BigEndian.Uint32(data[i:]),
+			end:   binary.BigEndian.Uint32(data[i+4:]),
+		})
+	}
+	return holes, nil
+}
+
+// encodeHoles returns the content of the holes file listing holes.
+func encodeHoles(holes []vlogHole) []byte {
+	data := make([]byte, 0, 8*len(holes)+crc32.Size)
+	for _, h := range holes {
+		data = append(data, y.U32ToBytes(h.start)...)
+		data = append(data, y.U32ToBytes(h.end)...)
+	}
+	return append(data, y.U32ToBytes(crc32.Checksum(data, y.CastagnoliCrcTable))...)
+}
+
+// writeHoles replaces the holes file of the value log file at path.
+func writeHoles(path string, holes []vlogHole) error {
+	data := encodeHoles(holes)
+	hpath := holesFilePath(path)
+	if err := writeSyncedFile(hpath+".tmp", data); err != nil {
+		os.Remove(hpath + ".tmp")
+		return err
+	}
+	if err := os.Rename(hpath+".tmp", hpath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(hpath))
+}
+
+// removeHoles removes the holes file of the value log file at path, if it has one.
+func removeHoles(path string) error {
+	if err := os.Remove(holesFilePath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// mergeHoles returns the holes of a and b, with the ones which touch merged.
+func mergeHoles(a, b []vlogHole) []vlogHole {
+	all := append(append([]vlogHole{}, a...), b...)
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].start < all[j].start
+	})
+	var merged []vlogHole
+	for _, h := range all {
+		if last := len(merged) - 1; last >= 0 && h.start <= merged[last].end {
+			if h.end > merged[last].end {
+				merged[last].end = h.end
+			}
+			continue
+		}
+		merged = append(merged, h)
+	}
+	return merged
+}
+
+// holeEnd returns the end of the hole of lf which offset is in, or 0 if there's none.
+func (lf *logFile) holeEnd(offset uint32) uint32 {
+	i := sort.Search(len(lf.holes), func(i int) bool {
+		return lf.holes[i].end > offset
+	})
+	if i < len(lf.holes) && lf.holes[i].start <= offset {
+		return lf.holes[i].end
+	}
+	return 0
+}
+
+// punchedBytes returns the size of the holes of lf.
+func (lf *logFile) punchedBytes() int64 {
+	var n int64
+	for _, h := range lf.holes {
+		n += int64(h.end - h.start)
+	}
+	return n
+}
+
+// punchStale punches holes in lf over its runs of stale entries, like the ones rewrite would
+// drop, and adds them to res. The holes are recorded before they're punched, so that the
+// iterations over lf skip them even if the DB crashes midway. It returns false if lf should be
+// rewritten instead, because it only holds stale entries, or has no runs of them long enough to
+// free disk space.
+func (vlog *valueLog) punchStale(ctx context.Context, lf *logFile,
+	res *GCResult) (bool, error) {
+
+	db := vlog.db
+	var runs []vlogHole
+	var run vlogHole
+	addRun := func() {
+		if run.end-run.start >= minHoleSize {
+			runs = append(runs, run)
+		}
+	}
+	var live int
+	_, err := lf.iterate(vlog.opt.ReadOnly, 0, func(e Entry, vp valuePointer) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		vs, err := db.get(y.KeyWithTs(y.ParseKey(e.Key), db.orc.readTs()))
+		if err != nil {
+			return err
+		}
+		if !discardEntry(e, vs, db) && sameValuePointer(vs, vp) {
+			live++
+			return nil
+		}
+		if vp.Offset != run.end {
+			addRun()
+			run.start = vp.Offset
+		}
+		run.end = vp.Offset + vp.Len
+		return nil
+	})
+	// iterate doesn't keep the identity of the errors.
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if err != nil {
+		return false, err
+	}
+	addRun()
+	if live == 0 || len(runs) == 0 {
+		return false, nil
+	}
+	// Like the rewritten files, the stale values may still be read by the open iterators.
+	if vlog.iteratorCount() > 0 {
+		return false, ErrRejected
+	}
+
+	holes := mergeHoles(lf.holes, runs)
+	if err := writeHoles(lf.path, holes); err != nil {
+		return false, err
+	}
+	lf.lock.Lock()
+	lf.holes = holes
+	lf.lock.Unlock()
+
+	var punched int64
+	for _, h := range runs {
+		if err := punchHole(lf.Fd, int64(h.start), int64(h.end-h.start)); err != nil {
+			return false, err
+		}
+		punched += int64(h.end - h.start)
+	}
+	res.FilesPunched++
+	res.BytesReclaimed += punched
+	vlog.opt.Infof("Punched %d holes of %d bytes in fid: %d, with %d live entries",
+		len(runs), punched, lf.fid, live)
+	return true, nil
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeHoles(t *testing.T) {
+	holes := mergeHoles([]vlogHole{{10, 20}, {40, 50}},
+		[]vlogHole{{20, 30}, {45, 60}, {70, 80}})
+	require.Equal(t, []vlogHole{{10, 30}, {40, 60}, {70, 80}}, holes)
+
+	lf := &logFile{holes: holes}
+	require.Equal(t, uint32(30), lf.holeEnd(10))
+	require.Equal(t, uint32(30), lf.holeEnd(29))
+	require.Zero(t, lf.holeEnd(30))
+	require.Zero(t, lf.holeEnd(5))
+	require.Equal(t, int64(50), lf.punchedBytes())
+}
+
+func TestReadWriteHoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	path := vlogFilePath(dir, 1)
+	holes, err := readHoles(path)
+	require.NoError(t, err)
+	require.Nil(t, holes)
+
+	want := []vlogHole{{20, 8 << 10}, {16 << 10, 64 << 10}}
+	require.NoError(t, writeHoles(path, want))
+	holes, err = readHoles(path)
+	require.NoError(t, err)
+	require.Equal(t, want, holes)
+
+	data, err := ioutil.ReadFile(holesFilePath(path))
+	require.NoError(t, err)
+	data[0] ^= 1
+	require.NoError(t, ioutil.WriteFile(holesFilePath(path), data, 0600))
+	_, err = readHoles(path)
+	require.Error(t, err)
+
+	require.NoError(t, removeHoles(path))
+	require.NoError(t, removeHoles(path))
+	_, err = os.Stat(holesFilePath(path))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestValueLogPunchHoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithValueLogFileSize(1 << 20).WithValueThreshold(1 << 10).
+		WithTrackVlogSpace(true).WithValueLogPunchHoles(true)
+
+	sz := 32 << 10
+	vals := make(map[int][]byte)
+	set := func(db *DB, i int) {
+		v := make([]byte, sz)
+		rand.Read(v)
+		txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), v, 0)
+		vals[i] = v
+	}
+	check := func(db *DB) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i, v := range vals {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+				require.NoError(t, err)
+				require.Equal(t, v, getItemValue(t, item))
+			}
+			return nil
+		}))
+	}
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		set(db, i)
+	}
+	// The first file holds the first keys, the overwritten ones make a run of stale entries.
+	for i := 0; i < 20; i++ {
+		set(db, i)
+	}
+	res, err := db.RunValueLogGCForSpaceAmp(context.Background(), 1.1, 0)
+	if db.vlog.noPunch {
+		require.NoError(t, db.Close())
+		t.Skip("The filesystem can't punch holes")
+	}
+	require.NoError(t, err)
+	require.Equal(t, 1, res.FilesPunched)
+	require.Zero(t, res.FilesRewritten)
+	require.Zero(t, res.EntriesMoved)
+
+	info := db.ValueLogFiles()[0]
+	require.Equal(t, uint32(1), info.Fid)
+	require.True(t, info.Punched >= int64(19*sz), "%d", info.Punched)
+	require.Zero(t, info.DiscardBytes)
+	_, err = os.Stat(holesFilePath(info.Path))
+	require.NoError(t, err)
+	check(db)
+	require.NoError(t, db.Close())
+
+	// The holes are skipped by the iterations over the file after a restart.
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	check(db)
+	info, err = db.RecomputeDiscardStats(1)
+	require.NoError(t, err)
+	require.Zero(t, info.DiscardBytes)
+	require.NotEmpty(t, db.vlog.filesMap[1].holes)
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"math"
+	"os"
+	"sync/atomic"
+)
+
+// vlogReadAhead tracks the value pointers an iterator fetches, to tell when they're close enough
+// to each other in a value log file to read the file ahead sequentially.
+type vlogReadAhead struct {
+	size uint32 // Bytes read ahead at once.
+
+	fid  uint32
+	last valuePointer
+	hits int // Number of pointers in a row close to the previous one.
+	// start and end are the region of the file fid already read ahead.
+	start, end uint32
+}
+
+// next records that vp is fetched, and returns the region of its file to read ahead, if any.
+// The region starts at vp and goes in the direction the pointers move in.
+func (ra *vlogReadAhead) next(vp valuePointer) (start, end uint32, ok bool) {
+	prev := ra.last
+	ra.last = vp
+	near := vp.Fid == ra.fid && absDiff(vp.Offset, prev.Offset) <= ra.size
+	if !near {
+		ra.fid, ra.hits, ra.start, ra.end = vp.Fid, 0, 0, 0
+		return 0, 0, false
+	}
+	// A single pair of close pointers may be a coincidence.
+	if ra.hits++; ra.hits < 2 {
+		return 0, 0, false
+	}
+	if vp.Offset >= ra.start && vp.Offset+vp.Len <= ra.end {
+		return 0, 0, false
+	}
+	start, end = vp.Offset, vp.Offset+ra.size
+	if end < start {
+		end = math.MaxUint32
+	}
+	if vp.Offset < prev.Offset {
+		start, end = 0, vp.Offset+vp.Len
+		if end > ra.size {
+			start = end - ra.size
+		}
+	}
+	ra.start, ra.end = start, end
+	return start, end, true
+}
+
+func absDiff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// readAhead asks the OS to read the region [start, end) of the value log file fid into memory,
+// without waiting for it. The region is cut to the part of the file that was written.
+func (vlog *valueLog) readAhead(fid, start, end uint32) {
+	vlog.filesLock.RLock()
+	lf, ok := vlog.filesMap[fid]
+	vlog.filesLock.RUnlock()
+	if !ok {
+		return
+	}
+	lf.lock.RLock()
+	defer lf.lock.RUnlock()
+
+	if size := atomic.LoadUint32(&lf.size); end > size {
+		end = size
+	}
+	if int64(end) > int64(len(lf.Data)) {
+		end = uint32(len(lf.Data))
+	}
+	// The region must start on a page boundary.
+	start -= start % uint32(os.Getpagesize())
+	if start >= end {
+		return
+	}
+	if err := madviseWillNeed(lf.Data[start:end]); err != nil {
+		vlog.opt.Debugf("Unable to read ahead value log file %d: %v", fid, err)
+	}
+}
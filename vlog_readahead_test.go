@@ -0,0 +1,99 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVlogReadAheadWindow(t *testing.T) {
+	ra := vlogReadAhead{size: 1000}
+	type region struct {
+		start, end uint32
+		ok         bool
+	}
+	next := func(fid, offset uint32) region {
+		start, end, ok := ra.next(valuePointer{Fid: fid, Offset: offset, Len: 100})
+		return region{start, end, ok}
+	}
+	// Three close pointers in a row start the read-ahead.
+	require.Equal(t, region{}, next(1, 0))
+	require.Equal(t, region{}, next(1, 100))
+	require.Equal(t, region{200, 1200, true}, next(1, 200))
+	// The region already read ahead isn't read again.
+	require.Equal(t, region{}, next(1, 300))
+	require.Equal(t, region{}, next(1, 1000))
+	require.Equal(t, region{1150, 2150, true}, next(1, 1150))
+
+	// A far pointer, or one in another file, starts over.
+	require.Equal(t, region{}, next(1, 50000))
+	require.Equal(t, region{}, next(2, 50100))
+	require.Equal(t, region{}, next(2, 50200))
+	require.Equal(t, region{50300, 51300, true}, next(2, 50300))
+
+	// Pointers going backwards are read ahead backwards.
+	ra = vlogReadAhead{size: 1000}
+	next(3, 5000)
+	next(3, 4900)
+	require.Equal(t, region{3900, 4900, true}, next(3, 4800))
+	ra = vlogReadAhead{size: 1000}
+	next(3, 500)
+	next(3, 400)
+	require.Equal(t, region{0, 400, true}, next(3, 300))
+}
+
+func TestIteratorValueReadAhead(t *testing.T) {
+	opt := getTestOptions("")
+	opt.ValueThreshold = 32
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		const n = 1000
+		wb := db.NewWriteBatch()
+		for i := 0; i < n; i++ {
+			val := fmt.Sprintf("value-%04d-%0100d", i, i)
+			require.NoError(t, wb.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(val)))
+		}
+		require.NoError(t, wb.Flush())
+
+		for _, reverse := range []bool{false, true} {
+			iopt := DefaultIteratorOptions
+			iopt.Reverse = reverse
+			iopt.ValueReadAhead = 4 << 10
+			require.NoError(t, db.View(func(txn *Txn) error {
+				it := txn.NewIterator(iopt)
+				defer it.Close()
+				require.NotZero(t, it.readAhead.size)
+				var count int
+				for it.Rewind(); it.Valid(); it.Next() {
+					i := count
+					if reverse {
+						i = n - 1 - count
+					}
+					item := it.Item()
+					require.Equal(t, fmt.Sprintf("key%04d", i), string(item.Key()))
+					require.Equal(t, fmt.Sprintf("value-%04d-%0100d", i, i),
+						string(getItemValue(t, item)))
+					count++
+				}
+				require.Equal(t, n, count)
+				return nil
+			}))
+		}
+	})
+}
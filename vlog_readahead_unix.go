@@ -0,0 +1,26 @@
+// +build !windows,!plan9
+
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import "golang.org/x/sys/unix"
+
+// madviseWillNeed tells the OS that the mmapped region b will be read soon.
+func madviseWillNeed(b []byte) error {
+	return unix.Madvise(b, unix.MADV_WILLNEED)
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/v3/y"
+	"github.com/pkg/errors"
+)
+
+// trackVlogSpace tells if the writes must look up the values they overwrite. In managed mode, the
+// values aren't written to the value log.
+func (db *DB) trackVlogSpace() bool {
+	return db.opt.TrackVlogSpace && db.opt.NumVersionsToKeep == 1 && !db.opt.InMemory &&
+		!db.opt.managedTxns
+}
+
+// trackDeadValues counts the values in the value log of the latest versions of the keys written
+// by b as dead, before b is written to the memtable.
+func (db *DB) trackDeadValues(b *request) {
+	tables, decr := db.getMemTables()
+	defer decr()
+
+	seen := make(map[string]struct{}, len(b.Entries))
+	dead := make(map[uint32]int64)
+	for _, e := range b.Entries {
+		// Merge operands don't replace the earlier versions.
+		if e.meta&(bitMergeEntry|bitFinTxn) > 0 {
+			continue
+		}
+		key := y.ParseKey(e.Key)
+		if _, ok := seen[string(key)]; ok {
+			continue
+		}
+		seen[string(key)] = struct{}{}
+
+		search := y.KeyWithTs(key, math.MaxUint64)
+		var vs y.ValueStruct
+		for _, mt := range tables {
+			if mvs := mt.sl.Get(search); mvs.Version > vs.Version {
+				vs = mvs
+			}
+		}
+		// The memtables hold newer versions than the tables.
+		if vs.Version == 0 {
+			var err error
+			if vs, err = db.lc.get(search, vs, 0); err != nil {
+				continue
+			}
+		}
+		if vs.Meta&bitValuePointer == 0 {
+			continue
+		}
+		var vp valuePointer
+		vp.Decode(vs.Value)
+		if vp.isBlob() {
+			continue
+		}
+		dead[vp.Fid] += int64(vp.Len)
+	}
+	if len(dead) == 0 {
+		return
+	}
+	db.vlog.deadLock.Lock()
+	for fid, n := range dead {
+		db.vlog.deadBytes[fid] += n
+	}
+	db.vlog.deadLock.Unlock()
+}
+
+// vlogSpace returns the disk space used by the value log files, and how much of it is dead.
+func (db *DB) vlogSpace() (total, dead int64) {
+	for _, info := range db.vlogDeadBytes() {
+		total += info.Size - info.Punched
+		dead += info.DiscardBytes
+	}
+	return total, dead
+}
+
+// vlogDeadBytes returns the value log files, with their DiscardBytes set to their dead bytes: the
+// larger of their discard stats and of the bytes tracked by trackDeadValues, as both count the
+// same values once the compactions drop them. All the bytes of the deleted files are dead. The
+// holes punched in the files aren't counted.
+func (db *DB) vlogDeadBytes() []VlogFileInfo {
+	// ValueLogFiles holds filesLock, which is taken before deadLock when deleting a file.
+	infos := db.ValueLogFiles()
+
+	db.vlog.deadLock.Lock()
+	defer db.vlog.deadLock.Unlock()
+	for i := range infos {
+		info := &infos[i]
+		if tracked := db.vlog.deadBytes[info.Fid]; tracked > info.DiscardBytes {
+			info.DiscardBytes = tracked
+		}
+		if used := info.Size - info.Punched; info.Deleted || info.DiscardBytes > used {
+			info.DiscardBytes = used
+		}
+	}
+	return infos
+}
+
+// spaceAmp returns the space amplification of total bytes, of which dead are dead. It's 1 if
+// total is 0, and +Inf if all of them are dead.
+func spaceAmp(total, dead int64) float64 {
+	switch live := total - dead; {
+	case total == 0:
+		return 1
+	case live <= 0:
+		return math.Inf(1)
+	default:
+		return float64(total) / float64(live)
+	}
+}
+
+// RunValueLogGCForSpaceAmp runs the value log GC until the space amplification of the value log,
+// as reported by DB.Metrics, is at most target. Instead of only rewriting a file with enough to
+// discard like RunValueLogGC, it rewrites the file with the most dead bytes, one after the other.
+// The files already rewritten, but not yet deleted because iterators may read them, aren't
+// counted. target must be at least 1.
+//
+// The GC stops once maxBytes bytes of files were rewritten, if maxBytes is positive, with
+// ErrGCBudgetExhausted, and once ctx is done, with ctx.Err(), like RunValueLogGCWithContext. It
+// returns ErrNoRewrite if no file has dead bytes left to reach target, which happens when they're
+// only accounted for by the compactions, unless Options.TrackVlogSpace is set. It returns what
+// the runs of the GC did in any case.
+func (db *DB) RunValueLogGCForSpaceAmp(ctx context.Context, target float64,
+	maxBytes int64) (GCResult, error) {
+
+	var res GCResult
+	if db.opt.InMemory {
+		return res, ErrGCInMemoryMode
+	}
+	if target < 1 {
+		return res, errors.Wrapf(ErrInvalidRequest, "target space amplification %f is below 1",
+			target)
+	}
+	var rewrittenBytes int64
+	for {
+		infos := db.vlogDeadBytes()
+		var total, dead int64
+		var pick *VlogFileInfo
+		for i := range infos {
+			info := &infos[i]
+			if info.Deleted {
+				continue
+			}
+			total += info.Size - info.Punched
+			dead += info.DiscardBytes
+			if !info.Active && info.DiscardBytes > 0 &&
+				(pick == nil || info.DiscardBytes > pick.DiscardBytes) {
+				pick = info
+			}
+		}
+		if spaceAmp(total, dead) <= target {
+			return res, nil
+		}
+		if pick == nil {
+			return res, ErrNoRewrite
+		}
+		if maxBytes > 0 && rewrittenBytes+pick.Size > maxBytes {
+			return res, ErrGCBudgetExhausted
+		}
+
+		fid := pick.Fid
+		run, err := db.vlog.runGCWith(ctx, func() *logFile {
+			db.vlog.filesLock.RLock()
+			defer db.vlog.filesLock.RUnlock()
+			return db.vlog.filesMap[fid]
+		})
+		res.add(run)
+		switch err {
+		case nil:
+			atomic.AddInt64(&db.metrics.vlogGCRuns, 1)
+		case ErrRejected, ctx.Err():
+			return res, err
+		default:
+			atomic.AddInt64(&db.metrics.vlogGCErrors, 1)
+			return res, err
+		}
+		rewrittenBytes += pick.Size
+	}
+}
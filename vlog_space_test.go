@@ -0,0 +1,75 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpaceAmp(t *testing.T) {
+	require.Equal(t, 1.0, spaceAmp(0, 0))
+	require.Equal(t, 2.0, spaceAmp(100, 50))
+	require.True(t, math.IsInf(spaceAmp(100, 100), 1))
+}
+
+func TestRunValueLogGCForSpaceAmp(t *testing.T) {
+	opt := getTestOptions("").WithValueLogFileSize(1 << 20).WithValueThreshold(1 << 10).
+		WithTrackVlogSpace(true)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		sz := 32 << 10
+		set := func(i int) {
+			v := make([]byte, sz)
+			rand.Read(v)
+			txnSet(t, db, []byte(fmt.Sprintf("key%d", i)), v, 0)
+		}
+		for i := 0; i < 100; i++ {
+			set(i)
+		}
+		for i := 0; i < 60; i++ {
+			set(i)
+		}
+		require.True(t, db.Metrics().VlogSpaceAmp > 1.5)
+
+		_, err := db.RunValueLogGCForSpaceAmp(context.Background(), 0.5, 0)
+		require.Equal(t, ErrInvalidRequest, errors.Cause(err))
+		res, err := db.RunValueLogGCForSpaceAmp(context.Background(), 1.1, 1)
+		require.Equal(t, ErrGCBudgetExhausted, err)
+		require.Zero(t, res.FilesRewritten)
+
+		res, err = db.RunValueLogGCForSpaceAmp(context.Background(), 1.3, 0)
+		require.NoError(t, err)
+		require.True(t, res.FilesRewritten > 0)
+		require.True(t, res.BytesReclaimed > res.BytesMoved)
+		require.True(t, db.Metrics().VlogSpaceAmp <= 1.3, "%f", db.Metrics().VlogSpaceAmp)
+
+		for i := 0; i < 100; i++ {
+			require.NoError(t, db.View(func(txn *Txn) error {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%d", i)))
+				require.NoError(t, err)
+				require.Len(t, getItemValue(t, item), sz)
+				return nil
+			}))
+		}
+	})
+}
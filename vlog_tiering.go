@@ -0,0 +1,232 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
+)
+
+// isCold tells if lf was moved to the cold directory.
+func (vlog *valueLog) isCold(lf *logFile) bool {
+	coldDir := vlog.opt.ValueLogTiering.ColdDir
+	return coldDir != "" && filepath.Dir(lf.path) == filepath.Clean(coldDir)
+}
+
+// runVlogTiering moves the cold value log files every Options.ValueLogTiering.Interval, until c
+// is closed. The ticks at which the files can't be moved, e.g. while the DB is frozen, are
+// skipped.
+func (db *DB) runVlogTiering(c *z.Closer) {
+	defer c.Done()
+	ticker := time.NewTicker(db.opt.ValueLogTiering.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.HasBeenClosed():
+			return
+		case <-ticker.C:
+		}
+		if _, err := db.MoveColdValueLogFiles(); err != nil && err != ErrRejected {
+			db.opt.Warningf("While moving cold value log files: %v", err)
+		}
+	}
+}
+
+// MoveColdValueLogFiles moves the value log files which are cold according to
+// Options.ValueLogTiering to its ColdDir right away, and returns the number of files moved.
+// It returns ErrRejected if the value log GC is running, as it rewrites the files, if there are
+// active iterators or backups, which read the files, or if the DB is frozen. Freeze waits for the
+// files being moved.
+func (db *DB) MoveColdValueLogFiles() (int, error) {
+	if db.opt.InMemory || db.opt.ReadOnly || db.opt.ValueLogTiering.ColdDir == "" {
+		return 0, errors.Wrapf(ErrInvalidRequest,
+			"moving value log files requires a writable DB with ValueLogTiering.ColdDir set")
+	}
+	db.freezeLock.Lock()
+	defer db.freezeLock.Unlock()
+	if db.thaw != nil {
+		return 0, ErrRejected
+	}
+	vlog := &db.vlog
+	select {
+	case vlog.garbageCh <- struct{}{}:
+		defer func() {
+			<-vlog.garbageCh
+		}()
+	default:
+		return 0, ErrRejected
+	}
+	if vlog.iteratorCount() > 0 {
+		return 0, ErrRejected
+	}
+
+	lfs, err := vlog.coldFiles(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	for i, lf := range lfs {
+		if err := vlog.moveToCold(lf); err == ErrRejected {
+			return i, err
+		} else if err != nil {
+			return i, errors.Wrapf(err, "while moving value log file %d", lf.fid)
+		}
+	}
+	return len(lfs), nil
+}
+
+// coldFiles returns the files of the value directory which are cold as of now.
+func (vlog *valueLog) coldFiles(now time.Time) ([]*logFile, error) {
+	tiering := vlog.opt.ValueLogTiering
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+
+	deleted := make(map[uint32]bool)
+	for _, fid := range vlog.filesToBeDeleted {
+		deleted[fid] = true
+	}
+	maxFid := atomic.LoadUint32(&vlog.maxFid)
+	hotBytes := int64(vlog.woffset())
+	var hot []*logFile
+	for fid, lf := range vlog.filesMap {
+		if fid != maxFid && !deleted[fid] && !vlog.isCold(lf) {
+			hot = append(hot, lf)
+		}
+	}
+	// The newest files are kept first.
+	sort.Slice(hot, func(i, j int) bool {
+		return hot[i].fid > hot[j].fid
+	})
+	var cold []*logFile
+	for _, lf := range hot {
+		hotBytes += int64(atomic.LoadUint32(&lf.size))
+		if tiering.HotBytes > 0 && hotBytes > tiering.HotBytes {
+			cold = append(cold, lf)
+			continue
+		}
+		if tiering.ColdAfter > 0 {
+			fi, err := os.Stat(lf.path)
+			if err != nil {
+				return nil, err
+			}
+			if now.Sub(fi.ModTime()) > tiering.ColdAfter {
+				cold = append(cold, lf)
+			}
+		}
+	}
+	return cold, nil
+}
+
+// moveToCold copies lf to the cold directory, maps the copy in place of lf, and deletes lf. The
+// file isn't written to anymore, and the GC, which rewrites and deletes files, isn't running. It
+// returns ErrRejected if an iterator was created in the meantime, as it may read lf by its path.
+func (vlog *valueLog) moveToCold(lf *logFile) error {
+	coldDir := vlog.opt.ValueLogTiering.ColdDir
+	coldPath := vlogFilePath(coldDir, lf.fid)
+	tmpPath := coldPath + ".tmp"
+
+	lf.lock.RLock()
+	holes := lf.holes
+	var err error
+	// The holes are listed first, so that the copy is never without them. A list left by a failed
+	// move is removed, so that the copy doesn't get holes it doesn't have.
+	if len(holes) > 0 {
+		err = writeHoles(coldPath, holes)
+	} else {
+		err = removeHoles(coldPath)
+	}
+	if err == nil {
+		err = writeSyncedFile(tmpPath, lf.Data[:atomic.LoadUint32(&lf.size)])
+	}
+	lf.lock.RUnlock()
+	if err != nil {
+		os.Remove(tmpPath)
+		removeHoles(coldPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, coldPath); err != nil {
+		return err
+	}
+	if err := syncDir(coldDir); err != nil {
+		return err
+	}
+
+	// Swap the files while no value is read from lf. The iterators are counted before the files
+	// are looked up, so none can pick lf up until it's swapped.
+	vlog.filesLock.Lock()
+	defer vlog.filesLock.Unlock()
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+	if vlog.iteratorCount() > 0 {
+		os.Remove(coldPath)
+		removeHoles(coldPath)
+		return ErrRejected
+	}
+	hotPath := lf.path
+	if err := lf.MmapFile.Close(-1); err != nil {
+		return err
+	}
+	if err := lf.open(coldPath, os.O_RDWR, 2*vlog.opt.ValueLogFileSize); err != nil {
+		// Map the hot file back, it's still there.
+		if herr := lf.open(hotPath, os.O_RDWR, 2*vlog.opt.ValueLogFileSize); herr != nil {
+			return errors.Wrapf(herr, "while reopening %s after failing to open %s: %v",
+				hotPath, coldPath, err)
+		}
+		return err
+	}
+	lf.path = coldPath
+	if err := os.Remove(hotPath); err != nil {
+		return err
+	}
+	if err := removeHoles(hotPath); err != nil {
+		return err
+	}
+	// The holes were copied as zeros.
+	for _, h := range holes {
+		err := punchHole(lf.Fd, int64(h.start), int64(h.end-h.start))
+		if err == errPunchHoleUnsupported {
+			break
+		} else if err != nil {
+			vlog.opt.Warningf("While punching the holes of %s: %v", coldPath, err)
+			break
+		}
+	}
+	vlog.opt.Infof("Moved value log file %d to %s", lf.fid, coldPath)
+	return syncDir(vlog.dirPath)
+}
+
+// writeSyncedFile writes data to a new file at path, and syncs it.
+func writeSyncedFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMoveColdValueLogFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	coldDir := filepath.Join(dir, "cold")
+
+	opt := getTestOptions(dir).WithValueLogFileSize(1 << 20).WithValueThreshold(1 << 10).
+		WithValueLogTiering(VlogTiering{ColdDir: coldDir, HotBytes: 2 << 20, Interval: time.Hour})
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	vals := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		vals[key] = make([]byte, 32<<10)
+		rand.Read(vals[key])
+		txnSet(t, db, []byte(key), vals[key], 0)
+	}
+	check := func(db *DB) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for key, val := range vals {
+				item, err := txn.Get([]byte(key))
+				require.NoError(t, err)
+				require.True(t, bytes.Equal(val, getItemValue(t, item)), key)
+			}
+			return nil
+		}))
+	}
+
+	// The files aren't moved while they're read by iterators, or while the DB is frozen.
+	txn := db.NewTransaction(false)
+	itr := txn.NewIterator(DefaultIteratorOptions)
+	_, err = db.MoveColdValueLogFiles()
+	require.Equal(t, ErrRejected, err)
+	itr.Close()
+	txn.Discard()
+	require.NoError(t, db.Freeze())
+	_, err = db.MoveColdValueLogFiles()
+	require.Equal(t, ErrRejected, err)
+	db.Thaw()
+
+	n, err := db.MoveColdValueLogFiles()
+	require.NoError(t, err)
+	require.True(t, n > 0)
+	var cold int
+	for _, info := range db.ValueLogFiles() {
+		if !info.Cold {
+			continue
+		}
+		cold++
+		require.False(t, info.Active)
+		require.Equal(t, coldDir, filepath.Dir(info.Path))
+		_, err := os.Stat(vlogFilePath(dir, info.Fid))
+		require.True(t, os.IsNotExist(err))
+	}
+	require.Equal(t, n, cold)
+	check(db)
+
+	// The files are already cold.
+	n, err = db.MoveColdValueLogFiles()
+	require.NoError(t, err)
+	require.Zero(t, n)
+	var hotFid uint32
+	for _, info := range db.ValueLogFiles() {
+		if !info.Cold {
+			hotFid = info.Fid
+		}
+	}
+	require.NoError(t, db.Close())
+
+	// Leave the holes and the partial copy of a hot file in the cold directory, as if the DB
+	// crashed while moving it. They are removed by Open.
+	leftovers := []string{
+		holesFilePath(vlogFilePath(coldDir, hotFid)),
+		vlogFilePath(coldDir, hotFid) + ".tmp",
+	}
+	for _, path := range leftovers {
+		require.NoError(t, ioutil.WriteFile(path, []byte("leftover"), 0600))
+	}
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+	for _, path := range leftovers {
+		_, err := os.Stat(path)
+		require.True(t, os.IsNotExist(err), path)
+	}
+	check(db)
+	var reopened int
+	for _, info := range db.ValueLogFiles() {
+		if info.Cold {
+			reopened++
+		}
+	}
+	require.Equal(t, cold, reopened)
+}
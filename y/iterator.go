@@ -21,13 +21,18 @@ import (
 	"encoding/binary"
 )
 
+// BitUserMetaExt is set in the encoded Meta of the values which carry a UserMetaExt. Badger never
+// sets it in the Meta of a ValueStruct, as the presence of UserMetaExt is given by its length.
+const BitUserMetaExt byte = 1 << 4
+
 // ValueStruct represents the value info that can be associated with a key, but also the internal
 // Meta field.
 type ValueStruct struct {
-	Meta      byte
-	UserMeta  byte
-	ExpiresAt uint64
-	Value     []byte
+	Meta        byte
+	UserMeta    byte
+	UserMetaExt []byte // Extended user metadata, of at most 255 bytes.
+	ExpiresAt   uint64
+	Value       []byte
 
 	Version uint64 // This field is not serialized. Only for internal usage.
 }
@@ -47,37 +52,77 @@ func sizeVarint(x uint64) (n int) {
 func (v *ValueStruct) EncodedSize() uint32 {
 	sz := len(v.Value) + 2 // meta, usermeta.
 	enc := sizeVarint(v.ExpiresAt)
+	if v.hasUserMetaExt() {
+		sz += 1 + len(v.UserMetaExt) // length, usermetaext.
+	}
 	return uint32(sz + enc)
 }
 
+// hasUserMetaExt tells if the encoding of v carries a UserMetaExt. A Meta with BitUserMetaExt set
+// is encoded with an empty one, so that it's decoded unchanged.
+func (v *ValueStruct) hasUserMetaExt() bool {
+	return len(v.UserMetaExt) > 0 || v.Meta&BitUserMetaExt > 0
+}
+
+// encodedMeta returns the Meta to encode.
+func (v *ValueStruct) encodedMeta() byte {
+	if v.hasUserMetaExt() {
+		return v.Meta | BitUserMetaExt
+	}
+	return v.Meta
+}
+
 // Decode uses the length of the slice to infer the length of the Value field.
+// The encoded value looks like
+// +------+----------+-----------+-------------+-------+
+// | Meta | UserMeta | ExpiresAt | UserMetaExt | Value |
+// +------+----------+-----------+-------------+-------+
+// where UserMetaExt, prefixed by its length byte, is only present if BitUserMetaExt is set in Meta.
 func (v *ValueStruct) Decode(b []byte) {
 	v.Meta = b[0]
 	v.UserMeta = b[1]
 	var sz int
 	v.ExpiresAt, sz = binary.Uvarint(b[2:])
-	v.Value = b[2+sz:]
+	b = b[2+sz:]
+	v.UserMetaExt = nil
+	if v.Meta&BitUserMetaExt > 0 {
+		n := int(b[0])
+		if n > 0 {
+			v.Meta &^= BitUserMetaExt
+			v.UserMetaExt = b[1 : 1+n]
+		}
+		b = b[1+n:]
+	}
+	v.Value = b
 }
 
 // Encode expects a slice of length at least v.EncodedSize().
 func (v *ValueStruct) Encode(b []byte) uint32 {
-	b[0] = v.Meta
+	b[0] = v.encodedMeta()
 	b[1] = v.UserMeta
-	sz := binary.PutUvarint(b[2:], v.ExpiresAt)
-	n := copy(b[2+sz:], v.Value)
-	return uint32(2 + sz + n)
+	sz := 2 + binary.PutUvarint(b[2:], v.ExpiresAt)
+	if v.hasUserMetaExt() {
+		b[sz] = byte(len(v.UserMetaExt))
+		sz += 1 + copy(b[sz+1:], v.UserMetaExt)
+	}
+	n := copy(b[sz:], v.Value)
+	return uint32(sz + n)
 }
 
 // EncodeTo should be kept in sync with the Encode function above. The reason
 // this function exists is to avoid creating byte arrays per key-value pair in
 // table/builder.go.
 func (v *ValueStruct) EncodeTo(buf *bytes.Buffer) {
-	buf.WriteByte(v.Meta)
+	buf.WriteByte(v.encodedMeta())
 	buf.WriteByte(v.UserMeta)
 	var enc [binary.MaxVarintLen64]byte
 	sz := binary.PutUvarint(enc[:], v.ExpiresAt)
 
 	buf.Write(enc[:sz])
+	if v.hasUserMetaExt() {
+		buf.WriteByte(byte(len(v.UserMetaExt)))
+		buf.Write(v.UserMetaExt)
+	}
 	buf.Write(v.Value)
 }
 
@@ -279,6 +279,25 @@ func TestEncodedSize(t *testing.T) {
 	require.Equal(t, valBufSize+uint32(2)+expVarintSize, valStruct.EncodedSize())
 }
 
+func TestValueStructEncode(t *testing.T) {
+	for _, v := range []ValueStruct{
+		{Meta: 2, UserMeta: 7, ExpiresAt: 300, Value: []byte("val")},
+		{Meta: 2, UserMeta: 7, UserMetaExt: []byte("ext"), Value: []byte("val")},
+		// A Meta with BitUserMetaExt set is kept as is.
+		{Meta: 55, Value: []byte("val")},
+	} {
+		buf := make([]byte, v.EncodedSize())
+		require.Equal(t, v.EncodedSize(), v.Encode(buf))
+		var bb bytes.Buffer
+		v.EncodeTo(&bb)
+		require.Equal(t, buf, bb.Bytes())
+
+		var got ValueStruct
+		got.Decode(buf)
+		require.Equal(t, v, got)
+	}
+}
+
 func TestAllocatorReuse(t *testing.T) {
 	a := z.NewAllocator(1024, "test")
 	defer a.Release()